@@ -0,0 +1,152 @@
+package sshtun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/sa6mwa/sshtun/pkg/tun"
+)
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598), not
+// covered by net.IP.IsPrivate but common on tunnels.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0).To4(), Mask: net.CIDRMask(10, 32)}
+
+// ValidateAddressing checks that the local and remote networks of a
+// tun tunnel describe the same subnet with different host addresses,
+// that neither is the network or broadcast address of it. A /31 pair
+// (RFC 3021) is a subnet without network and broadcast addresses, an
+// IPv4 /32 on a tun device is configured with the other end as peer
+// address and needs no shared subnet. Other single addresses (/128, or
+// a /32 on a tap device) would leave the other end unreachable. Unusual but working setups (different prefix
+// lengths, public addresses) are returned as warnings. Every message
+// names the tunnel. Bridged ends and networks that do not parse (see
+// Validate) are not checked. Returns an errors.Join of errors wrapping
+// ErrInvalidConfig or nil.
+func (s *SSHTUN) ValidateAddressing() (warnings []string, err error) {
+	if s.forwarding() || s.bridging() {
+		return nil, nil
+	}
+	var errs []error
+	invalid := func(format string, a ...any) {
+		errs = append(errs, fmt.Errorf("%w: tunnel %q: %s", ErrInvalidConfig, s.Name, fmt.Sprintf(format, a...)))
+	}
+	warn := func(format string, a ...any) {
+		warnings = append(warnings, fmt.Sprintf("tunnel %q: %s", s.Name, fmt.Sprintf(format, a...)))
+	}
+	for _, pair := range [][4]string{
+		{"local_network", s.LocalNetwork, "remote_network", s.RemoteNetwork},
+		{"local_network6", s.LocalNetwork6, "remote_network6", s.RemoteNetwork6},
+	} {
+		localIP, localNet, err := net.ParseCIDR(pair[1])
+		if err != nil {
+			continue
+		}
+		remoteIP, remoteNet, err := net.ParseCIDR(pair[3])
+		if err != nil {
+			continue
+		}
+		if (localIP.To4() == nil) != (remoteIP.To4() == nil) {
+			continue
+		}
+		peer := false
+		for _, side := range []struct {
+			field   string
+			address string
+			ip      net.IP
+			network *net.IPNet
+		}{
+			{pair[0], pair[1], localIP, localNet},
+			{pair[2], pair[3], remoteIP, remoteNet},
+		} {
+			ones, bits := side.network.Mask.Size()
+			switch {
+			case ones == bits && bits == 32 && !s.tap():
+				peer = true
+			case ones == bits:
+				peer = true
+				invalid("%s %s is a single address, use a subnet shared with %s (e.g a /%d)", side.field, side.address, otherField(pair, side.field), bits-2)
+			case bits == 32 && ones < 31 && side.ip.Equal(side.network.IP):
+				invalid("%s %s is the network address of %s", side.field, side.address, side.network)
+			case bits == 32 && ones < 31 && side.ip.Equal(broadcast(side.network)):
+				invalid("%s %s is the broadcast address of %s", side.field, side.address, side.network)
+			}
+			if !side.ip.IsPrivate() && !sharedAddressSpace.Contains(side.ip) && !side.ip.IsLinkLocalUnicast() {
+				warn("%s %s is not a private address, it may clash with a host on the internet", side.field, side.address)
+			}
+		}
+		if localIP.Equal(remoteIP) {
+			invalid("%s and %s have the same address %s", pair[0], pair[2], localIP)
+			continue
+		}
+		if peer {
+			continue
+		}
+		if !localNet.Contains(remoteIP) && !remoteNet.Contains(localIP) {
+			invalid("%s %s and %s %s are not in the same subnet, neither end can reach the other", pair[0], pair[1], pair[2], pair[3])
+			continue
+		}
+		localOnes, _ := localNet.Mask.Size()
+		remoteOnes, _ := remoteNet.Mask.Size()
+		if localOnes != remoteOnes {
+			warn("%s %s and %s %s have different prefix lengths", pair[0], pair[1], pair[2], pair[3])
+		}
+	}
+	return warnings, errors.Join(errs...)
+}
+
+// otherField returns the field of pair (local, value, remote, value)
+// that is not field.
+func otherField(pair [4]string, field string) string {
+	if field == pair[0] {
+		return pair[2]
+	}
+	return pair[0]
+}
+
+// broadcast returns the broadcast address of the IPv4 network.
+func broadcast(network *net.IPNet) net.IP {
+	ip := make(net.IP, len(network.IP))
+	for i := range network.IP {
+		ip[i] = network.IP[i] | ^network.Mask[i]
+	}
+	return ip
+}
+
+// hostOf returns the address of network (172.18.0.1 for
+// 172.18.0.1/24), empty if it does not parse.
+func hostOf(network string) string {
+	ip, _, err := net.ParseCIDR(network)
+	if err != nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// localPeer returns the peer address of the local tun device, the
+// remote address if local_network is point-to-point (/31 or /32) and
+// the device a tun device.
+func (s *SSHTUN) localPeer() string {
+	if s.tap() || !tun.PointToPoint(s.LocalNetwork) {
+		return ""
+	}
+	return hostOf(s.RemoteNetwork)
+}
+
+// remotePeer returns the peer address of the remote tun device, the
+// local address if remote_network is point-to-point (/31 or /32) and
+// the device a tun device.
+func (s *SSHTUN) remotePeer() string {
+	if s.tap() || !tun.PointToPoint(s.RemoteNetwork) {
+		return ""
+	}
+	return hostOf(s.LocalNetwork)
+}
+
+// warnAddressing logs the warnings of ValidateAddressing.
+func (s *SSHTUN) warnAddressing() {
+	warnings, _ := s.ValidateAddressing()
+	for _, warning := range warnings {
+		s.log().Warn(warning, "name", s.Name, "remote", s.Remote, "local_net", s.LocalNetwork, "remote_net", s.RemoteNetwork)
+	}
+}
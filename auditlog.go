@@ -0,0 +1,227 @@
+package sshtun
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// DEFAULT_AUDIT_LOG_MAX_SIZE is the size in bytes at which the
+	// audit log is rotated unless audit_log_max_size is set.
+	DEFAULT_AUDIT_LOG_MAX_SIZE int64 = 10 << 20
+
+	AUDIT_CONNECTED         string = "connected"
+	AUDIT_DISCONNECTED      string = "disconnected"
+	AUDIT_AUTH_FAILURE      string = "auth-failure"
+	AUDIT_HOST_KEY_MISMATCH string = "host-key-mismatch"
+
+	// Reasons of a disconnected record besides the class of the error
+	// (see ErrorClass).
+	AUDIT_REASON_CLOSED  string = "closed"
+	AUDIT_REASON_DROPPED string = "dropped"
+)
+
+var (
+	ErrAuditLog error = errors.New("audit log")
+)
+
+// AuditRecord is one line of the audit log (see Tunnels.AuditLog): a
+// tunnel connected, disconnected (Reason is AUDIT_REASON_CLOSED,
+// AUDIT_REASON_DROPPED or the class of the error), failed to
+// authenticate or was refused because the host key of the remote did
+// not match.
+type AuditRecord struct {
+	Time          time.Time  `json:"time"`
+	Event         string     `json:"event"`
+	Tunnel        string     `json:"tunnel"`
+	Remote        string     `json:"remote"`
+	RemoteUser    string     `json:"remote_user"`
+	LocalAddr     string     `json:"local_addr,omitempty"`
+	RemoteAddr    string     `json:"remote_addr,omitempty"`
+	LocalNetwork  string     `json:"local_network,omitempty"`
+	RemoteNetwork string     `json:"remote_network,omitempty"`
+	LocalTun      string     `json:"local_tun,omitempty"`
+	ConnectedAt   *time.Time `json:"connected_at,omitempty"`
+	Uptime        Duration   `json:"uptime,omitempty"`
+	Reason        string     `json:"reason,omitempty"`
+	Error         string     `json:"error,omitempty"`
+	Pid           int        `json:"pid"`
+}
+
+// auditLog appends AuditRecords as json lines to a file, syncing each
+// record to disk. When the file would grow beyond maxSize it is
+// renamed with the UTC time appended and a new file is started,
+// rotated files are never removed.
+type auditLog struct {
+	mutex   sync.Mutex
+	path    string
+	maxSize int64
+	file    *os.File
+	size    int64
+}
+
+// openAuditLog opens (or creates, mode 0600) the audit log at pth for
+// appending.
+func openAuditLog(pth string, maxSize int64) (*auditLog, error) {
+	if maxSize <= 0 {
+		maxSize = DEFAULT_AUDIT_LOG_MAX_SIZE
+	}
+	a := &auditLog{path: pth, maxSize: maxSize}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrAuditLog, err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("%w: %w", ErrAuditLog, err)
+	}
+	a.file, a.size = f, fi.Size()
+	return nil
+}
+
+// write appends r as a json line and syncs it, rotating the file
+// first if the line would not fit. If rotating fails the line is
+// written to the current file anyway.
+func (a *auditLog) write(r AuditRecord) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	var rerr error
+	if a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		rerr = a.rotate()
+	}
+	if a.file == nil {
+		return errors.Join(rerr, fmt.Errorf("%w: %s is closed", ErrAuditLog, a.path))
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err == nil {
+		err = a.file.Sync()
+	}
+	if err != nil {
+		err = fmt.Errorf("%w: %w", ErrAuditLog, err)
+	}
+	return errors.Join(rerr, err)
+}
+
+// rotate renames the file to its path with the UTC time appended and
+// opens a new one.
+func (a *auditLog) rotate() error {
+	rotated := a.path + "." + time.Now().UTC().Format("20060102T150405.000000000Z")
+	if err := os.Rename(a.path, rotated); err != nil {
+		return fmt.Errorf("%w: unable to rotate: %w", ErrAuditLog, err)
+	}
+	a.file.Close()
+	a.file = nil
+	return a.open()
+}
+
+// Close closes the audit log file.
+func (a *auditLog) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+// openAuditLog opens AuditLog (if set) and makes every tunnel write
+// to it, called by OpenAll and OpenOnce. The returned func closes it.
+func (t *Tunnels) openAuditLog() (func(), error) {
+	if t.AuditLog == "" {
+		return func() {}, nil
+	}
+	pth, err := ResolveTilde(t.AuditLog)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrAuditLog, err)
+	}
+	a, err := openAuditLog(pth, t.AuditLogMaxSize)
+	if err != nil {
+		return nil, err
+	}
+	t.mutex.Lock()
+	t.audit = a
+	for _, tunnel := range t.Tunnels {
+		tunnel.audit.Store(a)
+	}
+	t.mutex.Unlock()
+	return func() {
+		t.mutex.Lock()
+		t.audit = nil
+		for _, tunnel := range t.Tunnels {
+			tunnel.audit.CompareAndSwap(a, nil)
+		}
+		t.mutex.Unlock()
+		a.Close()
+	}, nil
+}
+
+// auditRecord writes a record of event to the audit log of s, if any,
+// regardless of the log level. err is the error of a failure or
+// disconnect, nil if closed.
+func (s *SSHTUN) auditRecord(event string, err error) {
+	a := s.audit.Load()
+	if a == nil {
+		return
+	}
+	r := AuditRecord{
+		Time:          time.Now(),
+		Event:         event,
+		Tunnel:        s.Name,
+		Remote:        s.Remote,
+		RemoteUser:    s.RemoteUser,
+		LocalNetwork:  s.LocalNetwork,
+		RemoteNetwork: s.RemoteNetwork,
+		Pid:           os.Getpid(),
+	}
+	if !s.forwarding() {
+		r.LocalTun = s.LocalTunDevice
+	}
+	// The addresses of a failed handshake are not known, those of the
+	// last connection may be stale.
+	switch event {
+	case AUDIT_CONNECTED:
+		r.LocalAddr, r.RemoteAddr = s.localAddr, s.remoteAddr
+		connectedAt := time.Unix(0, s.upSince.Load())
+		r.ConnectedAt = &connectedAt
+	case AUDIT_DISCONNECTED:
+		r.LocalAddr, r.RemoteAddr = s.localAddr, s.remoteAddr
+		if since := s.lastUpSince.Load(); since != 0 {
+			connectedAt := time.Unix(0, since)
+			r.ConnectedAt = &connectedAt
+		}
+		r.Uptime = Duration(s.lastUptime())
+		r.Reason = AUDIT_REASON_CLOSED
+		if err != nil {
+			r.Reason = AUDIT_REASON_DROPPED
+			if class := ErrorClass(err); class != "" {
+				r.Reason = class
+			}
+		}
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if werr := a.write(r); werr != nil {
+		s.log().Error("Unable to write audit log", "name", s.Name, "audit_log", a.path, "event", event, "error", werr)
+	}
+}
@@ -0,0 +1,133 @@
+package sshtun
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sa6mwa/sshtun/pkg/sshtest"
+)
+
+// readAudit returns the records of the audit log at pth.
+func readAudit(t *testing.T, pth string) []AuditRecord {
+	t.Helper()
+	f, err := os.Open(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []AuditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("%s: %v", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestAuditLog(t *testing.T) {
+	privateKey, _, err := sshtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, err := sshtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyFile, privateKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	audit := filepath.Join(dir, "audit.jsonl")
+
+	refusing, err := sshtest.NewHoneyPot(sshtest.WithAuthorizedKeys(otherKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refusing.Close()
+	s := NewSecureShellTunneler(nil)
+	s.Name = "audited"
+	s.Type = TYPE_LOCAL_FORWARD
+	s.Enable = true
+	s.Remote = refusing.Addr()
+	s.RemoteUser = "root"
+	s.PrivateKeyFiles = PrivateKeyFiles{keyFile}
+	s.KeepaliveInterval = 0
+	s.Forwards = []*Forward{{Listen: freePort(t), Target: echoServer(t)}}
+	tunnels := &Tunnels{Tunnels: []*SSHTUN{s}, AuditLog: audit}
+	// Records are written with nothing logged, like -level OFF.
+	tunnels.SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err := tunnels.OpenOnce(context.Background()); ErrorClass(err) != CLASS_AUTH {
+		t.Fatalf("expected an auth failure, got %v", err)
+	}
+
+	hp, err := sshtest.NewHoneyPot(sshtest.WithPortForwarding(), sshtest.WithCloseTimeout(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hp.Close()
+	s.Remote = hp.Addr()
+	opened := make(chan error, 1)
+	go func() { opened <- tunnels.OpenOnce(context.Background()) }()
+	for deadline := time.Now().Add(10 * time.Second); !s.IsUp(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel did not come up")
+		}
+	}
+	if err := tunnels.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-opened
+
+	records := readAudit(t, audit)
+	if len(records) != 3 {
+		t.Fatalf("expected 3 records, got %+v", records)
+	}
+	if r := records[0]; r.Event != AUDIT_AUTH_FAILURE || r.Tunnel != "audited" || r.Remote != refusing.Addr() || r.RemoteUser != "root" || !strings.Contains(r.Error, "authentication failed") || r.RemoteAddr != "" {
+		t.Errorf("unexpected auth failure record %+v", r)
+	}
+	if r := records[1]; r.Event != AUDIT_CONNECTED || r.RemoteAddr != hp.Addr() || r.LocalAddr == "" || r.ConnectedAt == nil || r.Pid != os.Getpid() {
+		t.Errorf("unexpected connected record %+v", r)
+	}
+	if r := records[2]; r.Event != AUDIT_DISCONNECTED || r.Reason != AUDIT_REASON_CLOSED || r.Uptime <= 0 || r.LocalAddr != records[1].LocalAddr || !r.ConnectedAt.Equal(*records[1].ConnectedAt) {
+		t.Errorf("unexpected disconnected record %+v", r)
+	}
+	if s.audit.Load() != nil {
+		t.Error("expected the audit log to be detached once OpenOnce returned")
+	}
+}
+
+func TestAuditLogRotate(t *testing.T) {
+	pth := filepath.Join(t.TempDir(), "audit.jsonl")
+	a, err := openAuditLog(pth, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	for i := 0; i < 4; i++ {
+		if err := a.write(AuditRecord{Event: AUDIT_CONNECTED, Tunnel: "rotated", Remote: "vpn.example.com:22", RemoteUser: "user"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotated, err := filepath.Glob(pth + ".*")
+	if err != nil || len(rotated) != 1 {
+		t.Fatalf("expected one rotated file, got %q: %v", rotated, err)
+	}
+	if n := len(readAudit(t, rotated[0])) + len(readAudit(t, pth)); n != 4 {
+		t.Errorf("expected 4 records in total, got %d", n)
+	}
+	if fi, err := os.Stat(pth); err != nil || fi.Mode().Perm() != 0600 || fi.Size() > 300 {
+		t.Errorf("expected a new file of at most 300 bytes with mode 0600, got %v: %v", fi, err)
+	}
+}
@@ -0,0 +1,56 @@
+package sshtun
+
+import (
+	"fmt"
+)
+
+const (
+	// DEVICE_TUN tunnels IP packets between tun devices, the default.
+	DEVICE_TUN string = "tun"
+	// DEVICE_TAP tunnels ethernet frames between tap devices, usually
+	// enslaved into a bridge on each end (local_bridge and
+	// remote_bridge) to join two layer 2 segments.
+	DEVICE_TAP string = "tap"
+)
+
+// deviceType returns DeviceType or DEVICE_TUN if not set.
+func (s *SSHTUN) deviceType() string {
+	if s.DeviceType == "" {
+		return DEVICE_TUN
+	}
+	return s.DeviceType
+}
+
+// tap reports if the tunnel is between tap devices.
+func (s *SSHTUN) tap() bool {
+	return s.deviceType() == DEVICE_TAP
+}
+
+// bridging reports if either end enslaves its tap device into a
+// bridge.
+func (s *SSHTUN) bridging() bool {
+	return s.LocalBridge != "" || s.RemoteBridge != ""
+}
+
+// remoteDeviceArgs returns the tunreadwriter arguments creating a tap
+// device and enslaving it into remote_bridge, the -net arguments are
+// left out when bridging.
+func (s *SSHTUN) remoteDeviceArgs() []string {
+	if !s.tap() {
+		return nil
+	}
+	args := []string{"-tap"}
+	if s.RemoteBridge != "" {
+		args = append(args, "-bridge", s.RemoteBridge)
+	}
+	return args
+}
+
+// warnBridging logs a warning about loops when bridging, joining two
+// segments that are already connected some other way floods both.
+func (s *SSHTUN) warnBridging() {
+	if !s.bridging() {
+		return
+	}
+	s.log().Warn(fmt.Sprintf("Tunnel %s bridges ethernet segments over ssh: another path between them (a second tunnel, a VPN or a cable) makes a loop flooding both segments, enable STP on the bridges (ip link set <bridge> type bridge stp_state 1) unless sure there is none", s.Name), "name", s.Name, "remote", s.Remote, "local_bridge", s.LocalBridge, "remote_bridge", s.RemoteBridge)
+}
@@ -0,0 +1,85 @@
+package sshtun
+
+import (
+	"fmt"
+	"time"
+)
+
+// Info describes a tunnel in the lifecycle callbacks of SSHTUN.
+// RemoteAddr and ConnectedAt are empty until the tunnel is connected.
+type Info struct {
+	Name            string
+	Remote          string
+	RemoteAddr      string
+	LocalTunDevice  string
+	RemoteTunDevice string
+	ConnectedAt     time.Time
+}
+
+// Lifecycle callbacks, all optional. OnConnecting is called when Open
+// starts, OnConnected when the remote helper is up and packets flow,
+// OnDisconnected when Open returns after the tunnel was connected (err
+// is nil if closed by the context) and OnReconnectScheduled by
+// Tunnels.OpenAll before waiting delay to reconnect. Callbacks are
+// called from the goroutine running Open, never while an internal
+// mutex is held, and a panic in a callback is recovered and logged.
+type Callbacks struct {
+	OnConnecting         func(info Info)                      `json:"-"`
+	OnConnected          func(info Info)                      `json:"-"`
+	OnDisconnected       func(info Info, err error)           `json:"-"`
+	OnReconnectScheduled func(info Info, delay time.Duration) `json:"-"`
+}
+
+// info returns the Info of s, connected at connectedAt (zero if not
+// connected).
+func (s *SSHTUN) info(connectedAt time.Time) Info {
+	info := Info{
+		Name:            s.Name,
+		Remote:          s.Remote,
+		LocalTunDevice:  s.LocalTunDevice,
+		RemoteTunDevice: s.RemoteTunDevice,
+	}
+	if s.remoteHandshake.Device != "" {
+		info.RemoteTunDevice = s.remoteHandshake.Device
+	}
+	if !connectedAt.IsZero() {
+		info.RemoteAddr = s.remoteAddr
+		info.ConnectedAt = connectedAt
+	}
+	return info
+}
+
+// callback calls fn (the callback called name) unless it is nil,
+// recovering and logging a panic.
+func (s *SSHTUN) callback(name string, fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.log().Error(fmt.Sprintf("Recovered from panic in %s callback of tunnel %s: %v", name, s.Name, r), "name", s.Name, "remote", s.Remote, "callback", name, "panic", fmt.Sprint(r))
+		}
+	}()
+	fn()
+}
+
+func (s *SSHTUN) onConnecting() {
+	if s.OnConnecting != nil {
+		s.callback("OnConnecting", func() { s.OnConnecting(s.info(time.Time{})) })
+	}
+}
+
+func (s *SSHTUN) onConnected(connectedAt time.Time) {
+	if s.OnConnected != nil {
+		s.callback("OnConnected", func() { s.OnConnected(s.info(connectedAt)) })
+	}
+}
+
+func (s *SSHTUN) onDisconnected(connectedAt time.Time, err error) {
+	if s.OnDisconnected != nil {
+		s.callback("OnDisconnected", func() { s.OnDisconnected(s.info(connectedAt), err) })
+	}
+}
+
+func (s *SSHTUN) onReconnectScheduled(delay time.Duration) {
+	if s.OnReconnectScheduled != nil {
+		s.callback("OnReconnectScheduled", func() { s.OnReconnectScheduled(s.info(time.Time{}), delay) })
+	}
+}
@@ -0,0 +1,43 @@
+package sshtun
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sa6mwa/sshtun/internal/pkg/handshake"
+)
+
+func TestCallbacks(t *testing.T) {
+	s := NewSecureShellTunneler(nil)
+	var connecting []Info
+	disconnected := false
+	s.OnConnecting = func(info Info) {
+		connecting = append(connecting, info)
+		panic("callback panic")
+	}
+	s.OnDisconnected = func(info Info, err error) {
+		disconnected = true
+	}
+	if err := s.Open(context.Background()); !errors.Is(err, ErrMissingContext) {
+		t.Fatalf("expected %v, got %v", ErrMissingContext, err)
+	}
+	if len(connecting) != 1 {
+		t.Fatalf("expected OnConnecting to be called once, got %d", len(connecting))
+	}
+	if connecting[0].Name != s.Name || connecting[0].Remote != s.Remote || !connecting[0].ConnectedAt.IsZero() {
+		t.Errorf("unexpected info %+v", connecting[0])
+	}
+	if disconnected {
+		t.Error("expected no OnDisconnected for a tunnel that never connected")
+	}
+
+	s.remoteAddr = "192.0.2.1:22"
+	s.remoteHandshake = handshake.Handshake{Device: "tun7"}
+	now := time.Now()
+	info := s.info(now)
+	if info.RemoteAddr != s.remoteAddr || info.RemoteTunDevice != "tun7" || !info.ConnectedAt.Equal(now) {
+		t.Errorf("unexpected info %+v", info)
+	}
+}
@@ -0,0 +1,89 @@
+package sshtun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Classes of Open failures, use errors.Is to tell them apart. Auth
+// and host key failures are unrecoverable (the tunnel is not retried)
+// unless RetryAuthFailures is set.
+var (
+	ErrAuthFailed         error = errors.New("authentication failed")
+	ErrConnectFailed      error = errors.New("connection failed")
+	ErrHostKeyMismatch    error = errors.New("host key mismatch")
+	ErrRemoteSetupFailed  error = errors.New("remote setup failed")
+	ErrHelperUploadFailed error = errors.New("helper upload failed")
+)
+
+const (
+	CLASS_AUTH          string = "auth"
+	CLASS_CONNECT       string = "connect"
+	CLASS_HOST_KEY      string = "host-key"
+	CLASS_REMOTE_SETUP  string = "remote-setup"
+	CLASS_HELPER_UPLOAD string = "helper-upload"
+)
+
+// ErrorClass returns the class of an error returned by Open (e.g
+// CLASS_AUTH for ErrAuthFailed) or an empty string if it has none.
+func ErrorClass(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrAuthFailed):
+		return CLASS_AUTH
+	case errors.Is(err, ErrHostKeyMismatch):
+		return CLASS_HOST_KEY
+	case errors.Is(err, ErrConnectFailed):
+		return CLASS_CONNECT
+	case errors.Is(err, ErrHelperUploadFailed):
+		return CLASS_HELPER_UPLOAD
+	case errors.Is(err, ErrRemoteSetupFailed):
+		return CLASS_REMOTE_SETUP
+	}
+	return ""
+}
+
+// classified returns err wrapped in class unless it is nil or already
+// wraps class.
+func classified(class, err error) error {
+	if err == nil || errors.Is(err, class) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", class, err)
+}
+
+// checkHostKey wraps callback so that a rejected host key is returned
+// by Dial as ErrHostKeyMismatch.
+func checkHostKey(callback ssh.HostKeyCallback) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		return classified(ErrHostKeyMismatch, callback(hostname, remote, key))
+	}
+}
+
+// handshakeError classifies an error from the ssh handshake, a failed
+// host key check, failed authentication or else a failed connection.
+func handshakeError(err error) error {
+	switch {
+	case errors.Is(err, ErrHostKeyMismatch):
+		return err
+	case strings.Contains(err.Error(), "unable to authenticate"):
+		// x/crypto/ssh has no sentinel for this.
+		return classified(ErrAuthFailed, err)
+	}
+	return classified(ErrConnectFailed, err)
+}
+
+// retryable returns err from Dial as is if it may go away by retrying
+// or unrecoverable if it is an auth or host key failure, unless
+// RetryAuthFailures is set.
+func (s *SSHTUN) retryable(err error) error {
+	if !s.RetryAuthFailures && (errors.Is(err, ErrAuthFailed) || errors.Is(err, ErrHostKeyMismatch)) {
+		return unrecoverable(err)
+	}
+	return err
+}
@@ -0,0 +1,73 @@
+package sshtun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sa6mwa/sshtun/pkg/sshtest"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestErrorClass(t *testing.T) {
+	privateKey, _, err := sshtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, err := sshtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, privateKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewSecureShellTunneler(nil)
+	s.Remote = "127.0.0.1:9"
+	s.PrivateKeyFiles = PrivateKeyFiles{keyFile}
+	_, err = s.Dial(context.Background())
+	if !errors.Is(err, ErrConnectFailed) || ErrorClass(err) != CLASS_CONNECT {
+		t.Errorf("expected %v, got: %v", ErrConnectFailed, err)
+	}
+	if s.retryable(err) != err {
+		t.Errorf("expected a connect failure to be retried, got: %v", s.retryable(err))
+	}
+
+	hp, err := sshtest.NewHoneyPot(sshtest.WithAuthorizedKeys(otherKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hp.Close()
+	s.Remote = hp.Addr()
+	_, err = s.Dial(context.Background())
+	if ErrorClass(err) != CLASS_AUTH {
+		t.Errorf("expected class %s, got %q: %v", CLASS_AUTH, ErrorClass(err), err)
+	}
+	if !errors.Is(s.retryable(err), ErrUnrecoverable) {
+		t.Errorf("expected an auth failure to be unrecoverable, got: %v", s.retryable(err))
+	}
+	s.RetryAuthFailures = true
+	if errors.Is(s.retryable(err), ErrUnrecoverable) {
+		t.Errorf("expected an auth failure to be retried with retry_auth_failures, got: %v", s.retryable(err))
+	}
+
+	rejected := errors.New("key rejected")
+	callback := checkHostKey(func(string, net.Addr, ssh.PublicKey) error { return rejected })
+	err = handshakeError(callback("localhost", nil, nil))
+	if !errors.Is(err, ErrHostKeyMismatch) || !errors.Is(err, rejected) || ErrorClass(err) != CLASS_HOST_KEY {
+		t.Errorf("expected %v, got: %v", ErrHostKeyMismatch, err)
+	}
+
+	for _, class := range []error{ErrRemoteSetupFailed, ErrHelperUploadFailed} {
+		if err := classified(class, classified(class, errors.New("x"))); err.Error() != class.Error()+": x" {
+			t.Errorf("expected %v to be wrapped once, got: %v", class, err)
+		}
+	}
+	if ErrorClass(errors.New("x")) != "" || ErrorClass(nil) != "" {
+		t.Error("expected no class for unclassified errors")
+	}
+}
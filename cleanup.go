@@ -0,0 +1,90 @@
+package sshtun
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/alessio/shellescape"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	DEFAULT_REMOTE_CLEANUP_AGE time.Duration = time.Hour
+)
+
+// staleHelperName matches the randomly named helpers uploaded when
+// caching is disabled, tunreadwriter-20231012T225150-0123456789abcdef
+// (or a decimal number instead of hex digits by older versions).
+// Cached helpers (tunreadwriter-<hash>) never match.
+var staleHelperName = regexp.MustCompile(`^tunreadwriter-[0-9]{8}T[0-9]{6}-(?:[0-9a-f]{16}|[0-9]+)$`)
+
+// remoteCleanupAge returns RemoteCleanupAge or
+// DEFAULT_REMOTE_CLEANUP_AGE if zero. A negative age disables
+// cleanup.
+func (s *SSHTUN) remoteCleanupAge() time.Duration {
+	if s.RemoteCleanupAge == 0 {
+		return DEFAULT_REMOTE_CLEANUP_AGE
+	}
+	return time.Duration(s.RemoteCleanupAge)
+}
+
+// remoteUploadDirectory returns RemoteUploadDirectory or
+// DEFAULT_UPLOAD_DIR if empty.
+func (s *SSHTUN) remoteUploadDirectory() string {
+	if s.RemoteUploadDirectory == "" {
+		return DEFAULT_UPLOAD_DIR
+	}
+	return s.RemoteUploadDirectory
+}
+
+// CleanupRemoteHelpers removes randomly named tunreadwriter binaries
+// older than RemoteCleanupAge left in RemoteUploadDirectory by
+// connections that died before the helper could delete itself. Only
+// regular files directly in the upload directory, owned by the remote
+// user and matching the exact upload name pattern are removed, the
+// cached helper, the helper of the current connection and helpers
+// shared with other tunnels to the remote are kept.
+// Returns the number of files removed.
+func (s *SSHTUN) CleanupRemoteHelpers(client *ssh.Client) (int, error) {
+	age := s.remoteCleanupAge()
+	if age < 0 {
+		return 0, nil
+	}
+	dir := s.remoteUploadDirectory()
+	minutes := int(age.Minutes())
+	out, err := sshoutput(client, fmt.Sprintf("find %s -maxdepth 1 -type f -user \"$(id -u)\" -name 'tunreadwriter-*' -mmin +%d", shellescape.Quote(dir), minutes))
+	if err != nil {
+		return 0, fmt.Errorf("unable to list %s on ssh://%s: %w", dir, s.Remote, err)
+	}
+	// Helpers shared with other tunnels to this remote are in use.
+	stale := staleHelpers(dir, out, append(s.helpers.paths(s.helperKeyPrefix()), s.remoteTunReadWriter)...)
+	if len(stale) == 0 {
+		return 0, nil
+	}
+	if err := sshrun(client, shellescape.QuoteCommand(append([]string{"rm", "-f", "--"}, stale...))); err != nil {
+		return 0, fmt.Errorf("unable to remove stale helpers in %s on ssh://%s: %w", dir, s.Remote, err)
+	}
+	return len(stale), nil
+}
+
+// staleHelpers returns the paths in the find output that are directly
+// in dir, match staleHelperName and are not current.
+func staleHelpers(dir, findOutput string, current ...string) []string {
+	dir = path.Clean(dir)
+	var stale []string
+	for _, line := range strings.Split(findOutput, "\n") {
+		pth := strings.TrimSpace(line)
+		if pth == "" || slices.Contains(current, pth) {
+			continue
+		}
+		if path.Dir(path.Clean(pth)) != dir || !staleHelperName.MatchString(path.Base(pth)) {
+			continue
+		}
+		stale = append(stale, pth)
+	}
+	return stale
+}
@@ -0,0 +1,118 @@
+package sshtun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrCloseTimeout error = errors.New("tunnels did not close in time")
+)
+
+const (
+	DEFAULT_CLOSE_TIMEOUT time.Duration = 10 * time.Second
+)
+
+// closeTimeout returns CloseTimeout or DEFAULT_CLOSE_TIMEOUT if not
+// set.
+func (t *Tunnels) closeTimeout() time.Duration {
+	if t.CloseTimeout <= 0 {
+		return DEFAULT_CLOSE_TIMEOUT
+	}
+	return t.CloseTimeout
+}
+
+// begin derives the context of OpenAll or OpenOnce from ctx so that
+// Close can cancel it.
+func (t *Tunnels) begin(ctx context.Context) context.Context {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	ctx, t.cancel = context.WithCancel(ctx)
+	if t.done == nil {
+		t.done = make(chan struct{})
+	}
+	t.teardownErrs = nil
+	return ctx
+}
+
+// end waits for every supervised tunnel to exit and releases Close
+// and Wait, called when OpenAll or OpenOnce returns.
+func (t *Tunnels) end() {
+	t.mutex.Lock()
+	// No new supervisors from EnableTunnel or ReconnectTunnel.
+	t.ctx = nil
+	t.mutex.Unlock()
+	t.waitSupervisors()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.cancel()
+	t.cancel = nil
+	close(t.done)
+	t.done = nil
+}
+
+// teardownError records err from tearing down the named tunnel for
+// Close.
+func (t *Tunnels) teardownError(name string, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.teardownErrs = append(t.teardownErrs, &TunnelError{Name: name, Err: err})
+}
+
+// Close stops OpenAll or OpenOnce like cancelling their context:
+// every tunnel is closed and the retry loops are broken, also while
+// waiting to reconnect. Close waits for every tunnel to exit for at
+// most CloseTimeout (DEFAULT_CLOSE_TIMEOUT if not set) and returns an
+// errors.Join of one *TunnelError per tunnel that failed to tear down
+// (e.g close its tun device) and an error wrapping ErrCloseTimeout if
+// tunnels were still running. Close does nothing if neither OpenAll
+// nor OpenOnce is running.
+func (t *Tunnels) Close() error {
+	t.mutex.Lock()
+	cancel, done := t.cancel, t.done
+	t.mutex.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	for _, tunnel := range t.snapshot() {
+		tunnel.Close()
+	}
+	timeout := t.closeTimeout()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var errs []error
+	select {
+	case <-done:
+	case <-timer.C:
+		errs = append(errs, fmt.Errorf("%w: still running after %s", ErrCloseTimeout, timeout))
+	}
+	t.mutex.Lock()
+	errs = append(t.teardownErrs, errs...)
+	t.mutex.Unlock()
+	return errors.Join(errs...)
+}
+
+// Wait blocks until the running OpenAll or OpenOnce has returned and
+// all of its tunnels have exited. Wait returns immediately if neither
+// OpenAll nor OpenOnce is running.
+func (t *Tunnels) Wait() {
+	t.mutex.Lock()
+	done := t.done
+	t.mutex.Unlock()
+	if done == nil {
+		return
+	}
+	<-done
+}
+
+// closeLocalTUN closes the local TUN device of tunnel when its
+// supervisor exits, a failure is returned by Close.
+func (t *Tunnels) closeLocalTUN(tunnel *SSHTUN) {
+	if err := tunnel.closeLocalTUN(); err != nil {
+		t.log.Warn(fmt.Sprintf("Unable to close local tun device of tunnel %s", tunnel.Name), "name", tunnel.Name, "error", err)
+		t.teardownError(tunnel.Name, err)
+	}
+}
@@ -0,0 +1,95 @@
+//go:build linux
+
+package sshtun
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sa6mwa/sshtun/pkg/sshtest"
+)
+
+func TestTunnelsClose(t *testing.T) {
+	privateKey, _, err := sshtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, privateKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	s := NewSecureShellTunneler(nil)
+	s.Enable = true
+	// Nothing listens on the discard port, the tunnel keeps failing
+	// and backing off.
+	s.Remote = "127.0.0.1:9"
+	s.RemoteUser = "root"
+	s.PrivateKeyFiles = PrivateKeyFiles{keyFile}
+	s.KeepaliveInterval = 0
+	s.localTUN, _ = fakeTUN(t)
+	s.retainTUN = true
+	tunnels := &Tunnels{Tunnels: []*SSHTUN{s}, DisableExpvar: true}
+	tunnels.log = SetLogger(nil)
+	if err := tunnels.Close(); err != nil {
+		t.Fatalf("expected Close before OpenAll to do nothing, got: %v", err)
+	}
+
+	opened := make(chan error, 1)
+	go func() {
+		opened <- tunnels.OpenAll(context.Background())
+	}()
+	deadline := time.After(5 * time.Second)
+	for s.Status().State != STATE_RECONNECTING {
+		select {
+		case err := <-opened:
+			t.Fatalf("OpenAll returned before backing off: %v", err)
+		case <-deadline:
+			t.Fatal("tunnel did not back off")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	waited := make(chan struct{})
+	go func() {
+		tunnels.Wait()
+		close(waited)
+	}()
+	start := time.Now()
+	if err := tunnels.Close(); err != nil {
+		t.Errorf("expected Close to return nil, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > DEFAULT_RECONNECT_DELAY {
+		t.Errorf("expected Close to break the backoff, took %s", elapsed)
+	}
+	select {
+	case err := <-opened:
+		if err != nil {
+			t.Errorf("expected OpenAll to return nil after Close, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OpenAll did not return after Close")
+	}
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait did not return after Close")
+	}
+	if s.localTUN != nil {
+		t.Error("expected the local tun device to be closed")
+	}
+	if err := tunnels.Close(); err != nil {
+		t.Errorf("expected Close after OpenAll to do nothing, got: %v", err)
+	}
+	waited = make(chan struct{})
+	go func() {
+		tunnels.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Wait after OpenAll to return immediately")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/sa6mwa/sshtun"
+)
+
+var (
+	ErrCheckFailed error = errors.New("configuration check failed")
+)
+
+// unjoin returns the errors joined in err (errors.Join), or err alone
+// if it is not joined.
+func unjoin(err error) []error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
+
+// Check validates tunnels (see Tunnels.Validate) and every tunnel in
+// it without opening any tunnel or requiring root and writes a
+// per-tunnel OK/FAIL summary to w, problems not tied to a tunnel are
+// reported as FAIL configuration.
+// With resolve, the remote host is looked up in DNS. With connect, an
+// SSH handshake including authentication is attempted. Returns
+// ErrCheckFailed if any tunnel failed any check.
+func Check(ctx context.Context, w io.Writer, tunnels *sshtun.Tunnels, resolve, connect bool) error {
+	failed := false
+	invalid := make(map[string][]error)
+	if err := tunnels.Validate(); err != nil {
+		var configuration []error
+		for _, err := range unjoin(err) {
+			var tunnelErr *sshtun.TunnelError
+			if errors.As(err, &tunnelErr) {
+				invalid[tunnelErr.Name] = append(invalid[tunnelErr.Name], tunnelErr.Err)
+			} else {
+				configuration = append(configuration, err)
+			}
+		}
+		if len(configuration) > 0 {
+			failed = true
+			fmt.Fprintf(w, "FAIL configuration: %s\n", strings.ReplaceAll(errors.Join(configuration...).Error(), "\n", "; "))
+		}
+	}
+	for _, tunnel := range tunnels.Tunnels {
+		if tunnel == nil {
+			continue
+		}
+		errs := invalid[tunnel.Name]
+		if err := tunnel.CheckPrivateKeys(); err != nil {
+			errs = append(errs, fmt.Errorf("private keys: %w", err))
+		}
+		var warnings []string
+		if err := tunnel.CheckAddressConflicts(); errors.Is(err, sshtun.ErrAddressConflict) && tunnel.AllowOverlap {
+			warnings = append(warnings, err.Error())
+		} else if err != nil {
+			errs = append(errs, err)
+		}
+		if resolve {
+			c, cancel := context.WithTimeout(ctx, 10*time.Second)
+			if err := tunnel.ResolveRemote(c); err != nil {
+				errs = append(errs, fmt.Errorf("resolve: %w", err))
+			}
+			cancel()
+		}
+		if connect && len(errs) == 0 {
+			if err := tunnel.CheckConnect(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("connect: %w", err))
+			}
+		}
+		if len(errs) > 0 {
+			failed = true
+			fmt.Fprintf(w, "FAIL %s: %s\n", tunnel.Name, strings.ReplaceAll(errors.Join(errs...).Error(), "\n", "; "))
+			continue
+		}
+		fmt.Fprintf(w, "OK   %s\n", tunnel.Name)
+		addressing, _ := tunnel.ValidateAddressing()
+		for _, warning := range append(warnings, addressing...) {
+			fmt.Fprintf(w, "WARN %s\n", warning)
+		}
+	}
+	if failed {
+		return ErrCheckFailed
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/sa6mwa/sshtun"
+)
+
+func TestCheck(t *testing.T) {
+	office, duplicate := sshtun.NewSecureShellTunneler(nil), sshtun.NewSecureShellTunneler(nil)
+	office.Name, duplicate.Name = "office", "office"
+	lab := sshtun.NewSecureShellTunneler(nil)
+	lab.Name = "lab"
+	lab.Remote = ""
+	tunnels := &sshtun.Tunnels{
+		Tunnels:     []*sshtun.SSHTUN{office, duplicate, lab},
+		DebugListen: "0.0.0.0:6060",
+	}
+	var out bytes.Buffer
+	if err := Check(context.Background(), &out, tunnels, false, false); !errors.Is(err, ErrCheckFailed) {
+		t.Fatalf("expected %v, got: %v", ErrCheckFailed, err)
+	}
+	for _, line := range []string{"FAIL configuration: invalid configuration: debug_listen: ", "FAIL office: invalid configuration: duplicate name", "FAIL lab: invalid configuration: tunnel \"lab\": remote"} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("expected %q in:\n%s", line, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "duplicate name; invalid configuration: duplicate name") {
+		t.Errorf("expected the duplicate name once per tunnel:\n%s", out.String())
+	}
+}
+
+func TestUnjoin(t *testing.T) {
+	a, b := errors.New("a"), errors.New("b")
+	if errs := unjoin(a); len(errs) != 1 || errs[0] != a {
+		t.Errorf("expected a single error as is, got %v", errs)
+	}
+	if errs := unjoin(errors.Join(a, b)); len(errs) != 2 || errs[0] != a || errs[1] != b {
+		t.Errorf("expected the joined errors, got %v", errs)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrUnsupportedShell error = errors.New("unsupported shell, supported shells are bash and zsh")
+)
+
+// completionValues holds fixed value lists for flags taking an
+// argument, flags not listed here complete file paths if their usage
+// names a file or path, commands and files if it names a command,
+// tunnel names if it names a tunnel, otherwise nothing.
+var completionValues = map[string][]string{
+	"level":       {"DEBUG", "INFO", "WARN", "ERROR", "OFF"},
+	"ctl":         {"enable", "disable", "reconnect", "level", "status"},
+	"completion":  {"bash", "zsh"},
+	"init-system": {INIT_SYSTEMD, INIT_OPENRC, INIT_SYSV},
+}
+
+// tunnelNameFlags are flags after which the remaining arguments are
+// tunnel names.
+var tunnelNameFlags = []string{"ctl", "status"}
+
+type completionFlag struct {
+	name      string
+	usage     string
+	isBool    bool
+	isFile    bool
+	isCommand bool
+	isTunnel  bool
+	values    []string
+	argument  string
+}
+
+// completionFlags derives the list of flags from fs so that new flags
+// are picked up automatically.
+func completionFlags(fs *flag.FlagSet) []completionFlag {
+	var flags []completionFlag
+	fs.VisitAll(func(f *flag.Flag) {
+		argument, usage := flag.UnquoteUsage(f)
+		cf := completionFlag{
+			name:     f.Name,
+			usage:    usage,
+			values:   completionValues[f.Name],
+			argument: argument,
+		}
+		if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && bf.IsBoolFlag() {
+			cf.isBool = true
+		}
+		switch argument {
+		case "file", "path":
+			cf.isFile = true
+		case "command":
+			cf.isCommand = true
+		case "tunnel":
+			cf.isTunnel = true
+		}
+		flags = append(flags, cf)
+	})
+	sort.Slice(flags, func(i, j int) bool { return flags[i].name < flags[j].name })
+	return flags
+}
+
+// WriteCompletion writes a completion script for shell (bash or zsh)
+// to w covering all flags in fs.
+func WriteCompletion(w io.Writer, shell string, fs *flag.FlagSet) error {
+	program := filepath.Base(os.Args[0])
+	flags := completionFlags(fs)
+	switch shell {
+	case "bash":
+		return writeBashCompletion(w, program, flags)
+	case "zsh":
+		return writeZshCompletion(w, program, flags)
+	default:
+		return fmt.Errorf("%w: %q", ErrUnsupportedShell, shell)
+	}
+}
+
+func writeBashCompletion(w io.Writer, program string, flags []completionFlag) error {
+	fn := "_" + strings.ReplaceAll(program, "-", "_")
+	var all, files, commands, tunnels, none []string
+	for _, f := range flags {
+		all = append(all, "-"+f.name)
+		switch {
+		case f.isBool, f.values != nil:
+		case f.isFile:
+			files = append(files, "-"+f.name)
+		case f.isCommand:
+			commands = append(commands, "-"+f.name)
+		case f.isTunnel:
+			tunnels = append(tunnels, "-"+f.name)
+		default:
+			none = append(none, "-"+f.name)
+		}
+	}
+	names := fmt.Sprintf("COMPREPLY=( $(compgen -W \"$(%s ${config:+-config \"$config\"} -level OFF -names 2>/dev/null)\" -- \"$cur\") )", program)
+	var b strings.Builder
+	fmt.Fprintf(&b, "# bash completion for %s, generated by %s -completion bash\n", program, program)
+	fmt.Fprintf(&b, "%s() {\n", fn)
+	b.WriteString("\tlocal cur prev config i\n")
+	b.WriteString("\tcur=\"${COMP_WORDS[COMP_CWORD]}\"\n")
+	b.WriteString("\tprev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+	b.WriteString("\tfor ((i = 1; i < COMP_CWORD; i++)); do\n")
+	b.WriteString("\t\tif [[ \"${COMP_WORDS[i]}\" == -config ]]; then config=\"${COMP_WORDS[i+1]}\"; fi\n")
+	b.WriteString("\tdone\n")
+	b.WriteString("\tcase \"$prev\" in\n")
+	if len(files) > 0 {
+		fmt.Fprintf(&b, "\t%s)\n\t\tCOMPREPLY=( $(compgen -f -- \"$cur\") )\n\t\treturn\n\t\t;;\n", strings.Join(files, "|"))
+	}
+	if len(commands) > 0 {
+		fmt.Fprintf(&b, "\t%s)\n\t\tCOMPREPLY=( $(compgen -c -- \"$cur\") $(compgen -f -- \"$cur\") )\n\t\treturn\n\t\t;;\n", strings.Join(commands, "|"))
+	}
+	if len(tunnels) > 0 {
+		fmt.Fprintf(&b, "\t%s)\n\t\t%s\n\t\treturn\n\t\t;;\n", strings.Join(tunnels, "|"), names)
+	}
+	for _, f := range flags {
+		if f.values != nil {
+			fmt.Fprintf(&b, "\t-%s)\n\t\tCOMPREPLY=( $(compgen -W %q -- \"$cur\") )\n\t\treturn\n\t\t;;\n", f.name, strings.Join(f.values, " "))
+		}
+	}
+	if len(none) > 0 {
+		fmt.Fprintf(&b, "\t%s)\n\t\treturn\n\t\t;;\n", strings.Join(none, "|"))
+	}
+	b.WriteString("\tesac\n")
+	fmt.Fprintf(&b, "\tif [[ \"$cur\" == -* ]]; then\n\t\tCOMPREPLY=( $(compgen -W %q -- \"$cur\") )\n\t\treturn\n\tfi\n", strings.Join(all, " "))
+	for _, name := range tunnelNameFlags {
+		fmt.Fprintf(&b, "\tif [[ \" ${COMP_WORDS[*]} \" == *\" -%s \"* ]]; then\n", name)
+		fmt.Fprintf(&b, "\t\t%s\n", names)
+		b.WriteString("\t\treturn\n\tfi\n")
+	}
+	b.WriteString("}\n")
+	fmt.Fprintf(&b, "complete -F %s %s\n", fn, program)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeZshCompletion(w io.Writer, program string, flags []completionFlag) error {
+	escape := strings.NewReplacer("[", "\\[", "]", "\\]", ":", "\\:", "'", "'\\''")
+	var b strings.Builder
+	fmt.Fprintf(&b, "#compdef %s\n", program)
+	fmt.Fprintf(&b, "# zsh completion for %s, generated by %s -completion zsh\n\n", program, program)
+	fmt.Fprintf(&b, "_%s_tunnels() {\n", program)
+	b.WriteString("\tlocal -a names\n\tlocal config\n")
+	b.WriteString("\tconfig=\"${opt_args[-config]}\"\n")
+	fmt.Fprintf(&b, "\tnames=(${(f)\"$(%s ${config:+-config \"$config\"} -level OFF -names 2>/dev/null)\"})\n", program)
+	b.WriteString("\t_describe 'tunnel' names\n}\n\n")
+	fmt.Fprintf(&b, "_%s() {\n", program)
+	b.WriteString("\t_arguments \\\n")
+	for _, f := range flags {
+		spec := fmt.Sprintf("-%s[%s]", f.name, escape.Replace(f.usage))
+		switch {
+		case f.isBool:
+		case f.values != nil:
+			spec += fmt.Sprintf(":%s:(%s)", f.name, strings.Join(f.values, " "))
+		case f.isFile:
+			spec += ":" + f.argument + ":_files"
+		case f.isCommand:
+			spec += ":" + f.argument + ":_command_names -e"
+		case f.isTunnel:
+			spec += fmt.Sprintf(":tunnel:_%s_tunnels", program)
+		default:
+			argument := f.argument
+			if argument == "" {
+				argument = "value"
+			}
+			spec += ":" + escape.Replace(argument) + ": "
+		}
+		fmt.Fprintf(&b, "\t\t'%s' \\\n", spec)
+	}
+	fmt.Fprintf(&b, "\t\t'*:tunnel:_%s_tunnels'\n}\n\n", program)
+	fmt.Fprintf(&b, "compdef _%s %s\n", program, program)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
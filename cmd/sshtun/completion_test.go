@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestWriteCompletion(t *testing.T) {
+	fs := flag.NewFlagSet("sshtun", flag.ContinueOnError)
+	fs.String("config", "", "Configuration `file` as json")
+	fs.String("editor", "", "Use editor `command`")
+	fs.String("ctl", "", "Send `command`")
+	fs.String("tunnel", "", "Only run `tunnel`")
+	fs.String("speedtest", "", "Measure throughput of `tunnel`")
+	fs.String("remote-user", "", "Override the remote user `name`")
+	fs.Bool("names", false, "Print tunnel names")
+
+	var bash strings.Builder
+	if err := WriteCompletion(&bash, "bash", fs); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"\t-config)\n\t\tCOMPREPLY=( $(compgen -f",
+		"\t-editor)\n\t\tCOMPREPLY=( $(compgen -c -- \"$cur\") $(compgen -f -- \"$cur\") )",
+		"\t-ctl)\n\t\tCOMPREPLY=( $(compgen -W \"enable ",
+		"\t-speedtest|-tunnel)\n\t\tCOMPREPLY=( $(compgen -W \"$(",
+		"\t-remote-user)\n\t\treturn\n",
+	} {
+		if !strings.Contains(bash.String(), want) {
+			t.Errorf("expected %q in the bash completion, got:\n%s", want, bash.String())
+		}
+	}
+
+	var zsh strings.Builder
+	if err := WriteCompletion(&zsh, "zsh", fs); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"'-config[Configuration file as json]:file:_files'",
+		"'-editor[Use editor command]:command:_command_names -e'",
+		"'-tunnel[Only run tunnel]:tunnel:_",
+		"'-speedtest[Measure throughput of tunnel]:tunnel:_",
+		"'-remote-user[Override the remote user name]:name: '",
+	} {
+		if !strings.Contains(zsh.String(), want) {
+			t.Errorf("expected %q in the zsh completion, got:\n%s", want, zsh.String())
+		}
+	}
+}
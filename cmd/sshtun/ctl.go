@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/sa6mwa/sshtun"
+)
+
+var (
+	ErrMissingTunnelName error = errors.New("missing tunnel name, usage: sshtun -ctl command name")
+	ErrMissingLogLevel   error = errors.New("missing log level, usage: sshtun -ctl level name... level")
+)
+
+// Ctl sends command for each tunnel name in names to a running sshtun
+// over the control socket. The last name of the level command is the
+// log level, status without names asks for every tunnel. With -save,
+// enable and disable are also persisted to the configuration file.
+func Ctl(ctx context.Context, command string, names []string, l *slog.Logger) error {
+	var args []string
+	if command == "status" && len(names) == 0 {
+		names = []string{""}
+	}
+	if command == "level" {
+		if len(names) < 2 {
+			return ErrMissingLogLevel
+		}
+		names, args = names[:len(names)-1], names[len(names)-1:]
+	}
+	if len(names) == 0 {
+		return ErrMissingTunnelName
+	}
+	for _, name := range names {
+		msg, err := sshtun.SendControl(ctx, controlSocket, command, name, args...)
+		if err != nil {
+			return fmt.Errorf("%s %s: %w", command, name, err)
+		}
+		fmt.Println(msg)
+	}
+	if !saveConfig {
+		return nil
+	}
+	var enable bool
+	switch command {
+	case "enable":
+		enable = true
+	case "disable":
+		enable = false
+	default:
+		return nil
+	}
+	tunnels, err := sshtun.LoadConfig(configJson, l)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		tunnel, err := tunnels.Lookup(name)
+		if err != nil {
+			return err
+		}
+		tunnel.Enable = enable
+	}
+	if err := tunnels.SaveConfig(configJson); err != nil {
+		return err
+	}
+	l.Info("Saved configuration", "file", sshtun.ResolveTildeSlash(configJson))
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	runtimepprof "runtime/pprof"
+	"time"
+
+	"github.com/sa6mwa/sshtun"
+)
+
+// ServeDebug serves net/http/pprof on /debug/pprof/, the expvar
+// counters of tunnels on /debug/vars, /healthz and a text dump of all
+// goroutines on /goroutines over http on address until ctx is
+// cancelled. There is no authentication, address must be loopback
+// unless allowRemote is true (see sshtun.CheckDebugListen). pprof is
+// part of the executable only, the sshtun package does not register
+// anything on http.DefaultServeMux.
+func ServeDebug(ctx context.Context, tunnels *sshtun.Tunnels, address string, allowRemote bool, l *slog.Logger) error {
+	if err := sshtun.CheckDebugListen(address, allowRemote); err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler:           debugHandler(tunnels),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	l.Info(fmt.Sprintf("Debug listener on http://%s", listener.Addr()), "address", listener.Addr().String(), "allow_remote", allowRemote)
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func debugHandler(tunnels *sshtun.Tunnels) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		// Healthy while at least one enabled tunnel is up.
+		up, enabled := tunnels.Up(), tunnels.Enabled()
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if up == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		fmt.Fprintf(w, "%d/%d tunnels up\n", up, enabled)
+	})
+	mux.HandleFunc("/goroutines", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		runtimepprof.Lookup("goroutine").WriteTo(w, 2)
+	})
+	return mux
+}
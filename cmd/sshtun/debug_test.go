@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sa6mwa/sshtun"
+)
+
+func TestDebugHandler(t *testing.T) {
+	s := sshtun.NewSecureShellTunneler(nil)
+	s.Enable = true
+	handler := debugHandler(&sshtun.Tunnels{Tunnels: []*sshtun.SSHTUN{s}})
+	get := func(pth string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, pth, nil))
+		return rec
+	}
+	if rec := get("/healthz"); rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "0/1 tunnels up\n" {
+		t.Errorf("unexpected /healthz %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := get("/goroutines"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "goroutine ") {
+		t.Errorf("unexpected /goroutines %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := get("/debug/pprof/"); rec.Code != http.StatusOK {
+		t.Errorf("unexpected /debug/pprof/ status %d", rec.Code)
+	}
+}
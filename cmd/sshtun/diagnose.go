@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/sa6mwa/sshtun"
+)
+
+var (
+	ErrDiagnoseFailed error = errors.New("diagnosis found a broken step")
+)
+
+// Diagnose runs sshtun.SSHTUN.Diagnose on the tunnel named name and
+// writes the checklist to w as text or json. Returns
+// ErrDiagnoseFailed if any step failed.
+func Diagnose(ctx context.Context, w io.Writer, tunnels *sshtun.Tunnels, name, format string) error {
+	if format != "" && format != "text" && format != "json" {
+		return fmt.Errorf("unsupported output format %q, use text or json", format)
+	}
+	tunnel, err := tunnels.Lookup(name)
+	if err != nil {
+		return err
+	}
+	diagnosis := tunnel.Diagnose(ctx)
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(diagnosis)
+	} else {
+		_, err = fmt.Fprintln(w, diagnosis)
+	}
+	if err != nil {
+		return err
+	}
+	if diagnosis.Failed() {
+		return ErrDiagnoseFailed
+	}
+	return nil
+}
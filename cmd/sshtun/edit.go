@@ -3,55 +3,166 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"syscall"
-	"unsafe"
 )
 
 var (
-	DefaultEditors = []string{"/bin/vim", "/usr/bin/vim", "/bin/vi", "/usr/bin/nano"}
+	// DefaultEditors are tried in order after VISUAL and EDITOR, names
+	// are looked up in PATH.
+	DefaultEditors = []string{"sensible-editor", "editor", "vim", "vi", "nano"}
 )
 
 var (
-	ErrNoEditorFound  error = errors.New("no editor found")
-	ErrNotATerminal   error = errors.New("os.Stdin is not a terminal")
-	ErrEditorNotFound error = errors.New("editor not found")
+	ErrNoEditorFound     error = errors.New("no editor found")
+	ErrNotATerminal      error = errors.New("os.Stdin is not a terminal")
+	ErrEditorNotFound    error = errors.New("editor not found")
+	ErrUnterminatedQuote error = errors.New("unterminated quote")
 )
 
-func EditFile(ctx context.Context, pth string, becomeRoot bool) error {
-	if !IsUnixTerminal(os.Stdin) {
-		return ErrNotATerminal
+// Editor is an editor executable and the arguments to pass before the
+// file to edit, e.g code --wait.
+type Editor struct {
+	Path string
+	Args []string
+}
+
+// ParseEditor splits value with shell-like word splitting (see
+// splitWords) and resolves the first word with exec.LookPath. The
+// remaining words become leading arguments.
+func ParseEditor(value string) (Editor, error) {
+	words, err := splitWords(value)
+	if err != nil {
+		return Editor{}, fmt.Errorf("%w: %q: %w", ErrEditorNotFound, value, err)
+	}
+	if len(words) == 0 {
+		return Editor{}, fmt.Errorf("%w: %q", ErrEditorNotFound, value)
+	}
+	pth, err := exec.LookPath(words[0])
+	if err != nil {
+		return Editor{}, fmt.Errorf("%w: %w", ErrEditorNotFound, err)
+	}
+	return Editor{Path: pth, Args: words[1:]}, nil
+}
+
+// splitWords splits s into words separated by unquoted white space.
+// Single quotes preserve everything literally, double quotes allow
+// backslash escaping of " and \, and an unquoted backslash escapes
+// the next character.
+func splitWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			if quote == '"' && r != '"' && r != '\\' {
+				word.WriteRune('\\')
+			}
+			word.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, ErrUnterminatedQuote
 	}
-	executables := []string{}
-	envEditor := os.Getenv("EDITOR")
-	switch {
-	case envEditor != "" && fileExists(envEditor):
-		executables = append(executables, envEditor)
-	case editor == "":
-		executables = append(executables, DefaultEditors...)
-	default:
-		if !fileExists(editor) {
-			return ErrEditorNotFound
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// editors returns the editors to try: only the -editor option if
+// set, otherwise every candidate from the VISUAL and EDITOR
+// environment variables followed by DefaultEditors that resolves via
+// PATH (or as an absolute path).
+func editors() ([]Editor, error) {
+	if editor != "" {
+		e, err := ParseEditor(editor)
+		if err != nil {
+			return nil, err
+		}
+		return []Editor{e}, nil
+	}
+	var candidates []string
+	for _, env := range []string{"VISUAL", "EDITOR"} {
+		if value := os.Getenv(env); value != "" {
+			candidates = append(candidates, value)
 		}
-		executables = append(executables, editor)
 	}
-	if len(executables) == 0 {
-		return ErrNoEditorFound
+	candidates = append(candidates, DefaultEditors...)
+	var found []Editor
+	for _, candidate := range candidates {
+		if e, err := ParseEditor(candidate); err == nil {
+			found = append(found, e)
+		}
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("%w, tried %s", ErrNoEditorFound, strings.Join(candidates, ", "))
+	}
+	return found, nil
+}
+
+// EditFile edits pth in a temporary copy and writes it back when the
+// editor exits. If validate is not nil it is called with the edited
+// copy and on error the user is offered to edit the file again, the
+// file is only written back if it passes or the user chooses to save
+// it anyway.
+func EditFile(ctx context.Context, pth string, becomeRoot bool, validate func(ctx context.Context, file string) error) error {
+	if !IsUnixTerminal(os.Stdin) {
+		return ErrNotATerminal
+	}
+	executables, err := editors()
+	if err != nil {
+		return err
 	}
 
 	var origEUID int
 	if becomeRoot {
 		origEUID = syscall.Geteuid()
 		if origEUID != 0 {
-			if err := syscall.Seteuid(0); err != nil {
+			if err := seteuid(0); err != nil {
 				return err
 			}
 			defer func() {
-				syscall.Seteuid(origEUID)
+				seteuid(origEUID)
 			}()
 		}
 	}
@@ -81,18 +192,39 @@ func EditFile(ctx context.Context, pth string, becomeRoot bool) error {
 	}()
 
 	if becomeRoot {
-		if err := syscall.Seteuid(origEUID); err != nil {
+		if err := seteuid(origEUID); err != nil {
 			return err
 		}
 	}
-	if err := tryExec(c, executables, tempfile); err != nil {
-		return err
-	}
-	if c.Err() != nil {
-		return nil
+	for {
+		if err := tryExec(c, executables, 0, tempfile); err != nil {
+			return err
+		}
+		if c.Err() != nil {
+			return nil
+		}
+		if validate == nil {
+			break
+		}
+		err := validate(c, tempfile)
+		if err == nil {
+			break
+		}
+		fmt.Printf("%v\n", err)
+		again, aerr := ask(c, "Edit file again? [Y/n] ", true)
+		if aerr != nil {
+			return err
+		}
+		if again {
+			continue
+		}
+		if save, aerr := ask(c, "Save anyway? [y/N] ", false); aerr != nil || !save {
+			return err
+		}
+		break
 	}
 	if becomeRoot {
-		if err := syscall.Seteuid(0); err != nil {
+		if err := seteuid(0); err != nil {
 			return err
 		}
 	}
@@ -100,6 +232,7 @@ func EditFile(ctx context.Context, pth string, becomeRoot bool) error {
 	if err != nil {
 		return err
 	}
+	defer editedF.Close()
 	outputF, err := os.OpenFile(pth, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
 	if err != nil {
 		return err
@@ -150,9 +283,19 @@ func copyFileToTemp(originalFile string) (string, error) {
 	return tempfile, nil
 }
 
-func tryExec(ctx context.Context, executables []string, arg ...string) error {
+// lineEditors accept +LINE before the file to place the cursor.
+var lineEditors = []string{"vi", "vim", "nvim", "view", "nano", "emacs", "mg", "micro"}
+
+// tryExec runs each editor in turn on file until one could be
+// started. If line is greater than 0 and the editor supports it, +LINE
+// is passed to position the cursor.
+func tryExec(ctx context.Context, executables []Editor, line int, file string) error {
 	for _, executable := range executables {
-		cmd := exec.CommandContext(ctx, executable, arg...)
+		args := append([]string{}, executable.Args...)
+		if line > 0 && slices.Contains(lineEditors, filepath.Base(executable.Path)) {
+			args = append(args, "+"+strconv.Itoa(line))
+		}
+		cmd := exec.CommandContext(ctx, executable.Path, append(args, file)...)
 		cmd.Stdin = os.Stdin
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
@@ -179,25 +322,3 @@ func tryExec(ctx context.Context, executables []string, arg ...string) error {
 // 	}
 // 	return hex.EncodeToString(buf)
 // }
-
-// IsUnixTerminal is constructed from terminal.IsTerminal() and is only
-// reproduced here in order not to import an external dependency.
-func IsUnixTerminal(f *os.File) bool {
-	type UnixTermios struct {
-		Iflag  uint32
-		Oflag  uint32
-		Cflag  uint32
-		Lflag  uint32
-		Line   uint8
-		Cc     [19]uint8
-		Ispeed uint32
-		Ospeed uint32
-	}
-	const TCGETS = 0x5401
-	const SYS_IOCTL = 16
-	fd := f.Fd()
-	var value UnixTermios
-	req := TCGETS
-	_, _, e1 := syscall.Syscall(SYS_IOCTL, uintptr(fd), uintptr(req), uintptr(unsafe.Pointer(&value)))
-	return e1 == 0
-}
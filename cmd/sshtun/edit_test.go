@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitWords(t *testing.T) {
+	for value, want := range map[string][]string{
+		"vim":                                 {"vim"},
+		"code --wait":                         {"code", "--wait"},
+		`"/opt/My Editor/bin/edit" -w`:        {"/opt/My Editor/bin/edit", "-w"},
+		`'/opt/My Editor/bin/edit'`:           {"/opt/My Editor/bin/edit"},
+		`/opt/My\ Editor/bin/edit  --new-win`: {"/opt/My Editor/bin/edit", "--new-win"},
+		`emacs -nw --eval "(setq x \"y\")"`:   {"emacs", "-nw", "--eval", `(setq x "y")`},
+		"  ":                                  nil,
+	} {
+		got, err := splitWords(value)
+		if err != nil {
+			t.Errorf("splitWords(%q): %v", value, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("splitWords(%q) = %q, expected %q", value, got, want)
+		}
+	}
+	if _, err := splitWords(`"vim`); !errors.Is(err, ErrUnterminatedQuote) {
+		t.Errorf("expected ErrUnterminatedQuote, got %v", err)
+	}
+}
+
+func TestParseEditor(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "My Editor")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	executable := filepath.Join(dir, "edit")
+	if err := os.WriteFile(executable, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	e, err := ParseEditor("edit --wait")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Path != executable || !reflect.DeepEqual(e.Args, []string{"--wait"}) {
+		t.Errorf("unexpected editor %+v", e)
+	}
+	e, err = ParseEditor(`"` + executable + `" -w`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Path != executable || !reflect.DeepEqual(e.Args, []string{"-w"}) {
+		t.Errorf("unexpected editor %+v", e)
+	}
+	if _, err := ParseEditor("nonexistent-editor --wait"); !errors.Is(err, ErrEditorNotFound) {
+		t.Errorf("expected ErrEditorNotFound, got %v", err)
+	}
+}
+
+func TestEditors(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"vi", "nano"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir)
+	t.Setenv("VISUAL", "")
+	t.Setenv("EDITOR", "nano -w")
+	found, err := editors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range found {
+		got = append(got, filepath.Base(e.Path))
+	}
+	if want := []string{"nano", "vi", "nano"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("editors() = %q, expected %q", got, want)
+	}
+	if len(found[0].Args) != 1 || found[0].Args[0] != "-w" {
+		t.Errorf("expected EDITOR arguments to be kept, got %q", found[0].Args)
+	}
+
+	t.Setenv("PATH", t.TempDir())
+	t.Setenv("EDITOR", "")
+	if _, err := editors(); !errors.Is(err, ErrNoEditorFound) {
+		t.Errorf("expected ErrNoEditorFound, got %v", err)
+	} else if !strings.Contains(err.Error(), "sensible-editor") {
+		t.Errorf("expected tried candidates in %q", err)
+	}
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"strings"
@@ -13,27 +16,33 @@ import (
 	"github.com/sa6mwa/sshtun"
 )
 
+var (
+	ErrTrailingJson error = errors.New("invalid content after the configuration")
+)
+
+// trailingJsonError is content after the configuration json, Offset
+// points just past its first byte like the offset of a
+// json.SyntaxError.
+type trailingJsonError struct {
+	Offset int64
+	char   byte
+}
+
+func (e *trailingJsonError) Error() string {
+	return fmt.Sprintf("%v: %q", ErrTrailingJson, e.char)
+}
+
+func (e *trailingJsonError) Unwrap() error {
+	return ErrTrailingJson
+}
+
 func EditConfig(configJson string) error {
 	if !IsUnixTerminal(os.Stdin) {
 		return ErrNotATerminal
 	}
-	executables := []string{}
-
-	envEditor := os.Getenv("EDITOR")
-	switch {
-	case envEditor != "" && fileExists(envEditor):
-		// Use editor in the EDITOR environment variables
-		executables = append(executables, envEditor)
-	case editor == "":
-		executables = append(executables, DefaultEditors...)
-	default:
-		if !fileExists(editor) {
-			return ErrEditorNotFound
-		}
-		executables = append(executables, editor)
-	}
-	if len(executables) == 0 {
-		return ErrNoEditorFound
+	executables, err := editors()
+	if err != nil {
+		return err
 	}
 
 	tempfile, err := copyFileToTemp(configJson)
@@ -54,8 +63,9 @@ func EditConfig(configJson string) error {
 		close(sigCh)
 	}()
 
+	line := 0
 	for {
-		if err := tryExec(ctx, executables, tempfile); err != nil {
+		if err := tryExec(ctx, executables, line, tempfile); err != nil {
 			return err
 		}
 
@@ -69,24 +79,26 @@ func EditConfig(configJson string) error {
 		}
 
 		var config sshtun.Tunnels
-		if err := json.Unmarshal(marshalledConfig, &config); err != nil {
-			fmt.Printf("Error encoding json: %v\n", err)
-			fmt.Printf("Edit file again? [Y/n] ")
-		retryQuestion:
-			s := bufio.NewScanner(os.Stdin)
-			s.Scan()
-			if ctx.Err() != nil {
-				break
+		line = 0
+		err = decodeConfig(marshalledConfig, &config)
+		if err != nil {
+			var column int
+			if offset, ok := jsonErrorOffset(err); ok {
+				line, column = lineAndColumn(marshalledConfig, offset)
+				fmt.Printf("Error decoding json at line %d, column %d: %v\n", line, column, err)
+				fmt.Print(errorContext(marshalledConfig, line, column))
+			} else {
+				fmt.Printf("Error decoding json: %v\n", err)
 			}
-			switch {
-			case s.Text() == "", strings.EqualFold(s.Text(), "y"), strings.EqualFold(s.Text(), "yes"):
-				continue
-			case strings.EqualFold(s.Text(), "n"), strings.EqualFold(s.Text(), "no"):
+		} else if err = config.Validate(); err != nil {
+			fmt.Printf("Invalid configuration: %v\n", err)
+		}
+		if err != nil {
+			again, aerr := ask(ctx, "Edit file again? [Y/n] ", true)
+			if aerr != nil || !again {
 				return err
-			default:
-				fmt.Printf("Sorry, please answer yes or no. Edit file again? [Y/n] ")
-				goto retryQuestion
 			}
+			continue
 		}
 
 		// Store config
@@ -105,3 +117,98 @@ func EditConfig(configJson string) error {
 	}
 	return nil
 }
+
+// ask prints question and reads a yes or no answer from stdin, an
+// empty answer returns def.
+func ask(ctx context.Context, question string, def bool) (bool, error) {
+	fmt.Print(question)
+	s := bufio.NewScanner(os.Stdin)
+	for s.Scan() {
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		switch {
+		case s.Text() == "":
+			return def, nil
+		case strings.EqualFold(s.Text(), "y"), strings.EqualFold(s.Text(), "yes"):
+			return true, nil
+		case strings.EqualFold(s.Text(), "n"), strings.EqualFold(s.Text(), "no"):
+			return false, nil
+		default:
+			fmt.Print("Sorry, please answer yes or no. " + question)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return false, err
+	}
+	return false, io.EOF
+}
+
+// decodeConfig decodes the configuration json in data into config.
+// Anything but whitespace after it (e.g a second object pasted or a
+// stray }) is a trailingJsonError instead of being dropped on save.
+func decodeConfig(data []byte, config *sshtun.Tunnels) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if err := dec.Decode(config); err != nil {
+		return err
+	}
+	if rest := bytes.TrimLeft(data[dec.InputOffset():], " \t\r\n"); len(rest) > 0 {
+		return &trailingJsonError{Offset: int64(len(data)-len(rest)) + 1, char: rest[0]}
+	}
+	return nil
+}
+
+// jsonErrorOffset returns the input offset of a json.SyntaxError,
+// json.UnmarshalTypeError or trailingJsonError.
+func jsonErrorOffset(err error) (int64, bool) {
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	var trailingError *trailingJsonError
+	switch {
+	case errors.As(err, &syntaxError):
+		return syntaxError.Offset, true
+	case errors.As(err, &typeError):
+		return typeError.Offset, true
+	case errors.As(err, &trailingError):
+		return trailingError.Offset, true
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return -1, true
+	}
+	return 0, false
+}
+
+// lineAndColumn translates a byte offset in data into a 1-based line
+// and column. A negative offset means the end of data. The offset of
+// a json error points just past the offending byte.
+func lineAndColumn(data []byte, offset int64) (int, int) {
+	switch {
+	case offset < 0 || offset > int64(len(data)):
+		offset = int64(len(data))
+	case offset > 0:
+		offset--
+	}
+	line, column := 1, 1
+	for _, b := range data[:offset] {
+		if b == '\n' {
+			line++
+			column = 1
+		} else {
+			column++
+		}
+	}
+	return line, column
+}
+
+// errorContext returns up to two lines before and after line with a
+// caret under column.
+func errorContext(data []byte, line, column int) string {
+	lines := strings.Split(string(data), "\n")
+	var b strings.Builder
+	for i := max(line-3, 0); i < min(line+2, len(lines)); i++ {
+		fmt.Fprintf(&b, "%5d | %s\n", i+1, lines[i])
+		if i == line-1 {
+			fmt.Fprintf(&b, "      | %s^\n", strings.Repeat(" ", max(column-1, 0)))
+		}
+	}
+	return b.String()
+}
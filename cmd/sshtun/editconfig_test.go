@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sa6mwa/sshtun"
+)
+
+func TestJsonErrorPosition(t *testing.T) {
+	for _, test := range []struct {
+		input        string
+		line, column int
+	}{
+		{"{\n  \"tunnels\": [\n    {\"name\": \"a\",}\n  ]\n}\n", 3, 18},
+		{"{\n  \"tunnels\": [\n    {\"local_mtu\": \"big\"}\n  ]\n}\n", 3, 23},
+		{"{\n  \"tunnels\": [\n", 3, 1},
+		{"{\n  \"tunnels\": []\n}\n}\n", 4, 1},
+		{"{\"tunnels\": []}\n  {\"tunnels\": []}\n", 2, 3},
+	} {
+		var config sshtun.Tunnels
+		err := decodeConfig([]byte(test.input), &config)
+		if err == nil {
+			t.Fatalf("expected error decoding %q", test.input)
+		}
+		offset, ok := jsonErrorOffset(err)
+		if !ok {
+			t.Fatalf("expected an offset from %v", err)
+		}
+		line, column := lineAndColumn([]byte(test.input), offset)
+		if line != test.line || column != test.column {
+			t.Errorf("%v: got line %d column %d, expected line %d column %d", err, line, column, test.line, test.column)
+		}
+	}
+	context := errorContext([]byte("a\nb\nc\nd\ne\nf\n"), 3, 1)
+	if !strings.Contains(context, "    3 | c\n      | ^\n") || strings.Contains(context, "| f") {
+		t.Errorf("unexpected context:\n%s", context)
+	}
+}
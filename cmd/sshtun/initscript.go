@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/alessio/shellescape"
+)
+
+const (
+	INIT_SYSTEMD string = "systemd"
+	INIT_OPENRC  string = "openrc"
+	INIT_SYSV    string = "sysv"
+
+	DEFAULT_INIT_SCRIPT string = "/etc/init.d/sshtun"
+)
+
+var (
+	ErrUnsupportedInitSystem    error = errors.New("unsupported init system, use systemd, openrc or sysv")
+	ErrUserModeNotSupported     error = errors.New("-user is only supported with systemd")
+	ErrHardenedNotSupported     error = errors.New("-hardened is only supported with systemd")
+	ErrCapabilitiesNotSupported error = errors.New("-capabilities is only supported with systemd")
+)
+
+var defaultOpenRCScript string = `#!/sbin/openrc-run
+
+name="sshtun"
+description="sshtun"
+command=%s
+command_args=%s
+command_user=%s
+command_background="yes"
+pidfile="/run/${RC_SVCNAME}.pid"
+output_log="/var/log/${RC_SVCNAME}.log"
+error_log="/var/log/${RC_SVCNAME}.log"
+
+depend() {
+	need net
+	after firewall
+}
+
+start_pre() {
+	checkpath --file --owner %s --mode 0640 "/var/log/${RC_SVCNAME}.log"
+}
+`
+
+var defaultSysvScript string = `#!/bin/sh
+### BEGIN INIT INFO
+# Provides:          %s
+# Required-Start:    $network $remote_fs $syslog
+# Required-Stop:     $network $remote_fs $syslog
+# Default-Start:     2 3 4 5
+# Default-Stop:      0 1 6
+# Short-Description: sshtun
+# Description:       Point-to-point tun tunnels over SSH
+### END INIT INFO
+
+NAME=%s
+DAEMON=%s
+DAEMON_USER=%s
+PIDFILE="/run/$NAME.pid"
+LOGFILE="/var/log/$NAME.log"
+
+. /lib/lsb/init-functions
+
+case "$1" in
+start)
+	log_daemon_msg "Starting $NAME" "$NAME"
+	touch "$LOGFILE" && chown "$DAEMON_USER" "$LOGFILE"
+	start-stop-daemon --start --quiet --background --make-pidfile --pidfile "$PIDFILE" \
+		--chuid "$DAEMON_USER" --output "$LOGFILE" --exec "$DAEMON" -- %s
+	log_end_msg $?
+	;;
+stop)
+	log_daemon_msg "Stopping $NAME" "$NAME"
+	start-stop-daemon --stop --quiet --retry=TERM/30/KILL/5 --pidfile "$PIDFILE" --remove-pidfile
+	log_end_msg $?
+	;;
+restart|force-reload)
+	"$0" stop
+	"$0" start
+	;;
+status)
+	status_of_proc -p "$PIDFILE" "$DAEMON" "$NAME"
+	;;
+*)
+	echo "Usage: $0 {start|stop|restart|force-reload|status}" >&2
+	exit 3
+	;;
+esac
+`
+
+// defaultServicePath returns the default unit or init script path
+// for initSystem.
+func defaultServicePath(initSystem string) string {
+	if initSystem == INIT_OPENRC || initSystem == INIT_SYSV {
+		return DEFAULT_INIT_SCRIPT
+	}
+	return systemdUnit
+}
+
+// RenderServiceFile returns the default systemd unit, OpenRC script
+// or LSB (sysvinit) init script for initSystem. pth is the path the
+// file will be installed to, the sysv script provides its base name.
+func RenderServiceFile(initSystem, pth, configJson string, opts UnitOptions) (string, error) {
+	if initSystem == INIT_SYSTEMD {
+		return RenderSystemdUnit(configJson, strings.HasSuffix(filepath.Base(pth), "@.service"), opts)
+	}
+	if opts.UserMode {
+		return "", ErrUserModeNotSupported
+	}
+	if opts.Hardened {
+		return "", ErrHardenedNotSupported
+	}
+	if opts.Capabilities {
+		return "", ErrCapabilitiesNotSupported
+	}
+	absolutePath, args, err := serviceCommand(configJson, "")
+	if err != nil {
+		return "", err
+	}
+	u, g, err := currentUserAndGroup()
+	if err != nil {
+		return "", err
+	}
+	owner := u + ":" + g
+	switch initSystem {
+	case INIT_OPENRC:
+		// openrc-run evaluates command_args, quote every argument
+		// inside the quoted value.
+		return fmt.Sprintf(defaultOpenRCScript, shellescape.Quote(absolutePath), shellescape.Quote(shellescape.QuoteCommand(args)), shellescape.Quote(owner), shellescape.Quote(owner)), nil
+	case INIT_SYSV:
+		name := filepath.Base(pth)
+		return fmt.Sprintf(defaultSysvScript, name, shellescape.Quote(name), shellescape.Quote(absolutePath), shellescape.Quote(owner), shellescape.QuoteCommand(args)), nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrUnsupportedInitSystem, initSystem)
+	}
+}
+
+// WriteServiceFile writes a default systemd unit, OpenRC script or
+// LSB (sysvinit) init script depending on initSystem.
+func WriteServiceFile(initSystem, pth, configJson string, opts UnitOptions) error {
+	if initSystem == INIT_SYSTEMD {
+		m := NewSystemdManager(pth, systemctl, opts.UserMode)
+		m.Hardened = opts.Hardened
+		m.Capabilities = opts.Capabilities
+		return m.WriteDefaultUnit(configJson)
+	}
+	script, err := RenderServiceFile(initSystem, pth, configJson, opts)
+	if err != nil {
+		return err
+	}
+	restore, err := seteuidRoot(false)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	if err := os.WriteFile(pth, []byte(script), 0755); err != nil {
+		return fmt.Errorf("unable to write init script %s: %w", pth, err)
+	}
+	return nil
+}
+
+// InstallService writes the default unit or init script if pth does
+// not exist, enables and (re)starts the service using the tools of
+// initSystem. instance is the instance name if pth is a systemd
+// template unit. Returns the status output.
+func InstallService(ctx context.Context, initSystem, pth, instance, configJson string, opts UnitOptions) ([]byte, error) {
+	if initSystem == INIT_SYSTEMD {
+		m := NewSystemdManager(pth, systemctl, opts.UserMode)
+		m.Hardened = opts.Hardened
+		m.Capabilities = opts.Capabilities
+		m.Instance = instance
+		return m.Install(ctx, configJson)
+	}
+	if opts.UserMode {
+		return nil, ErrUserModeNotSupported
+	}
+	if !fileExists(pth) {
+		if err := WriteServiceFile(initSystem, pth, configJson, opts); err != nil {
+			return nil, err
+		}
+	}
+	restore, err := seteuidRoot(false)
+	if err != nil {
+		return nil, err
+	}
+	defer restore()
+	name := filepath.Base(pth)
+	var commands [][]string
+	switch initSystem {
+	case INIT_OPENRC:
+		commands = [][]string{
+			{"rc-update", "add", name, "default"},
+			{"rc-service", name, "restart"},
+			{"rc-service", name, "status"},
+		}
+	case INIT_SYSV:
+		commands = [][]string{
+			{"update-rc.d", name, "defaults"},
+			{pth, "restart"},
+			{pth, "status"},
+		}
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedInitSystem, initSystem)
+	}
+	var out []byte
+	for _, command := range commands {
+		if out, err = runCommand(ctx, command...); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// UninstallService stops, disables and removes the service at pth,
+// detecting the init system from what exists on disk. instance is
+// the instance name if pth is a systemd template unit.
+func UninstallService(ctx context.Context, pth, instance string, userMode bool) error {
+	initSystem, pth := DetectInitSystem(pth)
+	if initSystem == INIT_SYSTEMD {
+		m := NewSystemdManager(pth, systemctl, userMode)
+		m.Instance = instance
+		return m.Uninstall(ctx)
+	}
+	restore, err := seteuidRoot(false)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	name := filepath.Base(pth)
+	var commands [][]string
+	switch initSystem {
+	case INIT_OPENRC:
+		commands = [][]string{
+			{"rc-service", name, "stop"},
+			{"rc-update", "del", name, "default"},
+		}
+	case INIT_SYSV:
+		commands = [][]string{
+			{pth, "stop"},
+			{"update-rc.d", "-f", name, "remove"},
+		}
+	}
+	for _, command := range commands {
+		if _, err := runCommand(ctx, command...); err != nil {
+			return err
+		}
+	}
+	return os.Remove(pth)
+}
+
+// DetectInitSystem returns the init system of the installed service
+// at pth and the path to its unit or script: a file ending in
+// .service is a systemd unit unless it does not exist while
+// DEFAULT_INIT_SCRIPT does. The shebang of an init script tells OpenRC
+// (openrc-run) from sysvinit.
+func DetectInitSystem(pth string) (string, string) {
+	if strings.HasSuffix(pth, ".service") {
+		if fileExists(pth) || !fileExists(DEFAULT_INIT_SCRIPT) {
+			return INIT_SYSTEMD, pth
+		}
+		pth = DEFAULT_INIT_SCRIPT
+	}
+	f, err := os.Open(pth)
+	if err != nil {
+		return INIT_SYSTEMD, pth
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	if s.Scan() && strings.Contains(s.Text(), "openrc-run") {
+		return INIT_OPENRC, pth
+	}
+	return INIT_SYSV, pth
+}
+
+func runCommand(ctx context.Context, command ...string) ([]byte, error) {
+	out, err := exec.CommandContext(ctx, command[0], command[1:]...).CombinedOutput()
+	if err != nil {
+		if len(out) > 0 {
+			return nil, fmt.Errorf("%s: %w: %s", strings.Join(command, " "), err, strings.TrimSpace(string(out)))
+		}
+		return nil, fmt.Errorf("%s: %w", strings.Join(command, " "), err)
+	}
+	return out, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderServiceFileQuotesArguments(t *testing.T) {
+	defer func(args []string) { os.Args = args }(os.Args)
+	os.Args = []string{"/usr/local/bin/sshtun"}
+	configJson := filepath.Join(t.TempDir(), "my tunnels", "config.json")
+	sysv, err := RenderServiceFile(INIT_SYSV, DEFAULT_INIT_SCRIPT, configJson, UnitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `--exec "$DAEMON" -- -config '` + configJson + `'`; !strings.Contains(sysv, want) {
+		t.Errorf("expected %q in:\n%s", want, sysv)
+	}
+	openrc, err := RenderServiceFile(INIT_OPENRC, DEFAULT_INIT_SCRIPT, configJson, UnitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("test requires sh")
+	}
+	script := filepath.Join(t.TempDir(), "sshtun")
+	if err := os.WriteFile(script, []byte(openrc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// openrc-run passes command_args through eval.
+	out, err := exec.Command("sh", "-c", `. "$1"; eval "set -- $command_args"; printf '%s\n' "$@"`, "sh", script).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if got, want := strings.Split(strings.TrimSpace(string(out)), "\n"), []string{"-config", configJson}; strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("expected command_args %q, got %q", want, got)
+	}
+}
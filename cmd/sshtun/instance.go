@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrInvalidInstance      error = errors.New("invalid instance name")
+	ErrInstanceNotSupported error = errors.New("-instance is only supported with systemd")
+)
+
+var instanceNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.:-]+$`)
+
+// ValidateInstance returns an error if name can not be used as a
+// systemd template instance name.
+func ValidateInstance(name string) error {
+	if !instanceNameRegexp.MatchString(name) {
+		return fmt.Errorf("%w %q, use letters, digits, -, _, . or :", ErrInvalidInstance, name)
+	}
+	return nil
+}
+
+// instanceDirectory is where per-instance configuration, pid file
+// and control socket are kept: /etc/sshtun for root, otherwise
+// ~/.config/sshtun.
+func instanceDirectory() string {
+	if os.Getuid() == 0 {
+		return "/etc/sshtun"
+	}
+	return "~/.config/sshtun"
+}
+
+// instanceConfigFile returns the configuration file of instance, e.g
+// ~/.config/sshtun/office.json.
+func instanceConfigFile(instance string) string {
+	return instanceDirectory() + "/" + instance + ".json"
+}
+
+// instancePidFile returns the pid file of instance.
+func instancePidFile(instance string) string {
+	if os.Getuid() == 0 {
+		return "/run/sshtun@" + instance + ".pid"
+	}
+	return "~/.config/sshtun/" + instance + ".pid"
+}
+
+// instanceControlSocket returns the control socket of instance.
+func instanceControlSocket(instance string) string {
+	return "~/.config/sshtun/" + instance + ".sock"
+}
+
+// templateUnitPath returns the template unit path for unitPath, e.g
+// /etc/systemd/system/sshtun@.service for
+// /etc/systemd/system/sshtun.service.
+func templateUnitPath(unitPath string) string {
+	dir, base := filepath.Split(unitPath)
+	name := strings.TrimSuffix(base, ".service")
+	if strings.HasSuffix(name, "@") {
+		return unitPath
+	}
+	return dir + name + "@.service"
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/sa6mwa/sshtun"
+)
+
+// List writes a table of every tunnel in tunnels to w: name, whether
+// it is enabled, remote and the local and remote networks, marked
+// (pool) if assigned from address_pool.
+func List(w io.Writer, tunnels *sshtun.Tunnels) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tENABLED\tREMOTE\tLOCAL NETWORK\tREMOTE NETWORK\t")
+	for _, tunnel := range tunnels.Tunnels {
+		if tunnel == nil {
+			continue
+		}
+		pool := ""
+		if tunnel.AddressFromPool {
+			pool = "(pool)"
+		}
+		fmt.Fprintf(tw, "%s\t%t\t%s\t%s\t%s\t%s\n", tunnel.Name, tunnel.Enable, tunnel.Remote, tunnel.LocalNetwork, tunnel.RemoteNetwork, pool)
+	}
+	return tw.Flush()
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -9,14 +11,24 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/sa6mwa/sshtun"
+	"github.com/sa6mwa/sshtun/internal/pkg/logging"
+)
+
+var (
+	ErrStdinConfig error = errors.New("configuration read from stdin (-config -) can not be saved or run as a service")
 )
 
 var (
 	version              string = "v0.0.0"
+	commit               string = ""
+	date                 string = ""
 	copyright            string = "(c) 2023 SA6MWA https://github.com/sa6mwa/sshtun"
 	configJson           string = sshtun.DEFAULT_CONFIG_FILE
 	systemdUnit          string = "/etc/systemd/system/sshtun.service"
@@ -28,28 +40,132 @@ var (
 	uninstallSystemdUnit bool   = false
 	editor               string = ""
 	logLevel             string = slog.LevelInfo.String()
+	controlSocket        string = sshtun.DEFAULT_CONTROL_SOCKET
+	ctlCommand           string = ""
+	showStatus           bool   = false
+	saveConfig           bool   = false
+	checkConfig          bool   = false
+	checkResolve         bool   = false
+	checkConnect         bool   = false
+	once                 bool   = false
+	setValues            assignments
+	getPath              string        = ""
+	completionShell      string        = ""
+	listNames            bool          = false
+	listTunnels          bool          = false
+	showVersion          bool          = false
+	outputFormat         string        = "text"
+	logSyslog            string        = ""
+	logSyslogFacility    string        = "daemon"
+	logJournald          bool          = false
+	pidFilePath          string        = defaultPidFile()
+	notifyAll            bool          = false
+	userUnit             bool          = false
+	enableLinger         bool          = false
+	initSystem           string        = INIT_SYSTEMD
+	printUnit            bool          = false
+	printConfig          bool          = false
+	instance             string        = ""
+	hardenedUnit         bool          = false
+	installRemoteHelper  string        = ""
+	speedTest            string        = ""
+	speedTestDuration    time.Duration = sshtun.DEFAULT_SPEEDTEST_DURATION
+	diagnose             string        = ""
+	selfTest             bool          = false
+	capabilitiesUnit     bool          = false
+	dropPrivileges       bool          = false
+	provision            bool          = false
+	debugListen          string        = ""
+	debugAllowRemote     bool          = false
+	override             overrides
 )
 
 func main() {
+	// Serve as the privileged helper if re-executed with -privop,
+	// otherwise create TUN devices through it.
+	sshtun.PrivOpMain()
+
 	flag.CommandLine.SetOutput(os.Stderr)
 	flag.Usage = func() {
 		fmt.Fprintln(os.Stderr, "sshtun", version, copyright)
 		fmt.Fprintln(os.Stderr, "usage:", os.Args[0], "[options]")
 		flag.PrintDefaults()
 	}
-	flag.StringVar(&configJson, "config", configJson, "Configuration `file` as json")
+	flag.StringVar(&configJson, "config", configJson, "Configuration `file` as json, - reads it from stdin")
 	flag.BoolVar(&generateConfig, "example", generateConfig, "Generate an example configuration if "+configJson+" does not exist")
 	flag.BoolVar(&editConfig, "edit", editConfig, "Edit configuration json, implies -example if file does not exist")
-	flag.StringVar(&editor, "editor", editor, "Use `path` to edit configuration json or systemd unit")
+	flag.StringVar(&editor, "editor", editor, "Use editor `command` to edit configuration json or systemd unit, may include arguments, e.g \"code --wait\"")
 	flag.StringVar(&systemdUnit, "systemd-unit", systemdUnit, "If issuing -install or -edit-unit, `path` to systemd unit file")
+	flag.BoolVar(&printUnit, "print-unit", printUnit, "Print the default unit or init script -edit-unit would create to stdout, touches nothing")
+	flag.BoolVar(&printConfig, "print-config", printConfig, "Print the effective configuration with defaults applied as json to stdout")
 	flag.BoolVar(&editSystemdUnit, "edit-unit", editSystemdUnit, "Edit systemd unit, create a default if file does not exist")
-	flag.BoolVar(&installSystemdUnit, "install", installSystemdUnit, "Install sshtun as a systemd service, use -edit-unit to generate an example unit")
+	flag.BoolVar(&installSystemdUnit, "install", installSystemdUnit, "Install sshtun as a systemd service, writes a default unit first if it does not exist (see -edit-unit)")
 	flag.BoolVar(&uninstallSystemdUnit, "uninstall", uninstallSystemdUnit, "Uninstall sshtun as a systemd service and remove unit file")
+	flag.BoolVar(&userUnit, "user", userUnit, "With -install, -uninstall or -edit-unit, use a user-level systemd unit in "+defaultUserSystemdUnitPath+" and systemctl --user")
+	flag.BoolVar(&enableLinger, "linger", enableLinger, "With -install -user, also run loginctl enable-linger so tunnels survive logout")
+	flag.BoolVar(&hardenedUnit, "hardened", hardenedUnit, "With -edit-unit, -install or -print-unit, generate a sandboxed systemd unit (ProtectSystem=strict, capabilities or setuid)")
+	flag.BoolVar(&capabilitiesUnit, "capabilities", capabilitiesUnit, "With -edit-unit, -install or -print-unit, run the service as the current user with CAP_NET_ADMIN (AmbientCapabilities) instead of root or setuid")
+	flag.StringVar(&instance, "instance", instance, "Use the sshtun@`name`.service template unit and the per-instance configuration "+instanceConfigFile("name")+", pid file and control socket")
+	flag.StringVar(&initSystem, "init-system", initSystem, "With -install or -edit-unit, generate a service for init `system` systemd, openrc or sysv (script in "+DEFAULT_INIT_SCRIPT+")")
 	flag.StringVar(&systemctl, "systemctl", systemctl, "If issuing -install, `path` to systemctl")
+	flag.StringVar(&controlSocket, "control-socket", controlSocket, "Unix socket `path` for runtime control of a running sshtun, empty disables it")
+	flag.BoolVar(&showStatus, "status", showStatus, "Print the state and active DNS configuration of the tunnels named as arguments (or every tunnel) of a running sshtun, same as -ctl status")
+	flag.StringVar(&ctlCommand, "ctl", ctlCommand, "Send `command` (enable, disable, reconnect, level or status) to a running sshtun for the tunnel named as argument, level takes the log level (or inherit) as last argument")
+	flag.BoolVar(&saveConfig, "save", saveConfig, "With -ctl enable or disable, also save the change to the configuration file")
+	flag.BoolVar(&checkConfig, "check", checkConfig, "Validate configuration and private keys without opening any tunnel, exit 0 only if all tunnels pass")
+	flag.BoolVar(&checkResolve, "check-dns", checkResolve, "With -check, also resolve the remote host of each tunnel")
+	flag.BoolVar(&checkConnect, "check-connect", checkConnect, "Like -check, but also attempt the SSH handshake and authentication (no TUN, no root)")
+	flag.StringVar(&installRemoteHelper, "install-remote-helper", installRemoteHelper, "Install tunreadwriter on the remote of `tunnel` as its remote_helper_path (sudo install -m 0755) and exit")
+	flag.StringVar(&speedTest, "speedtest", speedTest, "Measure the echo rate (at most 64 packets per round trip, not link capacity), packet loss and latency of `tunnel` through a running sshtun, or open it for the test if none runs, print the result and exit")
+	flag.DurationVar(&speedTestDuration, "speedtest-duration", speedTestDuration, "With -speedtest, send traffic for `duration` (at most "+sshtun.MAX_SPEEDTEST_DURATION.String()+")")
+	flag.StringVar(&diagnose, "diagnose", diagnose, "Check step by step (configuration, DNS, TCP, SSH, remote helper and sudo, local TUN, ping) what opening `tunnel` takes, print where it breaks with a hint and exit")
+	flag.BoolVar(&selfTest, "selftest", selfTest, "As root, verify this binary end-to-end through a tunnel to an in-process SSH server in a private network namespace and exit, 77 if skipped")
+	flag.BoolVar(&dropPrivileges, "drop-privileges", dropPrivileges, "Permanently drop to the calling user once every enabled tunnel is up, reconnects reuse the TUN devices (same as drop_privileges in the configuration)")
+	flag.BoolVar(&provision, "provision", provision, "As root (e.g via sudo), create the persistent TUN devices of every unprivileged tunnel owned by the calling user and exit")
+	flag.StringVar(&debugListen, "debug-listen", debugListen, "Serve pprof (/debug/pprof/), tunnel counters (/debug/vars), /healthz and /goroutines over http on loopback `address`, e.g 127.0.0.1:6060 (same as debug_listen in the configuration)")
+	flag.BoolVar(&debugAllowRemote, "debug-allow-remote", debugAllowRemote, "Allow -debug-listen on a non-loopback address, the debug listener has no authentication")
+	flag.StringVar(&override.tunnel, "tunnel", override.tunnel, "Only run `tunnel`, the tunnel -remote, -remote-user, -i, -local-net and -remote-net override")
+	flag.StringVar(&override.remote, "remote", override.remote, "Override the remote `host:port` (port 22 if omitted), without a configuration file a one-off tunnel is run")
+	flag.StringVar(&override.remoteUser, "remote-user", override.remoteUser, "Override the remote user `name`")
+	flag.Var(&override.privateKeyFiles, "i", "Override private_key_files with private key `file` (repeatable)")
+	flag.StringVar(&override.localNetwork, "local-net", override.localNetwork, "Override local_network with `network`, e.g 10.9.9.1/30")
+	flag.StringVar(&override.remoteNetwork, "remote-net", override.remoteNetwork, "Override remote_network with `network`, e.g 10.9.9.2/30")
+	flag.BoolVar(&once, "once", once, "Open each enabled tunnel once and exit when any tunnel closes, exit code 2 on setup failure, 3 if a connected tunnel dropped")
+	flag.Var(&setValues, "set", "Set configuration `path=value` non-interactively and save, e.g tunnels.example.enable=true (repeatable)")
+	flag.StringVar(&getPath, "get", getPath, "Print configuration value at dotted `key`, e.g tunnels.example.remote")
+	flag.StringVar(&completionShell, "completion", completionShell, "Print completion script for `shell` (bash or zsh)")
+	flag.BoolVar(&listNames, "names", listNames, "Print the name of every tunnel in the configuration, one per line")
+	flag.BoolVar(&listTunnels, "list", listTunnels, "Print every tunnel in the configuration with its networks, marking addresses assigned from address_pool")
+	flag.BoolVar(&showVersion, "version", showVersion, "Print version and build information and exit")
+	flag.StringVar(&outputFormat, "o", outputFormat, "Output `format` of -version, -speedtest and -diagnose, text or json")
+	flag.StringVar(&logSyslog, "log-syslog", logSyslog, "Log to syslog instead of stderr, `address` is local (/dev/log), unix:///path, udp://host:port or tcp://host:port")
+	flag.StringVar(&logSyslogFacility, "log-syslog-facility", logSyslogFacility, "Syslog `facility` when using -log-syslog, e.g daemon, user or local0-local7")
+	flag.BoolVar(&logJournald, "log-journald", logJournald, "Log structured entries to the journald socket, default when JOURNAL_STREAM is set (falls back to stderr)")
+	flag.StringVar(&pidFilePath, "pidfile", pidFilePath, "Write pid to `file` and refuse to start if another sshtun holds it, empty disables it")
+	flag.BoolVar(&notifyAll, "notify-all", notifyAll, "With systemd Type=notify, signal readiness when all enabled tunnels are up instead of at least one")
 	flag.StringVar(&logLevel, "level", logLevel, fmt.Sprintf("Set log level, can be %s, %s, %s or %s", slog.LevelDebug.String(), slog.LevelInfo.String(), slog.LevelWarn.String(), slog.LevelError.String()))
 
 	flag.Parse()
 
+	var unsupported []string
+	flag.Visit(func(f *flag.Flag) {
+		if slices.Contains(unsupportedFlags, f.Name) {
+			unsupported = append(unsupported, "-"+f.Name)
+		}
+	})
+	if len(unsupported) > 0 {
+		fmt.Fprintf(os.Stderr, "%s not supported on %s\n", strings.Join(unsupported, ", "), runtime.GOOS)
+		os.Exit(2)
+	}
+
+	if showVersion {
+		if err := WriteVersion(os.Stdout, outputFormat); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	logOutput := (io.Writer)(os.Stderr)
 	lvl := new(slog.LevelVar)
 	switch strings.ToUpper(logLevel) {
@@ -69,23 +185,168 @@ func main() {
 		os.Exit(1)
 	}
 
-	l := slog.New(slog.NewJSONHandler(logOutput, &slog.HandlerOptions{
+	var handler slog.Handler = slog.NewJSONHandler(logOutput, &slog.HandlerOptions{
 		Level: lvl,
-	}))
+	})
+	if logSyslog != "" && logOutput != io.Discard {
+		h, err := logging.NewSyslogHandler(logSyslog, logSyslogFacility, &slog.HandlerOptions{Level: lvl})
+		if err != nil {
+			slog.New(handler).Error("Unable to setup syslog logging", "address", logSyslog, "facility", logSyslogFacility, "error", err)
+			os.Exit(1)
+		}
+		defer h.Close()
+		handler = h
+	} else if (logJournald || logging.UnderJournald()) && logOutput != io.Discard && logging.JournaldAvailable() {
+		if h, err := logging.NewJournaldHandler("", handler, &slog.HandlerOptions{Level: lvl}); err == nil {
+			defer h.Close()
+			handler = h
+		}
+	}
+	l := slog.New(handler)
 
 	// Ensure a SETUID u+s execve is running as the calling user, not the effective user.
 
 	if uid, euid := os.Getuid(), os.Geteuid(); uid != euid {
 		gid := os.Getgid()
 		egid := os.Getegid()
-		if err := syscall.Seteuid(uid); err != nil {
+		if err := seteuid(uid); err != nil {
 			l.Error("Unable to set effective user ID to calling user", "error", err, "uid", uid, "euid", euid, "gid", gid, "egid", egid)
 			os.Exit(1)
 		}
 	}
 
-	configurationFile := sshtun.ResolveTildeSlash(configJson)
+	// -selftest
+
+	if selfTest {
+		if err := SelfTest(context.Background(), os.Stdout, l); err != nil {
+			if errors.Is(err, ErrSelfTestSkipped) {
+				os.Exit(SELFTEST_SKIPPED)
+			}
+			l.Error("Selftest failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// -instance
+
+	if instance != "" {
+		if err := ValidateInstance(instance); err != nil {
+			l.Error("Invalid instance", "instance", instance, "error", err)
+			os.Exit(1)
+		}
+		if initSystem != INIT_SYSTEMD {
+			l.Error("Invalid instance", "instance", instance, "error", ErrInstanceNotSupported)
+			os.Exit(1)
+		}
+		if !flagIsSet("config") {
+			configJson = instanceConfigFile(instance)
+		}
+		if !flagIsSet("pidfile") {
+			pidFilePath = instancePidFile(instance)
+		}
+		if !flagIsSet("control-socket") {
+			controlSocket = instanceControlSocket(instance)
+		}
+	}
+
+	// -config -
+
+	if configJson == sshtun.STDIO_CONFIG {
+		if err := stdinConfigConflict(); err != nil {
+			l.Error("Invalid use of configuration from stdin", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := overrideConflict(); err != nil {
+		l.Error("Invalid use of command line overrides", "error", err)
+		os.Exit(1)
+	}
+
+	// -completion
+
+	if completionShell != "" {
+		if err := WriteCompletion(os.Stdout, completionShell, flag.CommandLine); err != nil {
+			l.Error("Unable to generate completion script", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// -ctl
+
+	if showStatus {
+		ctlCommand = "status"
+	}
+	if ctlCommand != "" {
+		if err := Ctl(context.Background(), ctlCommand, flag.Args(), l); err != nil {
+			l.Error("Control command failed", "command", ctlCommand, "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// -speedtest
+
+	if speedTest != "" {
+		if err := SpeedTest(context.Background(), os.Stdout, speedTest, speedTestDuration, outputFormat, l); err != nil {
+			l.Error("Speedtest failed", "name", speedTest, "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	configurationFile, err := sshtun.ResolveTilde(configJson)
+	if err != nil {
+		l.Error("Unable to resolve configuration file", "file", configJson, "error", err)
+		os.Exit(1)
+	}
+	if userUnit && !flagIsSet("systemd-unit") {
+		systemdUnit = sshtun.ResolveTildeSlash(defaultUserSystemdUnitPath)
+	} else if !flagIsSet("systemd-unit") {
+		systemdUnit = defaultServicePath(initSystem)
+	}
+	if instance != "" && !flagIsSet("systemd-unit") {
+		systemdUnit = templateUnitPath(systemdUnit)
+	}
 	systemdUnitFile := sshtun.ResolveTildeSlash(systemdUnit)
+	unitOptions := UnitOptions{UserMode: userUnit, Hardened: hardenedUnit, Capabilities: capabilitiesUnit}
+
+	// -print-unit and -print-config
+
+	if printUnit {
+		unit, err := RenderServiceFile(initSystem, systemdUnitFile, configJson, unitOptions)
+		if err != nil {
+			l.Error("Unable to render unit", "error", err, "init", initSystem)
+			os.Exit(1)
+		}
+		fmt.Print(unit)
+		return
+	}
+
+	if printConfig {
+		tunnels, err := loadConfig(l)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				l.Error("Unable to load configuration file: "+err.Error(), "error", err)
+				os.Exit(1)
+			}
+			tunnels = sshtun.DefaultConfig(l)
+		}
+		effective, err := tunnels.Effective()
+		if err != nil {
+			l.Error("Unable to resolve effective configuration", "error", err)
+			os.Exit(1)
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(effective); err != nil {
+			l.Error("Unable to print configuration", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	// -edit
 
@@ -109,14 +370,20 @@ func main() {
 	// -edit-unit
 
 	if editSystemdUnit {
-		l.Info("Editing systemd unit", "file", systemdUnitFile)
+		l.Info("Editing service", "file", systemdUnitFile, "init", initSystem)
 		if !fileExists(systemdUnitFile) {
-			if err := WriteDefaultSystemdUnit(systemdUnitFile, configJson); err != nil {
+			if err := WriteServiceFile(initSystem, systemdUnitFile, configJson, unitOptions); err != nil {
 				l.Error("Unable to write default systemd unit file", "error", err, "file", systemdUnitFile)
 				os.Exit(1)
 			}
 		}
-		if err := EditFile(context.Background(), systemdUnitFile, true); err != nil {
+		var validate func(context.Context, string) error
+		if initSystem == INIT_SYSTEMD {
+			validate = func(ctx context.Context, file string) error {
+				return VerifySystemdUnit(ctx, file, userUnit)
+			}
+		}
+		if err := EditFile(context.Background(), systemdUnitFile, !userUnit, validate); err != nil {
 			l.Error("Unable to edit systemd unit file", "error", err, "file", systemdUnitFile)
 			os.Exit(1)
 		}
@@ -125,19 +392,38 @@ func main() {
 	// -install
 
 	if installSystemdUnit {
-		l.Info("Installing systemd unit", "file", systemdUnitFile, "systemctl", systemctl)
-		status, err := InstallSystemdUnit(context.Background(), systemdUnitFile)
+		if initSystem == INIT_SYSTEMD {
+			l.Info("Installing systemd unit", "file", systemdUnitFile, "systemctl", systemctl)
+		} else {
+			l.Info("Installing init script", "file", systemdUnitFile, "init", initSystem)
+		}
+		status, err := InstallService(context.Background(), initSystem, systemdUnitFile, instance, configJson, unitOptions)
 		if err != nil {
-			l.Error("Unable to install systemd unit file", "error", err, "file", systemdUnitFile)
+			l.Error("Unable to install service", "error", err, "file", systemdUnitFile)
 			os.Exit(1)
 		}
-		l.Info("Systemd status", "status", string(status), "unit", filepath.Base(systemdUnitFile), "file", systemdUnitFile, "systemctl", systemctl)
+		statusMessage := "Systemd status"
+		if initSystem != INIT_SYSTEMD {
+			statusMessage = "Service status"
+		}
+		l.Info(statusMessage, "status", string(status), "unit", filepath.Base(systemdUnitFile), "file", systemdUnitFile, "systemctl", systemctl)
+		if userUnit && enableLinger {
+			if err := EnableLinger(context.Background()); err != nil {
+				l.Error("Unable to enable lingering", "error", err)
+				os.Exit(1)
+			}
+			l.Info("Enabled lingering, tunnels keep running after logout")
+		}
 	}
 
 	if uninstallSystemdUnit {
-		l.Info("Removing (uninstalling) systemd unit", "file", systemdUnitFile, "systemctl", systemctl)
-		if err := UninstallSystemdUnit(context.Background(), systemdUnitFile); err != nil {
-			l.Error("Unable to uninstall systemd unit file", "error", err, "file", systemdUnitFile)
+		if detected, pth := DetectInitSystem(systemdUnitFile); detected == INIT_SYSTEMD {
+			l.Info("Removing (uninstalling) systemd unit", "file", pth, "systemctl", systemctl)
+		} else {
+			l.Info("Removing (uninstalling) init script", "file", pth, "init", detected)
+		}
+		if err := UninstallService(context.Background(), systemdUnitFile, instance, userUnit); err != nil {
+			l.Error("Unable to uninstall service", "error", err, "file", systemdUnitFile)
 			os.Exit(1)
 		}
 	}
@@ -148,7 +434,7 @@ func main() {
 		return
 	}
 
-	tunnels, err := sshtun.LoadConfig(configJson, l)
+	tunnels, err := loadConfig(l)
 	if err != nil {
 		if os.IsNotExist(err) && generateConfig {
 			tunnels = sshtun.LoadConfigOrReturnDefault(configJson, l)
@@ -163,6 +449,123 @@ func main() {
 		os.Exit(1)
 	}
 
+	// -names
+
+	if listNames {
+		for _, tunnel := range tunnels.Tunnels {
+			fmt.Println(tunnel.Name)
+		}
+		return
+	}
+
+	// -list
+
+	if listTunnels {
+		if err := List(os.Stdout, tunnels); err != nil {
+			l.Error("Unable to list tunnels", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// -set and -get
+
+	if len(setValues) > 0 {
+		if err := SetConfig(tunnels, setValues); err != nil {
+			l.Error("Unable to set configuration value", "file", configurationFile, "error", err)
+			os.Exit(1)
+		}
+		l.Info("Saved configuration", "file", configurationFile)
+		return
+	}
+
+	if getPath != "" {
+		value, err := tunnels.Get(getPath)
+		if err != nil {
+			l.Error("Unable to get configuration value", "file", configurationFile, "error", err)
+			os.Exit(1)
+		}
+		fmt.Println(value)
+		return
+	}
+
+	// -check and -check-connect
+
+	if checkConfig || checkConnect {
+		if err := Check(context.Background(), os.Stdout, tunnels, checkResolve, checkConnect); err != nil {
+			l.Error("Configuration check failed", "file", configurationFile, "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// -diagnose
+
+	if diagnose != "" {
+		if err := Diagnose(context.Background(), os.Stdout, tunnels, diagnose, outputFormat); err != nil {
+			l.Error("Diagnosis failed", "name", diagnose, "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// -install-remote-helper
+
+	if installRemoteHelper != "" {
+		tunnel, err := tunnels.Lookup(installRemoteHelper)
+		if err == nil {
+			err = tunnel.InstallRemoteHelper(context.Background())
+		}
+		if err != nil {
+			l.Error("Unable to install remote helper", "name", installRemoteHelper, "error", err)
+			os.Exit(1)
+		}
+		l.Info("Installed remote helper", "name", tunnel.Name, "remote", tunnel.Remote, "tunreadwriter", tunnel.RemoteHelperPath)
+		return
+	}
+
+	// -provision
+
+	if provision {
+		uid, gid, err := Provision(tunnels, configurationFile)
+		if err != nil {
+			l.Error("Unable to provision TUN devices", "file", configurationFile, "error", err)
+			os.Exit(1)
+		}
+		l.Info("Provisioned TUN devices", "file", configurationFile, "uid", uid, "gid", gid)
+		return
+	}
+
+	// Keep addresses assigned from address_pool stable.
+
+	if assigned := tunnels.UnsavedAddresses(); len(assigned) > 0 && (configJson == sshtun.STDIO_CONFIG || overridden()) {
+		l.Warn("Addresses assigned from address_pool are not saved with a configuration from stdin or overridden on the command line, they may change with the configuration", "tunnels", strings.Join(assigned, ","))
+	} else if len(assigned) > 0 {
+		if err := tunnels.SaveConfig(configJson); err != nil {
+			l.Warn("Unable to save addresses assigned from address_pool, they may change with the configuration", "file", configurationFile, "tunnels", strings.Join(assigned, ","), "error", err)
+		} else {
+			l.Info("Saved addresses assigned from address_pool", "file", configurationFile, "tunnels", strings.Join(assigned, ","))
+		}
+	}
+
+	// -pidfile
+
+	var pidFile *PidFile
+	if pidFilePath != "" {
+		pidFile, err = CreatePidFile(pidFilePath)
+		if err != nil {
+			l.Error("Unable to create pid file", "file", sshtun.ResolveTildeSlash(pidFilePath), "error", err)
+			os.Exit(1)
+		}
+		defer pidFile.Remove()
+	}
+	exit := func(code int) {
+		if pidFile != nil {
+			pidFile.Remove()
+		}
+		os.Exit(code)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -180,11 +583,105 @@ func main() {
 		close(signalChannel)
 	}()
 
-	l.Info("Welcome to sshtun "+version+" "+copyright, "config", configurationFile, "total_tunnels", tunnels.Total(), "enabled_tunnels", tunnels.Enabled())
+	if controlSocket != "" {
+		go func() {
+			if err := tunnels.ServeControl(ctx, controlSocket); err != nil {
+				l.Error("Control socket failed", "socket", sshtun.ResolveTildeSlash(controlSocket), "error", err)
+			}
+		}()
+	}
+
+	if debugListen != "" {
+		tunnels.DebugListen = debugListen
+	}
+	if debugAllowRemote {
+		tunnels.DebugAllowRemote = true
+	}
+	if tunnels.DebugListen != "" {
+		if err := sshtun.CheckDebugListen(tunnels.DebugListen, tunnels.DebugAllowRemote); err != nil {
+			l.Error("Refusing to start debug listener", "address", tunnels.DebugListen, "error", err)
+			exit(1)
+		}
+		go func() {
+			if err := ServeDebug(ctx, tunnels, tunnels.DebugListen, tunnels.DebugAllowRemote, l); err != nil {
+				l.Error("Debug listener failed", "address", tunnels.DebugListen, "error", err)
+			}
+		}()
+	}
+
+	go NotifySystemd(ctx, tunnels, notifyAll, l)
+
+	if dropPrivileges {
+		tunnels.DropPrivileges = true
+	}
+
+	// Unprivileged tunnels use pre-provisioned devices, no privileges
+	// needed if all enabled tunnels are.
+	if !tunnels.Unprivileged() {
+		if err := sshtun.CheckPrivileges(); err != nil {
+			l.Error("Unable to create TUN devices", "error", err)
+			exit(1)
+		}
+	}
+
+	l.Info("Welcome to sshtun "+version+" "+copyright, "config", configurationFile, "total_tunnels", tunnels.Total(), "enabled_tunnels", tunnels.Enabled(), "privileges", sshtun.Privileges())
+
+	if once {
+		if err := tunnels.OpenOnce(ctx); err != nil {
+			l.Error("Tunnel(s) closed", "error", err)
+			cancel()
+			exit(onceExitCode(err))
+		}
+		return
+	}
 
 	if err := tunnels.OpenAll(ctx); err != nil {
-		l.Error("Error establishing tunnel(s)", "error", err)
+		l.Error("Tunnel(s) failed", "error", err)
 		cancel()
-		os.Exit(1)
+		exit(1)
+	}
+}
+
+// flagIsSet returns true if flag name was given on the command line.
+func flagIsSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// saveFlags are the flags saving the configuration back or running it
+// as a service, neither works with -config - or overrides.
+var saveFlags = []string{"example", "edit", "set", "save", "edit-unit", "install", "print-unit"}
+
+// stdinConfigConflict returns an error wrapping ErrStdinConfig naming
+// the first flag in saveFlags given on the command line.
+func stdinConfigConflict() error {
+	for _, name := range saveFlags {
+		if flagIsSet(name) {
+			return fmt.Errorf("%w: -%s", ErrStdinConfig, name)
+		}
+	}
+	return nil
+}
+
+// onceExitCode returns 3 if every tunnel in err from OpenOnce
+// connected and was then dropped, otherwise 2 (authentication,
+// configuration or other setup failure).
+func onceExitCode(err error) int {
+	var errs []error
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	} else {
+		errs = []error{err}
+	}
+	for _, e := range errs {
+		if !errors.Is(e, sshtun.ErrDisconnected) {
+			return 2
+		}
 	}
+	return 3
 }
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/sa6mwa/sshtun"
+)
+
+func TestOnceExitCode(t *testing.T) {
+	setup := &sshtun.TunnelError{Name: "office", Err: fmt.Errorf("%w: invalid handshake from remote helper: EOF", sshtun.ErrRemoteSetupFailed)}
+	auth := &sshtun.TunnelError{Name: "lab", Err: fmt.Errorf("%w: no supported methods remain", sshtun.ErrAuthFailed)}
+	dropped := &sshtun.TunnelError{Name: "home", Err: fmt.Errorf("%w: closed by remote", sshtun.ErrDisconnected)}
+	for _, c := range []struct {
+		err  error
+		want int
+	}{
+		{errors.Join(setup), 2},
+		{errors.Join(auth), 2},
+		{errors.Join(dropped), 3},
+		{errors.Join(dropped, setup), 2},
+		{fmt.Errorf("0 out of 1 tunnel(s) marked enabled in configuration"), 2},
+	} {
+		if got := onceExitCode(c.err); got != c.want {
+			t.Errorf("expected exit code %d for %v, got %d", c.want, c.err, got)
+		}
+	}
+}
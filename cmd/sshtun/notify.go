@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/sa6mwa/sshtun"
+	"github.com/sa6mwa/sshtun/internal/pkg/sdnotify"
+)
+
+const (
+	notifyPollInterval   time.Duration = time.Second
+	notifyStatusInterval time.Duration = 30 * time.Second
+)
+
+// NotifySystemd implements systemd Type=notify readiness. READY=1 is
+// sent once at least one (or with all every) enabled tunnel is up,
+// STATUS is updated whenever the number of tunnels up changes (and
+// periodically) and STOPPING=1 is sent when ctx is cancelled. Does
+// nothing if NOTIFY_SOCKET is not set.
+func NotifySystemd(ctx context.Context, tunnels *sshtun.Tunnels, all bool, l *slog.Logger) {
+	if !sdnotify.Enabled() {
+		return
+	}
+	ready := false
+	lastStatus := ""
+	lastSent := time.Time{}
+	ticker := time.NewTicker(notifyPollInterval)
+	defer ticker.Stop()
+	for {
+		up, enabled := tunnels.Up(), tunnels.Enabled()
+		status := fmt.Sprintf("%d/%d tunnels up", up, enabled)
+		var state []string
+		if !ready && ((all && up >= enabled && enabled > 0) || (!all && up > 0)) {
+			ready = true
+			state = append(state, sdnotify.READY)
+			l.Info("Notifying systemd that sshtun is ready", "status", status)
+		}
+		if len(state) > 0 || status != lastStatus || time.Since(lastSent) >= notifyStatusInterval {
+			state = append(state, sdnotify.Status(status))
+			if _, err := sdnotify.Notify(state...); err != nil {
+				l.Warn("Unable to notify systemd", "error", err)
+			}
+			lastStatus = status
+			lastSent = time.Now()
+		}
+		select {
+		case <-ctx.Done():
+			sdnotify.Notify(sdnotify.STOPPING, sdnotify.Status("shutting down"))
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"strings"
+
+	"github.com/sa6mwa/sshtun"
+)
+
+var (
+	ErrOverrideNeedsTunnel error = errors.New("-remote, -remote-user, -i, -local-net and -remote-net need -tunnel to select the tunnel of the configuration to override")
+	ErrOverrideSave        error = errors.New("a configuration overridden on the command line (-tunnel, -remote, -remote-user, -i, -local-net or -remote-net) can not be saved or run as a service")
+)
+
+// overrideFlags are the flags of overrides, none of them combine with
+// saveFlags.
+var overrideFlags = []string{"tunnel", "remote", "remote-user", "i", "local-net", "remote-net"}
+
+// overrides are tunnel settings given on the command line for ad-hoc
+// use, they are never saved.
+type overrides struct {
+	tunnel          string
+	remote          string
+	remoteUser      string
+	privateKeyFiles sshtun.PrivateKeyFiles
+	localNetwork    string
+	remoteNetwork   string
+}
+
+// any returns true if a setting other than the tunnel name is given.
+func (o *overrides) any() bool {
+	return o.remote != "" || o.remoteUser != "" || len(o.privateKeyFiles) > 0 || o.localNetwork != "" || o.remoteNetwork != ""
+}
+
+// override sets the given settings on tunnel. A remote without port
+// gets port 22, key files replace private_key_files and use_ssh_agent.
+func (o *overrides) override(tunnel *sshtun.SSHTUN) {
+	if o.remote != "" {
+		tunnel.Remote = o.remote
+		if _, _, err := net.SplitHostPort(o.remote); err != nil {
+			tunnel.Remote = net.JoinHostPort(strings.Trim(o.remote, "[]"), "22")
+		}
+	}
+	if o.remoteUser != "" {
+		tunnel.RemoteUser = o.remoteUser
+	}
+	if len(o.privateKeyFiles) > 0 {
+		tunnel.PrivateKeyFiles = append(sshtun.PrivateKeyFiles{}, o.privateKeyFiles...)
+		tunnel.UseSSHAgent = false
+	}
+	if o.localNetwork != "" {
+		tunnel.LocalNetwork = o.localNetwork
+	}
+	if o.remoteNetwork != "" {
+		tunnel.RemoteNetwork = o.remoteNetwork
+	}
+}
+
+// oneOff returns a configuration with a single enabled tunnel with the
+// defaults of NewSecureShellTunneler and o applied, named after the
+// remote host.
+func (o *overrides) oneOff(l *slog.Logger) (*sshtun.Tunnels, error) {
+	tunnel := sshtun.NewSecureShellTunneler(l)
+	tunnel.Enable = true
+	o.override(tunnel)
+	if host, _, err := net.SplitHostPort(tunnel.Remote); err == nil {
+		tunnel.Name = host
+	}
+	tunnels := &sshtun.Tunnels{}
+	tunnels.SetLogger(l)
+	if err := tunnels.Add(tunnel); err != nil {
+		return nil, err
+	}
+	return tunnels, nil
+}
+
+// apply overrides the tunnel named o.tunnel in tunnels and disables
+// every other tunnel. Without -tunnel, tunnels is left as is unless
+// other settings are given, then an error wrapping
+// ErrOverrideNeedsTunnel is returned.
+func (o *overrides) apply(tunnels *sshtun.Tunnels) error {
+	if o.tunnel == "" {
+		if o.any() {
+			return ErrOverrideNeedsTunnel
+		}
+		return nil
+	}
+	selected, err := tunnels.Lookup(o.tunnel)
+	if err != nil {
+		return err
+	}
+	for _, tunnel := range tunnels.Tunnels {
+		tunnel.Enable = tunnel == selected
+	}
+	o.override(selected)
+	// Learn an overridden remote for redact_remotes.
+	tunnels.Refresh()
+	return nil
+}
+
+// loadConfig loads configJson and applies the command line overrides.
+// If the configuration file does not exist, settings given without
+// -tunnel make a one-off tunnel (see oneOff).
+func loadConfig(l *slog.Logger) (*sshtun.Tunnels, error) {
+	tunnels, err := sshtun.LoadConfig(configJson, l)
+	if errors.Is(err, fs.ErrNotExist) && override.tunnel == "" && override.any() {
+		return override.oneOff(l)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := override.apply(tunnels); err != nil {
+		return nil, err
+	}
+	return tunnels, nil
+}
+
+// overridden returns true if any of overrideFlags was given on the
+// command line.
+func overridden() bool {
+	for _, name := range overrideFlags {
+		if flagIsSet(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// overrideConflict returns an error wrapping ErrOverrideSave naming the
+// first flag in saveFlags given together with an override.
+func overrideConflict() error {
+	if !overridden() {
+		return nil
+	}
+	for _, name := range saveFlags {
+		if flagIsSet(name) {
+			return fmt.Errorf("%w: -%s", ErrOverrideSave, name)
+		}
+	}
+	return nil
+}
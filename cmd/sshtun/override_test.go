@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sa6mwa/sshtun"
+)
+
+func TestOverrides(t *testing.T) {
+	o := &overrides{
+		remote:          "vps.example.com",
+		remoteUser:      "alice",
+		privateKeyFiles: sshtun.PrivateKeyFiles{"/keys/one", "/keys/two"},
+		localNetwork:    "10.9.9.1/30",
+		remoteNetwork:   "10.9.9.2/30",
+	}
+	tunnels, err := o.oneOff(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tunnels.Tunnels) != 1 {
+		t.Fatalf("expected a single tunnel, got %d", len(tunnels.Tunnels))
+	}
+	tunnel := tunnels.Tunnels[0]
+	if tunnel.Name != "vps.example.com" || tunnel.Remote != "vps.example.com:22" || tunnel.RemoteUser != "alice" || !tunnel.Enable {
+		t.Errorf("unexpected one-off tunnel %s %s %s enable %t", tunnel.Name, tunnel.Remote, tunnel.RemoteUser, tunnel.Enable)
+	}
+	if tunnel.PrivateKeyFiles.String() != "/keys/one, /keys/two" || tunnel.LocalNetwork != "10.9.9.1/30" || tunnel.RemoteNetwork != "10.9.9.2/30" {
+		t.Errorf("unexpected one-off tunnel keys %q networks %s %s", tunnel.PrivateKeyFiles.String(), tunnel.LocalNetwork, tunnel.RemoteNetwork)
+	}
+	if err := tunnel.Validate(); err != nil {
+		t.Errorf("expected a valid one-off tunnel, got: %v", err)
+	}
+
+	office := sshtun.NewSecureShellTunneler(nil)
+	office.Name, office.Enable, office.UseSSHAgent = "office", false, true
+	lab := sshtun.NewSecureShellTunneler(nil)
+	lab.Name, lab.Enable = "lab", true
+	config := &sshtun.Tunnels{Tunnels: []*sshtun.SSHTUN{office, lab}}
+	if err := o.apply(config); !errors.Is(err, ErrOverrideNeedsTunnel) {
+		t.Errorf("expected %v without -tunnel, got %v", ErrOverrideNeedsTunnel, err)
+	}
+	o.remote = "[2001:db8::1]"
+	o.tunnel = "office"
+	if err := o.apply(config); err != nil {
+		t.Fatal(err)
+	}
+	if !office.Enable || lab.Enable {
+		t.Errorf("expected only office enabled, got office %t lab %t", office.Enable, lab.Enable)
+	}
+	if office.Remote != "[2001:db8::1]:22" || office.UseSSHAgent || len(office.PrivateKeyFiles) != 2 || lab.RemoteUser == "alice" {
+		t.Errorf("unexpected override %s agent %t keys %v", office.Remote, office.UseSSHAgent, office.PrivateKeyFiles)
+	}
+	o.tunnel = "nope"
+	if err := o.apply(config); !errors.Is(err, sshtun.ErrUnknownTunnel) {
+		t.Errorf("expected %v, got %v", sshtun.ErrUnknownTunnel, err)
+	}
+}
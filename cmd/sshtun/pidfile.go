@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/sa6mwa/sshtun"
+)
+
+var (
+	ErrAlreadyRunning error = errors.New("sshtun is already running")
+)
+
+// defaultPidFile returns /run/sshtun.pid when running as root,
+// otherwise ~/.config/sshtun/sshtun.pid.
+func defaultPidFile() string {
+	if os.Getuid() == 0 {
+		return "/run/sshtun.pid"
+	}
+	return "~/.config/sshtun/sshtun.pid"
+}
+
+// PidFile is an exclusively locked file containing the pid of the
+// running sshtun.
+type PidFile struct {
+	path string
+	f    *os.File
+}
+
+// CreatePidFile opens (or creates) pth, takes an exclusive flock on it
+// and writes the current pid. If another live process holds the lock,
+// an error wrapping ErrAlreadyRunning with its pid is returned. A
+// stale pid file left by a dead process is silently reclaimed since
+// the lock dies with the process.
+func CreatePidFile(pth string) (*PidFile, error) {
+	pth, err := sshtun.ResolveTilde(pth)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(pth, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		defer f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			b, _ := os.ReadFile(pth)
+			if pid, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil {
+				return nil, fmt.Errorf("%w as pid %d (pid file %s)", ErrAlreadyRunning, pid, pth)
+			}
+			return nil, fmt.Errorf("%w (pid file %s is locked)", ErrAlreadyRunning, pth)
+		}
+		return nil, fmt.Errorf("unable to lock pid file %s: %w", pth, err)
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &PidFile{path: pth, f: f}, nil
+}
+
+// Path returns the resolved path of the pid file.
+func (p *PidFile) Path() string {
+	return p.path
+}
+
+// Remove removes the pid file and releases the lock.
+func (p *PidFile) Remove() error {
+	err := os.Remove(p.path)
+	if cerr := p.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
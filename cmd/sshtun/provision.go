@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/sa6mwa/sshtun"
+)
+
+var (
+	ErrProvisionOwner error = errors.New("unable to determine a non-root owner for the provisioned tun devices")
+)
+
+// provisionOwner returns the uid and gid that should own the tun
+// devices created by -provision: the user that invoked sudo (SUDO_UID
+// and SUDO_GID) or else the owner of the configuration file. Returns
+// ErrProvisionOwner if that is root.
+func provisionOwner(configFile string) (int, int, error) {
+	if uid, err := strconv.Atoi(os.Getenv("SUDO_UID")); err == nil && uid != 0 {
+		gid, err := strconv.Atoi(os.Getenv("SUDO_GID"))
+		if err != nil {
+			return 0, 0, fmt.Errorf("%w: invalid SUDO_GID: %w", ErrProvisionOwner, err)
+		}
+		return uid, gid, nil
+	}
+	fi, err := os.Stat(configFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	uid, gid, ok := fileOwner(fi)
+	if !ok || uid == 0 {
+		return 0, 0, fmt.Errorf("%w: run it through sudo as the user of the tunnels or use a configuration file owned by that user", ErrProvisionOwner)
+	}
+	return uid, gid, nil
+}
+
+// Provision creates the persistent tun devices of every unprivileged
+// tunnel in tunnels owned by the user of configFile, see
+// provisionOwner.
+func Provision(tunnels *sshtun.Tunnels, configFile string) (int, int, error) {
+	uid, gid, err := provisionOwner(configFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, tunnels.Provision(uid, gid)
+}
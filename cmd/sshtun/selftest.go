@@ -0,0 +1,21 @@
+package main
+
+import (
+	"errors"
+)
+
+const (
+	SELFTEST_LOCAL_TUN      string = "sshtun-st0"
+	SELFTEST_REMOTE_TUN     string = "sshtun-st1"
+	SELFTEST_LOCAL_NETWORK  string = "172.31.255.1/30"
+	SELFTEST_REMOTE_NETWORK string = "172.31.255.2/30"
+
+	// SELFTEST_SKIPPED is the exit status of a skipped -selftest, the
+	// automake convention for a skipped test.
+	SELFTEST_SKIPPED int = 77
+)
+
+var (
+	ErrSelfTestSkipped error = errors.New("selftest skipped")
+	ErrSelfTestFailed  error = errors.New("selftest failed")
+)
@@ -0,0 +1,190 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/sa6mwa/sshtun"
+	"github.com/sa6mwa/sshtun/internal/pkg/netns"
+	"github.com/sa6mwa/sshtun/pkg/sshtest"
+)
+
+var (
+	// selfTestTimeout limits how long the tunnel may take to come up.
+	selfTestTimeout = 30 * time.Second
+	// selfTestDuration is how long packets are sent through the
+	// tunnel.
+	selfTestDuration = time.Second
+)
+
+// SelfTest verifies this binary end-to-end without a remote host: an
+// in-process SSH server (pkg/sshtest) with an ephemeral key runs the
+// commands of sshtun with sh in a new network namespace, standing in
+// for the remote. A tunnel is opened to it, uploading the embedded
+// helper with the cat upload method, and a burst of ICMP echo
+// requests is sent through the tunnel to the remote tunnel address
+// (see sshtun.SSHTUN.SpeedTest). Every step is written to w as PASS or
+// FAIL. Returns ErrSelfTestSkipped unless running as root with
+// /dev/net/tun and ErrSelfTestFailed if a step failed.
+func SelfTest(ctx context.Context, w io.Writer, l *slog.Logger) error {
+	if err := selfTestSupported(); err != nil {
+		fmt.Fprintf(w, "SKIP selftest: %v\n", err)
+		return fmt.Errorf("%w: %w", ErrSelfTestSkipped, err)
+	}
+	step := func(name string, fn func() (string, error)) error {
+		start := time.Now()
+		detail, err := fn()
+		if err != nil {
+			fmt.Fprintf(w, "FAIL %-10s %v\n", name, err)
+			return fmt.Errorf("%w: %s: %w", ErrSelfTestFailed, name, err)
+		}
+		fmt.Fprintf(w, "PASS %-10s %s (%s)\n", name, detail, time.Since(start).Round(time.Millisecond))
+		return nil
+	}
+
+	var remote *netns.NetNS
+	if err := step("namespace", func() (detail string, err error) {
+		remote, err = netns.New()
+		return "created the network namespace of the remote", err
+	}); err != nil {
+		return err
+	}
+	defer remote.Close()
+
+	dir, err := os.MkdirTemp("", "sshtun-selftest-")
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrSelfTestFailed, err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "id_ed25519")
+	var hp *sshtest.HoneyPot
+	if err := step("ssh-server", func() (string, error) {
+		key, public, err := sshtest.GenerateKey()
+		if err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(keyFile, key, 0600); err != nil {
+			return "", err
+		}
+		hp, err = sshtest.NewHoneyPot(
+			sshtest.WithAuthorizedKeys(public),
+			sshtest.WithScriptedHandler("", selfTestShell(remote)),
+		)
+		if err != nil {
+			return "", err
+		}
+		return "listening on " + hp.Addr(), nil
+	}); err != nil {
+		return err
+	}
+	defer hp.Close()
+
+	s := sshtun.NewSecureShellTunneler(l)
+	s.Name = "selftest"
+	s.Remote = hp.Addr()
+	s.RemoteUser = "root"
+	s.PrivateKeyFiles = sshtun.PrivateKeyFiles{keyFile}
+	s.RemoteUploadDirectory = dir
+	s.UploadMethod = sshtun.UPLOAD_CAT
+	s.LocalTunDevice = SELFTEST_LOCAL_TUN
+	s.RemoteTunDevice = SELFTEST_REMOTE_TUN
+	s.LocalNetwork = SELFTEST_LOCAL_NETWORK
+	s.RemoteNetwork = SELFTEST_REMOTE_NETWORK
+	s.MaxReconnectAttempts = 1
+	ctx, cancel := context.WithCancel(sshtun.Context(ctx))
+	defer cancel()
+	opened := make(chan error, 1)
+	if err := step("open", func() (string, error) {
+		go func() { opened <- s.Open(ctx) }()
+		deadline := time.After(selfTestTimeout)
+		for !s.IsUp() {
+			select {
+			case err := <-opened:
+				opened <- err
+				if err == nil {
+					err = errors.New("closed before it came up")
+				}
+				return "", err
+			case <-deadline:
+				return "", fmt.Errorf("not up after %s: %s", selfTestTimeout, s.Status().LastError)
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+		return fmt.Sprintf("%s %s to %s %s", SELFTEST_LOCAL_TUN, SELFTEST_LOCAL_NETWORK, SELFTEST_REMOTE_TUN, SELFTEST_REMOTE_NETWORK), nil
+	}); err != nil {
+		return err
+	}
+
+	err = step("packets", func() (string, error) {
+		result, err := s.SpeedTest(ctx, selfTestDuration)
+		if err != nil {
+			return "", err
+		}
+		if result.Received == 0 {
+			return "", fmt.Errorf("none of %d echo requests answered through the tunnel", result.Sent)
+		}
+		return fmt.Sprintf("%d of %d echo requests answered, rtt p50 %s", result.Received, result.Sent, time.Duration(result.RTTP50)), nil
+	})
+	err = errors.Join(err, step("close", func() (string, error) {
+		cancel()
+		select {
+		case err := <-opened:
+			if err != nil && !errors.Is(err, context.Canceled) {
+				return "", err
+			}
+		case <-time.After(10 * time.Second):
+			return "", errors.New("tunnel did not close")
+		}
+		return "closed the tunnel", nil
+	}))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "PASS selftest")
+	return nil
+}
+
+// selfTestSupported returns why the selftest can not run, nil if it
+// can.
+func selfTestSupported() error {
+	if os.Geteuid() != sshtun.ROOT {
+		return errors.New("requires root")
+	}
+	if _, err := os.Stat(sshtun.DEV_NET_TUN); err != nil {
+		return fmt.Errorf("requires %s: %w", sshtun.DEV_NET_TUN, err)
+	}
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		return fmt.Errorf("requires /bin/sh: %w", err)
+	}
+	return nil
+}
+
+// selfTestShell returns a ScriptedHandler running commands with sh in
+// ns, like sshd on the remote.
+func selfTestShell(ns *netns.NetNS) sshtest.ScriptedHandler {
+	return func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		cmd := exec.Command("/bin/sh", "-c", command)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, stdout, stderr
+		if err := ns.Start(cmd); err != nil {
+			io.WriteString(stderr, err.Error()+"\n")
+			return 127
+		}
+		if err := cmd.Wait(); err != nil {
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				return exitErr.ExitCode()
+			}
+			return 1
+		}
+		return 0
+	}
+}
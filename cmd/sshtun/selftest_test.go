@@ -0,0 +1,34 @@
+//go:build integration
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// TestIntegrationSelfTest runs -selftest, skipped unless root with
+// /dev/net/tun. Run as root with
+//
+//	go test -tags integration -run TestIntegrationSelfTest ./cmd/sshtun
+func TestIntegrationSelfTest(t *testing.T) {
+	var out bytes.Buffer
+	err := SelfTest(context.Background(), &out, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if errors.Is(err, ErrSelfTestSkipped) {
+		t.Skip(strings.TrimSpace(out.String()))
+	}
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out.String())
+	}
+	for _, step := range []string{"namespace", "ssh-server", "open", "packets", "close"} {
+		if !strings.Contains(out.String(), "PASS "+step) {
+			t.Errorf("expected step %s to pass:\n%s", step, out.String())
+		}
+	}
+	t.Logf("\n%s", out.String())
+}
@@ -0,0 +1,19 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// SelfTest is skipped on Windows, the remote it stands up is a Linux
+// network namespace.
+func SelfTest(ctx context.Context, w io.Writer, l *slog.Logger) error {
+	err := errors.New("requires a Linux network namespace for the remote")
+	fmt.Fprintf(w, "SKIP selftest: %v\n", err)
+	return fmt.Errorf("%w: %w", ErrSelfTestSkipped, err)
+}
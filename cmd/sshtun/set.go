@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sa6mwa/sshtun"
+)
+
+// assignments implements flag.Value for the repeatable -set flag.
+type assignments []string
+
+func (a *assignments) String() string {
+	if a == nil {
+		return ""
+	}
+	return strings.Join(*a, " ")
+}
+
+func (a *assignments) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return fmt.Errorf("expected path=value, got %q", value)
+	}
+	*a = append(*a, value)
+	return nil
+}
+
+// SetConfig applies every path=value assignment to tunnels, validates
+// the result and atomically saves it to the configuration file. The
+// file is left untouched if any assignment or the validation fails.
+func SetConfig(tunnels *sshtun.Tunnels, values assignments) error {
+	for _, assignment := range values {
+		path, value, _ := strings.Cut(assignment, "=")
+		if err := tunnels.Set(strings.TrimSpace(path), value); err != nil {
+			return err
+		}
+	}
+	if err := tunnels.Validate(); err != nil {
+		return err
+	}
+	return tunnels.SaveConfigAtomic(configJson)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/sa6mwa/sshtun"
+)
+
+// SpeedTest runs a speedtest (see sshtun.SSHTUN.SpeedTest) of the
+// tunnel named name for duration and writes the result to w as text or
+// json. A running sshtun is asked over the control socket, if none
+// listens the tunnel is opened alone in this process (with the
+// privileges that takes) and closed after the test.
+func SpeedTest(ctx context.Context, w io.Writer, name string, duration time.Duration, format string, l *slog.Logger) error {
+	if format != "" && format != "text" && format != "json" {
+		return fmt.Errorf("unsupported output format %q, use text or json", format)
+	}
+	var result *sshtun.SpeedTestResult
+	var msg string
+	err := os.ErrNotExist
+	if controlSocket != "" {
+		msg, err = sshtun.SendControl(ctx, controlSocket, "speedtest", name, duration.String())
+	}
+	switch {
+	case errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED):
+		l.Info("No sshtun running, opening the tunnel for the speedtest", "name", name)
+		if result, err = openSpeedTest(ctx, name, duration, l); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	default:
+		result = &sshtun.SpeedTestResult{}
+		if err := json.Unmarshal([]byte(msg), result); err != nil {
+			return err
+		}
+	}
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	}
+	_, err = fmt.Fprintln(w, result)
+	return err
+}
+
+// openSpeedTest opens the tunnel named name (and no other), runs the
+// speedtest once it is connected and closes it again.
+func openSpeedTest(ctx context.Context, name string, duration time.Duration, l *slog.Logger) (*sshtun.SpeedTestResult, error) {
+	tunnels, err := loadConfig(l)
+	if err != nil {
+		return nil, err
+	}
+	tunnel, err := tunnels.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tunnels.Tunnels {
+		t.Enable = t == tunnel
+	}
+	if !tunnels.Unprivileged() {
+		if err := sshtun.CheckPrivileges(); err != nil {
+			return nil, err
+		}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	opened := make(chan error, 1)
+	go func() { opened <- tunnels.OpenOnce(ctx) }()
+	defer func() {
+		cancel()
+		<-opened
+	}()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for tunnel.Status().State != sshtun.STATE_CONNECTED {
+		select {
+		case err := <-opened:
+			opened <- err
+			return nil, fmt.Errorf("tunnel %q closed before the speedtest: %w", name, err)
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return tunnel.SpeedTest(ctx, duration)
+}
@@ -0,0 +1,54 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// unsupportedFlags are the flags main rejects on this platform, none
+// on Linux.
+var unsupportedFlags []string
+
+func seteuid(uid int) error {
+	return syscall.Seteuid(uid)
+}
+
+// lockFile takes an exclusive flock on f without blocking, failing
+// with syscall.EWOULDBLOCK if another process holds it.
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+// fileOwner returns the uid and gid owning fi, ok is false if unknown.
+func fileOwner(fi os.FileInfo) (uid, gid int, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
+
+// IsUnixTerminal is constructed from terminal.IsTerminal() and is only
+// reproduced here in order not to import an external dependency.
+func IsUnixTerminal(f *os.File) bool {
+	type UnixTermios struct {
+		Iflag  uint32
+		Oflag  uint32
+		Cflag  uint32
+		Lflag  uint32
+		Line   uint8
+		Cc     [19]uint8
+		Ispeed uint32
+		Ospeed uint32
+	}
+	const TCGETS = 0x5401
+	const SYS_IOCTL = 16
+	fd := f.Fd()
+	var value UnixTermios
+	req := TCGETS
+	_, _, e1 := syscall.Syscall(SYS_IOCTL, uintptr(fd), uintptr(req), uintptr(unsafe.Pointer(&value)))
+	return e1 == 0
+}
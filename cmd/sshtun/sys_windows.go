@@ -0,0 +1,68 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/sa6mwa/sshtun/pkg/tun"
+)
+
+const (
+	lockfileFailImmediately uint32 = 0x1
+	lockfileExclusiveLock   uint32 = 0x2
+
+	// errorLockViolation is ERROR_LOCK_VIOLATION from winerror.h.
+	errorLockViolation syscall.Errno = 33
+)
+
+// unsupportedFlags are the flags main rejects on Windows: systemd
+// units, init scripts, instances and the Linux ways of gaining and
+// dropping privileges.
+var unsupportedFlags = []string{
+	"systemd-unit", "print-unit", "edit-unit", "install", "uninstall",
+	"user", "linger", "hardened", "capabilities", "instance",
+	"init-system", "systemctl", "notify-all", "log-journald",
+	"drop-privileges", "provision",
+}
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+// seteuid fails unless uid is the current (-1 on Windows), there are
+// no uids to switch between.
+func seteuid(uid int) error {
+	if uid == os.Geteuid() {
+		return nil
+	}
+	return fmt.Errorf("seteuid %d: %w", uid, tun.ErrNotSupported)
+}
+
+// lockFile takes an exclusive lock (LockFileEx) on the first byte of f
+// without blocking, failing with syscall.EWOULDBLOCK if another
+// process holds it.
+func lockFile(f *os.File) error {
+	var overlapped syscall.Overlapped
+	r, _, err := procLockFileEx.Call(f.Fd(), uintptr(lockfileExclusiveLock|lockfileFailImmediately), 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if r != 0 {
+		return nil
+	}
+	if errors.Is(err, errorLockViolation) {
+		return syscall.EWOULDBLOCK
+	}
+	return err
+}
+
+// fileOwner returns false, files on Windows are not owned by uids.
+func fileOwner(fi os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+// IsUnixTerminal returns true if f is a console.
+func IsUnixTerminal(f *os.File) bool {
+	var mode uint32
+	return syscall.GetConsoleMode(syscall.Handle(f.Fd()), &mode) == nil
+}
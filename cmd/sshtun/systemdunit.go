@@ -2,21 +2,119 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
-	"os/exec"
 	"os/user"
 	"path/filepath"
+	"slices"
 	"strings"
 	"syscall"
+
+	"github.com/sa6mwa/sshtun"
+)
+
+var (
+	ErrMissingInstance      error = errors.New("a template unit needs an instance, use -instance name")
+	ErrHardenedUserUnit     error = errors.New("-hardened is not supported with -user")
+	ErrCapabilitiesUserUnit error = errors.New("-capabilities is not supported with -user")
+	ErrCapabilitiesRootUser error = errors.New("-capabilities needs a service user other than root, run -install with sudo as that user")
 )
 
+// UnitOptions select the variant of the generated systemd unit.
+type UnitOptions struct {
+	// UserMode renders a user unit without User= and Group=.
+	UserMode bool
+	// Hardened adds sandboxing options, see hardeningOptions.
+	Hardened bool
+	// Capabilities runs the service as an ordinary user granted
+	// CAP_NET_ADMIN by systemd (AmbientCapabilities) instead of
+	// relying on root or a setuid executable.
+	Capabilities bool
+}
+
+const (
+	// PRIVILEGES_SETUID is a setuid-root executable switching
+	// effective uid to root while creating the TUN device.
+	PRIVILEGES_SETUID string = sshtun.PRIVILEGES_SETUID
+	// PRIVILEGES_CAPABILITIES is an executable given CAP_NET_ADMIN by
+	// systemd (AmbientCapabilities).
+	PRIVILEGES_CAPABILITIES string = sshtun.PRIVILEGES_CAPABILITIES
+
+	// capabilityOptions grant CAP_NET_ADMIN as the only capability.
+	capabilityOptions string = "AmbientCapabilities=CAP_NET_ADMIN\nCapabilityBoundingSet=CAP_NET_ADMIN\n"
+	// runtimeDirectoryOptions have systemd create
+	// sshtun.ROUTE_STATE_DIRECTORY owned by the service user, which
+	// can not create it with capabilities only, writable under
+	// ProtectSystem=strict. Preserved as instances share it.
+	runtimeDirectoryOptions string = "RuntimeDirectory=sshtun\nRuntimeDirectoryPreserve=yes\n"
+)
+
+// privilegeMode returns PRIVILEGES_SETUID if executable is owned by
+// root with the setuid bit set, otherwise PRIVILEGES_CAPABILITIES.
+func privilegeMode(executable string) string {
+	fi, err := os.Stat(executable)
+	if err != nil {
+		return PRIVILEGES_CAPABILITIES
+	}
+	if uid, _, ok := fileOwner(fi); ok && uid == 0 && fi.Mode()&os.ModeSetuid != 0 {
+		return PRIVILEGES_SETUID
+	}
+	return PRIVILEGES_CAPABILITIES
+}
+
+// hardeningOptions returns the sandboxing lines of a hardened unit for
+// privilege mode (PRIVILEGES_SETUID or PRIVILEGES_CAPABILITIES) with
+// writePaths writable. A setuid executable needs NoNewPrivileges=no
+// while the capabilities variant gets CAP_NET_ADMIN as the only
+// capability and can not gain more.
+func hardeningOptions(mode string, writePaths []string) string {
+	var b strings.Builder
+	if mode == PRIVILEGES_SETUID {
+		b.WriteString("NoNewPrivileges=no\n")
+	} else {
+		b.WriteString("NoNewPrivileges=yes\n")
+		b.WriteString(capabilityOptions)
+	}
+	b.WriteString("ProtectSystem=strict\n")
+	if len(writePaths) > 0 {
+		// - ignores paths that do not exist (yet).
+		b.WriteString("ReadWritePaths=-" + strings.Join(writePaths, " -") + "\n")
+	}
+	b.WriteString("ProtectHome=read-only\n")
+	b.WriteString("PrivateTmp=true\n")
+	b.WriteString("RestrictAddressFamilies=AF_INET AF_INET6 AF_UNIX AF_NETLINK\n")
+	b.WriteString("DeviceAllow=/dev/net/tun rw\n")
+	return b.String()
+}
+
+// unitWritePaths returns the directories a hardened unit needs to
+// write to: configuration (for -ctl -save and -set), pid file and
+// control socket.
+func unitWritePaths(configJson, pidFile, socket string) []string {
+	var paths []string
+	for _, pth := range []string{configJson, pidFile, socket} {
+		if pth == "" {
+			continue
+		}
+		dir := filepath.Dir(sshtun.ResolveTildeSlash(pth))
+		if !slices.Contains(paths, dir) {
+			paths = append(paths, dir)
+		}
+	}
+	return paths
+}
+
 var defaultSystemdUnit string = `[Unit]
 Description=sshtun
 After=network.target
 
 [Service]
+Type=notify
+NotifyAccess=main
 ExecStart=%s
+PIDFile=%s
 Restart=on-failure
 RestartSec=5s
 WorkingDirectory=/tmp
@@ -24,111 +122,365 @@ StandardOutput=journal
 StandardError=journal
 User=%s
 Group=%s
-
+%s
 [Install]
 WantedBy=multi-user.target
 `
 
-func InstallSystemdUnit(ctx context.Context, pth string) ([]byte, error) {
+var defaultUserSystemdUnit string = `[Unit]
+Description=sshtun
+After=network.target
+
+[Service]
+Type=notify
+NotifyAccess=main
+ExecStart=%s
+PIDFile=%s
+Restart=on-failure
+RestartSec=5s
+WorkingDirectory=/tmp
+StandardOutput=journal
+StandardError=journal
+
+[Install]
+WantedBy=default.target
+`
+
+// defaultUserSystemdUnitPath is where -user installs the unit.
+const defaultUserSystemdUnitPath string = "~/.config/systemd/user/sshtun.service"
+
+// seteuidRoot switches effective uid to root unless userMode is true
+// or already root, returns a function restoring the original euid.
+func seteuidRoot(userMode bool) (func(), error) {
 	origEUID := syscall.Geteuid()
-	if origEUID != 0 {
-		if err := syscall.Seteuid(0); err != nil {
-			return nil, fmt.Errorf("unable to seteuid 0: %w", err)
-		}
-		defer func() {
-			syscall.Seteuid(origEUID)
-		}()
+	if userMode || origEUID == 0 {
+		return func() {}, nil
 	}
-	if out, err := exec.CommandContext(ctx, systemctl, "enable", filepath.Base(systemdUnit)).CombinedOutput(); err != nil {
-		if out != nil && len(out) > 0 {
-			return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
-		}
-		return nil, err
+	if err := seteuid(0); err != nil {
+		return nil, fmt.Errorf("unable to seteuid 0: %w", err)
 	}
-	if out, err := exec.CommandContext(ctx, systemctl, "restart", filepath.Base(systemdUnit)).CombinedOutput(); err != nil {
-		if out != nil && len(out) > 0 {
-			return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
-		}
-		return nil, err
+	return func() {
+		seteuid(origEUID)
+	}, nil
+}
+
+// EnableLinger runs loginctl enable-linger for the current user so
+// that user units keep running after logout.
+func EnableLinger(ctx context.Context) error {
+	u, err := user.Current()
+	if err != nil {
+		return err
+	}
+	_, err = runCommand(ctx, "loginctl", "enable-linger", u.Username)
+	return err
+}
+
+// CommandRunner runs an external command and returns its combined
+// output. SystemdManager uses it for systemctl so that tests can
+// replace exec.
+type CommandRunner interface {
+	Run(ctx context.Context, name string, args ...string) ([]byte, error)
+}
+
+// execRunner is the CommandRunner using os/exec.
+type execRunner struct{}
+
+func (execRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return runCommand(ctx, append([]string{name}, args...)...)
+}
+
+// SystemdManager writes, installs and uninstalls the systemd unit at
+// UnitPath using the systemctl binary at SystemctlPath. In UserMode,
+// systemctl is run with --user and no effective uid switch is made.
+// If UnitPath is a template unit (sshtun@.service), Instance names the
+// instance to install or uninstall.
+type SystemdManager struct {
+	UnitPath      string
+	SystemctlPath string
+	UserMode      bool
+	Hardened      bool
+	Capabilities  bool
+	Instance      string
+	Runner        CommandRunner
+}
+
+// NewSystemdManager returns a SystemdManager running commands with
+// os/exec.
+func NewSystemdManager(unitPath, systemctlPath string, userMode bool) *SystemdManager {
+	return &SystemdManager{
+		UnitPath:      unitPath,
+		SystemctlPath: systemctlPath,
+		UserMode:      userMode,
+		Runner:        execRunner{},
 	}
-	out, err := exec.CommandContext(ctx, systemctl, "status", filepath.Base(systemdUnit)).CombinedOutput()
+}
+
+// Template returns true if UnitPath is a template unit.
+func (m *SystemdManager) Template() bool {
+	return strings.HasSuffix(filepath.Base(m.UnitPath), "@.service")
+}
+
+// Unit returns the unit name, i.e the base name of UnitPath or the
+// instance unit name (e.g sshtun@office.service) for a template.
+func (m *SystemdManager) Unit() string {
+	unit := filepath.Base(m.UnitPath)
+	if m.Template() && m.Instance != "" {
+		return strings.TrimSuffix(unit, "@.service") + "@" + m.Instance + ".service"
+	}
+	return unit
+}
+
+func (m *SystemdManager) systemctl(ctx context.Context, args ...string) ([]byte, error) {
+	if m.UserMode {
+		args = append([]string{"--user"}, args...)
+	}
+	return m.Runner.Run(ctx, m.SystemctlPath, args...)
+}
+
+// WriteDefaultUnit writes the unit from RenderSystemdUnit to
+// UnitPath.
+func (m *SystemdManager) WriteDefaultUnit(configJson string) error {
+	unit, err := RenderSystemdUnit(configJson, m.Template(), UnitOptions{UserMode: m.UserMode, Hardened: m.Hardened, Capabilities: m.Capabilities})
 	if err != nil {
-		if out != nil && len(out) > 0 {
-			return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+		return err
+	}
+	restore, err := seteuidRoot(m.UserMode)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	if m.UserMode {
+		if err := os.MkdirAll(filepath.Dir(m.UnitPath), 0755); err != nil {
+			return err
 		}
-		return nil, err
 	}
-	return out, nil
+	if err := os.WriteFile(m.UnitPath, []byte(unit), 0644); err != nil {
+		return fmt.Errorf("unable to write systemd unit file %s: %w", m.UnitPath, err)
+	}
+	return nil
 }
 
-func UninstallSystemdUnit(ctx context.Context, pth string) error {
-	origEUID := syscall.Geteuid()
-	if origEUID != 0 {
-		if err := syscall.Seteuid(0); err != nil {
-			return fmt.Errorf("unable to seteuid 0: %w", err)
+// Install writes the default unit if UnitPath does not exist, reloads
+// systemd, enables and restarts the unit (or instance). Returns the
+// output of systemctl status.
+func (m *SystemdManager) Install(ctx context.Context, configJson string) ([]byte, error) {
+	if m.Template() && m.Instance == "" {
+		return nil, ErrMissingInstance
+	}
+	if !fileExists(m.UnitPath) {
+		if err := m.WriteDefaultUnit(configJson); err != nil {
+			return nil, err
 		}
-		defer func() {
-			syscall.Seteuid(origEUID)
-		}()
 	}
-
-	if out, err := exec.CommandContext(ctx, systemctl, "stop", filepath.Base(systemdUnit)).CombinedOutput(); err != nil {
-		if out != nil && len(out) > 0 {
-			return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	restore, err := seteuidRoot(m.UserMode)
+	if err != nil {
+		return nil, err
+	}
+	defer restore()
+	for _, args := range [][]string{
+		{"daemon-reload"},
+		{"enable", m.Unit()},
+		{"restart", m.Unit()},
+	} {
+		if _, err := m.systemctl(ctx, args...); err != nil {
+			return nil, err
 		}
+	}
+	return m.systemctl(ctx, "status", m.Unit())
+}
+
+// Uninstall stops and disables the unit, removes UnitPath and reloads
+// systemd. For a template, only the instance is stopped and disabled
+// if Instance is set, otherwise only the template is removed.
+func (m *SystemdManager) Uninstall(ctx context.Context) error {
+	restore, err := seteuidRoot(m.UserMode)
+	if err != nil {
 		return err
 	}
-	if out, err := exec.CommandContext(ctx, systemctl, "disable", filepath.Base(systemdUnit)).CombinedOutput(); err != nil {
-		if out != nil && len(out) > 0 {
-			return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	defer restore()
+	if !m.Template() || m.Instance != "" {
+		for _, args := range [][]string{
+			{"stop", m.Unit()},
+			{"disable", m.Unit()},
+		} {
+			if _, err := m.systemctl(ctx, args...); err != nil {
+				return err
+			}
+		}
+		if m.Template() {
+			return nil
 		}
-		return err
 	}
-	if err := os.Remove(systemdUnit); err != nil {
+	if err := os.Remove(m.UnitPath); err != nil {
 		return err
 	}
-	return nil
+	_, err = m.systemctl(ctx, "daemon-reload")
+	return err
 }
 
-func WriteDefaultSystemdUnit(unitFile, configJson string) error {
-	origEUID := syscall.Geteuid()
-	if origEUID != 0 {
-		if err := syscall.Seteuid(0); err != nil {
-			return fmt.Errorf("unable to seteuid 0: %w", err)
-		}
-		defer func() {
-			syscall.Seteuid(origEUID)
-		}()
-	}
+// serviceOmitFlags are options that are not passed on to the service.
+var serviceOmitFlags = []string{"install", "edit-unit", "edit", "example", "user", "linger", "print-unit", "init-system", "instance", "hardened", "capabilities"}
+
+// instanceOmitFlags are also omitted from a template unit since they
+// are derived from the instance name.
+var instanceOmitFlags = []string{"config", "pidfile", "control-socket"}
+
+// serviceCommand returns the absolute path of the running executable
+// and the arguments the service should run it with, i.e the current
+// arguments without the install and edit options. If instance is not
+// empty (e.g %i in a template unit), -instance is passed instead of
+// -config. A configJson starting with ~ is resolved, the service may
+// run with another (or no) home directory.
+func serviceCommand(configJson, instance string) (string, []string, error) {
 	absolutePath, err := filepath.Abs(os.Args[0])
 	if err != nil {
-		return err
+		return "", nil, err
+	}
+	omit := serviceOmitFlags
+	if instance != "" {
+		omit = append(append([]string{}, serviceOmitFlags...), instanceOmitFlags...)
 	}
 	args := []string{}
 	gotConfig := false
+	skipValue := false
 	for _, arg := range os.Args[1:] {
-		switch arg {
-		case "-install", "-edit-unit", "-edit", "-example":
-		case "-config":
-			gotConfig = true
-		default:
+		if skipValue {
+			skipValue = false
+			continue
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") {
 			args = append(args, arg)
+			continue
 		}
+		if slices.Contains(omit, name) {
+			skipValue = !hasValue && !isBoolFlag(name)
+			continue
+		}
+		if name == "config" {
+			gotConfig = true
+		}
+		args = append(args, arg)
 	}
-	if !gotConfig {
-		args = append(args, "-config", configJson)
+	switch {
+	case instance != "":
+		args = append(args, "-instance", instance)
+	case !gotConfig:
+		pth, err := sshtun.ResolveTilde(configJson)
+		if err != nil {
+			return "", nil, err
+		}
+		args = append(args, "-config", pth)
+	}
+	return absolutePath, args, nil
+}
+
+// isBoolFlag returns true if name is a boolean command line flag.
+func isBoolFlag(name string) bool {
+	f := flag.CommandLine.Lookup(name)
+	if f == nil {
+		return false
+	}
+	bf, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && bf.IsBoolFlag()
+}
+
+// RenderSystemdUnit returns the default systemd unit running the
+// current executable with the current arguments as the current user
+// and group (no User= or Group= in UserMode). If template is true, a
+// template unit (sshtun@.service) is returned where the instance name
+// selects configuration, pid file and control socket. If Hardened,
+// sandboxing options matching how the executable gains privileges are
+// added. If Capabilities, the unit runs as the current (or sudo
+// invoking) user with CAP_NET_ADMIN instead.
+func RenderSystemdUnit(configJson string, template bool, opts UnitOptions) (string, error) {
+	if opts.UserMode && opts.Hardened {
+		return "", ErrHardenedUserUnit
+	}
+	if opts.UserMode && opts.Capabilities {
+		return "", ErrCapabilitiesUserUnit
+	}
+	instance := ""
+	pidFile := pidFilePath
+	socket := controlSocket
+	if template {
+		instance = "%i"
+		pidFile = instancePidFile(instance)
+		socket = instanceControlSocket(instance)
+		configJson = instanceConfigFile(instance)
+	}
+	absolutePath, args, err := serviceCommand(configJson, instance)
+	if err != nil {
+		return "", err
+	}
+	mode := privilegeMode(absolutePath)
+	if opts.Capabilities {
+		mode = PRIVILEGES_CAPABILITIES
+	}
+	serviceOptions := ""
+	if opts.Hardened {
+		serviceOptions = hardeningOptions(mode, unitWritePaths(configJson, pidFile, socket))
+	} else if opts.Capabilities {
+		serviceOptions = capabilityOptions
+	}
+	if opts.Hardened || opts.Capabilities {
+		serviceOptions += runtimeDirectoryOptions
+	}
+	if template {
+		// Escape % in everything but the trailing %i specifier.
+		absolutePath = strings.ReplaceAll(absolutePath, "%", "%%")
+		for i := range args[:len(args)-1] {
+			args[i] = strings.ReplaceAll(args[i], "%", "%%")
+		}
 	}
 	cmd := fmt.Sprintf("%s %s", absolutePath, strings.Join(args, " "))
+	if pidFile, err = sshtun.ResolveTilde(pidFile); err != nil {
+		return "", err
+	}
+	if opts.UserMode {
+		return fmt.Sprintf(defaultUserSystemdUnit, cmd, pidFile), nil
+	}
+	owner, group, err := currentUserAndGroup()
+	if err != nil {
+		return "", err
+	}
+	if opts.Capabilities && owner == "root" {
+		if owner, group, err = sudoUserAndGroup(); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf(defaultSystemdUnit, cmd, pidFile, owner, group, serviceOptions), nil
+}
+
+// currentUserAndGroup returns the name of the current user and its
+// primary group.
+func currentUserAndGroup() (string, string, error) {
 	u, err := user.Current()
 	if err != nil {
-		return err
+		return "", "", err
 	}
 	g, err := user.LookupGroupId(u.Gid)
 	if err != nil {
-		return err
+		return "", "", err
 	}
-	if err := os.WriteFile(unitFile, []byte(fmt.Sprintf(defaultSystemdUnit, cmd, u.Username, g.Name)), 0644); err != nil {
-		return fmt.Errorf("unable to write systemd unit file %s: %w", unitFile, err)
+	return u.Username, g.Name, nil
+}
+
+// sudoUserAndGroup returns the name and primary group of the user
+// that invoked sudo (SUDO_USER). Returns ErrCapabilitiesRootUser if
+// not run through sudo or if that user is root.
+func sudoUserAndGroup() (string, string, error) {
+	name := os.Getenv("SUDO_USER")
+	if name == "" || name == "root" {
+		return "", "", ErrCapabilitiesRootUser
 	}
-	return nil
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", "", err
+	}
+	g, err := user.LookupGroupId(u.Gid)
+	if err != nil {
+		return "", "", err
+	}
+	return u.Username, g.Name, nil
 }
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type recordingRunner struct {
+	commands []string
+}
+
+func (r *recordingRunner) Run(_ context.Context, name string, args ...string) ([]byte, error) {
+	r.commands = append(r.commands, strings.Join(append([]string{name}, args...), " "))
+	return []byte("active"), nil
+}
+
+func TestSystemdManager(t *testing.T) {
+	unitPath := filepath.Join(t.TempDir(), "tunnels.service")
+	runner := &recordingRunner{}
+	m := &SystemdManager{
+		UnitPath:      unitPath,
+		SystemctlPath: "/test/systemctl",
+		UserMode:      true,
+		Runner:        runner,
+	}
+	status, err := m.Install(context.Background(), "/etc/sshtun/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(status) != "active" {
+		t.Errorf("expected status output, got %q", status)
+	}
+	unit, err := os.ReadFile(unitPath)
+	if err != nil {
+		t.Fatalf("expected Install to write the missing unit: %v", err)
+	}
+	if !strings.Contains(string(unit), "ExecStart=") || !strings.Contains(string(unit), "-config /etc/sshtun/config.json") {
+		t.Errorf("unexpected unit:\n%s", unit)
+	}
+	if err := m.Uninstall(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if fileExists(unitPath) {
+		t.Errorf("expected Uninstall to remove %s", unitPath)
+	}
+	expected := []string{
+		"/test/systemctl --user daemon-reload",
+		"/test/systemctl --user enable tunnels.service",
+		"/test/systemctl --user restart tunnels.service",
+		"/test/systemctl --user status tunnels.service",
+		"/test/systemctl --user stop tunnels.service",
+		"/test/systemctl --user disable tunnels.service",
+		"/test/systemctl --user daemon-reload",
+	}
+	if !reflect.DeepEqual(runner.commands, expected) {
+		t.Errorf("unexpected commands\n got: %q\nwant: %q", runner.commands, expected)
+	}
+}
+
+func TestSystemdManagerTemplate(t *testing.T) {
+	unitPath := filepath.Join(t.TempDir(), "sshtun@.service")
+	runner := &recordingRunner{}
+	m := &SystemdManager{
+		UnitPath:      unitPath,
+		SystemctlPath: "systemctl",
+		UserMode:      true,
+		Runner:        runner,
+	}
+	if _, err := m.Install(context.Background(), ""); !errors.Is(err, ErrMissingInstance) {
+		t.Errorf("expected ErrMissingInstance, got %v", err)
+	}
+	m.Instance = "office"
+	if _, err := m.Install(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	unit, err := os.ReadFile(unitPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(unit), "-instance %i\n") || !strings.Contains(string(unit), "PIDFile=") || strings.Contains(string(unit), "-config") {
+		t.Errorf("unexpected template unit:\n%s", unit)
+	}
+	if err := m.Uninstall(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !fileExists(unitPath) {
+		t.Errorf("expected template %s to be kept when uninstalling an instance", unitPath)
+	}
+	expected := []string{
+		"systemctl --user daemon-reload",
+		"systemctl --user enable sshtun@office.service",
+		"systemctl --user restart sshtun@office.service",
+		"systemctl --user status sshtun@office.service",
+		"systemctl --user stop sshtun@office.service",
+		"systemctl --user disable sshtun@office.service",
+	}
+	if !reflect.DeepEqual(runner.commands, expected) {
+		t.Errorf("unexpected commands\n got: %q\nwant: %q", runner.commands, expected)
+	}
+}
+
+// unitDirectives parses the [Service] section of unit into a map.
+func unitDirectives(unit string) map[string]string {
+	directives := map[string]string{}
+	section := ""
+	for _, line := range strings.Split(unit, "\n") {
+		if strings.HasPrefix(line, "[") {
+			section = strings.Trim(line, "[]")
+			continue
+		}
+		if key, value, found := strings.Cut(line, "="); found && section == "Service" {
+			directives[key] = value
+		}
+	}
+	return directives
+}
+
+func TestHardenedUnit(t *testing.T) {
+	unit, err := RenderSystemdUnit("/etc/sshtun/config.json", false, UnitOptions{Hardened: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckSystemdUnit([]byte(unit)); err != nil {
+		t.Errorf("hardened unit does not pass CheckSystemdUnit: %v", err)
+	}
+	if d := unitDirectives(unit); d["ProtectSystem"] != "strict" || !strings.Contains(d["ReadWritePaths"], "-/etc/sshtun") || d["RuntimeDirectory"] != "sshtun" {
+		t.Errorf("unexpected hardened unit:\n%s", unit)
+	}
+	if _, err := RenderSystemdUnit("", false, UnitOptions{Hardened: true, UserMode: true}); !errors.Is(err, ErrHardenedUserUnit) {
+		t.Errorf("expected ErrHardenedUserUnit, got %v", err)
+	}
+
+	for mode, want := range map[string]map[string]string{
+		PRIVILEGES_SETUID: {
+			"NoNewPrivileges":     "no",
+			"AmbientCapabilities": "",
+		},
+		PRIVILEGES_CAPABILITIES: {
+			"NoNewPrivileges":       "yes",
+			"AmbientCapabilities":   "CAP_NET_ADMIN",
+			"CapabilityBoundingSet": "CAP_NET_ADMIN",
+		},
+	} {
+		d := unitDirectives("[Service]\n" + hardeningOptions(mode, []string{"/etc/sshtun", "/run"}))
+		for key, value := range want {
+			if d[key] != value {
+				t.Errorf("%s: expected %s=%q, got %q", mode, key, value, d[key])
+			}
+		}
+		for key, value := range map[string]string{
+			"ProtectSystem":           "strict",
+			"ReadWritePaths":          "-/etc/sshtun -/run",
+			"ProtectHome":             "read-only",
+			"PrivateTmp":              "true",
+			"RestrictAddressFamilies": "AF_INET AF_INET6 AF_UNIX AF_NETLINK",
+			"DeviceAllow":             "/dev/net/tun rw",
+		} {
+			if d[key] != value {
+				t.Errorf("%s: expected %s=%q, got %q", mode, key, value, d[key])
+			}
+		}
+	}
+}
+
+func TestCapabilitiesUnit(t *testing.T) {
+	if _, err := RenderSystemdUnit("", false, UnitOptions{Capabilities: true, UserMode: true}); !errors.Is(err, ErrCapabilitiesUserUnit) {
+		t.Errorf("expected ErrCapabilitiesUserUnit, got %v", err)
+	}
+	owner, _, err := currentUserAndGroup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner == "root" {
+		t.Setenv("SUDO_USER", "")
+		if _, err := RenderSystemdUnit("/etc/sshtun/config.json", false, UnitOptions{Capabilities: true}); !errors.Is(err, ErrCapabilitiesRootUser) {
+			t.Errorf("expected ErrCapabilitiesRootUser, got %v", err)
+		}
+		owner = "nobody"
+		t.Setenv("SUDO_USER", owner)
+	}
+	for _, hardened := range []bool{false, true} {
+		unit, err := RenderSystemdUnit("/etc/sshtun/config.json", false, UnitOptions{Capabilities: true, Hardened: hardened})
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := unitDirectives(unit)
+		if d["User"] != owner || d["AmbientCapabilities"] != "CAP_NET_ADMIN" || d["CapabilityBoundingSet"] != "CAP_NET_ADMIN" || d["RuntimeDirectory"] != "sshtun" {
+			t.Errorf("hardened=%v: unexpected capabilities unit:\n%s", hardened, unit)
+		}
+	}
+}
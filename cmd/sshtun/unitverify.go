@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+var (
+	ErrInvalidUnit error = errors.New("invalid systemd unit")
+)
+
+// VerifySystemdUnit checks the unit file at pth. The structure is
+// checked in Go: known sections, key=value lines, a [Service] section
+// with a non-empty ExecStart whose binary exists. If systemd-analyze
+// is available, systemd-analyze verify is also run and its findings
+// returned. userMode adds --user to systemd-analyze.
+func VerifySystemdUnit(ctx context.Context, pth string, userMode bool) error {
+	data, err := os.ReadFile(pth)
+	if err != nil {
+		return err
+	}
+	if err := CheckSystemdUnit(data); err != nil {
+		return err
+	}
+	analyze, err := exec.LookPath("systemd-analyze")
+	if err != nil {
+		return nil
+	}
+	args := []string{"verify", pth}
+	if userMode {
+		args = append([]string{"--user"}, args...)
+	}
+	if out, err := exec.CommandContext(ctx, analyze, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: systemd-analyze verify: %w\n%s", ErrInvalidUnit, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// CheckSystemdUnit is the structural part of VerifySystemdUnit, all
+// problems found are joined into the returned error.
+func CheckSystemdUnit(data []byte) error {
+	var errs []error
+	section := ""
+	sections := map[string]bool{}
+	var execStart []string
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		switch {
+		case line == "", strings.HasPrefix(line, "#"), strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "["):
+			if !strings.HasSuffix(line, "]") {
+				errs = append(errs, fmt.Errorf("%w: line %d: malformed section header %q", ErrInvalidUnit, n, line))
+				continue
+			}
+			section = line[1 : len(line)-1]
+			sections[section] = true
+		default:
+			key, value, found := strings.Cut(line, "=")
+			if !found {
+				errs = append(errs, fmt.Errorf("%w: line %d: expected key=value, got %q", ErrInvalidUnit, n, line))
+				continue
+			}
+			if section == "" {
+				errs = append(errs, fmt.Errorf("%w: line %d: %s outside of a section", ErrInvalidUnit, n, strings.TrimSpace(key)))
+				continue
+			}
+			if section == "Service" && strings.TrimSpace(key) == "ExecStart" {
+				execStart = append(execStart, strings.TrimSpace(value))
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	for _, required := range []string{"Unit", "Service"} {
+		if !sections[required] {
+			errs = append(errs, fmt.Errorf("%w: missing [%s] section", ErrInvalidUnit, required))
+		}
+	}
+	if sections["Service"] {
+		if len(execStart) == 0 || execStart[len(execStart)-1] == "" {
+			errs = append(errs, fmt.Errorf("%w: ExecStart is missing or empty", ErrInvalidUnit))
+		} else if err := checkExecStart(execStart[len(execStart)-1]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkExecStart verifies that the binary of an ExecStart value is an
+// absolute path to an existing executable. Prefixes like - and @ are
+// skipped.
+func checkExecStart(value string) error {
+	words, err := splitWords(value)
+	if err != nil || len(words) == 0 {
+		return fmt.Errorf("%w: unable to parse ExecStart %q", ErrInvalidUnit, value)
+	}
+	binary := strings.TrimLeft(words[0], "-@:+!")
+	if !strings.HasPrefix(binary, "/") {
+		// systemd looks up relative names in a fixed search path,
+		// leave that to systemd-analyze.
+		if _, err := exec.LookPath(binary); err != nil {
+			return fmt.Errorf("%w: ExecStart binary %s not found", ErrInvalidUnit, binary)
+		}
+		return nil
+	}
+	fi, err := os.Stat(binary)
+	if err != nil {
+		return fmt.Errorf("%w: ExecStart binary %s: %w", ErrInvalidUnit, binary, err)
+	}
+	if fi.IsDir() || fi.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("%w: ExecStart binary %s is not executable", ErrInvalidUnit, binary)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCheckSystemdUnit(t *testing.T) {
+	unit, err := RenderSystemdUnit("/etc/sshtun/config.json", false, UnitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckSystemdUnit([]byte(unit)); err != nil {
+		t.Errorf("expected default unit to pass, got %v", err)
+	}
+	for name, test := range map[string]struct {
+		unit string
+		want string
+	}{
+		"no service":   {"[Unit]\nDescription=x\n", "missing [Service]"},
+		"no execstart": {"[Unit]\n[Service]\nType=simple\n", "ExecStart is missing"},
+		"no binary":    {"[Unit]\n[Service]\nExecStart=/nonexistent/sshtun -config x\n", "/nonexistent/sshtun"},
+		"garbage":      {"[Unit]\nDescription\n[Service]\nExecStart=/bin/sh\n", "expected key=value"},
+		"outside":      {"Description=x\n[Unit]\n[Service]\nExecStart=/bin/sh\n", "outside of a section"},
+	} {
+		err := CheckSystemdUnit([]byte(test.unit))
+		if !errors.Is(err, ErrInvalidUnit) || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: expected ErrInvalidUnit containing %q, got %v", name, test.want, err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/sa6mwa/sshtun"
+)
+
+// BuildInfo is printed by -version.
+type BuildInfo struct {
+	Version   string       `json:"version"`
+	Commit    string       `json:"commit"`
+	Date      string       `json:"date"`
+	GoVersion string       `json:"go_version"`
+	Platform  string       `json:"platform"`
+	Helpers   []HelperInfo `json:"helpers"`
+	Modified  bool         `json:"modified,omitempty"`
+}
+
+// HelperInfo describes one embedded tunreadwriter.
+type HelperInfo struct {
+	Arch   string `json:"arch"`
+	SHA256 string `json:"sha256"`
+	Size   int    `json:"size"`
+}
+
+// GetBuildInfo returns version information from the ldflags variables
+// version, commit and date, falling back to the vcs information in
+// debug.ReadBuildInfo for commit and date.
+func GetBuildInfo() BuildInfo {
+	bi := BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		Date:      date,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	for _, arch := range sshtun.HelperArchitectures() {
+		if h, err := sshtun.HelperFor(arch); err == nil {
+			bi.Helpers = append(bi.Helpers, HelperInfo{Arch: arch, SHA256: h.SHA256, Size: len(h.Binary)})
+		}
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		bi.GoVersion = info.GoVersion
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if bi.Commit == "" {
+					bi.Commit = setting.Value
+				}
+			case "vcs.time":
+				if bi.Date == "" {
+					bi.Date = setting.Value
+				}
+			case "vcs.modified":
+				bi.Modified = setting.Value == "true"
+			}
+		}
+	}
+	if bi.Commit == "" {
+		bi.Commit = "unknown"
+	}
+	if bi.Date == "" {
+		bi.Date = "unknown"
+	}
+	return bi
+}
+
+// WriteVersion writes build information to w as text or, if format
+// is json, as a json object.
+func WriteVersion(w io.Writer, format string) error {
+	bi := GetBuildInfo()
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(&bi)
+	case "", "text":
+		modified := ""
+		if bi.Modified {
+			modified = " (modified)"
+		}
+		if _, err := fmt.Fprintf(w, "sshtun %s %s\ncommit:        %s%s\nbuilt:         %s\ngo:            %s\nplatform:      %s\n",
+			bi.Version, copyright, bi.Commit, modified, bi.Date, bi.GoVersion, bi.Platform); err != nil {
+			return err
+		}
+		for _, h := range bi.Helpers {
+			if _, err := fmt.Fprintf(w, "helper:        linux/%s sha256:%s size:%d\n", h.Arch, h.SHA256, h.Size); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported output format %q, use text or json", format)
+	}
+}
@@ -1,6 +1,9 @@
+//go:build linux
+
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -10,29 +13,67 @@ import (
 	"os/user"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
+	"github.com/sa6mwa/sshtun/internal/pkg/handshake"
+	"github.com/sa6mwa/sshtun/internal/pkg/policy"
 	"github.com/sa6mwa/sshtun/pkg/tun"
 )
 
 var (
-	mtu          int
-	device       string
-	network      string
-	username     string
-	groupname    string
-	uid          int
-	gid          int
-	deleteMyself bool
+	mtu           int
+	device        string
+	networks      = &listFlag{values: []string{"172.16.0.3/24"}}
+	networks6     = &listFlag{}
+	peer          string
+	routes        = &listFlag{}
+	routeVia      string
+	defaultRoute  bool
+	except        string
+	ipForward     bool
+	forwarding    bool
+	nat           string
+	masquerade    string
+	tap           bool
+	bridge        string
+	username      string
+	groupname     string
+	uid           int
+	gid           int
+	deleteMyself  bool
+	sendHandshake bool
+	idleExit      time.Duration
+	statsInterval time.Duration
+	windowSize    int
 )
 
 func main() {
 	flag.IntVar(&mtu, "mtu", 0, "`MTU` of created tun device, 0 means the kernel default, usually 1500")
 	flag.StringVar(&device, "dev", "tun0", "`TUN` device to read from and write to stdout, write to and read from stdin")
-	flag.StringVar(&network, "net", "172.16.0.3/24", "Network address with CIDR to assign to the tun device")
+	flag.Var(networks, "net", "IPv4 network address with CIDR to assign to the tun device, repeat for multiple addresses")
+	flag.StringVar(&peer, "peer", "", "peer `address` of the first -net if it is a point-to-point /31 or /32")
+	flag.Var(networks6, "net6", "IPv6 network address with prefix length to assign to the tun device, repeat for multiple addresses")
+	flag.Var(routes, "route", "Add an IPv4 route to `network` with CIDR through the tun device, repeat for multiple routes")
+	flag.StringVar(&routeVia, "route-via", "", "Optional `gateway` for -route, e.g the address of the other end of the tunnel")
+	flag.BoolVar(&defaultRoute, "default-route", false, "Route every IPv4 address through the tun device (0.0.0.0/1 and 128.0.0.0/1), requires -except")
+	flag.StringVar(&except, "except", "", "IPv4 `address` keeping its current route with -default-route, the ssh client")
+	flag.BoolVar(&ipForward, "ip-forward", false, "Enable IPv4 forwarding between interfaces")
+	flag.BoolVar(&forwarding, "enable-forwarding", false, "Enable IPv4 (and with -net6 IPv6) forwarding if off and restore it on exit, unless -ip-forward, -nat or -masquerade leave it enabled")
+	flag.StringVar(&nat, "nat", "", "Enable IPv4 forwarding and masquerade traffic from `network` with CIDR leaving through other devices than the tun device (nft or iptables)")
+	flag.StringVar(&masquerade, "masquerade", "", "Enable IPv4 forwarding and masquerade traffic from `network` with CIDR leaving through the device of the default route (nft or iptables)")
+	flag.BoolVar(&tap, "tap", false, "Create a tap (ethernet) device instead of a tun device")
+	flag.StringVar(&bridge, "bridge", "", "Enslave the tap device into the existing `bridge` instead of assigning -net and -net6, requires -tap")
 	flag.StringVar(&username, "user", "", "Set owner of created tun device to `username`")
 	flag.StringVar(&groupname, "group", "", "Set group of created tun device to `groupname`")
+	flag.IntVar(&uid, "owner-uid", -1, "Set owner of created tun device to numeric `uid`, for systems where -user can not be looked up")
+	flag.IntVar(&gid, "owner-gid", -1, "Set group of created tun device to numeric `gid`, for systems where -group can not be looked up")
 	flag.BoolVar(&deleteMyself, "delete", false, "Delete myself when exiting")
+	flag.DurationVar(&idleExit, "idle-exit", 0, "Exit after `duration` without packets in either direction, 0 disables")
+	flag.DurationVar(&statsInterval, "stats-interval", 0, "Write traffic statistics as a STATS json line to stderr every `duration` (and on SIGUSR1), 0 means only on SIGUSR1")
+	flag.IntVar(&windowSize, "window-size", tun.DEFAULT_WINDOW_SIZE, "Queue up to `bytes` of packets read from the tun device while stdout is busy and write them together, 1 writes every packet on its own (ignored with -tap)")
+	flag.BoolVar(&sendHandshake, "handshake", false, "Write a handshake line with protocol version, device name and MTU to stdout before forwarding traffic")
 	flag.Parse()
 	if err := tunreadwriter(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -40,6 +81,136 @@ func main() {
 	}
 }
 
+// addRoutes adds routes through t, reporting each result on stderr
+// as ROUTE ok <network> or ROUTE err <network> <error> for sshtun to
+// relay into its log. Returns the routes that were added and should
+// be removed on exit, routes that already existed are left alone.
+func addRoutes(t *tun.TUN, routes []string, via string) []string {
+	var added []string
+	for _, route := range routes {
+		err := t.AddRoute(route, via)
+		switch {
+		case err == nil:
+			added = append(added, route)
+			fmt.Fprintf(os.Stderr, "ROUTE ok %s\n", route)
+		case errors.Is(err, syscall.EEXIST):
+			fmt.Fprintf(os.Stderr, "ROUTE ok %s already exists\n", route)
+		default:
+			fmt.Fprintf(os.Stderr, "ROUTE err %s %v\n", route, err)
+		}
+	}
+	return added
+}
+
+// applyPolicy applies -enable-forwarding, -default-route,
+// -ip-forward, -nat and -masquerade, reporting each result on stderr
+// like addRoutes (FORWARD ok <family> <before> <after>, FORWARD err
+// <family> <error>, ROUTE ok default, NAT ok <network>, NAT ok
+// <network> <egress device> <firewall> or NAT err <network> <error>).
+// Failures are reported but do not stop the tunnel. The returned func
+// undoes what was applied.
+func applyPolicy(t *tun.TUN) func() {
+	var undo []func()
+	if forwarding {
+		sysctls := map[string]string{"inet": policy.IP_FORWARD}
+		if len(networks6.values) > 0 {
+			sysctls["inet6"] = policy.IP6_FORWARD
+		}
+		keep := ipForward || nat != "" || masquerade != ""
+		for _, family := range []string{"inet", "inet6"} {
+			pth, ok := sysctls[family]
+			if !ok {
+				continue
+			}
+			before, after, restore, err := policy.SetForwarding(pth)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "FORWARD err %s %v\n", family, err)
+				continue
+			}
+			if !keep {
+				undo = append(undo, func() { restore() })
+			}
+			fmt.Fprintf(os.Stderr, "FORWARD ok %s %s %s\n", family, before, after)
+		}
+	}
+	if defaultRoute {
+		if remove, err := policy.DefaultRoute(t, except, nil); err != nil {
+			fmt.Fprintf(os.Stderr, "ROUTE err default %v\n", err)
+		} else {
+			undo = append(undo, remove)
+			fmt.Fprintf(os.Stderr, "ROUTE ok default except %s\n", except)
+		}
+	}
+	if ipForward && nat == "" && masquerade == "" {
+		if err := policy.EnableForwarding(); err != nil {
+			fmt.Fprintf(os.Stderr, "NAT err forward %v\n", err)
+		} else {
+			fmt.Fprintln(os.Stderr, "NAT ok forward")
+		}
+	}
+	if nat != "" {
+		if remove, err := policy.Masquerade(nat, t.Name); err != nil {
+			fmt.Fprintf(os.Stderr, "NAT err %s %v\n", nat, err)
+		} else {
+			undo = append(undo, func() { remove() })
+			fmt.Fprintf(os.Stderr, "NAT ok %s\n", nat)
+		}
+	}
+	if masquerade != "" {
+		egress, err := policy.EgressDevice()
+		var remove func() error
+		var firewall string
+		if err == nil {
+			remove, firewall, err = policy.MasqueradeEgress(masquerade, egress)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "NAT err %s %v\n", masquerade, err)
+		} else {
+			undo = append(undo, func() { remove() })
+			fmt.Fprintf(os.Stderr, "NAT ok %s %s %s\n", masquerade, egress, firewall)
+		}
+	}
+	return func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}
+}
+
+// listFlag is a repeatable flag. The first use replaces the default
+// values, an empty value clears the list.
+type listFlag struct {
+	values []string
+	set    bool
+}
+
+func (l *listFlag) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(l.values, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	if !l.set {
+		l.values = nil
+		l.set = true
+	}
+	if value = strings.TrimSpace(value); value == "" {
+		l.values = nil
+		return nil
+	}
+	l.values = append(l.values, value)
+	return nil
+}
+
+// createTUN is tun.CreateTUN and createTAP tun.CreateTAP,
+// replaceable in tests.
+var (
+	createTUN = tun.CreateTUN
+	createTAP = tun.CreateTAP
+)
+
 func tunreadwriter() error {
 	if deleteMyself {
 		defer func() {
@@ -52,11 +223,21 @@ func tunreadwriter() error {
 		return errors.New("missing device name")
 	}
 
-	network = strings.TrimSpace(network)
-	if network == "" {
+	if bridge != "" {
+		if !tap {
+			return errors.New("-bridge requires -tap")
+		}
+		// A bridged device carries the segment of the bridge, the
+		// addresses belong to the bridge.
+		networks.values, networks6.values = nil, nil
+	} else if len(networks.values) == 0 && len(networks6.values) == 0 {
 		return errors.New("missing network address")
 	}
 
+	if defaultRoute && except == "" {
+		return errors.New("-default-route requires -except")
+	}
+
 	if username != "" {
 		usr, err := user.Lookup(username)
 		if err != nil {
@@ -66,9 +247,12 @@ func tunreadwriter() error {
 		if err != nil {
 			return err
 		}
-		gid, err = strconv.Atoi(usr.Gid)
-		if err != nil {
-			return err
+		// The primary group of -user unless -owner-gid was given.
+		if gid < 0 {
+			gid, err = strconv.Atoi(usr.Gid)
+			if err != nil {
+				return err
+			}
 		}
 	}
 	if groupname != "" {
@@ -82,53 +266,236 @@ func tunreadwriter() error {
 		}
 	}
 
-	localTUN, err := tun.CreateTUN(device, mtu, 0, 0)
+	create := createTUN
+	if tap {
+		create = createTAP
+	}
+	localTUN, err := create(device, mtu, uid, gid)
 	if err != nil {
 		return err
 	}
 	defer localTUN.Close()
 
-	if err := localTUN.ConfigureInterface(network); err != nil {
-		return err
+	if bridge != "" {
+		if err := localTUN.JoinBridge(bridge); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "BRIDGE ok %s %s\n", bridge, localTUN.Name)
+	}
+
+	var families []string
+	for i, network := range networks.values {
+		if i == 0 {
+			err = localTUN.ConfigureAddress(network, peer)
+		} else {
+			err = localTUN.AddAddress(i, network)
+		}
+		if err != nil {
+			return fmt.Errorf("-net %s: %w", network, err)
+		}
+	}
+	if len(networks.values) > 0 {
+		families = append(families, "inet")
+	}
+	for _, network := range networks6.values {
+		if err := localTUN.ConfigureInterface6(network); err != nil {
+			return fmt.Errorf("-net6 %s: %w", network, err)
+		}
+	}
+	if len(networks6.values) > 0 {
+		families = append(families, "inet6")
 	}
 
 	if err := localTUN.LinkUp(); err != nil {
 		return err
 	}
 
+	// Routes through the device disappear with it, but remove them
+	// explicitly in case the device outlives us.
+	for _, route := range addRoutes(localTUN, routes.values, routeVia) {
+		defer localTUN.DelRoute(route, routeVia)
+	}
+	defer applyPolicy(localTUN)()
+
+	if sendHandshake {
+		actualMTU, err := localTUN.MTU()
+		if err != nil {
+			return err
+		}
+		if err := handshake.New(localTUN.Name, actualMTU, families...).Write(os.Stdout); err != nil {
+			return err
+		}
+	}
+
+	// Any error or EOF in either direction tears the tunnel down:
+	// returning closes the tun device and removes the binary if
+	// -delete was given.
+	actualMTU, _ := localTUN.MTU()
+	activity := newActivityTracker(localTUN.Name, actualMTU)
+
 	// Read from TUN device, write to stdout
 	fromTUNdone := make(chan struct{})
 	go func() {
 		defer close(fromTUNdone)
-		if _, err := io.Copy(os.Stdout, localTUN.File); err != nil {
-			fmt.Fprint(os.Stderr, "io error from "+localTUN.Name+" to stdout:", err)
+		var err error
+		if tap {
+			_, err = io.Copy(os.Stdout, activity.fromTUN(localTUN.File))
+		} else {
+			_, err = tun.CopyPackets(os.Stdout, activity.fromTUN(localTUN.File), windowSize)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "io error from "+localTUN.Name+" to stdout:", err)
 		}
 	}()
 
 	fromSTDINdone := make(chan struct{})
 	go func() {
 		defer close(fromSTDINdone)
-		// Read from stdin, write to TUN device
-		if _, err := io.Copy(localTUN.File, os.Stdin); err != nil {
-			fmt.Fprint(os.Stderr, "io error from stdin to "+localTUN.Name+":", err)
+		// Read from stdin, write to TUN device one packet at a time
+		toTUN := activity.toTUN(localTUN.File)
+		if !tap {
+			toTUN = tun.NewPacketWriter(toTUN)
+		}
+		if _, err := io.Copy(toTUN, os.Stdin); err != nil {
+			fmt.Fprintln(os.Stderr, "io error from stdin to "+localTUN.Name+":", err)
 		}
 	}()
 
-	done := make(chan struct{})
-	go func() {
-		defer close(done)
-		sigCh := make(chan os.Signal, 1)
-		defer close(sigCh)
-		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	var idle <-chan time.Time
+	if idleExit > 0 {
+		ticker := time.NewTicker(min(idleExit/4+time.Millisecond, time.Minute))
+		defer ticker.Stop()
+		idle = ticker.C
+	}
+
+	var statsTick <-chan time.Time
+	if statsInterval > 0 {
+		ticker := time.NewTicker(statsInterval)
+		defer ticker.Stop()
+		statsTick = ticker.C
+	}
+
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	defer signal.Stop(usr1)
+
+	// sshd sends SIGHUP when the session ends.
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigCh)
+	for {
 		select {
+		case <-usr1:
+			activity.dump(os.Stderr)
+		case <-statsTick:
+			activity.dump(os.Stderr)
 		case sig := <-sigCh:
 			fmt.Fprintln(os.Stderr, "Caught signal", sig.String())
+			return nil
 		case <-fromTUNdone:
+			return nil
 		case <-fromSTDINdone:
+			return nil
+		case <-idle:
+			if since := activity.since(); since >= idleExit {
+				fmt.Fprintf(os.Stderr, "No traffic for %s, exiting\n", since.Truncate(time.Second))
+				return nil
+			}
 		}
-		signal.Stop(sigCh)
-	}()
+	}
+}
 
-	<-done
-	return nil
+// activityTracker counts bytes and packets in both directions and
+// records the time of the last packet for -idle-exit and the
+// statistics dumped on SIGUSR1 or every -stats-interval.
+type activityTracker struct {
+	device  string
+	mtu     int
+	started time.Time
+	last    atomic.Int64
+	// tx is from the tun device to stdout (towards sshtun), every
+	// read from the tun device is one packet. rx is from stdin to the
+	// tun device, every write to the tun device is one packet. Both
+	// are counted at the tun device as packets are batched on stdout
+	// and stdin.
+	txBytes, txPackets atomic.Uint64
+	rxBytes, rxPackets atomic.Uint64
+}
+
+func newActivityTracker(device string, mtu int) *activityTracker {
+	a := &activityTracker{device: device, mtu: mtu, started: time.Now()}
+	a.touch()
+	return a
+}
+
+func (a *activityTracker) touch() {
+	a.last.Store(time.Now().UnixNano())
+}
+
+func (a *activityTracker) since() time.Duration {
+	return time.Since(time.Unix(0, a.last.Load()))
 }
+
+// fromTUN counts every read from the tun device r as a tx packet.
+func (a *activityTracker) fromTUN(r io.Reader) io.Reader {
+	return readerFunc(func(p []byte) (int, error) {
+		n, err := r.Read(p)
+		if n > 0 {
+			a.touch()
+			a.txBytes.Add(uint64(n))
+			a.txPackets.Add(1)
+		}
+		return n, err
+	})
+}
+
+// toTUN counts every write to the tun device w as an rx packet.
+func (a *activityTracker) toTUN(w io.Writer) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		a.touch()
+		a.rxBytes.Add(uint64(len(p)))
+		a.rxPackets.Add(1)
+		return w.Write(p)
+	})
+}
+
+// Stats is written as STATS <json> on a single line.
+type Stats struct {
+	Device    string `json:"device"`
+	MTU       int    `json:"mtu"`
+	Uptime    string `json:"uptime"`
+	Idle      string `json:"idle"`
+	RxBytes   uint64 `json:"rx_bytes"`
+	RxPackets uint64 `json:"rx_packets"`
+	TxBytes   uint64 `json:"tx_bytes"`
+	TxPackets uint64 `json:"tx_packets"`
+}
+
+func (a *activityTracker) stats() Stats {
+	return Stats{
+		Device:    a.device,
+		MTU:       a.mtu,
+		Uptime:    time.Since(a.started).Truncate(time.Second).String(),
+		Idle:      a.since().Truncate(time.Second).String(),
+		RxBytes:   a.rxBytes.Load(),
+		RxPackets: a.rxPackets.Load(),
+		TxBytes:   a.txBytes.Load(),
+		TxPackets: a.txPackets.Load(),
+	}
+}
+
+func (a *activityTracker) dump(w io.Writer) {
+	b, err := json.Marshal(a.stats())
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "STATS %s\n", b)
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
@@ -0,0 +1,120 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os/user"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/sa6mwa/sshtun/pkg/tun"
+)
+
+func TestOwnerPlumbing(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	currentUID, _ := strconv.Atoi(current.Uid)
+	currentGID, _ := strconv.Atoi(current.Gid)
+
+	errStub := errors.New("stub")
+	var gotUID, gotGID int
+	createTUN = func(name string, mtu, uid, gid int) (*tun.TUN, error) {
+		gotUID, gotGID = uid, gid
+		return nil, errStub
+	}
+	defer func() { createTUN = tun.CreateTUN }()
+
+	for _, c := range []struct {
+		name             string
+		username         string
+		uid, gid         int
+		wantUID, wantGID int
+	}{
+		{"none", "", -1, -1, -1, -1},
+		{"numeric", "", 1234, 5678, 1234, 5678},
+		{"user", current.Username, -1, -1, currentUID, currentGID},
+		{"user and gid", current.Username, -1, 5678, currentUID, 5678},
+	} {
+		device = "tun9"
+		username, groupname, uid, gid = c.username, "", c.uid, c.gid
+		if err := tunreadwriter(); !errors.Is(err, errStub) {
+			t.Fatalf("%s: expected stub error, got %v", c.name, err)
+		}
+		if gotUID != c.wantUID || gotGID != c.wantGID {
+			t.Errorf("%s: CreateTUN got uid %d gid %d, expected uid %d gid %d", c.name, gotUID, gotGID, c.wantUID, c.wantGID)
+		}
+	}
+}
+
+func TestTapPlumbing(t *testing.T) {
+	errStub := errors.New("stub")
+	created := ""
+	createTUN = func(name string, mtu, uid, gid int) (*tun.TUN, error) {
+		created = "tun"
+		return nil, errStub
+	}
+	createTAP = func(name string, mtu, uid, gid int) (*tun.TUN, error) {
+		created = "tap"
+		return nil, errStub
+	}
+	defer func() {
+		createTUN, createTAP = tun.CreateTUN, tun.CreateTAP
+		tap, bridge = false, ""
+	}()
+
+	device, username, groupname = "tap9", "", ""
+	tap, bridge = false, "br0"
+	if err := tunreadwriter(); err == nil || err.Error() != "-bridge requires -tap" {
+		t.Fatalf("expected -bridge to require -tap, got %v", err)
+	}
+	networks.values, networks6.values = nil, nil
+	tap = true
+	if err := tunreadwriter(); !errors.Is(err, errStub) || created != "tap" {
+		t.Fatalf("expected a bridged tap device without networks, got %v creating %q", err, created)
+	}
+	tap, bridge = false, ""
+	networks.values = []string{"172.16.0.3/24"}
+	if err := tunreadwriter(); !errors.Is(err, errStub) || created != "tun" {
+		t.Fatalf("expected a tun device, got %v creating %q", err, created)
+	}
+}
+
+func TestListFlag(t *testing.T) {
+	l := &listFlag{values: []string{"172.16.0.3/24"}}
+	for _, v := range []string{"10.0.0.1/24", "10.0.1.1/24"} {
+		l.Set(v)
+	}
+	if l.String() != "10.0.0.1/24,10.0.1.1/24" {
+		t.Errorf("expected the default to be replaced, got %q", l)
+	}
+	l.Set("")
+	if len(l.values) != 0 {
+		t.Errorf("expected an empty value to clear the list, got %q", l)
+	}
+}
+
+func TestActivityTrackerStats(t *testing.T) {
+	a := newActivityTracker("tun0", 1500)
+	io.Copy(io.Discard, a.fromTUN(strings.NewReader("packet")))
+	io.Copy(a.toTUN(io.Discard), strings.NewReader("hello world"))
+	var b bytes.Buffer
+	a.dump(&b)
+	line, ok := strings.CutPrefix(strings.TrimSpace(b.String()), "STATS ")
+	if !ok {
+		t.Fatalf("expected a STATS line, got %q", b.String())
+	}
+	var stats Stats
+	if err := json.Unmarshal([]byte(line), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Device != "tun0" || stats.MTU != 1500 || stats.TxBytes != 6 || stats.TxPackets != 1 || stats.RxBytes != 11 || stats.RxPackets != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,232 @@
+package sshtun
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidPath  error = errors.New("invalid configuration path")
+	ErrInvalidValue error = errors.New("invalid value")
+)
+
+// Set assigns value to the configuration field addressed by the
+// dotted path, for example tunnels.office.remote, tunnels.0.enable or
+// address_pool. Tunnels are addressed by name (which may contain
+// dots) or, if no tunnel has that name, by index. Field names are the
+// json keys. value is coerced to the type of the field: bool, int,
+// duration strings like 2m0s, string or a comma separated list for
+// string slices. Optional fields are reset to their default by an
+// empty value. The configuration is left untouched on error.
+func (t *Tunnels) Set(path, value string) error {
+	field, err := t.resolvePath(path)
+	if err != nil {
+		return err
+	}
+	if !field.IsValid() || !field.CanSet() || field.Kind() == reflect.Struct {
+		return fmt.Errorf("%w %q: not a settable field", ErrInvalidPath, path)
+	}
+	return setValue(field, path, value)
+}
+
+// setValue coerces value to the type of field and sets it. Optional
+// (pointer) fields are reset to their default with an empty value.
+func setValue(field reflect.Value, path, value string) error {
+	if field.Kind() == reflect.Pointer {
+		if value == "" {
+			field.Set(reflect.Zero(field.Type()))
+			return nil
+		}
+		v := reflect.New(field.Type().Elem())
+		if err := setValue(v.Elem(), path, value); err != nil {
+			return err
+		}
+		field.Set(v)
+		return nil
+	}
+	switch v := field.Addr().Interface().(type) {
+	case *Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%w for %s: expected a duration like 2m0s: %w", ErrInvalidValue, path, err)
+		}
+		*v = Duration(d)
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%w for %s: expected true or false, got %q", ErrInvalidValue, path, value)
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || field.OverflowInt(i) {
+			return fmt.Errorf("%w for %s: expected an integer, got %q", ErrInvalidValue, path, value)
+		}
+		field.SetInt(i)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("%w %q: unsupported slice type %s", ErrInvalidPath, path, field.Type())
+		}
+		slice := reflect.MakeSlice(field.Type(), 0, 0)
+		if value != "" {
+			for _, e := range strings.Split(value, ",") {
+				slice = reflect.Append(slice, reflect.ValueOf(strings.TrimSpace(e)).Convert(field.Type().Elem()))
+			}
+		}
+		field.Set(slice)
+	default:
+		return fmt.Errorf("%w %q: unsupported type %s", ErrInvalidPath, path, field.Type())
+	}
+	return nil
+}
+
+// Get returns the value of the configuration field addressed by the
+// dotted path (see Set). Scalars are returned as plain text, tunnels,
+// lists and the whole configuration as indented json.
+func (t *Tunnels) Get(path string) (string, error) {
+	field, err := t.resolvePath(path)
+	if err != nil {
+		return "", err
+	}
+	if field.Kind() == reflect.Pointer {
+		if field.IsNil() {
+			return "", nil
+		}
+		field = field.Elem()
+	}
+	switch v := field.Interface().(type) {
+	case Duration:
+		return time.Duration(v).String(), nil
+	case string:
+		return v, nil
+	case bool, int:
+		return fmt.Sprint(v), nil
+	}
+	b, err := json.MarshalIndent(field.Interface(), "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// resolvePath returns the field addressed by path: a json key of the
+// configuration, tunnels, a tunnel or a json key of a tunnel. Tunnel
+// names may contain dots, the longest name matching the start of the
+// rest of path wins. Null tunnels are skipped, Validate reports them.
+func (t *Tunnels) resolvePath(path string) (reflect.Value, error) {
+	root, rest, found := strings.Cut(path, ".")
+	if root != "tunnels" {
+		field, ok := jsonField(reflect.ValueOf(t).Elem(), root)
+		switch {
+		case !ok:
+			return reflect.Value{}, fmt.Errorf("%w %q: unknown field %q", ErrInvalidPath, path, root)
+		case found:
+			return reflect.Value{}, fmt.Errorf("%w %q: too many elements", ErrInvalidPath, path)
+		}
+		return field, nil
+	}
+	if !found {
+		return reflect.ValueOf(t.Tunnels), nil
+	}
+	var tunnel *SSHTUN
+	key := ""
+	for _, tun := range t.Tunnels {
+		if tun == nil || (rest != tun.Name && !strings.HasPrefix(rest, tun.Name+".")) {
+			continue
+		}
+		if tunnel == nil || len(tun.Name) > len(tunnel.Name) {
+			tunnel, key = tun, strings.TrimPrefix(rest[len(tun.Name):], ".")
+		}
+	}
+	if tunnel == nil {
+		var index string
+		index, key, _ = strings.Cut(rest, ".")
+		i, err := strconv.Atoi(index)
+		if err != nil || i < 0 || i >= len(t.Tunnels) {
+			_, err := t.Lookup(index)
+			return reflect.Value{}, fmt.Errorf("%w %q: %w", ErrInvalidPath, path, err)
+		}
+		if tunnel = t.Tunnels[i]; tunnel == nil {
+			return reflect.Value{}, fmt.Errorf("%w %q: tunnel %d is null", ErrInvalidPath, path, i)
+		}
+	}
+	v := reflect.ValueOf(tunnel).Elem()
+	if key == "" {
+		return v, nil
+	}
+	if strings.Contains(key, ".") {
+		return reflect.Value{}, fmt.Errorf("%w %q: too many elements", ErrInvalidPath, path)
+	}
+	if field, ok := jsonField(v, key); ok {
+		return field, nil
+	}
+	return reflect.Value{}, fmt.Errorf("%w %q: unknown field %q", ErrInvalidPath, path, key)
+}
+
+// jsonField returns the field of struct v with json key.
+func jsonField(v reflect.Value, key string) (reflect.Value, bool) {
+	for i := 0; i < v.NumField(); i++ {
+		tag, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		if tag != "" && tag != "-" && tag == key {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// SaveConfigAtomic writes the configuration to a temporary file in
+// the same directory as configJson and renames it into place, so the
+// configuration file is never left partially written. STDIO_CONFIG
+// (-) writes to os.Stdout as SaveConfig does.
+func (t *Tunnels) SaveConfigAtomic(configJson string) error {
+	if configJson == STDIO_CONFIG {
+		return t.WriteConfig(os.Stdout)
+	}
+	pth, err := ResolveTilde(configJson)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(pth), 0777); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(pth), "."+filepath.Base(pth)+".*")
+	if err != nil {
+		return err
+	}
+	tempfile := f.Name()
+	defer os.Remove(tempfile)
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(pth); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(t); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempfile, pth)
+}
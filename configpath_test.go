@@ -0,0 +1,95 @@
+package sshtun
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSetAndGet(t *testing.T) {
+	tunnels := DefaultConfig(nil)
+	for path, value := range map[string]string{
+		"tunnels.example.remote":             "newhost:22",
+		"tunnels.0.enable":                   "true",
+		"tunnels.example.local_mtu":          "1400",
+		"tunnels.example.keepalive_interval": "30s",
+		"tunnels.example.private_key_files":  "~/.ssh/a, ~/.ssh/b",
+	} {
+		if err := tunnels.Set(path, value); err != nil {
+			t.Fatalf("Set(%q, %q): %v", path, value, err)
+		}
+	}
+	tunnel := tunnels.Tunnels[0]
+	if tunnel.Remote != "newhost:22" || !tunnel.Enable || tunnel.LocalMTU != 1400 {
+		t.Errorf("unexpected tunnel after Set: %+v", tunnel)
+	}
+	if time.Duration(tunnel.KeepaliveInterval) != 30*time.Second {
+		t.Errorf("expected keepalive_interval 30s, got %s", time.Duration(tunnel.KeepaliveInterval))
+	}
+	if len(tunnel.PrivateKeyFiles) != 2 || tunnel.PrivateKeyFiles[1] != "~/.ssh/b" {
+		t.Errorf("unexpected private_key_files %v", tunnel.PrivateKeyFiles)
+	}
+	if v, err := tunnels.Get("tunnels.example.keepalive_interval"); err != nil || v != "30s" {
+		t.Errorf("Get keepalive_interval = %q, %v", v, err)
+	}
+
+	if err := tunnels.Set("tunnels.example.remote_cache_helper", "false"); err != nil {
+		t.Fatal(err)
+	}
+	if tunnel.CachesHelper() {
+		t.Error("expected remote_cache_helper false to disable the helper cache")
+	}
+	if v, err := tunnels.Get("tunnels.example.remote_cache_helper"); err != nil || v != "false" {
+		t.Errorf("Get remote_cache_helper = %q, %v", v, err)
+	}
+	if err := tunnels.Set("tunnels.example.remote_cache_helper", ""); err != nil || tunnel.RemoteCacheHelper != nil {
+		t.Errorf("expected an empty value to reset remote_cache_helper, got %v, %v", tunnel.RemoteCacheHelper, err)
+	}
+
+	for path, value := range map[string]string{
+		"tunnels.example.enable":      "maybe",
+		"tunnels.example.local_mtu":   "big",
+		"tunnels.example.nonexisting": "x",
+		"tunnels.nonexisting.remote":  "x",
+		"remote":                      "x",
+	} {
+		err := tunnels.Set(path, value)
+		if !errors.Is(err, ErrInvalidPath) && !errors.Is(err, ErrInvalidValue) {
+			t.Errorf("Set(%q, %q): expected ErrInvalidPath or ErrInvalidValue, got %v", path, value, err)
+		}
+	}
+}
+
+func TestSetAndGetPaths(t *testing.T) {
+	office, officeLab := NewSecureShellTunneler(nil), NewSecureShellTunneler(nil)
+	office.Name, officeLab.Name = "office", "office.lab"
+	tunnels := &Tunnels{Tunnels: []*SSHTUN{nil, office, officeLab}}
+	for path, value := range map[string]string{
+		"address_pool":              "10.99.0.0/16",
+		"drop_privileges":           "true",
+		"audit_log_max_size":        "1024",
+		"tunnels.office.remote":     "office:22",
+		"tunnels.office.lab.remote": "lab:22",
+	} {
+		if err := tunnels.Set(path, value); err != nil {
+			t.Fatalf("Set(%q, %q): %v", path, value, err)
+		}
+	}
+	if tunnels.AddressPool != "10.99.0.0/16" || !tunnels.DropPrivileges || tunnels.AuditLogMaxSize != 1024 {
+		t.Errorf("unexpected top-level settings after Set: %+v", tunnels)
+	}
+	if office.Remote != "office:22" || officeLab.Remote != "lab:22" {
+		t.Errorf("expected the longest tunnel name to win, got office %q and office.lab %q", office.Remote, officeLab.Remote)
+	}
+	if v, err := tunnels.Get("address_pool"); err != nil || v != "10.99.0.0/16" {
+		t.Errorf("Get address_pool = %q, %v", v, err)
+	}
+	if v, err := tunnels.Get("tunnels.office.lab.remote"); err != nil || v != "lab:22" {
+		t.Errorf("Get tunnels.office.lab.remote = %q, %v", v, err)
+	}
+	for _, path := range []string{"tunnels.0.remote", "tunnels.nonexisting.remote", "address_pool.x", "nonexisting"} {
+		if _, err := tunnels.Get(path); !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("Get(%q): expected ErrInvalidPath, got %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package sshtun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/sa6mwa/sshtun/internal/pkg/policy"
+)
+
+var (
+	ErrAddressConflict error = errors.New("local network overlaps an existing network")
+)
+
+// localNetworks returns the networks of every interface address and
+// IPv4 route in the network namespace of the calling thread. Reading
+// either needs no privileges.
+func localNetworks() ([]policy.Route, error) {
+	var networks []policy.Route
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				networks = append(networks, policy.Route{Device: iface.Name, Network: *ipnet})
+			}
+		}
+	}
+	f, err := os.Open(policy.PROC_NET_ROUTE)
+	if err != nil {
+		// No routing table to check (e.g not Linux), the addresses are
+		// still checked.
+		return networks, nil
+	}
+	defer f.Close()
+	routes, err := policy.Routes(f)
+	if err != nil {
+		return nil, err
+	}
+	return append(networks, routes...), nil
+}
+
+// addressConflicts returns a description of every network in
+// networks (interface addresses and routes) overlapping network,
+// except those of device (the tun device of the tunnel itself) and
+// default routes, which overlap everything.
+func addressConflicts(network *net.IPNet, device string, networks []policy.Route) []string {
+	var conflicts []string
+	seen := make(map[string]bool)
+	for _, n := range networks {
+		if n.Device == device {
+			continue
+		}
+		if ones, _ := n.Network.Mask.Size(); ones == 0 || isDefaultRoute(n.Network) {
+			continue
+		}
+		if !n.Network.Contains(network.IP) && !network.Contains(n.Network.IP) {
+			continue
+		}
+		// An interface address and its connected route are the same
+		// conflict.
+		ip := n.Network.IP.Mask(n.Network.Mask)
+		key := n.Device + " " + (&net.IPNet{IP: ip, Mask: n.Network.Mask}).String()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if n.Gateway != nil && !n.Gateway.IsUnspecified() {
+			conflicts = append(conflicts, fmt.Sprintf("route %s via %s dev %s", &net.IPNet{IP: ip, Mask: n.Network.Mask}, n.Gateway, n.Device))
+		} else {
+			conflicts = append(conflicts, fmt.Sprintf("%s on %s", n.Network.String(), n.Device))
+		}
+	}
+	return conflicts
+}
+
+// isDefaultRoute reports if network is one of policy.DefaultRoutes,
+// added by server_default_route.
+func isDefaultRoute(network net.IPNet) bool {
+	for _, route := range policy.DefaultRoutes {
+		if network.String() == route {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckAddressConflicts returns an error wrapping ErrAddressConflict
+// naming the interfaces and routes overlapping LocalNetwork or
+// LocalNetwork6, which configuring the tun device would break local
+// connectivity to. The tun device of the tunnel itself (if it already
+// exists) and default routes are not conflicts. Needs no privileges,
+// see AllowOverlap for turning a conflict into a warning when opened.
+func (s *SSHTUN) CheckAddressConflicts() error {
+	if s.forwarding() || s.LocalBridge != "" {
+		return nil
+	}
+	networks, err := localNetworks()
+	if err != nil {
+		return err
+	}
+	var overlaps []string
+	for _, address := range []string{s.LocalNetwork, s.LocalNetwork6} {
+		if address == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(address)
+		if err != nil {
+			continue
+		}
+		if conflicts := addressConflicts(network, s.LocalTunDevice, networks); len(conflicts) > 0 {
+			overlaps = append(overlaps, fmt.Sprintf("%s overlaps %s", address, strings.Join(conflicts, ", ")))
+		}
+	}
+	if len(overlaps) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: tunnel %q: %s", ErrAddressConflict, s.Name, strings.Join(overlaps, "; "))
+}
+
+// checkAddressConflicts runs CheckAddressConflicts before the local
+// tun device is created, only logging a warning if AllowOverlap is
+// set.
+func (s *SSHTUN) checkAddressConflicts() error {
+	err := s.CheckAddressConflicts()
+	if errors.Is(err, ErrAddressConflict) && s.AllowOverlap {
+		s.log().Warn(err.Error(), "name", s.Name, "remote", s.Remote, "local_net", s.LocalNetwork, "allow_overlap", true)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,65 @@
+package sshtun
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/sa6mwa/sshtun/internal/pkg/policy"
+)
+
+func TestAddressConflicts(t *testing.T) {
+	cidr := func(s string) net.IPNet {
+		ip, network, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return net.IPNet{IP: ip, Mask: network.Mask}
+	}
+	networks := []policy.Route{
+		{Device: "eth0", Network: cidr("172.18.0.10/24")},
+		{Device: "eth0", Network: cidr("172.18.0.0/24"), Gateway: net.IPv4zero},
+		{Device: "eth0", Network: cidr("0.0.0.0/0"), Gateway: net.IPv4(172, 18, 0, 1)},
+		{Device: "tun1", Network: cidr("0.0.0.0/1")},
+		{Device: "wg0", Network: cidr("10.0.0.0/8"), Gateway: net.IPv4(10, 1, 0, 1)},
+		{Device: "tun0", Network: cidr("172.19.0.1/24")},
+	}
+	for _, c := range []struct {
+		network string
+		want    []string
+	}{
+		{"172.18.0.1/24", []string{"172.18.0.10/24 on eth0"}},
+		{"172.18.0.1/30", []string{"172.18.0.10/24 on eth0"}},
+		{"10.200.0.1/30", []string{"route 10.0.0.0/8 via 10.1.0.1 dev wg0"}},
+		{"172.19.0.1/24", nil},
+		{"192.168.0.1/24", nil},
+	} {
+		_, network, err := net.ParseCIDR(c.network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := addressConflicts(network, "tun0", networks)
+		if strings.Join(got, ", ") != strings.Join(c.want, ", ") {
+			t.Errorf("%s: expected conflicts %q, got %q", c.network, c.want, got)
+		}
+	}
+}
+
+func TestCheckAddressConflicts(t *testing.T) {
+	s := NewSecureShellTunneler(nil)
+	s.LocalNetwork = "127.0.0.2/8"
+	err := s.CheckAddressConflicts()
+	if !errors.Is(err, ErrAddressConflict) || !strings.Contains(err.Error(), "on lo") || !strings.Contains(err.Error(), `tunnel "example"`) {
+		t.Errorf("expected a conflict with lo, got: %v", err)
+	}
+	s.AllowOverlap = true
+	s.setLog(SetLogger(nil))
+	if err := s.checkAddressConflicts(); err != nil {
+		t.Errorf("expected allow_overlap to only warn, got: %v", err)
+	}
+	s.DeviceType, s.LocalBridge = DEVICE_TAP, "br0"
+	if err := s.CheckAddressConflicts(); err != nil {
+		t.Errorf("expected a bridged end not to be checked, got: %v", err)
+	}
+}
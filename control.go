@@ -0,0 +1,207 @@
+package sshtun
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_CONTROL_SOCKET string = `~/.config/sshtun/sshtun.sock`
+)
+
+var (
+	ErrUnknownCommand error = errors.New("unknown control command")
+)
+
+// ControlRequest is sent as a single json line by the client over the
+// control socket.
+type ControlRequest struct {
+	Command string   `json:"command"`
+	Tunnel  string   `json:"tunnel,omitempty"`
+	Args    []string `json:"args,omitempty"`
+}
+
+// ControlResponse is the single json line reply to a ControlRequest.
+// Error is empty on success.
+type ControlResponse struct {
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ServeControl listens on unix socket pth and serves control
+// requests (enable, disable, reconnect, set the log level of a tunnel,
+// status, answered with StatusText, or speedtest, answered with the
+// SpeedTestResult as json) until ctx is cancelled. OpenAll
+// should be running (or about to run) in another goroutine. A stale
+// socket file is removed before listening. The socket is only
+// accessible by the owner, as is the directory of
+// DEFAULT_CONTROL_SOCKET if the socket is in it.
+func (t *Tunnels) ServeControl(ctx context.Context, pth string) error {
+	pth, err := ResolveTilde(pth)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(pth)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// The configuration directory may already exist, created 0755 by
+	// CreateFile.
+	if defaultDir, err := ResolveTilde(filepath.Dir(DEFAULT_CONTROL_SOCKET)); err == nil && dir == defaultDir {
+		if err := os.Chmod(dir, 0700); err != nil {
+			return err
+		}
+	}
+	if conn, err := net.Dial("unix", pth); err == nil {
+		conn.Close()
+		return fmt.Errorf("control socket %s is already in use", pth)
+	}
+	os.Remove(pth)
+	// The socket is created with the permissions left by the umask,
+	// nobody else may connect before the Chmod below.
+	mask := umask(0077)
+	l, err := net.Listen("unix", pth)
+	umask(mask)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(pth)
+	if err := os.Chmod(pth, 0600); err != nil {
+		l.Close()
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	t.log.Info("Listening on control socket", "socket", pth)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go t.handleControl(conn)
+	}
+}
+
+func (t *Tunnels) handleControl(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	var req ControlRequest
+	var resp ControlResponse
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		resp.Error = err.Error()
+		json.NewEncoder(conn).Encode(&resp)
+		return
+	}
+	t.log.Info("Control command received", "command", req.Command, "name", req.Tunnel, "args", strings.Join(req.Args, " "))
+	if req.Command == "status" {
+		if msg, err := t.StatusText(req.Tunnel); err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Message = msg
+		}
+	} else if req.Command == "speedtest" {
+		if msg, err := t.speedTestControl(conn, req); err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Message = msg
+		}
+	} else if err := t.Control(req.Command, req.Tunnel, req.Args...); err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.Message = fmt.Sprintf("%s %s: ok", req.Command, req.Tunnel)
+	}
+	json.NewEncoder(conn).Encode(&resp)
+}
+
+// Control executes command (enable, disable, reconnect or level) on
+// the tunnel named name. level takes the log level (see
+// SSHTUN.SetLogLevel) as its only argument. status and speedtest only
+// check name, the text is returned by StatusText and the result by
+// SpeedTest.
+func (t *Tunnels) Control(command, name string, args ...string) error {
+	switch command {
+	case "enable":
+		return t.EnableTunnel(name)
+	case "disable":
+		return t.DisableTunnel(name)
+	case "reconnect":
+		return t.ReconnectTunnel(name)
+	case "level":
+		if len(args) != 1 {
+			return fmt.Errorf("level takes exactly one argument (DEBUG, INFO, WARN, ERROR or %s), got %d", LOG_LEVEL_INHERIT, len(args))
+		}
+		return t.SetLogLevel(name, args[0])
+	case "status":
+		_, err := t.StatusText(name)
+		return err
+	case "speedtest":
+		_, err := t.Lookup(name)
+		return err
+	default:
+		return fmt.Errorf("%w %q, valid commands are: enable, disable, reconnect, level, status, speedtest", ErrUnknownCommand, command)
+	}
+}
+
+// speedTestControl runs SpeedTest for the tunnel of req for the
+// duration in its only argument (DEFAULT_SPEEDTEST_DURATION if none)
+// and returns the result as json, extending the deadline of conn to
+// cover it.
+func (t *Tunnels) speedTestControl(conn net.Conn, req ControlRequest) (string, error) {
+	var duration time.Duration
+	if len(req.Args) > 1 {
+		return "", fmt.Errorf("speedtest takes at most one argument (the duration), got %d", len(req.Args))
+	} else if len(req.Args) == 1 {
+		var err error
+		if duration, err = time.ParseDuration(req.Args[0]); err != nil {
+			return "", err
+		}
+	}
+	conn.SetDeadline(time.Now().Add(time.Minute + MAX_SPEEDTEST_DURATION))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute+MAX_SPEEDTEST_DURATION)
+	defer cancel()
+	result, err := t.SpeedTest(ctx, req.Tunnel, duration)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(result)
+	return string(b), err
+}
+
+// SendControl connects to the control socket at pth, sends command,
+// tunnel name and args and returns the message from the daemon or an
+// error.
+func SendControl(ctx context.Context, pth, command, name string, args ...string) (string, error) {
+	pth, err := ResolveTilde(pth)
+	if err != nil {
+		return "", err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", pth)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if err := json.NewEncoder(conn).Encode(&ControlRequest{Command: command, Tunnel: name, Args: args}); err != nil {
+		return "", err
+	}
+	var resp ControlResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return "", err
+	}
+	if resp.Error != "" {
+		return "", errors.New(resp.Error)
+	}
+	return resp.Message, nil
+}
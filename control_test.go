@@ -0,0 +1,165 @@
+//go:build linux
+
+package sshtun
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sa6mwa/sshtun/pkg/sshtest"
+)
+
+func TestServeControl(t *testing.T) {
+	privateKey, _, err := sshtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, privateKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tunnels := &Tunnels{DisableExpvar: true}
+	tunnels.log = SetLogger(nil)
+	for _, name := range []string{"office", "lab"} {
+		s := NewSecureShellTunneler(nil)
+		s.Name = name
+		s.Enable = name == "office"
+		// Nothing listens on the discard port, the tunnels keep
+		// failing and backing off while supervised.
+		s.Remote = "127.0.0.1:9"
+		s.RemoteUser = "root"
+		s.PrivateKeyFiles = PrivateKeyFiles{keyFile}
+		s.KeepaliveInterval = 0
+		s.localTUN, _ = fakeTUN(t)
+		s.retainTUN = true
+		tunnels.Tunnels = append(tunnels.Tunnels, s)
+	}
+	office, lab := tunnels.Tunnels[0], tunnels.Tunnels[1]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socket := filepath.Join(t.TempDir(), "sshtun.sock")
+	served := make(chan error, 1)
+	go func() {
+		served <- tunnels.ServeControl(ctx, socket)
+	}()
+	opened := make(chan error, 1)
+	go func() {
+		opened <- tunnels.OpenAll(ctx)
+	}()
+	send := func(command, name string) (string, error) {
+		return SendControl(ctx, socket, command, name)
+	}
+	waitRunning := func(n int) {
+		t.Helper()
+		deadline := time.After(5 * time.Second)
+		for tunnels.Running() != n {
+			select {
+			case <-deadline:
+				t.Fatalf("expected %d running tunnels, got %d", n, tunnels.Running())
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+	waitRunning(1)
+	deadline := time.After(5 * time.Second)
+	for _, err := os.Stat(socket); err != nil; _, err = os.Stat(socket) {
+		select {
+		case err := <-served:
+			t.Fatalf("ServeControl returned: %v", err)
+		case <-deadline:
+			t.Fatalf("control socket not created: %v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	msg, err := send("status", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(msg, "office: ") || !strings.Contains(msg, "lab: "+string(STATE_IDLE)) {
+		t.Errorf("unexpected status %q", msg)
+	}
+	if msg, err := send("enable", "lab"); err != nil || msg != "enable lab: ok" {
+		t.Fatalf("unexpected enable reply %q: %v", msg, err)
+	}
+	waitRunning(2)
+	if tunnels.Enabled() != 2 {
+		t.Errorf("expected 2 enabled tunnels, got %d", tunnels.Enabled())
+	}
+	if msg, err := send("disable", "office"); err != nil || msg != "disable office: ok" {
+		t.Fatalf("unexpected disable reply %q: %v", msg, err)
+	}
+	waitRunning(1)
+	if office.Enable || !lab.Enable {
+		t.Errorf("expected office disabled and lab enabled, got %t and %t", office.Enable, lab.Enable)
+	}
+	if msg, err := send("status", "office"); err != nil || !strings.HasPrefix(msg, "office: "+string(STATE_IDLE)) {
+		t.Errorf("unexpected status of office %q: %v", msg, err)
+	}
+	if _, err := send("enable", "nonexistent"); err == nil || !strings.Contains(err.Error(), "valid names are: office, lab") {
+		t.Errorf("expected an unknown tunnel error, got: %v", err)
+	}
+	if _, err := send("restart", "lab"); err == nil || !strings.Contains(err.Error(), ErrUnknownCommand.Error()) {
+		t.Errorf("expected an unknown command error, got: %v", err)
+	}
+
+	cancel()
+	for name, done := range map[string]chan error{"OpenAll": opened, "ServeControl": served} {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("expected %s to return nil, got: %v", name, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s did not return after cancel", name)
+		}
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("expected the control socket to be removed, got: %v", err)
+	}
+}
+
+func TestServeControlPermissions(t *testing.T) {
+	defer syscall.Umask(syscall.Umask(0))
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	dir := filepath.Join(home, ".config", "sshtun")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	tunnels := &Tunnels{DisableExpvar: true}
+	tunnels.log = SetLogger(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- tunnels.ServeControl(ctx, DEFAULT_CONTROL_SOCKET)
+	}()
+	socket := filepath.Join(dir, "sshtun.sock")
+	deadline := time.After(5 * time.Second)
+	for _, err := os.Stat(socket); err != nil; _, err = os.Stat(socket) {
+		select {
+		case err := <-served:
+			t.Fatalf("ServeControl returned: %v", err)
+		case <-deadline:
+			t.Fatalf("control socket not created: %v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	for pth, want := range map[string]os.FileMode{socket: 0600, dir: 0700} {
+		if fi, err := os.Stat(pth); err != nil {
+			t.Error(err)
+		} else if fi.Mode().Perm() != want {
+			t.Errorf("expected %s with mode %v, got %v", pth, want, fi.Mode().Perm())
+		}
+	}
+	cancel()
+	if err := <-served; err != nil {
+		t.Error(err)
+	}
+}
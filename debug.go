@@ -0,0 +1,29 @@
+package sshtun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+var (
+	ErrDebugNotLoopback error = errors.New("debug listener is not on a loopback address")
+)
+
+// CheckDebugListen returns an error if address is not host:port or,
+// unless allowRemote is true, host is not a loopback address
+// (localhost, 127.0.0.0/8 or ::1). An empty host listens on every
+// interface and is not loopback.
+func CheckDebugListen(address string, allowRemote bool) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if allowRemote || host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("%w: %s, use 127.0.0.1 or allow remote access explicitly (debug_allow_remote)", ErrDebugNotLoopback, address)
+	}
+	return nil
+}
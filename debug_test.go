@@ -0,0 +1,29 @@
+package sshtun
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckDebugListen(t *testing.T) {
+	for _, address := range []string{"127.0.0.1:6060", "[::1]:6060", "localhost:0"} {
+		if err := CheckDebugListen(address, false); err != nil {
+			t.Errorf("expected %s to be allowed, got %v", address, err)
+		}
+	}
+	for _, address := range []string{":6060", "0.0.0.0:6060", "192.0.2.1:6060", "example.com:6060"} {
+		if err := CheckDebugListen(address, false); !errors.Is(err, ErrDebugNotLoopback) {
+			t.Errorf("expected %v for %s, got %v", ErrDebugNotLoopback, address, err)
+		}
+		if err := CheckDebugListen(address, true); err != nil {
+			t.Errorf("expected %s to be allowed with allowRemote, got %v", address, err)
+		}
+	}
+	if err := CheckDebugListen("127.0.0.1", false); err == nil {
+		t.Error("expected an error for an address without port")
+	}
+	tunnels := &Tunnels{DebugListen: "0.0.0.0:6060"}
+	if err := tunnels.Validate(); !errors.Is(err, ErrDebugNotLoopback) {
+		t.Errorf("expected Validate to return %v, got %v", ErrDebugNotLoopback, err)
+	}
+}
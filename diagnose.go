@@ -0,0 +1,481 @@
+package sshtun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/alessio/shellescape"
+	"github.com/sa6mwa/sshtun/pkg/tun"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	DIAGNOSE_PASS string = "pass"
+	DIAGNOSE_FAIL string = "fail"
+	DIAGNOSE_SKIP string = "skip"
+
+	// diagnosePingSize is the size of the small echo request of
+	// Diagnose, the 84 bytes of a default ping.
+	diagnosePingSize int = 84
+)
+
+var (
+	// diagnoseTimeout bounds each network step of Diagnose and how long
+	// a ping waits for its reply, changed by tests.
+	diagnoseTimeout = 5 * time.Second
+)
+
+// DiagnosticStep is the outcome of one step of Diagnose. Result is
+// DIAGNOSE_PASS, DIAGNOSE_FAIL or DIAGNOSE_SKIP. A failed step has
+// the error and a hint on how to fix it.
+type DiagnosticStep struct {
+	Step     string   `json:"step"`
+	Result   string   `json:"result"`
+	Detail   string   `json:"detail,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	Hint     string   `json:"hint,omitempty"`
+	Duration Duration `json:"duration"`
+}
+
+// Diagnosis is the checklist returned by SSHTUN.Diagnose.
+type Diagnosis struct {
+	Tunnel string           `json:"tunnel"`
+	Steps  []DiagnosticStep `json:"steps"`
+}
+
+// Failed returns true if any step failed.
+func (d *Diagnosis) Failed() bool {
+	for _, step := range d.Steps {
+		if step.Result == DIAGNOSE_FAIL {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns d as one PASS, FAIL or SKIP line per step, a failed
+// step followed by its error and hint.
+func (d *Diagnosis) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "diagnosis of %s", d.Tunnel)
+	for _, step := range d.Steps {
+		line := fmt.Sprintf("%-4s %-13s %s", strings.ToUpper(step.Result), step.Step, step.Detail)
+		b.WriteString("\n" + strings.TrimRight(line, " "))
+		if step.Error != "" {
+			fmt.Fprintf(&b, "\n     error: %s", step.Error)
+		}
+		if step.Hint != "" {
+			fmt.Fprintf(&b, "\n     hint:  %s", step.Hint)
+		}
+	}
+	return b.String()
+}
+
+// diagnoser records the steps of a Diagnosis, skipping every step
+// after the first failure as it depends on the earlier ones.
+type diagnoser struct {
+	d      *Diagnosis
+	failed bool
+}
+
+// run runs fn as step name unless an earlier step failed. fn returns
+// a detail for the report, hint returns how to fix its error.
+func (g *diagnoser) run(name string, hint func(error) string, fn func() (string, error)) bool {
+	if g.failed {
+		g.skip(name, "an earlier step failed")
+		return false
+	}
+	start := time.Now()
+	detail, err := fn()
+	step := DiagnosticStep{Step: name, Result: DIAGNOSE_PASS, Detail: detail, Duration: Duration(time.Since(start))}
+	if err != nil {
+		g.failed = true
+		step.Result, step.Error, step.Hint = DIAGNOSE_FAIL, err.Error(), hint(err)
+	}
+	g.d.Steps = append(g.d.Steps, step)
+	return err == nil
+}
+
+func (g *diagnoser) skip(name, reason string) {
+	g.d.Steps = append(g.d.Steps, DiagnosticStep{Step: name, Result: DIAGNOSE_SKIP, Detail: reason})
+}
+
+// hint returns a hint function always returning text.
+func hint(text string) func(error) string {
+	return func(error) string { return text }
+}
+
+// Diagnose goes through what opening the tunnel takes one step at a
+// time and returns which steps passed and where it broke: the
+// configuration, DNS resolution of remote, the TCP connection, SSH
+// authentication, the remote architecture, /dev/net/tun on the
+// remote, the helper upload with its hash, sudo on the remote, the
+// local tun device with its address and link, starting the helper and
+// finally ICMP echo requests to the address of RemoteNetwork, one
+// small and one as large as the MTU allows with don't fragment set.
+// Steps after a failed one are skipped. The tunnel is closed and the
+// local device removed again before Diagnose returns, creating it
+// takes the same privileges as Open.
+func (s *SSHTUN) Diagnose(ctx context.Context) *Diagnosis {
+	g := &diagnoser{d: &Diagnosis{Tunnel: s.Name}}
+	var cleanup []func()
+	defer func() {
+		for i := len(cleanup) - 1; i >= 0; i-- {
+			cleanup[i]()
+		}
+	}()
+
+	g.run("config", hint("fix the tunnel with sshtun -edit, sshtun -check validates every tunnel"), func() (string, error) {
+		if err := s.Validate(); err != nil {
+			return "", err
+		}
+		if err := s.CheckPrivateKeys(); err != nil {
+			return "", fmt.Errorf("private keys: %w", err)
+		}
+		warnings, err := s.ValidateAddressing()
+		return strings.Join(warnings, "; "), err
+	})
+	g.run("dns", hint("check the host name of remote and the resolver (/etc/resolv.conf), or use an IP address"), func() (string, error) {
+		host, _, err := net.SplitHostPort(s.Remote)
+		if err != nil {
+			return "", err
+		}
+		if net.ParseIP(host) != nil {
+			return host + " is an address", nil
+		}
+		c, cancel := context.WithTimeout(ctx, diagnoseTimeout)
+		defer cancel()
+		addrs, err := net.DefaultResolver.LookupHost(c, host)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s is %s", host, strings.Join(addrs, ", ")), nil
+	})
+	g.run("tcp-connect", s.connectHint, func() (string, error) {
+		d := net.Dialer{Timeout: diagnoseTimeout}
+		conn, err := d.DialContext(ctx, s.Protocol, s.Remote)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		return "connected to " + conn.RemoteAddr().String(), nil
+	})
+	var client *ssh.Client
+	g.run("ssh-auth", s.authHint, func() (string, error) {
+		var err error
+		if client, err = s.Dial(ctx); err != nil {
+			return "", err
+		}
+		cleanup = append(cleanup, func() { client.Close() })
+		return fmt.Sprintf("authenticated as %s, server %s", s.RemoteUser, client.ServerVersion()), nil
+	})
+
+	if s.forwarding() {
+		for _, name := range []string{"remote-arch", "remote-tun", "helper-upload", "remote-sudo", "local-tun", "local-address", "link-up", "helper-start", "ping", "ping-mtu"} {
+			g.skip(name, "not used by port forwarding tunnels")
+		}
+		return g.d
+	}
+
+	g.run("remote-arch", hint("build tunreadwriter for the remote yourself and install it as remote_helper_path"), func() (string, error) {
+		helper, err := remoteHelper(client)
+		if err != nil {
+			return "", err
+		}
+		return "embedded helper for " + helper.Arch, nil
+	})
+	g.run("remote-tun", hint("load the tun module on the remote (modprobe tun), a container needs /dev/net/tun passed through"), func() (string, error) {
+		if err := sshrun(client, "test -c "+DEV_NET_TUN); err != nil {
+			return "", fmt.Errorf("%s is not a character device on the remote: %w", DEV_NET_TUN, err)
+		}
+		return DEV_NET_TUN + " exists", nil
+	})
+	g.run("helper-upload", s.uploadHint, func() (string, error) {
+		if s.RemoteHelperPath != "" {
+			if err := s.useInstalledHelper(client); err != nil {
+				return "", err
+			}
+		} else if err := s.UploadHelperToRemote(client, s.remoteUploadDirectory()); err != nil {
+			return "", err
+		}
+		pth := s.remoteTunReadWriter
+		if !s.CachesHelper() && s.RemoteHelperPath == "" {
+			cleanup = append(cleanup, func() { sshrun(client, "rm -f "+shellescape.Quote(pth)) })
+		}
+		out, err := sshoutput(client, "sha256sum "+shellescape.Quote(pth))
+		if err != nil {
+			return "", err
+		}
+		sum, _, _ := strings.Cut(strings.TrimSpace(out), " ")
+		helper, err := remoteHelper(client)
+		if err != nil {
+			return "", err
+		}
+		if sum != helper.SHA256 {
+			return "", fmt.Errorf("%w: %s has sha256 %s, expected %s", ErrChecksumMismatch, pth, sum, helper.SHA256)
+		}
+		return fmt.Sprintf("%s with sha256 %s", pth, sum), nil
+	})
+	g.run("remote-sudo", s.sudoHint, func() (string, error) {
+		sudo := s.sudoCommand()
+		if len(sudo) == 0 {
+			return "not needed, remote_user is root", nil
+		}
+		if err := s.checkRemoteSudo(client); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s allows running %s", sudo[0], s.remoteExecutable()), nil
+	})
+
+	var localTUN *tun.TUN
+	var b *Became
+	privileged := privopEnabled()
+	g.run("local-tun", s.localTunHint, func() (string, error) {
+		var err error
+		switch {
+		case s.Unprivileged:
+			localTUN, err = s.openProvisionedTUN()
+		case privileged:
+			var uid, gid int
+			if uid, gid, err = s.localTunOwner(); err == nil {
+				localTUN, err = privopCreateTUN(TUNRequest{
+					Device:   s.LocalTunDevice,
+					MTU:      s.LocalMTU,
+					Network:  s.LocalNetwork,
+					Network6: s.LocalNetwork6,
+					Peer:     s.localPeer(),
+					TAP:      s.tap(),
+					Bridge:   s.LocalBridge,
+					UID:      uid,
+					GID:      gid,
+				})
+			}
+		default:
+			localTUN, b, err = s.diagnoseCreateTUN()
+		}
+		if err != nil {
+			return "", err
+		}
+		cleanup = append(cleanup, func() { localTUN.Close() })
+		return fmt.Sprintf("%s %s", s.deviceType(), localTUN.Name), nil
+	})
+	g.run("local-address", hint("remove the overlapping address or route, or pick another local_network, sshtun -list shows the networks of every tunnel"), func() (string, error) {
+		switch {
+		case s.Unprivileged:
+			return "assigned when provisioned", nil
+		case privileged:
+			return "assigned by the privileged helper", nil
+		}
+		return s.diagnoseConfigureTUN(b, localTUN)
+	})
+	g.run("link-up", hint("run as root or with CAP_NET_ADMIN, ip link shows why the device is down"), func() (string, error) {
+		if s.Unprivileged || privileged {
+			return localTUN.Name + " is up", nil
+		}
+		if err := s.linkUp(b, localTUN); err != nil {
+			return "", err
+		}
+		return localTUN.Name + " is up", nil
+	})
+
+	g.run("helper-start", s.startHint, func() (string, error) {
+		tunneling := make(chan error, 1)
+		go func() { tunneling <- s.StartTunneling(client, localTUN) }()
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		for s.inject.Load() == nil {
+			select {
+			case err := <-tunneling:
+				if err == nil {
+					err = errors.New("helper exited without error")
+				}
+				return "", err
+			case <-ticker.C:
+			case <-ctx.Done():
+				client.Close()
+				<-tunneling
+				return "", ctx.Err()
+			}
+		}
+		cleanup = append(cleanup, func() {
+			client.Close()
+			<-tunneling
+		})
+		return fmt.Sprintf("remote device %s with MTU %d", s.remoteHandshake.Device, s.remoteHandshake.MTU), nil
+	})
+	if _, err := s.newSpeedTester(diagnosePingSize); err != nil {
+		g.skip("ping", err.Error())
+		g.skip("ping-mtu", err.Error())
+		return g.d
+	}
+	g.run("ping", hint("the helper runs but nothing answers, check remote_network and that the firewall of the remote accepts ICMP on its tun device"), func() (string, error) {
+		return s.diagnosePing(ctx, diagnosePingSize)
+	})
+	size := s.speedTestPacketSize()
+	g.run("ping-mtu", hint(fmt.Sprintf("small packets pass but %d bytes do not, lower local_mtu and remote_mtu until ping-mtu passes", size)), func() (string, error) {
+		return s.diagnosePing(ctx, size)
+	})
+	return g.d
+}
+
+// diagnoseCreateTUN creates the local device like createLocalTUN
+// without configuring it, so that its address is a step of its own.
+func (s *SSHTUN) diagnoseCreateTUN() (*tun.TUN, *Became, error) {
+	uid, gid, err := s.localTunOwner()
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := s.Become(ROOT)
+	if err != nil {
+		return nil, nil, err
+	}
+	create := tun.CreateTUN
+	if s.tap() {
+		create = tun.CreateTAP
+	}
+	localTUN, err := create(s.LocalTunDevice, s.LocalMTU, uid, gid)
+	if uerr := b.Unbecome(); err == nil && uerr != nil {
+		localTUN.Close()
+		err = uerr
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return localTUN, b, nil
+}
+
+// diagnoseConfigureTUN assigns the addresses of localTUN or enslaves
+// it into LocalBridge, the second half of createLocalTUN.
+func (s *SSHTUN) diagnoseConfigureTUN(b *Became, localTUN *tun.TUN) (string, error) {
+	var detail string
+	if err := s.CheckAddressConflicts(); errors.Is(err, ErrAddressConflict) && s.AllowOverlap {
+		detail = err.Error() + ", allowed by allow_overlap; "
+	} else if err != nil {
+		return "", err
+	}
+	if err := b.Become(ROOT); err != nil {
+		return "", err
+	}
+	var err error
+	if s.LocalBridge != "" {
+		err = localTUN.JoinBridge(s.LocalBridge)
+		detail += "enslaved into bridge " + s.LocalBridge
+	} else {
+		err = s.configureLocalTUN(localTUN)
+		detail += strings.TrimSpace(s.LocalNetwork + " " + s.LocalNetwork6)
+	}
+	if uerr := b.Unbecome(); err == nil {
+		err = uerr
+	}
+	return detail, err
+}
+
+// diagnosePing sends one echo request of size bytes through the
+// running tunnel to the address of RemoteNetwork and waits up to
+// diagnoseTimeout for the reply.
+func (s *SSHTUN) diagnosePing(ctx context.Context, size int) (string, error) {
+	w := s.inject.Load()
+	if w == nil {
+		return "", fmt.Errorf("%w: tunnel %q is not connected", ErrTunnelNotRunning, s.Name)
+	}
+	t, err := s.newSpeedTester(size)
+	if err != nil {
+		return "", err
+	}
+	if !s.speedTest.CompareAndSwap(nil, t) {
+		return "", fmt.Errorf("%w on tunnel %q", ErrSpeedTestRunning, s.Name)
+	}
+	defer s.speedTest.Store(nil)
+	packet, err := t.request()
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(packet); err != nil {
+		return "", err
+	}
+	deadline := time.Now().Add(diagnoseTimeout)
+	for t.expire(time.Time{}) > 0 {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("no reply from %s to %d bytes within %s", t.dst, size, diagnoseTimeout)
+		}
+		t.wait(ctx)
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return fmt.Sprintf("%d bytes to %s, reply in %s", size, t.dst, t.rtts[0].Round(10*time.Microsecond)), nil
+}
+
+func (s *SSHTUN) connectHint(err error) string {
+	var nerr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return fmt.Sprintf("nothing listens on %s, check that sshd runs and the port of remote", s.Remote)
+	case errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH):
+		return "there is no route to the remote, check the network and the local routes"
+	case errors.As(err, &nerr) && nerr.Timeout():
+		return "the remote does not answer, a firewall may drop the connection or the host is down"
+	}
+	return "check remote and the network path to it"
+}
+
+func (s *SSHTUN) authHint(err error) string {
+	switch {
+	case errors.Is(err, ErrEmptySshAuthSock):
+		return "start ssh-agent and set SSH_AUTH_SOCK, or set use_ssh_agent to false and use private_key_files"
+	case errors.Is(err, ErrHostKeyMismatch):
+		return "the host key of the remote changed, verify it before connecting again"
+	case errors.Is(err, ErrAuthFailed):
+		return fmt.Sprintf("add the public key of private_key_files to ~%s/.ssh/authorized_keys on the remote, e.g with ssh-copy-id", s.RemoteUser)
+	}
+	return "the remote closed the connection during the handshake, check its sshd log"
+}
+
+func (s *SSHTUN) uploadHint(err error) string {
+	switch {
+	case errors.Is(err, ErrRemoteHelperMissing):
+		return fmt.Sprintf("install the helper with sshtun -install-remote-helper %s or set remote_helper_auto_update", s.Name)
+	case errors.Is(err, ErrChecksumMismatch):
+		return "the helper on the remote is not the embedded one, remove it and diagnose again"
+	}
+	return fmt.Sprintf("check that %s on the remote is writable, not full and not mounted noexec, or try another upload_method (scp, sftp or cat)", s.remoteUploadDirectory())
+}
+
+func (s *SSHTUN) sudoHint(err error) string {
+	if errors.Is(err, ErrSudoPasswordRequired) {
+		return "add the NOPASSWD sudoers entry in the error to the remote, or connect as root"
+	}
+	return "check remote_sudo_command and that remote_user may run the helper with it"
+}
+
+func (s *SSHTUN) localTunHint(err error) string {
+	switch {
+	case errors.Is(err, ErrNotProvisioned):
+		return "provision the device with sudo sshtun -provision"
+	case errors.Is(err, os.ErrNotExist):
+		return "load the tun module (modprobe tun)"
+	case errors.Is(err, os.ErrPermission) || errors.Is(err, syscall.EPERM):
+		return "run as root or with CAP_NET_ADMIN, or make the tunnel unprivileged and provision it with sudo sshtun -provision"
+	case errors.Is(err, syscall.EBUSY):
+		return fmt.Sprintf("%s is in use, close the sshtun using it or pick another local_tun_device", s.LocalTunDevice)
+	}
+	return "run as root or with CAP_NET_ADMIN and check that the tun module is loaded (modprobe tun)"
+}
+
+func (s *SSHTUN) startHint(err error) string {
+	switch {
+	case errors.Is(err, ErrSudoPasswordRequired):
+		return "add the NOPASSWD sudoers entry in the error to the remote"
+	case errors.Is(err, ErrHelperProtocol):
+		return fmt.Sprintf("the remote helper is incompatible, update it with sshtun -install-remote-helper %s", s.Name)
+	}
+	return "the helper failed on the remote, check the error, remote_network and that remote_tun_device is not in use"
+}
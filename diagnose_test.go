@@ -0,0 +1,87 @@
+package sshtun
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sa6mwa/sshtun/pkg/sshtest"
+)
+
+func TestDiagnose(t *testing.T) {
+	privateKey, _, err := sshtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, privateKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	helper, err := HelperForMachine("x86_64")
+	if err != nil {
+		t.Skip(err)
+	}
+	hp, err := sshtest.NewHoneyPot(
+		sshtest.WithExec("uname -m", sshtest.ExecResult{Stdout: "x86_64\n"}),
+		sshtest.WithExec("test -c /dev/net/tun", sshtest.ExecResult{}),
+		sshtest.WithExec("test -f /usr/local/bin/tunreadwriter", sshtest.ExecResult{Stdout: helper.SHA256 + "  /usr/local/bin/tunreadwriter\n"}),
+		sshtest.WithExec("sha256sum /usr/local/bin/tunreadwriter", sshtest.ExecResult{Stdout: helper.SHA256 + "  /usr/local/bin/tunreadwriter\n"}),
+		sshtest.WithExec("sudo -n -l", sshtest.ExecResult{ExitStatus: 1, Stderr: "sudo: a password is required\n"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hp.Close()
+
+	s := NewSecureShellTunneler(nil)
+	s.Name = "office"
+	s.Remote = hp.Addr()
+	s.RemoteUser = "test"
+	s.PrivateKeyFiles = PrivateKeyFiles{keyFile}
+	s.RemoteHelperPath = "/usr/local/bin/tunreadwriter"
+	d := s.Diagnose(context.Background())
+	if !d.Failed() {
+		t.Fatalf("expected the diagnosis to fail:\n%s", d)
+	}
+	results := make(map[string]DiagnosticStep)
+	var names []string
+	for _, step := range d.Steps {
+		results[step.Step] = step
+		names = append(names, step.Step)
+	}
+	if strings.Join(names, " ") != "config dns tcp-connect ssh-auth remote-arch remote-tun helper-upload remote-sudo local-tun local-address link-up helper-start ping ping-mtu" {
+		t.Errorf("unexpected steps %q", names)
+	}
+	for _, name := range []string{"config", "dns", "tcp-connect", "ssh-auth", "remote-arch", "remote-tun", "helper-upload"} {
+		if results[name].Result != DIAGNOSE_PASS {
+			t.Errorf("expected %s to pass, got %+v", name, results[name])
+		}
+	}
+	if sudo := results["remote-sudo"]; sudo.Result != DIAGNOSE_FAIL || !strings.Contains(sudo.Hint, "NOPASSWD") {
+		t.Errorf("expected remote-sudo to fail with a sudoers hint, got %+v", sudo)
+	}
+	if results["local-tun"].Result != DIAGNOSE_SKIP || results["ping-mtu"].Result != DIAGNOSE_SKIP {
+		t.Errorf("expected the steps after remote-sudo to be skipped:\n%s", d)
+	}
+	if text := d.String(); !strings.Contains(text, "FAIL remote-sudo") || !strings.Contains(text, "PASS remote-arch   embedded helper for "+helper.Arch) {
+		t.Errorf("unexpected text report:\n%s", text)
+	}
+
+	// Nothing listens on a port just closed.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Remote = l.Addr().String()
+	l.Close()
+	d = s.Diagnose(context.Background())
+	if tcp := d.Steps[2]; tcp.Step != "tcp-connect" || tcp.Result != DIAGNOSE_FAIL || !strings.Contains(tcp.Hint, "nothing listens on") {
+		t.Errorf("expected tcp-connect to fail with a hint, got %+v", tcp)
+	}
+	if auth := d.Steps[3]; auth.Result != DIAGNOSE_SKIP {
+		t.Errorf("expected ssh-auth to be skipped, got %+v", auth)
+	}
+}
@@ -0,0 +1,242 @@
+package sshtun
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	// DNS_RESOLVED configures the tun device as a link of
+	// systemd-resolved by running the resolvectl command (dns, domain
+	// and revert), which has to be installed. The D-Bus and varlink
+	// APIs are not used. The servers are used for the tunnel only.
+	DNS_RESOLVED string = "resolved"
+	// DNS_RESOLV_CONF rewrites RESOLV_CONF while the tunnel is up, the
+	// fallback when systemd-resolved is not running (or resolvectl is
+	// missing). Fails in a unit with ProtectSystem=strict where /etc is
+	// read-only.
+	DNS_RESOLV_CONF string = "resolv.conf"
+
+	RESOLV_CONF string = "/etc/resolv.conf"
+	RESOLVECTL  string = "resolvectl"
+
+	// resolvedVarlinkSocket exists while systemd-resolved is running.
+	resolvedVarlinkSocket string = "/run/systemd/resolve/io.systemd.Resolve"
+	// resolvConfMarker starts the first line of a RESOLV_CONF written
+	// by sshtun.
+	resolvConfMarker string = "# sshtun:"
+)
+
+var (
+	ErrResolvConfInUse error = errors.New("resolv.conf is already rewritten by sshtun")
+
+	// resolvConfPath is RESOLV_CONF, changed by tests.
+	resolvConfPath = RESOLV_CONF
+)
+
+// DNSStatus is the DNS configuration applied while a tunnel is up, see
+// DNSServers and DNSSearch.
+type DNSStatus struct {
+	Servers []string `json:"servers,omitempty"`
+	Search  []string `json:"search,omitempty"`
+	Method  string   `json:"method"`
+	Device  string   `json:"device,omitempty"`
+}
+
+// String describes d, e.g 10.0.0.53 search corp.example (resolved on
+// tun0).
+func (d *DNSStatus) String() string {
+	var b strings.Builder
+	b.WriteString(strings.Join(d.Servers, " "))
+	if len(d.Search) > 0 {
+		if b.Len() > 0 {
+			b.WriteString(" ")
+		}
+		b.WriteString("search " + strings.Join(d.Search, " "))
+	}
+	if d.Method == DNS_RESOLVED {
+		fmt.Fprintf(&b, " (%s on %s)", d.Method, d.Device)
+	} else {
+		fmt.Fprintf(&b, " (%s)", d.Method)
+	}
+	return b.String()
+}
+
+// resolvedRunning reports if DNS can be configured per link through
+// systemd-resolved: it is running and resolvectl is on the PATH.
+func resolvedRunning() bool {
+	if _, err := os.Stat(resolvedVarlinkSocket); err != nil {
+		return false
+	}
+	_, err := exec.LookPath(RESOLVECTL)
+	return err == nil
+}
+
+// applyDNS configures DNSServers and DNSSearch for the tunnel through
+// systemd-resolved on device or, if it is not running, by rewriting
+// RESOLV_CONF. Failures are logged as warnings, DNS is not worth
+// failing the tunnel for. The returned func restores the previous
+// configuration.
+func (s *SSHTUN) applyDNS(device string) func() {
+	if len(s.DNSServers) == 0 && len(s.DNSSearch) == 0 {
+		return func() {}
+	}
+	become := func() func() {
+		if privopEnabled() || s.Unprivileged {
+			return func() {}
+		}
+		b, err := s.Become(ROOT)
+		if err != nil {
+			return func() {}
+		}
+		return func() { b.Unbecome() }
+	}
+	defer become()()
+	status := &DNSStatus{Servers: s.DNSServers, Search: s.DNSSearch, Method: DNS_RESOLV_CONF}
+	var restore func() error
+	var err error
+	if resolvedRunning() {
+		status.Method, status.Device = DNS_RESOLVED, device
+		restore, err = resolvectl(device, s.DNSServers, s.DNSSearch)
+	} else {
+		restore, err = s.rewriteResolvConf(resolvConfPath)
+	}
+	if err != nil {
+		s.log().Warn(fmt.Sprintf("Unable to configure DNS with %s", status.Method), "name", s.Name, "remote", s.Remote, "dns_servers", strings.Join(s.DNSServers, ","), "dns_search", strings.Join(s.DNSSearch, ","), "error", err)
+		return func() {}
+	}
+	s.dns.Store(status)
+	s.log().Info(fmt.Sprintf("DNS %s", status), "name", s.Name, "remote", s.Remote, "dns_servers", strings.Join(s.DNSServers, ","), "dns_search", strings.Join(s.DNSSearch, ","), "dns_method", status.Method)
+	return func() {
+		defer become()()
+		s.dns.Store(nil)
+		if err := restore(); err != nil {
+			s.log().Warn(fmt.Sprintf("Unable to restore DNS configured with %s", status.Method), "name", s.Name, "remote", s.Remote, "error", err)
+		}
+	}
+}
+
+// resolvectl sets the DNS servers and search domains of the link
+// device in systemd-resolved. The returned func reverts the link, the
+// settings also go away with the device.
+func resolvectl(device string, servers, search []string) (func() error, error) {
+	run := func(args ...string) error {
+		out, err := exec.Command(RESOLVECTL, args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s %s: %w: %s", RESOLVECTL, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	revert := func() error { return run("revert", device) }
+	if len(servers) > 0 {
+		if err := run(append([]string{"dns", device}, servers...)...); err != nil {
+			return nil, err
+		}
+	}
+	if len(search) > 0 {
+		if err := run(append([]string{"domain", device}, search...)...); err != nil {
+			revert()
+			return nil, err
+		}
+	}
+	return revert, nil
+}
+
+// resolvConfBackup returns where the original resolv.conf is kept while
+// the tunnel has rewritten it, next to the route state file.
+func (s *SSHTUN) resolvConfBackup() string {
+	return filepath.Join(stateDirectory(), strings.ReplaceAll(s.Name, "/", "_")+".resolv.conf")
+}
+
+// rewriteResolvConf puts DNSServers and DNSSearch first in the
+// resolv.conf at pth, keeping the original in resolvConfBackup. A
+// symlink (managed by another service) or a file already rewritten by
+// another tunnel is left alone, a rewrite left behind by a crash of
+// this tunnel is restored first. The returned func restores the
+// original unless the file was changed by someone else since.
+func (s *SSHTUN) rewriteResolvConf(pth string) (func() error, error) {
+	if fi, err := os.Lstat(pth); err != nil {
+		return nil, err
+	} else if fi.Mode()&os.ModeSymlink != 0 {
+		target, _ := os.Readlink(pth)
+		return nil, fmt.Errorf("%s is a symlink to %s, managed by another service", pth, target)
+	}
+	original, err := os.ReadFile(pth)
+	if err != nil {
+		return nil, err
+	}
+	header := fmt.Sprintf("%s tunnel %q, the original is restored from %s when it goes down", resolvConfMarker, s.Name, s.resolvConfBackup())
+	if bytes.HasPrefix(original, []byte(resolvConfMarker)) {
+		backup, err := os.ReadFile(s.resolvConfBackup())
+		if !bytes.HasPrefix(original, []byte(header)) || err != nil {
+			line, _, _ := bytes.Cut(original, []byte("\n"))
+			return nil, fmt.Errorf("%w (%s)", ErrResolvConfInUse, line)
+		}
+		s.log().Warn(fmt.Sprintf("Restoring %s left behind by a previous run", pth), "name", s.Name, "remote", s.Remote, "backup", s.resolvConfBackup())
+		original = backup
+	}
+	if err := os.MkdirAll(filepath.Dir(s.resolvConfBackup()), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(s.resolvConfBackup(), original, 0644); err != nil {
+		return nil, err
+	}
+	rewritten := resolvConf(original, header, s.DNSServers, s.DNSSearch)
+	if err := os.WriteFile(pth, rewritten, 0644); err != nil {
+		os.Remove(s.resolvConfBackup())
+		return nil, err
+	}
+	return func() error {
+		current, err := os.ReadFile(pth)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(current, rewritten) {
+			os.Remove(s.resolvConfBackup())
+			return fmt.Errorf("%s was changed since it was rewritten, not restored", pth)
+		}
+		if err := os.WriteFile(pth, original, 0644); err != nil {
+			return err
+		}
+		return os.Remove(s.resolvConfBackup())
+	}, nil
+}
+
+// resolvConf returns original with header, a nameserver line for every
+// server and the search domains first. The original search (or domain)
+// domains are appended to search, its nameservers follow (the resolver
+// uses the first three).
+func resolvConf(original []byte, header string, servers, search []string) []byte {
+	var b bytes.Buffer
+	b.WriteString(header + "\n")
+	for _, server := range servers {
+		b.WriteString("nameserver " + server + "\n")
+	}
+	var rest bytes.Buffer
+	domains := append([]string{}, search...)
+	for _, line := range strings.SplitAfter(string(original), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && (fields[0] == "search" || fields[0] == "domain") {
+			for _, domain := range fields[1:] {
+				if !slices.Contains(domains, domain) {
+					domains = append(domains, domain)
+				}
+			}
+			continue
+		}
+		rest.WriteString(line)
+	}
+	if len(domains) > 0 {
+		b.WriteString("search " + strings.Join(domains, " ") + "\n")
+	}
+	b.Write(rest.Bytes())
+	if b.Len() > 0 && b.Bytes()[b.Len()-1] != '\n' {
+		b.WriteString("\n")
+	}
+	return b.Bytes()
+}
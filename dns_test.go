@@ -0,0 +1,139 @@
+package sshtun
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolvConf(t *testing.T) {
+	original := "# Generated by NetworkManager\nsearch home.example corp.example\nnameserver 192.168.1.1\noptions edns0"
+	got := string(resolvConf([]byte(original), "# sshtun: test", []string{"10.0.0.53", "10.0.0.54"}, []string{"corp.example"}))
+	want := "# sshtun: test\nnameserver 10.0.0.53\nnameserver 10.0.0.54\nsearch corp.example home.example\n# Generated by NetworkManager\nnameserver 192.168.1.1\noptions edns0\n"
+	if got != want {
+		t.Errorf("got:\n%s\nexpected:\n%s", got, want)
+	}
+}
+
+func TestRewriteResolvConf(t *testing.T) {
+	defer func(dir string) { routeStateDirectory = dir }(routeStateDirectory)
+	routeStateDirectory = t.TempDir()
+	pth := filepath.Join(t.TempDir(), "resolv.conf")
+	original := "nameserver 192.168.1.1\n"
+	if err := os.WriteFile(pth, []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+	read := func() string {
+		b, err := os.ReadFile(pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	s := NewSecureShellTunneler(nil)
+	s.Name = "office"
+	s.DNSServers, s.DNSSearch = []string{"10.0.0.53"}, []string{"corp.example"}
+	restore, err := s.rewriteResolvConf(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := read(); !strings.HasPrefix(got, `# sshtun: tunnel "office"`) || !strings.Contains(got, "nameserver 10.0.0.53\nsearch corp.example\nnameserver 192.168.1.1\n") {
+		t.Errorf("unexpected rewrite:\n%s", got)
+	}
+
+	other := NewSecureShellTunneler(nil)
+	other.Name = "lab"
+	other.DNSServers = []string{"10.1.0.53"}
+	if _, err := other.rewriteResolvConf(pth); !errors.Is(err, ErrResolvConfInUse) {
+		t.Errorf("expected %v for a second tunnel, got %v", ErrResolvConfInUse, err)
+	}
+
+	// A crash leaves the rewrite behind, the next run of the same
+	// tunnel starts from the original again.
+	s = NewSecureShellTunneler(nil)
+	s.Name = "office"
+	s.DNSServers = []string{"10.0.0.53"}
+	restore, err = s.rewriteResolvConf(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := read(); strings.Count(got, "# sshtun:") != 1 || strings.Contains(got, "corp.example") {
+		t.Errorf("expected a rewrite of the original, got:\n%s", got)
+	}
+	if err := restore(); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(); got != original {
+		t.Errorf("expected the original restored, got:\n%s", got)
+	}
+	if _, err := os.Stat(s.resolvConfBackup()); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the backup to be removed, got: %v", err)
+	}
+
+	restore, err = s.rewriteResolvConf(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pth, []byte("nameserver 192.168.2.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := restore(); err == nil || read() != "nameserver 192.168.2.1\n" {
+		t.Errorf("expected a file changed by someone else to be left alone, got %v:\n%s", err, read())
+	}
+
+	link := filepath.Join(t.TempDir(), "resolv.conf")
+	if err := os.Symlink(pth, link); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.rewriteResolvConf(link); err == nil || !strings.Contains(err.Error(), "symlink") {
+		t.Errorf("expected a symlinked resolv.conf to be refused, got %v", err)
+	}
+}
+
+func TestStatusText(t *testing.T) {
+	office := NewSecureShellTunneler(nil)
+	office.Name = "office"
+	office.setState(STATE_CONNECTED)
+	office.upSince.Store(time.Now().Add(-time.Minute).UnixNano())
+	office.dns.Store(&DNSStatus{Servers: []string{"10.0.0.53"}, Search: []string{"corp.example"}, Method: DNS_RESOLVED, Device: "tun0"})
+	lab := NewSecureShellTunneler(nil)
+	lab.Name = "lab"
+	tunnels := &Tunnels{Tunnels: []*SSHTUN{office, lab}, log: SetLogger(nil)}
+	text, err := tunnels.StatusText("office")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(text, "office: connected for 1m") || !strings.HasSuffix(text, ", dns 10.0.0.53 search corp.example (resolved on tun0)") {
+		t.Errorf("unexpected status %q", text)
+	}
+	if _, err := tunnels.StatusText("nope"); !errors.Is(err, ErrUnknownTunnel) {
+		t.Errorf("expected %v, got %v", ErrUnknownTunnel, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socket := filepath.Join(t.TempDir(), "sshtun.sock")
+	served := make(chan error, 1)
+	go func() { served <- tunnels.ServeControl(ctx, socket) }()
+	var msg string
+	for attempt := 0; ; attempt++ {
+		if msg, err = SendControl(ctx, socket, "status", ""); err == nil || attempt == 50 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(msg, "\n"); len(lines) != 2 || !strings.HasPrefix(lines[0], "office: connected") || lines[1] != "lab: idle" {
+		t.Errorf("unexpected status of every tunnel %q", msg)
+	}
+	cancel()
+	if err := <-served; err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,93 @@
+package sshtun
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Effective returns a copy of the configuration as it will be used
+// when the tunnels are opened: defaults filled in (e.g remote_scp,
+// remote_sudo_command, remote_cache_helper and upload_method), ~/ in
+// private key paths resolved and durations normalized (2m0s). The
+// configuration does not hold any secrets, keys are only referenced
+// by path. Intended for display, e.g sshtun -print-config.
+func (t *Tunnels) Effective() (*Tunnels, error) {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	var effective Tunnels
+	if err := json.Unmarshal(b, &effective); err != nil {
+		return nil, err
+	}
+	for _, tunnel := range effective.Tunnels {
+		if tunnel.Type == "" {
+			tunnel.Type = TYPE_TUN
+		}
+		if tunnel.Role == "" && !tunnel.forwarding() {
+			tunnel.Role = ROLE_CLIENT
+		}
+		if tunnel.DeviceType == "" && !tunnel.forwarding() {
+			tunnel.DeviceType = DEVICE_TUN
+		}
+		if tunnel.RemoteSCP == "" {
+			tunnel.RemoteSCP = USR_BIN_SCP
+		}
+		if tunnel.RemoteUploadDirectory == "" {
+			tunnel.RemoteUploadDirectory = DEFAULT_UPLOAD_DIR
+		}
+		if tunnel.UploadMethod == "" {
+			tunnel.UploadMethod = UPLOAD_AUTO
+		}
+		if tunnel.RemoteSudoCommand == nil {
+			sudo := strings.Join(tunnel.sudoCommand(), " ")
+			tunnel.RemoteSudoCommand = &sudo
+		}
+		if tunnel.RemoteCleanupAge == 0 {
+			tunnel.RemoteCleanupAge = Duration(DEFAULT_REMOTE_CLEANUP_AGE)
+		}
+		if tunnel.KeepaliveTimeout == 0 {
+			tunnel.KeepaliveTimeout = tunnel.keepaliveTimeout()
+		}
+		if tunnel.TCPKeepalive == 0 {
+			tunnel.TCPKeepalive = Duration(tunnel.tcpKeepalive())
+		}
+		if tunnel.TCPUserTimeout == 0 {
+			tunnel.TCPUserTimeout = Duration(tunnel.tcpUserTimeout())
+		}
+		if tunnel.UploadTimeout == 0 {
+			tunnel.UploadTimeout = Duration(tunnel.uploadTimeout())
+		}
+		if tunnel.StartTimeout == 0 {
+			tunnel.StartTimeout = Duration(tunnel.startTimeout())
+		}
+		if tunnel.HealthCheck != nil {
+			tunnel.HealthCheck.Interval = Duration(tunnel.HealthCheck.interval())
+			tunnel.HealthCheck.MaxMisses = tunnel.HealthCheck.maxMisses()
+		}
+		if tunnel.StableUptime == 0 {
+			tunnel.StableUptime = Duration(tunnel.stableUptime())
+		}
+		if tunnel.RemoteHelperRestarts == nil {
+			restarts := tunnel.remoteHelperRestarts()
+			tunnel.RemoteHelperRestarts = &restarts
+		}
+		if tunnel.CompressUpload == nil {
+			compress := true
+			tunnel.CompressUpload = &compress
+		}
+		if tunnel.RemoteCacheHelper == nil {
+			cache := true
+			tunnel.RemoteCacheHelper = &cache
+		}
+		if tunnel.PrivateKeyFiles == nil {
+			tunnel.PrivateKeyFiles = PrivateKeyFiles{}
+		}
+		for i := range tunnel.PrivateKeyFiles {
+			tunnel.PrivateKeyFiles[i] = ResolveTildeSlash(tunnel.PrivateKeyFiles[i])
+		}
+		tunnel.setLog(t.log)
+	}
+	effective.log = t.log
+	return &effective, nil
+}
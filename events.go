@@ -0,0 +1,136 @@
+package sshtun
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_EVENT_BUFFER int = 64
+
+	EVENT_CONNECTING       EventKind = "connecting"
+	EVENT_CONNECTED        EventKind = "connected"
+	EVENT_DISCONNECTED     EventKind = "disconnected"
+	EVENT_RETRY            EventKind = "retry"
+	EVENT_HELPER_UPLOADED  EventKind = "helper-uploaded"
+	EVENT_KEEPALIVE_FAILED EventKind = "keepalive-failed"
+)
+
+type EventKind string
+
+// Event is a state change of the tunnel named Tunnel, see
+// Tunnels.Events. Err is set on disconnected (nil if closed by the
+// context) and keepalive-failed, Attrs carries details like the delay
+// of a retry or the path of an uploaded helper.
+type Event struct {
+	Time   time.Time      `json:"time"`
+	Tunnel string         `json:"tunnel"`
+	Kind   EventKind      `json:"kind"`
+	Err    error          `json:"-"`
+	Attrs  map[string]any `json:"attrs,omitempty"`
+}
+
+// eventSink is the channel returned by Tunnels.Events shared by every
+// tunnel.
+type eventSink struct {
+	ch      chan Event
+	dropped atomic.Int64
+}
+
+// Events returns a channel receiving the Events of every tunnel. The
+// channel is buffered (EventBuffer, DEFAULT_EVENT_BUFFER if not set)
+// and never closed, events are dropped (see DroppedEvents) instead of
+// blocking a tunnel when the consumer falls behind. No events are
+// produced until Events is called, logging is not affected, see
+// LogEvents.
+func (t *Tunnels) Events() <-chan Event {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.events == nil {
+		t.events = &eventSink{ch: make(chan Event, t.eventBuffer())}
+	}
+	for _, tunnel := range t.Tunnels {
+		tunnel.events.Store(t.events)
+	}
+	return t.events.ch
+}
+
+// DroppedEvents returns the number of events dropped because the
+// consumer of Events was too slow.
+func (t *Tunnels) DroppedEvents() int64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.events == nil {
+		return 0
+	}
+	return t.events.dropped.Load()
+}
+
+// eventBuffer returns EventBuffer or DEFAULT_EVENT_BUFFER if not set.
+func (t *Tunnels) eventBuffer() int {
+	if t.EventBuffer <= 0 {
+		return DEFAULT_EVENT_BUFFER
+	}
+	return t.EventBuffer
+}
+
+// event sends an Event of kind with attrs as key-value pairs (like
+// slog) without blocking if Events has been called.
+func (s *SSHTUN) event(kind EventKind, err error, attrs ...any) {
+	sink := s.events.Load()
+	if sink == nil {
+		return
+	}
+	e := Event{
+		Time:   time.Now(),
+		Tunnel: s.Name,
+		Kind:   kind,
+		Err:    err,
+	}
+	if len(attrs) > 0 {
+		e.Attrs = make(map[string]any, len(attrs)/2)
+		for i := 0; i+1 < len(attrs); i += 2 {
+			e.Attrs[fmt.Sprint(attrs[i])] = attrs[i+1]
+		}
+	}
+	select {
+	case sink.ch <- e:
+	default:
+		sink.dropped.Add(1)
+	}
+}
+
+// LogEvents logs every event from events to logger until events is
+// closed or ctx is cancelled, for consumers of Tunnels.Events that
+// want them in their log as well.
+func LogEvents(ctx context.Context, events <-chan Event, logger *slog.Logger) {
+	logger = SetLogger(logger)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			LogEvent(logger, e)
+		}
+	}
+}
+
+// LogEvent logs e to logger, at level warn if it carries an error.
+func LogEvent(logger *slog.Logger, e Event) {
+	args := []any{"name", e.Tunnel, "event", string(e.Kind)}
+	for k, v := range e.Attrs {
+		args = append(args, k, v)
+	}
+	level := slog.LevelInfo
+	if e.Err != nil {
+		level = slog.LevelWarn
+		args = append(args, "error", e.Err)
+	}
+	logger.Log(context.Background(), level, fmt.Sprintf("Tunnel %s %s", e.Tunnel, e.Kind), args...)
+}
@@ -0,0 +1,37 @@
+package sshtun
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestEvents(t *testing.T) {
+	s := NewSecureShellTunneler(nil)
+	s.event(EVENT_CONNECTING, nil)
+	tunnels := &Tunnels{Tunnels: []*SSHTUN{s}, EventBuffer: 1}
+	events := tunnels.Events()
+	if len(events) != 0 {
+		t.Fatalf("expected no events before Events was called, got %d", len(events))
+	}
+	s.event(EVENT_RETRY, nil, "delay", "5s", "failures", 2)
+	s.event(EVENT_CONNECTING, nil)
+	if dropped := tunnels.DroppedEvents(); dropped != 1 {
+		t.Errorf("expected 1 dropped event, got %d", dropped)
+	}
+	e := <-events
+	if e.Tunnel != s.Name || e.Kind != EVENT_RETRY || e.Attrs["delay"] != "5s" || e.Attrs["failures"] != 2 {
+		t.Errorf("unexpected event %+v", e)
+	}
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	LogEvent(logger, Event{Tunnel: s.Name, Kind: EVENT_DISCONNECTED, Err: errors.New("eof")})
+	for _, want := range []string{"level=WARN", "event=disconnected", "error=eof", "name=" + s.Name} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("expected %q in %q", want, buf.String())
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package sshtun
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPublishExpvar(t *testing.T) {
+	s := NewSecureShellTunneler(nil)
+	tunnels := &Tunnels{Tunnels: []*SSHTUN{s}}
+	tunnels.publishExpvar()
+
+	// Simulate a tunnel that reconnected once and is up.
+	s.up.Store(true)
+	s.setState(STATE_CONNECTED)
+	s.upSince.Store(time.Now().Add(-time.Minute).UnixNano())
+	s.reconnects.Add(1)
+	var buf bytes.Buffer
+	countingWriter{w: &buf, n: &s.rxBytes}.Write([]byte("received"))
+	countingWriter{w: &buf, n: &s.txBytes}.Write([]byte("sent"))
+	s.lastError.Store("disconnected")
+
+	v := expvar.Get(EXPVAR_NAME)
+	if v == nil {
+		t.Fatalf("expected %s to be published", EXPVAR_NAME)
+	}
+	var published map[string]map[string]any
+	if err := json.Unmarshal([]byte(v.String()), &published); err != nil {
+		t.Fatal(err)
+	}
+	got, ok := published[s.Name]
+	if !ok {
+		t.Fatalf("expected tunnel %s in %s", s.Name, v.String())
+	}
+	expected := map[string]any{
+		"name":            s.Name,
+		"state":           string(STATE_CONNECTED),
+		"reconnects":      float64(1),
+		"helper_restarts": float64(0),
+		"rx_bytes":        float64(len("received")),
+		"tx_bytes":        float64(len("sent")),
+		"last_error":      "disconnected",
+	}
+	for k, want := range expected {
+		if got[k] != want {
+			t.Errorf("expected %s to be %v, got %v", k, want, got[k])
+		}
+	}
+	for _, k := range []string{"since", "connected_for"} {
+		if _, ok := got[k].(string); !ok {
+			t.Errorf("expected %s to be a string, got %v", k, got[k])
+		}
+		expected[k] = got[k]
+	}
+	if len(got) != len(expected) {
+		t.Errorf("expected %d fields, got %v", len(expected), got)
+	}
+
+	disabled := &Tunnels{Tunnels: []*SSHTUN{{Name: "disabled"}}, DisableExpvar: true}
+	disabled.publishExpvar()
+	if strings.Contains(v.String(), `"disabled"`) {
+		t.Errorf("expected DisableExpvar to leave %s published, got %s", s.Name, v.String())
+	}
+}
@@ -0,0 +1,218 @@
+package sshtun
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// TYPE_TUN is a layer 3 tunnel between two tun devices, the
+	// default.
+	TYPE_TUN string = "tun"
+	// TYPE_LOCAL_FORWARD listens on local addresses and forwards
+	// connections through the remote (ssh -L).
+	TYPE_LOCAL_FORWARD string = "local-forward"
+	// TYPE_REMOTE_FORWARD listens on the remote and forwards
+	// connections to local targets (ssh -R).
+	TYPE_REMOTE_FORWARD string = "remote-forward"
+
+	DEFAULT_FORWARD_DIAL_TIMEOUT time.Duration = 30 * time.Second
+)
+
+// Forward is a forwarded port of a local-forward or remote-forward
+// tunnel: connections to Listen (host:port, on the local host for
+// local-forward, on the remote for remote-forward) are forwarded to
+// Target (host:port, resolved by the remote for local-forward, by the
+// local host for remote-forward).
+type Forward struct {
+	Listen      string       `json:"listen"`
+	Target      string       `json:"target"`
+	connections atomic.Int64 `json:"-"`
+	active      atomic.Int64 `json:"-"`
+	rxBytes     atomic.Int64 `json:"-"`
+	txBytes     atomic.Int64 `json:"-"`
+}
+
+// ForwardStatus is a snapshot of the counters of a Forward since the
+// tunnel was first opened. TxBytes are sent from the listening side to
+// the target, RxBytes from the target back.
+type ForwardStatus struct {
+	Listen      string `json:"listen"`
+	Target      string `json:"target"`
+	Connections int64  `json:"connections"`
+	Active      int64  `json:"active"`
+	RxBytes     int64  `json:"rx_bytes"`
+	TxBytes     int64  `json:"tx_bytes"`
+}
+
+// Status returns a snapshot of the counters of f.
+func (f *Forward) Status() ForwardStatus {
+	return ForwardStatus{
+		Listen:      f.Listen,
+		Target:      f.Target,
+		Connections: f.connections.Load(),
+		Active:      f.active.Load(),
+		RxBytes:     f.rxBytes.Load(),
+		TxBytes:     f.txBytes.Load(),
+	}
+}
+
+// tunnelType returns Type or TYPE_TUN if not set.
+func (s *SSHTUN) tunnelType() string {
+	if s.Type == "" {
+		return TYPE_TUN
+	}
+	return s.Type
+}
+
+// forwarding returns true for local-forward and remote-forward
+// tunnels, which need no tun device, privileges or remote helper.
+func (s *SSHTUN) forwarding() bool {
+	switch s.tunnelType() {
+	case TYPE_LOCAL_FORWARD, TYPE_REMOTE_FORWARD:
+		return true
+	}
+	return false
+}
+
+// openForwards is open for local-forward and remote-forward tunnels:
+// connect, listen for every Forward and forward connections until the
+// connection is lost or ctx is cancelled.
+func (s *SSHTUN) openForwards(ctx context.Context) error {
+	// There is no device to link up, for drop_privileges.
+	if s.onLinkUp != nil {
+		s.onLinkUp(s.Name)
+	}
+	s.log().Info(fmt.Sprintf("Connecting to ssh://%s", s.Remote), "remote", s.Remote, "name", s.Name)
+	client, err := s.Dial(ctx)
+	if err != nil {
+		return s.retryable(err)
+	}
+	openDone := make(chan struct{})
+	defer close(openDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-openDone:
+		}
+		client.Close()
+	}()
+	defer s.trackConnection(client)()
+	defer s.startKeepalive(client)()
+
+	var wg sync.WaitGroup
+	var listeners []net.Listener
+	defer func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		wg.Wait()
+	}()
+	for _, f := range s.Forwards {
+		listener, dial, err := s.listenForward(ctx, client, f)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, listener)
+		s.log().Info(fmt.Sprintf("Forwarding %s to %s", listener.Addr(), f.Target), "name", s.Name, "remote", s.Remote, "type", s.tunnelType(), "listen", listener.Addr().String(), "target", f.Target)
+		wg.Add(1)
+		go func(f *Forward) {
+			defer wg.Done()
+			s.serveForward(listener, dial, f)
+		}(f)
+	}
+
+	s.up.Store(true)
+	s.setState(STATE_CONNECTED)
+	defer s.up.Store(false)
+	if now := time.Now(); s.upSince.CompareAndSwap(0, now.UnixNano()) {
+		s.event(EVENT_CONNECTED, nil, "remote", s.Remote, "remote_addr", s.remoteAddr, "forwards", len(s.Forwards))
+		s.auditRecord(AUDIT_CONNECTED, nil)
+		s.handle.Load().markUp(s)
+		s.onConnected(now)
+	}
+
+	err = client.Wait()
+	if ctx.Err() != nil {
+		s.log().Info("Tunnel closed", "name", s.Name, "remote", s.Remote, "type", s.tunnelType())
+		return nil
+	}
+	if err == nil {
+		return fmt.Errorf("%w: closed by remote", ErrDisconnected)
+	}
+	return fmt.Errorf("%w: %w", ErrDisconnected, err)
+}
+
+// listenForward listens on the Listen address of f, locally for
+// local-forward or on the remote for remote-forward, and returns the
+// listener and how to reach the Target from the other end.
+func (s *SSHTUN) listenForward(ctx context.Context, client *ssh.Client, f *Forward) (net.Listener, func(address string) (net.Conn, error), error) {
+	if s.tunnelType() == TYPE_REMOTE_FORWARD {
+		listener, err := client.Listen("tcp", f.Listen)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: unable to listen on %s on ssh://%s: %w", ErrRemoteSetupFailed, f.Listen, s.Remote, err)
+		}
+		d := net.Dialer{Timeout: DEFAULT_FORWARD_DIAL_TIMEOUT}
+		return listener, func(address string) (net.Conn, error) {
+			return d.DialContext(ctx, "tcp", address)
+		}, nil
+	}
+	listener, err := net.Listen("tcp", f.Listen)
+	if err != nil {
+		return nil, nil, err
+	}
+	return listener, func(address string) (net.Conn, error) {
+		return client.Dial("tcp", address)
+	}, nil
+}
+
+// serveForward accepts connections on listener and forwards them to
+// the Target of f until listener is closed.
+func (s *SSHTUN) serveForward(listener net.Listener, dial func(address string) (net.Conn, error), f *Forward) {
+	// The tunnel counts traffic to and from the remote, which is the
+	// listening side of a remote-forward.
+	toRemote, fromRemote := &s.txBytes, &s.rxBytes
+	if s.tunnelType() == TYPE_REMOTE_FORWARD {
+		toRemote, fromRemote = fromRemote, toRemote
+	}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		f.connections.Add(1)
+		f.active.Add(1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer f.active.Add(-1)
+			defer conn.Close()
+			target, err := dial(f.Target)
+			if err != nil {
+				s.log().Warn(fmt.Sprintf("Unable to forward connection to %s", f.Target), "name", s.Name, "remote", s.Remote, "listen", f.Listen, "target", f.Target, "error", err)
+				return
+			}
+			defer target.Close()
+			done := make(chan struct{}, 2)
+			go func() {
+				io.Copy(countingWriter{w: countingWriter{w: target, n: &f.txBytes}, n: toRemote}, conn)
+				done <- struct{}{}
+			}()
+			go func() {
+				io.Copy(countingWriter{w: countingWriter{w: conn, n: &f.rxBytes}, n: fromRemote}, target)
+				done <- struct{}{}
+			}()
+			// Either side closing ends the connection.
+			<-done
+		}()
+	}
+}
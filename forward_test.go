@@ -0,0 +1,155 @@
+package sshtun
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sa6mwa/sshtun/pkg/sshtest"
+)
+
+// echoServer returns the address of a tcp server echoing lines back.
+func echoServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// freePort returns a localhost address with a port nothing listens on.
+func freePort(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func TestForward(t *testing.T) {
+	privateKey, _, err := sshtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, privateKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tunnelType := range []string{TYPE_LOCAL_FORWARD, TYPE_REMOTE_FORWARD} {
+		t.Run(tunnelType, func(t *testing.T) {
+			hp, err := sshtest.NewHoneyPot(sshtest.WithPortForwarding(), sshtest.WithCloseTimeout(0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer hp.Close()
+
+			s := NewSecureShellTunneler(nil)
+			s.Type = tunnelType
+			s.Remote = hp.Addr()
+			s.RemoteUser = "root"
+			s.PrivateKeyFiles = PrivateKeyFiles{keyFile}
+			s.KeepaliveInterval = 0
+			// The honeypot and the targets are all on localhost.
+			s.Forwards = []*Forward{
+				{Listen: freePort(t), Target: echoServer(t)},
+				{Listen: freePort(t), Target: echoServer(t)},
+			}
+			if err := s.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			// No Context, a port forward needs no tun device.
+			tunnel, err := s.Start(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tunnel.Close()
+			if tunnel.LocalDevice() != "" || tunnel.RemoteAddr() != hp.Addr() {
+				t.Errorf("unexpected handle %q %q", tunnel.LocalDevice(), tunnel.RemoteAddr())
+			}
+			for i, f := range s.Forwards {
+				conn, err := net.DialTimeout("tcp", f.Listen, 5*time.Second)
+				if err != nil {
+					t.Fatal(err)
+				}
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				fmt.Fprintf(conn, "hello %d\n", i)
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				conn.Close()
+				if err != nil || line != fmt.Sprintf("hello %d\n", i) {
+					t.Fatalf("forward %d: expected echo, got %q: %v", i, line, err)
+				}
+			}
+			// Counters are updated after the echo has been written.
+			status := s.Status()
+			for deadline := time.Now().Add(5 * time.Second); status.RxBytes != 16 && time.Now().Before(deadline); status = s.Status() {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if len(status.Forwards) != 2 {
+				t.Fatalf("expected 2 forward statuses, got %+v", status.Forwards)
+			}
+			for i, f := range status.Forwards {
+				if f.Connections != 1 || f.TxBytes != 8 || f.RxBytes != 8 {
+					t.Errorf("forward %d: unexpected counters %+v", i, f)
+				}
+			}
+			if status.State != STATE_CONNECTED || status.TxBytes+status.RxBytes != 32 {
+				t.Errorf("unexpected status %+v", status)
+			}
+			tunnel.Close()
+			if err := tunnel.Wait(); err != nil {
+				t.Errorf("expected Wait to return nil after Close, got: %v", err)
+			}
+			if _, err := net.DialTimeout("tcp", s.Forwards[0].Listen, time.Second); err == nil && tunnelType == TYPE_LOCAL_FORWARD {
+				t.Error("expected the local listener to be closed")
+			}
+		})
+	}
+}
+
+func TestForwardRefused(t *testing.T) {
+	privateKey, _, err := sshtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, privateKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	hp, err := sshtest.NewHoneyPot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hp.Close()
+	s := NewSecureShellTunneler(nil)
+	s.Type = TYPE_REMOTE_FORWARD
+	s.Remote = hp.Addr()
+	s.PrivateKeyFiles = PrivateKeyFiles{keyFile}
+	s.KeepaliveInterval = 0
+	s.Forwards = []*Forward{{Listen: "127.0.0.1:0", Target: "127.0.0.1:9"}}
+	if err := s.Open(context.Background()); !errors.Is(err, ErrRemoteSetupFailed) {
+		t.Errorf("expected %v, got: %v", ErrRemoteSetupFailed, err)
+	}
+}
@@ -5,6 +5,5 @@ go 1.21.1
 require (
 	github.com/alessio/shellescape v1.4.2
 	golang.org/x/crypto v0.20.0
+	golang.org/x/sys v0.17.0
 )
-
-require golang.org/x/sys v0.17.0 // indirect
@@ -0,0 +1,206 @@
+package sshtun
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sa6mwa/sshtun/internal/pkg/crand"
+	"github.com/sa6mwa/sshtun/internal/pkg/icmp"
+)
+
+const (
+	DEFAULT_HEALTH_CHECK_INTERVAL   time.Duration = 30 * time.Second
+	DEFAULT_HEALTH_CHECK_MAX_MISSES int           = 3
+)
+
+var (
+	ErrUnhealthy error = errors.New("tunnel health check failed")
+)
+
+// HealthCheck pings the remote end of the tunnel (the address of
+// RemoteNetwork) every Interval by writing ICMP echo requests into the
+// tunnel and watching for the replies in the return stream. The
+// tunnel is reconnected after MaxMisses unanswered requests in a row.
+// This detects a broken data path (remote tun device down, helper
+// dead) while SSH keepalives still succeed.
+type HealthCheck struct {
+	Interval  Duration `json:"interval,omitempty"`
+	MaxMisses int      `json:"max_misses,omitempty"`
+}
+
+// interval returns Interval or DEFAULT_HEALTH_CHECK_INTERVAL if not
+// set.
+func (h *HealthCheck) interval() time.Duration {
+	if h.Interval == 0 {
+		return DEFAULT_HEALTH_CHECK_INTERVAL
+	}
+	return time.Duration(h.Interval)
+}
+
+// maxMisses returns MaxMisses or DEFAULT_HEALTH_CHECK_MAX_MISSES if
+// not set.
+func (h *HealthCheck) maxMisses() int {
+	if h.MaxMisses == 0 {
+		return DEFAULT_HEALTH_CHECK_MAX_MISSES
+	}
+	return h.MaxMisses
+}
+
+// healthChecker sends echo requests from the local to the remote
+// tunnel address and recognizes the replies by ID and sequence number.
+type healthChecker struct {
+	src      net.IP
+	dst      net.IP
+	id       uint16
+	mutex    sync.Mutex
+	seq      uint16
+	sent     time.Time
+	answered bool
+	failed   error
+}
+
+// newHealthChecker returns a healthChecker pinging the address of
+// RemoteNetwork from the address of LocalNetwork.
+func (s *SSHTUN) newHealthChecker() (*healthChecker, error) {
+	src, _, err := net.ParseCIDR(s.LocalNetwork)
+	if err != nil {
+		return nil, err
+	}
+	dst, _, err := net.ParseCIDR(s.RemoteNetwork)
+	if err != nil {
+		return nil, err
+	}
+	return &healthChecker{
+		src:      src.To4(),
+		dst:      dst.To4(),
+		id:       uint16(crand.Int63()),
+		answered: true,
+	}, nil
+}
+
+// request returns the next echo request and marks it unanswered.
+func (h *healthChecker) request() ([]byte, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.seq++
+	h.sent = time.Now()
+	h.answered = false
+	return icmp.Echo{
+		Type:    icmp.TYPE_ECHO_REQUEST,
+		Src:     h.src,
+		Dst:     h.dst,
+		ID:      h.id,
+		Seq:     h.seq,
+		Payload: []byte("sshtun health check"),
+	}.Marshal()
+}
+
+// isReply returns true if packet is an echo reply to this checker
+// (any sequence number) which should not be passed on to the local
+// tun device. A reply to the latest request marks it answered.
+func (h *healthChecker) isReply(packet []byte) bool {
+	if len(packet) == 0 || packet[0]>>4 != 4 {
+		return false
+	}
+	e, err := icmp.Parse(packet)
+	if err != nil || e.Type != icmp.TYPE_ECHO_REPLY || e.ID != h.id || !e.Src.Equal(h.dst) || !e.Dst.Equal(h.src) {
+		return false
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if e.Seq == h.seq {
+		h.answered = true
+	}
+	return true
+}
+
+// status returns whether the latest request has been answered and
+// when it was sent.
+func (h *healthChecker) status() (bool, time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.answered, h.sent
+}
+
+// run sends an echo request to w every interval until done is closed.
+// A request still unanswered when the next is due is a miss, after
+// maxMisses misses in a row run calls fail with an error wrapping
+// ErrUnhealthy and returns.
+func (h *healthChecker) run(w io.Writer, interval time.Duration, maxMisses int, logger *slog.Logger, fail func(error), done <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	misses := 0
+	first := true
+	for {
+		if !first {
+			if answered, sent := h.status(); answered {
+				logger.Debug("Health check reply", "dst", h.dst.String(), "rtt", time.Since(sent).String())
+				misses = 0
+			} else {
+				misses++
+				logger.Warn(fmt.Sprintf("Health check echo request to %s unanswered", h.dst), "dst", h.dst.String(), "misses", misses, "max_misses", maxMisses)
+				if misses >= maxMisses {
+					h.mutex.Lock()
+					h.failed = fmt.Errorf("%w: %d echo requests to %s unanswered", ErrUnhealthy, misses, h.dst)
+					err := h.failed
+					h.mutex.Unlock()
+					fail(err)
+					return
+				}
+			}
+		}
+		first = false
+		packet, err := h.request()
+		if err != nil {
+			fail(err)
+			return
+		}
+		if _, err := w.Write(packet); err != nil {
+			return
+		}
+		select {
+		case <-t.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// err returns the error run failed with, if any.
+func (h *healthChecker) err() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.failed
+}
+
+// replyFilter drops echo replies to the healthChecker instead of
+// writing them to the local tun device.
+type replyFilter struct {
+	w io.Writer
+	h *healthChecker
+}
+
+func (f replyFilter) Write(p []byte) (int, error) {
+	if f.h.isReply(p) {
+		return len(p), nil
+	}
+	return f.w.Write(p)
+}
+
+// lockedWriter serializes writes from the local tun device and the
+// healthChecker so that packets are not interleaved.
+type lockedWriter struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.w.Write(p)
+}
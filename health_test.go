@@ -0,0 +1,73 @@
+package sshtun
+
+import (
+	"bytes"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sa6mwa/sshtun/internal/pkg/icmp"
+)
+
+// echoPeer answers echo requests written to it through reply, like
+// the remote kernel at the other end of the tunnel.
+type echoPeer struct {
+	reply  replyFilter
+	silent atomic.Bool
+}
+
+func (p *echoPeer) Write(b []byte) (int, error) {
+	if p.silent.Load() {
+		return len(b), nil
+	}
+	e, err := icmp.Parse(b)
+	if err != nil {
+		return 0, err
+	}
+	packet, err := e.Reply().Marshal()
+	if err != nil {
+		return 0, err
+	}
+	return p.reply.Write(packet)
+}
+
+func TestHealthChecker(t *testing.T) {
+	s := NewSecureShellTunneler(nil)
+	h, err := s.newHealthChecker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var local bytes.Buffer
+	peer := &echoPeer{reply: replyFilter{w: &local, h: h}}
+	failed := make(chan error, 1)
+	done := make(chan struct{})
+	go h.run(peer, 10*time.Millisecond, 2, SetLogger(nil), func(err error) { failed <- err }, done)
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-failed:
+		t.Fatalf("expected an answering peer to be healthy, got: %v", err)
+	default:
+	}
+	if local.Len() != 0 {
+		t.Errorf("expected health check replies not to reach the local device, got %d bytes", local.Len())
+	}
+	other, err := icmp.Echo{Type: icmp.TYPE_ECHO_REPLY, Src: h.dst, Dst: h.src, ID: h.id + 1}.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.isReply(other) {
+		t.Error("expected a reply with another ID to be passed to the local device")
+	}
+
+	peer.silent.Store(true)
+	select {
+	case err := <-failed:
+		if !errors.Is(err, ErrUnhealthy) || !errors.Is(h.err(), ErrUnhealthy) {
+			t.Errorf("expected ErrUnhealthy, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a silent peer to be declared unhealthy")
+	}
+	close(done)
+}
@@ -0,0 +1,106 @@
+package sshtun
+
+//go:generate go run ./internal/cmd/buildhelpers -o bin
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// helpers holds the gzip compressed tunreadwriter builds, one per
+// GOARCH, named tunreadwriter-linux-<GOARCH>.gz.
+//
+//go:embed bin/tunreadwriter-linux-*.gz
+var helpers embed.FS
+
+var (
+	ErrUnsupportedArchitecture error = errors.New("unsupported remote architecture")
+)
+
+// unameMachines maps the output of uname -m to GOARCH.
+var unameMachines = map[string]string{
+	"x86_64":  "amd64",
+	"amd64":   "amd64",
+	"aarch64": "arm64",
+	"arm64":   "arm64",
+	"armv6l":  "arm",
+	"armv7l":  "arm",
+	"armv8l":  "arm",
+}
+
+// Helper is the embedded tunreadwriter for one architecture. SHA256
+// is the hash of the decompressed Binary.
+type Helper struct {
+	Arch       string
+	Binary     []byte
+	Compressed []byte
+	SHA256     string
+}
+
+var (
+	helperCache = map[string]*Helper{}
+	helperMutex sync.Mutex
+)
+
+// HelperArchitectures returns the GOARCH of every embedded helper.
+func HelperArchitectures() []string {
+	entries, _ := helpers.ReadDir("bin")
+	var archs []string
+	for _, e := range entries {
+		arch := strings.TrimSuffix(strings.TrimPrefix(e.Name(), "tunreadwriter-linux-"), ".gz")
+		archs = append(archs, arch)
+	}
+	sort.Strings(archs)
+	return archs
+}
+
+// HelperFor returns the decompressed helper for GOARCH arch.
+func HelperFor(arch string) (*Helper, error) {
+	helperMutex.Lock()
+	defer helperMutex.Unlock()
+	if h, ok := helperCache[arch]; ok {
+		return h, nil
+	}
+	compressed, err := helpers.ReadFile(path.Join("bin", "tunreadwriter-linux-"+arch+".gz"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s (embedded helpers: %s)", ErrUnsupportedArchitecture, arch, strings.Join(HelperArchitectures(), ", "))
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if _, err := io.Copy(&b, zr); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(b.Bytes())
+	h := &Helper{
+		Arch:       arch,
+		Binary:     b.Bytes(),
+		Compressed: compressed,
+		SHA256:     hex.EncodeToString(sum[:]),
+	}
+	helperCache[arch] = h
+	return h, nil
+}
+
+// HelperForMachine returns the helper for the output of uname -m on
+// the remote, e.g x86_64 or armv7l.
+func HelperForMachine(machine string) (*Helper, error) {
+	machine = strings.TrimSpace(machine)
+	arch, ok := unameMachines[machine]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedArchitecture, machine)
+	}
+	return HelperFor(arch)
+}
@@ -0,0 +1,48 @@
+package sshtun
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestHelperForMachine(t *testing.T) {
+	for machine, arch := range map[string]string{
+		"x86_64\n": "amd64",
+		"aarch64":  "arm64",
+		"armv7l":   "arm",
+		"armv6l":   "arm",
+	} {
+		h, err := HelperForMachine(machine)
+		if err != nil {
+			t.Fatalf("HelperForMachine(%q): %v", machine, err)
+		}
+		if h.Arch != arch {
+			t.Errorf("HelperForMachine(%q) returned %s, expected %s", machine, h.Arch, arch)
+		}
+		sum := sha256.Sum256(h.Binary)
+		if h.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("%s: SHA256 does not match the decompressed binary", arch)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(h.Compressed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err := io.ReadAll(zr); err != nil || !bytes.Equal(b, h.Binary) {
+			t.Errorf("%s: Compressed does not decompress to Binary (%v)", arch, err)
+		}
+		if len(h.Compressed) >= len(h.Binary) {
+			t.Errorf("%s: expected the compressed helper to be smaller", arch)
+		}
+		if len(h.Binary) < 4 || string(h.Binary[1:4]) != "ELF" {
+			t.Errorf("%s: expected an ELF binary", arch)
+		}
+	}
+	if _, err := HelperForMachine("mips64"); !errors.Is(err, ErrUnsupportedArchitecture) {
+		t.Errorf("expected ErrUnsupportedArchitecture for mips64, got %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package sshtun
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// HISTORY_SIZE is the number of connection attempts kept in the
+	// History of Status.
+	HISTORY_SIZE int = 10
+)
+
+// Attempt is a connection attempt (an Open) in the History of Status:
+// when it started, how long it lasted, how long of that the tunnel was
+// up (0 if it never came up) and the error that ended it, empty if it
+// was closed without error.
+type Attempt struct {
+	Started  time.Time `json:"started"`
+	Duration Duration  `json:"duration"`
+	Uptime   Duration  `json:"uptime"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// history is a ring buffer of the last HISTORY_SIZE attempts.
+type history struct {
+	mutex    sync.Mutex
+	attempts [HISTORY_SIZE]Attempt
+	next     int
+	n        int
+}
+
+// add records attempt, overwriting the oldest one if full.
+func (h *history) add(attempt Attempt) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.attempts[h.next] = attempt
+	h.next = (h.next + 1) % HISTORY_SIZE
+	if h.n < HISTORY_SIZE {
+		h.n++
+	}
+}
+
+// list returns the recorded attempts, oldest first.
+func (h *history) list() []Attempt {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	attempts := make([]Attempt, 0, h.n)
+	for i := 0; i < h.n; i++ {
+		attempts = append(attempts, h.attempts[(h.next-h.n+i+HISTORY_SIZE)%HISTORY_SIZE])
+	}
+	return attempts
+}
+
+// recordAttempt adds the attempt started at started and ended by err
+// to the history of s.
+func (s *SSHTUN) recordAttempt(started time.Time, err error) {
+	attempt := Attempt{
+		Started:  started,
+		Duration: Duration(time.Since(started)),
+		Uptime:   Duration(s.lastUptime()),
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	s.history.add(attempt)
+}
@@ -0,0 +1,1016 @@
+//go:build integration
+
+package sshtun
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sa6mwa/sshtun/internal/pkg/icmp"
+	"github.com/sa6mwa/sshtun/internal/pkg/netns"
+	"github.com/sa6mwa/sshtun/internal/pkg/policy"
+	"github.com/sa6mwa/sshtun/pkg/sshtest"
+)
+
+// TestIntegration moves packets through a full tunnel between two
+// network namespaces connected by a veth pair. The remote end is a
+// HoneyPot running every command with sh in the remote namespace, so
+// the embedded tunreadwriter is uploaded with the real scp and creates
+// a real tun device. Run as root with
+//
+//	go test -tags integration -run TestIntegration .
+func TestIntegration(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("integration test requires root")
+	}
+	for _, command := range []string{"ip", "scp"} {
+		if _, err := exec.LookPath(command); err != nil {
+			t.Skipf("integration test requires %s", command)
+		}
+	}
+	if _, err := os.Stat("/dev/net/tun"); err != nil {
+		t.Skipf("integration test requires /dev/net/tun: %v", err)
+	}
+
+	local, err := netns.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	remote, err := netns.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	for _, step := range []struct {
+		ns   *netns.NetNS
+		args []string
+	}{
+		{local, []string{"link", "add", "veth-local", "type", "veth", "peer", "name", "veth-remote", "netns", remote.Path()}},
+		{local, []string{"addr", "add", "10.231.0.1/30", "dev", "veth-local"}},
+		{local, []string{"link", "set", "veth-local", "up"}},
+		{local, []string{"link", "set", "lo", "up"}},
+		{remote, []string{"addr", "add", "10.231.0.2/30", "dev", "veth-remote"}},
+		{remote, []string{"link", "set", "veth-remote", "up"}},
+		{remote, []string{"link", "set", "lo", "up"}},
+	} {
+		if err := step.ns.Run("ip", step.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	key, public, err := sshtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyFile, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	var hp *sshtest.HoneyPot
+	if err := remote.Do(func() (err error) {
+		hp, err = sshtest.NewHoneyPot(
+			sshtest.WithListenAddress("10.231.0.2:0"),
+			sshtest.WithAuthorizedKeys(public),
+			sshtest.WithScriptedHandler("", remoteShell(remote)),
+		)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer hp.Close()
+
+	s := NewSecureShellTunneler(nil)
+	s.Name = "integration"
+	s.Remote = hp.Addr()
+	s.RemoteUser = "root"
+	s.PrivateKeyFiles = PrivateKeyFiles{keyFile}
+	s.RemoteUploadDirectory = dir
+	s.LocalTunDevice = "tun-itest"
+	s.RemoteTunDevice = "tun-itest"
+	s.LocalNetwork = "172.31.231.1/30"
+	s.RemoteNetwork = "172.31.231.2/30"
+	s.RemoteEnableForwarding = true
+	remoteForwarding := func() string {
+		var b []byte
+		remote.Do(func() (err error) {
+			b, err = os.ReadFile(policy.IP_FORWARD)
+			return err
+		})
+		return strings.TrimSpace(string(b))
+	}
+	if remoteForwarding() != "0" {
+		t.Fatalf("expected forwarding off in a new namespace, got %q", remoteForwarding())
+	}
+	ctx, cancel := context.WithCancel(Context(context.Background()))
+	defer cancel()
+	opened := make(chan error, 1)
+	go func() {
+		opened <- local.Do(func() error {
+			return s.Open(ctx)
+		})
+	}()
+	deadline := time.After(30 * time.Second)
+	for !s.IsUp() {
+		select {
+		case err := <-opened:
+			t.Fatalf("Open returned before the tunnel came up: %v", err)
+		case <-deadline:
+			t.Fatal("tunnel did not come up")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	if err := local.Do(func() error {
+		return ping(net.ParseIP("172.31.231.1"), net.ParseIP("172.31.231.2"), 3)
+	}); err != nil {
+		t.Fatalf("ping through the tunnel: %v", err)
+	}
+	if remoteForwarding() != "1" {
+		t.Errorf("expected remote_enable_forwarding to enable forwarding on the remote, got %q", remoteForwarding())
+	}
+
+	var listener net.Listener
+	if err := remote.Do(func() (err error) {
+		listener, err = net.Listen("tcp", "172.31.231.2:0")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	type result struct {
+		n   int64
+		sum []byte
+		err error
+	}
+	received := make(chan result, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- result{err: err}
+			return
+		}
+		defer conn.Close()
+		h := sha256.New()
+		n, err := io.Copy(h, conn)
+		received <- result{n: n, sum: h.Sum(nil), err: err}
+	}()
+	data := make([]byte, 1<<20)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	var conn net.Conn
+	if err := local.Do(func() (err error) {
+		conn, err = net.DialTimeout("tcp", listener.Addr().String(), 5*time.Second)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	var r result
+	select {
+	case r = <-received:
+	case <-time.After(60 * time.Second):
+		t.Fatal("transfer through the tunnel timed out")
+	}
+	elapsed := time.Since(start)
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.n != int64(len(data)) || !bytes.Equal(r.sum, sum[:]) {
+		t.Fatalf("corrupted transfer: received %d of %d bytes, sha256 %x, expected %x", r.n, len(data), r.sum, sum)
+	}
+	throughput := float64(r.n) / elapsed.Seconds()
+	if throughput <= 0 {
+		t.Errorf("expected non-zero throughput")
+	}
+	t.Logf("transferred %d bytes in %s (%.1f MB/s)", r.n, elapsed, throughput/1e6)
+	if status := s.Status(); status.TxBytes < int64(len(data)) {
+		t.Errorf("expected at least %d bytes sent through the tunnel, got %d", len(data), status.TxBytes)
+	}
+
+	speed, err := s.SpeedTest(ctx, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if speed.Received == 0 || speed.Upload <= 0 || speed.Download <= 0 {
+		t.Errorf("expected echo replies through the tunnel, got %+v", speed)
+	}
+	t.Logf("%s", speed)
+
+	cancel()
+	select {
+	case err := <-opened:
+		if err != nil && !errors.Is(err, context.Canceled) {
+			t.Errorf("Open: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("Open did not return after cancel")
+	}
+	// The helper restores forwarding when it exits after the session.
+	for attempt := 0; remoteForwarding() != "0"; attempt++ {
+		if attempt == 50 {
+			t.Errorf("expected forwarding restored on the remote, got %q", remoteForwarding())
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	var diagnosis *Diagnosis
+	local.Do(func() error {
+		diagnosis = s.Diagnose(context.Background())
+		return nil
+	})
+	if diagnosis.Failed() {
+		t.Errorf("expected every step of the diagnosis to pass:\n%s", diagnosis)
+	}
+	t.Logf("%s", diagnosis)
+}
+
+// ping sends count ICMP echo requests from src to dst with a raw
+// socket and waits for every reply.
+func ping(src, dst net.IP, count int) error {
+	conn, err := net.ListenPacket("ip4:icmp", src.String())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for seq := 1; seq <= count; seq++ {
+		packet, err := icmp.Echo{Type: icmp.TYPE_ECHO_REQUEST, Src: src, Dst: dst, ID: 0x5e5e, Seq: uint16(seq), Payload: []byte("sshtun integration")}.Marshal()
+		if err != nil {
+			return err
+		}
+		// The raw socket adds the IPv4 header itself.
+		if _, err := conn.WriteTo(packet[20:], &net.IPAddr{IP: dst}); err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			b := make([]byte, 1500)
+			n, _, err := conn.ReadFrom(b)
+			if err != nil {
+				return fmt.Errorf("echo %d: %w", seq, err)
+			}
+			if n >= 8 && b[0] == icmp.TYPE_ECHO_REPLY && binary.BigEndian.Uint16(b[6:]) == uint16(seq) {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// remoteShell returns a ScriptedHandler running commands with sh in
+// ns, like sshd.
+func remoteShell(ns *netns.NetNS) sshtest.ScriptedHandler {
+	return func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		cmd := exec.Command("/bin/sh", "-c", command)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, stdout, stderr
+		if err := ns.Start(cmd); err != nil {
+			io.WriteString(stderr, err.Error()+"\n")
+			return 127
+		}
+		if err := cmd.Wait(); err != nil {
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				return exitErr.ExitCode()
+			}
+			return 1
+		}
+		return 0
+	}
+}
+
+// TestIntegrationRoleServer is the NAT traversal scenario of role
+// server: the local end (behind NAT, next to a lan namespace) connects
+// to the remote which gets a default route through the tunnel, so a
+// connection from the remote reaches back into the lan. The local end
+// forwards into the lan, masquerading the remote network if nft or
+// iptables is installed, otherwise the lan routes the tunnel network
+// back.
+func TestIntegrationRoleServer(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("integration test requires root")
+	}
+	for _, command := range []string{"ip", "scp"} {
+		if _, err := exec.LookPath(command); err != nil {
+			t.Skipf("integration test requires %s", command)
+		}
+	}
+	if _, err := os.Stat("/dev/net/tun"); err != nil {
+		t.Skipf("integration test requires /dev/net/tun: %v", err)
+	}
+	_, _, err := policy.Firewall()
+	nat := err == nil
+
+	var namespaces [3]*netns.NetNS
+	for i := range namespaces {
+		if namespaces[i], err = netns.New(); err != nil {
+			t.Fatal(err)
+		}
+		defer namespaces[i].Close()
+	}
+	lan, local, remote := namespaces[0], namespaces[1], namespaces[2]
+	steps := []struct {
+		ns   *netns.NetNS
+		args []string
+	}{
+		{local, []string{"link", "add", "veth-local", "type", "veth", "peer", "name", "veth-remote", "netns", remote.Path()}},
+		{local, []string{"link", "add", "veth-gw", "type", "veth", "peer", "name", "veth-lan", "netns", lan.Path()}},
+		{local, []string{"addr", "add", "10.232.0.1/30", "dev", "veth-local"}},
+		{local, []string{"addr", "add", "10.232.1.1/30", "dev", "veth-gw"}},
+		{local, []string{"link", "set", "veth-local", "up"}},
+		{local, []string{"link", "set", "veth-gw", "up"}},
+		{local, []string{"link", "set", "lo", "up"}},
+		{remote, []string{"addr", "add", "10.232.0.2/30", "dev", "veth-remote"}},
+		{remote, []string{"link", "set", "veth-remote", "up"}},
+		{remote, []string{"link", "set", "lo", "up"}},
+		{lan, []string{"addr", "add", "10.232.1.2/30", "dev", "veth-lan"}},
+		{lan, []string{"link", "set", "veth-lan", "up"}},
+		{lan, []string{"link", "set", "lo", "up"}},
+	}
+	if !nat {
+		steps = append(steps, struct {
+			ns   *netns.NetNS
+			args []string
+		}{lan, []string{"route", "add", "172.31.232.0/30", "via", "10.232.1.1"}})
+	}
+	for _, step := range steps {
+		if err := step.ns.Run("ip", step.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	key, public, err := sshtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyFile, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	shell := remoteShell(remote)
+	var hp *sshtest.HoneyPot
+	if err := remote.Do(func() (err error) {
+		hp, err = sshtest.NewHoneyPot(
+			sshtest.WithListenAddress("10.232.0.2:0"),
+			sshtest.WithAuthorizedKeys(public),
+			// Like sshd, the helper finds the ssh client in
+			// SSH_CONNECTION.
+			sshtest.WithScriptedHandler("", func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+				return shell("SSH_CONNECTION='10.232.0.1 50000 10.232.0.2 22'; export SSH_CONNECTION; "+command, stdin, stdout, stderr)
+			}),
+		)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer hp.Close()
+
+	s := NewSecureShellTunneler(nil)
+	s.Name = "integration-server"
+	s.Remote = hp.Addr()
+	s.RemoteUser = "root"
+	s.PrivateKeyFiles = PrivateKeyFiles{keyFile}
+	s.RemoteUploadDirectory = dir
+	s.LocalTunDevice = "tun-iserver"
+	s.RemoteTunDevice = "tun-iclient"
+	s.LocalNetwork = "172.31.232.1/30"
+	s.RemoteNetwork = "172.31.232.2/30"
+	s.Role = ROLE_SERVER
+	s.ServerDefaultRoute = true
+	s.ServerNAT = nat
+	s.ServerForward = !nat
+	ctx, cancel := context.WithCancel(Context(context.Background()))
+	defer cancel()
+	opened := make(chan error, 1)
+	go func() {
+		opened <- local.Do(func() error {
+			return s.Open(ctx)
+		})
+	}()
+	deadline := time.After(30 * time.Second)
+	for !s.IsUp() {
+		select {
+		case err := <-opened:
+			t.Fatalf("Open returned before the tunnel came up: %v", err)
+		case <-deadline:
+			t.Fatal("tunnel did not come up")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	var listener net.Listener
+	if err := lan.Do(func() (err error) {
+		listener, err = net.Listen("tcp", "10.232.1.2:0")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	peer := make(chan net.Addr, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			peer <- nil
+			return
+		}
+		defer conn.Close()
+		peer <- conn.RemoteAddr()
+		io.WriteString(conn, "hello from the lan\n")
+	}()
+	var conn net.Conn
+	// The default route is added by the helper after the handshake.
+	for attempt := 0; ; attempt++ {
+		err = remote.Do(func() (err error) {
+			conn, err = net.DialTimeout("tcp", listener.Addr().String(), 2*time.Second)
+			return err
+		})
+		if err == nil {
+			break
+		} else if attempt == 10 {
+			t.Fatalf("connecting from the remote into the lan: %v", err)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello from the lan\n" {
+		t.Errorf("unexpected greeting %q", b)
+	}
+	want := "172.31.232.2"
+	if nat {
+		want = "10.232.1.1"
+	}
+	if addr := <-peer; addr == nil || addr.(*net.TCPAddr).IP.String() != want {
+		t.Errorf("expected the lan to see the connection from %s, got %v", want, addr)
+	}
+
+	cancel()
+	select {
+	case err := <-opened:
+		if err != nil && !errors.Is(err, context.Canceled) {
+			t.Errorf("Open: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("Open did not return after cancel")
+	}
+}
+
+// TestIntegrationDefaultRoute routes everything in the local namespace
+// through the tunnel with default_route, the ssh connection keeps its
+// route to the remote and the routes and their state file are removed
+// when the tunnel goes down.
+func TestIntegrationDefaultRoute(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("integration test requires root")
+	}
+	for _, command := range []string{"ip", "scp"} {
+		if _, err := exec.LookPath(command); err != nil {
+			t.Skipf("integration test requires %s", command)
+		}
+	}
+	if _, err := os.Stat("/dev/net/tun"); err != nil {
+		t.Skipf("integration test requires /dev/net/tun: %v", err)
+	}
+	defer func(dir string) { routeStateDirectory = dir }(routeStateDirectory)
+	routeStateDirectory = t.TempDir()
+
+	local, err := netns.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	remote, err := netns.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	for _, step := range []struct {
+		ns   *netns.NetNS
+		args []string
+	}{
+		{local, []string{"link", "add", "veth-local", "type", "veth", "peer", "name", "veth-remote", "netns", remote.Path()}},
+		{local, []string{"addr", "add", "10.233.0.1/30", "dev", "veth-local"}},
+		{local, []string{"link", "set", "veth-local", "up"}},
+		{local, []string{"link", "set", "lo", "up"}},
+		{local, []string{"route", "add", "default", "via", "10.233.0.2"}},
+		{remote, []string{"addr", "add", "10.233.0.2/30", "dev", "veth-remote"}},
+		{remote, []string{"link", "set", "veth-remote", "up"}},
+		{remote, []string{"link", "set", "lo", "up"}},
+	} {
+		if err := step.ns.Run("ip", step.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	key, public, err := sshtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyFile, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	var hp *sshtest.HoneyPot
+	if err := remote.Do(func() (err error) {
+		hp, err = sshtest.NewHoneyPot(
+			sshtest.WithListenAddress("10.233.0.2:0"),
+			sshtest.WithAuthorizedKeys(public),
+			sshtest.WithScriptedHandler("", remoteShell(remote)),
+		)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer hp.Close()
+
+	s := NewSecureShellTunneler(nil)
+	s.Name = "integration-default-route"
+	s.Remote = hp.Addr()
+	s.RemoteUser = "root"
+	s.PrivateKeyFiles = PrivateKeyFiles{keyFile}
+	s.RemoteUploadDirectory = dir
+	s.LocalTunDevice = "tun-idefault"
+	s.RemoteTunDevice = "tun-idefault"
+	s.LocalNetwork = "172.31.233.1/30"
+	s.RemoteNetwork = "172.31.233.2/30"
+	s.DefaultRoute = true
+	ctx, cancel := context.WithCancel(Context(context.Background()))
+	defer cancel()
+	opened := make(chan error, 1)
+	go func() {
+		opened <- local.Do(func() error {
+			return s.Open(ctx)
+		})
+	}()
+	deadline := time.After(30 * time.Second)
+	for !s.IsUp() {
+		select {
+		case err := <-opened:
+			t.Fatalf("Open returned before the tunnel came up: %v", err)
+		case <-deadline:
+			t.Fatal("tunnel did not come up")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	routes := func() string {
+		var out []byte
+		local.Do(func() (err error) {
+			out, err = exec.Command("ip", "-4", "route", "show").CombinedOutput()
+			return err
+		})
+		return string(out)
+	}
+	for _, route := range []string{"0.0.0.0/1 dev tun-idefault", "128.0.0.0/1 dev tun-idefault", "10.233.0.2 dev veth-local scope link"} {
+		if !strings.Contains(routes(), route) {
+			t.Errorf("expected route %q, got:\n%s", route, routes())
+		}
+	}
+	if b, err := os.ReadFile(s.routeStatePath()); err != nil || !strings.Contains(string(b), "128.0.0.0/1") {
+		t.Errorf("expected the routes in the state file, got %v: %s", err, b)
+	}
+	// Traffic follows the tunnel while the ssh connection carrying it
+	// keeps its own route.
+	if err := local.Do(func() error {
+		return ping(net.ParseIP("172.31.233.1"), net.ParseIP("172.31.233.2"), 3)
+	}); err != nil {
+		t.Fatalf("ping through the tunnel: %v", err)
+	}
+	if !s.IsUp() {
+		t.Fatal("tunnel went down with the default route through it")
+	}
+
+	cancel()
+	select {
+	case err := <-opened:
+		if err != nil && !errors.Is(err, context.Canceled) {
+			t.Errorf("Open: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("Open did not return after cancel")
+	}
+	if strings.Contains(routes(), "/1 dev") || strings.Contains(routes(), "10.233.0.2 dev veth-local scope link") {
+		t.Errorf("expected the routes to be removed, got:\n%s", routes())
+	}
+	if _, err := os.Stat(s.routeStatePath()); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the state file to be removed, got: %v", err)
+	}
+}
+
+// TestIntegrationBridge joins a bridge in the local namespace and one
+// in the remote namespace over a tap tunnel, the addresses are on the
+// bridges so the ping crosses the tunnel as ethernet frames.
+func TestIntegrationBridge(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("integration test requires root")
+	}
+	for _, command := range []string{"ip", "scp"} {
+		if _, err := exec.LookPath(command); err != nil {
+			t.Skipf("integration test requires %s", command)
+		}
+	}
+	if _, err := os.Stat("/dev/net/tun"); err != nil {
+		t.Skipf("integration test requires /dev/net/tun: %v", err)
+	}
+
+	local, err := netns.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	remote, err := netns.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	for _, step := range []struct {
+		ns   *netns.NetNS
+		args []string
+	}{
+		{local, []string{"link", "add", "veth-local", "type", "veth", "peer", "name", "veth-remote", "netns", remote.Path()}},
+		{local, []string{"addr", "add", "10.233.0.1/30", "dev", "veth-local"}},
+		{local, []string{"link", "set", "veth-local", "up"}},
+		{local, []string{"link", "set", "lo", "up"}},
+		{local, []string{"link", "add", "br-itest", "type", "bridge"}},
+		{local, []string{"addr", "add", "10.233.9.1/24", "dev", "br-itest"}},
+		{local, []string{"link", "set", "br-itest", "up"}},
+		{remote, []string{"addr", "add", "10.233.0.2/30", "dev", "veth-remote"}},
+		{remote, []string{"link", "set", "veth-remote", "up"}},
+		{remote, []string{"link", "set", "lo", "up"}},
+		{remote, []string{"link", "add", "br-itest", "type", "bridge"}},
+		{remote, []string{"addr", "add", "10.233.9.2/24", "dev", "br-itest"}},
+		{remote, []string{"link", "set", "br-itest", "up"}},
+	} {
+		if err := step.ns.Run("ip", step.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	key, public, err := sshtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyFile, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	var hp *sshtest.HoneyPot
+	if err := remote.Do(func() (err error) {
+		hp, err = sshtest.NewHoneyPot(
+			sshtest.WithListenAddress("10.233.0.2:0"),
+			sshtest.WithAuthorizedKeys(public),
+			sshtest.WithScriptedHandler("", remoteShell(remote)),
+		)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer hp.Close()
+
+	s := NewSecureShellTunneler(nil)
+	s.Name = "integration-bridge"
+	s.Remote = hp.Addr()
+	s.RemoteUser = "root"
+	s.PrivateKeyFiles = PrivateKeyFiles{keyFile}
+	s.RemoteUploadDirectory = dir
+	s.DeviceType = DEVICE_TAP
+	s.LocalTunDevice = "tap-itest"
+	s.RemoteTunDevice = "tap-itest"
+	s.LocalBridge = "br-itest"
+	s.RemoteBridge = "br-itest"
+	s.LocalNetwork, s.RemoteNetwork = "", ""
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(Context(context.Background()))
+	defer cancel()
+	opened := make(chan error, 1)
+	go func() {
+		opened <- local.Do(func() error {
+			return s.Open(ctx)
+		})
+	}()
+	deadline := time.After(30 * time.Second)
+	for !s.IsUp() {
+		select {
+		case err := <-opened:
+			t.Fatalf("Open returned before the tunnel came up: %v", err)
+		case <-deadline:
+			t.Fatal("tunnel did not come up")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	// Bridge ports and neighbour resolution may take a moment to
+	// settle.
+	for attempt := 0; ; attempt++ {
+		err = local.Do(func() error {
+			return ping(net.ParseIP("10.233.9.1"), net.ParseIP("10.233.9.2"), 3)
+		})
+		if err == nil {
+			break
+		} else if attempt == 10 {
+			t.Fatalf("ping across the bridged tunnel: %v", err)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-opened:
+		if err != nil && !errors.Is(err, context.Canceled) {
+			t.Errorf("Open: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("Open did not return after cancel")
+	}
+}
+
+// BenchmarkIntegrationWindowSize transfers 4 MiB over TCP through a
+// tunnel between two namespaces whose ssh connection goes through
+// delayProxy, delaying it by 25 ms in each direction (50 ms RTT), once
+// writing every packet on its own as before window_size (1) and once
+// with the default window. Without a window the tun device drops the
+// packets arriving while the channel waits for its window and the
+// connection inside the tunnel backs off. Run as root with
+//
+//	go test -tags integration -run '^$' -bench IntegrationWindowSize .
+func BenchmarkIntegrationWindowSize(b *testing.B) {
+	if os.Geteuid() != 0 {
+		b.Skip("integration benchmark requires root")
+	}
+	for _, command := range []string{"ip", "scp"} {
+		if _, err := exec.LookPath(command); err != nil {
+			b.Skipf("integration benchmark requires %s", command)
+		}
+	}
+	if _, err := os.Stat("/dev/net/tun"); err != nil {
+		b.Skipf("integration benchmark requires /dev/net/tun: %v", err)
+	}
+
+	local, err := netns.New()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer local.Close()
+	remote, err := netns.New()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer remote.Close()
+	for _, step := range []struct {
+		ns   *netns.NetNS
+		args []string
+	}{
+		{local, []string{"link", "add", "veth-local", "type", "veth", "peer", "name", "veth-remote", "netns", remote.Path()}},
+		{local, []string{"addr", "add", "10.234.0.1/30", "dev", "veth-local"}},
+		{local, []string{"link", "set", "veth-local", "up"}},
+		{local, []string{"link", "set", "lo", "up"}},
+		{remote, []string{"addr", "add", "10.234.0.2/30", "dev", "veth-remote"}},
+		{remote, []string{"link", "set", "veth-remote", "up"}},
+		{remote, []string{"link", "set", "lo", "up"}},
+	} {
+		if err := step.ns.Run("ip", step.args...); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	key, public, err := sshtest.GenerateKey()
+	if err != nil {
+		b.Fatal(err)
+	}
+	dir := b.TempDir()
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyFile, key, 0600); err != nil {
+		b.Fatal(err)
+	}
+	var hp *sshtest.HoneyPot
+	if err := remote.Do(func() (err error) {
+		hp, err = sshtest.NewHoneyPot(
+			sshtest.WithListenAddress("10.234.0.2:0"),
+			sshtest.WithAuthorizedKeys(public),
+			sshtest.WithScriptedHandler("", remoteShell(remote)),
+		)
+		return err
+	}); err != nil {
+		b.Fatal(err)
+	}
+	defer hp.Close()
+	var proxy net.Listener
+	if err := local.Do(func() (err error) {
+		proxy, err = net.Listen("tcp", "127.0.0.1:0")
+		return err
+	}); err != nil {
+		b.Fatal(err)
+	}
+	defer proxy.Close()
+	go delayProxy(proxy, local, hp.Addr(), 25*time.Millisecond)
+
+	var listener net.Listener
+	data := make([]byte, 4<<20)
+	if _, err := rand.Read(data); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bench := range []struct {
+		name       string
+		windowSize int
+	}{
+		{"window_size=1", 1},
+		{"window_size=default", 0},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			s := NewSecureShellTunneler(nil)
+			s.Name = "benchmark"
+			s.Remote = proxy.Addr().String()
+			s.RemoteUser = "root"
+			s.PrivateKeyFiles = PrivateKeyFiles{keyFile}
+			s.RemoteUploadDirectory = dir
+			s.LocalTunDevice = "tun-ibench"
+			s.RemoteTunDevice = "tun-ibench"
+			s.LocalNetwork = "172.31.234.1/30"
+			s.RemoteNetwork = "172.31.234.2/30"
+			s.WindowSize = bench.windowSize
+			ctx, cancel := context.WithCancel(Context(context.Background()))
+			opened := make(chan error, 1)
+			go func() {
+				opened <- local.Do(func() error {
+					return s.Open(ctx)
+				})
+			}()
+			defer func() {
+				cancel()
+				select {
+				case <-opened:
+				case <-time.After(10 * time.Second):
+					b.Error("Open did not return after cancel")
+				}
+			}()
+			deadline := time.After(30 * time.Second)
+			for !s.IsUp() {
+				select {
+				case err := <-opened:
+					b.Fatalf("Open returned before the tunnel came up: %v", err)
+				case <-deadline:
+					b.Fatal("tunnel did not come up")
+				case <-time.After(50 * time.Millisecond):
+				}
+			}
+			// The remote address appears once the helper has
+			// configured the device.
+			for attempt := 0; ; attempt++ {
+				err := remote.Do(func() (err error) {
+					listener, err = net.Listen("tcp", "172.31.234.2:0")
+					return err
+				})
+				if err == nil {
+					break
+				}
+				if attempt == 50 {
+					b.Fatal(err)
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+			defer listener.Close()
+
+			// One connection for every iteration, acknowledged per
+			// iteration, so that slow start of the inner TCP
+			// connection is not measured.
+			received := make(chan error, 1)
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					received <- err
+					return
+				}
+				defer conn.Close()
+				b := make([]byte, len(data))
+				for {
+					if _, err := io.ReadFull(conn, b); err != nil {
+						if err == io.EOF {
+							err = nil
+						}
+						received <- err
+						return
+					}
+					if _, err := conn.Write([]byte{1}); err != nil {
+						received <- err
+						return
+					}
+				}
+			}()
+			var conn net.Conn
+			if err := local.Do(func() (err error) {
+				conn, err = net.DialTimeout("tcp", listener.Addr().String(), 5*time.Second)
+				return err
+			}); err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			transfer := func() {
+				conn.SetDeadline(time.Now().Add(60 * time.Second))
+				if _, err := conn.Write(data); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.ReadFull(conn, make([]byte, 1)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			transfer()
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				transfer()
+			}
+			b.StopTimer()
+			conn.Close()
+			select {
+			case err := <-received:
+				if err != nil {
+					b.Fatal(err)
+				}
+			case <-time.After(10 * time.Second):
+				b.Fatal("receiver did not finish")
+			}
+		})
+	}
+}
+
+// delayProxy accepts connections on l and relays each to addr, dialed
+// in ns, holding back every chunk read in either direction for delay.
+func delayProxy(l net.Listener, ns *netns.NetNS, addr string, delay time.Duration) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		var upstream net.Conn
+		if err := ns.Do(func() (err error) {
+			upstream, err = net.Dial("tcp", addr)
+			return err
+		}); err != nil {
+			conn.Close()
+			continue
+		}
+		go delayCopy(upstream, conn, delay)
+		go delayCopy(conn, upstream, delay)
+	}
+}
+
+// delayCopy copies src to dst, writing every chunk read from src delay
+// after it was read. Closing either end closes both.
+func delayCopy(dst, src net.Conn, delay time.Duration) {
+	type chunk struct {
+		at time.Time
+		b  []byte
+	}
+	chunks := make(chan chunk, 4096)
+	go func() {
+		defer close(chunks)
+		for {
+			b := make([]byte, 32<<10)
+			n, err := src.Read(b)
+			if n > 0 {
+				chunks <- chunk{at: time.Now().Add(delay), b: b[:n]}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	defer dst.Close()
+	defer src.Close()
+	for c := range chunks {
+		time.Sleep(time.Until(c.at))
+		if _, err := dst.Write(c.b); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// buildhelpers cross-compiles cmd/tunreadwriter for every supported
+// remote architecture and writes gzip compressed binaries embedded by
+// the sshtun package. Run via go generate in the repository root.
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	outputDirectory string = "bin"
+	architectures   string = "amd64,arm64,arm"
+	version         string = os.Getenv("VERSION")
+)
+
+func main() {
+	flag.StringVar(&outputDirectory, "o", outputDirectory, "Output `directory`")
+	flag.StringVar(&architectures, "arch", architectures, "Comma separated list of `GOARCH` values to build for linux")
+	flag.StringVar(&version, "version", version, "Version passed to tunreadwriter via -X main.version")
+	flag.Parse()
+	if err := os.MkdirAll(outputDirectory, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	for _, arch := range strings.Split(architectures, ",") {
+		if err := build(strings.TrimSpace(arch)); err != nil {
+			fmt.Fprintf(os.Stderr, "linux/%s: %v\n", arch, err)
+			os.Exit(1)
+		}
+	}
+}
+
+func build(arch string) error {
+	binary := filepath.Join(outputDirectory, "tunreadwriter-linux-"+arch)
+	ldflags := "-s -w"
+	if version != "" {
+		ldflags += " -X main.version=" + version
+	}
+	cmd := exec.Command("go", "build", "-trimpath", "-ldflags="+ldflags, "-o", binary, "./cmd/tunreadwriter")
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0", "GOOS=linux", "GOARCH="+arch)
+	if arch == "arm" {
+		// ARMv6 runs on both armv6l and armv7l remotes.
+		cmd.Env = append(cmd.Env, "GOARM=6")
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	defer os.Remove(binary)
+	return compress(binary, binary+".gz")
+}
+
+func compress(src, dst string) error {
+	b, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	zw, err := gzip.NewWriterLevel(f, gzip.BestCompression)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := zw.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -9,14 +9,21 @@ package crand
 import (
 	cryptoRand "crypto/rand"
 	"encoding/binary"
+	"io"
 	"math/rand"
 	"sync"
 )
 
-// There is no seeding required in this implementation so no need to export a
-// new source like with math/rand, but this will have to change if we add
-// another PRNG. The API should then be backward compatible with the
-// crypto/rand implementation as default.
+// RETRIES is how many times crypto/rand is read before the functions
+// without an error return panic.
+const RETRIES int = 3
+
+// entropy is where all randomness comes from, only replaced by tests.
+var entropy io.Reader = cryptoRand.Reader
+
+// There is no seeding required in this implementation, a seeded
+// math/rand source for reproducible tests can be used through NewRand
+// or SetSourceForTesting while crypto/rand remains the default.
 var gsrc = cryptoRandSource{&sync.Mutex{}}
 var gr = rand.New(gsrc)
 
@@ -32,45 +39,58 @@ func (s cryptoRandSource) Seed(seed int64) {
 func (s cryptoRandSource) Int63() int64 {
 	return int64(s.Uint64() & ^uint64(1<<63))
 }
-func (s cryptoRandSource) Uint64() (v uint64) {
-	s.Lock()
-	err := binary.Read(cryptoRand.Reader, binary.BigEndian, &v)
-	s.Unlock()
-	if err != nil {
-		panic(err)
+
+// Uint64 retries a failing crypto/rand RETRIES times before
+// panicking, use Uint64E to handle the error instead.
+func (s cryptoRandSource) Uint64() uint64 {
+	var err error
+	for i := 0; i < RETRIES; i++ {
+		var v uint64
+		if v, err = s.Uint64E(); err == nil {
+			return v
+		}
 	}
-	return // automatically implies that v is returned
+	panic(err)
 }
 
-func (s cryptoRandSource) Read(p []byte) (n int, err error) {
+func (s cryptoRandSource) Uint64E() (v uint64, err error) {
 	s.Lock()
-	err = binary.Read(cryptoRand.Reader, binary.BigEndian, &p)
+	err = binary.Read(entropy, binary.BigEndian, &v)
 	s.Unlock()
-	return len(p), err
+	return v, err
 }
 
-func (s cryptoRandSource) ReadRunes(p []rune) (n int, err error) {
+// Read fills p with random bytes, n is less than len(p) only if err
+// is not nil.
+func (s cryptoRandSource) Read(p []byte) (n int, err error) {
 	s.Lock()
-	err = binary.Read(cryptoRand.Reader, binary.BigEndian, &p)
+	n, err = io.ReadFull(entropy, p)
 	s.Unlock()
-	return len(p), err
+	return n, err
 }
 
-// These functions are frontends to math/rand...
-func Seed(seed int64)                       { gsrc.Seed(seed) }
-func Int63() int64                          { return gsrc.Int63() }
-func Uint32() uint32                        { return gr.Uint32() }
-func Uint64() uint64                        { return gsrc.Uint64() }
-func Int31() int32                          { return gr.Int31() }
-func Int() int                              { return gr.Int() }
-func Int63n(n int64) int64                  { return gr.Int63n(n) }
-func Int31n(n int32) int32                  { return gr.Int31n(n) }
-func Intn(n int) int                        { return gr.Intn(n) }
-func Float64() float64                      { return gr.Float64() }
-func Float32() float32                      { return gr.Float32() }
-func Perm(n int) []int                      { return gr.Perm(n) }
-func Shuffle(n int, swap func(i, j int))    { gr.Shuffle(n, swap) }
-func Read(p []byte) (n int, err error)      { return gsrc.Read(p) }
-func ReadRunes(p []rune) (n int, err error) { return gsrc.ReadRunes(p) }
-func NormFloat64() float64                  { return gr.NormFloat64() }
-func ExpFloat64() float64                   { return gr.ExpFloat64() }
+// These functions are frontends to math/rand, drawing from crypto/rand
+// unless SetSourceForTesting is in effect.
+func Seed(seed int64)                    { global.Load().Seed(seed) }
+func Int63() int64                       { return global.Load().Int63() }
+func Uint32() uint32                     { return global.Load().Uint32() }
+func Uint64() uint64                     { return global.Load().Uint64() }
+func Int31() int32                       { return global.Load().Int31() }
+func Int() int                           { return global.Load().Int() }
+func Int63n(n int64) int64               { return global.Load().Int63n(n) }
+func Int31n(n int32) int32               { return global.Load().Int31n(n) }
+func Intn(n int) int                     { return global.Load().Intn(n) }
+func Float64() float64                   { return global.Load().Float64() }
+func Float32() float32                   { return global.Load().Float32() }
+func Perm(n int) []int                   { return global.Load().Perm(n) }
+func Shuffle(n int, swap func(i, j int)) { global.Load().Shuffle(n, swap) }
+func Read(p []byte) (n int, err error)   { return global.Load().Read(p) }
+func NormFloat64() float64               { return global.Load().NormFloat64() }
+func ExpFloat64() float64                { return global.Load().ExpFloat64() }
+
+// These variants return the error of crypto/rand instead of panicking.
+func Uint64E() (uint64, error)       { return global.Load().Uint64E() }
+func Int63E() (int64, error)         { return global.Load().Int63E() }
+func Int63nE(n int64) (int64, error) { return global.Load().Int63nE(n) }
+func IntnE(n int) (int, error)       { return global.Load().IntnE(n) }
+func HexE(n int) (string, error)     { return global.Load().HexE(n) }
@@ -7,8 +7,10 @@
 package crand
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"testing"
 )
@@ -177,3 +179,38 @@ func standardDeviationFloat64(samples []float64) (mean, sd float64) {
 	sd = math.Sqrt(squaresum/float64(len(samples)) - mean*mean)
 	return
 }
+
+func TestRead(t *testing.T) {
+	for _, size := range []int{0, 1, 7, 64, 4096} {
+		p := make([]byte, size)
+		n, err := Read(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != size {
+			t.Errorf("expected %d bytes, got %d", size, n)
+		}
+		if size >= 64 && bytes.Count(p, []byte{0}) > size/8 {
+			t.Errorf("expected the buffer to be filled, %d of %d bytes are zero", bytes.Count(p, []byte{0}), size)
+		}
+	}
+	a, b := make([]byte, 32), make([]byte, 32)
+	Read(a)
+	Read(b)
+	if bytes.Equal(a, b) {
+		t.Error("expected two reads to differ")
+	}
+}
+
+func TestReadShort(t *testing.T) {
+	defer func(r io.Reader) { entropy = r }(entropy)
+	entropy = io.LimitReader(bytes.NewReader(bytes.Repeat([]byte{0xaa}, 10)), 10)
+	p := make([]byte, 16)
+	n, err := Read(p)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+	if n != 10 {
+		t.Errorf("expected 10 bytes read, got %d", n)
+	}
+}
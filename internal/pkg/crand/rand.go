@@ -0,0 +1,235 @@
+package crand
+
+import (
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+// Rand has the same methods as the package level functions but draws
+// from its own source, e.g a seeded math/rand source for reproducible
+// tests. A Rand is goroutine-safe.
+type Rand struct {
+	mutex sync.Mutex
+	src   rand.Source64
+	r     *rand.Rand
+}
+
+// NewRand returns a Rand drawing from src.
+func NewRand(src rand.Source64) *Rand {
+	return &Rand{src: src, r: rand.New(src)}
+}
+
+// global backs the package level functions, crypto/rand unless
+// replaced by SetSourceForTesting.
+var global atomic.Pointer[Rand]
+
+func init() {
+	global.Store(NewRand(gsrc))
+}
+
+// SetSourceForTesting makes the package level functions draw from src
+// until the returned function is called, e.g
+//
+//	defer crand.SetSourceForTesting(rand.NewSource(1).(rand.Source64))()
+//
+// Only for tests, the default is cryptographically random.
+func SetSourceForTesting(src rand.Source64) (restore func()) {
+	previous := global.Swap(NewRand(src))
+	return func() {
+		global.Store(previous)
+	}
+}
+
+func (r *Rand) Seed(seed int64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.src.Seed(seed)
+}
+
+func (r *Rand) Int63() int64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.src.Int63()
+}
+
+func (r *Rand) Uint64() uint64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.src.Uint64()
+}
+
+func (r *Rand) Uint32() uint32 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.r.Uint32()
+}
+
+func (r *Rand) Int31() int32 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.r.Int31()
+}
+
+func (r *Rand) Int() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.r.Int()
+}
+
+func (r *Rand) Int63n(n int64) int64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.r.Int63n(n)
+}
+
+func (r *Rand) Int31n(n int32) int32 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.r.Int31n(n)
+}
+
+func (r *Rand) Intn(n int) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.r.Intn(n)
+}
+
+func (r *Rand) Float64() float64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.r.Float64()
+}
+
+func (r *Rand) Float32() float32 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.r.Float32()
+}
+
+func (r *Rand) Perm(n int) []int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.r.Perm(n)
+}
+
+func (r *Rand) Shuffle(n int, swap func(i, j int)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.r.Shuffle(n, swap)
+}
+
+func (r *Rand) NormFloat64() float64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.r.NormFloat64()
+}
+
+func (r *Rand) ExpFloat64() float64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.r.ExpFloat64()
+}
+
+// Read fills p with random bytes, from the source directly if it is
+// an io.Reader (like the crypto/rand source).
+func (r *Rand) Read(p []byte) (n int, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if reader, ok := r.src.(io.Reader); ok {
+		return reader.Read(p)
+	}
+	return r.r.Read(p)
+}
+
+// String returns a random string of n characters (runes) from
+// alphabet, each equally likely. Panics if alphabet is empty.
+func (r *Rand) String(n int, alphabet string) string {
+	runes := []rune(alphabet)
+	s := make([]rune, n)
+	for i := range s {
+		s[i] = runes[r.Intn(len(runes))]
+	}
+	return string(s)
+}
+
+// Hex returns n random bytes hex encoded, a string of 2*n lowercase
+// hex digits. Panics if the source fails.
+func (r *Rand) Hex(n int) string {
+	s, err := r.HexE(n)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// HexE is Hex returning the error of the source instead of panicking.
+func (r *Rand) HexE(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := r.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// source64E is a source that can fail, like the crypto/rand source.
+type source64E interface {
+	Uint64E() (uint64, error)
+}
+
+// Uint64E is Uint64 returning the error of the source instead of
+// panicking. Sources that can not fail never return an error.
+func (r *Rand) Uint64E() (uint64, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if src, ok := r.src.(source64E); ok {
+		return src.Uint64E()
+	}
+	return r.src.Uint64(), nil
+}
+
+// Int63E is Int63 returning the error of the source instead of
+// panicking.
+func (r *Rand) Int63E() (int64, error) {
+	v, err := r.Uint64E()
+	return int64(v & ^uint64(1<<63)), err
+}
+
+// Int63nE is Int63n returning the error of the source instead of
+// panicking, it still panics if n <= 0. The sequence differs from
+// Int63n for the same seed.
+func (r *Rand) Int63nE(n int64) (int64, error) {
+	if n <= 0 {
+		panic("invalid argument to Int63nE")
+	}
+	v, err := r.uint64nE(uint64(n))
+	return int64(v), err
+}
+
+// IntnE is Intn returning the error of the source instead of
+// panicking, it still panics if n <= 0. The sequence differs from
+// Intn for the same seed.
+func (r *Rand) IntnE(n int) (int, error) {
+	if n <= 0 {
+		panic("invalid argument to IntnE")
+	}
+	v, err := r.uint64nE(uint64(n))
+	return int(v), err
+}
+
+// uint64nE returns a uniform value in [0,n) rejecting the values of
+// the incomplete last range to avoid modulo bias.
+func (r *Rand) uint64nE(n uint64) (uint64, error) {
+	limit := ^uint64(0) - ^uint64(0)%n
+	for {
+		v, err := r.Uint64E()
+		if err != nil {
+			return 0, err
+		}
+		if v < limit {
+			return v % n, nil
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package crand
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestNewRand(t *testing.T) {
+	a := NewRand(rand.NewSource(1).(rand.Source64))
+	b := NewRand(rand.NewSource(1).(rand.Source64))
+	for i := 0; i < 100; i++ {
+		if x, y := a.Int63n(1000), b.Int63n(1000); x != y {
+			t.Fatalf("expected the same sequence from the same seed, got %d and %d", x, y)
+		}
+	}
+	if x, y := a.Hex(8), b.Hex(8); x != y || len(x) != 16 {
+		t.Errorf("expected the same 16 hex digits, got %q and %q", x, y)
+	}
+	if x, y := a.String(12, ALPHANUMERIC), b.String(12, ALPHANUMERIC); x != y {
+		t.Errorf("expected the same string, got %q and %q", x, y)
+	}
+}
+
+func TestSetSourceForTesting(t *testing.T) {
+	restore := SetSourceForTesting(rand.NewSource(42).(rand.Source64))
+	first := []int64{Int63(), Int63n(100), int64(Intn(100))}
+	hex := Hex(8)
+	restore()
+
+	restore = SetSourceForTesting(rand.NewSource(42).(rand.Source64))
+	second := []int64{Int63(), Int63n(100), int64(Intn(100))}
+	if Hex(8) != hex {
+		t.Error("expected Hex to be reproducible")
+	}
+	restore()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Errorf("expected %v, got %v", first, second)
+			break
+		}
+	}
+
+	if global.Load().src != gsrc {
+		t.Error("expected crypto/rand to be restored")
+	}
+}
+
+func TestRandConcurrent(t *testing.T) {
+	r := NewRand(rand.NewSource(1).(rand.Source64))
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				r.Intn(10)
+				r.Hex(4)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// failingReader fails the first failures reads.
+type failingReader struct {
+	failures int
+	reads    int
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	f.reads++
+	if f.reads <= f.failures {
+		return 0, errors.New("getrandom: operation not permitted")
+	}
+	for i := range p {
+		p[i] = byte(f.reads + i)
+	}
+	return len(p), nil
+}
+
+func TestErrorVariants(t *testing.T) {
+	defer func(r io.Reader) { entropy = r }(entropy)
+	entropy = &failingReader{failures: 1 << 30}
+	if _, err := Uint64E(); err == nil {
+		t.Error("expected an error from Uint64E")
+	}
+	if _, err := Int63E(); err == nil {
+		t.Error("expected an error from Int63E")
+	}
+	if _, err := Int63nE(10); err == nil {
+		t.Error("expected an error from Int63nE")
+	}
+	if _, err := IntnE(10); err == nil {
+		t.Error("expected an error from IntnE")
+	}
+	if _, err := HexE(8); err == nil {
+		t.Error("expected an error from HexE")
+	}
+
+	failing := &failingReader{failures: RETRIES}
+	entropy = failing
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected Uint64 to panic")
+			}
+		}()
+		Uint64()
+	}()
+	if failing.reads != RETRIES {
+		t.Errorf("expected %d attempts, got %d", RETRIES, failing.reads)
+	}
+
+	entropy = &failingReader{failures: RETRIES - 1}
+	Uint64()
+
+	entropy = &failingReader{}
+	for i := 0; i < 100; i++ {
+		if v, err := IntnE(7); err != nil || v < 0 || v >= 7 {
+			t.Fatalf("expected 0 <= v < 7, got %d: %v", v, err)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package crand
+
+import (
+	"io"
+)
+
+const (
+	ALPHANUMERIC string = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	LOWERCASE    string = "abcdefghijklmnopqrstuvwxyz"
+)
+
+// Reader is an io.Reader streaming random bytes (see Read), shared by
+// all callers and goroutine-safe.
+var Reader io.Reader = readerFunc(Read)
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+// String returns a random string of n characters (runes) from
+// alphabet, each equally likely. Panics if alphabet is empty.
+func String(n int, alphabet string) string {
+	return global.Load().String(n, alphabet)
+}
+
+// Hex returns n random bytes hex encoded, a string of 2*n lowercase
+// hex digits. Panics if crypto/rand fails.
+func Hex(n int) string {
+	return global.Load().Hex(n)
+}
@@ -0,0 +1,67 @@
+package crand
+
+import (
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestString(t *testing.T) {
+	for _, alphabet := range []string{LOWERCASE, ALPHANUMERIC, "01", "åäö"} {
+		for _, n := range []int{0, 1, 12, 100} {
+			s := String(n, alphabet)
+			if utf8.RuneCountInString(s) != n {
+				t.Errorf("expected %d characters, got %q", n, s)
+			}
+			for _, r := range s {
+				if !strings.ContainsRune(alphabet, r) {
+					t.Errorf("%q in %q is not in alphabet %q", r, s, alphabet)
+				}
+			}
+		}
+	}
+}
+
+func TestStringDistribution(t *testing.T) {
+	const samples = 26000
+	counts := make(map[rune]int)
+	for _, r := range String(samples, LOWERCASE) {
+		counts[r]++
+	}
+	if len(counts) != 26 {
+		t.Fatalf("expected all 26 letters, got %d", len(counts))
+	}
+	for r, count := range counts {
+		// Expected 1000 each, the standard deviation is about 31.
+		if count < 800 || count > 1200 {
+			t.Errorf("%q occurred %d times, expected about 1000", r, count)
+		}
+	}
+}
+
+func TestHex(t *testing.T) {
+	hex := regexp.MustCompile(`^[0-9a-f]*$`)
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		s := Hex(8)
+		if len(s) != 16 || !hex.MatchString(s) {
+			t.Fatalf("expected 16 hex digits, got %q", s)
+		}
+		if seen[s] {
+			t.Fatalf("duplicate %q", s)
+		}
+		seen[s] = true
+	}
+}
+
+func TestReader(t *testing.T) {
+	b, err := io.ReadAll(io.LimitReader(Reader, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 1000 {
+		t.Errorf("expected 1000 bytes, got %d", len(b))
+	}
+}
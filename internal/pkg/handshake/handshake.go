@@ -0,0 +1,107 @@
+// The handshake package implements the line written by tunreadwriter
+// -handshake before entering the data loop, allowing sshtun to detect
+// a helper speaking another protocol version and learn the name and
+// MTU of the tun device allocated on the remote.
+package handshake
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidHandshake error = errors.New("invalid handshake from remote helper")
+	ErrProtocolVersion  error = errors.New("remote helper protocol version mismatch")
+)
+
+const (
+	// MAGIC starts the handshake line.
+	MAGIC string = "SSHTUN-HELPER"
+	// VERSION is the protocol version spoken by this build of sshtun
+	// and tunreadwriter. Helpers without -handshake are version 0.
+	VERSION int = 1
+	// maxLength limits how much is read looking for the handshake.
+	maxLength int = 256
+)
+
+// Handshake is sent by the helper as a single line:
+// SSHTUN-HELPER <version> <device> <mtu> [<families>]
+// where families is a comma separated list of the address families
+// configured on the device (inet, inet6).
+type Handshake struct {
+	Version  int
+	Device   string
+	MTU      int
+	Families []string
+}
+
+// New returns a Handshake of the current VERSION.
+func New(device string, mtu int, families ...string) Handshake {
+	return Handshake{Version: VERSION, Device: device, MTU: mtu, Families: families}
+}
+
+func (h Handshake) String() string {
+	line := fmt.Sprintf("%s %d %s %d", MAGIC, h.Version, h.Device, h.MTU)
+	if len(h.Families) > 0 {
+		line += " " + strings.Join(h.Families, ",")
+	}
+	return line
+}
+
+// Write writes the handshake line to w.
+func (h Handshake) Write(w io.Writer) error {
+	_, err := io.WriteString(w, h.String()+"\n")
+	return err
+}
+
+// Read reads the handshake line from r. Data after the line is left
+// in r. Returns an error wrapping ErrProtocolVersion if the helper
+// speaks another version.
+func Read(r *bufio.Reader) (Handshake, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return Handshake{}, fmt.Errorf("%w: %w", ErrInvalidHandshake, err)
+		}
+		if b == '\n' {
+			break
+		}
+		line = append(line, b)
+		if len(line) > maxLength {
+			return Handshake{}, fmt.Errorf("%w: line too long", ErrInvalidHandshake)
+		}
+	}
+	return Parse(string(line))
+}
+
+// Parse parses a handshake line without the trailing newline.
+func Parse(line string) (Handshake, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != MAGIC {
+		return Handshake{}, fmt.Errorf("%w: %q", ErrInvalidHandshake, line)
+	}
+	version, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return Handshake{}, fmt.Errorf("%w: version: %w", ErrInvalidHandshake, err)
+	}
+	if version != VERSION {
+		return Handshake{Version: version}, fmt.Errorf("%w: remote helper protocol v%d, need v%d", ErrProtocolVersion, version, VERSION)
+	}
+	if len(fields) != 4 && len(fields) != 5 {
+		return Handshake{}, fmt.Errorf("%w: %q", ErrInvalidHandshake, line)
+	}
+	mtu, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return Handshake{}, fmt.Errorf("%w: mtu: %w", ErrInvalidHandshake, err)
+	}
+	h := Handshake{Version: version, Device: fields[2], MTU: mtu}
+	if len(fields) == 5 {
+		h.Families = strings.Split(fields[4], ",")
+	}
+	return h, nil
+}
@@ -0,0 +1,42 @@
+package handshake
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadWrite(t *testing.T) {
+	var b bytes.Buffer
+	if err := New("tun3", 1400, "inet", "inet6").Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	b.WriteString("packet data")
+	r := bufio.NewReader(&b)
+	h, err := Read(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(h, Handshake{Version: VERSION, Device: "tun3", MTU: 1400, Families: []string{"inet", "inet6"}}) {
+		t.Errorf("unexpected handshake %+v", h)
+	}
+	rest, _ := io.ReadAll(r)
+	if string(rest) != "packet data" {
+		t.Errorf("expected data after the handshake to be left in the reader, got %q", rest)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	if _, err := Parse("SSHTUN-HELPER 2 tun0 1500"); !errors.Is(err, ErrProtocolVersion) || !strings.Contains(err.Error(), "v2, need v1") {
+		t.Errorf("expected ErrProtocolVersion, got %v", err)
+	}
+	for _, line := range []string{"", "hello", "SSHTUN-HELPER x tun0 1500", "SSHTUN-HELPER 1 tun0"} {
+		if _, err := Parse(line); !errors.Is(err, ErrInvalidHandshake) {
+			t.Errorf("%q: expected ErrInvalidHandshake, got %v", line, err)
+		}
+	}
+}
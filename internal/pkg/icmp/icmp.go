@@ -0,0 +1,141 @@
+// The icmp package builds and parses ICMP echo requests and replies
+// in IPv4 packets as read from or written to a tun device, used to
+// ping the remote end of a tunnel through the tunnel itself without
+// raw sockets.
+package icmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+var (
+	ErrInvalidPacket error = errors.New("invalid packet")
+	ErrNotEcho       error = errors.New("not an ICMP echo packet")
+)
+
+const (
+	TYPE_ECHO_REPLY   uint8 = 0
+	TYPE_ECHO_REQUEST uint8 = 8
+
+	PROTOCOL_ICMP uint8 = 1
+
+	ipv4HeaderLength int   = 20
+	icmpHeaderLength int   = 8
+	ttl              uint8 = 64
+	flagDontFragment int   = 0x4000
+)
+
+// Echo is an ICMP echo request or reply from Src to Dst.
+type Echo struct {
+	Type    uint8
+	Src     net.IP
+	Dst     net.IP
+	ID      uint16
+	Seq     uint16
+	Payload []byte
+}
+
+// Marshal returns e as an IPv4 packet with checksums.
+func (e Echo) Marshal() ([]byte, error) {
+	src, dst := e.Src.To4(), e.Dst.To4()
+	if src == nil || dst == nil {
+		return nil, fmt.Errorf("%w: source and destination must be IPv4 addresses", ErrInvalidPacket)
+	}
+	if e.Type != TYPE_ECHO_REQUEST && e.Type != TYPE_ECHO_REPLY {
+		return nil, fmt.Errorf("%w: type %d", ErrNotEcho, e.Type)
+	}
+	length := ipv4HeaderLength + icmpHeaderLength + len(e.Payload)
+	if length > 0xffff {
+		return nil, fmt.Errorf("%w: payload too large", ErrInvalidPacket)
+	}
+	b := make([]byte, length)
+	b[0] = 0x45 // version 4, header length 5 words
+	binary.BigEndian.PutUint16(b[2:], uint16(length))
+	binary.BigEndian.PutUint16(b[4:], e.Seq)
+	binary.BigEndian.PutUint16(b[6:], uint16(flagDontFragment))
+	b[8] = ttl
+	b[9] = PROTOCOL_ICMP
+	copy(b[12:16], src)
+	copy(b[16:20], dst)
+	binary.BigEndian.PutUint16(b[10:], Checksum(b[:ipv4HeaderLength]))
+
+	m := b[ipv4HeaderLength:]
+	m[0] = e.Type
+	binary.BigEndian.PutUint16(m[4:], e.ID)
+	binary.BigEndian.PutUint16(m[6:], e.Seq)
+	copy(m[icmpHeaderLength:], e.Payload)
+	binary.BigEndian.PutUint16(m[2:], Checksum(m))
+	return b, nil
+}
+
+// Parse returns the ICMP echo request or reply in the IPv4 packet.
+// Returns an error wrapping ErrNotEcho if packet is valid but not an
+// unfragmented ICMP echo, otherwise ErrInvalidPacket.
+func Parse(packet []byte) (Echo, error) {
+	var e Echo
+	if len(packet) < ipv4HeaderLength || packet[0]>>4 != 4 {
+		return e, fmt.Errorf("%w: not an IPv4 packet", ErrInvalidPacket)
+	}
+	headerLength := int(packet[0]&0x0f) * 4
+	length := int(binary.BigEndian.Uint16(packet[2:]))
+	if headerLength < ipv4HeaderLength || length < headerLength || length > len(packet) {
+		return e, fmt.Errorf("%w: bad header or total length", ErrInvalidPacket)
+	}
+	if Checksum(packet[:headerLength]) != 0 {
+		return e, fmt.Errorf("%w: bad IPv4 header checksum", ErrInvalidPacket)
+	}
+	if packet[9] != PROTOCOL_ICMP {
+		return e, fmt.Errorf("%w: protocol %d", ErrNotEcho, packet[9])
+	}
+	if binary.BigEndian.Uint16(packet[6:])&0x3fff != 0 {
+		return e, fmt.Errorf("%w: fragmented", ErrNotEcho)
+	}
+	m := packet[headerLength:length]
+	if len(m) < icmpHeaderLength {
+		return e, fmt.Errorf("%w: short ICMP header", ErrInvalidPacket)
+	}
+	if Checksum(m) != 0 {
+		return e, fmt.Errorf("%w: bad ICMP checksum", ErrInvalidPacket)
+	}
+	if (m[0] != TYPE_ECHO_REQUEST && m[0] != TYPE_ECHO_REPLY) || m[1] != 0 {
+		return e, fmt.Errorf("%w: type %d code %d", ErrNotEcho, m[0], m[1])
+	}
+	e.Type = m[0]
+	e.Src = net.IP(append([]byte(nil), packet[12:16]...))
+	e.Dst = net.IP(append([]byte(nil), packet[16:20]...))
+	e.ID = binary.BigEndian.Uint16(m[4:])
+	e.Seq = binary.BigEndian.Uint16(m[6:])
+	e.Payload = append([]byte(nil), m[icmpHeaderLength:]...)
+	return e, nil
+}
+
+// Reply returns the echo reply to the echo request e.
+func (e Echo) Reply() Echo {
+	return Echo{
+		Type:    TYPE_ECHO_REPLY,
+		Src:     e.Dst,
+		Dst:     e.Src,
+		ID:      e.ID,
+		Seq:     e.Seq,
+		Payload: e.Payload,
+	}
+}
+
+// Checksum returns the internet checksum (RFC 1071) of b. The
+// checksum of data including a correct checksum field is 0.
+func Checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
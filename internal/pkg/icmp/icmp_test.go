@@ -0,0 +1,89 @@
+package icmp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestMarshalParse(t *testing.T) {
+	request := Echo{
+		Type:    TYPE_ECHO_REQUEST,
+		Src:     net.ParseIP("172.18.0.1"),
+		Dst:     net.ParseIP("172.18.0.2"),
+		ID:      0x1234,
+		Seq:     7,
+		Payload: []byte("sshtun"),
+	}
+	b, err := request.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 20+8+6 || b[9] != PROTOCOL_ICMP {
+		t.Fatalf("unexpected packet % x", b)
+	}
+	e, err := Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != TYPE_ECHO_REQUEST || !e.Src.Equal(request.Src) || !e.Dst.Equal(request.Dst) || e.ID != 0x1234 || e.Seq != 7 || !bytes.Equal(e.Payload, request.Payload) {
+		t.Errorf("unexpected echo %+v", e)
+	}
+
+	b, err = e.Reply().Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Type != TYPE_ECHO_REPLY || !reply.Src.Equal(request.Dst) || !reply.Dst.Equal(request.Src) || reply.ID != request.ID || reply.Seq != request.Seq {
+		t.Errorf("unexpected reply %+v", reply)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	valid, err := Echo{Type: TYPE_ECHO_REQUEST, Src: net.ParseIP("10.0.0.1"), Dst: net.ParseIP("10.0.0.2")}.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := append([]byte(nil), valid...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	udp := append([]byte(nil), valid...)
+	udp[9] = 17
+	udp[10], udp[11] = 0, 0
+	c := Checksum(udp[:20])
+	udp[10], udp[11] = byte(c>>8), byte(c)
+	cases := []struct {
+		name   string
+		packet []byte
+		want   error
+	}{
+		{"empty", nil, ErrInvalidPacket},
+		{"ipv6", append([]byte{0x60}, make([]byte, 39)...), ErrInvalidPacket},
+		{"truncated", valid[:len(valid)-1], ErrInvalidPacket},
+		{"bad icmp checksum", corrupt, ErrInvalidPacket},
+		{"udp", udp, ErrNotEcho},
+	}
+	for _, c := range cases {
+		if _, err := Parse(c.packet); !errors.Is(err, c.want) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.want, err)
+		}
+	}
+	if _, err := (Echo{Type: TYPE_ECHO_REQUEST, Src: net.ParseIP("fd00::1"), Dst: net.ParseIP("fd00::2")}).Marshal(); !errors.Is(err, ErrInvalidPacket) {
+		t.Errorf("expected ErrInvalidPacket for IPv6 addresses, got %v", err)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	// IPv4 header 192.168.0.1 -> 192.168.0.199 with a zeroed checksum field.
+	header := []byte{0x45, 0x00, 0x00, 0x73, 0x00, 0x00, 0x40, 0x00, 0x40, 0x11, 0x00, 0x00, 0xc0, 0xa8, 0x00, 0x01, 0xc0, 0xa8, 0x00, 0xc7}
+	if c := Checksum(header); c != 0xb861 {
+		t.Errorf("expected checksum 0xb861, got %#04x", c)
+	}
+	if c := Checksum([]byte{0xff}); c != 0x00ff {
+		t.Errorf("expected odd length checksum 0x00ff, got %#04x", c)
+	}
+}
@@ -0,0 +1,199 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// JOURNAL_SOCKET is the journald native protocol socket.
+	JOURNAL_SOCKET string = "/run/systemd/journal/socket"
+	// JOURNAL_STREAM is set by systemd when stdout/stderr is connected
+	// to the journal.
+	JOURNAL_STREAM string = "JOURNAL_STREAM"
+)
+
+// journaldFieldNames maps well known slog attribute keys to journald
+// field names, other keys are upper-cased.
+var journaldFieldNames = map[string]string{
+	"name":   "TUNNEL",
+	"remote": "REMOTE",
+}
+
+// JournaldHandler is an slog.Handler writing structured entries to
+// the journald native socket. Every attribute becomes a journal field
+// (e.g name becomes TUNNEL) making queries like
+// journalctl -u sshtun TUNNEL=office possible. Entries that can not
+// be sent are passed to the fallback handler.
+type JournaldHandler struct {
+	conn       *net.UnixConn
+	mutex      *sync.Mutex
+	opts       slog.HandlerOptions
+	identifier string
+	fallback   slog.Handler
+	attrs      []slog.Attr
+	group      string
+}
+
+// JournaldAvailable returns true if the journald socket exists.
+func JournaldAvailable() bool {
+	fi, err := os.Stat(JOURNAL_SOCKET)
+	return err == nil && fi.Mode()&os.ModeSocket != 0
+}
+
+// UnderJournald returns true if stderr is connected to the journal,
+// i.e the JOURNAL_STREAM environment variable is set.
+func UnderJournald() bool {
+	return os.Getenv(JOURNAL_STREAM) != ""
+}
+
+// NewJournaldHandler returns a handler sending to the journald socket
+// at socket (JOURNAL_SOCKET if empty). fallback receives records
+// that could not be sent and must not be nil.
+func NewJournaldHandler(socket string, fallback slog.Handler, opts *slog.HandlerOptions) (*JournaldHandler, error) {
+	if socket == "" {
+		socket = JOURNAL_SOCKET
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	h := &JournaldHandler{
+		conn:       conn,
+		mutex:      &sync.Mutex{},
+		identifier: filepath.Base(os.Args[0]),
+		fallback:   fallback,
+	}
+	if opts != nil {
+		h.opts = *opts
+	}
+	return h, nil
+}
+
+func (h *JournaldHandler) Close() error {
+	return h.conn.Close()
+}
+
+func (h *JournaldHandler) Enabled(_ context.Context, level slog.Level) bool {
+	minLevel := slog.LevelInfo
+	if h.opts.Level != nil {
+		minLevel = h.opts.Level.Level()
+	}
+	return level >= minLevel
+}
+
+func (h *JournaldHandler) Handle(ctx context.Context, r slog.Record) error {
+	msg := h.Format(r)
+	h.mutex.Lock()
+	_, err := h.conn.Write(msg)
+	h.mutex.Unlock()
+	if err != nil {
+		return h.fallback.Handle(ctx, r)
+	}
+	return nil
+}
+
+// Format renders r in the journald native protocol format.
+func (h *JournaldHandler) Format(r slog.Record) []byte {
+	var b bytes.Buffer
+	writeJournalField(&b, "MESSAGE", r.Message)
+	writeJournalField(&b, "PRIORITY", strconv.Itoa(Severity(r.Level)))
+	writeJournalField(&b, "SYSLOG_IDENTIFIER", h.identifier)
+	writeJournalField(&b, "SYSLOG_PID", strconv.Itoa(os.Getpid()))
+	for _, a := range h.attrs {
+		writeJournalAttr(&b, "", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		writeJournalAttr(&b, h.group, a)
+		return true
+	})
+	return b.Bytes()
+}
+
+func writeJournalAttr(b *bytes.Buffer, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	key := a.Key
+	if prefix != "" {
+		key = prefix + "_" + key
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		for _, ga := range a.Value.Group() {
+			writeJournalAttr(b, key, ga)
+		}
+		return
+	}
+	writeJournalField(b, journaldFieldName(key), a.Value.String())
+}
+
+// journaldFieldName returns key as a valid journal field name: upper
+// case letters, digits and underscores, not starting with an
+// underscore or digit.
+func journaldFieldName(key string) string {
+	if name, ok := journaldFieldNames[key]; ok {
+		return name
+	}
+	name := []byte(strings.ToUpper(key))
+	for i, c := range name {
+		if !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') {
+			name[i] = '_'
+		}
+	}
+	if len(name) == 0 || name[0] == '_' || (name[0] >= '0' && name[0] <= '9') {
+		name = append([]byte("X"), name...)
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return string(name)
+}
+
+func writeJournalField(b *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		b.WriteString(name + "=" + value + "\n")
+		return
+	}
+	// Values with newlines are written as name, newline, little endian
+	// uint64 length, value and a newline.
+	b.WriteString(name + "\n")
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value + "\n")
+}
+
+func (h *JournaldHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.fallback = h.fallback.WithAttrs(attrs)
+	h2.attrs = make([]slog.Attr, 0, len(h.attrs)+len(attrs))
+	h2.attrs = append(h2.attrs, h.attrs...)
+	for _, a := range attrs {
+		if h.group != "" {
+			a.Key = h.group + "_" + a.Key
+		}
+		h2.attrs = append(h2.attrs, a)
+	}
+	return &h2
+}
+
+func (h *JournaldHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.fallback = h.fallback.WithGroup(name)
+	if h2.group != "" {
+		h2.group += "_" + name
+	} else {
+		h2.group = name
+	}
+	return &h2
+}
@@ -0,0 +1,60 @@
+package logging
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJournaldHandler(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "journal.socket")
+	pc, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	h, err := NewJournaldHandler(socket, slog.NewJSONHandler(io.Discard, nil), &slog.HandlerOptions{Level: slog.LevelDebug})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	slog.New(h).With("name", "office").Error("Tunnel closed", "remote", "host:22", "error", "line1\nline2")
+
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	n, err := pc.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := buf[:n]
+	for _, want := range []string{"MESSAGE=Tunnel closed\n", "PRIORITY=3\n", "TUNNEL=office\n", "REMOTE=host:22\n"} {
+		if !bytes.Contains(msg, []byte(want)) {
+			t.Errorf("expected %q in journal entry %q", want, msg)
+		}
+	}
+	if !bytes.Contains(msg, []byte("ERROR\n\x0b\x00\x00\x00\x00\x00\x00\x00line1\nline2\n")) {
+		t.Errorf("expected binary encoded multi-line ERROR field in %q", msg)
+	}
+}
+
+func TestJournaldFieldName(t *testing.T) {
+	for key, want := range map[string]string{
+		"name":        "TUNNEL",
+		"local_net":   "LOCAL_NET",
+		"remote-addr": "REMOTE_ADDR",
+		"_secret":     "X_SECRET",
+		"1st":         "X1ST",
+	} {
+		if got := journaldFieldName(key); got != want {
+			t.Errorf("journaldFieldName(%q) = %q, expected %q", key, got, want)
+		}
+	}
+	if got := journaldFieldName(strings.Repeat("a", 100)); len(got) != 64 {
+		t.Errorf("expected field name to be truncated to 64 characters, got %d", len(got))
+	}
+}
@@ -0,0 +1,348 @@
+// The logging package provides slog.Handlers for syslog and journald
+// used by the sshtun command.
+package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownFacility error = errors.New("unknown syslog facility")
+	ErrUnsupportedURL  error = errors.New("unsupported syslog address, use local, unix:///dev/log, udp://host:port or tcp://host:port")
+)
+
+const (
+	// SD_ID is the structured data id used for slog attributes,
+	// 32473 is the private enterprise number reserved for
+	// documentation (RFC 5612).
+	SD_ID string = "sshtun@32473"
+	// DEV_LOG is the local syslog socket.
+	DEV_LOG string = "/dev/log"
+
+	syslogQueueSize   int           = 1024
+	syslogDialTimeout time.Duration = 2 * time.Second
+	syslogRedialDelay time.Duration = 5 * time.Second
+)
+
+var facilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// Severity maps an slog.Level to a syslog severity.
+func Severity(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3 // err
+	case level >= slog.LevelWarn:
+		return 4 // warning
+	case level >= slog.LevelInfo:
+		return 6 // info
+	default:
+		return 7 // debug
+	}
+}
+
+// Facility returns the syslog facility code of name (e.g daemon or
+// local0).
+func Facility(name string) (int, error) {
+	f, ok := facilities[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("%w %q", ErrUnknownFacility, name)
+	}
+	return f, nil
+}
+
+// syslogWriter owns the connection to the syslog daemon and writes
+// queued messages from a single goroutine so that logging never
+// blocks the caller. Messages are dropped when the queue is full or
+// the connection is down.
+type syslogWriter struct {
+	network string
+	address string
+	queue   chan []byte
+	done    chan struct{}
+	once    sync.Once
+	mutex   sync.Mutex
+	dropped uint64
+}
+
+func (w *syslogWriter) dial() (net.Conn, error) {
+	if w.network == "unix" {
+		// /dev/log is usually a datagram socket, but try stream too.
+		conn, err := net.DialTimeout("unixgram", w.address, syslogDialTimeout)
+		if err == nil {
+			return conn, nil
+		}
+		return net.DialTimeout("unix", w.address, syslogDialTimeout)
+	}
+	return net.DialTimeout(w.network, w.address, syslogDialTimeout)
+}
+
+func (w *syslogWriter) run() {
+	var conn net.Conn
+	var lastDial time.Time
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for {
+		var msg []byte
+		select {
+		case <-w.done:
+			return
+		case msg = <-w.queue:
+		}
+		if conn == nil {
+			if time.Since(lastDial) < syslogRedialDelay {
+				w.drop()
+				continue
+			}
+			lastDial = time.Now()
+			c, err := w.dial()
+			if err != nil {
+				w.drop()
+				continue
+			}
+			conn = c
+		}
+		frame := msg
+		if w.network == "tcp" {
+			// RFC 6587 octet counting
+			frame = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+		}
+		conn.SetWriteDeadline(time.Now().Add(syslogDialTimeout))
+		if _, err := conn.Write(frame); err != nil {
+			conn.Close()
+			conn = nil
+			w.drop()
+		}
+	}
+}
+
+func (w *syslogWriter) drop() {
+	w.mutex.Lock()
+	w.dropped++
+	w.mutex.Unlock()
+}
+
+func (w *syslogWriter) enqueue(msg []byte) {
+	select {
+	case <-w.done:
+		w.drop()
+		return
+	default:
+	}
+	select {
+	case w.queue <- msg:
+	default:
+		w.drop()
+	}
+}
+
+// SyslogHandler is an slog.Handler writing RFC 5424 messages to a
+// local or remote syslog daemon. Attributes are flattened into
+// structured data, groups are joined with a dot.
+type SyslogHandler struct {
+	writer   *syslogWriter
+	opts     slog.HandlerOptions
+	facility int
+	hostname string
+	appName  string
+	attrs    []slog.Attr
+	group    string
+}
+
+// NewSyslogHandler returns a SyslogHandler sending to address which
+// is local (or empty) for /dev/log, unix:///path/to/socket,
+// udp://host:port or tcp://host:port. The port defaults to 514.
+// facility is a facility name like daemon or local0.
+func NewSyslogHandler(address, facility string, opts *slog.HandlerOptions) (*SyslogHandler, error) {
+	f, err := Facility(facility)
+	if err != nil {
+		return nil, err
+	}
+	network, addr, err := parseSyslogAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	h := &SyslogHandler{
+		writer: &syslogWriter{
+			network: network,
+			address: addr,
+			queue:   make(chan []byte, syslogQueueSize),
+			done:    make(chan struct{}),
+		},
+		facility: f,
+		hostname: hostname,
+		appName:  filepath.Base(os.Args[0]),
+	}
+	if opts != nil {
+		h.opts = *opts
+	}
+	go h.writer.run()
+	return h, nil
+}
+
+func parseSyslogAddress(address string) (network, addr string, err error) {
+	if address == "" || address == "local" {
+		return "unix", DEV_LOG, nil
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %w", ErrUnsupportedURL, err)
+	}
+	switch u.Scheme {
+	case "unix", "unixgram":
+		if u.Path == "" {
+			return "", "", ErrUnsupportedURL
+		}
+		return "unix", u.Path, nil
+	case "udp", "tcp":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "514")
+		}
+		return u.Scheme, host, nil
+	default:
+		return "", "", ErrUnsupportedURL
+	}
+}
+
+// Close stops the writer goroutine. Messages logged after Close are
+// dropped.
+func (h *SyslogHandler) Close() error {
+	h.writer.once.Do(func() { close(h.writer.done) })
+	return nil
+}
+
+// Dropped returns the number of messages that could not be delivered.
+func (h *SyslogHandler) Dropped() uint64 {
+	h.writer.mutex.Lock()
+	defer h.writer.mutex.Unlock()
+	return h.writer.dropped
+}
+
+func (h *SyslogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	minLevel := slog.LevelInfo
+	if h.opts.Level != nil {
+		minLevel = h.opts.Level.Level()
+	}
+	return level >= minLevel
+}
+
+func (h *SyslogHandler) Handle(_ context.Context, r slog.Record) error {
+	h.writer.enqueue(h.Format(r))
+	return nil
+}
+
+// Format renders r as an RFC 5424 syslog message.
+func (h *SyslogHandler) Format(r slog.Record) []byte {
+	var b strings.Builder
+	t := r.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d - ", h.facility*8+Severity(r.Level), t.Format(time.RFC3339Nano), h.hostname, h.appName, os.Getpid())
+	var params []string
+	for _, a := range h.attrs {
+		params = appendParams(params, "", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		params = appendParams(params, h.group, a)
+		return true
+	})
+	if len(params) == 0 {
+		b.WriteString("-")
+	} else {
+		b.WriteString("[" + SD_ID)
+		for _, p := range params {
+			b.WriteString(" " + p)
+		}
+		b.WriteString("]")
+	}
+	b.WriteString(" " + r.Message)
+	return []byte(b.String())
+}
+
+var sdValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+func appendParams(params []string, prefix string, a slog.Attr) []string {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return params
+	}
+	key := a.Key
+	if prefix != "" {
+		key = prefix + "." + key
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		for _, ga := range a.Value.Group() {
+			params = appendParams(params, key, ga)
+		}
+		return params
+	}
+	return append(params, sdName(key)+`="`+sdValueEscaper.Replace(a.Value.String())+`"`)
+}
+
+// sdName returns key as a valid SD-NAME: printable US-ASCII except
+// '=', ' ', ']' and '"', at most 32 characters.
+func sdName(key string) string {
+	name := []byte(key)
+	for i, c := range name {
+		if c <= ' ' || c >= 127 || c == '=' || c == ']' || c == '"' {
+			name[i] = '_'
+		}
+	}
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	if len(name) == 0 {
+		return "_"
+	}
+	return string(name)
+}
+
+func (h *SyslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = make([]slog.Attr, 0, len(h.attrs)+len(attrs))
+	h2.attrs = append(h2.attrs, h.attrs...)
+	for _, a := range attrs {
+		if h.group != "" {
+			a.Key = h.group + "." + a.Key
+		}
+		h2.attrs = append(h2.attrs, a)
+	}
+	return &h2
+}
+
+func (h *SyslogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	if h2.group != "" {
+		h2.group += "." + name
+	} else {
+		h2.group = name
+	}
+	return &h2
+}
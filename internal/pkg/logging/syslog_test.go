@@ -0,0 +1,60 @@
+package logging
+
+import (
+	"log/slog"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogHandlerUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	h, err := NewSyslogHandler("udp://"+pc.LocalAddr().String(), "local3", &slog.HandlerOptions{Level: slog.LevelDebug})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	l := slog.New(h).With("name", "office").WithGroup("g")
+	l.Warn("Tunnel closed", "remote", `host"]\`, "count", 3)
+
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(buf[:n])
+	// local3 (19) * 8 + warning (4) = 156
+	re := regexp.MustCompile(`^<156>1 \S+ \S+ \S+ \d+ - \[sshtun@32473 name="office" g\.remote="host\\"\\]\\\\" g\.count="3"\] Tunnel closed$`)
+	if !re.MatchString(msg) {
+		t.Errorf("unexpected syslog message: %s", msg)
+	}
+}
+
+func TestParseSyslogAddress(t *testing.T) {
+	for address, want := range map[string]string{
+		"":                         "unix " + DEV_LOG,
+		"local":                    "unix " + DEV_LOG,
+		"unix:///run/log":          "unix /run/log",
+		"udp://syslog.example.com": "udp syslog.example.com:514",
+		"tcp://10.0.0.1:6514":      "tcp 10.0.0.1:6514",
+	} {
+		network, addr, err := parseSyslogAddress(address)
+		if err != nil {
+			t.Errorf("%q: %v", address, err)
+			continue
+		}
+		if got := network + " " + addr; got != want {
+			t.Errorf("%q: expected %q, got %q", address, want, got)
+		}
+	}
+	if _, _, err := parseSyslogAddress("http://x"); err == nil || !strings.Contains(err.Error(), "unsupported") {
+		t.Errorf("expected unsupported error, got %v", err)
+	}
+}
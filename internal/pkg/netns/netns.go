@@ -0,0 +1,138 @@
+//go:build linux
+
+// The netns package creates Linux network namespaces and runs code and
+// commands inside them (unshare and setns without the ip command), for
+// integration tests, benchmarks and sshtun -selftest moving packets
+// through a tunnel between namespaces. Everything requires
+// CAP_SYS_ADMIN.
+package netns
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// THREAD_NETNS is the network namespace of the calling thread.
+const THREAD_NETNS string = "/proc/thread-self/ns/net"
+
+// NetNS is a network namespace kept alive by an open file descriptor
+// until Close.
+type NetNS struct {
+	file *os.File
+}
+
+// New creates a new network namespace, only containing a loopback
+// interface that is down. The calling thread is not moved into it,
+// see Do.
+func New() (*NetNS, error) {
+	runtime.LockOSThread()
+	origin, err := os.Open(THREAD_NETNS)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return nil, err
+	}
+	defer origin.Close()
+	if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return nil, fmt.Errorf("unshare: %w", err)
+	}
+	file, openErr := os.Open(THREAD_NETNS)
+	if err := setns(origin); err != nil {
+		// Leave the thread locked, it terminates with the goroutine
+		// instead of running others in the wrong namespace.
+		if file != nil {
+			file.Close()
+		}
+		return nil, err
+	}
+	runtime.UnlockOSThread()
+	if openErr != nil {
+		return nil, openErr
+	}
+	return &NetNS{file: file}, nil
+}
+
+// Current returns the network namespace of the calling thread.
+func Current() (*NetNS, error) {
+	file, err := os.Open(THREAD_NETNS)
+	if err != nil {
+		return nil, err
+	}
+	return &NetNS{file: file}, nil
+}
+
+// Do runs fn on a thread in n. Sockets, tun devices and processes
+// created by fn itself belong to n, goroutines started by fn run in
+// the namespace of whatever thread they are scheduled on.
+func (n *NetNS) Do(fn func() error) error {
+	runtime.LockOSThread()
+	origin, err := os.Open(THREAD_NETNS)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer origin.Close()
+	if err := setns(n.file); err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	fnErr := fn()
+	if err := setns(origin); err != nil {
+		// See New.
+		return err
+	}
+	runtime.UnlockOSThread()
+	return fnErr
+}
+
+// Run runs command with args in n, returning an error with the output
+// of the command if it fails.
+func (n *NetNS) Run(command string, args ...string) error {
+	return n.Do(func() error {
+		cmd := exec.Command(command, args...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s %s: %w: %s", command, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	})
+}
+
+// Start starts cmd in n, wait for it with cmd.Wait.
+func (n *NetNS) Start(cmd *exec.Cmd) error {
+	return n.Do(cmd.Start)
+}
+
+// Path returns a path to n usable by other processes, e.g as netns
+// argument to the ip command.
+func (n *NetNS) Path() string {
+	return fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), n.file.Fd())
+}
+
+// ID returns the identity of n as shown by readlink on a ns/net file,
+// e.g net:[4026531840].
+func (n *NetNS) ID() (string, error) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(n.file.Fd()), &st); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("net:[%d]", st.Ino), nil
+}
+
+// Close releases n, the namespace is removed once nothing else (a
+// process or interface) uses it.
+func (n *NetNS) Close() error {
+	return n.file.Close()
+}
+
+func setns(file *os.File) error {
+	if err := unix.Setns(int(file.Fd()), unix.CLONE_NEWNET); err != nil {
+		return fmt.Errorf("setns: %w", err)
+	}
+	return nil
+}
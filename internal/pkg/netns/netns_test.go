@@ -0,0 +1,53 @@
+//go:build linux
+
+package netns
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestNewDo(t *testing.T) {
+	ns, err := New()
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("creating network namespaces is not permitted")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	current, err := Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer current.Close()
+	id, err := ns.ID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentID, err := current.ID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == currentID {
+		t.Fatalf("expected a new namespace, got the current %s", id)
+	}
+	var inside string
+	if err := ns.Do(func() error {
+		inside, err = os.Readlink(THREAD_NETNS)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if inside != id {
+		t.Errorf("expected Do to run in %s, ran in %s", id, inside)
+	}
+	after, err := os.Readlink(THREAD_NETNS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after != currentID {
+		t.Errorf("expected to be back in %s, got %s", currentID, after)
+	}
+}
@@ -0,0 +1,370 @@
+// The policy package applies the routing policy of the ends of a
+// tunnel: a default route through the tunnel on the client end and
+// forwarding and NAT (nftables or iptables) on the server end.
+package policy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/sa6mwa/sshtun/pkg/tun"
+)
+
+const (
+	// PROC_NET_ROUTE is the routing table of the network namespace of
+	// the calling thread, /proc/net is that of the main thread.
+	PROC_NET_ROUTE string = "/proc/thread-self/net/route"
+	IP_FORWARD     string = "/proc/sys/net/ipv4/ip_forward"
+	IP6_FORWARD    string = "/proc/sys/net/ipv6/conf/all/forwarding"
+	IPTABLES       string = "iptables"
+	NFT            string = "nft"
+)
+
+var (
+	ErrNoRoute    error = errors.New("no route to host")
+	ErrNoFirewall error = errors.New("neither nft nor iptables found, required for nat")
+
+	// DefaultRoutes cover every IPv4 address without replacing the
+	// default route (they are more specific).
+	DefaultRoutes = []string{"0.0.0.0/1", "128.0.0.0/1"}
+)
+
+// Route is an IPv4 route from PROC_NET_ROUTE.
+type Route struct {
+	Device  string
+	Network net.IPNet
+	Gateway net.IP
+	Metric  int
+}
+
+// Routes parses the IPv4 routing table in the format of
+// PROC_NET_ROUTE.
+func Routes(r io.Reader) ([]Route, error) {
+	var routes []Route
+	scanner := bufio.NewScanner(r)
+	for first := true; scanner.Scan(); first = false {
+		fields := strings.Fields(scanner.Text())
+		if first || len(fields) < 8 {
+			continue
+		}
+		var hex [3]uint32
+		for i, field := range []string{fields[1], fields[2], fields[7]} {
+			v, err := strconv.ParseUint(field, 16, 32)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", PROC_NET_ROUTE, err)
+			}
+			hex[i] = uint32(v)
+		}
+		metric, err := strconv.Atoi(fields[6])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", PROC_NET_ROUTE, err)
+		}
+		routes = append(routes, Route{
+			Device:  fields[0],
+			Network: net.IPNet{IP: littleEndianIP(hex[0]), Mask: net.IPMask(littleEndianIP(hex[2]))},
+			Gateway: littleEndianIP(hex[1]),
+			Metric:  metric,
+		})
+	}
+	return routes, scanner.Err()
+}
+
+// littleEndianIP returns the IPv4 address v as written in
+// PROC_NET_ROUTE (host byte order on little endian machines).
+func littleEndianIP(v uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.LittleEndian.PutUint32(ip, v)
+	return ip
+}
+
+// Lookup returns the most specific route (lowest metric among equals)
+// to address in routes.
+func Lookup(routes []Route, address net.IP) (Route, error) {
+	best := -1
+	for i, route := range routes {
+		if !route.Network.Contains(address) {
+			continue
+		}
+		if best < 0 {
+			best = i
+			continue
+		}
+		ones, _ := route.Network.Mask.Size()
+		bestOnes, _ := routes[best].Network.Mask.Size()
+		if ones > bestOnes || (ones == bestOnes && route.Metric < routes[best].Metric) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return Route{}, fmt.Errorf("%w %s", ErrNoRoute, address)
+	}
+	return routes[best], nil
+}
+
+// AddedRoute is a route added by DefaultRoute.
+type AddedRoute struct {
+	Device      string `json:"device"`
+	Destination string `json:"destination"`
+	Gateway     string `json:"gateway,omitempty"`
+}
+
+// DefaultRoute routes every IPv4 address through t (see
+// DefaultRoutes), except the address of the ssh peer which keeps its
+// current route so that the tunnel does not carry itself. The host
+// route of the peer is added first, before traffic to it would follow
+// the tunnel. If record is not nil it is called with every route
+// added (not those that already existed) so that routes left behind by
+// a crashed process can be removed with RemoveRoutes, a record error
+// removes the routes again and is returned. The returned func removes
+// the routes again.
+func DefaultRoute(t *tun.TUN, except string, record func(AddedRoute) error) (func(), error) {
+	ip := net.ParseIP(except).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("%w: %q is not an IPv4 address", tun.ErrInvalidAddress, except)
+	}
+	f, err := os.Open(PROC_NET_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	routes, err := Routes(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	current, err := Lookup(routes, ip)
+	if err != nil {
+		return nil, err
+	}
+	host := ip.String() + "/32"
+	gateway := ""
+	if !current.Gateway.IsUnspecified() {
+		gateway = current.Gateway.String()
+	}
+	var undo []func()
+	remove := func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}
+	if record == nil {
+		record = func(AddedRoute) error { return nil }
+	}
+	if err := tun.AddDeviceRoute(current.Device, host, gateway); err != nil && !errors.Is(err, os.ErrExist) {
+		return nil, fmt.Errorf("route %s via %s: %w", host, current.Device, err)
+	} else if err == nil {
+		undo = append(undo, func() { tun.DelDeviceRoute(current.Device, host, gateway) })
+		if err := record(AddedRoute{Device: current.Device, Destination: host, Gateway: gateway}); err != nil {
+			remove()
+			return nil, err
+		}
+	}
+	for _, route := range DefaultRoutes {
+		route := route
+		if err := t.AddRoute(route, ""); err != nil && !errors.Is(err, os.ErrExist) {
+			remove()
+			return nil, fmt.Errorf("route %s: %w", route, err)
+		} else if err == nil {
+			undo = append(undo, func() { t.DelRoute(route, "") })
+			if err := record(AddedRoute{Device: t.Name, Destination: route}); err != nil {
+				remove()
+				return nil, err
+			}
+		}
+	}
+	return remove, nil
+}
+
+// RemoveRoutes removes routes recorded by DefaultRoute, in reverse
+// order. Routes (or devices) that no longer exist are skipped, the
+// routes of a tun device are gone with the device.
+func RemoveRoutes(routes []AddedRoute) error {
+	var errs []error
+	for i := len(routes) - 1; i >= 0; i-- {
+		r := routes[i]
+		err := tun.DelDeviceRoute(r.Device, r.Destination, r.Gateway)
+		if err == nil || errors.Is(err, syscall.ESRCH) || errors.Is(err, syscall.ENODEV) {
+			continue
+		}
+		errs = append(errs, fmt.Errorf("route %s dev %s: %w", r.Destination, r.Device, err))
+	}
+	return errors.Join(errs...)
+}
+
+// EnableForwarding enables IPv4 forwarding between interfaces. It is
+// not disabled again, other services may depend on it.
+func EnableForwarding() error {
+	return os.WriteFile(IP_FORWARD, []byte("1\n"), 0644)
+}
+
+// SetForwarding enables forwarding in the sysctl file pth (IP_FORWARD
+// or IP6_FORWARD) if it is off. Returns the values before and after
+// and a func writing the value before back, which does nothing if
+// forwarding was already enabled.
+func SetForwarding(pth string) (before, after string, restore func() error, err error) {
+	b, err := os.ReadFile(pth)
+	if err != nil {
+		return "", "", nil, err
+	}
+	before = strings.TrimSpace(string(b))
+	if before != "0" {
+		return before, before, func() error { return nil }, nil
+	}
+	if err := os.WriteFile(pth, []byte("1\n"), 0644); err != nil {
+		return before, before, nil, err
+	}
+	return before, "1", func() error {
+		return os.WriteFile(pth, []byte(before+"\n"), 0644)
+	}, nil
+}
+
+// Masquerade enables forwarding and NATs traffic from source (a
+// network with CIDR, e.g the client end of the tunnel) leaving through
+// any device but device, using nftables or iptables (see Firewall).
+// The returned func removes the rule again.
+func Masquerade(source, device string) (func() error, error) {
+	remove, _, err := masquerade(source, device, true)
+	return remove, err
+}
+
+// MasqueradeEgress enables forwarding and NATs traffic from source
+// leaving through egress (e.g the device of the default route, see
+// EgressDevice), using nftables or iptables (see Firewall). Returns
+// the name of the firewall tool used and a func removing exactly the
+// rule added.
+func MasqueradeEgress(source, egress string) (func() error, string, error) {
+	return masquerade(source, egress, false)
+}
+
+// Firewall returns the name and path of the tool NAT rules are
+// added with, NFT if found, otherwise IPTABLES. Returns ErrNoFirewall
+// if neither is in PATH.
+func Firewall() (name, path string, err error) {
+	for _, name := range []string{NFT, IPTABLES} {
+		if path, err := exec.LookPath(name); err == nil {
+			return name, path, nil
+		}
+	}
+	return "", "", ErrNoFirewall
+}
+
+// EgressDevice returns the device of the default route (0.0.0.0/0)
+// with the lowest metric in PROC_NET_ROUTE.
+func EgressDevice() (string, error) {
+	f, err := os.Open(PROC_NET_ROUTE)
+	if err != nil {
+		return "", err
+	}
+	routes, err := Routes(f)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+	return egressDevice(routes)
+}
+
+// egressDevice returns the device of the default route with the
+// lowest metric in routes. DefaultRoutes are not default routes.
+func egressDevice(routes []Route) (string, error) {
+	best := -1
+	for i, route := range routes {
+		if ones, _ := route.Network.Mask.Size(); ones != 0 {
+			continue
+		}
+		if best < 0 || route.Metric < routes[best].Metric {
+			best = i
+		}
+	}
+	if best < 0 {
+		return "", fmt.Errorf("%w: no default route", ErrNoRoute)
+	}
+	return routes[best].Device, nil
+}
+
+// masquerade NATs source leaving through device, or through any
+// device but device if negate is set.
+func masquerade(source, device string, negate bool) (func() error, string, error) {
+	_, network, err := net.ParseCIDR(source)
+	if err != nil {
+		return nil, "", err
+	}
+	if network.IP.To4() == nil {
+		return nil, "", fmt.Errorf("%w: %s is not an IPv4 network", tun.ErrInvalidAddress, source)
+	}
+	name, path, err := Firewall()
+	if err != nil {
+		return nil, "", err
+	}
+	if err := EnableForwarding(); err != nil {
+		return nil, "", err
+	}
+	run := func(stdin string, args ...string) error {
+		cmd := exec.Command(path, args...)
+		if stdin != "" {
+			cmd.Stdin = strings.NewReader(stdin)
+		}
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	if name == NFT {
+		table := nftTable(network.String(), device, negate)
+		if err := run(nftMasqueradeScript(table, network.String(), device, negate), "-f", "-"); err != nil {
+			return nil, "", err
+		}
+		return func() error { return run("", "delete", "table", "ip", table) }, name, nil
+	}
+	rule := iptablesMasqueradeRule(network.String(), device, negate)
+	if err := run("", append([]string{"-t", "nat", "-A"}, rule...)...); err != nil {
+		return nil, "", err
+	}
+	return func() error { return run("", append([]string{"-t", "nat", "-D"}, rule...)...) }, name, nil
+}
+
+// nftTable returns the name of the nftables table holding the
+// masquerade rule of source and device. The rule gets a table of its
+// own so that it is removed without touching other rules, the name is
+// the same every time to replace a table left behind by a crash.
+func nftTable(source, device string, negate bool) string {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s %s %t", source, device, negate)
+	return fmt.Sprintf("sshtun_nat_%08x", h.Sum32())
+}
+
+// nftMasqueradeScript returns the nft -f script (re)creating table
+// with the masquerade rule, atomically.
+func nftMasqueradeScript(table, source, device string, negate bool) string {
+	match := "oifname"
+	if negate {
+		match += " !="
+	}
+	return fmt.Sprintf(`add table ip %[1]s
+delete table ip %[1]s
+table ip %[1]s {
+	chain postrouting {
+		type nat hook postrouting priority 100; policy accept;
+		ip saddr %[2]s %[3]s %[4]q masquerade
+	}
+}
+`, table, source, match, device)
+}
+
+// iptablesMasqueradeRule returns the POSTROUTING rule of the nat table
+// masquerading source.
+func iptablesMasqueradeRule(source, device string, negate bool) []string {
+	rule := []string{"POSTROUTING", "-s", source}
+	if negate {
+		rule = append(rule, "!")
+	}
+	return append(rule, "-o", device, "-j", "MASQUERADE")
+}
@@ -0,0 +1,297 @@
+//go:build linux
+
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sa6mwa/sshtun/internal/pkg/netns"
+	"github.com/sa6mwa/sshtun/pkg/tun"
+)
+
+const procNetRoute = `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	00000000	0100A8C0	0003	0	0	100	00000000	0	0	0
+eth0	0000A8C0	00000000	0001	0	0	100	00FFFFFF	0	0	0
+tun0	000012AC	00000000	0001	0	0	0	00FFFFFF	0	0	0
+wlan0	00000000	0101A8C0	0003	0	0	600	00000000	0	0	0
+`
+
+func TestRoutes(t *testing.T) {
+	routes, err := Routes(strings.NewReader(procNetRoute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 4 {
+		t.Fatalf("expected 4 routes, got %d", len(routes))
+	}
+	if routes[0].Device != "eth0" || !routes[0].Gateway.Equal(net.IPv4(192, 168, 0, 1)) || routes[0].Network.String() != "0.0.0.0/0" || routes[0].Metric != 100 {
+		t.Errorf("unexpected default route %+v", routes[0])
+	}
+	if routes[2].Network.String() != "172.18.0.0/24" {
+		t.Errorf("expected 172.18.0.0/24, got %s", routes[2].Network.String())
+	}
+	for _, c := range []struct {
+		address string
+		device  string
+		gateway string
+	}{
+		{"203.0.113.5", "eth0", "192.168.0.1"},
+		{"192.168.0.20", "eth0", "0.0.0.0"},
+		{"172.18.0.2", "tun0", "0.0.0.0"},
+	} {
+		route, err := Lookup(routes, net.ParseIP(c.address))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if route.Device != c.device || route.Gateway.String() != c.gateway {
+			t.Errorf("%s: expected %s via %s, got %s via %s", c.address, c.device, c.gateway, route.Device, route.Gateway)
+		}
+	}
+	if _, err := Lookup(routes[1:3], net.ParseIP("203.0.113.5")); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("expected %v, got %v", ErrNoRoute, err)
+	}
+	if _, err := Routes(strings.NewReader("Iface\tDestination\neth0 zz 0 0 0 0 0 0\n")); err == nil {
+		t.Error("expected an error from a malformed table")
+	}
+}
+
+func TestDefaultRoute(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("adding routes requires root")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("test requires ip")
+	}
+	ns, err := netns.New()
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ns.Close()
+	routes := func() string {
+		out, _ := exec.Command("ip", "-4", "route", "show").CombinedOutput()
+		return string(out)
+	}
+	var recorded []AddedRoute
+	err = ns.Do(func() error {
+		uplink, err := tun.CreateTUN("uplink0", 0, 0, 0)
+		if err != nil {
+			return err
+		}
+		defer uplink.Close()
+		if err := uplink.ConfigureInterface("10.1.0.1/24"); err != nil {
+			return err
+		}
+		if err := uplink.LinkUp(); err != nil {
+			return err
+		}
+		if err := uplink.AddRoute("0.0.0.0/0", "10.1.0.254"); err != nil {
+			return err
+		}
+		tunnel, err := tun.CreateTUN("tunnel0", 0, 0, 0)
+		if err != nil {
+			return err
+		}
+		if err := tunnel.ConfigureInterface("172.18.0.1/24"); err != nil {
+			return err
+		}
+		if err := tunnel.LinkUp(); err != nil {
+			return err
+		}
+		remove, err := DefaultRoute(tunnel, "198.51.100.7", func(route AddedRoute) error {
+			recorded = append(recorded, route)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		want := []AddedRoute{
+			{Device: "uplink0", Destination: "198.51.100.7/32", Gateway: "10.1.0.254"},
+			{Device: "tunnel0", Destination: "0.0.0.0/1"},
+			{Device: "tunnel0", Destination: "128.0.0.0/1"},
+		}
+		if fmt.Sprint(recorded) != fmt.Sprint(want) {
+			t.Errorf("expected the ssh server route to be added first, recorded %v, expected %v", recorded, want)
+		}
+		for _, route := range []string{"198.51.100.7 via 10.1.0.254 dev uplink0", "0.0.0.0/1 dev tunnel0", "128.0.0.0/1 dev tunnel0"} {
+			if !strings.Contains(routes(), route) {
+				t.Errorf("expected route %q, got:\n%s", route, routes())
+			}
+		}
+		remove()
+		if strings.Contains(routes(), "198.51.100.7") || strings.Contains(routes(), "/1 dev") {
+			t.Errorf("expected the routes to be removed, got:\n%s", routes())
+		}
+
+		// A crash leaves the host route behind, the tun device takes its
+		// routes with it.
+		recorded = nil
+		if _, err := DefaultRoute(tunnel, "198.51.100.7", func(route AddedRoute) error {
+			recorded = append(recorded, route)
+			return nil
+		}); err != nil {
+			return err
+		}
+		tunnel.Close()
+		if !strings.Contains(routes(), "198.51.100.7 via 10.1.0.254") {
+			t.Errorf("expected the host route to remain, got:\n%s", routes())
+		}
+		if err := RemoveRoutes(recorded); err != nil {
+			return err
+		}
+		if strings.Contains(routes(), "198.51.100.7") {
+			t.Errorf("expected RemoveRoutes to remove the host route, got:\n%s", routes())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEgressDevice(t *testing.T) {
+	routes, err := Routes(strings.NewReader(procNetRoute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, half, _ := net.ParseCIDR(DefaultRoutes[0])
+	routes = append(routes, Route{Device: "tun0", Network: *half})
+	if device, err := egressDevice(routes); err != nil || device != "eth0" {
+		t.Errorf("expected eth0 (lowest metric), got %q, %v", device, err)
+	}
+	if _, err := egressDevice(routes[1:3]); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("expected %v without a default route, got %v", ErrNoRoute, err)
+	}
+}
+
+// fakeFirewall puts a script named name first in PATH (and nothing
+// else) that logs its arguments and stdin to the returned file.
+func fakeFirewall(t *testing.T, name string) string {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "log")
+	script := "#!/bin/sh\necho \"$*\" >> " + log + "\nif [ \"$1\" = -f ]; then while read -r line; do echo \"$line\"; done >> " + log + "; fi\n"
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+	return log
+}
+
+func TestFirewall(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	if _, _, err := Firewall(); !errors.Is(err, ErrNoFirewall) {
+		t.Errorf("expected %v, got %v", ErrNoFirewall, err)
+	}
+	fakeFirewall(t, IPTABLES)
+	if name, _, err := Firewall(); err != nil || name != IPTABLES {
+		t.Errorf("expected %s, got %q, %v", IPTABLES, name, err)
+	}
+	fakeFirewall(t, NFT)
+	if name, _, err := Firewall(); err != nil || name != NFT {
+		t.Errorf("expected %s, got %q, %v", NFT, name, err)
+	}
+}
+
+func TestMasquerade(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("enabling forwarding requires root")
+	}
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("test requires /bin/sh")
+	}
+	ns, err := netns.New()
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ns.Close()
+	for _, c := range []struct {
+		firewall string
+		negate   bool
+		add      []string
+		remove   string
+	}{
+		{NFT, false, []string{"-f -", "add table ip sshtun_nat_", `ip saddr 172.18.0.0/24 oifname "eth0" masquerade`}, "delete table ip sshtun_nat_"},
+		{NFT, true, []string{`ip saddr 172.18.0.0/24 oifname != "tun0" masquerade`}, "delete table ip sshtun_nat_"},
+		{IPTABLES, false, []string{"-t nat -A POSTROUTING -s 172.18.0.0/24 -o eth0 -j MASQUERADE"}, "-t nat -D POSTROUTING -s 172.18.0.0/24 -o eth0 -j MASQUERADE"},
+		{IPTABLES, true, []string{"-t nat -A POSTROUTING -s 172.18.0.0/24 ! -o tun0 -j MASQUERADE"}, "-t nat -D POSTROUTING -s 172.18.0.0/24 ! -o tun0 -j MASQUERADE"},
+	} {
+		log := fakeFirewall(t, c.firewall)
+		err := ns.Do(func() error {
+			var remove func() error
+			var err error
+			if c.negate {
+				remove, err = Masquerade("172.18.0.1/24", "tun0")
+			} else {
+				var name string
+				remove, name, err = MasqueradeEgress("172.18.0.1/24", "eth0")
+				if err == nil && name != c.firewall {
+					t.Errorf("expected firewall %s, got %s", c.firewall, name)
+				}
+			}
+			if err != nil {
+				return err
+			}
+			b, _ := os.ReadFile(log)
+			for _, want := range c.add {
+				if !strings.Contains(string(b), want) {
+					t.Errorf("%s: expected %q when adding, got:\n%s", c.firewall, want, b)
+				}
+			}
+			if err := remove(); err != nil {
+				return err
+			}
+			b, _ = os.ReadFile(log)
+			if !strings.Contains(string(b), c.remove) {
+				t.Errorf("%s: expected %q when removing, got:\n%s", c.firewall, c.remove, b)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", c.firewall, err)
+		}
+	}
+	if nftTable("172.18.0.0/24", "eth0", false) != nftTable("172.18.0.0/24", "eth0", false) || nftTable("172.18.0.0/24", "eth0", false) == nftTable("172.18.0.0/24", "eth0", true) {
+		t.Error("expected the same table for the same rule and different tables for different rules")
+	}
+}
+
+func TestSetForwarding(t *testing.T) {
+	pth := filepath.Join(t.TempDir(), "ip_forward")
+	if err := os.WriteFile(pth, []byte("0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before, after, restore, err := SetForwarding(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before != "0" || after != "1" {
+		t.Errorf("expected 0 and 1, got %q and %q", before, after)
+	}
+	if b, _ := os.ReadFile(pth); string(b) != "1\n" {
+		t.Errorf("expected forwarding enabled, got %q", b)
+	}
+	// Already enabled, nothing to restore.
+	if before, after, restoreAgain, err := SetForwarding(pth); err != nil || before != "1" || after != "1" {
+		t.Errorf("expected 1 and 1, got %q, %q, %v", before, after, err)
+	} else if err := restoreAgain(); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(pth); string(b) != "1\n" {
+		t.Errorf("expected restoring an enabled value to do nothing, got %q", b)
+	}
+	if err := restore(); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(pth); string(b) != "0\n" {
+		t.Errorf("expected forwarding restored to 0, got %q", b)
+	}
+	if _, _, _, err := SetForwarding(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected an error for a missing sysctl")
+	}
+}
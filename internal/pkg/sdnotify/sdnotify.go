@@ -0,0 +1,49 @@
+// The sdnotify package implements the client side of the systemd
+// sd_notify protocol without cgo.
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"strings"
+)
+
+const (
+	NOTIFY_SOCKET string = "NOTIFY_SOCKET"
+
+	READY     string = "READY=1"
+	STOPPING  string = "STOPPING=1"
+	RELOADING string = "RELOADING=1"
+	WATCHDOG  string = "WATCHDOG=1"
+)
+
+// Enabled returns true if the NOTIFY_SOCKET environment variable is
+// set, i.e systemd expects notifications (Type=notify).
+func Enabled() bool {
+	return os.Getenv(NOTIFY_SOCKET) != ""
+}
+
+// Notify sends state (one or more newline separated assignments like
+// READY=1 or STATUS=...) to the socket in NOTIFY_SOCKET. Returns
+// false and no error if NOTIFY_SOCKET is not set. Abstract sockets
+// (starting with @) are supported.
+func Notify(state ...string) (bool, error) {
+	socket := os.Getenv(NOTIFY_SOCKET)
+	if socket == "" {
+		return false, nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(strings.Join(state, "\n"))); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Status returns a STATUS= assignment of status for Notify.
+func Status(status string) string {
+	return "STATUS=" + strings.ReplaceAll(status, "\n", " ")
+}
@@ -0,0 +1,34 @@
+package sdnotify
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	t.Setenv(NOTIFY_SOCKET, "")
+	if sent, err := Notify(READY); sent || err != nil {
+		t.Fatalf("expected nothing sent without %s, got %v, %v", NOTIFY_SOCKET, sent, err)
+	}
+	socket := filepath.Join(t.TempDir(), "notify")
+	pc, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	t.Setenv(NOTIFY_SOCKET, socket)
+	if sent, err := Notify(READY, Status("1/2 tunnels up")); !sent || err != nil {
+		t.Fatalf("Notify: %v, %v", sent, err)
+	}
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := pc.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf[:n]), "READY=1\nSTATUS=1/2 tunnels up"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,57 @@
+package sshtun
+
+import (
+	"log/slog"
+)
+
+// SetLogger makes the tunnel log to logger (nothing if nil) from now
+// on, keeping its LogLevel and, if the Tunnels it belongs to has
+// RedactRemotes set, the redaction of remotes.
+func (s *SSHTUN) SetLogger(logger *slog.Logger) {
+	logger = SetLogger(logger)
+	if s.redactor != nil {
+		logger = slog.New(&redactHandler{next: logger.Handler(), r: s.redactor})
+	}
+	if s.logLevel != nil {
+		logger = slog.New(&levelHandler{next: logger.Handler(), level: s.logLevel})
+	}
+	s.setLog(logger)
+}
+
+// log returns the logger of the tunnel, one discarding everything if
+// none has been set. SetLogger may replace it while the tunnel runs.
+func (s *SSHTUN) log() *slog.Logger {
+	if logger := s.logger.Load(); logger != nil {
+		return logger
+	}
+	return discardLogger
+}
+
+// setLog replaces the logger of the tunnel as is.
+func (s *SSHTUN) setLog(logger *slog.Logger) {
+	s.logger.Store(logger)
+}
+
+// SetLogger makes t and every tunnel in it log to logger (nothing if
+// nil) from now on, see SSHTUN.SetLogger. Tunnels added later with Add
+// get the same logger.
+func (t *Tunnels) SetLogger(logger *slog.Logger) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.log = SetLogger(logger)
+	if t.redactor != nil {
+		t.log = slog.New(&redactHandler{next: t.log.Handler(), r: t.redactor})
+	}
+	for _, tunnel := range t.Tunnels {
+		tunnel.SetLogger(logger)
+	}
+}
+
+// logger returns the logger given to t, without the redaction of
+// remotes (added by each tunnel itself).
+func (t *Tunnels) logger() *slog.Logger {
+	if h, ok := SetLogger(t.log).Handler().(*redactHandler); ok {
+		return slog.New(h.next)
+	}
+	return SetLogger(t.log)
+}
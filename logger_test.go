@@ -0,0 +1,131 @@
+//go:build linux
+
+package sshtun
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sa6mwa/sshtun/internal/pkg/handshake"
+	"github.com/sa6mwa/sshtun/pkg/sshtest"
+)
+
+func TestOpenWithoutLogger(t *testing.T) {
+	privateKey, _, err := sshtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, privateKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	hp, err := sshtest.NewHoneyPot(
+		sshtest.WithExec("uname -m", sshtest.ExecResult{Stdout: "x86_64\n"}),
+		sshtest.WithScriptedHandler("/tmp/tunreadwriter-", func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+			// Exit right after the handshake.
+			handshake.New("tun9", 1400, "inet").Write(stdout)
+			return 0
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hp.Close()
+
+	uncompressed := false
+	s := &SSHTUN{
+		Name:                  "literal",
+		Protocol:              "tcp4",
+		LocalNetwork:          "172.18.0.1/24",
+		LocalTunDevice:        "tun0",
+		Remote:                hp.Addr(),
+		RemoteNetwork:         "172.18.0.2/24",
+		RemoteTunDevice:       "tun0",
+		RemoteUser:            "root",
+		PrivateKeyFiles:       PrivateKeyFiles{keyFile},
+		RemoteSCP:             USR_BIN_SCP,
+		RemoteUploadDirectory: DEFAULT_UPLOAD_DIR,
+		CompressUpload:        &uncompressed,
+	}
+	s.localTUN, _ = fakeTUN(t)
+	if err := s.Open(Context(context.Background())); err != nil {
+		t.Errorf("Open returned: %v", err)
+	}
+	if s.log() == nil {
+		t.Error("expected Open to set a logger")
+	}
+}
+
+func TestSetLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	tunnels := &Tunnels{RedactRemotes: true}
+	tunnels.SetLogger(logger)
+	s := &SSHTUN{Name: "added", Remote: "secret.example.com:22"}
+	if err := tunnels.Add(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := tunnels.Add(&SSHTUN{Name: "added"}); err == nil || !strings.Contains(err.Error(), "duplicate name") {
+		t.Errorf("expected duplicate name error, got: %v", err)
+	}
+	if len(tunnels.Tunnels) != 1 {
+		t.Fatalf("expected 1 tunnel, got %d", len(tunnels.Tunnels))
+	}
+	s.log().Info("hello", "remote", s.Remote)
+	if !strings.Contains(buf.String(), "msg=hello") {
+		t.Fatalf("expected the added tunnel to log to the logger of Tunnels, got %q", buf.String())
+	}
+	if strings.Contains(buf.String(), "secret.example.com") {
+		t.Errorf("expected the remote to be redacted once, got %q", buf.String())
+	}
+	if !strings.Contains(buf.String(), redactAddress("secret.example.com:22")) {
+		t.Errorf("expected the remote to be redacted once, got %q", buf.String())
+	}
+
+	buf.Reset()
+	var other bytes.Buffer
+	tunnels.SetLogger(slog.New(slog.NewTextHandler(&other, nil)))
+	s.log().Info("again")
+	if buf.Len() != 0 || !strings.Contains(other.String(), "msg=again") {
+		t.Errorf("expected SetLogger to replace the logger of every tunnel, got %q and %q", buf.String(), other.String())
+	}
+}
+
+func TestSetLoggerConcurrently(t *testing.T) {
+	// Run with -race: the logger of a tunnel and the tunnels of
+	// Tunnels are replaced and added while being used.
+	tunnels := &Tunnels{}
+	s := NewSecureShellTunneler(nil)
+	if err := tunnels.Add(s); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.log().Info("logging")
+			tunnels.Status()
+			tunnels.Up()
+			tunnels.Total()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		tunnels.SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+		added := NewSecureShellTunneler(nil)
+		added.Name = fmt.Sprintf("added%d", i)
+		if err := tunnels.Add(added); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	if tunnels.Total() != 101 {
+		t.Errorf("expected 101 tunnels, got %d", tunnels.Total())
+	}
+}
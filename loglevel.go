@@ -0,0 +1,123 @@
+package sshtun
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+const (
+	// LOG_LEVEL_INHERIT sets the log level of a tunnel back to the
+	// global level at runtime (see SetLogLevel).
+	LOG_LEVEL_INHERIT string = "inherit"
+)
+
+// tunnelLevel is the log level of a single tunnel, the level of the
+// logger it wraps is used unless set.
+type tunnelLevel struct {
+	mutex sync.Mutex
+	set   bool
+	level slog.Level
+}
+
+func (l *tunnelLevel) get() (slog.Level, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.level, l.set
+}
+
+// levelHandler is a slog.Handler passing records of at least the
+// tunnelLevel (if set) to next, regardless of the level of next.
+type levelHandler struct {
+	next  slog.Handler
+	level *tunnelLevel
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if min, ok := h.level.get(); ok {
+		return level >= min
+	}
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.next.Handle(ctx, r)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{next: h.next.WithAttrs(attrs), level: h.level}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{next: h.next.WithGroup(name), level: h.level}
+}
+
+// parseLogLevel parses DEBUG, INFO, WARN or ERROR (any case, see
+// slog.Level.UnmarshalText).
+func parseLogLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(strings.TrimSpace(level)))
+	return l, err
+}
+
+// applyLogLevel makes the logger of the tunnel use LogLevel instead of
+// the level of the logger it was given, if set. The logger is wrapped
+// once, later changes go through SetLogLevel.
+func (s *SSHTUN) applyLogLevel() {
+	if s.logLevel == nil {
+		s.logLevel = &tunnelLevel{}
+		s.setLog(slog.New(&levelHandler{next: s.log().Handler(), level: s.logLevel}))
+	}
+	if level, err := parseLogLevel(s.LogLevel); err == nil && s.LogLevel != "" {
+		s.logLevel.mutex.Lock()
+		s.logLevel.set, s.logLevel.level = true, level
+		s.logLevel.mutex.Unlock()
+	}
+}
+
+// SetLogLevel changes the log level of the tunnel at runtime, level is
+// DEBUG, INFO, WARN, ERROR or LOG_LEVEL_INHERIT (or empty) for the
+// global level.
+func (s *SSHTUN) SetLogLevel(level string) error {
+	if level == LOG_LEVEL_INHERIT {
+		level = ""
+	}
+	var l slog.Level
+	if level != "" {
+		var err error
+		if l, err = parseLogLevel(level); err != nil {
+			return err
+		}
+	}
+	if s.logLevel == nil {
+		s.applyLogLevel()
+	}
+	s.logLevel.mutex.Lock()
+	s.logLevel.set, s.logLevel.level = level != "", l
+	s.LogLevel = strings.ToUpper(level)
+	s.logLevel.mutex.Unlock()
+	return nil
+}
+
+// applyLogLevels calls applyLogLevel on every tunnel, with t.mutex held
+// once t is shared.
+func (t *Tunnels) applyLogLevels() {
+	for _, tunnel := range t.Tunnels {
+		tunnel.applyLogLevel()
+	}
+}
+
+// SetLogLevel sets the log level of the tunnel named name, see
+// SSHTUN.SetLogLevel.
+func (t *Tunnels) SetLogLevel(name, level string) error {
+	tunnel, err := t.Lookup(name)
+	if err != nil {
+		return err
+	}
+	if err := tunnel.SetLogLevel(level); err != nil {
+		return err
+	}
+	t.log.Info("Changed log level", "name", name, "level", level)
+	return nil
+}
@@ -0,0 +1,45 @@
+package sshtun
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLogLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	noisy, troubleshoot := NewSecureShellTunneler(logger), NewSecureShellTunneler(logger)
+	noisy.Name, noisy.LogLevel = "noisy", "warn"
+	troubleshoot.Name, troubleshoot.LogLevel = "troubleshoot", "DEBUG"
+	tunnels := &Tunnels{Tunnels: []*SSHTUN{noisy, troubleshoot}}
+	tunnels.log = logger
+	tunnels.applyLogLevels()
+	tunnels.applyLogLevels()
+	noisy.log().Info("noisy info")
+	troubleshoot.log().Debug("troubleshoot debug")
+	if strings.Contains(buf.String(), "noisy info") || !strings.Contains(buf.String(), "troubleshoot debug") {
+		t.Errorf("unexpected log %q", buf.String())
+	}
+
+	buf.Reset()
+	if err := tunnels.Control("level", "noisy", "debug"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tunnels.Control("level", "troubleshoot", LOG_LEVEL_INHERIT); err != nil {
+		t.Fatal(err)
+	}
+	noisy.log().Debug("noisy debug")
+	troubleshoot.log().Debug("troubleshoot debug")
+	troubleshoot.log().Info("troubleshoot info")
+	if !strings.Contains(buf.String(), "noisy debug") || strings.Contains(buf.String(), "troubleshoot debug") || !strings.Contains(buf.String(), "troubleshoot info") {
+		t.Errorf("unexpected log after changing levels %q", buf.String())
+	}
+	if err := tunnels.Control("level", "noisy", "LOUD"); err == nil {
+		t.Error("expected an error for an invalid level")
+	}
+	if err := tunnels.Control("level", "noisy"); err == nil {
+		t.Error("expected an error for a missing level")
+	}
+}
@@ -0,0 +1,61 @@
+package sshtun
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// memfdLoader is run by python3 on the remote with the size of the
+// helper followed by the helper arguments. It reads exactly size
+// bytes from stdin into a memfd and executes it with fexecve, leaving
+// the rest of stdin to the helper. Nothing is written to the remote
+// file system.
+const memfdLoader = `import os,sys
+n=int(sys.argv[1])
+fd=os.memfd_create("tunreadwriter",os.MFD_CLOEXEC)
+while n>0:
+	b=os.read(0,min(n,65536))
+	if not b:
+		sys.exit("tunreadwriter loader: short read")
+	n-=len(b)
+	while b:
+		b=b[os.write(fd,b):]
+os.execve(fd,["tunreadwriter"]+sys.argv[2:],dict(os.environ))
+`
+
+// prepareMemfd checks that the remote can run the helper from memory
+// (python3 with os.memfd_create, Linux 3.17 or later) and selects the
+// embedded helper for the remote architecture. Returns an error if
+// not, the caller falls back to uploading the helper. Unless
+// MemfdSudoPython is set, memfd is also refused when python3 would be
+// run through sudo, as that requires sudoers to allow python3.
+func (s *SSHTUN) prepareMemfd(client *ssh.Client) error {
+	if sudo := s.sudoCommand(); len(sudo) > 0 && !s.MemfdSudoPython {
+		return fmt.Errorf("python3 would run through %s, set memfd_sudo_python to allow it", strings.Join(sudo, " "))
+	}
+	helper, err := remoteHelper(client)
+	if err != nil {
+		return err
+	}
+	out, err := sshoutput(client, `command -v python3 && python3 -c 'import os; os.memfd_create("probe", os.MFD_CLOEXEC)'`)
+	if err != nil {
+		return fmt.Errorf("python3 with os.memfd_create not available: %w", err)
+	}
+	interpreter := strings.TrimSpace(out)
+	if !strings.HasPrefix(interpreter, "/") {
+		return fmt.Errorf("python3 is not an executable file: %q", interpreter)
+	}
+	s.remoteInterpreter = interpreter
+	s.memfdHelper = helper
+	s.remoteTunReadWriter = "memfd:tunreadwriter"
+	return nil
+}
+
+// memfdCommand returns the loader part of the command line, the
+// interpreter, loader and helper size.
+func (s *SSHTUN) memfdCommand() []string {
+	return []string{s.remoteInterpreter, "-c", memfdLoader, strconv.Itoa(len(s.memfdHelper.Binary))}
+}
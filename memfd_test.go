@@ -0,0 +1,63 @@
+package sshtun
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/alessio/shellescape"
+)
+
+func TestMemfdLoader(t *testing.T) {
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip(err)
+	}
+	cat, err := exec.LookPath("cat")
+	if err != nil {
+		t.Skip(err)
+	}
+	binary, err := os.ReadFile(cat)
+	if err != nil {
+		t.Skip(err)
+	}
+	// The loader must consume exactly the binary and leave the rest
+	// of stdin to the executed program.
+	cmd := exec.Command(python, "-c", memfdLoader, strconv.Itoa(len(binary)))
+	cmd.Stdin = bytes.NewReader(append(binary, []byte("rest of stdin")...))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Skipf("memfd not supported here: %v: %s", err, out)
+	}
+	if string(out) != "rest of stdin" {
+		t.Errorf("expected the rest of stdin, got %q", out)
+	}
+}
+
+func TestMemfdCommand(t *testing.T) {
+	s := NewSecureShellTunneler(nil)
+	s.RemoteUser = "abc123"
+	s.remoteInterpreter = "/usr/bin/python3"
+	s.memfdHelper = &Helper{Arch: "amd64", Binary: []byte("12345")}
+	want := "sudo -n /usr/bin/python3 -c " + shellescape.Quote(memfdLoader) + " 5 -handshake -dev tun0 -net 172.18.0.2/24 -mtu 0"
+	if got := s.tunReadWriterCommand(); got != want {
+		t.Errorf("got %q, expected %q", got, want)
+	}
+	if s.remoteExecutable() != "/usr/bin/python3" {
+		t.Errorf("expected python3 to be checked with sudo -l, got %s", s.remoteExecutable())
+	}
+}
+
+func TestMemfdRequiresSudoPython(t *testing.T) {
+	s := NewSecureShellTunneler(nil)
+	s.RemoteUser = "abc123"
+	if err := s.prepareMemfd(nil); err == nil || !strings.Contains(err.Error(), "memfd_sudo_python") {
+		t.Errorf("expected memfd to be refused through sudo, got: %v", err)
+	}
+	if s.memfdHelper != nil {
+		t.Error("expected no memfd helper")
+	}
+}
@@ -0,0 +1,65 @@
+package sshtun
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+)
+
+// lookupOwner resolves a user name or numeric uid to the uid and, for
+// a name, its primary group (-1 for a numeric uid).
+func lookupOwner(owner string) (uid, gid int, err error) {
+	if uid, err := strconv.Atoi(owner); err == nil {
+		if uid < 0 {
+			return 0, 0, fmt.Errorf("uid %d is negative", uid)
+		}
+		return uid, -1, nil
+	}
+	usr, err := user.Lookup(owner)
+	if err != nil {
+		return 0, 0, err
+	}
+	if uid, err = strconv.Atoi(usr.Uid); err != nil {
+		return 0, 0, err
+	}
+	if gid, err = strconv.Atoi(usr.Gid); err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
+
+// lookupGroup resolves a group name or numeric gid to the gid.
+func lookupGroup(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		if gid < 0 {
+			return 0, fmt.Errorf("gid %d is negative", gid)
+		}
+		return gid, nil
+	}
+	grp, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(grp.Gid)
+}
+
+// localTunOwner resolves LocalTunOwner and LocalTunGroup to the uid
+// and gid passed to tun.CreateTUN, 0 if not set. Like -user of
+// tunreadwriter, a named owner also sets the group to its primary
+// group unless LocalTunGroup is set.
+func (s *SSHTUN) localTunOwner() (uid, gid int, err error) {
+	if s.LocalTunOwner != "" {
+		if uid, gid, err = lookupOwner(s.LocalTunOwner); err != nil {
+			return 0, 0, fmt.Errorf("local_tun_owner: %w", err)
+		}
+		if gid < 0 {
+			gid = 0
+		}
+	}
+	if s.LocalTunGroup != "" {
+		if gid, err = lookupGroup(s.LocalTunGroup); err != nil {
+			return 0, 0, fmt.Errorf("local_tun_group: %w", err)
+		}
+	}
+	return uid, gid, nil
+}
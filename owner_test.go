@@ -0,0 +1,43 @@
+package sshtun
+
+import (
+	"os/user"
+	"strconv"
+	"testing"
+)
+
+func TestLocalTunOwner(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	uid, _ := strconv.Atoi(current.Uid)
+	gid, _ := strconv.Atoi(current.Gid)
+	group, err := user.LookupGroupId(current.Gid)
+	if err != nil {
+		t.Skip(err)
+	}
+	cases := []struct {
+		owner, group string
+		uid, gid     int
+	}{
+		{"", "", 0, 0},
+		{"1234", "", 1234, 0},
+		{"", "4321", 0, 4321},
+		{current.Username, "", uid, gid},
+		{current.Username, "4321", uid, 4321},
+		{"1234", group.Name, 1234, gid},
+	}
+	for _, c := range cases {
+		s := NewSecureShellTunneler(nil)
+		s.LocalTunOwner, s.LocalTunGroup = c.owner, c.group
+		gotUID, gotGID, err := s.localTunOwner()
+		if err != nil {
+			t.Errorf("owner %q group %q: %v", c.owner, c.group, err)
+			continue
+		}
+		if gotUID != c.uid || gotGID != c.gid {
+			t.Errorf("owner %q group %q: expected %d:%d, got %d:%d", c.owner, c.group, c.uid, c.gid, gotUID, gotGID)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package sshtest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// scpSink matches an scp sink command (scp -t directory) as run by
+// sshtun, submatch 1 is the (possibly single quoted) directory.
+var scpSink = regexp.MustCompile(`^(?:\S*/)?scp -t (.+)$`)
+
+// File is a file received by the scp sink of the HoneyPot.
+type File struct {
+	Path string
+	Mode os.FileMode
+	Data []byte
+}
+
+// ExecResult is the canned response to an exec request, see WithExec.
+type ExecResult struct {
+	ExitStatus int
+	Stdout     string
+	Stderr     string
+}
+
+// WithExec makes the HoneyPot answer exec requests for commands
+// starting with prefix with result (after reading stdin) instead of
+// the default handling. The first matching prefix of WithExec and
+// WithScriptedHandler wins.
+func WithExec(prefix string, result ExecResult) Option {
+	return WithScriptedHandler(prefix, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		io.Copy(io.Discard, stdin)
+		io.WriteString(stdout, result.Stdout)
+		io.WriteString(stderr, result.Stderr)
+		return result.ExitStatus
+	})
+}
+
+// Commands returns every command requested with exec so far.
+func (h *HoneyPot) Commands() []string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]string(nil), h.commands...)
+}
+
+// Files returns every file received by the scp sink so far.
+func (h *HoneyPot) Files() []File {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]File(nil), h.files...)
+}
+
+// session serves a session channel, only exec requests are accepted.
+func (h *HoneyPot) session(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+		var payload struct{ Command string }
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+		h.mutex.Lock()
+		h.commands = append(h.commands, payload.Command)
+		h.mutex.Unlock()
+		status := h.record(payload.Command, channel, channel, channel.Stderr())
+		channel.CloseWrite()
+		exitStatus := make([]byte, 4)
+		binary.BigEndian.PutUint32(exitStatus, uint32(status))
+		channel.SendRequest("exit-status", false, exitStatus)
+		return
+	}
+}
+
+// exec runs command and returns its exit status: a scripted handler
+// (WithScriptedHandler or WithExec), the scp sink or exit status 0
+// without output.
+func (h *HoneyPot) exec(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+	for _, handler := range h.handlers {
+		if strings.HasPrefix(command, handler.prefix) {
+			return handler.handler(command, stdin, stdout, stderr)
+		}
+	}
+	if m := scpSink.FindStringSubmatch(command); m != nil {
+		return h.scpSink(strings.Trim(m[1], "'"), stdin, stdout, stderr)
+	}
+	io.Copy(io.Discard, stdin)
+	return 0
+}
+
+// scpSink speaks the sink side of the scp protocol for regular files
+// (C lines) into directory, acknowledging with zero bytes, and keeps
+// the files received.
+func (h *HoneyPot) scpSink(directory string, stdin io.Reader, stdout, stderr io.Writer) int {
+	in := bufio.NewReader(stdin)
+	stdout.Write([]byte{0})
+	for {
+		header, err := in.ReadString('\n')
+		if err == io.EOF && header == "" {
+			return 0
+		} else if err != nil {
+			fmt.Fprintf(stderr, "scp: %v\n", err)
+			return 1
+		}
+		fields := strings.SplitN(strings.TrimSuffix(header, "\n"), " ", 3)
+		if len(fields) != 3 || !strings.HasPrefix(fields[0], "C") {
+			fmt.Fprintf(stderr, "scp: protocol error: unexpected %q\n", header)
+			return 1
+		}
+		mode, err := strconv.ParseUint(fields[0][1:], 8, 32)
+		if err != nil {
+			fmt.Fprintf(stderr, "scp: protocol error: bad mode %q\n", fields[0][1:])
+			return 1
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || size < 0 {
+			fmt.Fprintf(stderr, "scp: protocol error: bad size %q\n", fields[1])
+			return 1
+		}
+		stdout.Write([]byte{0})
+		data := make([]byte, size)
+		if _, err := io.ReadFull(in, data); err != nil {
+			fmt.Fprintf(stderr, "scp: %v\n", err)
+			return 1
+		}
+		if b, err := in.ReadByte(); err != nil || b != 0 {
+			fmt.Fprintln(stderr, "scp: protocol error: missing trailing NUL")
+			return 1
+		}
+		h.mutex.Lock()
+		h.files = append(h.files, File{Path: path.Join(directory, fields[2]), Mode: os.FileMode(mode), Data: data})
+		h.mutex.Unlock()
+		stdout.Write([]byte{0})
+	}
+}
@@ -0,0 +1,161 @@
+package sshtest
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// TCPIP_FORWARD_REQUEST is the global request of ssh -R.
+	TCPIP_FORWARD_REQUEST string = "tcpip-forward"
+	// CANCEL_TCPIP_FORWARD_REQUEST stops a TCPIP_FORWARD_REQUEST.
+	CANCEL_TCPIP_FORWARD_REQUEST string = "cancel-tcpip-forward"
+)
+
+// WithPortForwarding makes the HoneyPot forward ports like an sshd
+// with AllowTcpForwarding yes: direct-tcpip channels (ssh -L) are
+// connected to their target and tcpip-forward requests (ssh -R) listen
+// on the host of the HoneyPot, both counted by Requests. Port
+// forwarding is refused otherwise.
+func WithPortForwarding() Option {
+	return func(h *HoneyPot) {
+		h.forwarding = true
+	}
+}
+
+// forwardRequest is the payload of TCPIP_FORWARD_REQUEST and
+// CANCEL_TCPIP_FORWARD_REQUEST.
+type forwardRequest struct {
+	Address string
+	Port    uint32
+}
+
+// forwardedChannel is the extra data of forwarded-tcpip and
+// direct-tcpip channels.
+type forwardedChannel struct {
+	Address           string
+	Port              uint32
+	OriginatorAddress string
+	OriginatorPort    uint32
+}
+
+// forwards are the listeners of the tcpip-forward requests of a
+// connection by address.
+type forwards struct {
+	mutex     sync.Mutex
+	listeners map[string]net.Listener
+}
+
+// close stops every listener.
+func (f *forwards) close() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for address, listener := range f.listeners {
+		listener.Close()
+		delete(f.listeners, address)
+	}
+}
+
+// directTCPIP connects a direct-tcpip channel to its target.
+func (h *HoneyPot) directTCPIP(newChannel ssh.NewChannel) {
+	var target forwardedChannel
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &target); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "bad direct-tcpip payload")
+		return
+	}
+	h.mutex.Lock()
+	h.requestCounts["direct-tcpip"]++
+	h.mutex.Unlock()
+	conn, err := net.Dial("tcp", net.JoinHostPort(target.Address, strconv.Itoa(int(target.Port))))
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	pipe(channel, conn)
+}
+
+// tcpipForward answers a tcpip-forward or cancel-tcpip-forward request
+// of sconn.
+func (h *HoneyPot) tcpipForward(sconn *ssh.ServerConn, f *forwards, req *ssh.Request) {
+	var payload forwardRequest
+	if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+		req.Reply(false, nil)
+		return
+	}
+	address := net.JoinHostPort(payload.Address, strconv.Itoa(int(payload.Port)))
+	if req.Type == CANCEL_TCPIP_FORWARD_REQUEST {
+		f.mutex.Lock()
+		listener, ok := f.listeners[address]
+		delete(f.listeners, address)
+		f.mutex.Unlock()
+		if ok {
+			listener.Close()
+		}
+		req.Reply(ok, nil)
+		return
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		req.Reply(false, nil)
+		return
+	}
+	port := uint32(listener.Addr().(*net.TCPAddr).Port)
+	f.mutex.Lock()
+	f.listeners[net.JoinHostPort(payload.Address, strconv.Itoa(int(port)))] = listener
+	f.mutex.Unlock()
+	var reply []byte
+	if payload.Port == 0 {
+		reply = ssh.Marshal(struct{ Port uint32 }{port})
+	}
+	req.Reply(true, reply)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				origin := conn.RemoteAddr().(*net.TCPAddr)
+				channel, requests, err := sconn.OpenChannel("forwarded-tcpip", ssh.Marshal(forwardedChannel{
+					Address:           payload.Address,
+					Port:              port,
+					OriginatorAddress: origin.IP.String(),
+					OriginatorPort:    uint32(origin.Port),
+				}))
+				if err != nil {
+					conn.Close()
+					return
+				}
+				go ssh.DiscardRequests(requests)
+				pipe(channel, conn)
+			}()
+		}
+	}()
+}
+
+// pipe copies between channel and conn until either side is done,
+// then closes both.
+func pipe(channel ssh.Channel, conn net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(channel, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, channel)
+		done <- struct{}{}
+	}()
+	<-done
+	channel.Close()
+	conn.Close()
+}
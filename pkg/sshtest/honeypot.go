@@ -0,0 +1,348 @@
+// The sshtest package provides an in-process SSH server (HoneyPot) for
+// testing SSH clients without a real sshd.
+package sshtest
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// DEFAULT_CLOSE_TIMEOUT is how long Close waits for active sessions
+	// to finish, see WithCloseTimeout.
+	DEFAULT_CLOSE_TIMEOUT time.Duration = 5 * time.Second
+	// DEFAULT_LISTEN_ADDRESS is a random port on localhost.
+	DEFAULT_LISTEN_ADDRESS string = "127.0.0.1:0"
+)
+
+var (
+	ErrClosed          error = errors.New("honeypot is closed")
+	ErrCloseTimeout    error = errors.New("sessions still active when closing, closed forcibly")
+	ErrUnauthorizedKey error = errors.New("public key is not authorized")
+)
+
+// HoneyPot is an SSH server on a random port on localhost accepting
+// any user with any password or public key (see WithAuthorizedKeys).
+// Session channels accept exec requests, which are recorded (see
+// Commands and Sessions) and answered by a ScriptedHandler, a canned
+// response (see WithExec), an scp sink (see Files) or exit status 0.
+// Global requests (e.g keepalive@openssh.com) are counted (see
+// Requests) and answered with false unless there is a RequestHandler.
+// Port forwarding is refused unless WithPortForwarding.
+// BlackHole makes every connection stop responding to simulate a dead
+// network path.
+type HoneyPot struct {
+	listener        net.Listener
+	config          *ssh.ServerConfig
+	hostKey         ssh.Signer
+	closeTimeout    time.Duration
+	listenAddress   string
+	active          int
+	idle            chan struct{}
+	authorizedKeys  [][]byte
+	handlers        []scriptedHandler
+	commands        []string
+	files           []File
+	sessions        []Session
+	requestHandlers map[string]RequestHandler
+	requestCounts   map[string]int
+	forwarding      bool
+	mutex           sync.Mutex
+	conns           map[*blackHoleConn]struct{}
+	blackHole       chan struct{}
+	wg              sync.WaitGroup
+	closed          bool
+}
+
+// Option configures a HoneyPot, see NewHoneyPot.
+type Option func(h *HoneyPot)
+
+// WithAuthorizedKeys makes the HoneyPot accept only keys for public
+// key authentication instead of any key. Passwords are still
+// accepted.
+func WithAuthorizedKeys(keys ...ssh.PublicKey) Option {
+	return func(h *HoneyPot) {
+		for _, key := range keys {
+			h.authorizedKeys = append(h.authorizedKeys, key.Marshal())
+		}
+	}
+}
+
+// WithCloseTimeout makes Close wait at most timeout for active
+// sessions instead of DEFAULT_CLOSE_TIMEOUT, 0 closes them at once.
+func WithCloseTimeout(timeout time.Duration) Option {
+	return func(h *HoneyPot) {
+		h.closeTimeout = timeout
+	}
+}
+
+// WithListenAddress makes the HoneyPot listen on address (host:port,
+// port 0 for a random port) instead of DEFAULT_LISTEN_ADDRESS.
+func WithListenAddress(address string) Option {
+	return func(h *HoneyPot) {
+		h.listenAddress = address
+	}
+}
+
+// NewHoneyPot starts a HoneyPot with an ephemeral ed25519 host key
+// (see WithHostKey) listening on a random port on 127.0.0.1 (see
+// WithListenAddress and Addr). Stop it with Close.
+func NewHoneyPot(options ...Option) (*HoneyPot, error) {
+	h := &HoneyPot{
+		closeTimeout:    DEFAULT_CLOSE_TIMEOUT,
+		listenAddress:   DEFAULT_LISTEN_ADDRESS,
+		conns:           make(map[*blackHoleConn]struct{}),
+		requestHandlers: make(map[string]RequestHandler),
+		requestCounts:   make(map[string]int),
+	}
+	for _, option := range options {
+		option(h)
+	}
+	if h.hostKey == nil {
+		key, err := GenerateHostKey()
+		if err != nil {
+			return nil, err
+		}
+		h.hostKey = key.Signer
+	}
+	h.config = &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+		PublicKeyCallback: h.publicKey,
+	}
+	h.config.AddHostKey(h.hostKey)
+	var err error
+	if h.listener, err = net.Listen("tcp", h.listenAddress); err != nil {
+		return nil, err
+	}
+	h.wg.Add(1)
+	go h.serve()
+	return h, nil
+}
+
+// publicKey accepts any key unless WithAuthorizedKeys was given.
+func (h *HoneyPot) publicKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if h.authorizedKeys == nil {
+		return nil, nil
+	}
+	for _, authorized := range h.authorizedKeys {
+		if bytes.Equal(authorized, key.Marshal()) {
+			return nil, nil
+		}
+	}
+	return nil, ErrUnauthorizedKey
+}
+
+// GenerateKey returns a new ed25519 private key as an OpenSSH PEM
+// (e.g for PrivateKeyFiles) and its public key (e.g for
+// WithAuthorizedKeys).
+func GenerateKey() ([]byte, ssh.PublicKey, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(private, "sshtest")
+	if err != nil {
+		return nil, nil, err
+	}
+	sshPublic, err := ssh.NewPublicKey(public)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(block), sshPublic, nil
+}
+
+// ListenAndServeOnRandomPort is NewHoneyPot also returning the
+// host:port it listens on, a random port (on 127.0.0.1 unless
+// WithListenAddress) so that parallel tests never collide.
+func ListenAndServeOnRandomPort(options ...Option) (*HoneyPot, string, error) {
+	h, err := NewHoneyPot(options...)
+	if err != nil {
+		return nil, "", err
+	}
+	return h, h.Addr(), nil
+}
+
+// Addr returns the host:port the HoneyPot listens on.
+func (h *HoneyPot) Addr() string {
+	return h.listener.Addr().String()
+}
+
+// ClientConfig returns an ssh.ClientConfig for user authenticating
+// with a password and accepting any host key.
+func (h *HoneyPot) ClientConfig(user string) *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.Password("honeypot")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+}
+
+// BlackHole makes every current and future connection stop
+// responding, data sent by the client is read but never answered,
+// like a TCP connection over a dropped wifi or expired NAT mapping.
+// Undo with Restore.
+func (h *HoneyPot) BlackHole() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.blackHole == nil {
+		h.blackHole = make(chan struct{})
+	}
+}
+
+// Restore makes black holed connections respond again, data held
+// back while black holed is delivered late.
+func (h *HoneyPot) Restore() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.blackHole != nil {
+		close(h.blackHole)
+		h.blackHole = nil
+	}
+}
+
+// blocked returns a channel closed by Restore if black holed, else
+// nil.
+func (h *HoneyPot) blocked() chan struct{} {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.blackHole
+}
+
+// Close stops listening, waits for active sessions to finish (see
+// WithCloseTimeout), closes all connections and waits for them.
+// Returns ErrCloseTimeout if sessions had to be closed forcibly.
+func (h *HoneyPot) Close() error {
+	h.mutex.Lock()
+	if h.closed {
+		h.mutex.Unlock()
+		return ErrClosed
+	}
+	h.closed = true
+	err := h.listener.Close()
+	if h.blackHole != nil {
+		close(h.blackHole)
+		h.blackHole = nil
+	}
+	idle := h.idle
+	h.mutex.Unlock()
+	if idle != nil {
+		timer := time.NewTimer(h.closeTimeout)
+		select {
+		case <-idle:
+		case <-timer.C:
+			if err == nil {
+				err = ErrCloseTimeout
+			}
+		}
+		timer.Stop()
+	}
+	h.mutex.Lock()
+	for conn := range h.conns {
+		conn.Close()
+	}
+	h.mutex.Unlock()
+	h.wg.Wait()
+	return err
+}
+
+// track counts a session as active until the returned func is
+// called, see Close.
+func (h *HoneyPot) track() func() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.active == 0 {
+		h.idle = make(chan struct{})
+	}
+	h.active++
+	return func() {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		h.active--
+		if h.active == 0 {
+			close(h.idle)
+			h.idle = nil
+		}
+	}
+}
+
+func (h *HoneyPot) serve() {
+	defer h.wg.Done()
+	for {
+		c, err := h.listener.Accept()
+		if err != nil {
+			return
+		}
+		conn := &blackHoleConn{Conn: c, h: h}
+		h.mutex.Lock()
+		if h.closed {
+			h.mutex.Unlock()
+			c.Close()
+			return
+		}
+		h.conns[conn] = struct{}{}
+		h.wg.Add(1)
+		h.mutex.Unlock()
+		go h.handle(conn)
+	}
+}
+
+func (h *HoneyPot) handle(conn *blackHoleConn) {
+	defer h.wg.Done()
+	defer func() {
+		h.mutex.Lock()
+		delete(h.conns, conn)
+		h.mutex.Unlock()
+		conn.Close()
+	}()
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, h.config)
+	if err != nil {
+		return
+	}
+	defer sconn.Close()
+	f := &forwards{listeners: make(map[string]net.Listener)}
+	defer f.close()
+	go h.requests(sconn, f, reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() == "direct-tcpip" && h.forwarding {
+			go h.directTCPIP(newChannel)
+			continue
+		}
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "honeypot only accepts session channels")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		done := h.track()
+		go func() {
+			defer done()
+			h.session(channel, requests)
+		}()
+	}
+}
+
+// blackHoleConn holds back everything the server writes while the
+// HoneyPot is black holed.
+type blackHoleConn struct {
+	net.Conn
+	h *HoneyPot
+}
+
+func (c *blackHoleConn) Write(b []byte) (int, error) {
+	if blocked := c.h.blocked(); blocked != nil {
+		<-blocked
+	}
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,119 @@
+package sshtest
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestHostKey(t *testing.T) {
+	key, err := GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hp, addr, err := ListenAndServeOnRandomPort(WithHostKey(key.Signer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hp.Close()
+	if hp.KnownHosts() != key.KnownHosts(addr) {
+		t.Errorf("expected %q, got %q", key.KnownHosts(addr), hp.KnownHosts())
+	}
+	if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key.AuthorizedKey())); err != nil {
+		t.Errorf("unable to parse %q: %v", key.AuthorizedKey(), err)
+	}
+
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(file, []byte(hp.KnownHosts()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	callback, err := knownhosts.New(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := hp.ClientConfig("test")
+	config.HostKeyCallback = callback
+	client, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		t.Fatalf("expected the host key to be known: %v", err)
+	}
+	client.Close()
+
+	other, err := NewHoneyPot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if _, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{User: "test", Auth: config.Auth, HostKeyCallback: ssh.FixedHostKey(other.HostKey())}); err == nil {
+		t.Error("expected a mismatching host key to be rejected")
+	}
+}
+
+func TestCloseTimeout(t *testing.T) {
+	hp, err := NewHoneyPot(WithCloseTimeout(50*time.Millisecond), WithScriptedHandler("wait", func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		io.Copy(io.Discard, stdin)
+		return 0
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := ssh.Dial("tcp", hp.Addr(), hp.ClientConfig("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Start("wait"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Finishing within the timeout is waited for.
+	closed := make(chan error, 1)
+	go func() {
+		closed <- hp.Close()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	stdin.Close()
+	if err := <-closed; err != nil {
+		t.Errorf("expected a clean close, got: %v", err)
+	}
+	if err := session.Wait(); err != nil {
+		t.Errorf("expected the session to exit 0, got: %v", err)
+	}
+
+	hp, err = NewHoneyPot(WithCloseTimeout(50 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err = ssh.Dial("tcp", hp.Addr(), hp.ClientConfig("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	session, err = client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.StdinPipe(); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Start("cat"); err != nil {
+		t.Fatal(err)
+	}
+	if err := hp.Close(); !errors.Is(err, ErrCloseTimeout) {
+		t.Errorf("expected %v, got: %v", ErrCloseTimeout, err)
+	}
+}
@@ -0,0 +1,65 @@
+package sshtest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKey is a host key for WithHostKey with its public key in the
+// formats of authorized_keys and known_hosts files.
+type HostKey struct {
+	Signer ssh.Signer
+}
+
+// GenerateHostKey returns a new ed25519 HostKey.
+func GenerateHostKey() (HostKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return HostKey{}, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return HostKey{}, err
+	}
+	return HostKey{Signer: signer}, nil
+}
+
+// PublicKey returns the public key of k.
+func (k HostKey) PublicKey() ssh.PublicKey {
+	return k.Signer.PublicKey()
+}
+
+// AuthorizedKey returns the public key in authorized_keys format
+// without trailing newline, e.g ssh-ed25519 AAAA...
+func (k HostKey) AuthorizedKey() string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(k.PublicKey())))
+}
+
+// KnownHosts returns a known_hosts line for addresses (host or
+// host:port, e.g HoneyPot.Addr) without trailing newline.
+func (k HostKey) KnownHosts(addresses ...string) string {
+	return knownhosts.Line(addresses, k.PublicKey())
+}
+
+// WithHostKey makes the HoneyPot present key instead of an ephemeral
+// ed25519 host key.
+func WithHostKey(key ssh.Signer) Option {
+	return func(h *HoneyPot) {
+		h.hostKey = key
+	}
+}
+
+// HostKey returns the public host key presented by the HoneyPot.
+func (h *HoneyPot) HostKey() ssh.PublicKey {
+	return h.hostKey.PublicKey()
+}
+
+// KnownHosts returns a known_hosts line for the address of the
+// HoneyPot (see Addr) without trailing newline.
+func (h *HoneyPot) KnownHosts() string {
+	return knownhosts.Line([]string{h.Addr()}, h.HostKey())
+}
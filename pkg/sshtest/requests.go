@@ -0,0 +1,94 @@
+package sshtest
+
+import (
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// KEEPALIVE_REQUEST is the global request sent by ssh clients
+	// (ServerAliveInterval) and sshtun to check the server is alive.
+	KEEPALIVE_REQUEST string = "keepalive@openssh.com"
+)
+
+// RequestHandler answers a global request, count is the number of
+// requests of the same type received so far including req. A handler
+// not replying to a request wanting a reply leaves the client waiting,
+// replies are matched to requests in order so later replies are
+// matched to the unanswered request.
+type RequestHandler func(count int, req *ssh.Request)
+
+// WithRequestHandler makes the HoneyPot answer global requests of
+// requestType (e.g KEEPALIVE_REQUEST) with handler instead of
+// replying false. Requests of a connection are handled one at a time
+// in order.
+func WithRequestHandler(requestType string, handler RequestHandler) Option {
+	return func(h *HoneyPot) {
+		h.requestHandlers[requestType] = handler
+	}
+}
+
+// Reply returns a RequestHandler replying ok (if a reply is wanted).
+func Reply(ok bool) RequestHandler {
+	return func(count int, req *ssh.Request) {
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+	}
+}
+
+// Delay returns a RequestHandler passing requests to handler after d,
+// e.g for replies slower than a keepalive timeout.
+func Delay(d time.Duration, handler RequestHandler) RequestHandler {
+	return func(count int, req *ssh.Request) {
+		time.Sleep(d)
+		handler(count, req)
+	}
+}
+
+// StopAfter returns a RequestHandler passing the first n requests to
+// handler and never replying to the rest, like a server that hung.
+func StopAfter(n int, handler RequestHandler) RequestHandler {
+	return func(count int, req *ssh.Request) {
+		if count <= n {
+			handler(count, req)
+		}
+	}
+}
+
+// Requests returns the number of global requests of requestType
+// received so far.
+func (h *HoneyPot) Requests(requestType string) int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.requestCounts[requestType]
+}
+
+// Keepalives returns the number of KEEPALIVE_REQUEST received so far.
+func (h *HoneyPot) Keepalives() int {
+	return h.Requests(KEEPALIVE_REQUEST)
+}
+
+// requests counts and answers the global requests of sconn, with
+// false unless there is a RequestHandler for the type or it is a port
+// forwarding request and WithPortForwarding was given.
+func (h *HoneyPot) requests(sconn *ssh.ServerConn, f *forwards, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		h.mutex.Lock()
+		h.requestCounts[req.Type]++
+		count := h.requestCounts[req.Type]
+		h.mutex.Unlock()
+		if h.forwarding && (req.Type == TCPIP_FORWARD_REQUEST || req.Type == CANCEL_TCPIP_FORWARD_REQUEST) {
+			if _, ok := h.requestHandlers[req.Type]; !ok {
+				h.tcpipForward(sconn, f, req)
+				continue
+			}
+		}
+		handler, ok := h.requestHandlers[req.Type]
+		if !ok {
+			handler = Reply(false)
+		}
+		handler(count, req)
+	}
+}
@@ -0,0 +1,86 @@
+package sshtest
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// ScriptedHandler serves an exec request for command, reading the
+// stdin and writing the stdout and stderr of the session, and returns
+// the exit status. The session ends when it returns.
+type ScriptedHandler func(command string, stdin io.Reader, stdout, stderr io.Writer) int
+
+type scriptedHandler struct {
+	prefix  string
+	handler ScriptedHandler
+}
+
+// WithScriptedHandler makes the HoneyPot serve exec requests for
+// commands starting with prefix (empty for any command) with handler,
+// e.g to act like tunreadwriter. The first matching prefix of
+// WithScriptedHandler and WithExec wins.
+func WithScriptedHandler(prefix string, handler ScriptedHandler) Option {
+	return func(h *HoneyPot) {
+		h.handlers = append(h.handlers, scriptedHandler{prefix: prefix, handler: handler})
+	}
+}
+
+// Session is the record of an exec request, see Sessions.
+type Session struct {
+	Command     string
+	Start       time.Time
+	End         time.Time
+	StdinBytes  int64
+	StdoutBytes int64
+	StderrBytes int64
+	ExitStatus  int
+}
+
+// Duration returns how long the command ran.
+func (s Session) Duration() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+// Sessions returns the record of every finished exec request, also
+// after Close.
+func (h *HoneyPot) Sessions() []Session {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]Session(nil), h.sessions...)
+}
+
+// record runs exec counting bytes and keeps the Session.
+func (h *HoneyPot) record(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var in, out, errOut atomic.Int64
+	session := Session{Command: command, Start: time.Now()}
+	session.ExitStatus = h.exec(command, countingReader{r: stdin, n: &in}, countingWriter{w: stdout, n: &out}, countingWriter{w: stderr, n: &errOut})
+	session.End = time.Now()
+	session.StdinBytes, session.StdoutBytes, session.StderrBytes = in.Load(), out.Load(), errOut.Load()
+	h.mutex.Lock()
+	h.sessions = append(h.sessions, session)
+	h.mutex.Unlock()
+	return session.ExitStatus
+}
+
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
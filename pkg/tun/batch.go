@@ -0,0 +1,163 @@
+package tun
+
+import (
+	"io"
+	"sync"
+)
+
+const (
+	// DEFAULT_WINDOW_SIZE is the channel window of
+	// golang.org/x/crypto/ssh: as many bytes of packets as can be in
+	// flight on a channel are queued in front of it.
+	DEFAULT_WINDOW_SIZE int = 2 << 20
+
+	// MAX_BATCH_SIZE is the largest payload of an SSH packet
+	// (golang.org/x/crypto/ssh and OpenSSH), so that a batch is sent
+	// as one SSH packet.
+	MAX_BATCH_SIZE int = 32 << 10
+
+	// maxPacket is the largest packet a tun or tap device returns.
+	maxPacket int = 65535
+)
+
+var packetPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 2048)
+		return &b
+	},
+}
+
+// packetQueue holds the packets read from the source until the
+// destination takes them, at most window bytes (but always at least
+// one packet).
+type packetQueue struct {
+	mutex   sync.Mutex
+	cond    sync.Cond
+	packets []*[]byte
+	bytes   int
+	window  int
+	eof     bool
+	done    bool
+}
+
+// put waits for room for p and queues it. It returns false if the
+// destination is done.
+func (q *packetQueue) put(p *[]byte) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for !q.done && q.bytes > 0 && q.bytes+len(*p) > q.window {
+		q.cond.Wait()
+	}
+	if q.done {
+		return false
+	}
+	q.packets = append(q.packets, p)
+	q.bytes += len(*p)
+	q.cond.Broadcast()
+	return true
+}
+
+// take waits for at least one packet and appends the queued packets
+// that fit in size bytes to batch. It returns false once the source
+// is at its end and the queue is empty.
+func (q *packetQueue) take(batch []byte, size int) ([]byte, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for len(q.packets) == 0 && !q.eof {
+		q.cond.Wait()
+	}
+	if len(q.packets) == 0 {
+		return batch, false
+	}
+	n := 0
+	for _, p := range q.packets {
+		if n > 0 && len(batch)+len(*p) > size {
+			break
+		}
+		batch = append(batch, *p...)
+		q.bytes -= len(*p)
+		packetPool.Put(p)
+		n++
+	}
+	q.packets = append(q.packets[:0], q.packets[n:]...)
+	q.cond.Broadcast()
+	return batch, true
+}
+
+// close marks the source at its end (eof) or the destination done.
+func (q *packetQueue) close(eof bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if eof {
+		q.eof = true
+	} else {
+		q.done = true
+	}
+	q.cond.Broadcast()
+}
+
+// CopyPackets copies the packets read from src, a tun device returning
+// one packet per read, to dst. src is read as fast as it returns
+// packets while up to window bytes of them (DEFAULT_WINDOW_SIZE if 0,
+// always at least one packet) wait for dst, so that a dst which is
+// slow now and then, like an ssh channel waiting for its window, does
+// not leave the packets to the queue of the device where they are
+// dropped. Queued packets are written together in writes of up to
+// MAX_BATCH_SIZE bytes (or window if smaller). A window of 1 writes
+// every packet on its own. dst must split the stream into packets
+// again (see PacketWriter), which rules out tap devices.
+//
+// CopyPackets returns the number of bytes written and the first error
+// of src (nil at io.EOF) or dst. It only returns once src has
+// returned, like io.Copy.
+func CopyPackets(dst io.Writer, src io.Reader, window int) (written int64, err error) {
+	if window <= 0 {
+		window = DEFAULT_WINDOW_SIZE
+	}
+	q := &packetQueue{window: window}
+	q.cond.L = &q.mutex
+	read := make(chan struct{})
+	var rerr error
+	go func() {
+		defer close(read)
+		defer q.close(true)
+		b := make([]byte, maxPacket)
+		for {
+			n, err := src.Read(b)
+			if n > 0 {
+				p := packetPool.Get().(*[]byte)
+				*p = append((*p)[:0], b[:n]...)
+				if !q.put(p) {
+					return
+				}
+			}
+			if err != nil {
+				if err != io.EOF {
+					rerr = err
+				}
+				return
+			}
+		}
+	}()
+	defer func() {
+		// Wait for the reader.
+		q.close(false)
+		<-read
+		if err == nil {
+			err = rerr
+		}
+	}()
+
+	batch := make([]byte, 0, max(min(window, MAX_BATCH_SIZE), maxPacket))
+	for {
+		var ok bool
+		if batch, ok = q.take(batch[:0], min(window, MAX_BATCH_SIZE)); !ok {
+			return written, nil
+		}
+		n, err := dst.Write(batch)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+}
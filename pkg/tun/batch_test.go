@@ -0,0 +1,118 @@
+package tun
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// packetSource returns one packet per read, then err. drained, if
+// set, is closed at the first read after the last packet.
+type packetSource struct {
+	packets [][]byte
+	err     error
+	drained chan struct{}
+	reads   atomic.Int32
+}
+
+func (s *packetSource) Read(b []byte) (int, error) {
+	s.reads.Add(1)
+	if len(s.packets) == 0 {
+		if s.drained != nil {
+			close(s.drained)
+			s.drained = nil
+		}
+		return 0, s.err
+	}
+	n := copy(b, s.packets[0])
+	s.packets = s.packets[1:]
+	return n, nil
+}
+
+// gatedRecorder records every write, the first one only once gate is
+// closed so that the packets after it queue up.
+type gatedRecorder struct {
+	packetRecorder
+	gate chan struct{}
+}
+
+func (r *gatedRecorder) Write(p []byte) (int, error) {
+	if len(r.packets) == 0 {
+		<-r.gate
+	}
+	return r.packetRecorder.Write(p)
+}
+
+func TestCopyPackets(t *testing.T) {
+	var packets [][]byte
+	var stream []byte
+	for i := 0; i < 100; i++ {
+		p := bytes.Repeat([]byte{byte(i)}, 1000+i)
+		packets = append(packets, p)
+		stream = append(stream, p...)
+	}
+	drained := make(chan struct{})
+	src := &packetSource{packets: append([][]byte{}, packets...), err: io.EOF, drained: drained}
+	// Every packet queues up behind the first write.
+	dst := &gatedRecorder{gate: drained}
+	n, err := CopyPackets(dst, src, 0)
+	if err != nil || n != int64(len(stream)) {
+		t.Fatalf("expected %d bytes copied, got %d and %v", len(stream), n, err)
+	}
+	if !bytes.Equal(bytes.Join(dst.packets, nil), stream) {
+		t.Fatal("expected the packets in order")
+	}
+	if len(dst.packets) > 10 {
+		t.Errorf("expected queued packets batched, got %d writes of 100 packets", len(dst.packets))
+	}
+	for _, w := range dst.packets {
+		if len(w) > MAX_BATCH_SIZE {
+			t.Errorf("expected writes of at most %d bytes, got %d", MAX_BATCH_SIZE, len(w))
+		}
+	}
+
+	// No more than the window is queued while the first write blocks:
+	// at most two packets in the write, two queued and one waiting for
+	// room.
+	src = &packetSource{packets: append([][]byte{}, packets...), err: io.EOF}
+	gate := make(chan struct{})
+	dst = &gatedRecorder{gate: gate}
+	copied := make(chan error, 1)
+	go func() {
+		_, err := CopyPackets(dst, src, 3000)
+		copied <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if reads := src.reads.Load(); reads < 4 || reads > 5 {
+		t.Errorf("expected reading to stop at a full window after 4 or 5 packets, got %d reads", reads)
+	}
+	close(gate)
+	if err := <-copied; err != nil || !bytes.Equal(bytes.Join(dst.packets, nil), stream) {
+		t.Errorf("expected the packets in order, got %v", err)
+	}
+	for _, w := range dst.packets {
+		if len(w) > 3000 {
+			t.Errorf("expected writes of at most the window, got %d", len(w))
+		}
+	}
+
+	// A window of one packet or less writes each on its own.
+	src = &packetSource{packets: append([][]byte{}, packets[:10]...), err: io.EOF}
+	r := &packetRecorder{}
+	if _, err := CopyPackets(r, src, 1); err != nil || len(r.packets) != 10 || !bytes.Equal(r.packets[9], packets[9]) {
+		t.Errorf("expected 10 writes, got %d and %v", len(r.packets), err)
+	}
+
+	failed := errors.New("read failed")
+	src = &packetSource{packets: append([][]byte{}, packets[:2]...), err: failed}
+	if _, err := CopyPackets(&packetRecorder{}, src, 0); !errors.Is(err, failed) {
+		t.Errorf("expected %v, got %v", failed, err)
+	}
+	src = &packetSource{packets: append([][]byte{}, packets...), err: io.EOF}
+	if _, err := CopyPackets(&packetRecorder{fail: true}, src, 0); err == nil || err.Error() != "write failed" {
+		t.Errorf("expected the write error, got %v", err)
+	}
+}
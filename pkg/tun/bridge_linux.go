@@ -0,0 +1,51 @@
+package tun
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+const (
+	// SIOCBRADDIF and SIOCBRDELIF from linux/sockios.h add and remove
+	// an interface (by index) to and from a bridge.
+	SIOCBRADDIF uint = 0x89a2
+	SIOCBRDELIF uint = 0x89a3
+)
+
+// JoinBridge enslaves the device (a tap device created with
+// CreateTAP) into the existing Linux bridge, joining the ethernet
+// segment of the bridge. Requires CAP_NET_ADMIN.
+func (t *TUN) JoinBridge(bridge string) error {
+	return t.bridge(SIOCBRADDIF, bridge)
+}
+
+// LeaveBridge removes the device from bridge again, closing the
+// device does that as well.
+func (t *TUN) LeaveBridge(bridge string) error {
+	return t.bridge(SIOCBRDELIF, bridge)
+}
+
+func (t *TUN) bridge(req uint, bridge string) error {
+	if _, err := net.InterfaceByName(bridge); err != nil {
+		return fmt.Errorf("%w: %s", ErrNoSuchBridge, bridge)
+	}
+	iface, err := net.InterfaceByName(t.Name)
+	if err != nil {
+		return err
+	}
+	ifr, err := NewIfreq(bridge)
+	if err != nil {
+		return err
+	}
+	ifr.SetUint32(uint32(iface.Index))
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	if err := IoctlIfreq(fd, req, ifr); err != nil {
+		return fmt.Errorf("bridge %s: %w", bridge, err)
+	}
+	return nil
+}
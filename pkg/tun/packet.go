@@ -0,0 +1,86 @@
+package tun
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// PacketWriter writes a stream of IP packets to a tun device one
+// packet per write. A single read from a stream (e.g an ssh session)
+// can return several packets back-to-back or only part of one, while
+// a write to a tun device takes exactly one packet and drops anything
+// after it. Data that is not an IPv4 or IPv6 packet is written as is.
+type PacketWriter struct {
+	w       io.Writer
+	pending []byte
+}
+
+// NewPacketWriter returns a PacketWriter writing to w, usually the
+// File of a tun (not tap) device.
+func NewPacketWriter(w io.Writer) *PacketWriter {
+	return &PacketWriter{w: w}
+}
+
+// Write writes every complete packet in what was written so far to
+// the underlying writer, keeping an incomplete packet at the end for
+// the next Write.
+func (p *PacketWriter) Write(b []byte) (int, error) {
+	p.pending = append(p.pending, b...)
+	var err error
+	rest := p.pending
+	for len(rest) > 0 && err == nil {
+		length := PacketLength(rest)
+		if length < 0 {
+			length = len(rest)
+		} else if length == 0 || length > len(rest) {
+			break
+		}
+		_, err = p.w.Write(rest[:length])
+		rest = rest[length:]
+	}
+	p.pending = append(p.pending[:0], rest...)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// PacketLength returns the length of the IPv4 or IPv6 packet starting
+// b from its header, 0 if b is too short to tell and -1 if b does not
+// start with an IP packet.
+func PacketLength(b []byte) int {
+	if len(b) == 0 {
+		return 0
+	}
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < 4 {
+			return 0
+		}
+		if length := int(binary.BigEndian.Uint16(b[2:])); length >= 20 {
+			return length
+		}
+	case 6:
+		if len(b) < 6 {
+			return 0
+		}
+		return 40 + int(binary.BigEndian.Uint16(b[4:]))
+	}
+	return -1
+}
+
+// DSCP returns the differentiated services code point (the upper six
+// bits of the IPv4 TOS or IPv6 traffic class) of the packet starting
+// b, -1 if b does not start with an IP header.
+func DSCP(b []byte) int {
+	if len(b) < 2 {
+		return -1
+	}
+	switch b[0] >> 4 {
+	case 4:
+		return int(b[1] >> 2)
+	case 6:
+		return int((b[0]&0x0f)<<2 | b[1]>>6)
+	}
+	return -1
+}
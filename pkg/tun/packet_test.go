@@ -0,0 +1,89 @@
+package tun
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// packetRecorder records every write as one packet.
+type packetRecorder struct {
+	packets [][]byte
+	fail    bool
+}
+
+func (r *packetRecorder) Write(p []byte) (int, error) {
+	if r.fail {
+		return 0, errors.New("write failed")
+	}
+	r.packets = append(r.packets, append([]byte{}, p...))
+	return len(p), nil
+}
+
+func TestPacketWriter(t *testing.T) {
+	ipv4 := func(length int, fill byte) []byte {
+		b := bytes.Repeat([]byte{fill}, length)
+		b[0], b[2], b[3] = 0x45, byte(length>>8), byte(length)
+		return b
+	}
+	ipv6 := func(payload int, fill byte) []byte {
+		b := bytes.Repeat([]byte{fill}, 40+payload)
+		b[0], b[4], b[5] = 0x60, byte(payload>>8), byte(payload)
+		return b
+	}
+	a, b, c := ipv4(1500, 1), ipv6(100, 2), ipv4(60, 3)
+	stream := append(append(append([]byte{}, a...), b...), c...)
+	r := &packetRecorder{}
+	w := NewPacketWriter(r)
+	// Back-to-back packets split at odd places, including within a
+	// header.
+	for _, chunk := range [][]byte{stream[:2], stream[2:1000], stream[1000:1503], stream[1503:]} {
+		if n, err := w.Write(chunk); err != nil || n != len(chunk) {
+			t.Fatalf("expected %d bytes written, got %d and %v", len(chunk), n, err)
+		}
+	}
+	if len(r.packets) != 3 || !bytes.Equal(r.packets[0], a) || !bytes.Equal(r.packets[1], b) || !bytes.Equal(r.packets[2], c) {
+		t.Errorf("expected 3 packets of %d, %d and %d bytes, got %d packets", len(a), len(b), len(c), len(r.packets))
+	}
+
+	r.packets = nil
+	if _, err := w.Write([]byte("\x00not a packet")); err != nil || len(r.packets) != 1 || string(r.packets[0]) != "\x00not a packet" {
+		t.Errorf("expected data that is not a packet written as is, got %q and %v", r.packets, err)
+	}
+	r.fail = true
+	if _, err := w.Write(c); err == nil {
+		t.Error("expected the error of the underlying writer")
+	}
+
+	for _, tc := range []struct {
+		b    []byte
+		want int
+	}{
+		{nil, 0},
+		{[]byte{0x45, 0}, 0},
+		{[]byte{0x45, 0, 0, 19}, -1},
+		{[]byte{0x60, 0, 0, 0}, 0},
+		{[]byte{0x60, 0, 0, 0, 0, 8}, 48},
+		{[]byte{0x00, 1, 2, 3}, -1},
+	} {
+		if got := PacketLength(tc.b); got != tc.want {
+			t.Errorf("PacketLength(% x): expected %d, got %d", tc.b, tc.want, got)
+		}
+	}
+
+	for _, tc := range []struct {
+		b    []byte
+		want int
+	}{
+		{nil, -1},
+		{[]byte{0x45, 0xb8}, 46}, // EF
+		{[]byte{0x45, 0x02}, 0},  // ECN only
+		{[]byte{0x6b, 0x80}, 46}, // traffic class 0xb8
+		{[]byte{0x62, 0x80}, 10}, // AF11
+		{[]byte{0x00, 0xb8}, -1},
+	} {
+		if got := DSCP(tc.b); got != tc.want {
+			t.Errorf("DSCP(% x): expected %d, got %d", tc.b, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+//go:build linux
+// +build linux
+
+package tun
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// rtentry is struct rtentry from linux/route.h used with SIOCADDRT
+// and SIOCDELRT. Go aligns the fields the same way as C.
+type rtentry struct {
+	pad1    uintptr
+	dst     syscall.RawSockaddrInet4
+	gateway syscall.RawSockaddrInet4
+	genmask syscall.RawSockaddrInet4
+	flags   uint16
+	pad2    int16
+	pad3    uintptr
+	pad4    uintptr
+	metric  int16
+	dev     *byte
+	mtu     uintptr
+	window  uintptr
+	irtt    uint16
+}
+
+const (
+	rtfUp      uint16 = 0x0001
+	rtfGateway uint16 = 0x0002
+	rtfHost    uint16 = 0x0004
+)
+
+// AddRoute adds an IPv4 route to destination (e.g 10.0.0.0/8) through
+// the tun device, via gateway if not empty. An existing route returns
+// an error wrapping syscall.EEXIST.
+func (t *TUN) AddRoute(destination, gateway string) error {
+	return t.route(syscall.SIOCADDRT, destination, gateway)
+}
+
+// DelRoute removes a route added with AddRoute.
+func (t *TUN) DelRoute(destination, gateway string) error {
+	return t.route(syscall.SIOCDELRT, destination, gateway)
+}
+
+func (t *TUN) route(req uint, destination, gateway string) error {
+	return route(req, t.Name, destination, gateway)
+}
+
+// AddDeviceRoute adds an IPv4 route to destination through any
+// device, via gateway if not empty, e.g to keep the address of the
+// ssh server off a default route through the tunnel.
+func AddDeviceRoute(device, destination, gateway string) error {
+	return route(syscall.SIOCADDRT, device, destination, gateway)
+}
+
+// DelDeviceRoute removes a route added with AddDeviceRoute.
+func DelDeviceRoute(device, destination, gateway string) error {
+	return route(syscall.SIOCDELRT, device, destination, gateway)
+}
+
+func route(req uint, device, destination, gateway string) error {
+	_, ipnet, err := net.ParseCIDR(destination)
+	if err != nil {
+		return err
+	}
+	dst := ipnet.IP.To4()
+	if dst == nil {
+		return fmt.Errorf("%w: %s is not an IPv4 network", ErrInvalidAddress, destination)
+	}
+	dev, err := syscall.BytePtrFromString(device)
+	if err != nil {
+		return err
+	}
+	rt := rtentry{
+		dst:     syscall.RawSockaddrInet4{Family: syscall.AF_INET, Addr: [4]byte(dst)},
+		genmask: syscall.RawSockaddrInet4{Family: syscall.AF_INET, Addr: [4]byte(ipnet.Mask)},
+		flags:   rtfUp,
+		dev:     dev,
+	}
+	if ones, bits := ipnet.Mask.Size(); ones == bits {
+		rt.flags |= rtfHost
+	}
+	if gateway != "" {
+		gw := net.ParseIP(gateway).To4()
+		if gw == nil {
+			return fmt.Errorf("%w: gateway %s is not an IPv4 address", ErrInvalidAddress, gateway)
+		}
+		rt.gateway = syscall.RawSockaddrInet4{Family: syscall.AF_INET, Addr: [4]byte(gw)}
+		rt.flags |= rtfGateway
+	}
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	return ioctlPtr(fd, req, unsafe.Pointer(&rt))
+}
@@ -1,184 +1,73 @@
-// The tun package creates, reads and writes to/from tun devices.
+// The tun package creates, reads and writes to/from tun devices, on
+// Linux through /dev/net/tun and on Windows through the wintun driver.
 package tun
 
 import (
 	"errors"
-	"fmt"
 	"net"
-	"os"
-	"syscall"
-	"unsafe"
 )
 
 var (
-	ErrInvalidAddress error = errors.New("invalid address")
+	ErrInvalidAddress   error = errors.New("invalid address")
+	ErrIPv6NotSupported error = errors.New("IPv6 is not supported by the kernel or is disabled on the device")
+	ErrTooManyAliases   error = errors.New("alias interface name too long")
+	ErrNoSuchDevice     error = errors.New("tun device does not exist")
+	ErrNotOwner         error = errors.New("tun device is not owned by the calling user or group")
+	ErrNoSuchBridge     error = errors.New("bridge does not exist")
+	ErrNotSupported     error = errors.New("not supported on this platform")
 )
 
-const (
-	DEV_NET_TUN string = "/dev/net/tun"
-)
-
-type TUN struct {
-	Name  string
-	File  *os.File
-	Fd    int
-	Ifreq *Ifreq
-}
-
-// CreateTUN creates a new tun device with name. If mtu is above 0 it
-// attempts to set the MTU. If uid is above 0 it attempts to set the
-// owner, same with gid. Returns a TUN which should be closed with
-// receiver function Close() when you want to terminate the tunnel.
-func CreateTUN(name string, mtu, uid, gid int) (*TUN, error) {
-	fd, err := syscall.Open(DEV_NET_TUN, syscall.O_RDWR|syscall.O_CLOEXEC, syscall.IPPROTO_IP)
-	//fd, err := unix.Open(DEV_NET_TUN, unix.O_RDWR|unix.O_CLOEXEC, 0)
+// HasAddress returns true if the tun device has the IPv4 or IPv6
+// address with CIDR (e.g 172.18.0.1/24), prefix length included.
+func (t *TUN) HasAddress(address_with_cidr string) (bool, error) {
+	ip, ipnet, err := net.ParseCIDR(address_with_cidr)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
-	closeFD := true
-	defer func() {
-		if closeFD {
-			syscall.Close(fd)
-		}
-	}()
-
-	ifr, err := NewIfreq(name)
+	iface, err := net.InterfaceByName(t.Name)
 	if err != nil {
-		syscall.Close(fd)
-		return nil, err
+		return false, err
 	}
+	addrs, err := iface.Addrs()
 	if err != nil {
-		return nil, err
+		return false, err
 	}
-	//ifr.SetUint16(syscall.IFF_TUN | syscall.IFF_NO_PI | syscall.IFF_VNET_HDR)
-	ifr.SetUint16(syscall.IFF_TUN | syscall.IFF_NO_PI)
-	err = IoctlIfreq(fd, syscall.TUNSETIFF, ifr)
-	if err != nil {
-		return nil, fmt.Errorf("ioctl interface request: %w", err)
-	}
-	// err = unix.SetNonblock(fd, true)
-	// if err != nil {
-	// 	return nil, err
-	// }
-	t := &TUN{
-		Name:  ifr.Name(),
-		Fd:    fd,
-		Ifreq: ifr,
-	}
-
-	if mtu > 0 {
-		if err := t.SetMTU(mtu); err != nil {
-			return nil, err
+	for _, addr := range addrs {
+		if a, ok := addr.(*net.IPNet); ok && a.IP.Equal(ip) && a.Mask.String() == ipnet.Mask.String() {
+			return true, nil
 		}
 	}
-	if uid > 0 {
-		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(syscall.TUNSETOWNER), uintptr(uid))
-		if errno != 0 {
-			return nil, os.NewSyscallError("ioctl TUNSETOWNER", errno)
-		}
-	}
-	if gid > 0 {
-		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(syscall.TUNSETGROUP), uintptr(gid))
-		if errno != 0 {
-			return nil, os.NewSyscallError("ioctl TUNSETGROUP", errno)
-		}
-	}
-	closeFD = false
-	t.File = os.NewFile(uintptr(fd), DEV_NET_TUN)
-	return t, nil
+	return false, nil
 }
 
-func (t *TUN) SetMTU(mtu int) error {
-	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+// IsUp returns true if the tun device is administratively up.
+func (t *TUN) IsUp() (bool, error) {
+	iface, err := net.InterfaceByName(t.Name)
 	if err != nil {
-		return err
-	}
-	defer syscall.Close(fd)
-	t.Ifreq.SetUint32(uint32(mtu))
-	if err := IoctlIfreq(fd, syscall.SIOCSIFMTU, t.Ifreq); err != nil {
-		return fmt.Errorf("failed to set MTU of TUN device: %w", err)
-	}
-	return nil
-}
-
-func (t *TUN) Close() error {
-	e1 := t.File.Close()
-	e2 := syscall.Close(t.Fd)
-	if e1 != nil && e2 != nil {
-		return fmt.Errorf("%w: %w", e1, e2)
-	} else if e1 != nil {
-		return e1
-	} else if e2 != nil {
-		return e2
+		return false, err
 	}
-	return nil
+	return iface.Flags&net.FlagUp != 0, nil
 }
 
-func (t *TUN) ConfigureInterface(ipv4_address_with_cidr string) error {
-	ipv4, ipnet, err := net.ParseCIDR(ipv4_address_with_cidr)
-	if err != nil {
-		return err
-	}
-	ipv4 = ipv4.To4()
-	if ipv4 == nil {
-		return ErrInvalidAddress
-	}
-
-	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_IP)
-	if err != nil {
-		return err
-	}
-	defer syscall.Close(fd)
-
-	t.Ifreq.Clear()
-
-	*(*syscall.RawSockaddrInet4)(
-		unsafe.Pointer(&t.Ifreq.Ifru[:syscall.SizeofSockaddrInet4][0]),
-	) = syscall.RawSockaddrInet4{
-		Family: syscall.AF_INET,
-		Addr:   [4]byte(ipv4),
-	}
-	if err := IoctlIfreq(fd, syscall.SIOCSIFADDR, t.Ifreq); err != nil {
-		return fmt.Errorf("ioctl SIOCSIFADDR: %w", err)
+// PointToPoint reports if ipv4_address_with_cidr is a /31 (RFC 3021)
+// or /32 address, which have no network and broadcast address and are
+// configured with a peer address instead, see ConfigurePeer.
+func PointToPoint(ipv4_address_with_cidr string) bool {
+	ip, ipnet, err := net.ParseCIDR(ipv4_address_with_cidr)
+	if err != nil || ip.To4() == nil {
+		return false
 	}
-
-	t.Ifreq.Clear()
-
-	*(*syscall.RawSockaddrInet4)(
-		unsafe.Pointer(&t.Ifreq.Ifru[:syscall.SizeofSockaddrInet4][0]),
-	) = syscall.RawSockaddrInet4{
-		Family: syscall.AF_INET,
-		Addr:   [4]byte(ipnet.Mask),
-	}
-	if err := IoctlIfreq(fd, syscall.SIOCSIFNETMASK, t.Ifreq); err != nil {
-		return fmt.Errorf("ioctl SIOCSIFNETMASK: %w", err)
-	}
-
-	return nil
+	ones, _ := ipnet.Mask.Size()
+	return ones >= 31
 }
 
-func (t *TUN) LinkUp() error {
-	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_IP)
-	if err != nil {
-		return err
-	}
-	defer syscall.Close(fd)
-
-	// Get flags
-
-	t.Ifreq.Clear()
-
-	if err := IoctlIfreq(fd, syscall.SIOCGIFFLAGS, t.Ifreq); err != nil {
-		return fmt.Errorf("ioctl SIOCGIFFLAGS: %w", err)
+// ConfigureAddress configures the tun device with
+// ConfigurePeer if ipv4_address_with_cidr is point-to-point (see
+// PointToPoint) and peer is not empty, otherwise with
+// ConfigureInterface.
+func (t *TUN) ConfigureAddress(ipv4_address_with_cidr, peer string) error {
+	if peer != "" && PointToPoint(ipv4_address_with_cidr) {
+		return t.ConfigurePeer(ipv4_address_with_cidr, peer)
 	}
-
-	// Enable broadcast and bring link up
-
-	t.Ifreq.SetUint16(t.Ifreq.Uint16() | syscall.IFF_BROADCAST | syscall.IFF_UP | syscall.IFF_RUNNING)
-
-	if err := IoctlIfreq(fd, syscall.SIOCSIFFLAGS, t.Ifreq); err != nil {
-		return fmt.Errorf("ioctl SIOCSIFFLAGS: %w", err)
-	}
-
-	return nil
+	return t.ConfigureInterface(ipv4_address_with_cidr)
 }
@@ -0,0 +1,416 @@
+//go:build linux
+
+package tun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	DEV_NET_TUN string = "/dev/net/tun"
+)
+
+type TUN struct {
+	Name  string
+	File  *os.File
+	Fd    int
+	Ifreq *Ifreq
+}
+
+// CreateTUN creates a new tun device with name. If mtu is above 0 it
+// attempts to set the MTU. If uid is above 0 it attempts to set the
+// owner, same with gid. Returns a TUN which should be closed with
+// receiver function Close() when you want to terminate the tunnel.
+func CreateTUN(name string, mtu, uid, gid int) (*TUN, error) {
+	return create(name, syscall.IFF_TUN, mtu, uid, gid)
+}
+
+// CreateTAP creates a new tap (ethernet) device with name like
+// CreateTUN. Reads and writes are whole ethernet frames, the device
+// is usually enslaved into a bridge with JoinBridge instead of being
+// given an address.
+func CreateTAP(name string, mtu, uid, gid int) (*TUN, error) {
+	return create(name, syscall.IFF_TAP, mtu, uid, gid)
+}
+
+func create(name string, mode uint16, mtu, uid, gid int) (*TUN, error) {
+	fd, ifr, err := attach(name, mode)
+	if err != nil {
+		return nil, err
+	}
+	closeFD := true
+	defer func() {
+		if closeFD {
+			syscall.Close(fd)
+		}
+	}()
+
+	t := &TUN{
+		Name:  ifr.Name(),
+		Fd:    fd,
+		Ifreq: ifr,
+	}
+
+	if mtu > 0 {
+		if err := t.SetMTU(mtu); err != nil {
+			return nil, err
+		}
+	}
+	if uid > 0 {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(syscall.TUNSETOWNER), uintptr(uid))
+		if errno != 0 {
+			return nil, os.NewSyscallError("ioctl TUNSETOWNER", errno)
+		}
+	}
+	if gid > 0 {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(syscall.TUNSETGROUP), uintptr(gid))
+		if errno != 0 {
+			return nil, os.NewSyscallError("ioctl TUNSETGROUP", errno)
+		}
+	}
+	closeFD = false
+	t.File = os.NewFile(uintptr(fd), DEV_NET_TUN)
+	return t, nil
+}
+
+// OpenTUN attaches to the existing (persistent) tun device name
+// without creating, configuring or linking it up. This does not
+// require any privileges if the device is owned by the calling user
+// or group (ip tuntap add mode tun user alice). Returns an error
+// wrapping ErrNoSuchDevice if the device does not exist and
+// ErrNotOwner if the calling user is not allowed to attach to it.
+func OpenTUN(name string) (*TUN, error) {
+	if _, err := net.InterfaceByName(name); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoSuchDevice, name)
+	}
+	fd, ifr, err := attach(name, syscall.IFF_TUN)
+	if err != nil {
+		if errors.Is(err, syscall.EPERM) {
+			return nil, fmt.Errorf("%w: %s: %w", ErrNotOwner, name, err)
+		}
+		return nil, err
+	}
+	return &TUN{
+		Name:  ifr.Name(),
+		Fd:    fd,
+		Ifreq: ifr,
+		File:  os.NewFile(uintptr(fd), DEV_NET_TUN),
+	}, nil
+}
+
+// attach opens DEV_NET_TUN and attaches it to tun (mode IFF_TUN) or
+// tap (IFF_TAP) device name with TUNSETIFF, creating the device if it
+// does not exist (requires CAP_NET_ADMIN).
+func attach(name string, mode uint16) (int, *Ifreq, error) {
+	fd, err := syscall.Open(DEV_NET_TUN, syscall.O_RDWR|syscall.O_CLOEXEC, syscall.IPPROTO_IP)
+	//fd, err := unix.Open(DEV_NET_TUN, unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, nil, err
+	}
+	ifr, err := NewIfreq(name)
+	if err != nil {
+		syscall.Close(fd)
+		return -1, nil, err
+	}
+	//ifr.SetUint16(syscall.IFF_TUN | syscall.IFF_NO_PI | syscall.IFF_VNET_HDR)
+	ifr.SetUint16(mode | syscall.IFF_NO_PI)
+	if err := IoctlIfreq(fd, syscall.TUNSETIFF, ifr); err != nil {
+		syscall.Close(fd)
+		return -1, nil, fmt.Errorf("ioctl interface request: %w", err)
+	}
+	return fd, ifr, nil
+}
+
+// FromFd returns a TUN for an already created tun device name open
+// as fd, e.g received from a privileged process over a unix socket.
+// The TUN takes ownership of fd.
+func FromFd(name string, fd int) (*TUN, error) {
+	ifr, err := NewIfreq(name)
+	if err != nil {
+		return nil, err
+	}
+	syscall.CloseOnExec(fd)
+	return &TUN{
+		Name:  name,
+		Fd:    fd,
+		Ifreq: ifr,
+		File:  os.NewFile(uintptr(fd), DEV_NET_TUN),
+	}, nil
+}
+
+// SetNonblock puts the device in non-blocking mode, File then uses the
+// runtime poller and a pending Read can be interrupted with
+// SetReadDeadline. As os.File only checks the mode when it is
+// created, Fd and File are replaced by a duplicate of the descriptor
+// and the previous one is closed.
+func (t *TUN) SetNonblock() error {
+	r1, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(t.Fd), syscall.F_DUPFD_CLOEXEC, 0)
+	if errno != 0 {
+		return os.NewSyscallError("fcntl F_DUPFD_CLOEXEC", errno)
+	}
+	fd := int(r1)
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	t.Close()
+	t.Fd = fd
+	t.File = os.NewFile(uintptr(fd), DEV_NET_TUN)
+	return nil
+}
+
+// SetPersist makes the tun device outlive the process (TUNSETPERSIST),
+// it is then removed with ip tuntap del or SetPersist(false).
+func (t *TUN) SetPersist(persist bool) error {
+	var value uintptr
+	if persist {
+		value = 1
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(t.Fd), uintptr(syscall.TUNSETPERSIST), value); errno != 0 {
+		return os.NewSyscallError("ioctl TUNSETPERSIST", errno)
+	}
+	return nil
+}
+
+func (t *TUN) SetMTU(mtu int) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	t.Ifreq.SetUint32(uint32(mtu))
+	if err := IoctlIfreq(fd, syscall.SIOCSIFMTU, t.Ifreq); err != nil {
+		return fmt.Errorf("failed to set MTU of TUN device: %w", err)
+	}
+	return nil
+}
+
+// MTU returns the current MTU of the tun device.
+func (t *TUN) MTU() (int, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer syscall.Close(fd)
+	ifr, err := NewIfreq(t.Name)
+	if err != nil {
+		return 0, err
+	}
+	if err := IoctlIfreq(fd, syscall.SIOCGIFMTU, ifr); err != nil {
+		return 0, fmt.Errorf("failed to get MTU of TUN device: %w", err)
+	}
+	return int(ifr.Uint32()), nil
+}
+
+// Close closes the tun device. File owns Fd, closing both would
+// fail with EBADF (or close an fd reused in between).
+func (t *TUN) Close() error {
+	if t.File == nil {
+		return syscall.Close(t.Fd)
+	}
+	return t.File.Close()
+}
+
+// Read reads one packet (or frame of a tap device) from the device.
+func (t *TUN) Read(b []byte) (int, error) {
+	return t.File.Read(b)
+}
+
+// Write writes one packet (or frame of a tap device) to the device.
+func (t *TUN) Write(b []byte) (int, error) {
+	return t.File.Write(b)
+}
+
+// Dropped always returns 0, a write to a tun device is not dropped
+// by Write, the kernel counts packets it drops itself (ip -s link).
+func (t *TUN) Dropped() uint64 {
+	return 0
+}
+
+// SetReadDeadline makes a pending and future Read return
+// os.ErrDeadlineExceeded after deadline, the zero time clears it.
+// Returns os.ErrNoDeadline unless SetNonblock has been called.
+func (t *TUN) SetReadDeadline(deadline time.Time) error {
+	return t.File.SetReadDeadline(deadline)
+}
+
+func (t *TUN) ConfigureInterface(ipv4_address_with_cidr string) error {
+	return configureIPv4(t.Ifreq, ipv4_address_with_cidr)
+}
+
+// ConfigurePeer configures the tun device like ConfigureInterface and
+// sets peer (an IPv4 address without prefix length, the address of the
+// other end) as its point-to-point destination address, which adds a
+// host route to peer. Used for /31 and /32 addresses (see
+// PointToPoint), with a /32 the peer does not have to be in the same
+// subnet. Only tun devices are point-to-point, not tap devices.
+func (t *TUN) ConfigurePeer(ipv4_address_with_cidr, peer string) error {
+	peerIP := net.ParseIP(peer).To4()
+	if peerIP == nil {
+		return fmt.Errorf("%w: peer %q is not an IPv4 address", ErrInvalidAddress, peer)
+	}
+	if err := configureIPv4(t.Ifreq, ipv4_address_with_cidr); err != nil {
+		return err
+	}
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_IP)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	t.Ifreq.Clear()
+	*(*syscall.RawSockaddrInet4)(
+		unsafe.Pointer(&t.Ifreq.Ifru[:syscall.SizeofSockaddrInet4][0]),
+	) = syscall.RawSockaddrInet4{
+		Family: syscall.AF_INET,
+		Addr:   [4]byte(peerIP),
+	}
+	if err := IoctlIfreq(fd, syscall.SIOCSIFDSTADDR, t.Ifreq); err != nil {
+		return fmt.Errorf("ioctl SIOCSIFDSTADDR: %w", err)
+	}
+	return nil
+}
+
+// AddAddress adds an additional IPv4 address with CIDR to the tun
+// device as alias number n (label name:n, n starting at 1), the
+// first address is set with ConfigureInterface.
+func (t *TUN) AddAddress(n int, ipv4_address_with_cidr string) error {
+	ifr, err := NewIfreq(fmt.Sprintf("%s:%d", t.Name, n))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrTooManyAliases, err)
+	}
+	return configureIPv4(ifr, ipv4_address_with_cidr)
+}
+
+func configureIPv4(ifr *Ifreq, ipv4_address_with_cidr string) error {
+	ipv4, ipnet, err := net.ParseCIDR(ipv4_address_with_cidr)
+	if err != nil {
+		return err
+	}
+	ipv4 = ipv4.To4()
+	if ipv4 == nil {
+		return ErrInvalidAddress
+	}
+
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_IP)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	ifr.Clear()
+
+	*(*syscall.RawSockaddrInet4)(
+		unsafe.Pointer(&ifr.Ifru[:syscall.SizeofSockaddrInet4][0]),
+	) = syscall.RawSockaddrInet4{
+		Family: syscall.AF_INET,
+		Addr:   [4]byte(ipv4),
+	}
+	if err := IoctlIfreq(fd, syscall.SIOCSIFADDR, ifr); err != nil {
+		return fmt.Errorf("ioctl SIOCSIFADDR: %w", err)
+	}
+
+	ifr.Clear()
+
+	*(*syscall.RawSockaddrInet4)(
+		unsafe.Pointer(&ifr.Ifru[:syscall.SizeofSockaddrInet4][0]),
+	) = syscall.RawSockaddrInet4{
+		Family: syscall.AF_INET,
+		Addr:   [4]byte(ipnet.Mask),
+	}
+	if err := IoctlIfreq(fd, syscall.SIOCSIFNETMASK, ifr); err != nil {
+		return fmt.Errorf("ioctl SIOCSIFNETMASK: %w", err)
+	}
+
+	return nil
+}
+
+// in6Ifreq is struct in6_ifreq from linux/ipv6.h used to add IPv6
+// addresses with SIOCSIFADDR on an AF_INET6 socket.
+type in6Ifreq struct {
+	addr      [16]byte
+	prefixlen uint32
+	ifindex   int32
+}
+
+// IPv6Supported returns nil if the kernel supports IPv6 and it is not
+// disabled on the tun device, otherwise an error wrapping
+// ErrIPv6NotSupported.
+func (t *TUN) IPv6Supported() error {
+	if _, err := os.Stat("/proc/net/if_inet6"); err != nil {
+		return fmt.Errorf("%w: %w", ErrIPv6NotSupported, err)
+	}
+	if b, err := os.ReadFile("/proc/sys/net/ipv6/conf/" + t.Name + "/disable_ipv6"); err == nil && strings.TrimSpace(string(b)) == "1" {
+		return fmt.Errorf("%w: net.ipv6.conf.%s.disable_ipv6 is 1", ErrIPv6NotSupported, t.Name)
+	}
+	return nil
+}
+
+// ConfigureInterface6 adds an IPv6 address with prefix length (e.g
+// fd00::2/64) to the tun device.
+func (t *TUN) ConfigureInterface6(ipv6_address_with_prefix string) error {
+	ipv6, ipnet, err := net.ParseCIDR(ipv6_address_with_prefix)
+	if err != nil {
+		return err
+	}
+	if ipv6.To4() != nil || ipv6.To16() == nil {
+		return ErrInvalidAddress
+	}
+	if err := t.IPv6Supported(); err != nil {
+		return err
+	}
+	iface, err := net.InterfaceByName(t.Name)
+	if err != nil {
+		return err
+	}
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		if errors.Is(err, syscall.EAFNOSUPPORT) {
+			return fmt.Errorf("%w: %w", ErrIPv6NotSupported, err)
+		}
+		return err
+	}
+	defer syscall.Close(fd)
+	prefixlen, _ := ipnet.Mask.Size()
+	req := in6Ifreq{
+		addr:      [16]byte(ipv6.To16()),
+		prefixlen: uint32(prefixlen),
+		ifindex:   int32(iface.Index),
+	}
+	if err := ioctlPtr(fd, syscall.SIOCSIFADDR, unsafe.Pointer(&req)); err != nil {
+		return fmt.Errorf("ioctl SIOCSIFADDR (inet6): %w", err)
+	}
+	return nil
+}
+
+func (t *TUN) LinkUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_IP)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	// Get flags
+
+	t.Ifreq.Clear()
+
+	if err := IoctlIfreq(fd, syscall.SIOCGIFFLAGS, t.Ifreq); err != nil {
+		return fmt.Errorf("ioctl SIOCGIFFLAGS: %w", err)
+	}
+
+	// Enable broadcast and bring link up
+
+	t.Ifreq.SetUint16(t.Ifreq.Uint16() | syscall.IFF_BROADCAST | syscall.IFF_UP | syscall.IFF_RUNNING)
+
+	if err := IoctlIfreq(fd, syscall.SIOCSIFFLAGS, t.Ifreq); err != nil {
+		return fmt.Errorf("ioctl SIOCSIFFLAGS: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+//go:build linux
+
+package tun
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sa6mwa/sshtun/internal/pkg/netns"
+)
+
+func TestPointToPoint(t *testing.T) {
+	for address, want := range map[string]bool{
+		"10.0.0.0/31":   true,
+		"10.0.0.1/32":   true,
+		"10.0.0.1/30":   false,
+		"fd00::1/127":   false,
+		"not-a-network": false,
+	} {
+		if got := PointToPoint(address); got != want {
+			t.Errorf("%s: expected %t, got %t", address, want, got)
+		}
+	}
+}
+
+func TestConfigurePeer(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating tun devices requires root")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("test requires ip")
+	}
+	ns, err := netns.New()
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ns.Close()
+	for _, c := range []struct {
+		device, address, peer string
+		want                  string
+	}{
+		{"ptp31", "10.9.0.0/31", "10.9.0.1", "inet 10.9.0.0 peer 10.9.0.1/31"},
+		{"ptp32", "10.9.1.1/32", "10.9.2.1", "inet 10.9.1.1 peer 10.9.2.1/32"},
+		{"subnet30", "10.9.3.1/30", "10.9.3.2", "inet 10.9.3.1/30"},
+	} {
+		err := ns.Do(func() error {
+			tun, err := CreateTUN(c.device, 0, 0, 0)
+			if err != nil {
+				return err
+			}
+			defer tun.Close()
+			if err := tun.ConfigureAddress(c.address, c.peer); err != nil {
+				return err
+			}
+			if err := tun.LinkUp(); err != nil {
+				return err
+			}
+			out, err := exec.Command("ip", "-4", "-o", "addr", "show", "dev", c.device).CombinedOutput()
+			if err != nil {
+				return fmt.Errorf("%w: %s", err, out)
+			}
+			if !strings.Contains(string(out), c.want) {
+				t.Errorf("%s: expected %q, got %s", c.device, c.want, out)
+			}
+			out, err = exec.Command("ip", "-4", "route", "get", c.peer).CombinedOutput()
+			if err != nil || !strings.Contains(string(out), "dev "+c.device) {
+				t.Errorf("%s: expected a route to %s through the device, got %v: %s", c.device, c.peer, err, out)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", c.device, err)
+		}
+	}
+	if err := ns.Do(func() error {
+		tun, err := CreateTUN("ptpbad", 0, 0, 0)
+		if err != nil {
+			return err
+		}
+		defer tun.Close()
+		return tun.ConfigurePeer("10.9.4.1/32", "fd00::1")
+	}); err == nil {
+		t.Error("expected an IPv6 peer to fail")
+	}
+}
+
+func TestSetNonblock(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[1])
+	dev, err := FromFd("faketun0", fds[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	if err := dev.SetReadDeadline(time.Now()); !errors.Is(err, os.ErrNoDeadline) {
+		t.Fatalf("expected a blocking device by default, got: %v", err)
+	}
+	if err := dev.SetNonblock(); err != nil {
+		t.Fatal(err)
+	}
+	if dev.Fd == fds[0] {
+		t.Errorf("expected a duplicated descriptor")
+	}
+	if err := dev.SetReadDeadline(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dev.Read(make([]byte, 16)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected the read to time out, got: %v", err)
+	}
+}
@@ -0,0 +1,453 @@
+//go:build windows
+
+package tun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	// WINTUN_DLL is loaded from the directory of the executable only,
+	// never from the search path.
+	WINTUN_DLL string = "wintun.dll"
+	// WINTUN_TUNNEL_TYPE is the tunnel type of the adapters created.
+	WINTUN_TUNNEL_TYPE string = "sshtun"
+	// WINTUN_RING_CAPACITY is the size of the ring buffers of a
+	// session, a power of 2 between 128 KiB and 64 MiB.
+	WINTUN_RING_CAPACITY uint32 = 8 << 20
+
+	// Errors returned by the wintun session functions.
+	errorHandleEOF      syscall.Errno = 38
+	errorNoMoreItems    syscall.Errno = 259
+	errorBufferOverflow syscall.Errno = 111
+)
+
+var (
+	wintunOnce sync.Once
+	wintunErr  error
+	wintun     struct {
+		createAdapter        *syscall.Proc
+		closeAdapter         *syscall.Proc
+		startSession         *syscall.Proc
+		endSession           *syscall.Proc
+		getReadWaitEvent     *syscall.Proc
+		receivePacket        *syscall.Proc
+		releaseReceivePacket *syscall.Proc
+		allocateSendPacket   *syscall.Proc
+		sendPacket           *syscall.Proc
+	}
+)
+
+// loadWintun loads WINTUN_DLL from the directory of the executable
+// once.
+func loadWintun() error {
+	wintunOnce.Do(func() {
+		exe, err := os.Executable()
+		if err != nil {
+			wintunErr = err
+			return
+		}
+		dll, err := syscall.LoadDLL(filepath.Join(filepath.Dir(exe), WINTUN_DLL))
+		if err != nil {
+			wintunErr = fmt.Errorf("unable to load %s from the directory of %s (download it from https://www.wintun.net): %w", WINTUN_DLL, filepath.Base(exe), err)
+			return
+		}
+		for _, proc := range []struct {
+			p    **syscall.Proc
+			name string
+		}{
+			{&wintun.createAdapter, "WintunCreateAdapter"},
+			{&wintun.closeAdapter, "WintunCloseAdapter"},
+			{&wintun.startSession, "WintunStartSession"},
+			{&wintun.endSession, "WintunEndSession"},
+			{&wintun.getReadWaitEvent, "WintunGetReadWaitEvent"},
+			{&wintun.receivePacket, "WintunReceivePacket"},
+			{&wintun.releaseReceivePacket, "WintunReleaseReceivePacket"},
+			{&wintun.allocateSendPacket, "WintunAllocateSendPacket"},
+			{&wintun.sendPacket, "WintunSendPacket"},
+		} {
+			if *proc.p, err = dll.FindProc(proc.name); err != nil {
+				wintunErr = fmt.Errorf("%s: %w", WINTUN_DLL, err)
+				return
+			}
+		}
+	})
+	return wintunErr
+}
+
+// TUN is a wintun adapter and its session. The adapter (and with it
+// the network interface) is removed on Close.
+type TUN struct {
+	Name    string
+	mutex   sync.RWMutex
+	adapter uintptr
+	session uintptr
+	// readEvent is signalled by wintun when packets are available,
+	// wakeEvent by SetReadDeadline and Close to interrupt a Read
+	// waiting for it.
+	readEvent windows.Handle
+	wakeEvent windows.Handle
+	deadline  atomic.Int64
+	dropped   atomic.Uint64
+	closing   atomic.Bool
+	closed    bool
+}
+
+// packetBytes returns the size bytes of a packet at ptr, as returned
+// by WintunReceivePacket or WintunAllocateSendPacket. The packet is in
+// the ring buffer of the session, memory allocated by wintun that the
+// Go garbage collector neither moves nor frees. It is valid until the
+// packet is released (WintunReleaseReceivePacket) or sent
+// (WintunSendPacket), which happens only after copying from or to the
+// slice. ptr is read through its address rather than converted with
+// unsafe.Pointer(ptr), which go vet reports as a possible misuse of a
+// uintptr that may hold a Go pointer.
+func packetBytes(ptr uintptr, size int) []byte {
+	return unsafe.Slice(*(**byte)(unsafe.Pointer(&ptr)), size)
+}
+
+// CreateTUN creates a wintun adapter with name and starts a session
+// on it. If mtu is above 0 it attempts to set the MTU. uid and gid are
+// ignored, requires Administrator.
+func CreateTUN(name string, mtu, uid, gid int) (*TUN, error) {
+	if err := loadWintun(); err != nil {
+		return nil, err
+	}
+	name16, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	type16, err := syscall.UTF16PtrFromString(WINTUN_TUNNEL_TYPE)
+	if err != nil {
+		return nil, err
+	}
+	adapter, _, err := wintun.createAdapter.Call(uintptr(unsafe.Pointer(name16)), uintptr(unsafe.Pointer(type16)), 0)
+	if adapter == 0 {
+		return nil, fmt.Errorf("WintunCreateAdapter: %w", err)
+	}
+	session, _, err := wintun.startSession.Call(adapter, uintptr(WINTUN_RING_CAPACITY))
+	if session == 0 {
+		wintun.closeAdapter.Call(adapter)
+		return nil, fmt.Errorf("WintunStartSession: %w", err)
+	}
+	// The read event belongs to the session and must not be closed.
+	event, _, _ := wintun.getReadWaitEvent.Call(session)
+	wake, err := windows.CreateEvent(nil, 0, 0, nil)
+	if err != nil {
+		wintun.endSession.Call(session)
+		wintun.closeAdapter.Call(adapter)
+		return nil, fmt.Errorf("CreateEvent: %w", err)
+	}
+	t := &TUN{
+		Name:      name,
+		adapter:   adapter,
+		session:   session,
+		readEvent: windows.Handle(event),
+		wakeEvent: wake,
+	}
+	if mtu > 0 {
+		if err := t.SetMTU(mtu); err != nil {
+			t.Close()
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// CreateTAP is not supported, wintun adapters are layer 3 only.
+func CreateTAP(name string, mtu, uid, gid int) (*TUN, error) {
+	return nil, fmt.Errorf("tap device: %w", ErrNotSupported)
+}
+
+// OpenTUN is not supported, wintun adapters do not outlive the
+// process.
+func OpenTUN(name string) (*TUN, error) {
+	return nil, fmt.Errorf("persistent tun device: %w", ErrNotSupported)
+}
+
+// FromFd is not supported, there are no file descriptors to pass.
+func FromFd(name string, fd int) (*TUN, error) {
+	return nil, fmt.Errorf("tun device from fd: %w", ErrNotSupported)
+}
+
+// SetPersist is not supported.
+func (t *TUN) SetPersist(persist bool) error {
+	return fmt.Errorf("persistent tun device: %w", ErrNotSupported)
+}
+
+// Read reads one packet from the adapter, waiting for the read event
+// of the session if there is none.
+func (t *TUN) Read(b []byte) (int, error) {
+	for {
+		n, again, err := t.receive(b)
+		if !again {
+			return n, err
+		}
+	}
+}
+
+// receive reads one packet. If there is none, it waits until the read
+// event is signalled, the deadline passes or wakeEvent is signalled
+// and returns with again set.
+func (t *TUN) receive(b []byte) (n int, again bool, err error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.closed {
+		return 0, false, os.ErrClosed
+	}
+	timeout := uint32(windows.INFINITE)
+	if deadline := t.deadline.Load(); deadline != 0 {
+		remaining := time.Until(time.Unix(0, deadline))
+		if remaining <= 0 {
+			return 0, false, os.ErrDeadlineExceeded
+		}
+		timeout = uint32((remaining + time.Millisecond - 1) / time.Millisecond)
+	}
+	var size uint32
+	r1, _, err := wintun.receivePacket.Call(t.session, uintptr(unsafe.Pointer(&size)))
+	if r1 != 0 {
+		n = copy(b, packetBytes(r1, int(size)))
+		wintun.releaseReceivePacket.Call(t.session, r1)
+		return n, false, nil
+	}
+	switch {
+	case errors.Is(err, errorNoMoreItems):
+		if _, err := windows.WaitForMultipleObjects([]windows.Handle{t.readEvent, t.wakeEvent}, false, timeout); err != nil {
+			return 0, false, fmt.Errorf("WaitForMultipleObjects: %w", err)
+		}
+		return 0, true, nil
+	case errors.Is(err, errorHandleEOF):
+		return 0, false, os.ErrClosed
+	}
+	return 0, false, fmt.Errorf("WintunReceivePacket: %w", err)
+}
+
+// Write writes one packet to the adapter. A packet that does not fit
+// in the ring buffer is dropped, like by a full queue of a Linux tun
+// device, and counted (see Dropped).
+func (t *TUN) Write(b []byte) (int, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.closed {
+		return 0, os.ErrClosed
+	}
+	r1, _, err := wintun.allocateSendPacket.Call(t.session, uintptr(len(b)))
+	if r1 == 0 {
+		if errors.Is(err, errorBufferOverflow) {
+			t.dropped.Add(1)
+			return len(b), nil
+		}
+		if errors.Is(err, errorHandleEOF) {
+			return 0, os.ErrClosed
+		}
+		return 0, fmt.Errorf("WintunAllocateSendPacket: %w", err)
+	}
+	copy(packetBytes(r1, len(b)), b)
+	wintun.sendPacket.Call(t.session, r1)
+	return len(b), nil
+}
+
+// Dropped returns the number of packets Write has dropped because the
+// ring buffer of the session was full.
+func (t *TUN) Dropped() uint64 {
+	return t.dropped.Load()
+}
+
+// SetNonblock does nothing, Read always honours SetReadDeadline.
+func (t *TUN) SetNonblock() error {
+	return nil
+}
+
+// SetReadDeadline makes a pending and future Read return
+// os.ErrDeadlineExceeded after deadline, the zero time clears it.
+func (t *TUN) SetReadDeadline(deadline time.Time) error {
+	if deadline.IsZero() {
+		t.deadline.Store(0)
+	} else {
+		t.deadline.Store(deadline.UnixNano())
+	}
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.closed {
+		return os.ErrClosed
+	}
+	// A pending Read waits with the previous deadline.
+	return windows.SetEvent(t.wakeEvent)
+}
+
+// Close ends the session and removes the adapter, waking a pending
+// Read first so that it releases the session.
+func (t *TUN) Close() error {
+	if !t.closing.CompareAndSwap(false, true) {
+		return os.ErrClosed
+	}
+	windows.SetEvent(t.wakeEvent)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.closed = true
+	wintun.endSession.Call(t.session)
+	wintun.closeAdapter.Call(t.adapter)
+	windows.CloseHandle(t.wakeEvent)
+	return nil
+}
+
+// netsh runs netsh with args, returning its output in the error if it
+// fails. An object that already exists is reported as syscall.EEXIST.
+func netsh(args ...string) error {
+	out, err := exec.Command("netsh", args...).CombinedOutput()
+	if err != nil {
+		output := strings.TrimSpace(string(out))
+		if strings.Contains(strings.ToLower(output), "already exists") {
+			return fmt.Errorf("netsh %s: %w: %s", strings.Join(args, " "), syscall.EEXIST, output)
+		}
+		return fmt.Errorf("netsh %s: %w: %s", strings.Join(args, " "), err, output)
+	}
+	return nil
+}
+
+// SetMTU sets the IPv4 and IPv6 MTU of the adapter (netsh, not
+// persisted).
+func (t *TUN) SetMTU(mtu int) error {
+	for _, family := range []string{"ipv4", "ipv6"} {
+		if err := netsh("interface", family, "set", "subinterface", t.Name, "mtu="+strconv.Itoa(mtu), "store=active"); err != nil && family == "ipv4" {
+			return fmt.Errorf("failed to set MTU of TUN device: %w", err)
+		}
+	}
+	return nil
+}
+
+// MTU returns the current MTU of the adapter.
+func (t *TUN) MTU() (int, error) {
+	iface, err := net.InterfaceByName(t.Name)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get MTU of TUN device: %w", err)
+	}
+	return iface.MTU, nil
+}
+
+// ipv4AndMask splits an IPv4 address with CIDR into the address and
+// dotted netmask netsh takes.
+func ipv4AndMask(ipv4_address_with_cidr string) (string, string, error) {
+	ip, ipnet, err := net.ParseCIDR(ipv4_address_with_cidr)
+	if err != nil {
+		return "", "", err
+	}
+	if ip.To4() == nil {
+		return "", "", ErrInvalidAddress
+	}
+	return ip.String(), net.IP(ipnet.Mask).String(), nil
+}
+
+// ConfigureInterface sets the IPv4 address with CIDR of the adapter.
+func (t *TUN) ConfigureInterface(ipv4_address_with_cidr string) error {
+	ip, mask, err := ipv4AndMask(ipv4_address_with_cidr)
+	if err != nil {
+		return err
+	}
+	return netsh("interface", "ipv4", "set", "address", "name="+t.Name, "source=static", "address="+ip, "mask="+mask, "store=active")
+}
+
+// ConfigurePeer configures the adapter like ConfigureInterface and
+// adds a host route to peer through it, Windows has no point-to-point
+// addresses.
+func (t *TUN) ConfigurePeer(ipv4_address_with_cidr, peer string) error {
+	peerIP := net.ParseIP(peer).To4()
+	if peerIP == nil {
+		return fmt.Errorf("%w: peer %q is not an IPv4 address", ErrInvalidAddress, peer)
+	}
+	if err := t.ConfigureInterface(ipv4_address_with_cidr); err != nil {
+		return err
+	}
+	if err := t.AddRoute(peerIP.String()+"/32", ""); err != nil && !errors.Is(err, syscall.EEXIST) {
+		return err
+	}
+	return nil
+}
+
+// AddAddress adds an additional IPv4 address with CIDR to the
+// adapter, n is only used on Linux.
+func (t *TUN) AddAddress(n int, ipv4_address_with_cidr string) error {
+	ip, mask, err := ipv4AndMask(ipv4_address_with_cidr)
+	if err != nil {
+		return err
+	}
+	return netsh("interface", "ipv4", "add", "address", "name="+t.Name, "address="+ip, "mask="+mask, "store=active")
+}
+
+// IPv6Supported returns nil, IPv6 is always available on Windows.
+func (t *TUN) IPv6Supported() error {
+	return nil
+}
+
+// ConfigureInterface6 adds an IPv6 address with prefix length (e.g
+// fd00::2/64) to the adapter.
+func (t *TUN) ConfigureInterface6(ipv6_address_with_prefix string) error {
+	ipv6, _, err := net.ParseCIDR(ipv6_address_with_prefix)
+	if err != nil {
+		return err
+	}
+	if ipv6.To4() != nil || ipv6.To16() == nil {
+		return ErrInvalidAddress
+	}
+	return netsh("interface", "ipv6", "add", "address", "interface="+t.Name, "address="+ipv6_address_with_prefix, "store=active")
+}
+
+// LinkUp does nothing, the adapter is up while its session runs.
+func (t *TUN) LinkUp() error {
+	return nil
+}
+
+// AddRoute adds an IPv4 route to destination (e.g 10.0.0.0/8) through
+// the adapter, via gateway if not empty. An existing route returns an
+// error wrapping syscall.EEXIST.
+func (t *TUN) AddRoute(destination, gateway string) error {
+	return AddDeviceRoute(t.Name, destination, gateway)
+}
+
+// DelRoute deletes a route added with AddRoute.
+func (t *TUN) DelRoute(destination, gateway string) error {
+	return DelDeviceRoute(t.Name, destination, gateway)
+}
+
+// AddDeviceRoute adds an IPv4 route to destination through the
+// interface named device, via gateway if not empty.
+func AddDeviceRoute(device, destination, gateway string) error {
+	return netsh(routeArgs("add", device, destination, gateway)...)
+}
+
+// DelDeviceRoute deletes a route added with AddDeviceRoute.
+func DelDeviceRoute(device, destination, gateway string) error {
+	return netsh(routeArgs("delete", device, destination, gateway)...)
+}
+
+func routeArgs(command, device, destination, gateway string) []string {
+	args := []string{"interface", "ipv4", command, "route", "prefix=" + destination, "interface=" + device}
+	if gateway != "" {
+		args = append(args, "nexthop="+gateway)
+	}
+	return append(args, "store=active")
+}
+
+// JoinBridge is not supported, there are no tap devices.
+func (t *TUN) JoinBridge(bridge string) error {
+	return fmt.Errorf("bridge: %w", ErrNotSupported)
+}
+
+// LeaveBridge is not supported, there are no tap devices.
+func (t *TUN) LeaveBridge(bridge string) error {
+	return fmt.Errorf("bridge: %w", ErrNotSupported)
+}
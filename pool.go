@@ -0,0 +1,113 @@
+package sshtun
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+)
+
+const (
+	// POOL_PREFIX is the prefix length of the network assigned to a
+	// tunnel from AddressPool, the local end gets the first and the
+	// remote end the second host address.
+	POOL_PREFIX int = 30
+)
+
+var (
+	ErrPoolExhausted error = errors.New("address pool exhausted")
+)
+
+// addressPool parses AddressPool, an IPv4 network with room for at
+// least one POOL_PREFIX network.
+func (t *Tunnels) addressPool() (*net.IPNet, error) {
+	_, pool, err := net.ParseCIDR(t.AddressPool)
+	if err != nil {
+		return nil, err
+	}
+	if pool.IP.To4() == nil {
+		return nil, fmt.Errorf("%q is not an IPv4 network", t.AddressPool)
+	}
+	if ones, _ := pool.Mask.Size(); ones > POOL_PREFIX {
+		return nil, fmt.Errorf("%q is smaller than a /%d", t.AddressPool, POOL_PREFIX)
+	}
+	return pool, nil
+}
+
+// AssignAddresses gives every tun tunnel with both local_network and
+// remote_network empty a /30 (POOL_PREFIX) from AddressPool, chosen
+// by a hash of the tunnel name and moved to the next free /30 if it
+// overlaps the network of another tunnel. Assigned tunnels are marked
+// with AddressFromPool, save the configuration (SaveConfig) to keep
+// the addresses stable when tunnels are added or renamed. Returns the
+// names of the tunnels assigned, nothing is assigned if AddressPool is
+// empty.
+func (t *Tunnels) AssignAddresses() ([]string, error) {
+	if t.AddressPool == "" {
+		return nil, nil
+	}
+	pool, err := t.addressPool()
+	if err != nil {
+		return nil, fmt.Errorf("%w: address_pool: %w", ErrInvalidConfig, err)
+	}
+	var taken []*net.IPNet
+	for _, tunnel := range t.Tunnels {
+		if tunnel == nil {
+			continue
+		}
+		for _, address := range []string{tunnel.LocalNetwork, tunnel.RemoteNetwork} {
+			if _, network, err := net.ParseCIDR(address); err == nil {
+				taken = append(taken, network)
+			}
+		}
+	}
+	overlaps := func(network *net.IPNet) bool {
+		for _, n := range taken {
+			if n.Contains(network.IP) || network.Contains(n.IP) {
+				return true
+			}
+		}
+		return false
+	}
+	ones, _ := pool.Mask.Size()
+	blocks := uint32(1) << (POOL_PREFIX - ones)
+	base := binary.BigEndian.Uint32(pool.IP.To4())
+	var assigned []string
+	for _, tunnel := range t.Tunnels {
+		if tunnel == nil || tunnel.forwarding() || tunnel.bridging() || tunnel.LocalNetwork != "" || tunnel.RemoteNetwork != "" {
+			continue
+		}
+		h := fnv.New32a()
+		h.Write([]byte(tunnel.Name))
+		start := h.Sum32() % blocks
+		var network *net.IPNet
+		for i := uint32(0); i < blocks; i++ {
+			ip := make(net.IP, net.IPv4len)
+			binary.BigEndian.PutUint32(ip, base+((start+i)%blocks)<<(32-POOL_PREFIX))
+			candidate := &net.IPNet{IP: ip, Mask: net.CIDRMask(POOL_PREFIX, 32)}
+			if !overlaps(candidate) {
+				network = candidate
+				break
+			}
+		}
+		if network == nil {
+			return assigned, fmt.Errorf("%w: no free /%d in %s for tunnel %q", ErrPoolExhausted, POOL_PREFIX, t.AddressPool, tunnel.Name)
+		}
+		taken = append(taken, network)
+		host := binary.BigEndian.Uint32(network.IP)
+		tunnel.LocalNetwork = hostAddress(host+1, POOL_PREFIX)
+		tunnel.RemoteNetwork = hostAddress(host+2, POOL_PREFIX)
+		tunnel.AddressFromPool = true
+		assigned = append(assigned, tunnel.Name)
+		t.logger().Info(fmt.Sprintf("Assigned %s and %s to tunnel %s from address pool %s", tunnel.LocalNetwork, tunnel.RemoteNetwork, tunnel.Name, t.AddressPool), "name", tunnel.Name, "local_net", tunnel.LocalNetwork, "remote_net", tunnel.RemoteNetwork, "address_pool", t.AddressPool)
+	}
+	return assigned, nil
+}
+
+// hostAddress formats the IPv4 address ip with prefix length ones.
+func hostAddress(ip uint32, ones int) string {
+	b := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(b, ip)
+	return fmt.Sprintf("%s/%d", b, ones)
+}
@@ -0,0 +1,118 @@
+package sshtun
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAssignAddresses(t *testing.T) {
+	newTunnel := func(name string) *SSHTUN {
+		s := NewSecureShellTunneler(nil)
+		s.Name = name
+		s.LocalNetwork, s.RemoteNetwork = "", ""
+		return s
+	}
+	a, b, c := newTunnel("a"), newTunnel("b"), newTunnel("c")
+	manual := NewSecureShellTunneler(nil)
+	manual.Name = "manual"
+	manual.LocalNetwork, manual.RemoteNetwork = "172.30.0.1/24", "172.30.0.2/24"
+	tunnels := &Tunnels{Tunnels: []*SSHTUN{a, manual, b, c}, AddressPool: "172.30.0.0/23"}
+	assigned, err := tunnels.AssignAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(assigned) != 3 || assigned[0] != "a" || assigned[1] != "b" || assigned[2] != "c" {
+		t.Fatalf("expected a, b and c to be assigned, got %q", assigned)
+	}
+	if manual.LocalNetwork != "172.30.0.1/24" || manual.AddressFromPool {
+		t.Errorf("expected a configured network to be kept, got %s", manual.LocalNetwork)
+	}
+	_, pool, _ := net.ParseCIDR(tunnels.AddressPool)
+	_, taken, _ := net.ParseCIDR(manual.LocalNetwork)
+	seen := make(map[string]bool)
+	for _, s := range []*SSHTUN{a, b, c} {
+		if !s.AddressFromPool {
+			t.Errorf("%s: expected address_from_pool to be set", s.Name)
+		}
+		local, network, err := net.ParseCIDR(s.LocalNetwork)
+		if err != nil {
+			t.Fatalf("%s: %v", s.Name, err)
+		}
+		remote, _, err := net.ParseCIDR(s.RemoteNetwork)
+		if err != nil {
+			t.Fatalf("%s: %v", s.Name, err)
+		}
+		if ones, _ := network.Mask.Size(); ones != POOL_PREFIX || !pool.Contains(local) || taken.Contains(local) || !network.Contains(remote) || local.Equal(remote) {
+			t.Errorf("%s: unexpected networks %s and %s", s.Name, s.LocalNetwork, s.RemoteNetwork)
+		}
+		if seen[network.String()] {
+			t.Errorf("%s: %s assigned twice", s.Name, network)
+		}
+		seen[network.String()] = true
+		if _, err := s.ValidateAddressing(); err != nil {
+			t.Errorf("%s: %v", s.Name, err)
+		}
+	}
+
+	// The same configuration gets the same networks.
+	again := &Tunnels{Tunnels: []*SSHTUN{newTunnel("a"), manual, newTunnel("b"), newTunnel("c")}, AddressPool: tunnels.AddressPool}
+	if _, err := again.AssignAddresses(); err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range tunnels.Tunnels {
+		if again.Tunnels[i].LocalNetwork != s.LocalNetwork {
+			t.Errorf("%s: expected %s again, got %s", s.Name, s.LocalNetwork, again.Tunnels[i].LocalNetwork)
+		}
+	}
+	if assigned, err := tunnels.AssignAddresses(); err != nil || len(assigned) != 0 {
+		t.Errorf("expected nothing to assign twice, got %q and %v", assigned, err)
+	}
+
+	full := &Tunnels{Tunnels: []*SSHTUN{newTunnel("a"), newTunnel("b")}, AddressPool: "172.30.0.0/30"}
+	if _, err := full.AssignAddresses(); !errors.Is(err, ErrPoolExhausted) {
+		t.Errorf("expected %v, got: %v", ErrPoolExhausted, err)
+	}
+	bad := &Tunnels{Tunnels: []*SSHTUN{newTunnel("a")}, AddressPool: "172.30.0.0/31"}
+	if _, err := bad.AssignAddresses(); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("expected %v, got: %v", ErrInvalidConfig, err)
+	}
+	if err := bad.Validate(); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("expected Validate to refuse address_pool, got: %v", err)
+	}
+}
+
+func TestLoadConfigAddressPool(t *testing.T) {
+	s := NewSecureShellTunneler(nil)
+	s.LocalNetwork, s.RemoteNetwork = "", ""
+	pth := filepath.Join(t.TempDir(), "sshtun.json")
+	if err := (&Tunnels{Tunnels: []*SSHTUN{s}, AddressPool: "10.99.0.0/16"}).SaveConfig(pth); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadConfig(pth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unsaved := loaded.UnsavedAddresses(); len(unsaved) != 1 || loaded.Tunnels[0].LocalNetwork == "" {
+		t.Fatalf("expected LoadConfig to assign addresses, got %q", unsaved)
+	}
+	if err := loaded.SaveConfig(pth); err != nil {
+		t.Fatal(err)
+	}
+	if unsaved := loaded.UnsavedAddresses(); len(unsaved) != 0 {
+		t.Errorf("expected SaveConfig to clear the unsaved addresses, got %q", unsaved)
+	}
+	b, err := os.ReadFile(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := LoadConfig(pth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reloaded.UnsavedAddresses()) != 0 || reloaded.Tunnels[0].LocalNetwork != loaded.Tunnels[0].LocalNetwork || !reloaded.Tunnels[0].AddressFromPool {
+		t.Errorf("expected the saved addresses to be kept, got %s", string(b))
+	}
+}
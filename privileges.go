@@ -0,0 +1,62 @@
+package sshtun
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+)
+
+const (
+	// PRIVILEGES_ROOT is a process running as root.
+	PRIVILEGES_ROOT string = "root"
+	// PRIVILEGES_SETUID is a setuid-root executable switching
+	// effective uid to root while creating the TUN device.
+	PRIVILEGES_SETUID string = "setuid"
+	// PRIVILEGES_CAPABILITIES is a process with CAP_NET_ADMIN in its
+	// effective set, from file capabilities (setcap cap_net_admin+ep)
+	// or AmbientCapabilities in a systemd unit.
+	PRIVILEGES_CAPABILITIES string = "capabilities"
+	// PRIVILEGES_ADMINISTRATOR is an elevated process on Windows
+	// (Run as administrator), able to create wintun adapters.
+	PRIVILEGES_ADMINISTRATOR string = "administrator"
+	// PRIVILEGES_NONE is a process unable to create TUN devices.
+	PRIVILEGES_NONE string = "none"
+)
+
+var (
+	ErrNoPrivileges      error = errors.New("insufficient privileges to create TUN devices")
+	ErrPrivilegesDropped error = errors.New("privileges have been dropped (drop_privileges), restart sshtun to create new TUN devices")
+	ErrDropAsRoot        error = errors.New("running as root, there is no calling user to drop privileges to")
+)
+
+// privilegesDropped is set by DropPrivileges.
+var privilegesDropped atomic.Bool
+
+// dropPrivileges is called by Tunnels once every tunnel is up,
+// replaced in tests.
+var dropPrivileges = DropPrivileges
+
+// CheckPrivileges returns an error wrapping ErrNoPrivileges
+// explaining how to grant them if Privileges is PRIVILEGES_NONE.
+func CheckPrivileges() error {
+	if Privileges() != PRIVILEGES_NONE {
+		return nil
+	}
+	return privilegesError(nil)
+}
+
+// PrivilegesDropped returns true if DropPrivileges has been called.
+func PrivilegesDropped() bool {
+	return privilegesDropped.Load()
+}
+
+// holdsPrivileges returns true if p (see Privileges) creates TUN
+// devices without switching effective uid.
+func holdsPrivileges(p string) bool {
+	return p == PRIVILEGES_CAPABILITIES || p == PRIVILEGES_ADMINISTRATOR
+}
+
+// switchesToRoot returns true if Become(ROOT) switches effective uid.
+func switchesToRoot() bool {
+	return os.Geteuid() != ROOT && !holdsPrivileges(Privileges())
+}
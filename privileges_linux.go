@@ -0,0 +1,162 @@
+//go:build linux
+
+package sshtun
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// CAP_NET_ADMIN is the capability needed to create and configure
+	// TUN devices.
+	CAP_NET_ADMIN int = 12
+
+	linuxCapabilityVersion3 uint32  = 0x20080522
+	vfsCapFlagsEffective    uint32  = 0x000001
+	prCapAmbient            uintptr = 47
+	prCapAmbientClearAll    uintptr = 4
+)
+
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+// HasNetAdmin returns true if CAP_NET_ADMIN is in the effective
+// capability set of the process (capget).
+func HasNetAdmin() bool {
+	header := capHeader{version: linuxCapabilityVersion3}
+	var data [2]capData
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPGET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return false
+	}
+	return data[CAP_NET_ADMIN/32].effective&(1<<(CAP_NET_ADMIN%32)) != 0
+}
+
+// FileHasNetAdmin returns true if the executable at pth has
+// cap_net_admin+ep in its security.capability extended attribute.
+func FileHasNetAdmin(pth string) bool {
+	buf := make([]byte, 64)
+	n, err := syscall.Getxattr(pth, "security.capability", buf)
+	if err != nil {
+		return false
+	}
+	return vfsCapNetAdmin(buf[:n])
+}
+
+// vfsCapNetAdmin returns true if data (struct vfs_cap_data) has the
+// effective flag set and CAP_NET_ADMIN in the permitted set.
+func vfsCapNetAdmin(data []byte) bool {
+	if len(data) < 12 {
+		return false
+	}
+	magic := binary.LittleEndian.Uint32(data)
+	permitted := binary.LittleEndian.Uint32(data[4+8*(CAP_NET_ADMIN/32):])
+	return magic&vfsCapFlagsEffective != 0 && permitted&(1<<(CAP_NET_ADMIN%32)) != 0
+}
+
+// Privileges returns how this process gains the privileges needed to
+// create TUN devices: PRIVILEGES_ROOT, PRIVILEGES_SETUID (real uid is
+// not root, but the effective or saved uid is),
+// PRIVILEGES_CAPABILITIES or PRIVILEGES_NONE.
+func Privileges() string {
+	var r, e, s int32
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_GETRESUID, uintptr(unsafe.Pointer(&r)), uintptr(unsafe.Pointer(&e)), uintptr(unsafe.Pointer(&s))); errno != 0 {
+		r, e, s = int32(os.Getuid()), int32(os.Geteuid()), -1
+	}
+	ruid, euid, suid := int(r), int(e), int(s)
+	switch {
+	case ruid == ROOT && euid == ROOT:
+		return PRIVILEGES_ROOT
+	case euid == ROOT || suid == ROOT:
+		return PRIVILEGES_SETUID
+	case HasNetAdmin():
+		return PRIVILEGES_CAPABILITIES
+	}
+	return PRIVILEGES_NONE
+}
+
+// privilegesError returns an error wrapping ErrNoPrivileges (and err
+// if not nil) listing the three ways to run sshtun.
+func privilegesError(err error) error {
+	executable, xerr := os.Executable()
+	if xerr != nil {
+		executable = "sshtun"
+	}
+	msg := fmt.Sprintf("either grant CAP_NET_ADMIN (sudo setcap cap_net_admin+ep %s), make it setuid root (sudo chown 0:0 %s; sudo chmod 4755 %s) or run it as root", executable, executable, executable)
+	if FileHasNetAdmin(executable) {
+		msg = fmt.Sprintf("%s has cap_net_admin+ep, but the process did not get it (file system mounted nosuid or NoNewPrivileges without AmbientCapabilities?), %s", executable, msg)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrNoPrivileges, msg, err)
+	}
+	return fmt.Errorf("%w: %s", ErrNoPrivileges, msg)
+}
+
+// setCallingUser irreversibly sets the real, effective and saved uid
+// and gid to the calling (real) user, leaving capabilities as they
+// are. Returns ErrDropAsRoot if the calling user is root.
+func setCallingUser() error {
+	uid, gid := os.Getuid(), os.Getgid()
+	if uid == ROOT {
+		return ErrDropAsRoot
+	}
+	if err := syscall.Setresgid(gid, gid, gid); err != nil {
+		return fmt.Errorf("setresgid %d: %w", gid, err)
+	}
+	if err := syscall.Setresuid(uid, uid, uid); err != nil {
+		return fmt.Errorf("setresuid %d: %w", uid, err)
+	}
+	return nil
+}
+
+// DropPrivileges irreversibly drops to the calling (real) uid and gid
+// with setresuid/setresgid, clears all capabilities and stops the
+// privileged helper. Afterwards, creating TUN devices fails with
+// ErrPrivilegesDropped. Returns ErrDropAsRoot if the calling user is
+// root.
+func DropPrivileges() error {
+	privop.mutex.Lock()
+	if privop.client != nil {
+		privop.client.Close()
+		privop.client = nil
+	}
+	privilegesDropped.Store(true)
+	privop.mutex.Unlock()
+
+	setuid := Privileges() == PRIVILEGES_SETUID
+	if err := setCallingUser(); err != nil {
+		return err
+	}
+	// Capabilities are per thread, clear them on all of them. With cgo,
+	// AllThreadsSyscall is not available (ENOTSUP), but leaving uid 0
+	// has already made the kernel clear them if we were setuid.
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientClearAll, 0); errno == syscall.ENOTSUP {
+		if !setuid {
+			return fmt.Errorf("unable to clear capabilities: %w (build with CGO_ENABLED=0)", errno)
+		}
+	} else {
+		if errno != 0 && errno != syscall.EINVAL {
+			return fmt.Errorf("unable to clear ambient capabilities: %w", errno)
+		}
+		header := capHeader{version: linuxCapabilityVersion3}
+		var data [2]capData
+		if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+			return fmt.Errorf("unable to clear capabilities: %w", errno)
+		}
+	}
+	if p := Privileges(); p != PRIVILEGES_NONE {
+		return fmt.Errorf("privileges are still %s after dropping them", p)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+//go:build linux
+
+package sshtun
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestVfsCapNetAdmin(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		// getcap: cap_net_admin=ep (VFS_CAP_REVISION_2)
+		{"net_admin+ep", []byte{0x01, 0x00, 0x00, 0x02, 0x00, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, true},
+		// cap_net_admin=p, not raised in the effective set on exec
+		{"net_admin+p", []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, false},
+		// cap_net_raw=ep
+		{"net_raw+ep", []byte{0x01, 0x00, 0x00, 0x02, 0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, false},
+		{"short", []byte{0x01, 0x00, 0x00, 0x02}, false},
+	} {
+		if got := vfsCapNetAdmin(c.data); got != c.want {
+			t.Errorf("%s: got %v, expected %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestPrivilegesError(t *testing.T) {
+	err := privilegesError(errors.New("operation not permitted"))
+	if !errors.Is(err, ErrNoPrivileges) {
+		t.Fatalf("expected ErrNoPrivileges, got %v", err)
+	}
+	for _, want := range []string{"setcap cap_net_admin+ep", "chmod 4755", "run it as root", "operation not permitted"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %q", want, err)
+		}
+	}
+}
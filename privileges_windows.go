@@ -0,0 +1,60 @@
+//go:build windows
+
+package sshtun
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/sa6mwa/sshtun/pkg/tun"
+)
+
+// tokenElevation is TokenElevation of TOKEN_INFORMATION_CLASS
+// (winnt.h).
+const tokenElevation uint32 = 20
+
+// IsElevated returns true if the process token is elevated (Run as
+// administrator).
+func IsElevated() bool {
+	token, err := syscall.OpenCurrentProcessToken()
+	if err != nil {
+		return false
+	}
+	defer token.Close()
+	var elevated, n uint32
+	if err := syscall.GetTokenInformation(token, tokenElevation, (*byte)(unsafe.Pointer(&elevated)), uint32(unsafe.Sizeof(elevated)), &n); err != nil {
+		return false
+	}
+	return elevated != 0
+}
+
+// Privileges returns PRIVILEGES_ADMINISTRATOR if the process is
+// elevated, otherwise PRIVILEGES_NONE.
+func Privileges() string {
+	if IsElevated() {
+		return PRIVILEGES_ADMINISTRATOR
+	}
+	return PRIVILEGES_NONE
+}
+
+// privilegesError returns an error wrapping ErrNoPrivileges (and err
+// if not nil) explaining how to run sshtun elevated.
+func privilegesError(err error) error {
+	executable, xerr := os.Executable()
+	if xerr != nil {
+		executable = "sshtun.exe"
+	}
+	msg := fmt.Sprintf("run %s as administrator (from an elevated command prompt or a service running as LocalSystem)", executable)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrNoPrivileges, msg, err)
+	}
+	return fmt.Errorf("%w: %s", ErrNoPrivileges, msg)
+}
+
+// DropPrivileges is not supported on Windows, an elevated process can
+// not give up its elevation.
+func DropPrivileges() error {
+	return fmt.Errorf("drop_privileges: %w", tun.ErrNotSupported)
+}
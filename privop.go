@@ -0,0 +1,34 @@
+package sshtun
+
+import (
+	"errors"
+)
+
+const (
+	// PRIVOP_FLAG is the only argument of the executable re-executed
+	// as privileged helper, see PrivOpMain.
+	PRIVOP_FLAG string = "-privop"
+)
+
+var (
+	ErrPrivOp error = errors.New("privileged helper")
+)
+
+// TUNRequest asks the privileged helper to create a tun device named
+// Device (a pattern like tun%d is allowed) with MTU, configure it with
+// Network (and Network6 if not empty) and link it up. With TAP a tap
+// device is created instead, enslaved into Bridge if not empty rather
+// than configured with the networks. Peer is the address of the other
+// end if Network is point-to-point (see tun.PointToPoint). UID and GID
+// (if above 0) own the device.
+type TUNRequest struct {
+	Device   string `json:"device"`
+	MTU      int    `json:"mtu"`
+	Network  string `json:"network"`
+	Network6 string `json:"network6,omitempty"`
+	Peer     string `json:"peer,omitempty"`
+	TAP      bool   `json:"tap,omitempty"`
+	Bridge   string `json:"bridge,omitempty"`
+	UID      int    `json:"uid,omitempty"`
+	GID      int    `json:"gid,omitempty"`
+}
@@ -0,0 +1,359 @@
+//go:build linux
+
+package sshtun
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+
+	"github.com/sa6mwa/sshtun/pkg/tun"
+)
+
+const (
+	// privopFd is the socket inherited by the privileged helper
+	// (first of exec.Cmd.ExtraFiles).
+	privopFd        int    = 3
+	privopBufSize   int    = 4096
+	privopSelfExe   string = "/proc/self/exe"
+	privopReadyName string = "ready"
+)
+
+type privopResponse struct {
+	Device string `json:"device,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// PrivOp is a privileged child process, this executable re-executed
+// with PRIVOP_FLAG, creating tun devices on behalf of an unprivileged
+// parent and passing them back as file descriptors (SCM_RIGHTS) over
+// a unix socket pair. The child exits when the socket is closed.
+type PrivOp struct {
+	mutex *sync.Mutex
+	conn  *net.UnixConn
+	cmd   *exec.Cmd
+}
+
+var privop = struct {
+	mutex   sync.Mutex
+	enabled bool
+	client  *PrivOp
+	// leftRoot is set once this process has switched to the calling
+	// user after starting the helper.
+	leftRoot bool
+}{}
+
+// PrivOpMain must be called first in main of a program using Open to
+// move privileged operations to a child process. If the process was
+// started as the privileged helper (PRIVOP_FLAG), PrivOpMain serves
+// requests and exits, otherwise it enables the privileged helper for
+// this process and returns. Once the helper has been started, this
+// process irreversibly switches to the calling user (setresuid), a
+// setuid-root executable regains root only in the re-executed
+// helper. Without PrivOpMain, Open switches effective uid in-process
+// instead.
+func PrivOpMain() {
+	if len(os.Args) == 2 && os.Args[1] == PRIVOP_FLAG {
+		os.Exit(ServePrivOp())
+	}
+	privop.mutex.Lock()
+	privop.enabled = true
+	privop.mutex.Unlock()
+}
+
+// privopEnabled returns true if PrivOpMain has enabled the privileged
+// helper.
+func privopEnabled() bool {
+	privop.mutex.Lock()
+	defer privop.mutex.Unlock()
+	return privop.enabled
+}
+
+// privopCreateTUN creates a tun device through the privileged helper
+// of this process, starting it if not running. If the helper has
+// died, it is restarted once.
+func privopCreateTUN(req TUNRequest) (*tun.TUN, error) {
+	privop.mutex.Lock()
+	defer privop.mutex.Unlock()
+	if privilegesDropped.Load() {
+		return nil, ErrPrivilegesDropped
+	}
+	for attempt := 0; ; attempt++ {
+		if privop.client == nil {
+			client, err := StartPrivOp()
+			if err != nil {
+				return nil, err
+			}
+			privop.client = client
+			if !privop.leftRoot {
+				// Started as root there is no calling user to switch
+				// to, keep running as root.
+				if err := setCallingUser(); err != nil && !errors.Is(err, ErrDropAsRoot) {
+					return nil, fmt.Errorf("unable to switch to the calling user: %w", err)
+				}
+				privop.leftRoot = true
+			}
+		}
+		t, err := privop.client.CreateTUN(req)
+		if err == nil || errors.Is(err, ErrPrivOp) || attempt > 0 {
+			return t, err
+		}
+		// Transport error, the helper is gone.
+		privop.client.Close()
+		privop.client = nil
+	}
+}
+
+// StartPrivOp re-executes this executable with PRIVOP_FLAG as the
+// privileged helper and waits until it reports that it is ready. A
+// setuid executable regains root on exec, file capabilities are
+// applied again and root or ambient capabilities are inherited.
+func StartPrivOp() (*PrivOp, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("socketpair: %w", err)
+	}
+	parent := os.NewFile(uintptr(fds[0]), "privop")
+	child := os.NewFile(uintptr(fds[1]), "privop")
+	defer child.Close()
+	conn, err := unixConn(parent)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(privopSelfExe, PRIVOP_FLAG)
+	cmd.ExtraFiles = []*os.File{child}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to start privileged helper: %w", err)
+	}
+	p := newPrivOp(conn)
+	p.cmd = cmd
+	if err := p.ready(); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func newPrivOp(conn *net.UnixConn) *PrivOp {
+	return &PrivOp{
+		mutex: &sync.Mutex{},
+		conn:  conn,
+	}
+}
+
+// ready reads the first message of the helper which carries an error
+// if it lacks the privileges to create tun devices.
+func (p *PrivOp) ready() error {
+	resp, _, err := p.receive()
+	if err != nil {
+		return fmt.Errorf("privileged helper did not start: %w", err)
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%w: %s", ErrPrivOp, resp.Error)
+	}
+	if resp.Device != privopReadyName {
+		return fmt.Errorf("%w: unexpected greeting %q", ErrPrivOp, resp.Device)
+	}
+	return nil
+}
+
+// CreateTUN asks the helper to create and configure a tun device as
+// described by req and returns it. Errors from the helper wrap
+// ErrPrivOp, any other error means the helper is gone.
+func (p *PrivOp) CreateTUN(req TUNRequest) (*tun.TUN, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := p.conn.WriteMsgUnix(b, nil, nil); err != nil {
+		return nil, err
+	}
+	resp, fds, err := p.receive()
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		closeAll(fds)
+		return nil, fmt.Errorf("%w: %s", ErrPrivOp, resp.Error)
+	}
+	if len(fds) != 1 {
+		closeAll(fds)
+		return nil, fmt.Errorf("%w: expected 1 file descriptor, got %d", ErrPrivOp, len(fds))
+	}
+	t, err := tun.FromFd(resp.Device, fds[0])
+	if err != nil {
+		syscall.Close(fds[0])
+		return nil, fmt.Errorf("%w: %w", ErrPrivOp, err)
+	}
+	return t, nil
+}
+
+func (p *PrivOp) receive() (privopResponse, []int, error) {
+	var resp privopResponse
+	buf := make([]byte, privopBufSize)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := p.conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return resp, nil, err
+	}
+	if n == 0 {
+		return resp, nil, fmt.Errorf("privileged helper closed the connection")
+	}
+	var fds []int
+	if oobn > 0 {
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return resp, nil, err
+		}
+		for _, msg := range msgs {
+			rights, err := syscall.ParseUnixRights(&msg)
+			if err != nil {
+				closeAll(fds)
+				return resp, nil, err
+			}
+			fds = append(fds, rights...)
+		}
+	}
+	if err := json.Unmarshal(buf[:n], &resp); err != nil {
+		closeAll(fds)
+		return resp, nil, err
+	}
+	return resp, fds, nil
+}
+
+// Close closes the socket, making the helper exit, and waits for it.
+func (p *PrivOp) Close() error {
+	err := p.conn.Close()
+	if p.cmd != nil {
+		p.cmd.Wait()
+	}
+	return err
+}
+
+// ServePrivOp is the privileged helper started by StartPrivOp. It
+// serves TUNRequests on the inherited socket until it is closed and
+// returns the exit code.
+func ServePrivOp() int {
+	conn, err := unixConn(os.NewFile(uintptr(privopFd), "privop"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "privop:", err)
+		return 1
+	}
+	defer conn.Close()
+	if err := servePrivOp(conn, CheckPrivileges(), setupTUN); err != nil {
+		fmt.Fprintln(os.Stderr, "privop:", err)
+		return 1
+	}
+	return 0
+}
+
+// servePrivOp greets the parent (with privErr if not nil) and answers
+// requests using setup until the connection is closed.
+func servePrivOp(conn *net.UnixConn, privErr error, setup func(TUNRequest) (*tun.TUN, error)) error {
+	greeting := privopResponse{Device: privopReadyName}
+	if privErr != nil {
+		greeting = privopResponse{Error: privErr.Error()}
+	}
+	if err := sendResponse(conn, greeting, nil); err != nil || privErr != nil {
+		return err
+	}
+	buf := make([]byte, privopBufSize)
+	for {
+		n, _, _, _, err := conn.ReadMsgUnix(buf, nil)
+		if err != nil || n == 0 {
+			// Parent closed the socket (or died).
+			return nil
+		}
+		var req TUNRequest
+		if err := json.Unmarshal(buf[:n], &req); err != nil {
+			if err := sendResponse(conn, privopResponse{Error: "invalid request: " + err.Error()}, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		t, err := setup(req)
+		if err != nil {
+			if err := sendResponse(conn, privopResponse{Error: err.Error()}, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		err = sendResponse(conn, privopResponse{Device: t.Name}, syscall.UnixRights(int(t.File.Fd())))
+		// The parent holds its own copy of the descriptor now.
+		t.File.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func sendResponse(conn *net.UnixConn, resp privopResponse, oob []byte) error {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	_, _, err = conn.WriteMsgUnix(b, oob, nil)
+	return err
+}
+
+// setupTUN creates, configures and links up the tun device of req.
+func setupTUN(req TUNRequest) (*tun.TUN, error) {
+	create := tun.CreateTUN
+	if req.TAP {
+		create = tun.CreateTAP
+	}
+	t, err := create(req.Device, req.MTU, req.UID, req.GID)
+	if err != nil {
+		return nil, err
+	}
+	if req.Bridge != "" {
+		if err := t.JoinBridge(req.Bridge); err != nil {
+			t.File.Close()
+			return nil, err
+		}
+	} else if err := t.ConfigureAddress(req.Network, req.Peer); err != nil {
+		t.File.Close()
+		return nil, err
+	}
+	if req.Network6 != "" && req.Bridge == "" {
+		if err := t.ConfigureInterface6(req.Network6); err != nil {
+			t.File.Close()
+			return nil, err
+		}
+	}
+	if err := t.LinkUp(); err != nil {
+		t.File.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// unixConn returns f as a *net.UnixConn, f is closed.
+func unixConn(f *os.File) (*net.UnixConn, error) {
+	defer f.Close()
+	c, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	conn, ok := c.(*net.UnixConn)
+	if !ok {
+		c.Close()
+		return nil, fmt.Errorf("%w: %s is not a unix socket", ErrPrivOp, f.Name())
+	}
+	return conn, nil
+}
+
+func closeAll(fds []int) {
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+}
@@ -0,0 +1,96 @@
+//go:build linux
+
+package sshtun
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/sa6mwa/sshtun/pkg/tun"
+)
+
+// privopPair returns both ends of a SOCK_SEQPACKET socket pair.
+func privopPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	t.Helper()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns [2]*net.UnixConn
+	for i, fd := range fds {
+		conn, err := unixConn(os.NewFile(uintptr(fd), "privop"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = conn
+	}
+	return conns[0], conns[1]
+}
+
+func TestPrivOp(t *testing.T) {
+	parent, child := privopPair(t)
+	// The fake helper hands out the read end of a pipe instead of a
+	// tun device.
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	setup := func(req TUNRequest) (*tun.TUN, error) {
+		if req.Network != "172.18.0.1/24" {
+			return nil, errors.New("bad network " + req.Network)
+		}
+		return &tun.TUN{Name: "tun7", File: r, Fd: int(r.Fd())}, nil
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- servePrivOp(child, nil, setup)
+		child.Close()
+	}()
+
+	p := newPrivOp(parent)
+	if err := p.ready(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.CreateTUN(TUNRequest{Device: "tun%d", Network: "10.0.0.1/8"}); !errors.Is(err, ErrPrivOp) || !strings.Contains(err.Error(), "bad network 10.0.0.1/8") {
+		t.Fatalf("expected ErrPrivOp from setup, got %v", err)
+	}
+	got, err := p.CreateTUN(TUNRequest{Device: "tun%d", Network: "172.18.0.1/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "tun7" {
+		t.Errorf("expected device tun7, got %s", got.Name)
+	}
+	if _, err := w.Write([]byte("packet")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(got.File, buf); err != nil || string(buf) != "packet" {
+		t.Errorf("expected to read packet through the passed descriptor, got %q: %v", buf, err)
+	}
+	got.File.Close()
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("expected helper to exit cleanly on close, got %v", err)
+	}
+}
+
+func TestPrivOpNoPrivileges(t *testing.T) {
+	parent, child := privopPair(t)
+	defer child.Close()
+	go servePrivOp(child, privilegesError(nil), nil)
+	p := newPrivOp(parent)
+	defer p.Close()
+	if err := p.ready(); !errors.Is(err, ErrPrivOp) || !strings.Contains(err.Error(), "setcap") {
+		t.Errorf("expected ErrPrivOp explaining privileges, got %v", err)
+	}
+}
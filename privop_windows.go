@@ -0,0 +1,23 @@
+//go:build windows
+
+package sshtun
+
+import (
+	"fmt"
+
+	"github.com/sa6mwa/sshtun/pkg/tun"
+)
+
+// PrivOpMain does nothing on Windows, where a wintun adapter can not
+// be passed to another process: sshtun creates it in-process and has
+// to run elevated.
+func PrivOpMain() {}
+
+// privopEnabled always returns false on Windows.
+func privopEnabled() bool {
+	return false
+}
+
+func privopCreateTUN(req TUNRequest) (*tun.TUN, error) {
+	return nil, fmt.Errorf("%w: %w", ErrPrivOp, tun.ErrNotSupported)
+}
@@ -0,0 +1,124 @@
+package sshtun
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/sa6mwa/sshtun/pkg/tun"
+)
+
+// setTOS sets IP_TOS (IPV6_TCLASS if ipv6) of the socket fd to tos.
+func setTOS(fd uintptr, ipv6 bool, tos int) error {
+	if ipv6 {
+		return setsockoptInt(fd, syscall.IPPROTO_IPV6, ipv6TClass, tos)
+	}
+	return setsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+}
+
+// transportControl is the net.Dialer Control func of the connection
+// to the remote, setting TransportTOS on the socket before it
+// connects so that the handshake is marked too. Failing to set it is
+// logged and the connection made anyway.
+func (s *SSHTUN) transportControl(network, address string, c syscall.RawConn) error {
+	if s.TransportTOS == 0 {
+		return nil
+	}
+	ipv6 := network == "tcp6"
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = setTOS(fd, ipv6, s.TransportTOS)
+	}); err != nil {
+		serr = err
+	}
+	if serr != nil {
+		s.log().Debug("Unable to set transport TOS", "name", s.Name, "remote", s.Remote, "transport_tos", s.TransportTOS, "error", fmt.Errorf("setsockopt: %w", serr))
+		return nil
+	}
+	s.log().Debug("Applied transport TOS", "name", s.Name, "remote", s.Remote, "address", address, "transport_tos", s.TransportTOS)
+	return nil
+}
+
+// dscpWriter raises the TOS of the transport socket to the DSCP of
+// the packets written to the tunnel when any of them is at or above
+// threshold, and restores base once none is. The packets written in
+// one write share the highest DSCP among them. Best-effort: the ssh
+// connection multiplexes and may resend data written before the
+// change, so the marking follows the tunneled packets only roughly.
+type dscpWriter struct {
+	w         io.Writer
+	conn      syscall.RawConn
+	ipv6      bool
+	base      int
+	threshold int
+	current   int
+	failed    bool
+	s         *SSHTUN
+}
+
+// newDSCPWriter returns w wrapped in a dscpWriter for the transport
+// conn if CopyDSCP is set and conn is a TCP connection, otherwise w.
+func (s *SSHTUN) newDSCPWriter(w io.Writer, conn net.Conn) io.Writer {
+	if s.CopyDSCP == 0 {
+		return w
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return w
+	}
+	rc, err := tcp.SyscallConn()
+	if err != nil {
+		s.log().Debug("Unable to copy DSCP to the transport", "name", s.Name, "remote", s.Remote, "error", err)
+		return w
+	}
+	addr, _ := tcp.RemoteAddr().(*net.TCPAddr)
+	return &dscpWriter{
+		w:         w,
+		conn:      rc,
+		ipv6:      addr != nil && addr.IP.To4() == nil,
+		base:      s.TransportTOS,
+		threshold: s.CopyDSCP,
+		current:   s.TransportTOS,
+		s:         s,
+	}
+}
+
+// tos returns the TOS for the packets in b: the highest DSCP at or
+// above threshold (shifted past the ECN bits) or base.
+func (d *dscpWriter) tos(b []byte) int {
+	highest := -1
+	for len(b) > 0 {
+		length := tun.PacketLength(b)
+		if length <= 0 || length > len(b) {
+			length = len(b)
+		}
+		if dscp := tun.DSCP(b); dscp >= d.threshold && dscp > highest {
+			highest = dscp
+		}
+		b = b[length:]
+	}
+	if highest < 0 {
+		return d.base
+	}
+	return highest << 2
+}
+
+func (d *dscpWriter) Write(b []byte) (int, error) {
+	if tos := d.tos(b); tos != d.current && !d.failed {
+		var serr error
+		if err := d.conn.Control(func(fd uintptr) {
+			serr = setTOS(fd, d.ipv6, tos)
+		}); err != nil {
+			serr = err
+		}
+		if serr != nil {
+			// Do not try again for every write.
+			d.failed = true
+			d.s.log().Debug("Unable to copy DSCP to the transport", "name", d.s.Name, "remote", d.s.Remote, "error", fmt.Errorf("setsockopt: %w", serr))
+		} else {
+			d.current = tos
+		}
+	}
+	return d.w.Write(b)
+}
@@ -0,0 +1,116 @@
+//go:build linux
+
+package sshtun
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"syscall"
+	"testing"
+)
+
+// socketTOS returns IP_TOS (IPV6_TCLASS if ipv6) of conn.
+func socketTOS(t *testing.T, conn net.Conn, ipv6 bool) int {
+	t.Helper()
+	rc, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tos int
+	var serr error
+	rc.Control(func(fd uintptr) {
+		if ipv6 {
+			tos, serr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS)
+		} else {
+			tos, serr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS)
+		}
+	})
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	return tos
+}
+
+func TestTransportTOS(t *testing.T) {
+	for _, tc := range []struct {
+		network, address string
+		ipv6             bool
+	}{
+		{"tcp4", "127.0.0.1:0", false},
+		{"tcp6", "[::1]:0", true},
+	} {
+		l, err := net.Listen(tc.network, tc.address)
+		if err != nil {
+			t.Logf("%s: %v", tc.network, err)
+			continue
+		}
+		defer l.Close()
+		s := NewSecureShellTunneler(nil)
+		s.TransportTOS = 0xb8
+		d := net.Dialer{Control: s.transportControl}
+		conn, err := d.DialContext(context.Background(), "tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if tos := socketTOS(t, conn, tc.ipv6); tos != 0xb8 {
+			t.Errorf("%s: expected TOS 0xb8, got %#x", tc.network, tos)
+		}
+	}
+}
+
+func TestDSCPWriter(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	s := NewSecureShellTunneler(nil)
+	s.TransportTOS = 0x20
+	d := net.Dialer{Control: s.transportControl}
+	conn, err := d.DialContext(context.Background(), "tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	packet := func(tos byte) []byte {
+		b := make([]byte, 40)
+		b[0], b[1], b[3] = 0x45, tos, 40
+		return b
+	}
+
+	var out bytes.Buffer
+	if w := s.newDSCPWriter(&out, conn); w != &out {
+		t.Error("expected no dscpWriter without copy_dscp")
+	}
+	s.CopyDSCP = 40
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if w := s.newDSCPWriter(&out, a); w != &out {
+		t.Error("expected no dscpWriter on a connection that is not TCP")
+	}
+	w := s.newDSCPWriter(&out, conn)
+	for _, tc := range []struct {
+		name  string
+		batch []byte
+		want  int
+	}{
+		{"below the threshold", packet(0x28), 0x20},
+		{"voice", append(packet(0x28), packet(0xb8)...), 0xb8},
+		{"cs5 after voice", packet(0xa0), 0xa0},
+		{"best effort", packet(0), 0x20},
+		{"not a packet", []byte("hello"), 0x20},
+	} {
+		if _, err := w.Write(tc.batch); err != nil {
+			t.Fatal(err)
+		}
+		if tos := socketTOS(t, conn, false); tos != tc.want {
+			t.Errorf("%s: expected TOS %#x, got %#x", tc.name, tc.want, tos)
+		}
+	}
+	if !bytes.HasSuffix(out.Bytes(), []byte("hello")) {
+		t.Error("expected every write passed on")
+	}
+}
@@ -0,0 +1,222 @@
+package sshtun
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	// REDACTED replaces a Secret and masked command arguments in logs.
+	REDACTED string = "[redacted]"
+)
+
+// Secret is a string never revealed by logging or formatting (a
+// password or passphrase), use Reveal to get the value.
+type Secret string
+
+// LogValue implements slog.LogValuer.
+func (s Secret) LogValue() slog.Value {
+	return slog.StringValue(REDACTED)
+}
+
+// String implements fmt.Stringer, also used by %v.
+func (s Secret) String() string {
+	return REDACTED
+}
+
+// GoString implements fmt.GoStringer (%#v).
+func (s Secret) GoString() string {
+	return REDACTED
+}
+
+// Reveal returns the secret value.
+func (s Secret) Reveal() string {
+	return string(s)
+}
+
+// credentialArgument matches an argument (or environment assignment)
+// carrying a credential in a command line: -password x, --token=x,
+// SUDO_PASSWORD=x, etc. The value is submatch 2 or, if the argument
+// has no =, the next argument.
+var credentialArgument = regexp.MustCompile(`(?i)^(-{0,2}[A-Za-z0-9_]*(?:pass|passwd|password|passphrase|secret|token)[A-Za-z0-9_]*)(=.*)?$`)
+
+// redactCommand returns command with the value of every credential
+// bearing argument replaced by REDACTED, for logging remote commands.
+func redactCommand(command string) string {
+	args := strings.Fields(command)
+	for i := 0; i < len(args); i++ {
+		m := credentialArgument.FindStringSubmatch(args[i])
+		if m == nil {
+			continue
+		}
+		if m[2] != "" {
+			args[i] = m[1] + "=" + REDACTED
+		} else if strings.HasPrefix(m[1], "-") && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+			i++
+			args[i] = REDACTED
+		}
+	}
+	return strings.Join(args, " ")
+}
+
+// redactHost returns a stable pseudonym for host, the first 12 hex
+// digits of its sha256 prefixed by h-.
+func redactHost(host string) string {
+	sum := sha256.Sum256([]byte(host))
+	return "h-" + hex.EncodeToString(sum[:])[:12]
+}
+
+// redactAddress returns address (host or host:port) with the host
+// replaced by redactHost.
+func redactAddress(address string) string {
+	if host, port, err := net.SplitHostPort(address); err == nil {
+		return net.JoinHostPort(redactHost(host), port)
+	}
+	return redactHost(address)
+}
+
+// redactor hashes remote hostnames and addresses in log records, see
+// RedactRemotes.
+type redactor struct {
+	mutex    sync.Mutex
+	hosts    map[string]bool
+	replacer *strings.Replacer
+}
+
+func newRedactor() *redactor {
+	return &redactor{
+		hosts:    make(map[string]bool),
+		replacer: strings.NewReplacer(),
+	}
+}
+
+// add makes the host of address (host or host:port) redacted from now
+// on, e.g the address a remote resolved to.
+func (r *redactor) add(address string) {
+	if r == nil {
+		return
+	}
+	host := address
+	if h, _, err := net.SplitHostPort(address); err == nil {
+		host = h
+	}
+	if host == "" {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.hosts[host] {
+		return
+	}
+	r.hosts[host] = true
+	hosts := make([]string, 0, len(r.hosts))
+	for h := range r.hosts {
+		hosts = append(hosts, h)
+	}
+	// Longest first so that a host containing another is replaced
+	// whole.
+	for i := 1; i < len(hosts); i++ {
+		for j := i; j > 0 && len(hosts[j]) > len(hosts[j-1]); j-- {
+			hosts[j], hosts[j-1] = hosts[j-1], hosts[j]
+		}
+	}
+	var pairs []string
+	for _, h := range hosts {
+		pairs = append(pairs, h, redactHost(h))
+	}
+	r.replacer = strings.NewReplacer(pairs...)
+}
+
+func (r *redactor) replace(s string) string {
+	r.mutex.Lock()
+	replacer := r.replacer
+	r.mutex.Unlock()
+	return replacer.Replace(s)
+}
+
+// attr returns a with every known host in string values replaced,
+// remote and remote_addr are redacted even if the host is not known.
+func (r *redactor) attr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		switch a.Key {
+		case "remote", "remote_addr":
+			r.add(v.String())
+			return slog.String(a.Key, redactAddress(v.String()))
+		}
+		return slog.String(a.Key, r.replace(v.String()))
+	case slog.KindGroup:
+		attrs := v.Group()
+		redacted := make([]any, 0, len(attrs))
+		for _, ga := range attrs {
+			redacted = append(redacted, r.attr(ga))
+		}
+		return slog.Group(a.Key, redacted...)
+	case slog.KindAny:
+		if err, ok := v.Any().(error); ok {
+			return slog.String(a.Key, r.replace(err.Error()))
+		}
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
+
+// redactHandler is a slog.Handler passing records to next with remote
+// hostnames and addresses redacted.
+type redactHandler struct {
+	next slog.Handler
+	r    *redactor
+}
+
+func (h *redactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *redactHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, h.r.replace(record.Message), record.PC)
+	record.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(h.r.attr(a))
+		return true
+	})
+	return h.next.Handle(ctx, redacted)
+}
+
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, 0, len(attrs))
+	for _, a := range attrs {
+		redacted = append(redacted, h.r.attr(a))
+	}
+	return &redactHandler{next: h.next.WithAttrs(redacted), r: h.r}
+}
+
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{next: h.next.WithGroup(name), r: h.r}
+}
+
+// redactRemotes makes the logger of t and of every tunnel hash the
+// remote hostnames and addresses if RedactRemotes is set. Called again
+// it only learns new remotes. Called with t.mutex held once t is
+// shared.
+func (t *Tunnels) redactRemotes() {
+	if !t.RedactRemotes {
+		return
+	}
+	t.log = SetLogger(t.log)
+	if t.redactor == nil {
+		t.redactor = newRedactor()
+		t.log = slog.New(&redactHandler{next: t.log.Handler(), r: t.redactor})
+	}
+	for _, tunnel := range t.Tunnels {
+		t.redactor.add(tunnel.Remote)
+		if tunnel.redactor != t.redactor {
+			tunnel.redactor = t.redactor
+			tunnel.setLog(slog.New(&redactHandler{next: tunnel.log().Handler(), r: t.redactor}))
+		}
+	}
+}
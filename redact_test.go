@@ -0,0 +1,77 @@
+package sshtun
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSecret(t *testing.T) {
+	secret := Secret("hunter2")
+	var buf bytes.Buffer
+	slog.New(slog.NewTextHandler(&buf, nil)).Info("login", "password", secret)
+	out := buf.String() + fmt.Sprintf("%s %v %+v %#v", secret, secret, struct{ P Secret }{secret}, secret)
+	if strings.Contains(out, "hunter2") {
+		t.Errorf("secret revealed in %q", out)
+	}
+	if secret.Reveal() != "hunter2" {
+		t.Errorf("expected Reveal to return the secret, got %q", secret.Reveal())
+	}
+}
+
+func TestRedactCommand(t *testing.T) {
+	for command, expected := range map[string]string{
+		"sudo -n /tmp/trw -handshake -dev tun0":        "sudo -n /tmp/trw -handshake -dev tun0",
+		"sudo -n /tmp/trw -password hunter2 -dev tun0": "sudo -n /tmp/trw -password [redacted] -dev tun0",
+		"sudo /tmp/trw --token=abc -dev tun0":          "sudo /tmp/trw --token=[redacted] -dev tun0",
+		"SUDO_PASSWORD=hunter2 sudo -S /tmp/trw":       "SUDO_PASSWORD=[redacted] sudo -S /tmp/trw",
+	} {
+		if got := redactCommand(command); got != expected {
+			t.Errorf("redactCommand(%q): expected %q, got %q", command, expected, got)
+		}
+	}
+}
+
+func TestRedactRemotes(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewSecureShellTunneler(slog.New(slog.NewTextHandler(&buf, nil)))
+	s.Remote = "secret.example.com:22"
+	tunnels := &Tunnels{Tunnels: []*SSHTUN{s}, RedactRemotes: true}
+	tunnels.log = s.log()
+	tunnels.redactRemotes()
+	tunnels.redactRemotes()
+	s.redactor.add("192.0.2.7:22")
+	s.log().With("remote", s.Remote).Info("Connecting to ssh://"+s.Remote, "remote_addr", "192.0.2.7:22", "error", errors.New("dial tcp 192.0.2.7:22: refused"))
+	out := buf.String()
+	for _, leaked := range []string{"secret.example.com", "192.0.2.7"} {
+		if strings.Contains(out, leaked) {
+			t.Errorf("%s not redacted in %q", leaked, out)
+		}
+	}
+	if !strings.Contains(out, redactHost("secret.example.com")+":22") || !strings.Contains(out, redactHost("192.0.2.7")) {
+		t.Errorf("expected hashed hosts in %q", out)
+	}
+	if strings.Count(out, "\n") != 1 {
+		t.Errorf("expected the logger to be wrapped once, got %q", out)
+	}
+}
+
+func TestRefreshRedactsChangedRemote(t *testing.T) {
+	var buf bytes.Buffer
+	tunnels := &Tunnels{RedactRemotes: true}
+	tunnels.SetLogger(slog.New(slog.NewTextHandler(&buf, nil)))
+	s := NewSecureShellTunneler(nil)
+	s.Remote = "old.example.com:22"
+	if err := tunnels.Add(s); err != nil {
+		t.Fatal(err)
+	}
+	s.Remote = "new.example.com:22"
+	tunnels.Refresh()
+	s.log().Info("Connecting to ssh://" + s.Remote)
+	if strings.Contains(buf.String(), "new.example.com") {
+		t.Errorf("changed remote not redacted after Refresh in %q", buf.String())
+	}
+}
@@ -0,0 +1,108 @@
+package sshtun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/alessio/shellescape"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	ErrRemoteHelperMissing error = errors.New("remote helper not installed")
+	ErrNoRemoteHelperPath  error = errors.New("remote_helper_path is not set")
+)
+
+// useInstalledHelper verifies that RemoteHelperPath exists and is
+// executable on the remote and compares its SHA-256 hash with the
+// embedded helper for the remote architecture. A missing helper is
+// an error unless RemoteHelperAutoUpdate is set in which case it is
+// installed, a helper with another hash is only reported with a
+// warning unless RemoteHelperAutoUpdate is set in which case it is
+// replaced.
+func (s *SSHTUN) useInstalledHelper(client *ssh.Client) error {
+	helper, err := remoteHelper(client)
+	if err != nil {
+		return err
+	}
+	quoted := shellescape.Quote(s.RemoteHelperPath)
+	out, err := sshoutput(client, fmt.Sprintf("test -f %s && test -x %s && sha256sum %s", quoted, quoted, quoted))
+	if err != nil {
+		if !s.RemoteHelperAutoUpdate {
+			return fmt.Errorf("%w: %s on ssh://%s, install it with sshtun -install-remote-helper %s", ErrRemoteHelperMissing, s.RemoteHelperPath, s.Remote, s.Name)
+		}
+		s.log().Warn(fmt.Sprintf("Remote helper %s not found on ssh://%s, installing it", s.RemoteHelperPath, s.Remote), "name", s.Name, "remote", s.Remote, "tunreadwriter", s.RemoteHelperPath)
+		if err := s.installRemoteHelper(client, helper); err != nil {
+			return err
+		}
+	} else if sum, _, _ := strings.Cut(strings.TrimSpace(out), " "); sum != helper.SHA256 {
+		if !s.RemoteHelperAutoUpdate {
+			s.log().Warn(fmt.Sprintf("Remote helper %s on ssh://%s differs from the embedded helper, update it with sshtun -install-remote-helper %s or set remote_helper_auto_update", s.RemoteHelperPath, s.Remote, s.Name), "name", s.Name, "remote", s.Remote, "tunreadwriter", s.RemoteHelperPath, "sha256", sum, "expected_sha256", helper.SHA256)
+		} else {
+			s.log().Warn(fmt.Sprintf("Remote helper %s on ssh://%s differs from the embedded helper, updating it", s.RemoteHelperPath, s.Remote), "name", s.Name, "remote", s.Remote, "tunreadwriter", s.RemoteHelperPath, "sha256", sum, "expected_sha256", helper.SHA256)
+			if err := s.installRemoteHelper(client, helper); err != nil {
+				return err
+			}
+		}
+	} else {
+		s.log().Info(fmt.Sprintf("Using installed tunreadwriter %s on ssh://%s", s.RemoteHelperPath, s.Remote), "name", s.Name, "tunreadwriter", s.RemoteHelperPath, "arch", helper.Arch, "sha256", helper.SHA256)
+	}
+	s.remoteTunReadWriter = s.RemoteHelperPath
+	return nil
+}
+
+// InstallRemoteHelper connects to the remote and installs the embedded
+// tunreadwriter matching its architecture as RemoteHelperPath. The
+// helper is uploaded to RemoteUploadDirectory and moved into place
+// with install -D -m 0755 prefixed by the escalation command (see
+// RemoteSudoCommand) which must not require a password.
+func (s *SSHTUN) InstallRemoteHelper(ctx context.Context) error {
+	if s.RemoteHelperPath == "" {
+		return fmt.Errorf("%w for tunnel %s", ErrNoRemoteHelperPath, s.Name)
+	}
+	client, err := s.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	helper, err := remoteHelper(client)
+	if err != nil {
+		return err
+	}
+	return s.installRemoteHelper(client, helper)
+}
+
+// installRemoteHelper uploads helper to a temporary file in the upload
+// directory and installs it as RemoteHelperPath.
+func (s *SSHTUN) installRemoteHelper(client *ssh.Client, helper *Helper) error {
+	remoteDirectory := s.remoteUploadDirectory()
+	quotedDirectory := shellescape.Quote(remoteDirectory)
+	if err := sshrun(client, fmt.Sprintf("test -d %s || mkdir -p %s", quotedDirectory, quotedDirectory)); err != nil {
+		return fmt.Errorf("unable to create upload directory %s on ssh://%s: %w", remoteDirectory, s.Remote, err)
+	}
+	filename := s.randomHelperName()
+	if err := s.uploadHelper(client, remoteDirectory, filename, helper); err != nil {
+		return err
+	}
+	tmp := path.Join(remoteDirectory, filename)
+	defer sshrun(client, "rm -f "+shellescape.Quote(tmp))
+	s.log().Info(fmt.Sprintf("Installing tunreadwriter (linux/%s) as %s on ssh://%s", helper.Arch, s.RemoteHelperPath, s.Remote), "name", s.Name, "remote", s.Remote, "tunreadwriter", s.RemoteHelperPath, "arch", helper.Arch, "sha256", helper.SHA256)
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	args := append(nonInteractive(s.sudoCommand()), "install", "-D", "-m", "0755", tmp, s.RemoteHelperPath)
+	out, err := session.CombinedOutput(shellescape.QuoteCommand(args))
+	if err != nil {
+		output := strings.TrimSpace(string(out))
+		if sudoPasswordRequired(output) {
+			return fmt.Errorf("%w on ssh://%s (%s), install %s manually or allow install without a password", ErrSudoPasswordRequired, s.Remote, output, s.RemoteHelperPath)
+		}
+		return fmt.Errorf("unable to install tunreadwriter as %s on ssh://%s: %w: %s", s.RemoteHelperPath, s.Remote, err, output)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package sshtun
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sa6mwa/sshtun/pkg/sshtest"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestUploadHelperRemotePaths(t *testing.T) {
+	hp, err := sshtest.NewHoneyPot(sshtest.WithExec("uname -m", sshtest.ExecResult{Stdout: "x86_64\n"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hp.Close()
+	client, err := ssh.Dial("tcp", hp.Addr(), hp.ClientConfig("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	s := NewSecureShellTunneler(nil)
+	s.UploadMethod = UPLOAD_SCP
+	disabled := false
+	s.CompressUpload = &disabled
+	if err := s.UploadHelperToRemote(client, "/var/tmp/sshtun"); err != nil {
+		t.Fatal(err)
+	}
+	// Remote paths are joined with forward slashes on every platform.
+	const prefix = "/var/tmp/sshtun/tunreadwriter-"
+	if !strings.HasPrefix(s.remoteTunReadWriter, prefix) || strings.Contains(s.remoteTunReadWriter, "\\") {
+		t.Errorf("unexpected remote helper %q", s.remoteTunReadWriter)
+	}
+	files := hp.Files()
+	if len(files) != 1 || !strings.HasPrefix(files[0].Path, prefix) || strings.Contains(files[0].Path, "\\") {
+		t.Fatalf("unexpected uploaded files %+v", files)
+	}
+	moved := false
+	for _, command := range hp.Commands() {
+		if strings.Contains(command, "\\") {
+			t.Errorf("unexpected backslash in %q", command)
+		}
+		moved = moved || command == "mv -f "+files[0].Path+" "+s.remoteTunReadWriter
+	}
+	if !moved {
+		t.Errorf("expected the helper moved into its cached path, got %q", hp.Commands())
+	}
+}
@@ -0,0 +1,184 @@
+package sshtun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/sa6mwa/sshtun/internal/pkg/policy"
+	"github.com/sa6mwa/sshtun/pkg/tun"
+)
+
+const (
+	// ROLE_CLIENT makes the local end of a tun tunnel the client: the
+	// server_* routes are added locally and the remote forwards (and
+	// NATs) for it, the default.
+	ROLE_CLIENT string = "client"
+	// ROLE_SERVER makes the local end the server while it still
+	// initiates the ssh connection: the remote gets the server_*
+	// routes and forwarding and NAT are applied locally, for a local
+	// host behind NAT serving a remote that can not connect to it.
+	ROLE_SERVER string = "server"
+
+	// remoteSSHClient expands on the remote to the address of the ssh
+	// client (the local end) in the command starting the helper.
+	remoteSSHClient string = `"${SSH_CONNECTION%% *}"`
+)
+
+var (
+	ErrPolicyUnsupported error = errors.New("server_* options applied locally require in-process privileges, not the privileged helper or unprivileged")
+)
+
+// role returns Role or ROLE_CLIENT if not set.
+func (s *SSHTUN) role() string {
+	if s.Role == "" {
+		return ROLE_CLIENT
+	}
+	return s.Role
+}
+
+// serverPolicy reports if any routing policy (server_routes,
+// server_default_route, server_forward or server_nat) is configured.
+func (s *SSHTUN) serverPolicy() bool {
+	return len(s.ServerRoutes) > 0 || s.ServerDefaultRoute || s.ServerForward || s.ServerNAT
+}
+
+// localPolicy reports if part of the routing policy is applied on the
+// local end, depending on Role, or default_route is set.
+func (s *SSHTUN) localPolicy() bool {
+	if s.role() == ROLE_SERVER {
+		return s.ServerForward || s.ServerNAT || s.DefaultRoute
+	}
+	return len(s.ServerRoutes) > 0 || s.ServerDefaultRoute || s.DefaultRoute
+}
+
+// remotePolicyArgs returns the tunreadwriter arguments applying the
+// remote part of the routing policy, remote_masquerade and
+// remote_enable_forwarding. The -except argument of -default-route is
+// returned separately as it must not be quoted, the remote shell
+// expands it to the address of the ssh client.
+func (s *SSHTUN) remotePolicyArgs() (args []string, except string) {
+	if s.role() == ROLE_SERVER {
+		for _, route := range s.ServerRoutes {
+			args = append(args, "-route", route)
+		}
+		if s.ServerDefaultRoute {
+			args = append(args, "-default-route")
+			except = "-except " + remoteSSHClient
+		}
+	} else if s.ServerNAT {
+		args = append(args, "-nat", networkOf(s.LocalNetwork))
+	} else if s.ServerForward {
+		args = append(args, "-ip-forward")
+	}
+	if s.RemoteMasquerade {
+		args = append(args, "-masquerade", networkOf(s.LocalNetwork))
+	}
+	if s.RemoteEnableForwarding {
+		args = append(args, "-enable-forwarding")
+	}
+	return args, except
+}
+
+// natDescription describes the subject of a NAT status line from the
+// remote helper, forward for -ip-forward or the network of -nat.
+func natDescription(subject string) string {
+	if subject == "forward" {
+		return "IPv4 forwarding"
+	}
+	return "masquerading of " + subject
+}
+
+// networkOf returns the network of address with CIDR (172.18.0.0/24
+// for 172.18.0.1/24), or address if it does not parse.
+func networkOf(address string) string {
+	_, network, err := net.ParseCIDR(address)
+	if err != nil {
+		return address
+	}
+	return network.String()
+}
+
+// applyLocalPolicy applies the local part of the routing policy to
+// localTUN, switching effective uid to root like createLocalTUN. As a
+// client: server_routes and server_default_route (except the address
+// of the ssh server), as a server: server_forward and server_nat for
+// the remote network. default_route is applied in either role. The
+// returned func removes the routes and NAT rule again, forwarding is
+// left enabled.
+func (s *SSHTUN) applyLocalPolicy(localTUN *tun.TUN) (func(), error) {
+	if !s.localPolicy() {
+		return func() {}, nil
+	}
+	if privopEnabled() || s.Unprivileged {
+		return nil, ErrPolicyUnsupported
+	}
+	b, err := s.Become(ROOT)
+	if err != nil {
+		return nil, err
+	}
+	defer b.Unbecome()
+	var undo []func()
+	remove := func() {
+		if len(undo) == 0 {
+			return
+		}
+		if b, err := s.Become(ROOT); err == nil {
+			defer b.Unbecome()
+		}
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}
+	fail := func(err error) (func(), error) {
+		remove()
+		return nil, err
+	}
+	if s.role() == ROLE_SERVER {
+		if s.ServerNAT {
+			network := networkOf(s.RemoteNetwork)
+			unmasquerade, err := policy.Masquerade(network, localTUN.Name)
+			if err != nil {
+				return fail(fmt.Errorf("server_nat: %w", err))
+			}
+			undo = append(undo, func() { unmasquerade() })
+			s.log().Info(fmt.Sprintf("Masquerading %s leaving through other devices than %s", network, localTUN.Name), "name", s.Name, "remote", s.Remote, "nat", network)
+		} else if s.ServerForward {
+			if err := policy.EnableForwarding(); err != nil {
+				return fail(fmt.Errorf("server_forward: %w", err))
+			}
+			s.log().Info("Enabled IPv4 forwarding", "name", s.Name, "remote", s.Remote)
+		}
+		if s.DefaultRoute {
+			unroute, err := s.defaultRoute(localTUN, "default_route")
+			if err != nil {
+				return fail(err)
+			}
+			undo = append(undo, unroute)
+		}
+		return remove, nil
+	}
+	for _, route := range s.ServerRoutes {
+		route := route
+		if err := localTUN.AddRoute(route, ""); errors.Is(err, os.ErrExist) {
+			continue
+		} else if err != nil {
+			return fail(fmt.Errorf("server_routes %s: %w", route, err))
+		}
+		undo = append(undo, func() { localTUN.DelRoute(route, "") })
+		s.log().Info(fmt.Sprintf("Route %s via %s", route, localTUN.Name), "name", s.Name, "remote", s.Remote, "route", route)
+	}
+	if s.ServerDefaultRoute || s.DefaultRoute {
+		field := "server_default_route"
+		if !s.ServerDefaultRoute {
+			field = "default_route"
+		}
+		unroute, err := s.defaultRoute(localTUN, field)
+		if err != nil {
+			return fail(err)
+		}
+		undo = append(undo, unroute)
+	}
+	return remove, nil
+}
@@ -0,0 +1,66 @@
+//go:build linux
+
+package sshtun
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/sa6mwa/sshtun/internal/pkg/netns"
+	"github.com/sa6mwa/sshtun/pkg/tun"
+)
+
+func TestApplyLocalPolicyRemovesRoutes(t *testing.T) {
+	if os.Geteuid() != ROOT {
+		t.Skip("adding routes requires root")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("test requires ip")
+	}
+	ns, err := netns.New()
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ns.Close()
+	routes := func() string {
+		out, _ := exec.Command("ip", "-4", "route", "show").CombinedOutput()
+		return string(out)
+	}
+	serverRoutes := []string{"10.20.0.0/16", "10.30.0.0/16", "10.40.0.0/16"}
+	err = ns.Do(func() error {
+		localTUN, err := tun.CreateTUN("tunnel0", 0, 0, 0)
+		if err != nil {
+			return err
+		}
+		defer localTUN.Close()
+		if err := localTUN.ConfigureInterface("172.18.0.1/24"); err != nil {
+			return err
+		}
+		if err := localTUN.LinkUp(); err != nil {
+			return err
+		}
+		s := NewSecureShellTunneler(nil)
+		s.ServerRoutes = serverRoutes
+		remove, err := s.applyLocalPolicy(localTUN)
+		if err != nil {
+			return err
+		}
+		for _, route := range serverRoutes {
+			if !strings.Contains(routes(), route+" dev tunnel0") {
+				t.Errorf("expected route %s, got:\n%s", route, routes())
+			}
+		}
+		remove()
+		for _, route := range serverRoutes {
+			if strings.Contains(routes(), route) {
+				t.Errorf("expected route %s to be removed, got:\n%s", route, routes())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,138 @@
+package sshtun
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sa6mwa/sshtun/internal/pkg/policy"
+	"github.com/sa6mwa/sshtun/pkg/tun"
+)
+
+const (
+	// ROUTE_STATE_DIRECTORY keeps a state file for every tunnel with a
+	// default route through it, listing the routes added, so that a
+	// start after a crash can remove what was left behind. Under /run
+	// as the routes do not survive a reboot either. When not running as
+	// root, sshtun under $XDG_RUNTIME_DIR is used instead (see
+	// stateDirectory).
+	ROUTE_STATE_DIRECTORY string = "/run/sshtun"
+)
+
+var (
+	ErrRoutesInUse error = errors.New("default route held by another running process")
+
+	// routeStateDirectory is ROUTE_STATE_DIRECTORY, changed by tests.
+	routeStateDirectory = ROUTE_STATE_DIRECTORY
+)
+
+// routeState is the content of a route state file.
+type routeState struct {
+	PID    int                 `json:"pid"`
+	Routes []policy.AddedRoute `json:"routes"`
+}
+
+// stateDirectory returns routeStateDirectory or, when not running as
+// root (e.g with CAP_NET_ADMIN only, where Become(ROOT) keeps the uid)
+// and $XDG_RUNTIME_DIR is set, sshtun under it as an ordinary user can
+// not create directories in /run.
+func stateDirectory() string {
+	if os.Geteuid() != ROOT && routeStateDirectory == ROUTE_STATE_DIRECTORY {
+		if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+			return filepath.Join(dir, "sshtun")
+		}
+	}
+	return routeStateDirectory
+}
+
+// routeStatePath returns the route state file of the tunnel, e.g
+// /run/sshtun/office.routes.json.
+func (s *SSHTUN) routeStatePath() string {
+	return filepath.Join(stateDirectory(), strings.ReplaceAll(s.Name, "/", "_")+".routes.json")
+}
+
+// writeRouteState replaces the route state file of the tunnel with
+// state.
+func (s *SSHTUN) writeRouteState(state *routeState) error {
+	pth := s.routeStatePath()
+	if err := os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tempfile := pth + ".tmp"
+	if err := os.WriteFile(tempfile, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempfile, pth)
+}
+
+// repairRoutes removes the routes in the route state file of the
+// tunnel, left behind when the process holding them crashed, and the
+// file itself. Returns an error wrapping ErrRoutesInUse if that
+// process is still running.
+func (s *SSHTUN) repairRoutes() error {
+	pth := s.routeStatePath()
+	b, err := os.ReadFile(pth)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var state routeState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return fmt.Errorf("%s: %w", pth, err)
+	}
+	if state.PID != os.Getpid() && processRunning(state.PID) {
+		return fmt.Errorf("%w: pid %d (%s)", ErrRoutesInUse, state.PID, pth)
+	}
+	if err := policy.RemoveRoutes(state.Routes); err != nil {
+		return err
+	}
+	if len(state.Routes) > 0 {
+		s.log().Warn(fmt.Sprintf("Removed %d route(s) left behind by pid %d", len(state.Routes), state.PID), "name", s.Name, "remote", s.Remote, "state_file", pth)
+	}
+	return os.Remove(pth)
+}
+
+// defaultRoute routes everything through localTUN except the address
+// of the ssh server (see policy.DefaultRoute) for field
+// (server_default_route or default_route). Routes left behind by a
+// crash are repaired first and every route added is written to the
+// route state file, which the returned func removes with the routes.
+// Failing to write the state file is logged as a warning, the routes
+// are still added but not repaired after a crash.
+func (s *SSHTUN) defaultRoute(localTUN *tun.TUN, field string) (func(), error) {
+	host, _, err := net.SplitHostPort(s.remoteAddr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", field, err)
+	}
+	if err := s.repairRoutes(); err != nil {
+		return nil, fmt.Errorf("%s: %w", field, err)
+	}
+	state := &routeState{PID: os.Getpid()}
+	unrecorded := false
+	unroute, err := policy.DefaultRoute(localTUN, host, func(route policy.AddedRoute) error {
+		state.Routes = append(state.Routes, route)
+		if err := s.writeRouteState(state); err != nil && !unrecorded {
+			unrecorded = true
+			s.log().Warn("Unable to write route state file, routes left behind by a crash will not be removed on the next start", "name", s.Name, "remote", s.Remote, "state_file", s.routeStatePath(), "error", err)
+		}
+		return nil
+	})
+	if err != nil {
+		os.Remove(s.routeStatePath())
+		return nil, fmt.Errorf("%s: %w", field, err)
+	}
+	s.log().Info(fmt.Sprintf("Default route via %s except %s", localTUN.Name, host), "name", s.Name, "remote", s.Remote, "except", host)
+	return func() {
+		unroute()
+		os.Remove(s.routeStatePath())
+	}, nil
+}
@@ -0,0 +1,163 @@
+//go:build linux
+
+package sshtun
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/sa6mwa/sshtun/internal/pkg/netns"
+	"github.com/sa6mwa/sshtun/internal/pkg/policy"
+	"github.com/sa6mwa/sshtun/pkg/tun"
+	"golang.org/x/sys/unix"
+)
+
+func TestRouteState(t *testing.T) {
+	defer func(dir string) { routeStateDirectory = dir }(routeStateDirectory)
+	routeStateDirectory = t.TempDir()
+	s := NewSecureShellTunneler(nil)
+	s.Name = "office/vpn"
+	if want := filepath.Join(routeStateDirectory, "office_vpn.routes.json"); s.routeStatePath() != want {
+		t.Errorf("expected %s, got %s", want, s.routeStatePath())
+	}
+	if err := s.repairRoutes(); err != nil {
+		t.Errorf("expected nothing to repair without a state file, got: %v", err)
+	}
+	if err := s.writeRouteState(&routeState{PID: os.Getppid()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.repairRoutes(); !errors.Is(err, ErrRoutesInUse) {
+		t.Errorf("expected %v while the process holding the routes runs, got: %v", ErrRoutesInUse, err)
+	}
+	if err := s.writeRouteState(&routeState{PID: os.Getpid()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.repairRoutes(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(s.routeStatePath()); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the state file to be removed, got: %v", err)
+	}
+}
+
+func TestRepairRoutes(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("removing routes requires root")
+	}
+	ns, err := netns.New()
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ns.Close()
+	defer func(dir string) { routeStateDirectory = dir }(routeStateDirectory)
+	routeStateDirectory = t.TempDir()
+	s := NewSecureShellTunneler(nil)
+	// A crashed process: its tun device is gone and the pid is not
+	// running.
+	if err := s.writeRouteState(&routeState{PID: 1 << 30, Routes: []policy.AddedRoute{
+		{Device: "sshtun-gone0", Destination: "0.0.0.0/1"},
+		{Device: "lo", Destination: "198.51.100.7/32"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Do(s.repairRoutes); err != nil {
+		t.Fatalf("expected missing routes and devices to be skipped, got: %v", err)
+	}
+	if _, err := os.Stat(s.routeStatePath()); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the state file to be removed, got: %v", err)
+	}
+}
+
+func TestDefaultRouteUnwritableState(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("adding routes requires root")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("test requires ip")
+	}
+	ns, err := netns.New()
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ns.Close()
+	defer func(dir string) { routeStateDirectory = dir }(routeStateDirectory)
+	routeStateDirectory = t.TempDir()
+	if err := os.Chmod(routeStateDirectory, 0555); err != nil {
+		t.Fatal(err)
+	}
+	routes := func() string {
+		out, _ := exec.Command("ip", "-4", "route", "show").CombinedOutput()
+		return string(out)
+	}
+	defaultRoute := func() error {
+		uplink, err := tun.CreateTUN("uplink0", 0, 0, 0)
+		if err != nil {
+			return err
+		}
+		defer uplink.Close()
+		if err := uplink.ConfigureInterface("10.1.0.1/24"); err != nil {
+			return err
+		}
+		if err := uplink.LinkUp(); err != nil {
+			return err
+		}
+		tunnel, err := tun.CreateTUN("tunnel0", 0, 0, 0)
+		if err != nil {
+			return err
+		}
+		defer tunnel.Close()
+		if err := tunnel.ConfigureInterface("172.18.0.1/24"); err != nil {
+			return err
+		}
+		if err := tunnel.LinkUp(); err != nil {
+			return err
+		}
+		s := NewSecureShellTunneler(nil)
+		s.remoteAddr = "10.1.0.7:22"
+		unroute, err := s.defaultRoute(tunnel, "default_route")
+		if err != nil {
+			return fmt.Errorf("expected the default route without a state file, got: %w", err)
+		}
+		if _, err := os.Stat(s.routeStatePath()); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected no state file in an unwritable directory, got: %v", err)
+		}
+		for _, route := range []string{"0.0.0.0/1 dev tunnel0", "128.0.0.0/1 dev tunnel0"} {
+			if !strings.Contains(routes(), route) {
+				t.Errorf("expected route %q, got:\n%s", route, routes())
+			}
+		}
+		unroute()
+		if strings.Contains(routes(), "/1 dev") {
+			t.Errorf("expected the routes to be removed, got:\n%s", routes())
+		}
+		return nil
+	}
+	// Without CAP_DAC_OVERRIDE root can not write to the directory
+	// either. Dropped on a thread of its own that exits with the
+	// goroutine as it is never unlocked.
+	done := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+		var data [2]unix.CapUserData
+		if err := unix.Capget(&header, &data[0]); err != nil {
+			done <- err
+			return
+		}
+		data[0].Effective &^= 1 << unix.CAP_DAC_OVERRIDE
+		if err := unix.Capset(&header, &data[0]); err != nil {
+			done <- err
+			return
+		}
+		done <- ns.Do(defaultRoute)
+	}()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
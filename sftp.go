@@ -0,0 +1,207 @@
+package sshtun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	ErrSFTP error = errors.New("sftp error")
+	// ErrSFTPUnavailable is wrapped (with ErrSFTP) when the remote has
+	// no sftp subsystem or no sftp server behind it.
+	ErrSFTPUnavailable error = errors.New("unable to start sftp subsystem")
+)
+
+// SFTP version 3 packet types and flags used by sftpUpload, see
+// draft-ietf-secsh-filexfer-02.
+const (
+	sshFxpInit     byte = 1
+	sshFxpVersion  byte = 2
+	sshFxpOpen     byte = 3
+	sshFxpClose    byte = 4
+	sshFxpWrite    byte = 6
+	sshFxpFsetstat byte = 10
+	sshFxpStatus   byte = 101
+	sshFxpHandle   byte = 102
+
+	sshFxfWrite uint32 = 0x02
+	sshFxfCreat uint32 = 0x08
+	sshFxfTrunc uint32 = 0x10
+
+	sshFileXferAttrPermissions uint32 = 0x04
+
+	sshFxOk uint32 = 0
+
+	sftpVersion     uint32 = 3
+	sftpChunkSize   int    = 32768
+	sftpMaxPacketSz uint32 = 256 * 1024
+)
+
+// sftpUpload writes data to pth on the remote with permissions mode
+// using the sftp subsystem, for remotes where scp is not installed.
+// progress counts the bytes sent (nil for none).
+func sftpUpload(client *ssh.Client, pth string, mode uint32, data []byte, progress *uploadProgress) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	w, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrSFTP, ErrSFTPUnavailable, err)
+	}
+	if err := sftpWriteFile(r, progress.writer(w), pth, mode, data); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// sftpWriteFile speaks the client side of the sftp protocol over r
+// and w, creating (or truncating) pth, writing data and setting its
+// permissions before closing it.
+func sftpWriteFile(r io.Reader, w io.Writer, pth string, mode uint32, data []byte) error {
+	c := &sftpConn{r: r, w: w}
+	if err := c.send(sshFxpInit, binary.BigEndian.AppendUint32(nil, sftpVersion)); err != nil {
+		return err
+	}
+	typ, _, err := c.recv()
+	if err != nil {
+		return fmt.Errorf("%w: %w (no sftp server answered: %w)", ErrSFTP, ErrSFTPUnavailable, err)
+	}
+	if typ != sshFxpVersion {
+		return fmt.Errorf("%w: expected version packet, got type %d", ErrSFTP, typ)
+	}
+
+	var open []byte
+	open = appendSFTPString(open, []byte(pth))
+	open = binary.BigEndian.AppendUint32(open, sshFxfWrite|sshFxfCreat|sshFxfTrunc)
+	open = appendSFTPPermissions(open, mode)
+	handle, err := c.request(sshFxpOpen, open, sshFxpHandle)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", pth, err)
+	}
+	handle, _, err = readSFTPString(handle)
+	if err != nil {
+		return err
+	}
+
+	for offset := 0; offset < len(data); offset += sftpChunkSize {
+		chunk := data[offset:min(offset+sftpChunkSize, len(data))]
+		var write []byte
+		write = appendSFTPString(write, handle)
+		write = binary.BigEndian.AppendUint64(write, uint64(offset))
+		write = appendSFTPString(write, chunk)
+		if _, err := c.request(sshFxpWrite, write, sshFxpStatus); err != nil {
+			return fmt.Errorf("write %s: %w", pth, err)
+		}
+	}
+
+	// Permissions in open are subject to the remote umask, set them
+	// explicitly.
+	setstat := appendSFTPPermissions(appendSFTPString(nil, handle), mode)
+	if _, err := c.request(sshFxpFsetstat, setstat, sshFxpStatus); err != nil {
+		return fmt.Errorf("chmod %s: %w", pth, err)
+	}
+	if _, err := c.request(sshFxpClose, appendSFTPString(nil, handle), sshFxpStatus); err != nil {
+		return fmt.Errorf("close %s: %w", pth, err)
+	}
+	return nil
+}
+
+type sftpConn struct {
+	r  io.Reader
+	w  io.Writer
+	id uint32
+}
+
+func (c *sftpConn) send(typ byte, payload []byte) error {
+	packet := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+	packet = append(packet, typ)
+	packet = append(packet, payload...)
+	_, err := c.w.Write(packet)
+	return err
+}
+
+func (c *sftpConn) recv() (byte, []byte, error) {
+	var length uint32
+	if err := binary.Read(c.r, binary.BigEndian, &length); err != nil {
+		return 0, nil, fmt.Errorf("%w: %w", ErrSFTP, err)
+	}
+	if length == 0 || length > sftpMaxPacketSz {
+		return 0, nil, fmt.Errorf("%w: invalid packet length %d", ErrSFTP, length)
+	}
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(c.r, packet); err != nil {
+		return 0, nil, fmt.Errorf("%w: %w", ErrSFTP, err)
+	}
+	return packet[0], packet[1:], nil
+}
+
+// request sends a packet with a new request id prepended to payload
+// and returns the payload (after the id) of the response if it is of
+// type want. A status response other than SSH_FX_OK is returned as
+// an error.
+func (c *sftpConn) request(typ byte, payload []byte, want byte) ([]byte, error) {
+	c.id++
+	if err := c.send(typ, append(binary.BigEndian.AppendUint32(nil, c.id), payload...)); err != nil {
+		return nil, err
+	}
+	rtyp, response, err := c.recv()
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 4 || binary.BigEndian.Uint32(response) != c.id {
+		return nil, fmt.Errorf("%w: unexpected response id", ErrSFTP)
+	}
+	response = response[4:]
+	if rtyp == sshFxpStatus {
+		if len(response) < 4 {
+			return nil, fmt.Errorf("%w: short status packet", ErrSFTP)
+		}
+		code := binary.BigEndian.Uint32(response)
+		if code != sshFxOk {
+			msg, _, _ := readSFTPString(response[4:])
+			if len(msg) == 0 {
+				msg = []byte("no message")
+			}
+			return nil, fmt.Errorf("%w: status %d: %s", ErrSFTP, code, bytes.TrimSpace(msg))
+		}
+	}
+	if rtyp != want {
+		return nil, fmt.Errorf("%w: expected packet type %d, got %d", ErrSFTP, want, rtyp)
+	}
+	return response, nil
+}
+
+func appendSFTPString(b []byte, s []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+func appendSFTPPermissions(b []byte, mode uint32) []byte {
+	b = binary.BigEndian.AppendUint32(b, sshFileXferAttrPermissions)
+	return binary.BigEndian.AppendUint32(b, mode)
+}
+
+func readSFTPString(b []byte) ([]byte, []byte, error) {
+	if len(b) < 4 {
+		return nil, nil, fmt.Errorf("%w: short string", ErrSFTP)
+	}
+	n := binary.BigEndian.Uint32(b)
+	if uint32(len(b)-4) < n {
+		return nil, nil, fmt.Errorf("%w: short string", ErrSFTP)
+	}
+	return b[4 : 4+n], b[4+n:], nil
+}
@@ -0,0 +1,118 @@
+package sshtun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// fakeSFTPServer serves one sftp session over r and w, recording the
+// written file. If failWrite is set, write requests are answered
+// with SSH_FX_PERMISSION_DENIED.
+type fakeSFTPServer struct {
+	path      string
+	data      []byte
+	mode      uint32
+	closed    bool
+	failWrite bool
+}
+
+func (f *fakeSFTPServer) serve(r io.Reader, w io.Writer) error {
+	c := &sftpConn{r: r, w: w}
+	status := func(id, code uint32, msg string) error {
+		b := binary.BigEndian.AppendUint32(nil, id)
+		b = binary.BigEndian.AppendUint32(b, code)
+		b = appendSFTPString(b, []byte(msg))
+		b = appendSFTPString(b, nil)
+		return c.send(sshFxpStatus, b)
+	}
+	for {
+		typ, payload, err := c.recv()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if typ == sshFxpInit {
+			if err := c.send(sshFxpVersion, binary.BigEndian.AppendUint32(nil, sftpVersion)); err != nil {
+				return err
+			}
+			continue
+		}
+		id := binary.BigEndian.Uint32(payload)
+		payload = payload[4:]
+		switch typ {
+		case sshFxpOpen:
+			name, _, err := readSFTPString(payload)
+			if err != nil {
+				return err
+			}
+			f.path = string(name)
+			if err := c.send(sshFxpHandle, appendSFTPString(binary.BigEndian.AppendUint32(nil, id), []byte("h1"))); err != nil {
+				return err
+			}
+		case sshFxpWrite:
+			if f.failWrite {
+				if err := status(id, 3, "Permission denied"); err != nil {
+					return err
+				}
+				continue
+			}
+			_, rest, _ := readSFTPString(payload)
+			offset := binary.BigEndian.Uint64(rest)
+			data, _, _ := readSFTPString(rest[8:])
+			if int(offset) != len(f.data) {
+				return errors.New("non-sequential write")
+			}
+			f.data = append(f.data, data...)
+			if err := status(id, sshFxOk, ""); err != nil {
+				return err
+			}
+		case sshFxpFsetstat:
+			_, rest, _ := readSFTPString(payload)
+			f.mode = binary.BigEndian.Uint32(rest[4:])
+			if err := status(id, sshFxOk, ""); err != nil {
+				return err
+			}
+		case sshFxpClose:
+			f.closed = true
+			if err := status(id, sshFxOk, ""); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func TestSFTPWriteFile(t *testing.T) {
+	data := bytes.Repeat([]byte("tunreadwriter"), 10000)
+	for _, failWrite := range []bool{false, true} {
+		server := &fakeSFTPServer{failWrite: failWrite}
+		clientR, serverW := io.Pipe()
+		serverR, clientW := io.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			done <- server.serve(serverR, serverW)
+			serverW.Close()
+		}()
+		err := sftpWriteFile(clientR, clientW, "/tmp/tunreadwriter-abc", 0755, data)
+		clientW.Close()
+		if serr := <-done; serr != nil {
+			t.Fatalf("fake server: %v", serr)
+		}
+		if failWrite {
+			if !errors.Is(err, ErrSFTP) {
+				t.Errorf("expected ErrSFTP, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if server.path != "/tmp/tunreadwriter-abc" || !bytes.Equal(server.data, data) || server.mode != 0755 || !server.closed {
+			t.Errorf("unexpected upload: path %q, %d bytes, mode %o, closed %t", server.path, len(server.data), server.mode, server.closed)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package sshtun
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/alessio/shellescape"
+	"golang.org/x/crypto/ssh"
+)
+
+// helperRegistry remembers the helpers uploaded by the tunnels sharing
+// a Context so that tunnels to the same remote upload it once. Kept in
+// the sshtun context value next to the mutex.
+type helperRegistry struct {
+	mutex   sync.Mutex
+	helpers map[string]*sharedHelper
+}
+
+// sharedHelper is a helper uploaded to a remote. upload is held while
+// it is uploaded (or verified), path and users are guarded by the
+// mutex of the registry.
+type sharedHelper struct {
+	key    string
+	upload sync.Mutex
+	path   string
+	users  int
+}
+
+func newHelperRegistry() *helperRegistry {
+	return &helperRegistry{helpers: make(map[string]*sharedHelper)}
+}
+
+// helperRegistryFrom returns the registry of the sshtun context value
+// in ctx, nil if ctx was not initialized with Context.
+func helperRegistryFrom(ctx context.Context) *helperRegistry {
+	if v, ok := ctx.Value(sshtunKey{}).(sshtun); ok {
+		return v.helpers
+	}
+	return nil
+}
+
+// helperKeyPrefix identifies the remote of a shared helper, the same
+// user on the same host and port.
+func (s *SSHTUN) helperKeyPrefix() string {
+	return s.RemoteUser + "@" + s.Remote + ":"
+}
+
+// helperKey identifies a shared helper: the remote, the upload
+// directory and the SHA-256 hash of the helper.
+func (s *SSHTUN) helperKey(remoteDirectory string, helper *Helper) string {
+	return s.helperKeyPrefix() + remoteDirectory + "#" + helper.SHA256
+}
+
+// acquire returns the shared helper of key with its upload mutex
+// locked, nil if r is nil (no Context).
+func (r *helperRegistry) acquire(key string) *sharedHelper {
+	if r == nil {
+		return nil
+	}
+	r.mutex.Lock()
+	shared, ok := r.helpers[key]
+	if !ok {
+		shared = &sharedHelper{key: key}
+		r.helpers[key] = shared
+	}
+	r.mutex.Unlock()
+	shared.upload.Lock()
+	return shared
+}
+
+// path returns where shared was uploaded, empty if it has not been.
+func (r *helperRegistry) path(shared *sharedHelper) string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return shared.path
+}
+
+// paths returns the uploaded helpers in use by tunnels to the remotes
+// starting with prefix (see helperKeyPrefix).
+func (r *helperRegistry) paths(prefix string) []string {
+	if r == nil {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var paths []string
+	for key, shared := range r.helpers {
+		if strings.HasPrefix(key, prefix) && shared.path != "" && shared.users > 0 {
+			paths = append(paths, shared.path)
+		}
+	}
+	return paths
+}
+
+// shareHelper records that s uses shared uploaded at pth.
+func (s *SSHTUN) shareHelper(shared *sharedHelper, pth string) {
+	s.helpers.mutex.Lock()
+	defer s.helpers.mutex.Unlock()
+	shared.path = pth
+	if s.sharedHelper != shared {
+		shared.users++
+		s.sharedHelper = shared
+	}
+}
+
+// releaseHelper stops using the shared helper of s, if any. The last
+// tunnel using a randomly named (not cached) helper removes it from
+// the remote, which is what -delete does for a helper that is not
+// shared. If that fails, e.g the connection is already closed by the
+// context, the helper is kept for the next tunnel or
+// CleanupRemoteHelpers.
+func (s *SSHTUN) releaseHelper(client *ssh.Client) {
+	shared := s.sharedHelper
+	if shared == nil {
+		return
+	}
+	s.sharedHelper = nil
+	shared.upload.Lock()
+	defer shared.upload.Unlock()
+	s.helpers.mutex.Lock()
+	shared.users--
+	pth := shared.path
+	last := shared.users == 0
+	s.helpers.mutex.Unlock()
+	if !last || s.CachesHelper() || pth == "" {
+		return
+	}
+	if err := sshrun(client, "rm -f "+shellescape.Quote(pth)); err != nil {
+		s.log().Debug(fmt.Sprintf("Unable to remove tunreadwriter %s from ssh://%s, leaving it for cleanup", pth, s.Remote), "name", s.Name, "remote", s.Remote, "tunreadwriter", pth, "error", err)
+		return
+	}
+	s.log().Debug(fmt.Sprintf("Removed tunreadwriter %s from ssh://%s", pth, s.Remote), "name", s.Name, "remote", s.Remote, "tunreadwriter", pth)
+	s.helpers.mutex.Lock()
+	if shared.users == 0 {
+		shared.path = ""
+	}
+	s.helpers.mutex.Unlock()
+}
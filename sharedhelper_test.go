@@ -0,0 +1,123 @@
+//go:build linux
+
+package sshtun
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sa6mwa/sshtun/internal/pkg/handshake"
+	"github.com/sa6mwa/sshtun/pkg/sshtest"
+)
+
+func TestSharedHelper(t *testing.T) {
+	privateKey, _, err := sshtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, privateKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	var hp *sshtest.HoneyPot
+	hp, err = sshtest.NewHoneyPot(
+		sshtest.WithExec("uname -m", sshtest.ExecResult{Stdout: "x86_64\n"}),
+		// cachedHelperValid: test -f <path> && ... && sha256sum <path>
+		sshtest.WithScriptedHandler("test -f ", func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+			pth := strings.Trim(strings.Fields(command)[2], "'")
+			for _, f := range hp.Files() {
+				if f.Path == pth {
+					sum := sha256.Sum256(f.Data)
+					fmt.Fprintf(stdout, "%s  %s\n", hex.EncodeToString(sum[:]), pth)
+					return 0
+				}
+			}
+			return 1
+		}),
+		sshtest.WithScriptedHandler("/tmp/tunreadwriter-", func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+			handshake.New("tun9", 1400, "inet").Write(stdout)
+			io.Copy(stdout, stdin)
+			return 0
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hp.Close()
+
+	ctx := Context(context.Background())
+	uncompressed, uncached := false, false
+	var tunnels []*Tunnel
+	for _, name := range []string{"first", "second"} {
+		s := NewSecureShellTunneler(nil)
+		s.Name = name
+		s.Remote = hp.Addr()
+		s.RemoteUser = "root"
+		s.PrivateKeyFiles = PrivateKeyFiles{keyFile}
+		s.KeepaliveInterval = 0
+		s.CompressUpload = &uncompressed
+		s.RemoteCacheHelper = &uncached
+		s.localTUN, _ = fakeTUN(t)
+		s.retainTUN = true
+		tunnel, err := s.Start(ctx)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		defer tunnel.Close()
+		tunnels = append(tunnels, tunnel)
+	}
+
+	if files := hp.Files(); len(files) != 1 {
+		t.Fatalf("expected exactly one upload, got %d", len(files))
+	}
+	uploaded := hp.Files()[0].Path
+	var started []string
+	for _, command := range hp.Commands() {
+		if strings.HasPrefix(command, "/tmp/tunreadwriter-") {
+			started = append(started, command)
+		}
+	}
+	if len(started) != 2 {
+		t.Fatalf("expected both tunnels to start a helper, got %q", started)
+	}
+	for _, command := range started {
+		if !strings.HasPrefix(command, uploaded+" ") {
+			t.Errorf("expected the shared helper %s to be started, got %q", uploaded, command)
+		}
+		if strings.Contains(command, "-delete") {
+			t.Errorf("a shared helper must not delete itself, got %q", command)
+		}
+	}
+	for _, tunnel := range tunnels {
+		if tunnel.s.remoteTunReadWriter != uploaded {
+			t.Errorf("%s: expected helper %s, got %s", tunnel.s.Name, uploaded, tunnel.s.remoteTunReadWriter)
+		}
+	}
+	registry := helperRegistryFrom(ctx)
+	if paths := registry.paths(tunnels[0].s.helperKeyPrefix()); len(paths) != 1 || paths[0] != uploaded {
+		t.Errorf("expected %s in use, got %q", uploaded, paths)
+	}
+	if stale := staleHelpers("/tmp", uploaded+"\n", registry.paths(tunnels[0].s.helperKeyPrefix())...); len(stale) != 0 {
+		t.Errorf("expected a shared helper never to be stale, got %q", stale)
+	}
+
+	for _, tunnel := range tunnels {
+		tunnel.Close()
+		select {
+		case <-tunnel.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s did not go down after Close", tunnel.s.Name)
+		}
+	}
+	if paths := registry.paths(tunnels[0].s.helperKeyPrefix()); len(paths) != 0 {
+		t.Errorf("expected no helper in use once both tunnels are down, got %q", paths)
+	}
+}
@@ -0,0 +1,322 @@
+package sshtun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sa6mwa/sshtun/internal/pkg/crand"
+	"github.com/sa6mwa/sshtun/internal/pkg/icmp"
+)
+
+const (
+	DEFAULT_SPEEDTEST_DURATION time.Duration = 10 * time.Second
+	// MAX_SPEEDTEST_DURATION keeps a speedtest well within the deadline
+	// of a control request.
+	MAX_SPEEDTEST_DURATION time.Duration = time.Minute
+
+	// speedTestWindow is how many echo requests may be unanswered at
+	// once, keeping the session from being flooded. It caps the
+	// measured rate at speedTestWindow packets per round trip.
+	speedTestWindow int = 64
+)
+
+var (
+	ErrSpeedTestRunning     error = errors.New("a speedtest is already running")
+	ErrSpeedTestUnsupported error = errors.New("speedtest needs an IPv4 tun tunnel")
+
+	// speedTestTimeout is how long an echo request may go unanswered
+	// before it is counted as lost, changed by tests.
+	speedTestTimeout = time.Second
+)
+
+// SpeedTestResult is the outcome of SSHTUN.SpeedTest. Upload is the
+// rate of echo requests sent into the tunnel, Download the rate of
+// replies coming back, both in Mbit/s of IP packets. Loss is the
+// percentage of requests never answered.
+type SpeedTestResult struct {
+	Tunnel      string   `json:"tunnel"`
+	Destination string   `json:"destination"`
+	Duration    Duration `json:"duration"`
+	PacketSize  int      `json:"packet_size"`
+	Sent        int      `json:"sent"`
+	Received    int      `json:"received"`
+	Loss        float64  `json:"loss_percent"`
+	Upload      float64  `json:"upload_mbps"`
+	Download    float64  `json:"download_mbps"`
+	RTTMin      Duration `json:"rtt_min"`
+	RTTP50      Duration `json:"rtt_p50"`
+	RTTP90      Duration `json:"rtt_p90"`
+	RTTP99      Duration `json:"rtt_p99"`
+	RTTMax      Duration `json:"rtt_max"`
+}
+
+// String returns r as a few lines of text.
+func (r *SpeedTestResult) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "speedtest of %s to %s for %s with %d byte packets\n", r.Tunnel, r.Destination, time.Duration(r.Duration), r.PacketSize)
+	fmt.Fprintf(&b, "  upload     %.2f Mbit/s\n", r.Upload)
+	fmt.Fprintf(&b, "  download   %.2f Mbit/s\n", r.Download)
+	fmt.Fprintf(&b, "  packets    %d sent, %d received, %.2f%% loss\n", r.Sent, r.Received, r.Loss)
+	fmt.Fprintf(&b, "  latency    min %s, p50 %s, p90 %s, p99 %s, max %s", roundRTT(r.RTTMin), roundRTT(r.RTTP50), roundRTT(r.RTTP90), roundRTT(r.RTTP99), roundRTT(r.RTTMax))
+	return b.String()
+}
+
+func roundRTT(d Duration) time.Duration {
+	return time.Duration(d).Round(10 * time.Microsecond)
+}
+
+// speedTester floods the tunnel with full size echo requests from
+// the local to the remote tunnel address, answered by the kernel of
+// the remote, keeping at most speedTestWindow unanswered.
+type speedTester struct {
+	src         net.IP
+	dst         net.IP
+	id          uint16
+	payload     []byte
+	mutex       sync.Mutex
+	seq         uint16
+	outstanding map[uint16]time.Time
+	freed       chan struct{}
+	rtts        []time.Duration
+	sent        int
+	sentBytes   int64
+	recvBytes   int64
+	lastReply   time.Time
+}
+
+// newSpeedTester returns a speedTester sending packets of packetSize
+// bytes from the address of LocalNetwork to the address of
+// RemoteNetwork.
+func (s *SSHTUN) newSpeedTester(packetSize int) (*speedTester, error) {
+	if s.tap() || s.forwarding() {
+		return nil, fmt.Errorf("%w: tunnel %q", ErrSpeedTestUnsupported, s.Name)
+	}
+	src, _, err := net.ParseCIDR(s.LocalNetwork)
+	if err != nil || src.To4() == nil {
+		return nil, fmt.Errorf("%w: tunnel %q has no IPv4 local_network", ErrSpeedTestUnsupported, s.Name)
+	}
+	dst, _, err := net.ParseCIDR(s.RemoteNetwork)
+	if err != nil || dst.To4() == nil {
+		return nil, fmt.Errorf("%w: tunnel %q has no IPv4 remote_network", ErrSpeedTestUnsupported, s.Name)
+	}
+	return &speedTester{
+		src:         src.To4(),
+		dst:         dst.To4(),
+		id:          uint16(crand.Int63()),
+		payload:     make([]byte, packetSize-28),
+		outstanding: map[uint16]time.Time{},
+		freed:       make(chan struct{}, 1),
+	}, nil
+}
+
+// speedTestPacketSize returns the smallest MTU of the two ends, 1500
+// (the kernel default) for an end without one.
+func (s *SSHTUN) speedTestPacketSize() int {
+	size := 1500
+	for _, mtu := range []int{s.LocalMTU, s.RemoteMTU, s.remoteHandshake.MTU} {
+		if mtu > 68 && mtu < size {
+			size = mtu
+		}
+	}
+	return size
+}
+
+// request returns the next echo request and marks it outstanding.
+func (t *speedTester) request() ([]byte, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.seq++
+	packet, err := icmp.Echo{
+		Type:    icmp.TYPE_ECHO_REQUEST,
+		Src:     t.src,
+		Dst:     t.dst,
+		ID:      t.id,
+		Seq:     t.seq,
+		Payload: t.payload,
+	}.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	t.outstanding[t.seq] = time.Now()
+	t.sent++
+	t.sentBytes += int64(len(packet))
+	return packet, nil
+}
+
+// isReply returns true if packet is an echo reply to this tester,
+// recording its round trip time if it is still outstanding.
+func (t *speedTester) isReply(packet []byte) bool {
+	if len(packet) == 0 || packet[0]>>4 != 4 {
+		return false
+	}
+	e, err := icmp.Parse(packet)
+	if err != nil || e.Type != icmp.TYPE_ECHO_REPLY || e.ID != t.id || !e.Src.Equal(t.dst) || !e.Dst.Equal(t.src) {
+		return false
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	sent, ok := t.outstanding[e.Seq]
+	if !ok {
+		return true
+	}
+	delete(t.outstanding, e.Seq)
+	t.lastReply = time.Now()
+	t.rtts = append(t.rtts, t.lastReply.Sub(sent))
+	t.recvBytes += int64(len(packet))
+	select {
+	case t.freed <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// expire forgets requests sent before deadline, lost unless answered
+// after all, and returns how many are still outstanding.
+func (t *speedTester) expire(deadline time.Time) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for seq, sent := range t.outstanding {
+		if sent.Before(deadline) {
+			delete(t.outstanding, seq)
+		}
+	}
+	return len(t.outstanding)
+}
+
+// wait returns when a reply frees the window, after a short while or
+// when ctx is done.
+func (t *speedTester) wait(ctx context.Context) {
+	timer := time.NewTimer(10 * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case <-t.freed:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// run sends echo requests to w for duration, then waits up to
+// speedTestTimeout for the outstanding replies and returns the result.
+func (t *speedTester) run(ctx context.Context, w io.Writer, duration time.Duration) (*SpeedTestResult, error) {
+	start := time.Now()
+	for time.Since(start) < duration && ctx.Err() == nil {
+		if t.expire(time.Now().Add(-speedTestTimeout)) >= speedTestWindow {
+			t.wait(ctx)
+			continue
+		}
+		packet, err := t.request()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(packet); err != nil {
+			return nil, err
+		}
+	}
+	sending := time.Since(start)
+	drain := time.Now()
+	for t.expire(time.Now().Add(-speedTestTimeout)) > 0 && time.Since(drain) < speedTestTimeout && ctx.Err() == nil {
+		t.wait(ctx)
+	}
+	t.expire(time.Now().Add(time.Second))
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	result := &SpeedTestResult{
+		Destination: t.dst.String(),
+		Duration:    Duration(sending),
+		PacketSize:  len(t.payload) + 28,
+		Sent:        t.sent,
+		Received:    len(t.rtts),
+		Upload:      mbps(t.sentBytes, sending),
+		Download:    mbps(t.recvBytes, t.lastReply.Sub(start)),
+	}
+	if t.sent > 0 {
+		result.Loss = 100 * float64(t.sent-len(t.rtts)) / float64(t.sent)
+	}
+	if len(t.rtts) > 0 {
+		slices.Sort(t.rtts)
+		percentile := func(p float64) Duration {
+			return Duration(t.rtts[int(p*float64(len(t.rtts)-1))])
+		}
+		result.RTTMin, result.RTTP50, result.RTTP90, result.RTTP99, result.RTTMax = percentile(0), percentile(0.5), percentile(0.9), percentile(0.99), percentile(1)
+	}
+	return result, nil
+}
+
+// mbps returns n bytes over d in Mbit/s, 0 if d is not positive.
+func mbps(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) * 8 / d.Seconds() / 1e6
+}
+
+// speedTestFilter drops echo replies to a running speedtest of s
+// instead of writing them to the local tun device.
+type speedTestFilter struct {
+	w io.Writer
+	s *SSHTUN
+}
+
+func (f speedTestFilter) Write(p []byte) (int, error) {
+	if t := f.s.speedTest.Load(); t != nil && t.isReply(p) {
+		return len(p), nil
+	}
+	return f.w.Write(p)
+}
+
+// SpeedTest measures the throughput, packet loss and latency of the
+// connected tunnel for duration (DEFAULT_SPEEDTEST_DURATION if 0, at
+// most MAX_SPEEDTEST_DURATION) by sending full size ICMP echo requests
+// to the address of RemoteNetwork through the tunnel alongside its
+// traffic. The kernel of the remote answers them, no helper support is
+// needed but the remote must not drop ICMP on its tun device. At most
+// speedTestWindow requests are unanswered at a time, so the result is
+// bound by the round trip time and is a lower bound of what the link
+// carries rather than its throughput. Returns
+// an error wrapping ErrTunnelNotRunning if the tunnel is not connected
+// and ErrSpeedTestRunning if another speedtest is.
+func (s *SSHTUN) SpeedTest(ctx context.Context, duration time.Duration) (*SpeedTestResult, error) {
+	if duration <= 0 {
+		duration = DEFAULT_SPEEDTEST_DURATION
+	}
+	duration = min(duration, MAX_SPEEDTEST_DURATION)
+	w := s.inject.Load()
+	if w == nil {
+		return nil, fmt.Errorf("%w: tunnel %q is not connected", ErrTunnelNotRunning, s.Name)
+	}
+	t, err := s.newSpeedTester(s.speedTestPacketSize())
+	if err != nil {
+		return nil, err
+	}
+	if !s.speedTest.CompareAndSwap(nil, t) {
+		return nil, fmt.Errorf("%w on tunnel %q", ErrSpeedTestRunning, s.Name)
+	}
+	defer s.speedTest.Store(nil)
+	s.log().Info(fmt.Sprintf("Running speedtest to %s for %s", t.dst, duration), "name", s.Name, "remote", s.Remote, "dst", t.dst.String(), "duration", duration.String(), "packet_size", len(t.payload)+28)
+	result, err := t.run(ctx, w, duration)
+	if err != nil {
+		return nil, err
+	}
+	result.Tunnel = s.Name
+	s.log().Info(fmt.Sprintf("Speedtest to %s: upload %.2f Mbit/s, download %.2f Mbit/s, %.2f%% loss", t.dst, result.Upload, result.Download, result.Loss), "name", s.Name, "remote", s.Remote, "upload_mbps", result.Upload, "download_mbps", result.Download, "loss_percent", result.Loss, "rtt_p50", time.Duration(result.RTTP50).String())
+	return result, nil
+}
+
+// SpeedTest runs SSHTUN.SpeedTest on the tunnel named name.
+func (t *Tunnels) SpeedTest(ctx context.Context, name string, duration time.Duration) (*SpeedTestResult, error) {
+	tunnel, err := t.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return tunnel.SpeedTest(ctx, duration)
+}
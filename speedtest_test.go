@@ -0,0 +1,95 @@
+package sshtun
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/sa6mwa/sshtun/internal/pkg/icmp"
+	"github.com/sa6mwa/sshtun/pkg/tun"
+)
+
+// speedTestPeer answers echo requests written to it through reply
+// two at a time in a single write, like replies read back-to-back
+// from the session, and leaves every tenth request unanswered.
+type speedTestPeer struct {
+	reply   io.Writer
+	n       int
+	pending []byte
+}
+
+func (p *speedTestPeer) Write(b []byte) (int, error) {
+	p.n++
+	if p.n%10 == 0 {
+		return len(b), nil
+	}
+	e, err := icmp.Parse(b)
+	if err != nil {
+		return 0, err
+	}
+	packet, err := e.Reply().Marshal()
+	if err != nil {
+		return 0, err
+	}
+	if p.pending == nil {
+		p.pending = packet
+		return len(b), nil
+	}
+	packet, p.pending = append(p.pending, packet...), nil
+	if _, err := p.reply.Write(packet); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func TestSpeedTest(t *testing.T) {
+	defer func(timeout time.Duration) { speedTestTimeout = timeout }(speedTestTimeout)
+	speedTestTimeout = 20 * time.Millisecond
+	s := NewSecureShellTunneler(nil)
+	s.Name = "office"
+	if _, err := s.SpeedTest(context.Background(), time.Millisecond); !errors.Is(err, ErrTunnelNotRunning) {
+		t.Errorf("expected %v before the tunnel is connected, got %v", ErrTunnelNotRunning, err)
+	}
+	var local bytes.Buffer
+	peer := &speedTestPeer{reply: tun.NewPacketWriter(speedTestFilter{w: &local, s: s})}
+	s.inject.Store(&lockedWriter{w: peer})
+	s.LocalMTU = 1400
+	result, err := s.SpeedTest(context.Background(), 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if local.Len() != 0 {
+		t.Errorf("expected speedtest replies not to reach the local device, got %d bytes", local.Len())
+	}
+	if result.Tunnel != "office" || result.PacketSize != 1400 || result.Sent < 100 || result.Received == 0 || result.Received >= result.Sent {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if result.Loss < 9 || result.Loss > 12 {
+		t.Errorf("expected about 10%% loss, got %.2f%%", result.Loss)
+	}
+	if result.Upload <= 0 || result.Download <= 0 || result.RTTMin > result.RTTP50 || result.RTTP50 > result.RTTP99 || result.RTTP99 > result.RTTMax {
+		t.Errorf("unexpected rates or percentiles %+v", result)
+	}
+	if s.speedTest.Load() != nil {
+		t.Error("expected the speedtest to be cleared")
+	}
+
+	// Without a running speedtest everything reaches the local device.
+	other, err := icmp.Echo{Type: icmp.TYPE_ECHO_REPLY, Src: []byte{172, 16, 0, 3}, Dst: []byte{172, 16, 0, 2}}.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.reply.Write(other); err != nil || !bytes.Equal(local.Bytes(), other) {
+		t.Errorf("expected the packet passed to the local device, got %d bytes and %v", local.Len(), err)
+	}
+
+	tap := NewSecureShellTunneler(nil)
+	tap.DeviceType = DEVICE_TAP
+	tap.inject.Store(&lockedWriter{w: peer})
+	if _, err := tap.SpeedTest(context.Background(), time.Millisecond); !errors.Is(err, ErrSpeedTestUnsupported) {
+		t.Errorf("expected %v for a tap tunnel, got %v", ErrSpeedTestUnsupported, err)
+	}
+}
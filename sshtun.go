@@ -1,6 +1,7 @@
 package sshtun
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	_ "embed"
@@ -12,37 +13,70 @@ import (
 	"net"
 	"os"
 	"os/user"
+	"path"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/alessio/shellescape"
 	"github.com/sa6mwa/sshtun/internal/pkg/crand"
+	"github.com/sa6mwa/sshtun/internal/pkg/handshake"
 	"github.com/sa6mwa/sshtun/pkg/tun"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
 
-//go:embed bin/tunreadwriter
-var tunreadwriter []byte
-
 var (
-	ErrNilPointer       error = errors.New("nil pointer error")
-	ErrEmptySshAuthSock error = fmt.Errorf("%s is empty", SSH_AUTH_SOCK)
-	ErrNoTunReadWriter  error = errors.New("missing path to remote tunreadwriter (CopyHelperToRemote must come first)")
-	ErrUnrecoverable    error = errors.New("unrecoverable")
-	ErrMissingContext   error = errors.New("sshtun context value missing, please use sshtun.Context(parent_ctx)")
+	ErrNilPointer           error = errors.New("nil pointer error")
+	ErrEmptySshAuthSock     error = fmt.Errorf("%s is empty", SSH_AUTH_SOCK)
+	ErrNoTunReadWriter      error = errors.New("missing path to remote tunreadwriter (CopyHelperToRemote must come first)")
+	ErrUnrecoverable        error = errors.New("unrecoverable")
+	ErrMissingContext       error = errors.New("sshtun context value missing, please use sshtun.Context(parent_ctx)")
+	ErrUnknownTunnel        error = errors.New("unknown tunnel")
+	ErrNotRunning           error = errors.New("tunnels are not running (OpenAll must come first)")
+	ErrDisconnected         error = errors.New("tunnel disconnected")
+	ErrSCPNotFound          error = errors.New("scp not found on remote")
+	ErrSudoPasswordRequired error = errors.New("remote sudo requires a password")
+	ErrHelperProtocol       error = errors.New("incompatible remote helper")
+	ErrGzipNotFound         error = errors.New("gzip not found on remote")
+	ErrChecksumMismatch     error = errors.New("checksum mismatch")
+	ErrKeepaliveTimeout     error = errors.New("keepalive request timed out")
+	ErrGaveUp               error = errors.New("gave up reconnecting")
+	ErrTunnelRunning        error = errors.New("tunnel is already running")
+	ErrTunnelNotRunning     error = errors.New("tunnel is not running")
+	ErrUnresolvedTilde      error = errors.New("unable to resolve ~")
 )
 
 const (
-	ROOT                int    = 0
-	DEFAULT_CONFIG_FILE string = `~/.config/sshtun/config.json`
-	SSH_AUTH_SOCK       string = `SSH_AUTH_SOCK`
-	DEV_NET_TUN         string = `/dev/net/tun`
-	USR_BIN_SCP         string = `/usr/bin/scp`
+	ROOT                 int    = 0
+	DEFAULT_CONFIG_FILE  string = `~/.config/sshtun/config.json`
+	STDIO_CONFIG         string = "-"
+	SSH_AUTH_SOCK        string = `SSH_AUTH_SOCK`
+	DEV_NET_TUN          string = `/dev/net/tun`
+	USR_BIN_SCP          string = `/usr/bin/scp`
+	DEFAULT_UPLOAD_DIR   string = `/tmp`
+	DEFAULT_SUDO_COMMAND string = "sudo"
+	UPLOAD_SCP           string = "scp"
+	UPLOAD_SFTP          string = "sftp"
+	UPLOAD_CAT           string = "cat"
+	UPLOAD_AUTO          string = "auto"
+	UPLOAD_MEMFD         string = "memfd"
+	UPLOAD_GZIP          string = "gzip"
+
+	DEFAULT_REMOTE_HELPER_RESTARTS int           = 3
+	DEFAULT_STABLE_UPTIME          time.Duration = 60 * time.Second
+	DEFAULT_RECONNECT_DELAY        time.Duration = 5 * time.Second
+	MAX_RECONNECT_DELAY            time.Duration = 5 * time.Minute
+	HELPER_STOP_TIMEOUT            time.Duration = 5 * time.Second
+
+	// MAX_WINDOW_SIZE limits the packets queued in front of the ssh
+	// channel in each direction (see tun.CopyPackets).
+	MAX_WINDOW_SIZE int = 64 << 20
 )
 
 type PrivateKeyFiles []string
@@ -50,28 +84,77 @@ type PrivateKeyFiles []string
 // sshtunKey and sshtun is set in the context passed to Open as a
 // context.WithValue. The mutex is used to prevent two tunnels from
 // opening at the same time or interfering with switching effective
-// uid which affects the main process.
+// uid which affects the main process. The helpers registry lets
+// tunnels to the same remote share one uploaded helper.
 type sshtunKey struct{}
 type sshtun struct {
-	mutex *sync.Mutex
+	mutex   *sync.Mutex
+	helpers *helperRegistry
 }
 
 type Tunnels struct {
-	Tunnels []*SSHTUN    `json:"tunnels"`
-	log     *slog.Logger `json:"-"`
+	Tunnels          []*SSHTUN              `json:"tunnels"`
+	DropPrivileges   bool                   `json:"drop_privileges,omitempty"`
+	DebugListen      string                 `json:"debug_listen,omitempty"`
+	DebugAllowRemote bool                   `json:"debug_allow_remote,omitempty"`
+	RedactRemotes    bool                   `json:"redact_remotes,omitempty"`
+	AddressPool      string                 `json:"address_pool,omitempty"`
+	AuditLog         string                 `json:"audit_log,omitempty"`
+	AuditLogMaxSize  int64                  `json:"audit_log_max_size,omitempty"`
+	DisableExpvar    bool                   `json:"-"`
+	EventBuffer      int                    `json:"-"`
+	CloseTimeout     time.Duration          `json:"-"`
+	log              *slog.Logger           `json:"-"`
+	mutex            sync.Mutex             `json:"-"`
+	ctx              context.Context        `json:"-"`
+	supervisors      map[string]*supervisor `json:"-"`
+	gaveUp           chan struct{}          `json:"-"`
+	failures         map[string]error       `json:"-"`
+	events           *eventSink             `json:"-"`
+	audit            *auditLog              `json:"-"`
+	redactor         *redactor              `json:"-"`
+	cancel           context.CancelFunc     `json:"-"`
+	done             chan struct{}          `json:"-"`
+	teardownErrs     []error                `json:"-"`
+	unsaved          []string               `json:"-"`
 }
 
 type SSHTUN struct {
 	Name                   string          `json:"name"`
 	Comment                string          `json:"comment,omitempty"`
+	Type                   string          `json:"type,omitempty"`
+	Forwards               []*Forward      `json:"forwards,omitempty"`
+	DeviceType             string          `json:"device_type,omitempty"`
 	Protocol               string          `json:"protocol"`
 	LocalNetwork           string          `json:"local_network"`
+	LocalNetwork6          string          `json:"local_network6,omitempty"`
 	LocalTunDevice         string          `json:"local_tun_device"`
 	LocalMTU               int             `json:"local_mtu"`
+	LocalBridge            string          `json:"local_bridge,omitempty"`
+	LocalTunOwner          string          `json:"local_tun_owner,omitempty"`
+	LocalTunGroup          string          `json:"local_tun_group,omitempty"`
+	AllowOverlap           bool            `json:"allow_overlap,omitempty"`
+	AddressFromPool        bool            `json:"address_from_pool,omitempty"`
 	Remote                 string          `json:"remote"`
 	RemoteNetwork          string          `json:"remote_network"`
+	RemoteNetwork6         string          `json:"remote_network6,omitempty"`
 	RemoteTunDevice        string          `json:"remote_tun_device"`
 	RemoteMTU              int             `json:"remote_mtu"`
+	RemoteBridge           string          `json:"remote_bridge,omitempty"`
+	RemoteRoutes           []string        `json:"remote_routes,omitempty"`
+	RemoteRouteVia         string          `json:"remote_route_via,omitempty"`
+	Role                   string          `json:"role,omitempty"`
+	ServerRoutes           []string        `json:"server_routes,omitempty"`
+	ServerDefaultRoute     bool            `json:"server_default_route,omitempty"`
+	ServerForward          bool            `json:"server_forward,omitempty"`
+	ServerNAT              bool            `json:"server_nat,omitempty"`
+	DefaultRoute           bool            `json:"default_route,omitempty"`
+	RemoteMasquerade       bool            `json:"remote_masquerade,omitempty"`
+	RemoteEnableForwarding bool            `json:"remote_enable_forwarding,omitempty"`
+	DNSServers             []string        `json:"dns_servers,omitempty"`
+	DNSSearch              []string        `json:"dns_search,omitempty"`
+	RemoteTunOwner         string          `json:"remote_tun_owner,omitempty"`
+	RemoteTunGroup         string          `json:"remote_tun_group,omitempty"`
 	RemoteUser             string          `json:"remote_user"`
 	UseSSHAgent            bool            `json:"use_ssh_agent"`
 	PrivateKeyFiles        PrivateKeyFiles `json:"private_key_files"`
@@ -80,9 +163,75 @@ type SSHTUN struct {
 	Enable                 bool            `json:"enable"`
 	KeepaliveInterval      Duration        `json:"keepalive_interval"`
 	KeepaliveMaxErrorCount int             `json:"keepalive_max_error_count"`
-	remoteTunReadWriter    string          `json:"-"`
-	done                   bool            `json:"-"`
-	log                    *slog.Logger    `json:"-"`
+	KeepaliveTimeout       Duration        `json:"keepalive_timeout,omitempty"`
+	HealthCheck            *HealthCheck    `json:"health_check,omitempty"`
+	TCPKeepalive           Duration        `json:"tcp_keepalive,omitempty"`
+	TCPUserTimeout         Duration        `json:"tcp_user_timeout,omitempty"`
+	WindowSize             int             `json:"window_size,omitempty"`
+	TransportTOS           int             `json:"transport_tos,omitempty"`
+	CopyDSCP               int             `json:"copy_dscp,omitempty"`
+	UploadTimeout          Duration        `json:"upload_timeout,omitempty"`
+	StartTimeout           Duration        `json:"start_timeout,omitempty"`
+	RemoteHelperRestarts   *int            `json:"remote_helper_restarts,omitempty"`
+	StableUptime           Duration        `json:"stable_uptime,omitempty"`
+	MaxReconnectAttempts   int             `json:"max_reconnect_attempts,omitempty"`
+	RetryAuthFailures      bool            `json:"retry_auth_failures,omitempty"`
+	RemoteCacheHelper      *bool           `json:"remote_cache_helper,omitempty"`
+	UploadMethod           string          `json:"upload_method,omitempty"`
+	MemfdSudoPython        bool            `json:"memfd_sudo_python,omitempty"`
+	CompressUpload         *bool           `json:"compress_upload,omitempty"`
+	RemoteSudoCommand      *string         `json:"remote_sudo_command,omitempty"`
+	RemoteCleanupAge       Duration        `json:"remote_cleanup_age,omitempty"`
+	RemoteStatsInterval    Duration        `json:"remote_stats_interval,omitempty"`
+	RemoteIdleExit         Duration        `json:"remote_idle_exit,omitempty"`
+	RemoteHelperExtraArgs  []string        `json:"remote_helper_extra_args,omitempty"`
+	RemoteHelperPath       string          `json:"remote_helper_path,omitempty"`
+	RemoteHelperAutoUpdate bool            `json:"remote_helper_auto_update,omitempty"`
+	Unprivileged           bool            `json:"unprivileged,omitempty"`
+	LogLevel               string          `json:"log_level,omitempty"`
+
+	Callbacks `json:"-"`
+
+	remoteTunReadWriter string                       `json:"-"`
+	remoteInterpreter   string                       `json:"-"`
+	memfdHelper         *Helper                      `json:"-"`
+	helpers             *helperRegistry              `json:"-"`
+	sharedHelper        *sharedHelper                `json:"-"`
+	remoteHandshake     handshake.Handshake          `json:"-"`
+	localTUN            *tun.TUN                     `json:"-"`
+	retainTUN           bool                         `json:"-"`
+	onLinkUp            func(name string)            `json:"-"`
+	up                  atomic.Bool                  `json:"-"`
+	connectedAt         atomic.Int64                 `json:"-"`
+	helperRestarts      atomic.Int64                 `json:"-"`
+	upSince             atomic.Int64                 `json:"-"`
+	uptime              atomic.Int64                 `json:"-"`
+	lastUpSince         atomic.Int64                 `json:"-"`
+	stateMutex          sync.Mutex                   `json:"-"`
+	state               State                        `json:"-"`
+	stateSince          time.Time                    `json:"-"`
+	logLevel            *tunnelLevel                 `json:"-"`
+	redactor            *redactor                    `json:"-"`
+	reconnects          atomic.Int64                 `json:"-"`
+	rxBytes             atomic.Int64                 `json:"-"`
+	txBytes             atomic.Int64                 `json:"-"`
+	lastError           atomic.Value                 `json:"-"`
+	history             history                      `json:"-"`
+	events              atomic.Pointer[eventSink]    `json:"-"`
+	audit               atomic.Pointer[auditLog]     `json:"-"`
+	handle              atomic.Pointer[Tunnel]       `json:"-"`
+	dns                 atomic.Pointer[DNSStatus]    `json:"-"`
+	uploadDuration      atomic.Int64                 `json:"-"`
+	inject              atomic.Pointer[lockedWriter] `json:"-"`
+	speedTest           atomic.Pointer[speedTester]  `json:"-"`
+	detectedSCP         string                       `json:"-"`
+	remoteAddr          string                       `json:"-"`
+	localAddr           string                       `json:"-"`
+	transport           net.Conn                     `json:"-"`
+	closeMutex          sync.Mutex                   `json:"-"`
+	closeOpen           context.CancelFunc           `json:"-"`
+	done                bool                         `json:"-"`
+	logger              atomic.Pointer[slog.Logger]  `json:"-"`
 }
 
 type Duration time.Duration
@@ -131,38 +280,64 @@ func NewSecureShellTunneler(logger *slog.Logger) *SSHTUN {
 			"~/.ssh/id_rsa",
 		},
 		RemoteSCP:              USR_BIN_SCP,
+		RemoteUploadDirectory:  DEFAULT_UPLOAD_DIR,
 		KeepaliveInterval:      Duration(2 * time.Minute),
 		KeepaliveMaxErrorCount: 5,
-		log:                    SetLogger(logger),
 	}
+	cfg.setLog(SetLogger(logger))
 	if usr, err := user.Current(); err == nil {
 		cfg.RemoteUser = usr.Username
 	}
 	return cfg
 }
 
+// LoadConfig reads the configuration from file configJson, or from
+// os.Stdin if configJson is STDIO_CONFIG (-), see ReadConfig.
 func LoadConfig(configJson string, logger *slog.Logger) (*Tunnels, error) {
-	f, err := os.Open(ResolveTildeSlash(configJson))
+	if configJson == STDIO_CONFIG {
+		return ReadConfig(os.Stdin, logger)
+	}
+	pth, err := ResolveTilde(configJson)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(pth)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
+	return ReadConfig(f, logger)
+}
+
+// ReadConfig decodes the json configuration from r, applies defaults
+// and assigns addresses from address_pool (see UnsavedAddresses).
+func ReadConfig(r io.Reader, logger *slog.Logger) (*Tunnels, error) {
 	var config Tunnels
-	if err := json.NewDecoder(f).Decode(&config); err != nil {
+	if err := json.NewDecoder(r).Decode(&config); err != nil {
 		return nil, err
 	}
 	for i := range config.Tunnels {
-		config.Tunnels[i].log = SetLogger(logger)
+		config.Tunnels[i].setLog(SetLogger(logger))
 		if config.Tunnels[i].RemoteSCP == "" {
 			config.Tunnels[i].RemoteSCP = USR_BIN_SCP
 		}
+		if config.Tunnels[i].RemoteUploadDirectory == "" {
+			config.Tunnels[i].RemoteUploadDirectory = DEFAULT_UPLOAD_DIR
+		}
 	}
 	config.log = SetLogger(logger)
+	config.redactRemotes()
+	config.applyLogLevels()
+	assigned, err := config.AssignAddresses()
+	if err != nil {
+		return nil, err
+	}
+	config.unsaved = assigned
 	return &config, nil
 }
 
 func LoadConfigOrReturnDefault(configJson string, logger *slog.Logger) *Tunnels {
-	config, err := LoadConfig(ResolveTildeSlash(configJson), logger)
+	config, err := LoadConfig(configJson, logger)
 	if err != nil {
 		return DefaultConfig(logger)
 	}
@@ -181,10 +356,88 @@ func LoadAndSave(configJson string, logger *slog.Logger) (*Tunnels, error) {
 }
 
 func (t *Tunnels) Total() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
 	return len(t.Tunnels)
 }
 
+// snapshot returns a copy of Tunnels taken under t.mutex, Add may
+// append to it concurrently.
+func (t *Tunnels) snapshot() []*SSHTUN {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]*SSHTUN(nil), t.Tunnels...)
+}
+
+// prepareLogging gives t a logger unless it has one and applies
+// RedactRemotes and the LogLevel of every tunnel (see Refresh). The
+// control socket may already be logging to t.log.
+func (t *Tunnels) prepareLogging() {
+	t.mutex.Lock()
+	if t.log == nil {
+		t.log = SetLogger(nil)
+	}
+	t.mutex.Unlock()
+	t.Refresh()
+}
+
+// Refresh applies RedactRemotes and the LogLevel of every tunnel
+// again, needed after tunnels were changed in place (e.g a remote
+// overridden) rather than through Add.
+func (t *Tunnels) Refresh() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.redactRemotes()
+	t.applyLogLevels()
+}
+
+// Up returns the number of tunnels where the remote helper has been
+// started and data is being forwarded.
+func (t *Tunnels) Up() int {
+	count := 0
+	for _, tunnel := range t.snapshot() {
+		if tunnel.IsUp() {
+			count++
+		}
+	}
+	return count
+}
+
+// IsUp returns true while the tunnel is established, i.e the remote
+// helper has been started and data is being forwarded.
+func (s *SSHTUN) IsUp() bool {
+	return s.up.Load()
+}
+
+// ConnectedSince returns when the current SSH connection was
+// established or the zero time if not connected. Restarting the
+// remote helper on the same connection does not change it.
+func (s *SSHTUN) ConnectedSince() time.Time {
+	if ns := s.connectedAt.Load(); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
+// HelperRestarts returns how many times the remote helper has been
+// restarted without reconnecting since the tunnel was first opened.
+func (s *SSHTUN) HelperRestarts() int64 {
+	return s.helperRestarts.Load()
+}
+
+// enabled returns Enable of tunnel, changed at runtime by EnableTunnel
+// and DisableTunnel under t.mutex.
+func (t *Tunnels) enabled(tunnel *SSHTUN) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return tunnel.Enable
+}
+
+// Enabled returns the number of tunnels marked enabled, see
+// EnableTunnel and DisableTunnel.
 func (t *Tunnels) Enabled() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
 	count := 0
 	for _, tunnel := range t.Tunnels {
 		if tunnel.Enable {
@@ -194,8 +447,16 @@ func (t *Tunnels) Enabled() int {
 	return count
 }
 
+// SaveConfig writes the configuration to file configJson, or to
+// os.Stdout if configJson is STDIO_CONFIG (-).
 func (t *Tunnels) SaveConfig(configJson string) error {
-	pth := ResolveTildeSlash(configJson)
+	if configJson == STDIO_CONFIG {
+		return t.WriteConfig(os.Stdout)
+	}
+	pth, err := ResolveTilde(configJson)
+	if err != nil {
+		return err
+	}
 	if err := os.MkdirAll(filepath.Dir(pth), 0777); err != nil {
 		return err
 	}
@@ -204,21 +465,135 @@ func (t *Tunnels) SaveConfig(configJson string) error {
 		return err
 	}
 	defer f.Close()
-	encoder := json.NewEncoder(f)
+	return t.WriteConfig(f)
+}
+
+// WriteConfig encodes the configuration as indented json to w.
+func (t *Tunnels) WriteConfig(w io.Writer) error {
+	encoder := json.NewEncoder(w)
 	encoder.SetIndent("", "  ")
 	if err := encoder.Encode(t); err != nil {
 		return err
 	}
+	t.unsaved = nil
 	return nil
 }
 
+// UnsavedAddresses returns the names of the tunnels LoadConfig
+// assigned addresses from AddressPool to since the configuration was
+// last saved with SaveConfig.
+func (t *Tunnels) UnsavedAddresses() []string {
+	return t.unsaved
+}
+
+// OpenAll opens every enabled tunnel and keeps reconnecting them until
+// ctx is cancelled (or Close is called), then returns nil. If every
+// tunnel gives up (ErrUnrecoverable or max_reconnect_attempts), the
+// returned error is an errors.Join of one *TunnelError per tunnel with
+// its final error.
 func (t *Tunnels) OpenAll(ctx context.Context) error {
-	var wg sync.WaitGroup
+	ctx = Context(ctx)
+	t.prepareLogging()
+	t.publishExpvar()
+	closeAudit, err := t.openAuditLog()
+	if err != nil {
+		return err
+	}
+	defer closeAudit()
+	if t.DropPrivileges {
+		t.prepareDropPrivileges()
+	}
+	ctx = t.begin(ctx)
+	defer t.end()
+	t.mutex.Lock()
+	t.ctx = ctx
+	t.supervisors = make(map[string]*supervisor)
+	t.gaveUp = make(chan struct{}, len(t.Tunnels))
+	t.failures = make(map[string]error)
+	t.mutex.Unlock()
+
+	tunnels := t.snapshot()
 	numberOfTunnels := 0
+	for i := range tunnels {
+		tunnel := tunnels[i]
+		// The control socket may enable (and start) or disable the
+		// tunnel meanwhile.
+		t.mutex.Lock()
+		enabled := tunnel.Enable
+		if _, running := t.supervisors[tunnel.Name]; enabled && !running {
+			t.startSupervisor(tunnel)
+		}
+		t.mutex.Unlock()
+		if !enabled {
+			t.log.Info("Tunnel not enabled, skipping", "name", tunnel.Name, "remote", tunnel.Remote, "remote_net", tunnel.RemoteNetwork, "local_net", tunnel.LocalNetwork)
+			continue
+		}
+		numberOfTunnels++
+	}
+
+	if numberOfTunnels == 0 {
+		return fmt.Errorf("0 out of %d tunnel(s) marked enabled in configuration", len(tunnels))
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			t.waitSupervisors()
+			return nil
+		case <-t.gaveUp:
+			// Only return when no tunnel is left running, tunnels stopped
+			// or started via the control socket do not count.
+			if t.Running() == 0 {
+				return t.failed()
+			}
+		}
+	}
+}
+
+// failed returns an errors.Join of one *TunnelError per tunnel that
+// gave up, in configuration order, the final error of each tunnel.
+func (t *Tunnels) failed() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var errs []error
+	for _, tunnel := range t.Tunnels {
+		if err, ok := t.failures[tunnel.Name]; ok {
+			errs = append(errs, &TunnelError{Name: tunnel.Name, Err: err})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// OpenOnce attempts to open every enabled tunnel exactly once. It
+// returns as soon as any tunnel fails to connect or is closed (and
+// then closes the other tunnels) or when ctx is cancelled. The
+// returned error is an errors.Join of one *TunnelError per failed
+// tunnel. Tunnels that connected and were later dropped wrap
+// ErrDisconnected, all other failures happened during setup.
+func (t *Tunnels) OpenOnce(ctx context.Context) error {
 	ctx = Context(ctx)
-	for i := range t.Tunnels {
-		tunnel := t.Tunnels[i]
-		if !tunnel.Enable {
+	t.prepareLogging()
+	t.publishExpvar()
+	closeAudit, err := t.openAuditLog()
+	if err != nil {
+		return err
+	}
+	defer closeAudit()
+	if t.DropPrivileges {
+		t.prepareDropPrivileges()
+	}
+	ctx = t.begin(ctx)
+	defer t.end()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	tunnels := t.snapshot()
+	numberOfTunnels := 0
+	for i := range tunnels {
+		tunnel := tunnels[i]
+		if !t.enabled(tunnel) {
 			t.log.Info("Tunnel not enabled, skipping", "name", tunnel.Name, "remote", tunnel.Remote, "remote_net", tunnel.RemoteNetwork, "local_net", tunnel.LocalNetwork)
 			continue
 		}
@@ -226,347 +601,1634 @@ func (t *Tunnels) OpenAll(ctx context.Context) error {
 		numberOfTunnels++
 		wg.Add(1)
 		go func() {
-			for {
-				if err := tunnel.Open(ctx); err != nil {
-					t.log.Error(err.Error())
-					if errors.Is(err, ErrUnrecoverable) {
-						wg.Done()
-						return
-					}
+			defer wg.Done()
+			defer t.closeLocalTUN(tunnel)
+			err := tunnel.Open(ctx)
+			if err == nil && ctx.Err() != nil {
+				return
+			}
+			if err == nil {
+				err = fmt.Errorf("%w: closed by remote", ErrDisconnected)
+			}
+			tunnel.setState(STATE_FAILED)
+			t.log.Error(err.Error(), "name", tunnel.Name, "class", ErrorClass(err))
+			mu.Lock()
+			errs = append(errs, &TunnelError{Name: tunnel.Name, Err: err})
+			mu.Unlock()
+			cancel()
+		}()
+	}
+	if numberOfTunnels == 0 {
+		return fmt.Errorf("0 out of %d tunnel(s) marked enabled in configuration", len(tunnels))
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// TunnelError associates an error with the name of the tunnel it
+// occurred in.
+type TunnelError struct {
+	Name string
+	Err  error
+}
+
+func (e *TunnelError) Error() string {
+	return fmt.Sprintf("tunnel %s: %v", e.Name, e.Err)
+}
+
+func (e *TunnelError) Unwrap() error {
+	return e.Err
+}
+
+// supervisor keeps track of the goroutine running the retry loop of
+// a single tunnel so that it can be cancelled and restarted at
+// runtime.
+type supervisor struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startSupervisor launches the retry loop for tunnel in a new
+// goroutine. t.mutex must be held by the caller and t.ctx must have
+// been set by OpenAll.
+func (t *Tunnels) startSupervisor(tunnel *SSHTUN) *supervisor {
+	ctx, cancel := context.WithCancel(t.ctx)
+	sv := &supervisor{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	t.supervisors[tunnel.Name] = sv
+	delete(t.failures, tunnel.Name)
+	t.log.Info(fmt.Sprintf("Connecting tunnel %s", tunnel.Name), "name", tunnel.Name, "remote", tunnel.Remote, "remote_net", tunnel.RemoteNetwork, "local_net", tunnel.LocalNetwork)
+	go func() {
+		defer close(sv.done)
+		defer cancel()
+		defer t.closeLocalTUN(tunnel)
+		giveUp := func(err error) {
+			tunnel.setState(STATE_FAILED)
+			t.mutex.Lock()
+			if t.supervisors[tunnel.Name] == sv {
+				delete(t.supervisors, tunnel.Name)
+				t.failures[tunnel.Name] = err
+			}
+			t.mutex.Unlock()
+			select {
+			case t.gaveUp <- struct{}{}:
+			default:
+			}
+		}
+		failures := 0
+		for {
+			err := tunnel.Open(ctx)
+			if err != nil {
+				t.log.Error(err.Error(), "name", tunnel.Name, "class", ErrorClass(err))
+				if errors.Is(err, ErrUnrecoverable) {
+					giveUp(err)
+					return
+				}
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if err == nil {
+				err = fmt.Errorf("%w: closed by remote", ErrDisconnected)
+			}
+			// Only a tunnel that stayed up for stable_uptime counts as
+			// a success, a tunnel dying right after connecting would
+			// otherwise reconnect in a tight loop.
+			uptime := tunnel.lastUptime()
+			if uptime >= tunnel.stableUptime() {
+				failures = 0
+			} else {
+				failures++
+				if uptime > 0 {
+					t.log.Warn(fmt.Sprintf("Tunnel %s connected but died after %s", tunnel.Name, uptime.Round(time.Second)), "name", tunnel.Name, "remote", tunnel.Remote, "uptime", uptime.String(), "stable_uptime", tunnel.stableUptime().String(), "failures", failures)
 				}
-				tmr := time.NewTimer(5 * time.Second)
-				defer tmr.Stop()
-				select {
-				case <-ctx.Done():
-					wg.Done()
+				if tunnel.MaxReconnectAttempts > 0 && failures > tunnel.MaxReconnectAttempts {
+					t.log.Error(fmt.Sprintf("Giving up on tunnel %s after %d failed reconnect attempts", tunnel.Name, tunnel.MaxReconnectAttempts), "name", tunnel.Name, "remote", tunnel.Remote, "max_reconnect_attempts", tunnel.MaxReconnectAttempts)
+					giveUp(fmt.Errorf("%w after %d failed reconnect attempts: %w", ErrGaveUp, tunnel.MaxReconnectAttempts, err))
 					return
-				case <-tmr.C:
 				}
 			}
-		}()
+			delay := reconnectDelay(failures, t.log)
+			tunnel.setState(STATE_RECONNECTING)
+			tunnel.event(EVENT_RETRY, nil, "delay", delay.String(), "failures", failures)
+			tunnel.onReconnectScheduled(delay)
+			t.log.Info(fmt.Sprintf("Reconnecting tunnel %s in %s", tunnel.Name, delay.Round(time.Millisecond)), "name", tunnel.Name, "remote", tunnel.Remote, "delay", delay.String(), "failures", failures)
+			tmr := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				// Stopped (e.g disabled) while waiting to reconnect.
+				tmr.Stop()
+				tunnel.setState(STATE_IDLE)
+				return
+			case <-tmr.C:
+			}
+			tunnel.reconnects.Add(1)
+		}
+	}()
+	return sv
+}
+
+// reconnectDelay returns the delay before the next reconnect after
+// failures unstable attempts in a row: DEFAULT_RECONNECT_DELAY
+// doubled per failure up to MAX_RECONNECT_DELAY, with up to 20%
+// random jitter so that tunnels to the same remote spread out. If
+// crypto/rand fails, the jitter is taken from the clock instead.
+func reconnectDelay(failures int, logger *slog.Logger) time.Duration {
+	delay := DEFAULT_RECONNECT_DELAY
+	for i := 1; i < failures && delay < MAX_RECONNECT_DELAY; i++ {
+		delay *= 2
+	}
+	if delay > MAX_RECONNECT_DELAY {
+		delay = MAX_RECONNECT_DELAY
+	}
+	jitter, err := crand.Int63nE(int64(delay)/5 + 1)
+	if err != nil {
+		SetLogger(logger).Warn("Unable to read crypto/rand, using the clock for reconnect jitter", "error", err)
+		jitter = time.Now().UnixNano() % (int64(delay)/5 + 1)
 	}
+	return delay + time.Duration(jitter)
+}
 
-	if numberOfTunnels == 0 {
-		return fmt.Errorf("0 out of %d tunnel(s) marked enabled in configuration", len(t.Tunnels))
+// stableUptime returns StableUptime or DEFAULT_STABLE_UPTIME if not
+// set.
+func (s *SSHTUN) stableUptime() time.Duration {
+	if s.StableUptime == 0 {
+		return DEFAULT_STABLE_UPTIME
 	}
+	return time.Duration(s.StableUptime)
+}
 
-	wg.Wait()
-	// should never reach here...
+// lastUptime returns how long the tunnel was up during the last Open,
+// 0 if it never came up.
+func (s *SSHTUN) lastUptime() time.Duration {
+	return time.Duration(s.uptime.Load())
+}
+
+// prepareDropPrivileges makes every tunnel keep its local TUN device
+// open across reconnects and drops privileges permanently (see
+// DropPrivileges) once every enabled tunnel has linked up its device.
+func (t *Tunnels) prepareDropPrivileges() {
+	var mu sync.Mutex
+	tunnels := t.snapshot()
+	pending := make(map[string]bool)
+	for _, tunnel := range tunnels {
+		if t.enabled(tunnel) {
+			pending[tunnel.Name] = true
+		}
+	}
+	dropped := false
+	report := func(name string) {
+		mu.Lock()
+		delete(pending, name)
+		drop := len(pending) == 0 && !dropped
+		if drop {
+			dropped = true
+		}
+		mu.Unlock()
+		if !drop {
+			return
+		}
+		if err := dropPrivileges(); errors.Is(err, ErrDropAsRoot) {
+			t.log.Warn("Not dropping privileges", "error", err)
+		} else if err != nil {
+			t.log.Error("Unable to drop privileges", "error", err)
+		} else {
+			t.log.Info("Dropped privileges permanently, new TUN devices can not be created until restart", "uid", os.Getuid(), "gid", os.Getgid())
+		}
+	}
+	for _, tunnel := range tunnels {
+		tunnel.retainTUN = true
+		tunnel.onLinkUp = report
+	}
+}
+
+// stopSupervisor cancels the retry loop of the named tunnel and waits
+// for it to exit. Returns false if the tunnel was not running.
+func (t *Tunnels) stopSupervisor(name string) bool {
+	t.mutex.Lock()
+	sv, ok := t.supervisors[name]
+	if ok {
+		delete(t.supervisors, name)
+	}
+	t.mutex.Unlock()
+	if !ok {
+		return false
+	}
+	sv.cancel()
+	if tunnel, err := t.Lookup(name); err == nil {
+		tunnel.Close()
+	}
+	<-sv.done
+	return true
+}
+
+func (t *Tunnels) waitSupervisors() {
+	t.mutex.Lock()
+	svs := make([]*supervisor, 0, len(t.supervisors))
+	for _, sv := range t.supervisors {
+		svs = append(svs, sv)
+	}
+	t.mutex.Unlock()
+	for _, sv := range svs {
+		<-sv.done
+	}
+}
+
+// Running returns the number of tunnels currently being supervised
+// (connected or retrying) by OpenAll.
+func (t *Tunnels) Running() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.supervisors)
+}
+
+// Lookup returns the tunnel with name or an error wrapping
+// ErrUnknownTunnel listing all valid names.
+func (t *Tunnels) Lookup(name string) (*SSHTUN, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	names := make([]string, 0, len(t.Tunnels))
+	for _, tunnel := range t.Tunnels {
+		if tunnel == nil {
+			continue
+		}
+		if tunnel.Name == name {
+			return tunnel, nil
+		}
+		names = append(names, tunnel.Name)
+	}
+	return nil, fmt.Errorf("%w %q, valid names are: %s", ErrUnknownTunnel, name, strings.Join(names, ", "))
+}
+
+// Add appends tunnels to t, logging to the logger of t (see
+// SetLogger) and sending events to Events if called. Returns an error
+// wrapping ErrInvalidConfig if the name of a tunnel is already taken,
+// no tunnel is added then. Added tunnels are not started, see
+// EnableTunnel.
+func (t *Tunnels) Add(tunnels ...*SSHTUN) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	names := make(map[string]bool, len(t.Tunnels)+len(tunnels))
+	for _, tunnel := range t.Tunnels {
+		names[tunnel.Name] = true
+	}
+	for _, tunnel := range tunnels {
+		if tunnel == nil {
+			return ErrNilPointer
+		}
+		if names[tunnel.Name] {
+			return fmt.Errorf("%w: tunnel %q: duplicate name", ErrInvalidConfig, tunnel.Name)
+		}
+		names[tunnel.Name] = true
+	}
+	logger := t.logger()
+	for _, tunnel := range tunnels {
+		tunnel.SetLogger(logger)
+		if t.events != nil {
+			tunnel.events.Store(t.events)
+		}
+		if t.audit != nil {
+			tunnel.audit.Store(t.audit)
+		}
+		t.Tunnels = append(t.Tunnels, tunnel)
+	}
+	t.redactRemotes()
+	t.applyLogLevels()
+	return nil
+}
+
+// Start launches the retry loop of the named tunnel, like OpenAll does
+// for every enabled tunnel, whether enabled or not. The tunnel runs
+// until Stop is called, OpenAll returns or ctx is cancelled. Returns
+// ErrNotRunning unless OpenAll is running and an error wrapping
+// ErrTunnelRunning if the tunnel already is.
+func (t *Tunnels) Start(ctx context.Context, name string) error {
+	tunnel, err := t.Lookup(name)
+	if err != nil {
+		return err
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.ctx == nil {
+		return ErrNotRunning
+	}
+	if _, running := t.supervisors[name]; running {
+		return fmt.Errorf("%w: %s", ErrTunnelRunning, name)
+	}
+	sv := t.startSupervisor(tunnel)
+	stop := context.AfterFunc(ctx, sv.cancel)
+	go func() {
+		<-sv.done
+		stop()
+		t.mutex.Lock()
+		if t.supervisors[name] == sv {
+			delete(t.supervisors, name)
+		}
+		t.mutex.Unlock()
+	}()
+	return nil
+}
+
+// Stop cancels the retry loop of the named tunnel and waits for the
+// tunnel to be torn down. The in-memory configuration is not changed,
+// see DisableTunnel. Returns an error wrapping ErrTunnelNotRunning if
+// the tunnel is not running.
+func (t *Tunnels) Stop(name string) error {
+	if _, err := t.Lookup(name); err != nil {
+		return err
+	}
+	if !t.stopSupervisor(name) {
+		return fmt.Errorf("%w: %s", ErrTunnelNotRunning, name)
+	}
+	t.log.Info("Tunnel stopped", "name", name)
+	return nil
+}
+
+// EnableTunnel marks the named tunnel as enabled and starts it unless
+// it is already running. Only the in-memory configuration is changed.
+// Requires OpenAll to be running.
+func (t *Tunnels) EnableTunnel(name string) error {
+	tunnel, err := t.Lookup(name)
+	if err != nil {
+		return err
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.ctx == nil {
+		return ErrNotRunning
+	}
+	tunnel.Enable = true
+	if _, running := t.supervisors[name]; !running {
+		t.startSupervisor(tunnel)
+	}
+	return nil
+}
+
+// DisableTunnel stops the named tunnel and marks it as disabled in
+// the in-memory configuration.
+func (t *Tunnels) DisableTunnel(name string) error {
+	tunnel, err := t.Lookup(name)
+	if err != nil {
+		return err
+	}
+	t.mutex.Lock()
+	tunnel.Enable = false
+	t.mutex.Unlock()
+	if t.stopSupervisor(name) {
+		t.log.Info("Tunnel disabled", "name", name)
+	}
+	return nil
+}
+
+// ReconnectTunnel tears down the named tunnel and starts it again
+// immediately.
+func (t *Tunnels) ReconnectTunnel(name string) error {
+	tunnel, err := t.Lookup(name)
+	if err != nil {
+		return err
+	}
+	if !t.stopSupervisor(name) && !t.enabled(tunnel) {
+		return fmt.Errorf("tunnel %q is disabled", name)
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.ctx == nil {
+		return ErrNotRunning
+	}
+	if _, running := t.supervisors[name]; !running {
+		t.log.Info("Reconnecting tunnel", "name", name)
+		t.startSupervisor(tunnel)
+	}
+	return nil
+}
+
+// ResolveTildeSlash returns pth with a leading ~ or ~user resolved as
+// ResolveTilde does, or pth unchanged if it can not be resolved.
+func ResolveTildeSlash(pth string) string {
+	resolved, err := ResolveTilde(pth)
+	if err != nil {
+		return pth
+	}
+	return resolved
+}
+
+// ResolveTilde replaces a leading ~ (or ~/) with the home directory of
+// the current user and ~user (or ~user/) with the home directory of
+// user, e.g ~alice/.ssh/id_ed25519 becomes
+// /home/alice/.ssh/id_ed25519. Other paths are returned as is. Returns
+// an error wrapping ErrUnresolvedTilde if the home directory is unknown
+// or the user does not exist.
+func ResolveTilde(pth string) (string, error) {
+	if !strings.HasPrefix(pth, "~") {
+		return pth, nil
+	}
+	name, rest, _ := strings.Cut(pth[1:], "/")
+	var dir string
+	if name == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return pth, fmt.Errorf("%w in %s: %w", ErrUnresolvedTilde, pth, err)
+		}
+		dir = home
+	} else {
+		usr, err := user.Lookup(name)
+		if err != nil {
+			return pth, fmt.Errorf("%w in %s: %w", ErrUnresolvedTilde, pth, err)
+		}
+		dir = usr.HomeDir
+	}
+	return filepath.Join(dir, rest), nil
+}
+
+// CreateFile creates (or truncates) pth for writing with permissions
+// perm (before umask), creating missing parent directories with mode
+// 0755. A leading ~ is resolved with ResolveTilde.
+func CreateFile(pth string, perm os.FileMode) (*os.File, error) {
+	fullPath, err := ResolveTilde(pth)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(fullPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+}
+
+// CreateFileDefault is CreateFile with mode 0644.
+//
+// Deprecated: use CreateFile with an explicit mode.
+func CreateFileDefault(pth string) (*os.File, error) {
+	return CreateFile(pth, 0644)
+}
+
+// Add receiver functions to implement the flag.Value interface for flag.Var()...
+
+func (k *PrivateKeyFiles) String() string {
+	if k == nil {
+		return ""
+	}
+	pkfs := make([]string, 0, len(*k))
+	for _, pkf := range *k {
+		pkfs = append(pkfs, ResolveTildeSlash(pkf))
+	}
+	return strings.Join(pkfs, ", ")
+}
+
+func (k *PrivateKeyFiles) Set(value string) error {
+	if k == nil {
+		return ErrNilPointer
+	}
+	*k = append(*k, value)
 	return nil
 }
 
-func ResolveTildeSlash(pth string) string {
-	if strings.HasPrefix(pth, "~/") {
-		dir, err := os.UserHomeDir()
-		if err != nil {
-			return pth
+func unrecoverable(err error) error {
+	return fmt.Errorf("%w: %w", ErrUnrecoverable, err)
+}
+
+// Returns a context with an internal sshtun object mainly used for
+// synchronization (sync.Mutex) and for sharing uploaded helpers
+// between tunnels to the same remote.
+func Context(ctx context.Context) context.Context {
+	var mu sync.Mutex
+	ctx = context.WithValue(ctx, sshtunKey{}, sshtun{
+		mutex:   &mu,
+		helpers: newHelperRegistry(),
+	})
+	return ctx
+}
+
+// Open is the main function for setting up and connecting both ends
+// of the tunnel. Open blocks until tunnel is closed or ctx is
+// cancelled. If PrivOpMain has enabled the privileged helper, the
+// local tun device is created by the helper and Open never changes
+// effective uid, otherwise ctx must be initialized via the Context
+// function before passed to Open or ErrMissingContext will be
+// returned. An Unprivileged tunnel opens its pre-provisioned tun
+// device (see Provision) and needs no privileges at all. The
+// Callbacks of s are called as the tunnel connects and disconnects.
+// Close stops the tunnel like cancelling ctx, Open then returns nil.
+// Port forwards (see Type) need neither privileges nor Context.
+// Open is Start and Wait without the handle, see Start, but runs in
+// the calling goroutine so that a thread locked to another network
+// namespace is honoured.
+func (s *SSHTUN) Open(ctx context.Context) error {
+	t := s.newTunnel()
+	t.run(ctx)
+	return t.err
+}
+
+// run is the body of Open, run by Tunnel.run.
+func (s *SSHTUN) run(ctx context.Context) error {
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	s.closeMutex.Lock()
+	s.closeOpen = cancel
+	s.closeMutex.Unlock()
+	defer func() {
+		s.closeMutex.Lock()
+		s.closeOpen = nil
+		s.closeMutex.Unlock()
+		cancel()
+	}()
+	s.uptime.Store(0)
+	s.lastUpSince.Store(0)
+	started := time.Now()
+	s.setState(STATE_DIALING)
+	s.event(EVENT_CONNECTING, nil, "remote", s.Remote)
+	s.onConnecting()
+	err := s.open(ctx)
+	if ctx.Err() != nil && parent.Err() == nil {
+		// Closed by Close.
+		err = nil
+	}
+	if err != nil {
+		s.lastError.Store(err.Error())
+	}
+	s.recordAttempt(started, err)
+	switch {
+	case errors.Is(err, ErrAuthFailed):
+		s.auditRecord(AUDIT_AUTH_FAILURE, err)
+	case errors.Is(err, ErrHostKeyMismatch):
+		s.auditRecord(AUDIT_HOST_KEY_MISMATCH, err)
+	}
+	if errors.Is(err, ErrUnrecoverable) && ctx.Err() == nil {
+		s.setState(STATE_FAILED)
+	} else {
+		s.setState(STATE_IDLE)
+	}
+	if since := s.lastUpSince.Load(); since != 0 {
+		s.event(EVENT_DISCONNECTED, err, "remote", s.Remote, "uptime", s.lastUptime().String())
+		s.auditRecord(AUDIT_DISCONNECTED, err)
+		s.onDisconnected(time.Unix(0, since), err)
+	}
+	return err
+}
+
+// transferHelper makes the helper available on the remote (installed,
+// in memory or uploaded), checks sudo and cleans up stale helpers, the
+// upload stage of Open.
+func (s *SSHTUN) transferHelper(ctx context.Context, client *ssh.Client) error {
+	s.remoteInterpreter, s.memfdHelper = "", nil
+	if s.RemoteHelperPath != "" {
+		if err := s.useInstalledHelper(client); err != nil {
+			return classified(ErrRemoteSetupFailed, err)
+		}
+	} else {
+		if s.uploadMethod() == UPLOAD_MEMFD {
+			if err := s.prepareMemfd(client); err != nil {
+				s.log().Warn(fmt.Sprintf("Unable to run tunreadwriter from memory on ssh://%s, uploading it instead", s.Remote), "name", s.Name, "remote", s.Remote, "error", err)
+			}
+		}
+		if s.memfdHelper == nil {
+			if err := s.uploadHelperRetrying(ctx, client); err != nil {
+				return err
+			}
+		}
+	}
+	if err := s.checkRemoteSudo(client); err != nil {
+		return classified(ErrRemoteSetupFailed, err)
+	}
+	if n, err := s.CleanupRemoteHelpers(client); err != nil {
+		s.log().Warn("Unable to clean up stale tunreadwriter binaries", "name", s.Name, "remote", s.Remote, "error", err)
+	} else if n > 0 {
+		s.log().Info(fmt.Sprintf("Removed %d stale tunreadwriter binaries from %s on ssh://%s", n, s.remoteUploadDirectory(), s.Remote), "name", s.Name, "remote", s.Remote, "removed", n)
+	}
+	return nil
+}
+
+// Close stops the tunnel opened by a running Open, taking the same path
+// as cancelling its context: the session with the remote helper and the
+// ssh connection are closed and the local tun device is closed unless
+// retained. Open then returns nil. Close does not wait for Open to
+// return and does nothing if Open is not running, it is safe to call
+// at any time and from callbacks.
+func (s *SSHTUN) Close() error {
+	s.closeMutex.Lock()
+	defer s.closeMutex.Unlock()
+	if s.closeOpen != nil {
+		s.log().Info(fmt.Sprintf("Closing tunnel %s", s.Name), "name", s.Name, "remote", s.Remote)
+		s.closeOpen()
+	}
+	return nil
+}
+
+func (s *SSHTUN) open(ctx context.Context) error {
+	if s.forwarding() {
+		return s.openForwards(ctx)
+	}
+	privileged := privopEnabled()
+	var v sshtun
+	unlockOnExit := false
+	if !privileged {
+		var ok bool
+		v, ok = ctx.Value(sshtunKey{}).(sshtun)
+		if !ok {
+			return ErrMissingContext
+		}
+		// Lock mutex and setup a defer conditionally unlocking the mutex
+		v.mutex.Lock()
+		s.log().Debug("Locked mutex", "name", s.Name)
+		unlockOnExit = true
+	}
+	defer func() {
+		if unlockOnExit {
+			s.log().Debug("Unlocking mutex", "name", s.Name)
+			v.mutex.Unlock()
+		}
+	}()
+
+	localTUN := s.localTUN
+	linkedUp := localTUN != nil || privileged || s.Unprivileged
+	if localTUN == nil && !s.Unprivileged {
+		if err := s.checkAddressConflicts(); err != nil {
+			return unrecoverable(err)
+		}
+	}
+	var b *Became
+	var err error
+	if localTUN != nil {
+		s.log().Info(fmt.Sprintf("Reusing local TUN device %s", localTUN.Name), "tun", localTUN.Name, "name", s.Name)
+	} else if s.Unprivileged {
+		localTUN, err = s.openProvisionedTUN()
+	} else if privileged {
+		var uid, gid int
+		if uid, gid, err = s.localTunOwner(); err == nil {
+			s.log().Info(fmt.Sprintf("Creating local TUN device with address %s and MTU %d through the privileged helper", s.LocalNetwork, s.LocalMTU), "tun", s.LocalTunDevice, "name", s.Name, "net", s.LocalNetwork, "net6", s.LocalNetwork6, "mtu", s.LocalMTU, "proto", s.Protocol, "uid", uid, "gid", gid)
+			localTUN, err = privopCreateTUN(TUNRequest{
+				Device:   s.LocalTunDevice,
+				MTU:      s.LocalMTU,
+				Network:  s.LocalNetwork,
+				Network6: s.LocalNetwork6,
+				Peer:     s.localPeer(),
+				TAP:      s.tap(),
+				Bridge:   s.LocalBridge,
+				UID:      uid,
+				GID:      gid,
+			})
+		}
+	} else {
+		b, localTUN, err = s.createLocalTUN()
+		if err == nil && s.retainTUN {
+			// A retained device must not need privileges on reconnect.
+			if err = s.linkUp(b, localTUN); err != nil {
+				localTUN.Close()
+			}
+			linkedUp = true
+		}
+	}
+	if err == nil && localTUN != s.localTUN {
+		// Only the local end is non-blocking, reading it is stopped
+		// with SetReadDeadline when the session ends.
+		if err = localTUN.SetNonblock(); err != nil {
+			localTUN.Close()
+		}
+	}
+	if err != nil {
+		return unrecoverable(err)
+	}
+	if s.retainTUN {
+		s.localTUN = localTUN
+	} else {
+		defer localTUN.Close()
+	}
+	s.LocalTunDevice = localTUN.Name
+	if linkedUp && s.onLinkUp != nil {
+		s.onLinkUp(s.Name)
+	}
+
+	s.warnBridging()
+	s.warnAddressing()
+
+	s.log().Info(fmt.Sprintf("Connecting to ssh://%s", s.Remote), "remote", s.Remote, "name", s.Name)
+
+	client, err := s.Dial(ctx)
+	if err != nil {
+		return s.retryable(err)
+	}
+	openDone := make(chan struct{})
+	defer close(openDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-openDone:
+		}
+		client.Close()
+	}()
+
+	defer s.trackConnection(client)()
+
+	// Transfer tunreadwriter to other side
+	s.setState(STATE_UPLOADING)
+
+	s.helpers = helperRegistryFrom(ctx)
+	defer s.releaseHelper(client)
+	stopUpload := stageTimer(client, STAGE_UPLOAD, s.uploadTimeout())
+	err = s.transferHelper(ctx, client)
+	if terr := stopUpload(); terr != nil {
+		return terr
+	}
+	if err != nil {
+		return err
+	}
+
+	if !linkedUp {
+		if err := s.linkUp(b, localTUN); err != nil {
+			return unrecoverable(err)
+		}
+		if s.onLinkUp != nil {
+			s.onLinkUp(s.Name)
+		}
+	}
+
+	removePolicy, err := s.applyLocalPolicy(localTUN)
+	if err != nil {
+		return unrecoverable(err)
+	}
+	defer func() {
+		// Removing the policy switches uid as well, hold the mutex
+		// again.
+		if !unlockOnExit && !privileged {
+			v.mutex.Lock()
+			defer v.mutex.Unlock()
+		}
+		removePolicy()
+	}()
+
+	removeDNS := s.applyDNS(localTUN.Name)
+	defer func() {
+		if !unlockOnExit && !privileged {
+			v.mutex.Lock()
+			defer v.mutex.Unlock()
+		}
+		removeDNS()
+	}()
+
+	defer s.startKeepalive(client)()
+
+	if unlockOnExit {
+		s.log().Debug("Unlocking mutex", "name", s.Name)
+		v.mutex.Unlock()
+		unlockOnExit = false
+	}
+
+	s.log().Info("Starting tunnel", "name", s.Name, "remote", s.Remote, "local_net", s.LocalNetwork, "remote_net", s.RemoteNetwork, "local_tun", s.LocalTunDevice, "remote_tun", s.RemoteTunDevice, "local_mtu", s.LocalMTU, "remote_mtu", s.RemoteMTU)
+
+	err = s.StartTunneling(client, localTUN)
+	if errors.Is(err, ErrHelperProtocol) && s.RemoteHelperPath != "" && ctx.Err() == nil {
+		if !s.RemoteHelperAutoUpdate {
+			return fmt.Errorf("%w, update %s with sshtun -install-remote-helper %s", err, s.RemoteHelperPath, s.Name)
+		}
+		s.log().Warn(fmt.Sprintf("Remote helper %s is incompatible, updating it", s.RemoteHelperPath), "name", s.Name, "remote", s.Remote, "error", err)
+		helper, herr := remoteHelper(client)
+		if herr != nil {
+			return herr
+		}
+		if err := s.installRemoteHelper(client, helper); err != nil {
+			return err
+		}
+		err = s.StartTunneling(client, localTUN)
+	} else if errors.Is(err, ErrHelperProtocol) && s.CachesHelper() && s.memfdHelper == nil && ctx.Err() == nil {
+		helper, herr := remoteHelper(client)
+		if herr != nil {
+			return herr
+		}
+		if cachedHelperValid(client, s.remoteTunReadWriter, helper) {
+			// Uploading the same binary again would not help.
+			return fmt.Errorf("%w (%s is the embedded helper)", err, s.remoteTunReadWriter)
+		}
+		s.log().Warn(fmt.Sprintf("Remote helper %s is incompatible, re-upload forced", s.remoteTunReadWriter), "name", s.Name, "remote", s.Remote, "error", err)
+		if err := sshrun(client, "rm -f "+shellescape.Quote(s.remoteTunReadWriter)); err != nil {
+			return fmt.Errorf("unable to remove incompatible helper %s: %w", s.remoteTunReadWriter, err)
+		}
+		if err := s.uploadHelperRetrying(ctx, client); err != nil {
+			return err
+		}
+		err = s.StartTunneling(client, localTUN)
+	}
+	for restarts := 0; err != nil && restarts < s.remoteHelperRestarts() && restartableHelperError(err) && ctx.Err() == nil; restarts++ {
+		if aerr := waitAlive(serverAliveCheck(client), 10*time.Second, ctx.Done()); aerr != nil {
+			s.log().Debug("SSH connection is gone, not restarting the remote helper", "name", s.Name, "remote", s.Remote, "error", aerr)
+			break
+		}
+		s.log().Warn(fmt.Sprintf("Remote helper exited, restarting it on the existing connection to ssh://%s", s.Remote), "name", s.Name, "remote", s.Remote, "restart", restarts+1, "max_restarts", s.remoteHelperRestarts(), "connected_since", s.ConnectedSince(), "error", err)
+		tmr := time.NewTimer(time.Second)
+		select {
+		case <-ctx.Done():
+			tmr.Stop()
+			continue
+		case <-tmr.C:
+		}
+		if rerr := s.restartRemoteHelper(ctx, client); rerr != nil {
+			err = fmt.Errorf("unable to restart remote helper: %w (after %w)", rerr, err)
+			break
+		}
+		s.helperRestarts.Add(1)
+		err = s.StartTunneling(client, localTUN)
+	}
+	if err != nil && ctx.Err() == nil {
+		// Only a tunnel that came up on this connection was
+		// disconnected, otherwise the remote helper failed to start.
+		if s.upSince.Load() == 0 {
+			return err
+		}
+		return fmt.Errorf("%w: sshtun.StartTunneling: %w", ErrDisconnected, err)
+	}
+	s.log().Info("Tunnel closed", "name", s.Name, "remote", s.Remote, "local_net", s.LocalNetwork, "remote_net", s.RemoteNetwork, "local_tun", s.LocalTunDevice, "remote_tun", s.RemoteTunDevice, "local_mtu", s.LocalMTU, "remote_mtu", s.RemoteMTU)
+	return nil
+}
+
+func (s *SSHTUN) StartTunneling(client *ssh.Client, localTUN *tun.TUN) (err error) {
+	if s.remoteTunReadWriter == "" {
+		return ErrNoTunReadWriter
+	}
+
+	// The start stage lasts until the helper has answered the
+	// handshake, failures until then are remote setup failures.
+	stopStart := stageTimer(client, STAGE_START, s.startTimeout())
+	started := false
+	defer func() {
+		if terr := stopStart(); terr != nil {
+			err = terr
+		} else if !started {
+			err = classified(ErrRemoteSetupFailed, err)
+		}
+	}()
+
+	remoteTunReadWriterCommand := s.tunReadWriterCommand()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	remoteIN, err := session.StdinPipe()
+	if err != nil {
+		return nil
+	}
+	defer remoteIN.Close()
+
+	remoteOUT, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	// tunreadwriter write errors to stderr
+	remoteERR, err := session.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	s.log().Info(fmt.Sprintf("Starting %s on remote ssh://%s", s.remoteTunReadWriter, s.Remote), "remote_addr", client.RemoteAddr().String(), "remote", s.Remote, "remote_command", redactCommand(remoteTunReadWriterCommand), "name", s.Name)
+
+	s.setState(STATE_STARTING)
+	if err := session.Start(remoteTunReadWriterCommand); err != nil {
+		return err
+	}
+	if s.memfdHelper != nil {
+		// The loader reads the helper from stdin before executing it.
+		if _, err := remoteIN.Write(s.memfdHelper.Binary); err != nil {
+			return fmt.Errorf("unable to send tunreadwriter to the memfd loader: %w", err)
+		}
+	}
+
+	// Relay ROUTE lines from the helper while it runs, keep the rest
+	// for the error message if it exits.
+	var rerr bytes.Buffer
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		scanner := bufio.NewScanner(remoteERR)
+		for scanner.Scan() {
+			if !s.logHelperLine(scanner.Text()) {
+				rerr.WriteString(scanner.Text() + "\n")
+			}
+		}
+	}()
+	trwERR := func() string {
+		<-stderrDone
+		if rerr.Len() > 0 {
+			return strings.TrimSpace(rerr.String())
+		}
+		return "no output on stderr"
+	}
+
+	out := bufio.NewReader(remoteOUT)
+	hs, err := handshake.Read(out)
+	if err != nil {
+		if errors.Is(err, handshake.ErrProtocolVersion) {
+			// The caller replaces the incompatible helper, it must
+			// not keep running (or its binary busy) meanwhile.
+			stopHelper(session, remoteIN)
+			return fmt.Errorf("%w: %w", ErrHelperProtocol, err)
+		}
+		session.Wait()
+		output := trwERR()
+		switch {
+		case strings.Contains(output, "flag provided but not defined: -handshake"):
+			return fmt.Errorf("%w: %w: remote helper protocol v0, need v%d", ErrHelperProtocol, handshake.ErrProtocolVersion, handshake.VERSION)
+		case strings.Contains(output, "flag provided but not defined: -window-size"):
+			return fmt.Errorf("%w: remote helper does not support -window-size (window_size), upgrade it or remove window_size", ErrHelperProtocol)
+		case sudoPasswordRequired(output):
+			return s.sudoPasswordError(output)
+		}
+		return fmt.Errorf("%w: %s", err, output)
+	}
+	if err := stopStart(); err != nil {
+		return err
+	}
+	started = true
+	s.remoteHandshake = hs
+	// Packets from the local tun device, the health check and a
+	// speedtest share the session.
+	toRemote := &lockedWriter{w: remoteIN}
+	s.inject.Store(toRemote)
+	defer s.inject.Store(nil)
+	s.log().Debug("Remote helper handshake", "name", s.Name, "protocol", hs.Version, "remote_tun", hs.Device, "remote_mtu", hs.MTU, "families", strings.Join(hs.Families, ","))
+
+	s.up.Store(true)
+	s.setState(STATE_CONNECTED)
+	// The error of a previous attempt is history once connected.
+	s.lastError.Store("")
+	defer s.up.Store(false)
+	if now := time.Now(); s.upSince.CompareAndSwap(0, now.UnixNano()) {
+		s.event(EVENT_CONNECTED, nil, "remote", s.Remote, "remote_addr", s.remoteAddr, "local_tun", s.LocalTunDevice, "remote_tun", hs.Device)
+		s.auditRecord(AUDIT_CONNECTED, nil)
+		s.handle.Load().markUp(s)
+		s.onConnected(now)
+	}
+
+	var toLocal io.Writer = speedTestFilter{w: localTUN, s: s}
+	var health *healthChecker
+	if s.HealthCheck != nil {
+		if health, err = s.newHealthChecker(); err != nil {
+			return err
+		}
+		toLocal = replyFilter{w: toLocal, h: health}
+		healthDone := make(chan struct{})
+		defer close(healthDone)
+		s.log().Info(fmt.Sprintf("Enabling health check of %s", health.dst), "name", s.Name, "remote", s.Remote, "dst", health.dst.String(), "interval", s.HealthCheck.interval().String(), "max_misses", s.HealthCheck.maxMisses())
+		go health.run(toRemote, s.HealthCheck.interval(), s.HealthCheck.maxMisses(), s.log().With("name", s.Name, "remote", s.Remote), func(err error) {
+			s.log().Error("Tunnel unhealthy, reconnecting", "name", s.Name, "remote", s.Remote, "error", err)
+			client.Close()
+		}, healthDone)
+	}
+	if !s.tap() {
+		// Packets read back-to-back from the session reach the
+		// filters and the tun device one by one.
+		toLocal = tun.NewPacketWriter(toLocal)
+	}
+
+	go func() {
+		if _, err := io.Copy(countingWriter{w: toLocal, n: &s.rxBytes}, out); err != nil {
+			s.log().Error("io error in remote to local go routine", "error", err)
+		}
+	}()
+	localDone := make(chan struct{})
+	go func() {
+		defer close(localDone)
+		var err error
+		if s.tap() {
+			_, err = io.Copy(countingWriter{w: toRemote, n: &s.txBytes}, localTUN)
+		} else {
+			// Packets read while the channel waits for its window
+			// are queued and sent together, the helper splits them
+			// again.
+			_, err = tun.CopyPackets(countingWriter{w: s.newDSCPWriter(toRemote, s.transport), n: &s.txBytes}, localTUN, s.WindowSize)
+		}
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			s.log().Error("io error in local to remote go routine", "error", err)
+		}
+	}()
+	dropped := localTUN.Dropped()
+	defer func() {
+		if n := localTUN.Dropped() - dropped; n > 0 {
+			s.log().Warn(fmt.Sprintf("Dropped %d packets from ssh://%s, the local tun device was full", n, s.Remote), "name", s.Name, "remote", s.Remote, "tun", localTUN.Name, "dropped", n)
+		}
+	}()
+	defer func() {
+		// Stop reading the local device so that a retained device is
+		// not read by this session once the next one starts.
+		if localTUN.SetReadDeadline(time.Now()) == nil {
+			<-localDone
+			localTUN.SetReadDeadline(time.Time{})
+		}
+	}()
+
+	err = session.Wait()
+	if health != nil && health.err() != nil {
+		return health.err()
+	}
+	if err != nil {
+		output := trwERR()
+		if sudoPasswordRequired(output) {
+			return s.sudoPasswordError(output)
+		}
+		return fmt.Errorf("%w: %s", err, output)
+	}
+	return nil
+}
+
+// logHelperLine logs a structured status line from the remote helper
+// (ROUTE ok <network>, ROUTE err <network> <error>, NAT ok <network>,
+// NAT ok <network> <egress device> <firewall>, NAT err <network>
+// <error>, FORWARD ok <family> <before> <after>, FORWARD err <family>
+// <error>, BRIDGE ok <bridge> <device> or STATS <json>).
+// Returns false if line is not a status line.
+func (s *SSHTUN) logHelperLine(line string) bool {
+	if stats, ok := strings.CutPrefix(line, "STATS "); ok {
+		var fields map[string]any
+		if err := json.Unmarshal([]byte(stats), &fields); err != nil {
+			return false
+		}
+		args := []any{"name", s.Name, "remote", s.Remote}
+		for _, k := range []string{"device", "mtu", "uptime", "idle", "rx_bytes", "rx_packets", "tx_bytes", "tx_packets"} {
+			if v, ok := fields[k]; ok {
+				args = append(args, "remote_"+k, v)
+			}
+		}
+		s.log().Info("Remote helper statistics", args...)
+		return true
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 4 && fields[0] == "BRIDGE" && fields[1] == "ok" {
+		s.log().Info(fmt.Sprintf("Remote tap device %s enslaved into bridge %s", fields[3], fields[2]), "name", s.Name, "remote", s.Remote, "remote_bridge", fields[2], "remote_tun", fields[3])
+		return true
+	}
+	if len(fields) >= 3 && fields[0] == "FORWARD" {
+		family := "IPv4"
+		if fields[2] == "inet6" {
+			family = "IPv6"
+		}
+		switch {
+		case fields[1] == "ok" && len(fields) == 5 && fields[3] == fields[4]:
+			s.log().Info(fmt.Sprintf("Remote %s forwarding already enabled", family), "name", s.Name, "remote", s.Remote, "family", fields[2], "before", fields[3], "after", fields[4])
+		case fields[1] == "ok" && len(fields) == 5:
+			s.log().Info(fmt.Sprintf("Remote %s forwarding enabled (was %s), restored when the tunnel goes down", family, fields[3]), "name", s.Name, "remote", s.Remote, "family", fields[2], "before", fields[3], "after", fields[4])
+		case fields[1] == "err":
+			s.log().Warn(fmt.Sprintf("Unable to enable remote %s forwarding", family), "name", s.Name, "remote", s.Remote, "family", fields[2], "error", strings.Join(fields[3:], " "))
+		default:
+			return false
+		}
+		return true
+	}
+	if len(fields) >= 3 && fields[0] == "NAT" {
+		switch fields[1] {
+		case "ok":
+			if len(fields) == 5 {
+				s.log().Info(fmt.Sprintf("Remote %s through %s (%s) enabled", natDescription(fields[2]), fields[3], fields[4]), "name", s.Name, "remote", s.Remote, "nat", fields[2], "egress", fields[3], "firewall", fields[4])
+				break
+			}
+			s.log().Info(fmt.Sprintf("Remote %s enabled", natDescription(fields[2])), "name", s.Name, "remote", s.Remote, "nat", fields[2])
+		case "err":
+			s.log().Warn(fmt.Sprintf("Unable to enable remote %s", natDescription(fields[2])), "name", s.Name, "remote", s.Remote, "nat", fields[2], "error", strings.Join(fields[3:], " "))
+		default:
+			return false
+		}
+		return true
+	}
+	if len(fields) < 3 || fields[0] != "ROUTE" {
+		return false
+	}
+	switch fields[1] {
+	case "ok":
+		s.log().Info(fmt.Sprintf("Remote route %s via %s", fields[2], s.RemoteTunDevice), "name", s.Name, "remote", s.Remote, "route", fields[2], "result", strings.Join(fields[1:], " "))
+	case "err":
+		s.log().Warn(fmt.Sprintf("Unable to add remote route %s", fields[2]), "name", s.Name, "remote", s.Remote, "route", fields[2], "error", strings.Join(fields[3:], " "))
+	default:
+		return false
+	}
+	return true
+}
+
+// tunReadWriterCommand returns the remote command line starting the
+// uploaded tunreadwriter, prefixed by the escalation command.
+func (s *SSHTUN) tunReadWriterCommand() string {
+	args := nonInteractive(s.sudoCommand())
+	if s.memfdHelper != nil {
+		args = append(args, s.memfdCommand()...)
+	} else {
+		args = append(args, s.remoteTunReadWriter)
+	}
+	// A shared helper is removed by the last tunnel using it, see
+	// releaseHelper.
+	if !s.CachesHelper() && s.memfdHelper == nil && s.RemoteHelperPath == "" && s.sharedHelper == nil {
+		args = append(args, "-delete")
+	}
+	if s.RemoteIdleExit > 0 {
+		args = append(args, "-idle-exit", time.Duration(s.RemoteIdleExit).String())
+	}
+	if s.RemoteTunOwner != "" {
+		args = append(args, "-user", s.RemoteTunOwner)
+	}
+	if s.RemoteTunGroup != "" {
+		args = append(args, "-group", s.RemoteTunGroup)
+	}
+	if s.RemoteStatsInterval > 0 {
+		args = append(args, "-stats-interval", time.Duration(s.RemoteStatsInterval).String())
+	}
+	if s.RemoteNetwork6 != "" {
+		args = append(args, "-net6", s.RemoteNetwork6)
+	}
+	for _, route := range s.RemoteRoutes {
+		args = append(args, "-route", route)
+	}
+	if s.RemoteRouteVia != "" {
+		args = append(args, "-route-via", s.RemoteRouteVia)
+	}
+	policyArgs, except := s.remotePolicyArgs()
+	args = append(args, policyArgs...)
+	args = append(args, s.remoteDeviceArgs()...)
+	if s.WindowSize != 0 && !s.tap() {
+		args = append(args, "-window-size", strconv.Itoa(s.WindowSize))
+	}
+	args = append(args, "-handshake", "-dev", s.RemoteTunDevice)
+	if s.RemoteBridge == "" {
+		args = append(args, "-net", s.RemoteNetwork)
+		if peer := s.remotePeer(); peer != "" {
+			args = append(args, "-peer", peer)
+		}
+	}
+	args = append(args, "-mtu", strconv.Itoa(s.RemoteMTU))
+	// Last so that they can override the arguments above.
+	args = append(args, s.RemoteHelperExtraArgs...)
+	if except != "" {
+		return shellescape.QuoteCommand(args) + " " + except
+	}
+	return shellescape.QuoteCommand(args)
+}
+
+// checkRemoteSudo verifies that sudo on the remote allows running
+// the uploaded helper without a password (sudo -n -l helper) so that
+// a missing NOPASSWD entry is reported before the tunnel is wired up.
+// Only sudo is checked, other escalation commands are left to fail
+// when the helper is started.
+func (s *SSHTUN) checkRemoteSudo(client *ssh.Client) error {
+	sudo := s.sudoCommand()
+	if len(sudo) == 0 || path.Base(sudo[0]) != DEFAULT_SUDO_COMMAND {
+		return nil
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	executable := s.remoteExecutable()
+	out, err := session.CombinedOutput(shellescape.QuoteCommand(append(nonInteractive(sudo), "-l", executable)))
+	if err == nil {
+		return nil
+	}
+	output := strings.TrimSpace(string(out))
+	if sudoPasswordRequired(output) || output == "" {
+		return s.sudoPasswordError(output)
+	}
+	return fmt.Errorf("%s -n -l %s: %w: %s", sudo[0], executable, err, output)
+}
+
+// remoteExecutable returns the program executed with sudo on the
+// remote, the uploaded helper or python3 when running it from memory.
+func (s *SSHTUN) remoteExecutable() string {
+	if s.memfdHelper != nil {
+		return s.remoteInterpreter
+	}
+	return s.remoteTunReadWriter
+}
+
+// sudoPasswordError returns an error wrapping
+// ErrSudoPasswordRequired suggesting the sudoers entry needed to run
+// the helper.
+func (s *SSHTUN) sudoPasswordError(output string) error {
+	helper := s.remoteExecutable()
+	if s.memfdHelper == nil && s.RemoteHelperPath == "" && (!s.CachesHelper() || helper == "") {
+		helper = path.Join(s.remoteUploadDirectory(), "tunreadwriter-*")
+	}
+	user := s.RemoteUser
+	if user == "" {
+		user = "USER"
+	}
+	return fmt.Errorf("%w on ssh://%s (%s), add \"%s ALL=(root) NOPASSWD: %s\" to sudoers on the remote (e.g with visudo -f /etc/sudoers.d/sshtun)", ErrSudoPasswordRequired, s.Remote, output, user, helper)
+}
+
+// sudoPasswordRequired returns true if output is sudo (or doas)
+// refusing to run without a password.
+func sudoPasswordRequired(output string) bool {
+	return strings.Contains(output, "a password is required") || strings.Contains(output, "Authentication required")
+}
+
+// nonInteractive returns sudo with -n inserted after the command if
+// it is sudo or doas, making them fail instead of waiting for a
+// password on a pipe nobody reads.
+func nonInteractive(sudo []string) []string {
+	if len(sudo) == 0 || slices.Contains(sudo, "-n") {
+		return sudo
+	}
+	switch path.Base(sudo[0]) {
+	case "sudo", "doas":
+		return append([]string{sudo[0], "-n"}, sudo[1:]...)
+	}
+	return sudo
+}
+
+// sudoCommand returns the words of RemoteSudoCommand used to run the
+// helper as root on the remote. If unset, it is sudo unless
+// RemoteUser is root in which case no prefix is used. An empty
+// RemoteSudoCommand also means no prefix.
+func (s *SSHTUN) sudoCommand() []string {
+	if s.RemoteSudoCommand == nil {
+		if s.RemoteUser == "root" {
+			return nil
 		}
-		return filepath.Join(dir, pth[2:])
+		return []string{DEFAULT_SUDO_COMMAND}
 	}
-	return pth
+	return strings.Fields(*s.RemoteSudoCommand)
 }
 
-func CreateFile(pth string) (*os.File, error) {
-	fullPath := ResolveTildeSlash(pth)
-	if err := os.MkdirAll(filepath.Dir(fullPath), 0222); err != nil {
-		return nil, err
+// keepaliveTimeout returns KeepaliveTimeout or KeepaliveInterval if
+// not set.
+func (s *SSHTUN) keepaliveTimeout() Duration {
+	if s.KeepaliveTimeout == 0 {
+		return s.KeepaliveInterval
 	}
-	return os.OpenFile(fullPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0222)
+	return s.KeepaliveTimeout
 }
 
-// Add receiver functions to implement the flag.Value interface for flag.Var()...
-
-func (k *PrivateKeyFiles) String() string {
-	if k == nil {
-		return ""
+// uploadMethod returns UploadMethod or UPLOAD_AUTO if empty. auto
+// tries scp first, falls back to sftp if the remote has no scp (see
+// scpUploadDetecting) and to cat if it has no sftp subsystem either.
+// memfd runs the helper from memory without uploading it and falls
+// back to auto if the remote can not.
+func (s *SSHTUN) uploadMethod() string {
+	if s.UploadMethod == "" {
+		return UPLOAD_AUTO
 	}
-	pkfs := make([]string, len(*k))
-	for _, pkf := range *k {
-		pkfs = append(pkfs, ResolveTildeSlash(pkf))
-	}
-	return strings.Join(pkfs, ", ")
+	return s.UploadMethod
 }
 
-func (k *PrivateKeyFiles) Set(value string) error {
-	if k == nil {
-		return ErrNilPointer
-	}
-	*k = append(*k, value)
-	return nil
+// CompressesUpload returns true unless compress_upload is false in
+// the configuration. When true, the gzip compressed helper is sent and
+// decompressed on the remote if it has gzip.
+func (s *SSHTUN) CompressesUpload() bool {
+	return s.CompressUpload == nil || *s.CompressUpload
 }
 
-func unrecoverable(err error) error {
-	return fmt.Errorf("%w: %w", ErrUnrecoverable, err)
+// CachesHelper returns true unless remote_cache_helper is false in
+// the configuration. A cached helper is uploaded once to a path
+// derived from its SHA-256 hash and reused on reconnect.
+func (s *SSHTUN) CachesHelper() bool {
+	return s.RemoteCacheHelper == nil || *s.RemoteCacheHelper
 }
 
-// Returns a context with an internal sshtun object mainly used for
-// synchronization (sync.Mutex).
-func Context(ctx context.Context) context.Context {
-	var mu sync.Mutex
-	ctx = context.WithValue(ctx, sshtunKey{}, sshtun{
-		mutex: &mu,
-	})
-	return ctx
+// cachedHelperName returns the file name of the cached helper,
+// tunreadwriter-<first 12 hex digits of its SHA-256 hash>.
+func cachedHelperName(helper *Helper) string {
+	return "tunreadwriter-" + helper.SHA256[:12]
 }
 
-// Open is the main function for setting up and connecting both ends
-// of the tunnel. Open blocks until tunnel is closed or ctx is
-// cancelled. ctx must be initialized via the Context function before
-// passed to Open or ErrMissingContext will be returned.
-func (s *SSHTUN) Open(ctx context.Context) error {
-	v, ok := ctx.Value(sshtunKey{}).(sshtun)
-	if !ok {
-		return ErrMissingContext
+// cachedHelperValid returns true if pth on the remote is a regular
+// file owned by the remote user (so no other user can have replaced
+// it) with the SHA-256 hash of helper.
+func cachedHelperValid(client *ssh.Client, pth string, helper *Helper) bool {
+	quoted := shellescape.Quote(pth)
+	out, err := sshoutput(client, fmt.Sprintf("test -f %s && test ! -L %s && test -O %s && sha256sum %s", quoted, quoted, quoted, quoted))
+	if err != nil {
+		return false
 	}
+	sum, _, _ := strings.Cut(strings.TrimSpace(out), " ")
+	return sum == helper.SHA256
+}
 
-	// Lock mutex and setup a defer conditionally unlocking the mutex
-	v.mutex.Lock()
-
-	s.log.Debug("Locked mutex", "name", s.Name)
+// remoteHelper runs uname -m on the remote and returns the matching
+// embedded helper.
+func remoteHelper(client *ssh.Client) (*Helper, error) {
+	machine, err := sshoutput(client, "uname -m")
+	if err != nil {
+		return nil, fmt.Errorf("unable to detect remote architecture: uname -m: %w", err)
+	}
+	return HelperForMachine(machine)
+}
 
-	unlockOnExit := true
-	defer func() {
-		if unlockOnExit {
-			s.log.Debug("Unlocking mutex", "name", s.Name)
-			v.mutex.Unlock()
-		}
-	}()
+// UploadHelperToRemote uploads the embedded tunreadwriter matching the
+// architecture of the remote (uname -m) to remoteDirectory (/tmp if
+// empty, created if missing) on the remote. If CachesHelper, the
+// helper is uploaded to a deterministic path and an existing copy
+// with the right hash is reused instead of uploading again, otherwise
+// a randomly named copy is uploaded for every connection. Errors wrap
+// ErrHelperUploadFailed.
+func (s *SSHTUN) UploadHelperToRemote(client *ssh.Client, remoteDirectory string) error {
+	return classified(ErrHelperUploadFailed, s.uploadHelperToRemote(client, remoteDirectory))
+}
 
-	if os.Geteuid() != ROOT {
-		s.log.Info(fmt.Sprintf("Switching to uid %d", ROOT), "sudo", "ConfigureInterface", "uid_to", ROOT, "uid_from", os.Geteuid(), "name", s.Name)
+func (s *SSHTUN) uploadHelperToRemote(client *ssh.Client, remoteDirectory string) error {
+	if remoteDirectory == "" {
+		remoteDirectory = DEFAULT_UPLOAD_DIR
 	}
-	b, err := s.Become(ROOT)
-	if err != nil {
-		return unrecoverable(err)
+	quoted := shellescape.Quote(remoteDirectory)
+	if err := sshrun(client, fmt.Sprintf("test -d %s || mkdir -p %s", quoted, quoted)); err != nil {
+		return fmt.Errorf("unable to create upload directory %s on ssh://%s: %w", remoteDirectory, s.Remote, err)
 	}
-
-	s.log.Info("Creating local TUN device", "tun", s.LocalTunDevice, "name", s.Name)
-	localTUN, err := tun.CreateTUN(s.LocalTunDevice, s.LocalMTU, 0, 0)
+	helper, err := remoteHelper(client)
 	if err != nil {
-		return unrecoverable(err)
+		return err
 	}
-	defer localTUN.Close()
-	s.LocalTunDevice = localTUN.Name
-
-	s.log.Info(fmt.Sprintf("Configuring interface %s with address %s and MTU %d", localTUN.Name, s.LocalNetwork, s.LocalMTU), "name", s.Name, "net", s.LocalNetwork, "mtu", s.LocalMTU, "proto", s.Protocol)
-
-	if err := localTUN.ConfigureInterface(s.LocalNetwork); err != nil {
-		return unrecoverable(err)
+	key := s.helperKey(remoteDirectory, helper)
+	if s.sharedHelper != nil && s.sharedHelper.key != key {
+		s.releaseHelper(client)
 	}
-
-	if os.Geteuid() != b.OriginalUID() {
-		s.log.Info("Switching back to original uid", "uid_to", b.OriginalUID(), "uid_from", os.Geteuid(), "name", s.Name)
+	shared := s.helpers.acquire(key)
+	if shared == nil {
+		return s.placeHelper(client, remoteDirectory, helper)
 	}
-
-	if err := b.Unbecome(); err != nil {
-		return unrecoverable(err)
+	defer shared.upload.Unlock()
+	if pth := s.helpers.path(shared); pth != "" && cachedHelperValid(client, pth, helper) {
+		s.log().Info(fmt.Sprintf("Reusing tunreadwriter %s already uploaded to ssh://%s", pth, s.Remote), "name", s.Name, "tunreadwriter", pth, "arch", helper.Arch, "sha256", helper.SHA256)
+		s.remoteTunReadWriter = pth
+		s.shareHelper(shared, pth)
+		return nil
 	}
-
-	s.log.Info(fmt.Sprintf("Connecting to ssh://%s", s.Remote), "remote", s.Remote, "name", s.Name)
-
-	client, err := s.Dial(ctx)
-	if err != nil {
+	if err := s.placeHelper(client, remoteDirectory, helper); err != nil {
 		return err
 	}
-	openDone := make(chan struct{})
-	defer close(openDone)
-	go func() {
-		select {
-		case <-ctx.Done():
-		case <-openDone:
-		}
-		client.Close()
-	}()
-
-	// Transfer tunreadwriter to other side
+	s.shareHelper(shared, s.remoteTunReadWriter)
+	return nil
+}
 
-	if err := s.UploadHelperToRemote(client, ""); err != nil {
-		return err
+// placeHelper makes helper available in remoteDirectory, reusing the
+// cached copy or uploading it.
+func (s *SSHTUN) placeHelper(client *ssh.Client, remoteDirectory string, helper *Helper) error {
+	var cachedFilename string
+	if s.CachesHelper() {
+		cachedFilename = path.Join(remoteDirectory, cachedHelperName(helper))
+		if cachedHelperValid(client, cachedFilename, helper) {
+			s.log().Info(fmt.Sprintf("Reusing cached tunreadwriter %s on ssh://%s", cachedFilename, s.Remote), "name", s.Name, "tunreadwriter", cachedFilename, "arch", helper.Arch, "sha256", helper.SHA256)
+			s.remoteTunReadWriter = cachedFilename
+			return nil
+		}
 	}
 
-	if os.Geteuid() != ROOT {
-		s.log.Info(fmt.Sprintf("Switching to uid %d", ROOT), "sudo", "LinkUp", "uid_to", ROOT, "uid_from", os.Geteuid(), "name", s.Name)
+	randomFilename := s.randomHelperName()
+	completeFilename := path.Join(remoteDirectory, randomFilename)
+	if err := s.uploadHelper(client, remoteDirectory, randomFilename, helper); err != nil {
+		return err
 	}
-	if err := b.Become(ROOT); err != nil {
-		return unrecoverable(err)
+	s.remoteTunReadWriter = completeFilename
+
+	if cachedFilename != "" {
+		// Rename into place so that a concurrent connection never
+		// executes a partially uploaded helper.
+		if err := sshrun(client, fmt.Sprintf("mv -f %s %s", shellescape.Quote(completeFilename), shellescape.Quote(cachedFilename))); err != nil {
+			sshrun(client, "rm -f "+shellescape.Quote(completeFilename))
+			return fmt.Errorf("unable to move tunreadwriter to %s: %w", cachedFilename, err)
+		}
+		s.remoteTunReadWriter = cachedFilename
 	}
+	s.event(EVENT_HELPER_UPLOADED, nil, "remote", s.Remote, "tunreadwriter", s.remoteTunReadWriter, "arch", helper.Arch, "sha256", helper.SHA256)
 
-	s.log.Info("Link up", "local_tun", localTUN.Name, "local_net", s.LocalNetwork, "name", s.Name)
+	return nil
+}
 
-	if err := localTUN.LinkUp(); err != nil {
-		return unrecoverable(err)
+// remoteHelperRestarts returns RemoteHelperRestarts or
+// DEFAULT_REMOTE_HELPER_RESTARTS if not set.
+func (s *SSHTUN) remoteHelperRestarts() int {
+	if s.RemoteHelperRestarts == nil {
+		return DEFAULT_REMOTE_HELPER_RESTARTS
 	}
+	return *s.RemoteHelperRestarts
+}
 
-	if os.Geteuid() != b.OriginalUID() {
-		s.log.Info("Switching back to original uid", "uid_to", b.OriginalUID(), "uid_from", os.Geteuid(), "name", s.Name)
-	}
+// restartableHelperError returns true if err from StartTunneling may
+// be resolved by starting the remote helper again on the same
+// connection, e.g it was killed or its cached binary removed. An
+// incompatible helper, a sudo asking for a password or a failed
+// health check is not.
+func restartableHelperError(err error) bool {
+	return !errors.Is(err, ErrHelperProtocol) && !errors.Is(err, ErrSudoPasswordRequired) && !errors.Is(err, ErrUnhealthy) && !errors.Is(err, ErrNoTunReadWriter)
+}
 
-	if err := b.Unbecome(); err != nil {
-		return unrecoverable(err)
+// restartRemoteHelper makes the remote helper available again before
+// it is restarted on client, re-uploading it only if it is gone. A
+// helper run from memory is sent again by StartTunneling.
+func (s *SSHTUN) restartRemoteHelper(ctx context.Context, client *ssh.Client) error {
+	switch {
+	case s.memfdHelper != nil:
+		return nil
+	case s.RemoteHelperPath != "":
+		return s.useInstalledHelper(client)
 	}
+	return s.uploadHelperRetrying(ctx, client)
+}
 
-	if s.KeepaliveInterval > 0 {
-		s.log.Info("Enabling ssh keep-alive", "keepalive_interval", s.KeepaliveInterval, "keepalive_max_error_count", s.KeepaliveMaxErrorCount, "name", s.Name, "remote", s.Remote, "remote_addr", client.RemoteAddr().String(), "local_addr", client.LocalAddr().String())
-		done := make(chan struct{})
-		defer close(done)
-		go StartKeepalive(client, time.Duration(s.KeepaliveInterval), s.KeepaliveMaxErrorCount, s.log, done)
+// stopHelper kills the remote helper started in session and waits at
+// most HELPER_STOP_TIMEOUT for it to exit. stdin of the helper is
+// closed as well, servers ignoring signals leave the helper to exit on
+// end of input (or sudo in between keeps it from being killed).
+func stopHelper(session *ssh.Session, stdin io.Closer) {
+	session.Signal(ssh.SIGKILL)
+	stdin.Close()
+	exited := make(chan struct{})
+	go func() {
+		session.Wait()
+		close(exited)
+	}()
+	tmr := time.NewTimer(HELPER_STOP_TIMEOUT)
+	defer tmr.Stop()
+	select {
+	case <-exited:
+	case <-tmr.C:
+		session.Close()
 	}
+}
 
-	s.log.Debug("Unlocking mutex", "name", s.Name)
-
-	// Unlock mutex
-	v.mutex.Unlock()
-	unlockOnExit = false
-
-	s.log.Info("Starting tunnel", "name", s.Name, "remote", s.Remote, "local_net", s.LocalNetwork, "remote_net", s.RemoteNetwork, "local_tun", s.LocalTunDevice, "remote_tun", s.RemoteTunDevice, "local_mtu", s.LocalMTU, "remote_mtu", s.RemoteMTU)
+// randomHelperName returns a unique file name for an uploaded helper,
+// tunreadwriter-<UTC timestamp>-<16 random hex digits>. If crypto/rand
+// fails, the hex digits are the nanoseconds of the clock instead.
+func (s *SSHTUN) randomHelperName() string {
+	now := time.Now().UTC()
+	random, err := crand.HexE(8)
+	if err != nil {
+		s.log().Warn("Unable to read crypto/rand, naming the helper after the clock", "name", s.Name, "error", err)
+		random = fmt.Sprintf("%016x", now.UnixNano())
+	}
+	return fmt.Sprintf("tunreadwriter-%s-%s", now.Format("20060102T150405"), random)
+}
 
-	if err := s.StartTunneling(client, localTUN); err != nil {
-		if ctx.Err() == nil {
-			return fmt.Errorf("sshtun.StartTunneling: %w", err)
+// uploadHelper uploads helper as filename in remoteDirectory, through
+// gzip on the remote if CompressesUpload and the remote has gzip,
+// otherwise using the configured upload method. The progress of a slow
+// upload is logged (see UPLOAD_PROGRESS_INTERVAL) and how long it took
+// is logged and kept for Status.
+func (s *SSHTUN) uploadHelper(client *ssh.Client, remoteDirectory, filename string, helper *Helper) error {
+	completeFilename := path.Join(remoteDirectory, filename)
+	method := s.uploadMethod()
+	uploaded := func(method string, progress *uploadProgress) {
+		duration := progress.done()
+		s.uploadDuration.Store(int64(duration))
+		s.log().Info(fmt.Sprintf("Uploaded tunreadwriter (linux/%s) as %s to ssh://%s in %s", helper.Arch, completeFilename, s.Remote, duration.Round(time.Millisecond)), "name", s.Name, "remote", s.Remote, "tunreadwriter", completeFilename, "size", progress.size, "upload_method", method, "upload_duration", duration)
+	}
+	var err error
+	if s.CompressesUpload() {
+		s.log().Info(fmt.Sprintf("Uploading compressed tunreadwriter (linux/%s) as %s to ssh://%s", helper.Arch, completeFilename, s.Remote), "name", s.Name, "tunreadwriter", completeFilename, "upload_directory", remoteDirectory, "arch", helper.Arch, "size", len(helper.Compressed), "upload_method", UPLOAD_GZIP)
+		progress := s.newUploadProgress(completeFilename, len(helper.Compressed))
+		err = gzipUpload(client, completeFilename, helper, progress)
+		if err == nil {
+			uploaded(UPLOAD_GZIP, progress)
+			return nil
+		} else if !errors.Is(err, ErrGzipNotFound) {
+			return fmt.Errorf("%s upload of tunreadwriter to %s failed: %w", UPLOAD_GZIP, completeFilename, err)
 		}
+		s.log().Info(fmt.Sprintf("gzip not found on ssh://%s, uploading uncompressed", s.Remote), "name", s.Name, "error", err)
 	}
-	s.log.Info("Tunnel closed", "name", s.Name, "remote", s.Remote, "local_net", s.LocalNetwork, "remote_net", s.RemoteNetwork, "local_tun", s.LocalTunDevice, "remote_tun", s.RemoteTunDevice, "local_mtu", s.LocalMTU, "remote_mtu", s.RemoteMTU)
+	s.log().Info(fmt.Sprintf("Uploading tunreadwriter (linux/%s) as %s to ssh://%s", helper.Arch, completeFilename, s.Remote), "name", s.Name, "tunreadwriter", completeFilename, "upload_directory", remoteDirectory, "arch", helper.Arch, "size", len(helper.Binary), "upload_method", method)
+	progress := s.newUploadProgress(completeFilename, len(helper.Binary))
+	if method, err = s.uploadWith(client, method, remoteDirectory, filename, helper, progress); err != nil {
+		return fmt.Errorf("%s upload of tunreadwriter to %s failed: %w", method, completeFilename, err)
+	}
+	uploaded(method, progress)
 	return nil
 }
 
-func (s *SSHTUN) StartTunneling(client *ssh.Client, localTUN *tun.TUN) error {
-	if s.remoteTunReadWriter == "" {
-		return ErrNoTunReadWriter
+// uploadWith uploads helper as filename in remoteDirectory using
+// method (scp, sftp, cat or auto) and returns the method used. progress
+// counts the bytes sent (nil for none).
+func (s *SSHTUN) uploadWith(client *ssh.Client, method, remoteDirectory, filename string, helper *Helper, progress *uploadProgress) (string, error) {
+	completeFilename := path.Join(remoteDirectory, filename)
+	switch method {
+	case UPLOAD_SCP:
+		return method, s.scpUploadDetecting(client, remoteDirectory, filename, helper.Binary, progress)
+	case UPLOAD_SFTP:
+		return method, sftpUpload(client, completeFilename, 0755, helper.Binary, progress)
+	case UPLOAD_CAT:
+		return method, catUpload(client, completeFilename, helper.Binary, helper.SHA256, progress)
 	}
-
-	mtustring := strconv.Itoa(s.RemoteMTU)
-	remoteTunReadWriterCommand := fmt.Sprintf(
-		"sudo %s -delete -dev %s -net %s -mtu %s",
-		shellescape.Quote(s.remoteTunReadWriter),
-		shellescape.Quote(s.RemoteTunDevice),
-		shellescape.Quote(s.RemoteNetwork),
-		shellescape.Quote(mtustring),
-	)
-
-	session, err := client.NewSession()
-	if err != nil {
-		return err
+	err := s.scpUploadDetecting(client, remoteDirectory, filename, helper.Binary, progress)
+	if !errors.Is(err, ErrSCPNotFound) {
+		return UPLOAD_SCP, err
 	}
-	defer session.Close()
-
-	remoteIN, err := session.StdinPipe()
-	if err != nil {
-		return nil
+	s.log().Info(fmt.Sprintf("scp not found on ssh://%s, falling back to sftp", s.Remote), "name", s.Name, "error", err)
+	err = sftpUpload(client, completeFilename, 0755, helper.Binary, progress)
+	if !errors.Is(err, ErrSFTPUnavailable) {
+		return UPLOAD_SFTP, err
 	}
-	defer remoteIN.Close()
+	s.log().Info(fmt.Sprintf("sftp not available on ssh://%s, falling back to cat", s.Remote), "name", s.Name, "error", err)
+	return UPLOAD_CAT, catUpload(client, completeFilename, helper.Binary, helper.SHA256, progress)
+}
 
-	remoteOUT, err := session.StdoutPipe()
-	if err != nil {
+// scpUploadDetecting runs scpUpload with the scp found on the remote
+// by an earlier connection or else RemoteSCP. If that scp is not
+// found, the scp on the PATH of the remote (command -v scp) is used
+// and remembered for reconnects. Returns an error wrapping
+// ErrSCPNotFound suggesting sftp if the remote has no scp at all.
+func (s *SSHTUN) scpUploadDetecting(client *ssh.Client, remoteDirectory, filename string, data []byte, progress *uploadProgress) error {
+	remoteSCP := s.RemoteSCP
+	if s.detectedSCP != "" {
+		remoteSCP = s.detectedSCP
+	}
+	err := scpUpload(client, remoteSCP, remoteDirectory, filename, data, progress)
+	if !errors.Is(err, ErrSCPNotFound) {
 		return err
 	}
-
-	// tunreadwriter write errors to stderr
-	remoteERR, err := session.StderrPipe()
-	if err != nil {
+	s.detectedSCP = ""
+	out, derr := sshoutput(client, "command -v scp")
+	detected := strings.TrimSpace(out)
+	if derr != nil || !strings.HasPrefix(detected, "/") {
+		s.log().Debug(fmt.Sprintf("scp not found on the PATH of ssh://%s", s.Remote), "name", s.Name, "remote", s.Remote, "remote_scp", remoteSCP, "error", derr)
+		return fmt.Errorf("%w (no scp on the PATH of the remote either), use \"upload_method\": %q", err, UPLOAD_SFTP)
+	}
+	if detected == remoteSCP {
 		return err
 	}
+	s.log().Debug(fmt.Sprintf("Found scp at %s on ssh://%s", detected, s.Remote), "name", s.Name, "remote", s.Remote, "remote_scp", remoteSCP, "detected_scp", detected)
+	s.detectedSCP = detected
+	return scpUpload(client, detected, remoteDirectory, filename, data, progress)
+}
 
-	s.log.Info(fmt.Sprintf("Starting %s on remote ssh://%s", s.remoteTunReadWriter, s.Remote), "remote_addr", client.RemoteAddr().String(), "remote", s.Remote, "remote_command", remoteTunReadWriterCommand, "name", s.Name)
-
-	if err := session.Start(remoteTunReadWriterCommand); err != nil {
+// gzipUpload streams the compressed helper to gzip -dc on the remote
+// writing pth and verifies the SHA-256 hash of the decompressed file,
+// progress counts the bytes sent (nil for none). Returns an error
+// wrapping ErrGzipNotFound if the remote lacks gzip.
+func gzipUpload(client *ssh.Client, pth string, helper *Helper, progress *uploadProgress) error {
+	session, err := client.NewSession()
+	if err != nil {
 		return err
 	}
-
-	go func() {
-		if _, err := io.Copy(localTUN.File, remoteOUT); err != nil {
-			s.log.Error("io error in remote to local go routine", "error", err)
-		}
-	}()
-	go func() {
-		if _, err := io.Copy(remoteIN, localTUN.File); err != nil {
-			s.log.Error("io error in local to remote go routine", "error", err)
-		}
-	}()
-
-	trwERR := func() string {
-		var rerr bytes.Buffer
-		io.Copy(&rerr, remoteERR)
-		if rerr.Len() > 0 {
-			return strings.TrimSpace(rerr.String())
+	defer session.Close()
+	var output bytes.Buffer
+	// Stdout and stderr are copied by separate goroutines.
+	combined := &lockedWriter{w: &output}
+	session.Stdin = progress.reader(bytes.NewReader(helper.Compressed))
+	session.Stdout = combined
+	session.Stderr = combined
+	quoted := shellescape.Quote(pth)
+	if err := session.Run(fmt.Sprintf("command -v gzip >/dev/null || exit 127; umask 077; gzip -dc > %s && chmod 0755 %s && sha256sum %s", quoted, quoted, quoted)); err != nil {
+		var exitErr *ssh.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitStatus() == 127 {
+			return fmt.Errorf("%w: %s", ErrGzipNotFound, strings.TrimSpace(output.String()))
 		}
-		return "no output on stderr"
+		sshrun(client, "rm -f "+quoted)
+		return &uploadError{err: fmt.Errorf("%w: %s", err, strings.TrimSpace(output.String())), stderr: strings.TrimSpace(output.String())}
 	}
-	if err := session.Wait(); err != nil {
-		return fmt.Errorf("%w: %s", err, trwERR())
+	sum, _, _ := strings.Cut(strings.TrimSpace(output.String()), " ")
+	if sum != helper.SHA256 {
+		sshrun(client, "rm -f "+quoted)
+		return fmt.Errorf("%w: %s has sha256 %s, expected %s", ErrChecksumMismatch, pth, sum, helper.SHA256)
 	}
 	return nil
 }
 
-func (s *SSHTUN) UploadHelperToRemote(client *ssh.Client, remoteDirectory string) error {
+// scpUpload uploads data as filename in remoteDirectory by running
+// remoteSCP -t on the remote, progress counts the bytes sent (nil for
+// none). Returns an error wrapping ErrSCPNotFound if remoteSCP could
+// not be executed.
+func scpUpload(client *ssh.Client, remoteSCP, remoteDirectory, filename string, data []byte, progress *uploadProgress) error {
 	session, err := client.NewSession()
 	if err != nil {
 		return err
 	}
 	defer session.Close()
-
-	if remoteDirectory == "" {
-		remoteDirectory = "/tmp"
-	}
-	randomFilename := fmt.Sprintf("tunreadwriter-%s-%d", time.Now().UTC().Format("20060102T150405"), crand.Int63())
-	size := len(tunreadwriter)
-	f := bytes.NewReader(tunreadwriter)
-
-	completeFilename := filepath.Join(remoteDirectory, randomFilename)
-
-	s.log.Info(fmt.Sprintf("Uploading tunreadwriter as %s to ssh://%s", completeFilename, s.Remote), "name", s.Name, "tunreadwriter", completeFilename, "size", size)
-
-	remoteOUT, err := session.StdoutPipe()
-	if err != nil {
-		return err
-	}
-	remoteERR, err := session.StderrPipe()
+	var remoteOUT, remoteERR bytes.Buffer
+	session.Stdout = &remoteOUT
+	session.Stderr = &remoteERR
+	remoteIN, err := session.StdinPipe()
 	if err != nil {
 		return err
 	}
-	errCh := make(chan error)
 	go func() {
-		defer close(errCh)
-		remoteIN, err := session.StdinPipe()
-		if err != nil {
-			errCh <- err
-			return
-		}
 		defer remoteIN.Close()
-		fmt.Fprintf(remoteIN, "C0755 %d %s\n", size, randomFilename)
-		io.CopyN(remoteIN, f, int64(size))
+		fmt.Fprintf(remoteIN, "C0755 %d %s\n", len(data), filename)
+		io.Copy(remoteIN, progress.reader(bytes.NewReader(data)))
 		fmt.Fprint(remoteIN, "\x00")
 	}()
 
 	combinedOut := func() string {
-		var rout bytes.Buffer
-		var rerr bytes.Buffer
-		io.Copy(&rout, remoteOUT)
-		io.Copy(&rerr, remoteERR)
-		var combinedOut string
-		if rout.Len() > 0 && rerr.Len() > 0 {
-			combinedOut = rout.String() + " " + rerr.String()
-		} else if rout.Len() > 0 {
-			combinedOut = rout.String()
-		} else if rerr.Len() > 0 {
-			combinedOut = rerr.String()
-		} else {
-			combinedOut = "no output from command"
+		output := strings.TrimSpace(strings.TrimSpace(remoteOUT.String()) + " " + strings.TrimSpace(remoteERR.String()))
+		if output == "" {
+			return "no output from command"
 		}
-		return strings.TrimSpace(combinedOut)
+		return output
 	}
 
-	if err := session.Run(s.RemoteSCP + " -t " + remoteDirectory); err != nil {
+	if err := session.Run(remoteSCP + " -t " + shellescape.Quote(remoteDirectory)); err != nil {
 		output := combinedOut()
-		return fmt.Errorf("%w: %s", err, output)
+		var exitErr *ssh.ExitError
+		if (errors.As(err, &exitErr) && exitErr.ExitStatus() == 127) || strings.Contains(output, "not found") {
+			return fmt.Errorf("%w: %s: %s", ErrSCPNotFound, remoteSCP, output)
+		}
+		return &uploadError{err: fmt.Errorf("%w: %s", err, output), stderr: strings.TrimSpace(remoteERR.String())}
 	}
+	return nil
+}
 
-	if err := <-errCh; err != nil {
-		output := combinedOut()
-		return fmt.Errorf("%w: %s", err, output)
+// sshoutput runs cmd on the remote and returns its standard output.
+func sshoutput(client *ssh.Client, cmd string) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
 	}
-	s.remoteTunReadWriter = filepath.Join(remoteDirectory, randomFilename)
-
-	return nil
+	defer session.Close()
+	out, err := session.Output(cmd)
+	return string(out), err
 }
 
 func sshrun(client *ssh.Client, cmd string) error {
@@ -581,7 +2243,8 @@ func sshrun(client *ssh.Client, cmd string) error {
 // Dial connects to ssh-agent (if s.UseSSHAgent is true), retrieves
 // signers or privatekeys from key files and ssh.Dials SSHTUN.Remote
 // using s.Protocol. Returns an ssh.Client or error. The ssh.Client
-// must be Closed when done.
+// must be Closed when done. Errors wrap ErrConnectFailed,
+// ErrAuthFailed or ErrHostKeyMismatch, see ErrorClass.
 func (s *SSHTUN) Dial(ctx context.Context) (*ssh.Client, error) {
 	signers := make([]ssh.Signer, 0)
 	if s.UseSSHAgent && os.Getenv(SSH_AUTH_SOCK) != "" {
@@ -598,13 +2261,19 @@ func (s *SSHTUN) Dial(ctx context.Context) (*ssh.Client, error) {
 		return nil, ErrEmptySshAuthSock
 	} else {
 		for _, pk := range s.PrivateKeyFiles {
-			pemBytes, err := os.ReadFile(ResolveTildeSlash(pk))
+			// Only the path is ever logged, never the key.
+			s.log().Debug("Loading private key", "name", s.Name, "private_key_file", pk)
+			pth, err := ResolveTilde(pk)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %w", ErrAuthFailed, err)
+			}
+			pemBytes, err := os.ReadFile(pth)
 			if err != nil {
-				return nil, err
+				return nil, classified(ErrAuthFailed, err)
 			}
 			signer, err := ssh.ParsePrivateKey(pemBytes)
 			if err != nil {
-				return nil, err
+				return nil, fmt.Errorf("%w: %s: %w", ErrAuthFailed, pk, err)
 			}
 			signers = append(signers, signer)
 		}
@@ -613,7 +2282,7 @@ func (s *SSHTUN) Dial(ctx context.Context) (*ssh.Client, error) {
 	cfg := &ssh.ClientConfig{
 		User:            s.RemoteUser,
 		Auth:            auths,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		HostKeyCallback: checkHostKey(ssh.InsecureIgnoreHostKey()),
 		Timeout:         30 * time.Second,
 	}
 	cfg.SetDefaults()
@@ -621,18 +2290,124 @@ func (s *SSHTUN) Dial(ctx context.Context) (*ssh.Client, error) {
 	// Use a DialContext dialer and use ssh.NewClientConn to establish a
 	// ssh.NewClientConn and ssh.NewClient.
 
-	d := net.Dialer{Timeout: cfg.Timeout}
+	d := net.Dialer{Timeout: cfg.Timeout, Control: s.transportControl}
 	conn, err := d.DialContext(ctx, s.Protocol, s.Remote)
 	if err != nil {
-		return nil, err
+		return nil, classified(ErrConnectFailed, err)
 	}
+	s.setTCPOptions(conn)
+	s.transport = conn
+	s.redactor.add(conn.RemoteAddr().String())
 	c, chans, reqs, err := ssh.NewClientConn(conn, s.Remote, cfg)
 	if err != nil {
-		return nil, err
+		return nil, handshakeError(err)
 	}
 	return ssh.NewClient(c, chans, reqs), nil
 }
 
+// closeLocalTUN closes the local TUN device kept open across
+// reconnects, if any.
+func (s *SSHTUN) closeLocalTUN() error {
+	if s.localTUN == nil {
+		return nil
+	}
+	err := s.localTUN.Close()
+	s.localTUN = nil
+	if errors.Is(err, os.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// createLocalTUN creates and configures the local tun device
+// in-process, switching effective uid to root (unless the process has
+// CAP_NET_ADMIN) and back. Used when the privileged helper is not
+// enabled.
+func (s *SSHTUN) createLocalTUN() (*Became, *tun.TUN, error) {
+	if switchesToRoot() {
+		s.log().Info(fmt.Sprintf("Switching to uid %d", ROOT), "sudo", "ConfigureInterface", "uid_to", ROOT, "uid_from", os.Geteuid(), "name", s.Name)
+	}
+	uid, gid, err := s.localTunOwner()
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := s.Become(ROOT)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	create := tun.CreateTUN
+	if s.tap() {
+		create = tun.CreateTAP
+	}
+	s.log().Info("Creating local TUN device", "tun", s.LocalTunDevice, "name", s.Name, "device_type", s.deviceType(), "uid", uid, "gid", gid)
+	localTUN, err := create(s.LocalTunDevice, s.LocalMTU, uid, gid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if s.LocalBridge != "" {
+		s.log().Info(fmt.Sprintf("Enslaving %s into bridge %s", localTUN.Name, s.LocalBridge), "name", s.Name, "tun", localTUN.Name, "bridge", s.LocalBridge)
+		if err := localTUN.JoinBridge(s.LocalBridge); err != nil {
+			localTUN.Close()
+			return nil, nil, err
+		}
+	} else if err := s.configureLocalTUN(localTUN); err != nil {
+		localTUN.Close()
+		return nil, nil, err
+	}
+
+	if os.Geteuid() != b.OriginalUID() {
+		s.log().Info("Switching back to original uid", "uid_to", b.OriginalUID(), "uid_from", os.Geteuid(), "name", s.Name)
+	}
+
+	if err := b.Unbecome(); err != nil {
+		localTUN.Close()
+		return nil, nil, err
+	}
+	return b, localTUN, nil
+}
+
+// configureLocalTUN assigns local_network and local_network6 to
+// localTUN.
+func (s *SSHTUN) configureLocalTUN(localTUN *tun.TUN) error {
+	s.log().Info(fmt.Sprintf("Configuring interface %s with address %s and MTU %d", localTUN.Name, s.LocalNetwork, s.LocalMTU), "name", s.Name, "net", s.LocalNetwork, "mtu", s.LocalMTU, "proto", s.Protocol)
+
+	if err := localTUN.ConfigureAddress(s.LocalNetwork, s.localPeer()); err != nil {
+		return err
+	}
+	if s.LocalNetwork6 != "" {
+		s.log().Info(fmt.Sprintf("Configuring interface %s with address %s", localTUN.Name, s.LocalNetwork6), "name", s.Name, "net6", s.LocalNetwork6)
+		if err := localTUN.ConfigureInterface6(s.LocalNetwork6); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkUp brings localTUN up in-process, switching effective uid like
+// createLocalTUN.
+func (s *SSHTUN) linkUp(b *Became, localTUN *tun.TUN) error {
+	if switchesToRoot() {
+		s.log().Info(fmt.Sprintf("Switching to uid %d", ROOT), "sudo", "LinkUp", "uid_to", ROOT, "uid_from", os.Geteuid(), "name", s.Name)
+	}
+	if err := b.Become(ROOT); err != nil {
+		return err
+	}
+
+	s.log().Info("Link up", "local_tun", localTUN.Name, "local_net", s.LocalNetwork, "name", s.Name)
+
+	if err := localTUN.LinkUp(); err != nil {
+		return err
+	}
+
+	if os.Geteuid() != b.OriginalUID() {
+		s.log().Info("Switching back to original uid", "uid_to", b.OriginalUID(), "uid_from", os.Geteuid(), "name", s.Name)
+	}
+
+	return b.Unbecome()
+}
+
 type Became struct {
 	originalUID int
 	becameUID   int
@@ -641,27 +2416,40 @@ type Became struct {
 }
 
 func (s *SSHTUN) Become(uid int) (*Became, error) {
-	s.log.Debug(fmt.Sprintf("Before Become(%d)", uid), "uid", os.Getuid(), "gid", os.Getgid(), "euid", os.Geteuid(), "egid", os.Getegid())
+	s.log().Debug(fmt.Sprintf("Before Become(%d)", uid), "uid", os.Getuid(), "gid", os.Getgid(), "euid", os.Geteuid(), "egid", os.Getegid())
 	became := &Became{
 		originalUID: syscall.Geteuid(),
-		logger:      s.log,
+		logger:      s.log(),
 		st:          s,
 	}
 	if became.originalUID != uid {
-		errmsg := "unable to change to uid 0 (perhaps missing setuid mode on executable? chown 0:0 sshtun; chmod 4755 sshtun)"
-		if err := syscall.Seteuid(uid); err != nil {
-			return nil, fmt.Errorf(errmsg+": %w", err)
+		if uid == ROOT && privilegesDropped.Load() {
+			return nil, ErrPrivilegesDropped
+		}
+		if p := Privileges(); uid == ROOT && holdsPrivileges(p) {
+			// CAP_NET_ADMIN (or an elevated process on Windows) is
+			// enough to create and configure the device, stay at the
+			// current euid.
+			s.log().Debug("Using privileges instead of switching uid", "privileges", p, "uid", os.Getuid(), "euid", os.Geteuid())
+			became.becameUID = became.originalUID
+			return became, nil
+		}
+		if err := seteuid(uid); err != nil {
+			if uid == ROOT {
+				return nil, privilegesError(err)
+			}
+			return nil, fmt.Errorf("unable to change to uid %d: %w", uid, err)
 		}
 	}
 	became.becameUID = syscall.Geteuid()
-	s.log.Debug(fmt.Sprintf("After Become(%d)", uid), "uid", os.Getuid(), "gid", os.Getgid(), "euid", os.Geteuid(), "egid", os.Getegid())
+	s.log().Debug(fmt.Sprintf("After Become(%d)", uid), "uid", os.Getuid(), "gid", os.Getgid(), "euid", os.Geteuid(), "egid", os.Getegid())
 	return became, nil
 }
 
 func (b *Became) Unbecome() error {
 	b.logger.Debug("Before Unbecome()", "uid", os.Getuid(), "gid", os.Getgid(), "euid", os.Geteuid(), "egid", os.Getegid())
 	if syscall.Geteuid() != b.originalUID {
-		if err := syscall.Seteuid(b.originalUID); err != nil {
+		if err := seteuid(b.originalUID); err != nil {
 			return err
 		}
 	}
@@ -688,20 +2476,91 @@ func (b *Became) OriginalUID() int {
 // https://github.com/scylladb/go-sshtools
 //
 // StartKeepalive starts sending server keepalive messages until done channel
-// is closed.
+// is closed. Each attempt times out after interval, see
+// StartKeepaliveTimeout.
 func StartKeepalive(client *ssh.Client, interval time.Duration, countMax int, logger *slog.Logger, done <-chan struct{}) {
+	StartKeepaliveTimeout(client, interval, interval, countMax, logger, done)
+}
+
+// StartKeepaliveTimeout is StartKeepalive where an attempt not
+// answered within timeout counts as failed, a black holed connection
+// is then detected after about countMax intervals instead of the TCP
+// retransmission timeout. While a request is unanswered, no new
+// request is sent, the next attempt waits for the pending reply
+// instead so that a late reply is counted once. A timeout of 0 waits
+// indefinitely.
+func StartKeepaliveTimeout(client *ssh.Client, interval, timeout time.Duration, countMax int, logger *slog.Logger, done <-chan struct{}) {
+	keepalive(client, interval, timeout, countMax, logger, nil, done)
+}
+
+// trackConnection records client as the connection of the tunnel for
+// Status and the uptime once the returned func is called, when the
+// connection is done.
+func (s *SSHTUN) trackConnection(client *ssh.Client) func() {
+	s.connectedAt.Store(time.Now().UnixNano())
+	s.remoteAddr = client.RemoteAddr().String()
+	s.localAddr = client.LocalAddr().String()
+	// Uptime is counted from when the tunnel first came up on this
+	// connection, restarting the helper does not reset it.
+	s.upSince.Store(0)
+	return func() {
+		if since := s.upSince.Swap(0); since != 0 {
+			s.uptime.Store(int64(time.Since(time.Unix(0, since))))
+			s.lastUpSince.Store(since)
+		}
+		s.connectedAt.Store(0)
+	}
+}
+
+// startKeepalive sends keepalives on client every KeepaliveInterval
+// (if not 0) until the returned func is called.
+func (s *SSHTUN) startKeepalive(client *ssh.Client) func() {
+	if s.KeepaliveInterval <= 0 {
+		return func() {}
+	}
+	s.log().Info("Enabling ssh keep-alive", "keepalive_interval", s.KeepaliveInterval, "keepalive_timeout", s.keepaliveTimeout(), "keepalive_max_error_count", s.KeepaliveMaxErrorCount, "name", s.Name, "remote", s.Remote, "remote_addr", client.RemoteAddr().String(), "local_addr", client.LocalAddr().String())
+	done := make(chan struct{})
+	go keepalive(client, time.Duration(s.KeepaliveInterval), time.Duration(s.keepaliveTimeout()), s.KeepaliveMaxErrorCount, s.log(), func(count int, err error) {
+		s.event(EVENT_KEEPALIVE_FAILED, err, "count", count, "max_count", s.KeepaliveMaxErrorCount)
+	}, done)
+	return func() { close(done) }
+}
+
+// keepalive is StartKeepaliveTimeout calling failed (unless nil) on
+// every failed keepalive check.
+func keepalive(client *ssh.Client, interval, timeout time.Duration, countMax int, logger *slog.Logger, failed func(count int, err error), done <-chan struct{}) {
 	logger = SetLogger(logger)
 	t := time.NewTicker(interval)
 	defer t.Stop()
 	n := 0
+	var pending <-chan error
 	for {
 		select {
 		case <-t.C:
-			logger.Debug("Sending keepalive message", "local_addr", client.LocalAddr().String(), "remote_addr", client.RemoteAddr().String())
-			if err := serverAliveCheck(client); err != nil {
+			if pending == nil {
+				logger.Debug("Sending keepalive message", "local_addr", client.LocalAddr().String(), "remote_addr", client.RemoteAddr().String())
+				pending = serverAliveCheck(client)
+			} else {
+				logger.Debug("Waiting for reply to previous keepalive message", "local_addr", client.LocalAddr().String(), "remote_addr", client.RemoteAddr().String())
+			}
+			err := waitAlive(pending, timeout, done)
+			select {
+			case <-done:
+				// Stopped while waiting, not a failed check.
+				return
+			default:
+			}
+			if !errors.Is(err, ErrKeepaliveTimeout) {
+				pending = nil
+			}
+			if err != nil {
 				n++
+				logger.Debug("Keepalive check failed", "error", err, "count", n, "local_addr", client.LocalAddr().String(), "remote_addr", client.RemoteAddr().String())
+				if failed != nil {
+					failed(n, err)
+				}
 				if n >= countMax {
-					logger.Error("Keepalive check failed too many times", "count", n, "local_addr", client.LocalAddr().String(), "remote_addr", client.RemoteAddr().String())
+					logger.Error("Keepalive check failed too many times", "count", n, "error", err, "local_addr", client.LocalAddr().String(), "remote_addr", client.RemoteAddr().String())
 					client.Close()
 					return
 				}
@@ -714,11 +2573,39 @@ func StartKeepalive(client *ssh.Client, interval time.Duration, countMax int, lo
 	}
 }
 
-func serverAliveCheck(client *ssh.Client) (err error) {
+// serverAliveCheck sends a keepalive request in a goroutine and
+// returns a channel receiving its result. The channel is buffered, the
+// goroutine never blocks and ends when the reply arrives or the
+// client is closed.
+func serverAliveCheck(client *ssh.Client) <-chan error {
 	// This is ported version of Open SSH client server_alive_check function
 	// see: https://github.com/openssh/openssh-portable/blob/b5e412a8993ad17b9e1141c78408df15d3d987e1/clientloop.c#L482
-	_, _, err = client.SendRequest("keepalive@openssh.com", true, nil)
-	return
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		result <- err
+	}()
+	return result
+}
+
+// waitAlive waits for the result of a keepalive request for at most
+// timeout (0 waits indefinitely) or until done is closed. Returns
+// ErrKeepaliveTimeout if the request is still pending.
+func waitAlive(pending <-chan error, timeout time.Duration, done <-chan struct{}) error {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case err := <-pending:
+		return err
+	case <-expired:
+		return fmt.Errorf("%w after %s", ErrKeepaliveTimeout, timeout)
+	case <-done:
+		return ErrKeepaliveTimeout
+	}
 }
 
 // NilSlogger implements a no-operation slog.Handler
@@ -744,6 +2631,9 @@ func (ns *NilSlogger) WithGroup(_ string) slog.Handler {
 	return &NilSlogger{nilslogger: &nilslogger{}}
 }
 
+// discardLogger is the logger of a tunnel without one.
+var discardLogger = SetLogger(nil)
+
 // SetLogger returns s if not nil or an slog.New(NilSlogger)
 // no-operation slog.Handler if s is nil.
 func SetLogger(s *slog.Logger) *slog.Logger {
@@ -0,0 +1,1160 @@
+//go:build linux
+
+package sshtun
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sa6mwa/sshtun/internal/pkg/crand"
+	"github.com/sa6mwa/sshtun/internal/pkg/handshake"
+	"github.com/sa6mwa/sshtun/pkg/sshtest"
+	"github.com/sa6mwa/sshtun/pkg/tun"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestTunReadWriterCommand(t *testing.T) {
+	str := func(s string) *string { return &s }
+	for _, c := range []struct {
+		user string
+		sudo *string
+		want string
+	}{
+		{"abc123", nil, "sudo -n /tmp/trw -handshake -dev tun0 -net 172.18.0.2/24 -mtu 0"},
+		{"root", nil, "/tmp/trw -handshake -dev tun0 -net 172.18.0.2/24 -mtu 0"},
+		{"abc123", str(""), "/tmp/trw -handshake -dev tun0 -net 172.18.0.2/24 -mtu 0"},
+		{"abc123", str("doas"), "doas -n /tmp/trw -handshake -dev tun0 -net 172.18.0.2/24 -mtu 0"},
+		{"root", str("sudo -u tunneluser"), "sudo -n -u tunneluser /tmp/trw -handshake -dev tun0 -net 172.18.0.2/24 -mtu 0"},
+	} {
+		s := NewSecureShellTunneler(nil)
+		s.RemoteUser = c.user
+		s.RemoteSudoCommand = c.sudo
+		s.remoteTunReadWriter = "/tmp/trw"
+		if got := s.tunReadWriterCommand(); got != c.want {
+			t.Errorf("user %s: got %q, expected %q", c.user, got, c.want)
+		}
+	}
+	s := NewSecureShellTunneler(nil)
+	s.RemoteUser = "root"
+	s.RemoteIdleExit = Duration(10 * time.Minute)
+	s.remoteTunReadWriter = "/tmp/trw"
+	s.RemoteTunOwner = "tunneluser"
+	s.RemoteTunGroup = "netdev"
+	s.RemoteNetwork6 = "fd00::2/64"
+	s.RemoteRoutes = []string{"10.0.0.0/8", "192.168.1.0/24"}
+	s.RemoteRouteVia = "172.18.0.1"
+	s.RemoteHelperExtraArgs = []string{"-stats-interval", "1m", "-x=a b;c"}
+	if want := "/tmp/trw -idle-exit 10m0s -user tunneluser -group netdev -net6 fd00::2/64 -route 10.0.0.0/8 -route 192.168.1.0/24 -route-via 172.18.0.1 -handshake -dev tun0 -net 172.18.0.2/24 -mtu 0 -stats-interval 1m '-x=a b;c'"; s.tunReadWriterCommand() != want {
+		t.Errorf("got %q, expected %q", s.tunReadWriterCommand(), want)
+	}
+	s = NewSecureShellTunneler(nil)
+	s.RemoteUser = "root"
+	s.RemoteCacheHelper = new(bool)
+	s.RemoteHelperPath = "/usr/local/libexec/sshtun-helper"
+	s.remoteTunReadWriter = s.RemoteHelperPath
+	if want := "/usr/local/libexec/sshtun-helper -handshake -dev tun0 -net 172.18.0.2/24 -mtu 0"; s.tunReadWriterCommand() != want {
+		t.Errorf("installed helper must never be deleted, got %q, expected %q", s.tunReadWriterCommand(), want)
+	}
+	s = NewSecureShellTunneler(nil)
+	s.RemoteUser = "root"
+	s.remoteTunReadWriter = "/tmp/trw"
+	s.Role = ROLE_SERVER
+	s.ServerRoutes = []string{"192.168.10.0/24"}
+	s.ServerDefaultRoute = true
+	s.ServerNAT = true
+	if want := `/tmp/trw -route 192.168.10.0/24 -default-route -handshake -dev tun0 -net 172.18.0.2/24 -mtu 0 -except "${SSH_CONNECTION%% *}"`; s.tunReadWriterCommand() != want {
+		t.Errorf("role server: got %q, expected %q", s.tunReadWriterCommand(), want)
+	}
+	s.Role = ROLE_CLIENT
+	if want := "/tmp/trw -nat 172.18.0.0/24 -handshake -dev tun0 -net 172.18.0.2/24 -mtu 0"; s.tunReadWriterCommand() != want {
+		t.Errorf("role client: got %q, expected %q", s.tunReadWriterCommand(), want)
+	}
+	s.ServerNAT, s.ServerForward = false, true
+	if want := "/tmp/trw -ip-forward -handshake -dev tun0 -net 172.18.0.2/24 -mtu 0"; s.tunReadWriterCommand() != want {
+		t.Errorf("role client: got %q, expected %q", s.tunReadWriterCommand(), want)
+	}
+	s.ServerForward, s.RemoteMasquerade = false, true
+	if want := "/tmp/trw -masquerade 172.18.0.0/24 -handshake -dev tun0 -net 172.18.0.2/24 -mtu 0"; s.tunReadWriterCommand() != want {
+		t.Errorf("remote masquerade: got %q, expected %q", s.tunReadWriterCommand(), want)
+	}
+	s.RemoteMasquerade, s.RemoteEnableForwarding = false, true
+	if want := "/tmp/trw -enable-forwarding -handshake -dev tun0 -net 172.18.0.2/24 -mtu 0"; s.tunReadWriterCommand() != want {
+		t.Errorf("remote enable forwarding: got %q, expected %q", s.tunReadWriterCommand(), want)
+	}
+	s = NewSecureShellTunneler(nil)
+	s.RemoteUser = "root"
+	s.remoteTunReadWriter = "/tmp/trw"
+	s.LocalNetwork, s.RemoteNetwork = "10.9.1.1/32", "10.9.2.1/32"
+	if want := "/tmp/trw -handshake -dev tun0 -net 10.9.2.1/32 -peer 10.9.1.1 -mtu 0"; s.tunReadWriterCommand() != want {
+		t.Errorf("point-to-point: got %q, expected %q", s.tunReadWriterCommand(), want)
+	}
+	s.LocalNetwork, s.RemoteNetwork = "10.9.0.0/31", "10.9.0.1/31"
+	if want := "/tmp/trw -handshake -dev tun0 -net 10.9.0.1/31 -peer 10.9.0.0 -mtu 0"; s.tunReadWriterCommand() != want {
+		t.Errorf("point-to-point: got %q, expected %q", s.tunReadWriterCommand(), want)
+	}
+	if s.localPeer() != "10.9.0.1" {
+		t.Errorf("expected local peer 10.9.0.1, got %q", s.localPeer())
+	}
+	s = NewSecureShellTunneler(nil)
+	s.RemoteUser = "root"
+	s.remoteTunReadWriter = "/tmp/trw"
+	s.WindowSize = 1
+	if want := "/tmp/trw -window-size 1 -handshake -dev tun0 -net 172.18.0.2/24 -mtu 0"; s.tunReadWriterCommand() != want {
+		t.Errorf("window size: got %q, expected %q", s.tunReadWriterCommand(), want)
+	}
+	s.DeviceType = DEVICE_TAP
+	if want := "/tmp/trw -tap -handshake -dev tun0 -net 172.18.0.2/24 -mtu 0"; s.tunReadWriterCommand() != want {
+		t.Errorf("tap: got %q, expected %q", s.tunReadWriterCommand(), want)
+	}
+	s.RemoteBridge = "br-lan"
+	if want := "/tmp/trw -tap -bridge br-lan -handshake -dev tun0 -mtu 0"; s.tunReadWriterCommand() != want {
+		t.Errorf("bridged tap: got %q, expected %q", s.tunReadWriterCommand(), want)
+	}
+}
+
+func TestSudoPasswordError(t *testing.T) {
+	s := NewSecureShellTunneler(nil)
+	s.RemoteUser = "abc123"
+	s.remoteTunReadWriter = "/tmp/tunreadwriter-0123456789ab"
+	if !sudoPasswordRequired("sudo: a password is required") {
+		t.Fatal("expected sudo output to be detected")
+	}
+	err := s.sudoPasswordError("sudo: a password is required")
+	if !errors.Is(err, ErrSudoPasswordRequired) {
+		t.Fatalf("expected ErrSudoPasswordRequired, got %v", err)
+	}
+	if want := `"abc123 ALL=(root) NOPASSWD: /tmp/tunreadwriter-0123456789ab"`; !strings.Contains(err.Error(), want) {
+		t.Errorf("expected %s in %q", want, err)
+	}
+}
+
+func TestStaleHelpers(t *testing.T) {
+	output := strings.Join([]string{
+		"/tmp/tunreadwriter-20231012T225150-8296832003517942891",
+		"/tmp/tunreadwriter-20231012T225151-3649837345642611420",
+		"/tmp/tunreadwriter-20231012T225152-0123456789abcdef",
+		"/tmp/tunreadwriter-0123456789ab",
+		"/tmp/tunreadwriter-20231012T225150-1; rm -rf ~",
+		"/tmp/sub/tunreadwriter-20231012T225150-1",
+		"/var/tmp/tunreadwriter-20231012T225150-2",
+		"",
+	}, "\n")
+	got := staleHelpers("/tmp/", output, "/tmp/tunreadwriter-20231012T225151-3649837345642611420")
+	if len(got) != 2 || got[0] != "/tmp/tunreadwriter-20231012T225150-8296832003517942891" || got[1] != "/tmp/tunreadwriter-20231012T225152-0123456789abcdef" {
+		t.Errorf("unexpected stale helpers: %q", got)
+	}
+}
+
+func TestPrepareDropPrivileges(t *testing.T) {
+	drops := 0
+	defer func(f func() error) { dropPrivileges = f }(dropPrivileges)
+	dropPrivileges = func() error {
+		drops++
+		return nil
+	}
+	tunnels := &Tunnels{DropPrivileges: true, log: SetLogger(nil)}
+	for _, name := range []string{"a", "b", "disabled"} {
+		s := NewSecureShellTunneler(nil)
+		s.Name = name
+		s.Enable = name != "disabled"
+		tunnels.Tunnels = append(tunnels.Tunnels, s)
+	}
+	tunnels.prepareDropPrivileges()
+	for _, tunnel := range tunnels.Tunnels {
+		if !tunnel.retainTUN || tunnel.onLinkUp == nil {
+			t.Fatalf("expected %s to retain its TUN device and report link up", tunnel.Name)
+		}
+	}
+	report := tunnels.Tunnels[0].onLinkUp
+	report("a")
+	report("a")
+	if drops != 0 {
+		t.Fatalf("dropped privileges before every enabled tunnel was up")
+	}
+	report("b")
+	report("b")
+	if drops != 1 {
+		t.Errorf("expected privileges to be dropped exactly once, got %d", drops)
+	}
+}
+
+func TestUnprivileged(t *testing.T) {
+	a, b := NewSecureShellTunneler(nil), NewSecureShellTunneler(nil)
+	a.Enable, b.Enable = true, false
+	a.Unprivileged = true
+	tunnels := &Tunnels{Tunnels: []*SSHTUN{a, b}}
+	if !tunnels.Unprivileged() {
+		t.Errorf("expected tunnels to be unprivileged when every enabled tunnel is")
+	}
+	b.Enable = true
+	if tunnels.Unprivileged() {
+		t.Errorf("expected an enabled privileged tunnel to require privileges")
+	}
+	a.LocalNetwork6, a.LocalMTU = "fd00::1/64", 1400
+	hint := a.provisionHint()
+	for _, want := range []string{"sshtun -provision", "ip tuntap add mode tun user", "ip addr add " + a.LocalNetwork + " dev tun0", "ip -6 addr add fd00::1/64", "mtu 1400 up"} {
+		if !strings.Contains(hint, want) {
+			t.Errorf("expected hint to contain %q, got: %s", want, hint)
+		}
+	}
+}
+
+func TestKeepaliveTimeout(t *testing.T) {
+	hp, err := sshtest.NewHoneyPot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hp.Close()
+	client, err := ssh.Dial("tcp", hp.Addr(), hp.ClientConfig("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := waitAlive(serverAliveCheck(client), 5*time.Second, nil); err != nil {
+		t.Fatalf("expected keepalive to be answered, got: %v", err)
+	}
+
+	hp.BlackHole()
+	pending := serverAliveCheck(client)
+	if err := waitAlive(pending, 50*time.Millisecond, nil); !errors.Is(err, ErrKeepaliveTimeout) {
+		t.Fatalf("expected ErrKeepaliveTimeout from a black holed server, got: %v", err)
+	}
+	hp.Restore()
+	if err := waitAlive(pending, 5*time.Second, nil); err != nil {
+		t.Fatalf("expected the late reply on the pending request, got: %v", err)
+	}
+
+	hp.BlackHole()
+	returned := make(chan struct{})
+	go func() {
+		defer close(returned)
+		StartKeepaliveTimeout(client, 20*time.Millisecond, 20*time.Millisecond, 3, nil, nil)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("StartKeepaliveTimeout did not give up on a black holed server")
+	}
+	if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+		t.Error("expected the client to be closed after too many failed keepalives")
+	}
+}
+
+func TestDialPublicKey(t *testing.T) {
+	privateKey, publicKey, err := sshtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, err := sshtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, privateKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name    string
+		options []sshtest.Option
+		ok      bool
+	}{
+		{"any key", nil, true},
+		{"authorized key", []sshtest.Option{sshtest.WithAuthorizedKeys(otherKey, publicKey)}, true},
+		{"unauthorized key", []sshtest.Option{sshtest.WithAuthorizedKeys(otherKey)}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hp, err := sshtest.NewHoneyPot(tc.options...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer hp.Close()
+			s := NewSecureShellTunneler(nil)
+			s.Remote = hp.Addr()
+			s.UseSSHAgent = false
+			s.PrivateKeyFiles = PrivateKeyFiles{keyFile}
+			client, err := s.Dial(context.Background())
+			if tc.ok {
+				if err != nil {
+					t.Fatalf("expected Dial to succeed, got: %v", err)
+				}
+				client.Close()
+			} else if err == nil {
+				client.Close()
+				t.Fatal("expected Dial to fail with an unauthorized key")
+			} else if !errors.Is(err, ErrAuthFailed) {
+				t.Errorf("expected %v, got: %v", ErrAuthFailed, err)
+			}
+		})
+	}
+}
+
+func TestSCPUpload(t *testing.T) {
+	hp, err := sshtest.NewHoneyPot(
+		sshtest.WithExec("/usr/bin/scp -t /readonly", sshtest.ExecResult{ExitStatus: 1, Stderr: "scp: /readonly: Read-only file system"}),
+		sshtest.WithExec("/opt/scp -t", sshtest.ExecResult{ExitStatus: 127, Stderr: "sh: 1: /opt/scp: not found"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hp.Close()
+	client, err := ssh.Dial("tcp", hp.Addr(), hp.ClientConfig("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	s := NewSecureShellTunneler(nil)
+	helper := &Helper{Arch: "amd64", Binary: []byte("\x7fELF tunreadwriter")}
+	filename := s.randomHelperName()
+	if method, err := s.uploadWith(client, UPLOAD_SCP, "/tmp/upload dir", filename, helper, nil); err != nil || method != UPLOAD_SCP {
+		t.Fatalf("expected scp upload to succeed, got %s: %v", method, err)
+	}
+	files := hp.Files()
+	if len(files) != 1 {
+		t.Fatalf("expected 1 file, got %d", len(files))
+	}
+	if files[0].Path != "/tmp/upload dir/"+filename || !staleHelperName.MatchString(filepath.Base(files[0].Path)) {
+		t.Errorf("unexpected path %s", files[0].Path)
+	}
+	if files[0].Mode != 0755 || string(files[0].Data) != string(helper.Binary) {
+		t.Errorf("unexpected file %s mode %o: %q", files[0].Path, files[0].Mode, files[0].Data)
+	}
+	if commands := hp.Commands(); len(commands) != 1 || commands[0] != "/usr/bin/scp -t '/tmp/upload dir'" {
+		t.Errorf("unexpected commands %q", commands)
+	}
+
+	err = scpUpload(client, USR_BIN_SCP, "/readonly", filename, helper.Binary, nil)
+	if err == nil || !strings.Contains(err.Error(), "Read-only file system") || errors.Is(err, ErrSCPNotFound) {
+		t.Errorf("expected the stderr of scp in the error, got: %v", err)
+	}
+	if err := scpUpload(client, "/opt/scp", "/tmp", filename, helper.Binary, nil); !errors.Is(err, ErrSCPNotFound) {
+		t.Errorf("expected %v, got: %v", ErrSCPNotFound, err)
+	}
+}
+
+func TestRestartableHelperError(t *testing.T) {
+	if err := errors.New("Process exited with status 137: no output on stderr"); !restartableHelperError(err) {
+		t.Errorf("expected %v to be restartable", err)
+	}
+	for _, err := range []error{
+		fmt.Errorf("%w: v0", ErrHelperProtocol),
+		fmt.Errorf("%w on ssh://x", ErrSudoPasswordRequired),
+		fmt.Errorf("%w: 3 echo requests unanswered", ErrUnhealthy),
+	} {
+		if restartableHelperError(err) {
+			t.Errorf("expected %v not to be restartable", err)
+		}
+	}
+	s := NewSecureShellTunneler(nil)
+	if s.remoteHelperRestarts() != DEFAULT_REMOTE_HELPER_RESTARTS {
+		t.Errorf("expected %d restarts by default, got %d", DEFAULT_REMOTE_HELPER_RESTARTS, s.remoteHelperRestarts())
+	}
+	disabled := 0
+	s.RemoteHelperRestarts = &disabled
+	if s.remoteHelperRestarts() != 0 {
+		t.Errorf("expected remote_helper_restarts 0 to disable restarts, got %d", s.remoteHelperRestarts())
+	}
+}
+
+func TestReconnectDelay(t *testing.T) {
+	for failures, base := range []time.Duration{
+		DEFAULT_RECONNECT_DELAY,
+		DEFAULT_RECONNECT_DELAY,
+		2 * DEFAULT_RECONNECT_DELAY,
+		4 * DEFAULT_RECONNECT_DELAY,
+	} {
+		for i := 0; i < 10; i++ {
+			if delay := reconnectDelay(failures, nil); delay < base || delay > base+base/5 {
+				t.Errorf("failures %d: expected delay between %s and %s, got %s", failures, base, base+base/5, delay)
+			}
+		}
+	}
+	if delay := reconnectDelay(1000, nil); delay < MAX_RECONNECT_DELAY || delay > MAX_RECONNECT_DELAY+MAX_RECONNECT_DELAY/5 {
+		t.Errorf("expected delay capped at %s, got %s", MAX_RECONNECT_DELAY, delay)
+	}
+	restore := crand.SetSourceForTesting(rand.NewSource(1).(rand.Source64))
+	first := []time.Duration{reconnectDelay(1, nil), reconnectDelay(2, nil), reconnectDelay(3, nil)}
+	restore()
+	restore = crand.SetSourceForTesting(rand.NewSource(1).(rand.Source64))
+	second := []time.Duration{reconnectDelay(1, nil), reconnectDelay(2, nil), reconnectDelay(3, nil)}
+	restore()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Errorf("expected the jitter to be reproducible with a fixed source, got %v and %v", first, second)
+			break
+		}
+	}
+	s := NewSecureShellTunneler(nil)
+	if s.stableUptime() != DEFAULT_STABLE_UPTIME {
+		t.Errorf("expected stable uptime %s by default, got %s", DEFAULT_STABLE_UPTIME, s.stableUptime())
+	}
+}
+
+// fakeTUN returns a local TUN that is one end of a packet socketpair
+// and the other end for the test to act as the kernel.
+func fakeTUN(t *testing.T) (*tun.TUN, *os.File) {
+	t.Helper()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	localTUN, err := tun.FromFd("faketun0", fds[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := localTUN.SetNonblock(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { localTUN.File.Close() })
+	kernel := os.NewFile(uintptr(fds[1]), "kernel")
+	t.Cleanup(func() { kernel.Close() })
+	return localTUN, kernel
+}
+
+func TestStartTunneling(t *testing.T) {
+	packet := []byte("\x45\x00\x00\x1d not quite an ipv4 packet")
+	hp, err := sshtest.NewHoneyPot(sshtest.WithScriptedHandler("", func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		if err := handshake.New("tun9", 1400, "inet").Write(stdout); err != nil {
+			return 1
+		}
+		// Echo a single packet back, then exit like a helper whose
+		// device went away.
+		buf := make([]byte, len(packet))
+		if _, err := io.ReadFull(stdin, buf); err != nil {
+			return 1
+		}
+		stdout.Write(buf)
+		return 0
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hp.Close()
+	client, err := ssh.Dial("tcp", hp.Addr(), hp.ClientConfig("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	localTUN, kernel := fakeTUN(t)
+
+	s := NewSecureShellTunneler(nil)
+	s.remoteTunReadWriter = "/tmp/tunreadwriter-test"
+	s.lastError.Store("connection refused")
+	done := make(chan error, 1)
+	go func() {
+		done <- s.StartTunneling(client, localTUN)
+	}()
+	if _, err := kernel.Write(packet); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	kernel.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := kernel.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastError := s.Status().LastError; lastError != "" {
+		t.Errorf("expected the last error cleared once connected, got %q", lastError)
+	}
+	if string(buf[:n]) != string(packet) {
+		t.Errorf("expected the packet echoed, got %q", buf[:n])
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected StartTunneling to return nil when the helper exits 0, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("StartTunneling did not return")
+	}
+	if s.remoteHandshake.Device != "tun9" {
+		t.Errorf("expected remote device tun9, got %q", s.remoteHandshake.Device)
+	}
+	if tx := s.txBytes.Load(); tx != int64(len(packet)) {
+		t.Errorf("expected %d bytes sent, got %d", len(packet), tx)
+	}
+
+	hp.Close()
+	sessions := hp.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("expected 1 session, got %d", len(sessions))
+	}
+	if sessions[0].Command != s.tunReadWriterCommand() || sessions[0].ExitStatus != 0 || sessions[0].Duration() <= 0 {
+		t.Errorf("unexpected session %+v", sessions[0])
+	}
+	if sessions[0].StdinBytes != int64(len(packet)) {
+		t.Errorf("expected %d bytes on stdin, got %d", len(packet), sessions[0].StdinBytes)
+	}
+	if sessions[0].StdoutBytes <= int64(len(packet)) {
+		t.Errorf("expected the handshake and packet on stdout, got %d bytes", sessions[0].StdoutBytes)
+	}
+}
+
+func TestStartKeepalive(t *testing.T) {
+	dial := func(t *testing.T, handler sshtest.RequestHandler) (*sshtest.HoneyPot, *ssh.Client) {
+		hp, err := sshtest.NewHoneyPot(sshtest.WithRequestHandler(sshtest.KEEPALIVE_REQUEST, handler))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { hp.Close() })
+		client, err := ssh.Dial("tcp", hp.Addr(), hp.ClientConfig("test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		return hp, client
+	}
+	run := func(client *ssh.Client, interval, timeout time.Duration, countMax int, d time.Duration) bool {
+		done := make(chan struct{})
+		returned := make(chan struct{})
+		go func() {
+			defer close(returned)
+			StartKeepaliveTimeout(client, interval, timeout, countMax, nil, done)
+		}()
+		select {
+		case <-returned:
+			return true
+		case <-time.After(d):
+			close(done)
+			<-returned
+			return false
+		}
+	}
+	alive := func(client *ssh.Client) bool {
+		_, _, err := client.SendRequest("ping@sshtun", true, nil)
+		return err == nil
+	}
+
+	t.Run("answered", func(t *testing.T) {
+		hp, client := dial(t, sshtest.Reply(true))
+		if run(client, 10*time.Millisecond, 10*time.Millisecond, 1, 200*time.Millisecond) {
+			t.Fatal("expected StartKeepalive to keep going while answered")
+		}
+		if !alive(client) {
+			t.Error("expected the client to stay open")
+		}
+		if n := hp.Keepalives(); n < 3 {
+			t.Errorf("expected several keepalives, got %d", n)
+		}
+	})
+
+	t.Run("countMax", func(t *testing.T) {
+		hp, client := dial(t, sshtest.StopAfter(2, sshtest.Reply(true)))
+		if !run(client, 10*time.Millisecond, 10*time.Millisecond, 3, 5*time.Second) {
+			t.Fatal("expected StartKeepalive to give up on an unanswered keepalive")
+		}
+		if alive(client) {
+			t.Error("expected the client to be closed after countMax failed keepalives")
+		}
+		// Two answered, the third pending until giving up.
+		if n := hp.Keepalives(); n != 3 {
+			t.Errorf("expected 3 keepalives, got %d", n)
+		}
+	})
+
+	t.Run("late replies", func(t *testing.T) {
+		hp, client := dial(t, sshtest.Delay(100*time.Millisecond, sshtest.Reply(true)))
+		if run(client, 10*time.Millisecond, 10*time.Millisecond, 50, 350*time.Millisecond) {
+			t.Fatal("expected StartKeepaliveTimeout to reset the count on a late reply")
+		}
+		if !alive(client) {
+			t.Error("expected the client to stay open")
+		}
+		// No new request is sent while one is pending.
+		if n := hp.Keepalives(); n < 2 || n > 5 {
+			t.Errorf("expected a keepalive per reply delay, got %d", n)
+		}
+	})
+}
+
+// failingSource is a crand source failing like crypto/rand in a
+// container without getrandom.
+type failingSource struct{}
+
+func (failingSource) Seed(int64)                 {}
+func (failingSource) Int63() int64               { panic(errRandom) }
+func (failingSource) Uint64() uint64             { panic(errRandom) }
+func (failingSource) Uint64E() (uint64, error)   { return 0, errRandom }
+func (failingSource) Read(p []byte) (int, error) { return 0, errRandom }
+
+var errRandom = errors.New("getrandom: operation not permitted")
+
+func TestRandomFallback(t *testing.T) {
+	defer crand.SetSourceForTesting(failingSource{})()
+	for failures, base := range []time.Duration{DEFAULT_RECONNECT_DELAY, 2 * DEFAULT_RECONNECT_DELAY} {
+		if delay := reconnectDelay(failures+1, nil); delay < base || delay > base+base/5 {
+			t.Errorf("expected delay between %s and %s, got %s", base, base+base/5, delay)
+		}
+	}
+	s := NewSecureShellTunneler(nil)
+	if name := s.randomHelperName(); !staleHelperName.MatchString(name) {
+		t.Errorf("unexpected helper name %s", name)
+	}
+}
+
+func TestClose(t *testing.T) {
+	privateKey, _, err := sshtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, privateKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	stdinClosed := make(chan struct{})
+	hp, err := sshtest.NewHoneyPot(
+		sshtest.WithExec("uname -m", sshtest.ExecResult{Stdout: "x86_64\n"}),
+		sshtest.WithScriptedHandler("/tmp/tunreadwriter-", func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+			handshake.New("tun9", 1400, "inet").Write(stdout)
+			io.Copy(stdout, stdin)
+			close(stdinClosed)
+			return 0
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hp.Close()
+
+	s := NewSecureShellTunneler(nil)
+	s.Remote = hp.Addr()
+	s.RemoteUser = "root"
+	s.PrivateKeyFiles = PrivateKeyFiles{keyFile}
+	s.KeepaliveInterval = 0
+	uncompressed := false
+	s.CompressUpload = &uncompressed
+	s.localTUN, _ = fakeTUN(t)
+	if err := s.Close(); err != nil {
+		t.Fatalf("expected Close before Open to do nothing, got: %v", err)
+	}
+
+	opened := make(chan error, 1)
+	go func() {
+		opened <- s.Open(Context(context.Background()))
+	}()
+	deadline := time.After(5 * time.Second)
+	for !s.IsUp() {
+		select {
+		case err := <-opened:
+			t.Fatalf("Open returned before the tunnel came up: %v", err)
+		case <-deadline:
+			t.Fatal("tunnel did not come up")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	s.Close()
+	select {
+	case err := <-opened:
+		if err != nil {
+			t.Errorf("expected Open to return nil after Close, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Open did not return after Close")
+	}
+	select {
+	case <-stdinClosed:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the remote helper session to be closed")
+	}
+	if state := s.Status().State; state != STATE_IDLE {
+		t.Errorf("expected state %s, got %s", STATE_IDLE, state)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("expected Close after Open to do nothing, got: %v", err)
+	}
+}
+
+func TestStageTimeouts(t *testing.T) {
+	privateKey, _, err := sshtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, privateKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// hang never answers, like a stuck scp sink or helper.
+	release := make(chan struct{})
+	defer close(release)
+	hang := func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		<-release
+		return 1
+	}
+	for _, tc := range []struct {
+		stage  string
+		prefix string
+	}{
+		{STAGE_UPLOAD, "/usr/bin/scp -t"},
+		{STAGE_START, "/tmp/tunreadwriter-"},
+	} {
+		t.Run(tc.stage, func(t *testing.T) {
+			hp, err := sshtest.NewHoneyPot(
+				sshtest.WithCloseTimeout(0),
+				sshtest.WithExec("uname -m", sshtest.ExecResult{Stdout: "x86_64\n"}),
+				sshtest.WithScriptedHandler(tc.prefix, hang),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer hp.Close()
+			s := NewSecureShellTunneler(nil)
+			s.Remote = hp.Addr()
+			s.RemoteUser = "root"
+			s.PrivateKeyFiles = PrivateKeyFiles{keyFile}
+			s.KeepaliveInterval = 0
+			uncompressed := false
+			s.CompressUpload = &uncompressed
+			if tc.stage == STAGE_UPLOAD {
+				s.UploadTimeout = Duration(100 * time.Millisecond)
+			} else {
+				s.StartTimeout = Duration(100 * time.Millisecond)
+			}
+			s.localTUN, _ = fakeTUN(t)
+			opened := make(chan error, 1)
+			go func() {
+				opened <- s.Open(Context(context.Background()))
+			}()
+			select {
+			case err := <-opened:
+				if !errors.Is(err, ErrStageTimeout) {
+					t.Fatalf("expected %v, got: %v", ErrStageTimeout, err)
+				}
+				if want := tc.stage + " stage timed out after 100ms"; !strings.Contains(err.Error(), want) {
+					t.Errorf("expected %q in %q", want, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Open did not time out")
+			}
+		})
+	}
+}
+
+func TestTunnelsStartStop(t *testing.T) {
+	privateKey, _, err := sshtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, privateKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	newTunnel := func(name string, enable bool) *SSHTUN {
+		s := NewSecureShellTunneler(nil)
+		s.Name = name
+		s.Enable = enable
+		// Nothing listens on the discard port, the tunnel keeps failing
+		// and backing off.
+		s.Remote = "127.0.0.1:9"
+		s.RemoteUser = "root"
+		s.PrivateKeyFiles = PrivateKeyFiles{keyFile}
+		s.KeepaliveInterval = 0
+		s.localTUN, _ = fakeTUN(t)
+		s.retainTUN = true
+		return s
+	}
+	a := newTunnel("a", true)
+	b := newTunnel("b", false)
+	tunnels := &Tunnels{Tunnels: []*SSHTUN{a, b}, DisableExpvar: true}
+	tunnels.log = SetLogger(nil)
+	if err := tunnels.Start(context.Background(), "b"); !errors.Is(err, ErrNotRunning) {
+		t.Fatalf("expected %v before OpenAll, got: %v", ErrNotRunning, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opened := make(chan error, 1)
+	go func() {
+		opened <- tunnels.OpenAll(ctx)
+	}()
+	deadline := time.After(5 * time.Second)
+	for tunnels.Running() != 1 {
+		select {
+		case <-deadline:
+			t.Fatal("OpenAll did not start the enabled tunnel")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	if err := tunnels.Start(ctx, "a"); !errors.Is(err, ErrTunnelRunning) {
+		t.Errorf("expected %v, got: %v", ErrTunnelRunning, err)
+	}
+	if err := tunnels.Stop("b"); !errors.Is(err, ErrTunnelNotRunning) {
+		t.Errorf("expected %v, got: %v", ErrTunnelNotRunning, err)
+	}
+	if err := tunnels.Stop("c"); !errors.Is(err, ErrUnknownTunnel) {
+		t.Errorf("expected %v, got: %v", ErrUnknownTunnel, err)
+	}
+	if err := tunnels.Start(ctx, "b"); err != nil {
+		t.Fatalf("expected a disabled tunnel to start, got: %v", err)
+	}
+	if running := tunnels.Running(); running != 2 {
+		t.Errorf("expected 2 running tunnels, got %d", running)
+	}
+	if b.Enable {
+		t.Error("expected Start to leave the configuration unchanged")
+	}
+	if err := tunnels.Stop("b"); err != nil {
+		t.Fatalf("expected Stop to return nil, got: %v", err)
+	}
+	if running := tunnels.Running(); running != 1 {
+		t.Errorf("expected 1 running tunnel after Stop, got %d", running)
+	}
+	if b.localTUN != nil {
+		t.Error("expected Stop to close the local tun device")
+	}
+
+	// A tunnel started with a context ends with it.
+	b.localTUN, _ = fakeTUN(t)
+	startCtx, stop := context.WithCancel(ctx)
+	if err := tunnels.Start(startCtx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	stop()
+	for tunnels.Running() != 1 {
+		select {
+		case <-deadline:
+			t.Fatal("tunnel did not stop with its context")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if err := tunnels.Stop("b"); !errors.Is(err, ErrTunnelNotRunning) {
+		t.Errorf("expected %v, got: %v", ErrTunnelNotRunning, err)
+	}
+
+	cancel()
+	select {
+	case err := <-opened:
+		if err != nil {
+			t.Errorf("expected OpenAll to return nil, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OpenAll did not return")
+	}
+}
+
+func TestLogHelperLine(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewSecureShellTunneler(nil)
+	s.setLog(slog.New(slog.NewTextHandler(&buf, nil)))
+	for line, want := range map[string]string{
+		"FORWARD ok inet 0 1":                                                    "Remote IPv4 forwarding enabled (was 0)",
+		"FORWARD ok inet6 1 1":                                                   "Remote IPv6 forwarding already enabled",
+		"FORWARD err inet open /proc/sys: permission denied":                     "level=WARN msg=\"Unable to enable remote IPv4 forwarding\"",
+		"NAT ok 172.18.0.0/24 eth0 nft":                                          "Remote masquerading of 172.18.0.0/24 through eth0 (nft) enabled",
+		"NAT err 172.18.0.0/24 neither nft nor iptables found, required for nat": "error=\"neither nft nor iptables found",
+	} {
+		buf.Reset()
+		if !s.logHelperLine(line) {
+			t.Errorf("%q: expected a status line", line)
+		}
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("%q: expected %q in %q", line, want, buf.String())
+		}
+	}
+	if s.logHelperLine("FORWARD maybe inet") {
+		t.Error("expected an unknown FORWARD line not to be a status line")
+	}
+}
+
+func TestResolveTilde(t *testing.T) {
+	t.Setenv("HOME", "/home/tester")
+	usr, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, c := range []struct {
+		pth  string
+		want string
+	}{
+		{"~", "/home/tester"},
+		{"~/.ssh/id_ed25519", "/home/tester/.ssh/id_ed25519"},
+		{"~" + usr.Username, usr.HomeDir},
+		{"~" + usr.Username + "/.ssh/id_ed25519", filepath.Join(usr.HomeDir, ".ssh/id_ed25519")},
+		{"/etc/sshtun/config.json", "/etc/sshtun/config.json"},
+		{"relative/~/path", "relative/~/path"},
+	} {
+		got, err := ResolveTilde(c.pth)
+		if err != nil || got != c.want {
+			t.Errorf("%s: expected %s, got %s (%v)", c.pth, c.want, got, err)
+		}
+	}
+	const unknown = "~sshtun-no-such-user/.ssh/id_ed25519"
+	if _, err := ResolveTilde(unknown); !errors.Is(err, ErrUnresolvedTilde) {
+		t.Errorf("expected %v, got %v", ErrUnresolvedTilde, err)
+	}
+	if got := ResolveTildeSlash(unknown); got != unknown {
+		t.Errorf("expected %s unchanged, got %s", unknown, got)
+	}
+}
+
+func TestStdioConfig(t *testing.T) {
+	const config = `{"tunnels":[{"name":"office","remote":"vps.example.com:22","local_network":"172.18.0.1/24","remote_network":"172.18.0.2/24","keepalive_interval":"30s"}]}`
+	pth := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(pth, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer func(stdin, stdout *os.File) { os.Stdin, os.Stdout = stdin, stdout }(os.Stdin, os.Stdout)
+	pipe := func(input string) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			io.WriteString(w, input)
+			w.Close()
+		}()
+		os.Stdin = r
+	}
+
+	fromFile, err := LoadConfig(pth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipe(config)
+	fromStdin, err := LoadConfig(STDIO_CONFIG, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fromStdin.Tunnels[0].KeepaliveInterval != fromFile.Tunnels[0].KeepaliveInterval || fromStdin.Tunnels[0].RemoteSCP != USR_BIN_SCP {
+		t.Errorf("expected the same configuration from stdin as from file, got %+v", fromStdin.Tunnels[0])
+	}
+	if errFile, errStdin := fromFile.Validate(), fromStdin.Validate(); fmt.Sprint(errFile) != fmt.Sprint(errStdin) {
+		t.Errorf("expected the same validation from stdin as from file, got %v and %v", errStdin, errFile)
+	}
+
+	pipe(`{"tunnels":[{"name":"office","keepalive_interval":"often"}]}`)
+	if _, err := LoadConfig(STDIO_CONFIG, nil); err == nil || !strings.Contains(err.Error(), `invalid duration "often"`) {
+		t.Errorf("expected an invalid duration error, got %v", err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	saved := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(r)
+		saved <- b
+	}()
+	if err := fromStdin.SaveConfig(STDIO_CONFIG); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	b := <-saved
+	roundtrip, err := ReadConfig(bytes.NewReader(b), nil)
+	if err != nil {
+		t.Fatalf("unable to read the configuration written to stdout: %v\n%s", err, b)
+	}
+	if roundtrip.Tunnels[0].Name != "office" || roundtrip.Tunnels[0].KeepaliveInterval != fromFile.Tunnels[0].KeepaliveInterval {
+		t.Errorf("unexpected configuration written to stdout:\n%s", b)
+	}
+}
+
+func TestCreateFile(t *testing.T) {
+	defer syscall.Umask(syscall.Umask(022))
+	dir := t.TempDir()
+	for _, c := range []struct {
+		pth    string
+		create func(string) (*os.File, error)
+		want   os.FileMode
+	}{
+		{filepath.Join(dir, "private", "key"), func(pth string) (*os.File, error) { return CreateFile(pth, 0600) }, 0600},
+		{filepath.Join(dir, "default", "config.json"), CreateFileDefault, 0644},
+	} {
+		f, err := c.create(c.pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteString("written"); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		for pth, want := range map[string]os.FileMode{c.pth: c.want, filepath.Dir(c.pth): 0755} {
+			fi, err := os.Stat(pth)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != want {
+				t.Errorf("%s: expected mode %v, got %v", pth, want, fi.Mode().Perm())
+			}
+		}
+		if b, err := os.ReadFile(c.pth); err != nil || string(b) != "written" {
+			t.Errorf("%s: expected to read back what was written, got %q (%v)", c.pth, b, err)
+		}
+	}
+}
+
+func TestSCPUploadDetecting(t *testing.T) {
+	hp, err := sshtest.NewHoneyPot(
+		sshtest.WithExec("/usr/bin/scp -t", sshtest.ExecResult{ExitStatus: 127, Stderr: "sh: 1: /usr/bin/scp: not found"}),
+		sshtest.WithExec("command -v scp", sshtest.ExecResult{Stdout: "/run/current-system/sw/bin/scp\n"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hp.Close()
+	client, err := ssh.Dial("tcp", hp.Addr(), hp.ClientConfig("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	s := NewSecureShellTunneler(nil)
+	data := []byte("\x7fELF tunreadwriter")
+	for i := 0; i < 2; i++ {
+		if err := s.scpUploadDetecting(client, "/tmp", s.randomHelperName(), data, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(hp.Files()) != 2 {
+		t.Errorf("expected 2 files uploaded, got %d", len(hp.Files()))
+	}
+	if s.RemoteSCP != USR_BIN_SCP || s.detectedSCP != "/run/current-system/sw/bin/scp" {
+		t.Errorf("expected the detected scp to be remembered without changing remote_scp, got %s and %s", s.RemoteSCP, s.detectedSCP)
+	}
+	want := []string{"/usr/bin/scp -t /tmp", "command -v scp", "/run/current-system/sw/bin/scp -t /tmp", "/run/current-system/sw/bin/scp -t /tmp"}
+	if commands := hp.Commands(); strings.Join(commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected commands %q, got %q", want, commands)
+	}
+
+	s = NewSecureShellTunneler(nil)
+	s.RemoteSCP = "/opt/scp"
+	none, err := sshtest.NewHoneyPot(sshtest.WithExec("/opt/scp -t", sshtest.ExecResult{ExitStatus: 127, Stderr: "sh: 1: /opt/scp: not found"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer none.Close()
+	noneClient, err := ssh.Dial("tcp", none.Addr(), none.ClientConfig("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer noneClient.Close()
+	if err := s.scpUploadDetecting(noneClient, "/tmp", s.randomHelperName(), data, nil); !errors.Is(err, ErrSCPNotFound) || !strings.Contains(err.Error(), `"upload_method": "sftp"`) {
+		t.Errorf("expected %v suggesting sftp, got: %v", ErrSCPNotFound, err)
+	}
+}
+
+func TestOpenOnceSetupFailure(t *testing.T) {
+	privateKey, _, err := sshtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, privateKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	hp, err := sshtest.NewHoneyPot(
+		sshtest.WithExec("uname -m", sshtest.ExecResult{Stdout: "x86_64\n"}),
+		sshtest.WithScriptedHandler("/tmp/tunreadwriter-", func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+			io.WriteString(stderr, "unable to create tun device: operation not permitted\n")
+			return 1
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hp.Close()
+	s := NewSecureShellTunneler(nil)
+	s.Enable = true
+	s.Remote = hp.Addr()
+	s.RemoteUser = "root"
+	s.PrivateKeyFiles = PrivateKeyFiles{keyFile}
+	s.KeepaliveInterval = 0
+	uncompressed, restarts := false, 0
+	s.CompressUpload, s.RemoteHelperRestarts = &uncompressed, &restarts
+	s.localTUN, _ = fakeTUN(t)
+	s.retainTUN = true
+	tunnels := &Tunnels{Tunnels: []*SSHTUN{s}, DisableExpvar: true}
+	err = tunnels.OpenOnce(context.Background())
+	if !errors.Is(err, ErrRemoteSetupFailed) || !strings.Contains(err.Error(), "operation not permitted") {
+		t.Fatalf("expected %v with the helper output, got: %v", ErrRemoteSetupFailed, err)
+	}
+	if errors.Is(err, ErrDisconnected) {
+		t.Errorf("expected a tunnel that never came up not to be %v, got: %v", ErrDisconnected, err)
+	}
+}
+
+func TestHelperProtocolMismatch(t *testing.T) {
+	privateKey, _, err := sshtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, privateKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	helper, err := HelperForMachine("x86_64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name     string
+		sha256   string
+		uploads  int
+		replaced bool
+	}{
+		// A cached helper of another build is replaced once.
+		{"stale", strings.Repeat("0", 64), 2, true},
+		// Uploading the embedded helper again would not help.
+		{"embedded", helper.SHA256, 0, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var running atomic.Int32
+			hp, err := sshtest.NewHoneyPot(
+				sshtest.WithExec("uname -m", sshtest.ExecResult{Stdout: "x86_64\n"}),
+				sshtest.WithExec("test -f ", sshtest.ExecResult{Stdout: c.sha256 + "  tunreadwriter\n"}),
+				sshtest.WithScriptedHandler("/tmp/tunreadwriter-", func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+					running.Add(1)
+					defer running.Add(-1)
+					fmt.Fprintf(stdout, "%s %d tun9 1400\n", handshake.MAGIC, handshake.VERSION+1)
+					io.Copy(io.Discard, stdin)
+					return 0
+				}),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer hp.Close()
+			s := NewSecureShellTunneler(nil)
+			s.Remote = hp.Addr()
+			s.RemoteUser = "root"
+			s.PrivateKeyFiles = PrivateKeyFiles{keyFile}
+			s.KeepaliveInterval = 0
+			uncompressed, restarts := false, 0
+			s.CompressUpload, s.RemoteHelperRestarts = &uncompressed, &restarts
+			s.localTUN, _ = fakeTUN(t)
+			s.retainTUN = true
+			if err := s.Open(Context(context.Background())); !errors.Is(err, ErrHelperProtocol) {
+				t.Fatalf("expected %v, got: %v", ErrHelperProtocol, err)
+			}
+			if n := running.Load(); n != 0 {
+				t.Errorf("expected every incompatible helper to be stopped, %d still running", n)
+			}
+			if uploads := len(hp.Files()); uploads != c.uploads {
+				t.Errorf("expected %d uploads, got %d", c.uploads, uploads)
+			}
+			removed := false
+			for _, command := range hp.Commands() {
+				removed = removed || strings.HasPrefix(command, "rm -f ")
+			}
+			if removed != c.replaced {
+				t.Errorf("expected the cached helper to be removed %t, got %t: %q", c.replaced, removed, hp.Commands())
+			}
+		})
+	}
+}
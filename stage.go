@@ -0,0 +1,59 @@
+package sshtun
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	ErrStageTimeout error = errors.New("stage timed out")
+)
+
+const (
+	DEFAULT_UPLOAD_TIMEOUT time.Duration = 60 * time.Second
+	DEFAULT_START_TIMEOUT  time.Duration = 60 * time.Second
+
+	STAGE_UPLOAD string = "upload"
+	STAGE_START  string = "start"
+)
+
+// uploadTimeout returns UploadTimeout or DEFAULT_UPLOAD_TIMEOUT if not
+// set.
+func (s *SSHTUN) uploadTimeout() time.Duration {
+	if s.UploadTimeout == 0 {
+		return DEFAULT_UPLOAD_TIMEOUT
+	}
+	return time.Duration(s.UploadTimeout)
+}
+
+// startTimeout returns StartTimeout or DEFAULT_START_TIMEOUT if not
+// set.
+func (s *SSHTUN) startTimeout() time.Duration {
+	if s.StartTimeout == 0 {
+		return DEFAULT_START_TIMEOUT
+	}
+	return time.Duration(s.StartTimeout)
+}
+
+// stageTimer closes client if stop is not called within timeout,
+// aborting every session of a stuck stage. stop returns an error
+// wrapping ErrStageTimeout naming stage if the timer expired, else
+// nil.
+func stageTimer(client *ssh.Client, stage string, timeout time.Duration) (stop func() error) {
+	var expired atomic.Bool
+	timer := time.AfterFunc(timeout, func() {
+		expired.Store(true)
+		client.Close()
+	})
+	return func() error {
+		timer.Stop()
+		if expired.Load() {
+			return fmt.Errorf("%s %w after %s", stage, ErrStageTimeout, timeout)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,59 @@
+package sshtun
+
+import (
+	"expvar"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// EXPVAR_NAME is the expvar (/debug/vars) map of Tunnels.Status
+	// by tunnel name.
+	EXPVAR_NAME string = "sshtun"
+)
+
+// published is the Tunnels shown under EXPVAR_NAME, the last one
+// opened with DisableExpvar unset.
+var published = struct {
+	once    sync.Once
+	mutex   sync.Mutex
+	tunnels *Tunnels
+}{}
+
+// publishExpvar publishes the Status of t as EXPVAR_NAME (served by
+// net/http on /debug/vars) unless DisableExpvar is set. expvar is
+// global, only the Tunnels opened last is published.
+func (t *Tunnels) publishExpvar() {
+	if t.DisableExpvar {
+		return
+	}
+	published.mutex.Lock()
+	published.tunnels = t
+	published.mutex.Unlock()
+	published.once.Do(func() {
+		expvar.Publish(EXPVAR_NAME, expvar.Func(func() any {
+			published.mutex.Lock()
+			defer published.mutex.Unlock()
+			statuses := make(map[string]Status)
+			if published.tunnels != nil {
+				for _, status := range published.tunnels.Status() {
+					statuses[status.Name] = status
+				}
+			}
+			return statuses
+		}))
+	})
+}
+
+// countingWriter adds the number of bytes written to w to n.
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
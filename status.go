@@ -0,0 +1,145 @@
+package sshtun
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// State is the stage of a tunnel, see SSHTUN.Status.
+type State string
+
+const (
+	// STATE_IDLE is a tunnel not opened, or closed by its context.
+	STATE_IDLE State = "idle"
+	// STATE_DIALING is creating the local tun device and connecting
+	// to the remote.
+	STATE_DIALING State = "dialing"
+	// STATE_UPLOADING is uploading (or locating) the remote helper.
+	STATE_UPLOADING State = "uploading"
+	// STATE_STARTING is starting the remote helper.
+	STATE_STARTING State = "starting"
+	// STATE_CONNECTED is forwarding packets.
+	STATE_CONNECTED State = "connected"
+	// STATE_RECONNECTING is waiting to reconnect after the tunnel
+	// closed or failed to open.
+	STATE_RECONNECTING State = "reconnecting"
+	// STATE_FAILED is a tunnel that failed and is not retried.
+	STATE_FAILED State = "failed"
+)
+
+// Status is a snapshot of the state and counters of a tunnel.
+// ConnectedFor is how long the tunnel has been connected (0 unless
+// STATE_CONNECTED), Reconnects, HelperRestarts and the traffic
+// counters (RxBytes received from and TxBytes sent to the remote) are
+// counted since the tunnel was first opened. Forwards has the counters
+// of every forwarded port of a local-forward or remote-forward tunnel.
+// History has the last HISTORY_SIZE connection attempts, oldest first.
+// DNS is the DNS configuration applied while the tunnel is up (see
+// DNSServers), nil if none is. UploadDuration is how long the last
+// upload of the remote helper took, 0 until one is uploaded.
+type Status struct {
+	Name           string          `json:"name"`
+	State          State           `json:"state"`
+	Since          time.Time       `json:"since"`
+	ConnectedFor   Duration        `json:"connected_for"`
+	LastError      string          `json:"last_error,omitempty"`
+	Reconnects     int64           `json:"reconnects"`
+	HelperRestarts int64           `json:"helper_restarts"`
+	RxBytes        int64           `json:"rx_bytes"`
+	TxBytes        int64           `json:"tx_bytes"`
+	Forwards       []ForwardStatus `json:"forwards,omitempty"`
+	History        []Attempt       `json:"history,omitempty"`
+	DNS            *DNSStatus      `json:"dns,omitempty"`
+	UploadDuration Duration        `json:"upload_duration,omitempty"`
+}
+
+// setState changes the State of the tunnel, a change to the same
+// state keeps Since.
+func (s *SSHTUN) setState(state State) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	if s.state == state {
+		return
+	}
+	s.state = state
+	s.stateSince = time.Now()
+}
+
+// Status returns a snapshot of the state and counters of the tunnel,
+// safe to call while the tunnel is running.
+func (s *SSHTUN) Status() Status {
+	s.stateMutex.Lock()
+	status := Status{
+		Name:  s.Name,
+		State: s.state,
+		Since: s.stateSince,
+	}
+	s.stateMutex.Unlock()
+	if status.State == "" {
+		status.State = STATE_IDLE
+	}
+	if since := s.upSince.Load(); since != 0 && status.State == STATE_CONNECTED {
+		status.ConnectedFor = Duration(time.Since(time.Unix(0, since)))
+	}
+	if lastError, ok := s.lastError.Load().(string); ok {
+		status.LastError = lastError
+	}
+	status.Reconnects = s.reconnects.Load()
+	status.HelperRestarts = s.helperRestarts.Load()
+	status.RxBytes = s.rxBytes.Load()
+	status.TxBytes = s.txBytes.Load()
+	for _, f := range s.Forwards {
+		if f != nil {
+			status.Forwards = append(status.Forwards, f.Status())
+		}
+	}
+	status.History = s.history.list()
+	status.DNS = s.dns.Load()
+	status.UploadDuration = Duration(s.uploadDuration.Load())
+	return status
+}
+
+// Status returns the Status of every tunnel in configuration order.
+func (t *Tunnels) Status() []Status {
+	tunnels := t.snapshot()
+	statuses := make([]Status, 0, len(tunnels))
+	for _, tunnel := range tunnels {
+		statuses = append(statuses, tunnel.Status())
+	}
+	return statuses
+}
+
+// String describes status on one line, e.g office: connected for
+// 1h2m3s, dns 10.0.0.53 search corp.example (resolved on tun0).
+func (status Status) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %s", status.Name, status.State)
+	if status.State == STATE_CONNECTED {
+		fmt.Fprintf(&b, " for %s", time.Duration(status.ConnectedFor).Truncate(time.Second))
+	}
+	if status.LastError != "" && status.State != STATE_CONNECTED {
+		fmt.Fprintf(&b, ", last error: %s", status.LastError)
+	}
+	if status.DNS != nil {
+		fmt.Fprintf(&b, ", dns %s", status.DNS)
+	}
+	return b.String()
+}
+
+// StatusText returns the Status of the tunnel named name, or of every
+// tunnel if name is empty, one line per tunnel (see Status.String).
+func (t *Tunnels) StatusText(name string) (string, error) {
+	if name != "" {
+		tunnel, err := t.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		return tunnel.Status().String(), nil
+	}
+	var lines []string
+	for _, status := range t.Status() {
+		lines = append(lines, status.String())
+	}
+	return strings.Join(lines, "\n"), nil
+}
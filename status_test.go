@@ -0,0 +1,107 @@
+package sshtun
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatus(t *testing.T) {
+	s := NewSecureShellTunneler(nil)
+	if status := s.Status(); status.State != STATE_IDLE || !status.Since.IsZero() {
+		t.Errorf("expected a new tunnel to be idle, got %+v", status)
+	}
+	s.setState(STATE_DIALING)
+	since := s.Status().Since
+	s.setState(STATE_DIALING)
+	if s.Status().Since != since {
+		t.Error("expected setting the same state to keep since")
+	}
+
+	if err := s.Open(context.Background()); !errors.Is(err, ErrMissingContext) {
+		t.Fatalf("expected %v, got %v", ErrMissingContext, err)
+	}
+	status := s.Status()
+	if status.State != STATE_IDLE || status.LastError != ErrMissingContext.Error() || status.ConnectedFor != 0 {
+		t.Errorf("unexpected status after failed Open %+v", status)
+	}
+	if len(status.History) != 1 || status.History[0].Error != ErrMissingContext.Error() || status.History[0].Started.IsZero() || status.History[0].Uptime != 0 {
+		t.Errorf("expected the failed Open in the history, got %+v", status.History)
+	}
+
+	s.setState(STATE_CONNECTED)
+	s.upSince.Store(time.Now().Add(-time.Minute).UnixNano())
+	if status := s.Status(); status.ConnectedFor < Duration(time.Minute) {
+		t.Errorf("expected connected for at least 1m, got %s", time.Duration(status.ConnectedFor))
+	}
+	b, err := json.Marshal(s.Status())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"state":"connected"`) || !strings.Contains(string(b), `"connected_for":"1m0`) {
+		t.Errorf("unexpected json %s", string(b))
+	}
+}
+
+func TestStatusFailed(t *testing.T) {
+	s := NewSecureShellTunneler(nil)
+	s.Enable = true
+	s.Unprivileged = true
+	s.LocalTunDevice = "sshtunnotfound0"
+	s2 := NewSecureShellTunneler(nil)
+	s2.Name = "second"
+	s2.Enable = true
+	s2.Unprivileged = true
+	s2.LocalTunDevice = "sshtunnotfound1"
+	tunnels := &Tunnels{Tunnels: []*SSHTUN{s, s2}, DisableExpvar: true}
+	tunnels.log = SetLogger(nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := tunnels.OpenAll(ctx)
+	if ctx.Err() != nil {
+		t.Fatal("expected OpenAll to return when every tunnel gave up")
+	}
+	if !errors.Is(err, ErrNotProvisioned) {
+		t.Fatalf("expected OpenAll to return %v, got: %v", ErrNotProvisioned, err)
+	}
+	var tunnelErr *TunnelError
+	if !errors.As(err, &tunnelErr) || tunnelErr.Name != s.Name {
+		t.Errorf("expected a *TunnelError for %s first, got: %v", s.Name, err)
+	}
+	for _, name := range []string{s.Name, s2.Name} {
+		if !strings.Contains(err.Error(), "tunnel "+name+": ") {
+			t.Errorf("expected the error to list tunnel %s, got: %v", name, err)
+		}
+	}
+	statuses := tunnels.Status()
+	if len(statuses) != 2 {
+		t.Fatalf("expected 2 statuses, got %d", len(statuses))
+	}
+	if statuses[0].State != STATE_FAILED || !strings.Contains(statuses[0].LastError, ErrNotProvisioned.Error()) {
+		t.Errorf("expected an unprovisioned tunnel to fail, got %+v", statuses[0])
+	}
+}
+
+func TestHistory(t *testing.T) {
+	var h history
+	if attempts := h.list(); len(attempts) != 0 {
+		t.Fatalf("expected an empty history, got %+v", attempts)
+	}
+	start := time.Now()
+	for i := 0; i < HISTORY_SIZE+3; i++ {
+		h.add(Attempt{Started: start.Add(time.Duration(i) * time.Second), Error: fmt.Sprint(i)})
+	}
+	attempts := h.list()
+	if len(attempts) != HISTORY_SIZE {
+		t.Fatalf("expected %d attempts, got %d", HISTORY_SIZE, len(attempts))
+	}
+	for i, attempt := range attempts {
+		if want := fmt.Sprint(i + 3); attempt.Error != want {
+			t.Errorf("expected attempt %d to be %s (oldest first), got %s", i, want, attempt.Error)
+		}
+	}
+}
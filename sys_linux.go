@@ -0,0 +1,45 @@
+//go:build linux
+
+package sshtun
+
+import (
+	"errors"
+	"syscall"
+	"time"
+)
+
+const (
+	// tcpUserTimeout is TCP_USER_TIMEOUT from linux/tcp.h, missing
+	// in package syscall.
+	tcpUserTimeout int = 0x12
+
+	ipv6TClass int = syscall.IPV6_TCLASS
+)
+
+func setsockoptInt(fd uintptr, level, opt, value int) error {
+	return syscall.SetsockoptInt(int(fd), level, opt, value)
+}
+
+// setUserTimeout sets TCP_USER_TIMEOUT of the socket fd to d.
+func setUserTimeout(fd uintptr, d time.Duration) error {
+	return setsockoptInt(fd, syscall.IPPROTO_TCP, tcpUserTimeout, int(d.Milliseconds()))
+}
+
+// processRunning reports if a process with pid exists.
+func processRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+func seteuid(uid int) error {
+	return syscall.Seteuid(uid)
+}
+
+// umask sets the umask of the process to mask and returns the previous
+// one.
+func umask(mask int) int {
+	return syscall.Umask(mask)
+}
@@ -0,0 +1,61 @@
+//go:build windows
+
+package sshtun
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/sa6mwa/sshtun/pkg/tun"
+)
+
+const (
+	// tcpMaxRT is TCP_MAXRT from ws2ipdef.h, the closest to
+	// TCP_USER_TIMEOUT: the seconds a segment is retransmitted before
+	// the connection is dropped.
+	tcpMaxRT int = 5
+
+	// ipv6TClass is IPV6_TCLASS from ws2ipdef.h, missing in package
+	// syscall.
+	ipv6TClass int = 39
+)
+
+func setsockoptInt(fd uintptr, level, opt, value int) error {
+	return syscall.SetsockoptInt(syscall.Handle(fd), level, opt, value)
+}
+
+// setUserTimeout sets TCP_MAXRT of the socket fd to d, rounded down to
+// seconds (at least one).
+func setUserTimeout(fd uintptr, d time.Duration) error {
+	return setsockoptInt(fd, syscall.IPPROTO_TCP, tcpMaxRT, max(1, int(d/time.Second)))
+}
+
+// processRunning reports if a process with pid exists.
+func processRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
+// seteuid fails unless uid is the current (-1 on Windows): there are
+// no uids to switch between, an elevated process has the privileges
+// of root for as long as it runs.
+func seteuid(uid int) error {
+	if uid == os.Geteuid() {
+		return nil
+	}
+	return fmt.Errorf("seteuid %d: %w", uid, tun.ErrNotSupported)
+}
+
+// umask does nothing, Windows has no umask.
+func umask(mask int) int {
+	return 0
+}
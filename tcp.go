@@ -0,0 +1,67 @@
+package sshtun
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	DEFAULT_TCP_KEEPALIVE    time.Duration = 30 * time.Second
+	DEFAULT_TCP_USER_TIMEOUT time.Duration = 90 * time.Second
+)
+
+// tcpKeepalive returns TCPKeepalive or DEFAULT_TCP_KEEPALIVE if not
+// set.
+func (s *SSHTUN) tcpKeepalive() time.Duration {
+	if s.TCPKeepalive == 0 {
+		return DEFAULT_TCP_KEEPALIVE
+	}
+	return time.Duration(s.TCPKeepalive)
+}
+
+// tcpUserTimeout returns TCPUserTimeout or DEFAULT_TCP_USER_TIMEOUT
+// if not set.
+func (s *SSHTUN) tcpUserTimeout() time.Duration {
+	if s.TCPUserTimeout == 0 {
+		return DEFAULT_TCP_USER_TIMEOUT
+	}
+	return time.Duration(s.TCPUserTimeout)
+}
+
+// setTCPOptions enables TCP keepalive probes every tcpKeepalive and
+// sets TCP_USER_TIMEOUT on conn so that the kernel detects a dead
+// peer and fails pending writes after tcpUserTimeout instead of
+// retransmitting for 15+ minutes. Options the platform does not
+// support are logged and skipped, conn is left untouched if it is not
+// a TCP connection.
+func (s *SSHTUN) setTCPOptions(conn net.Conn) {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	keepalive, userTimeout := s.tcpKeepalive(), s.tcpUserTimeout()
+	if err := tcp.SetKeepAlive(true); err == nil {
+		if err := tcp.SetKeepAlivePeriod(keepalive); err != nil {
+			s.log().Debug("Unable to set TCP keepalive period", "name", s.Name, "remote", s.Remote, "error", err)
+		}
+	} else {
+		s.log().Debug("Unable to enable TCP keepalive", "name", s.Name, "remote", s.Remote, "error", err)
+	}
+	rc, err := tcp.SyscallConn()
+	if err != nil {
+		s.log().Debug("Unable to set TCP_USER_TIMEOUT", "name", s.Name, "remote", s.Remote, "error", err)
+		return
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = setUserTimeout(fd, userTimeout)
+	}); err != nil {
+		serr = err
+	}
+	if serr != nil {
+		s.log().Debug("Unable to set TCP_USER_TIMEOUT", "name", s.Name, "remote", s.Remote, "error", fmt.Errorf("setsockopt: %w", serr))
+		return
+	}
+	s.log().Debug("Applied TCP options", "name", s.Name, "remote", s.Remote, "tcp_keepalive", keepalive.String(), "tcp_user_timeout", userTimeout.String())
+}
@@ -0,0 +1,56 @@
+//go:build linux
+
+package sshtun
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSetTCPOptions(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s := NewSecureShellTunneler(nil)
+	s.TCPKeepalive = Duration(20 * time.Second)
+	s.TCPUserTimeout = Duration(45 * time.Second)
+	s.setTCPOptions(conn)
+
+	rc, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keepalive, idle, userTimeout int
+	var errs [3]error
+	rc.Control(func(fd uintptr) {
+		keepalive, errs[0] = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+		idle, errs[1] = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+		userTimeout, errs[2] = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout)
+	})
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if keepalive != 1 || idle != 20 {
+		t.Errorf("expected SO_KEEPALIVE 1 and TCP_KEEPIDLE 20, got %d and %d", keepalive, idle)
+	}
+	if userTimeout != 45000 {
+		t.Errorf("expected TCP_USER_TIMEOUT 45000 ms, got %d", userTimeout)
+	}
+	// Not a TCP connection, nothing to do.
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	s.setTCPOptions(a)
+}
@@ -0,0 +1,167 @@
+package sshtun
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Tunnel is a handle to a tunnel started with SSHTUN.Start, the
+// runtime state of the connection it was started for.
+type Tunnel struct {
+	s           *SSHTUN
+	once        sync.Once
+	up          chan struct{}
+	done        chan struct{}
+	err         error
+	remoteAddr  string
+	localDevice string
+	remoteTUN   string
+}
+
+// Start connects the tunnel like Open but returns as soon as the
+// remote helper has answered the handshake and data is being
+// forwarded. The returned Tunnel keeps running (retrying nothing,
+// exactly like Open) until it is closed, ctx is cancelled or the
+// connection is lost, see Tunnel.Wait. Returns the error of Open if
+// the tunnel never came up, an error wrapping ErrDisconnected if it
+// was closed before that. The tunnel runs in a new goroutine, use
+// Open from a goroutine locked to a thread in another network
+// namespace.
+func (s *SSHTUN) Start(ctx context.Context) (*Tunnel, error) {
+	t := s.start(ctx)
+	select {
+	case <-t.up:
+		return t, nil
+	case <-t.done:
+	}
+	select {
+	case <-t.up:
+		// Came up and went down again before Start noticed.
+		return t, nil
+	default:
+	}
+	if t.err != nil {
+		return nil, t.err
+	}
+	return nil, fmt.Errorf("%w: closed before coming up", ErrDisconnected)
+}
+
+// start runs Open in a new goroutine and returns its handle.
+func (s *SSHTUN) start(ctx context.Context) *Tunnel {
+	t := s.newTunnel()
+	go t.run(ctx)
+	return t
+}
+
+// newTunnel returns a new handle stored as the running tunnel of s.
+func (s *SSHTUN) newTunnel() *Tunnel {
+	t := &Tunnel{
+		s:    s,
+		up:   make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	s.handle.Store(t)
+	return t
+}
+
+// run runs the body of Open, recording its error, until the tunnel is
+// down.
+func (t *Tunnel) run(ctx context.Context) {
+	defer close(t.done)
+	t.err = t.s.run(ctx)
+	t.s.handle.CompareAndSwap(t, nil)
+}
+
+// Tunnel returns the handle of the running Open or Start, nil if the
+// tunnel is not running.
+func (s *SSHTUN) Tunnel() *Tunnel {
+	return s.handle.Load()
+}
+
+// markUp records the addresses of the connection once it is up and
+// releases Start. t may be nil if StartTunneling was called directly.
+func (t *Tunnel) markUp(s *SSHTUN) {
+	if t == nil {
+		return
+	}
+	t.once.Do(func() {
+		t.remoteAddr = s.remoteAddr
+		if !s.forwarding() {
+			t.localDevice = s.LocalTunDevice
+			t.remoteTUN = s.remoteHandshake.Device
+		}
+		close(t.up)
+	})
+}
+
+// Wait blocks until the tunnel is down and returns the error Open
+// would have returned, nil if closed by Close or ctx.
+func (t *Tunnel) Wait() error {
+	<-t.done
+	return t.err
+}
+
+// Done returns a channel closed when the tunnel is down.
+func (t *Tunnel) Done() <-chan struct{} {
+	return t.done
+}
+
+// Close stops the tunnel like SSHTUN.Close, Wait then returns nil.
+// Close does not wait for the tunnel to go down and does nothing if it
+// already has.
+func (t *Tunnel) Close() error {
+	select {
+	case <-t.done:
+		return nil
+	default:
+	}
+	if t.s.handle.Load() != t {
+		return nil
+	}
+	return t.s.Close()
+}
+
+// Stats returns the current Status of the tunnel: state, uptime,
+// reconnects, helper restarts and bytes received and sent.
+func (t *Tunnel) Stats() Status {
+	return t.s.Status()
+}
+
+// cameUp returns true once the tunnel has come up, also after it went
+// down again.
+func (t *Tunnel) cameUp() bool {
+	select {
+	case <-t.up:
+		return true
+	default:
+		return false
+	}
+}
+
+// LocalDevice returns the name of the local tun device, empty until
+// the tunnel is up.
+func (t *Tunnel) LocalDevice() string {
+	if !t.cameUp() {
+		return ""
+	}
+	return t.localDevice
+}
+
+// RemoteDevice returns the name of the remote tun device as reported
+// by the remote helper, empty until the tunnel is up.
+func (t *Tunnel) RemoteDevice() string {
+	if !t.cameUp() {
+		return ""
+	}
+	return t.remoteTUN
+}
+
+// RemoteAddr returns the address of the ssh server (the address the
+// remote resolved to), empty until the tunnel is up.
+func (t *Tunnel) RemoteAddr() string {
+	if !t.cameUp() {
+		return ""
+	}
+	return t.remoteAddr
+}
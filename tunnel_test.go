@@ -0,0 +1,79 @@
+//go:build linux
+
+package sshtun
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sa6mwa/sshtun/internal/pkg/handshake"
+	"github.com/sa6mwa/sshtun/pkg/sshtest"
+)
+
+func TestStart(t *testing.T) {
+	privateKey, _, err := sshtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, privateKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	hp, err := sshtest.NewHoneyPot(
+		sshtest.WithExec("uname -m", sshtest.ExecResult{Stdout: "x86_64\n"}),
+		sshtest.WithScriptedHandler("/tmp/tunreadwriter-", func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+			handshake.New("tun9", 1400, "inet").Write(stdout)
+			io.Copy(stdout, stdin)
+			return 0
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hp.Close()
+
+	s := NewSecureShellTunneler(nil)
+	s.Remote = "127.0.0.1:9"
+	s.RemoteUser = "root"
+	s.PrivateKeyFiles = PrivateKeyFiles{keyFile}
+	s.KeepaliveInterval = 0
+	uncompressed := false
+	s.CompressUpload = &uncompressed
+	s.localTUN, _ = fakeTUN(t)
+	s.retainTUN = true
+	if tunnel, err := s.Start(Context(context.Background())); tunnel != nil || !errors.Is(err, ErrConnectFailed) {
+		t.Fatalf("expected no handle and %v, got %v and: %v", ErrConnectFailed, tunnel, err)
+	}
+
+	s.Remote = hp.Addr()
+	tunnel, err := s.Start(Context(context.Background()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Tunnel() != tunnel {
+		t.Error("expected SSHTUN.Tunnel to return the running handle")
+	}
+	if tunnel.LocalDevice() != "faketun0" || tunnel.RemoteDevice() != "tun9" || tunnel.RemoteAddr() != hp.Addr() {
+		t.Errorf("unexpected handle %q %q %q", tunnel.LocalDevice(), tunnel.RemoteDevice(), tunnel.RemoteAddr())
+	}
+	if state := tunnel.Stats().State; state != STATE_CONNECTED {
+		t.Errorf("expected state %s, got %s", STATE_CONNECTED, state)
+	}
+	tunnel.Close()
+	select {
+	case <-tunnel.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel did not go down after Close")
+	}
+	if err := tunnel.Wait(); err != nil {
+		t.Errorf("expected Wait to return nil after Close, got: %v", err)
+	}
+	if s.Tunnel() != nil {
+		t.Error("expected no handle once the tunnel is down")
+	}
+}
@@ -0,0 +1,151 @@
+package sshtun
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/sa6mwa/sshtun/pkg/tun"
+)
+
+var (
+	ErrNotProvisioned     error = errors.New("tun device is not provisioned")
+	ErrNothingToProvision error = errors.New("no tunnel has unprivileged set")
+	ErrProvisionAsRoot    error = errors.New("provisioning tun devices requires root")
+)
+
+// openProvisionedTUN opens the pre-provisioned (persistent) tun device
+// LocalTunDevice of an unprivileged tunnel and verifies that it has
+// LocalNetwork (and LocalNetwork6 if set) and is up. No privileges
+// are needed as long as the device is owned by the calling user.
+// Errors wrap ErrNotProvisioned and explain how to provision the
+// device.
+func (s *SSHTUN) openProvisionedTUN() (*tun.TUN, error) {
+	s.log().Info(fmt.Sprintf("Opening provisioned TUN device %s", s.LocalTunDevice), "tun", s.LocalTunDevice, "name", s.Name, "net", s.LocalNetwork, "net6", s.LocalNetwork6)
+	localTUN, err := tun.OpenTUN(s.LocalTunDevice)
+	if err != nil {
+		if errors.Is(err, syscall.EACCES) {
+			return nil, fmt.Errorf("%w: unable to open %s (%w), it must be readable and writable by everyone (mode 0666)", ErrNotProvisioned, DEV_NET_TUN, err)
+		}
+		return nil, fmt.Errorf("%w: %w, %s", ErrNotProvisioned, err, s.provisionHint())
+	}
+	var missing []string
+	for _, address := range []string{s.LocalNetwork, s.LocalNetwork6} {
+		if address == "" {
+			continue
+		}
+		if ok, err := localTUN.HasAddress(address); err != nil {
+			localTUN.Close()
+			return nil, err
+		} else if !ok {
+			missing = append(missing, address)
+		}
+	}
+	if len(missing) > 0 {
+		localTUN.Close()
+		return nil, fmt.Errorf("%w: %s does not have address %s, %s", ErrNotProvisioned, s.LocalTunDevice, strings.Join(missing, " and "), s.provisionHint())
+	}
+	if up, err := localTUN.IsUp(); err != nil {
+		localTUN.Close()
+		return nil, err
+	} else if !up {
+		localTUN.Close()
+		return nil, fmt.Errorf("%w: %s is down, %s", ErrNotProvisioned, s.LocalTunDevice, s.provisionHint())
+	}
+	if mtu, err := localTUN.MTU(); err == nil && s.LocalMTU > 0 && mtu != s.LocalMTU {
+		s.log().Warn(fmt.Sprintf("TUN device %s has MTU %d, expected %d", s.LocalTunDevice, mtu, s.LocalMTU), "tun", s.LocalTunDevice, "name", s.Name, "mtu", mtu, "local_mtu", s.LocalMTU)
+	}
+	return localTUN, nil
+}
+
+// provisionHint returns instructions for provisioning LocalTunDevice
+// for the current user.
+func (s *SSHTUN) provisionHint() string {
+	username := strconv.Itoa(os.Getuid())
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+	commands := []string{
+		fmt.Sprintf("sudo ip tuntap add mode tun user %s name %s", username, s.LocalTunDevice),
+		fmt.Sprintf("sudo ip addr add %s dev %s", s.LocalNetwork, s.LocalTunDevice),
+	}
+	if s.LocalNetwork6 != "" {
+		commands = append(commands, fmt.Sprintf("sudo ip -6 addr add %s dev %s", s.LocalNetwork6, s.LocalTunDevice))
+	}
+	if s.LocalMTU > 0 {
+		commands = append(commands, fmt.Sprintf("sudo ip link set %s mtu %d up", s.LocalTunDevice, s.LocalMTU))
+	} else {
+		commands = append(commands, fmt.Sprintf("sudo ip link set %s up", s.LocalTunDevice))
+	}
+	return fmt.Sprintf("provision it with sudo sshtun -provision or: %s", strings.Join(commands, "; "))
+}
+
+// Provision creates the persistent tun device LocalTunDevice owned by
+// uid and gid, sets the MTU, configures LocalNetwork (and
+// LocalNetwork6) and links it up, so that an unprivileged tunnel can
+// open it later without any privileges. An existing device is
+// reconfigured. Requires CAP_NET_ADMIN.
+func (s *SSHTUN) Provision(uid, gid int) error {
+	s.log().Info(fmt.Sprintf("Provisioning TUN device %s with address %s and MTU %d for uid %d", s.LocalTunDevice, s.LocalNetwork, s.LocalMTU, uid), "tun", s.LocalTunDevice, "name", s.Name, "net", s.LocalNetwork, "net6", s.LocalNetwork6, "mtu", s.LocalMTU, "uid", uid, "gid", gid)
+	t, err := tun.CreateTUN(s.LocalTunDevice, s.LocalMTU, uid, gid)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+	if err := t.SetPersist(true); err != nil {
+		return err
+	}
+	if err := t.ConfigureAddress(s.LocalNetwork, s.localPeer()); err != nil {
+		return err
+	}
+	if s.LocalNetwork6 != "" {
+		if ok, err := t.HasAddress(s.LocalNetwork6); err != nil {
+			return err
+		} else if !ok {
+			if err := t.ConfigureInterface6(s.LocalNetwork6); err != nil {
+				return err
+			}
+		}
+	}
+	return t.LinkUp()
+}
+
+// Unprivileged returns true if every enabled tunnel is unprivileged,
+// i.e no privileges are needed to open them.
+func (t *Tunnels) Unprivileged() bool {
+	for _, tunnel := range t.snapshot() {
+		if t.enabled(tunnel) && !tunnel.Unprivileged {
+			return false
+		}
+	}
+	return true
+}
+
+// Provision provisions the tun device of every tunnel with
+// Unprivileged set (enabled or not) for uid and gid, see
+// SSHTUN.Provision. Returns ErrProvisionAsRoot unless running as root
+// and ErrNothingToProvision if no tunnel is unprivileged.
+func (t *Tunnels) Provision(uid, gid int) error {
+	if Privileges() != PRIVILEGES_ROOT {
+		return ErrProvisionAsRoot
+	}
+	var errs []error
+	provisioned := 0
+	for _, tunnel := range t.snapshot() {
+		if !tunnel.Unprivileged {
+			continue
+		}
+		provisioned++
+		if err := tunnel.Provision(uid, gid); err != nil {
+			errs = append(errs, fmt.Errorf("tunnel %s: %w", tunnel.Name, err))
+		}
+	}
+	if provisioned == 0 {
+		return ErrNothingToProvision
+	}
+	return errors.Join(errs...)
+}
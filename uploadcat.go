@@ -0,0 +1,63 @@
+package sshtun
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/alessio/shellescape"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// catStderrLimit is how much of the stderr of the remote shell
+	// pipeline catUpload keeps for the error, the rest is discarded.
+	catStderrLimit int = 4096
+)
+
+// cappedWriter keeps the first limit bytes written to it and discards
+// the rest without failing the writer.
+type cappedWriter struct {
+	buf   bytes.Buffer
+	limit int
+}
+
+func (c *cappedWriter) Write(p []byte) (int, error) {
+	if room := c.limit - c.buf.Len(); room > 0 {
+		c.buf.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
+
+func (c *cappedWriter) String() string {
+	return strings.TrimSpace(c.buf.String())
+}
+
+// catUpload streams data to cat > pth in a shell on the remote, makes
+// it executable and verifies that its sha256sum is sum, for busybox
+// remotes (OpenWrt) with neither scp nor an sftp subsystem. progress
+// counts the bytes sent (nil for none). On failure the file is
+// removed.
+func catUpload(client *ssh.Client, pth string, data []byte, sum string, progress *uploadProgress) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	var stdout bytes.Buffer
+	stderr := &cappedWriter{limit: catStderrLimit}
+	session.Stdin = progress.reader(bytes.NewReader(data))
+	session.Stdout = &stdout
+	session.Stderr = stderr
+	quoted := shellescape.Quote(pth)
+	if err := session.Run(fmt.Sprintf("umask 077; cat > %s && chmod 0755 %s && sha256sum %s", quoted, quoted, quoted)); err != nil {
+		sshrun(client, "rm -f "+quoted)
+		return &uploadError{err: fmt.Errorf("%w: %s", err, stderr), stderr: stderr.String()}
+	}
+	uploaded, _, _ := strings.Cut(strings.TrimSpace(stdout.String()), " ")
+	if uploaded != sum {
+		sshrun(client, "rm -f "+quoted)
+		return fmt.Errorf("%w: %s has sha256 %s, expected %s", ErrChecksumMismatch, pth, uploaded, sum)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package sshtun
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/sa6mwa/sshtun/pkg/sshtest"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCatUpload(t *testing.T) {
+	data := bytes.Repeat([]byte("\x7fELF tunreadwriter"), 1000)
+	sum := sha256.Sum256(data)
+	helper := &Helper{Arch: "amd64", Binary: data, SHA256: hex.EncodeToString(sum[:])}
+	var received []byte
+	hp, err := sshtest.NewHoneyPot(
+		sshtest.WithExec("/usr/bin/scp -t", sshtest.ExecResult{ExitStatus: 127, Stderr: "sh: /usr/bin/scp: not found"}),
+		sshtest.WithExec("command -v scp", sshtest.ExecResult{ExitStatus: 1}),
+		sshtest.WithScriptedHandler("umask 077; cat > ", func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+			received, _ = io.ReadAll(stdin)
+			if strings.Contains(command, "full") {
+				io.WriteString(stderr, strings.Repeat("cat: write error: No space left on device\n", 1000))
+				return 1
+			}
+			sum := sha256.Sum256(received)
+			if strings.Contains(command, "corrupt") {
+				sum = sha256.Sum256(nil)
+			}
+			io.WriteString(stdout, hex.EncodeToString(sum[:])+"  /tmp/tunreadwriter\n")
+			return 0
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hp.Close()
+	client, err := ssh.Dial("tcp", hp.Addr(), hp.ClientConfig("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	s := NewSecureShellTunneler(nil)
+	method, err := s.uploadWith(client, UPLOAD_AUTO, "/tmp", "tunreadwriter-x y", helper, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method != UPLOAD_CAT || !bytes.Equal(received, data) {
+		t.Errorf("expected %d bytes uploaded with cat, got %d with %s", len(data), len(received), method)
+	}
+	if commands := hp.Commands(); len(commands) == 0 || commands[len(commands)-1] != "umask 077; cat > '/tmp/tunreadwriter-x y' && chmod 0755 '/tmp/tunreadwriter-x y' && sha256sum '/tmp/tunreadwriter-x y'" {
+		t.Errorf("expected a quoted cat pipeline last, got %q", commands)
+	}
+
+	err = catUpload(client, "/tmp/corrupt", data, helper.SHA256, nil)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected %v, got %v", ErrChecksumMismatch, err)
+	}
+	err = catUpload(client, "/tmp/full", data, helper.SHA256, nil)
+	var uerr *uploadError
+	if !errors.As(err, &uerr) || !retryableUploadError(err) {
+		t.Fatalf("expected a retryable upload error, got %v", err)
+	}
+	if len(uerr.stderr) > catStderrLimit || !strings.HasPrefix(uerr.stderr, "cat: write error: No space left on device") {
+		t.Errorf("expected at most %d bytes of stderr, got %d", catStderrLimit, len(uerr.stderr))
+	}
+	if commands := hp.Commands(); commands[len(commands)-1] != "rm -f /tmp/full" {
+		t.Errorf("expected the partial file to be removed, got %q", commands)
+	}
+}
@@ -0,0 +1,103 @@
+package sshtun
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// UPLOAD_PROGRESS_INTERVAL is how often the progress of a helper
+	// upload is logged, the first time once the upload has taken that
+	// long, so a fast upload logs no progress at all. A stuck upload is
+	// aborted by upload_timeout.
+	UPLOAD_PROGRESS_INTERVAL time.Duration = 5 * time.Second
+)
+
+// uploadProgressInterval is UPLOAD_PROGRESS_INTERVAL, changed by
+// tests.
+var uploadProgressInterval = UPLOAD_PROGRESS_INTERVAL
+
+// uploadProgress counts the bytes of a helper upload to pth of size
+// bytes and logs the progress every uploadProgressInterval. A nil
+// uploadProgress counts nothing.
+type uploadProgress struct {
+	s     *SSHTUN
+	pth   string
+	size  int64
+	start time.Time
+	sent  atomic.Int64
+	last  atomic.Int64
+}
+
+// newUploadProgress starts counting an upload of size bytes to pth.
+func (s *SSHTUN) newUploadProgress(pth string, size int) *uploadProgress {
+	p := &uploadProgress{s: s, pth: pth, size: int64(size), start: time.Now()}
+	p.last.Store(p.start.UnixNano())
+	return p
+}
+
+// add counts n bytes sent and logs the progress if
+// uploadProgressInterval has passed since the start or the last time
+// it was logged.
+func (p *uploadProgress) add(n int) {
+	if p == nil {
+		return
+	}
+	sent := p.sent.Add(int64(n))
+	last := p.last.Load()
+	now := time.Now()
+	if now.Sub(time.Unix(0, last)) < uploadProgressInterval || !p.last.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	percent := int64(100)
+	if p.size > 0 && sent < p.size {
+		percent = sent * 100 / p.size
+	}
+	elapsed := now.Sub(p.start).Truncate(time.Second)
+	p.s.log().Info(fmt.Sprintf("Uploading tunreadwriter to ssh://%s: %d%% (%d of %d bytes) in %s", p.s.Remote, percent, min(sent, p.size), p.size, elapsed), "name", p.s.Name, "remote", p.s.Remote, "tunreadwriter", p.pth, "sent", min(sent, p.size), "size", p.size, "elapsed", elapsed, "upload_timeout", p.s.uploadTimeout())
+}
+
+// done returns how long the upload took.
+func (p *uploadProgress) done() time.Duration {
+	return time.Since(p.start)
+}
+
+// reader returns r counting every byte read from it as sent.
+func (p *uploadProgress) reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &progressReader{r: r, p: p}
+}
+
+// writer returns w counting every byte written to it as sent.
+func (p *uploadProgress) writer(w io.Writer) io.Writer {
+	if p == nil {
+		return w
+	}
+	return &progressWriter{w: w, p: p}
+}
+
+type progressReader struct {
+	r io.Reader
+	p *uploadProgress
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	pr.p.add(n)
+	return n, err
+}
+
+type progressWriter struct {
+	w io.Writer
+	p *uploadProgress
+}
+
+func (pw *progressWriter) Write(b []byte) (int, error) {
+	n, err := pw.w.Write(b)
+	pw.p.add(n)
+	return n, err
+}
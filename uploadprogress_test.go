@@ -0,0 +1,77 @@
+package sshtun
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sa6mwa/sshtun/pkg/sshtest"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestUploadProgress(t *testing.T) {
+	defer func(interval time.Duration) { uploadProgressInterval = interval }(uploadProgressInterval)
+	uploadProgressInterval = 20 * time.Millisecond
+	var buf bytes.Buffer
+	s := NewSecureShellTunneler(slog.New(slog.NewJSONHandler(&buf, nil)))
+	p := s.newUploadProgress("/tmp/tunreadwriter", 1000)
+	start := time.Now()
+	r := p.reader(&slowReader{r: bytes.NewReader(make([]byte, 1000)), chunk: 100, delay: 5 * time.Millisecond})
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+	if p.sent.Load() != 1000 {
+		t.Errorf("expected 1000 bytes sent, got %d", p.sent.Load())
+	}
+	elapsed := time.Since(start)
+	lines := strings.Count(buf.String(), `"msg":"Uploading tunreadwriter to ssh://`)
+	if lines == 0 || lines > int(elapsed/uploadProgressInterval) {
+		t.Errorf("expected progress logged at most every %s, got %d lines:\n%s", uploadProgressInterval, lines, buf.String())
+	}
+	if !strings.Contains(buf.String(), `% (`) || !strings.Contains(buf.String(), ` of 1000 bytes) in `) {
+		t.Errorf("expected percentage and bytes in the progress, got:\n%s", buf.String())
+	}
+
+	uploadProgressInterval = time.Hour
+	hp, err := sshtest.NewHoneyPot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hp.Close()
+	client, err := ssh.Dial("tcp", hp.Addr(), hp.ClientConfig("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	buf.Reset()
+	s.UploadMethod = UPLOAD_SCP
+	disabled := false
+	s.CompressUpload = &disabled
+	if err := s.uploadHelper(client, "/tmp", s.randomHelperName(), &Helper{Arch: "amd64", Binary: []byte("\x7fELF tunreadwriter")}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), `% (`) {
+		t.Errorf("expected no progress for a fast upload, got:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), `"msg":"Uploaded tunreadwriter (linux/amd64)`) || !strings.Contains(buf.String(), `"upload_duration":`) {
+		t.Errorf("expected the upload duration logged, got:\n%s", buf.String())
+	}
+	if s.Status().UploadDuration <= 0 {
+		t.Errorf("expected the upload duration in the status, got %s", time.Duration(s.Status().UploadDuration))
+	}
+}
+
+// slowReader reads at most chunk bytes from r per Read after delay.
+type slowReader struct {
+	r     io.Reader
+	chunk int
+	delay time.Duration
+}
+
+func (s *slowReader) Read(b []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.r.Read(b[:min(len(b), s.chunk)])
+}
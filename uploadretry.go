@@ -0,0 +1,94 @@
+package sshtun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// UPLOAD_RETRIES is how many times a failed upload of the helper is
+	// retried on the same connection before the tunnel reconnects, after
+	// 2, 4 and 8 seconds.
+	UPLOAD_RETRIES int = 3
+)
+
+var (
+	// uploadRetryDelay is the delay before the first retry, doubled for
+	// every following retry, changed by tests.
+	uploadRetryDelay = 2 * time.Second
+)
+
+// uploadError is a failed upload command with what the remote wrote to
+// stderr.
+type uploadError struct {
+	err    error
+	stderr string
+}
+
+func (e *uploadError) Error() string {
+	return e.err.Error()
+}
+
+func (e *uploadError) Unwrap() error {
+	return e.err
+}
+
+// retryableUploadError returns true if err from UploadHelperToRemote
+// may pass on another attempt over the same connection: a session that
+// could not be opened (e.g sshd MaxSessions reached) or a remote
+// command exiting with status 1 (e.g a full upload directory). A
+// missing scp, permission denied, a read-only file system, an unknown
+// architecture or a connection that is gone is not.
+func retryableUploadError(err error) bool {
+	if errors.Is(err, ErrSCPNotFound) {
+		return false
+	}
+	var openErr *ssh.OpenChannelError
+	if errors.As(err, &openErr) {
+		return true
+	}
+	var exitErr *ssh.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 1 {
+		return false
+	}
+	for _, permanent := range []string{"Permission denied", "Read-only file system"} {
+		if strings.Contains(err.Error(), permanent) {
+			return false
+		}
+	}
+	return true
+}
+
+// uploadHelperRetrying runs UploadHelperToRemote to RemoteUploadDirectory
+// and retries a retryableUploadError up to UPLOAD_RETRIES times on the
+// same client, with a doubling delay, instead of failing the tunnel.
+// Every retry is logged with the attempt and the stderr of the remote.
+// Returns the last error, also when ctx is done while waiting.
+func (s *SSHTUN) uploadHelperRetrying(ctx context.Context, client *ssh.Client) error {
+	delay := uploadRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := s.UploadHelperToRemote(client, s.RemoteUploadDirectory)
+		if err == nil || attempt > UPLOAD_RETRIES || !retryableUploadError(err) {
+			return err
+		}
+		var stderr string
+		var uerr *uploadError
+		if errors.As(err, &uerr) {
+			stderr = uerr.stderr
+		}
+		s.log().Warn(fmt.Sprintf("Upload of tunreadwriter to ssh://%s failed, retrying in %s", s.Remote, delay), "name", s.Name, "remote", s.Remote, "attempt", attempt, "max_attempts", UPLOAD_RETRIES+1, "stderr", stderr, "error", err)
+		tmr := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			tmr.Stop()
+			return err
+		case <-tmr.C:
+		}
+		delay *= 2
+	}
+}
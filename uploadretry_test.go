@@ -0,0 +1,117 @@
+package sshtun
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sa6mwa/sshtun/pkg/sshtest"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestUploadHelperRetrying(t *testing.T) {
+	defer func(delay time.Duration) { uploadRetryDelay = delay }(uploadRetryDelay)
+	uploadRetryDelay = time.Millisecond
+	for _, c := range []struct {
+		name     string
+		failures int32
+		stderr   string
+		attempts int32
+		fails    bool
+	}{
+		{"transient", 2, "scp: /tmp/tunreadwriter: No space left on device", 3, false},
+		{"persistent", 10, "scp: /tmp/tunreadwriter: No space left on device", int32(UPLOAD_RETRIES) + 1, true},
+		{"permanent", 10, "scp: /tmp: Permission denied", 1, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			hp, err := sshtest.NewHoneyPot(
+				sshtest.WithExec("uname -m", sshtest.ExecResult{Stdout: "x86_64\n"}),
+				sshtest.WithScriptedHandler("/usr/bin/scp -t", func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+					io.Copy(io.Discard, stdin)
+					if attempts.Add(1) <= c.failures {
+						io.WriteString(stderr, c.stderr)
+						return 1
+					}
+					return 0
+				}),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer hp.Close()
+			client, err := ssh.Dial("tcp", hp.Addr(), hp.ClientConfig("test"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			var buf bytes.Buffer
+			s := NewSecureShellTunneler(slog.New(slog.NewJSONHandler(&buf, nil)))
+			s.UploadMethod = UPLOAD_SCP
+			disabled := false
+			s.CompressUpload, s.RemoteCacheHelper = &disabled, &disabled
+			err = s.uploadHelperRetrying(context.Background(), client)
+			if got := attempts.Load(); got != c.attempts {
+				t.Errorf("expected %d attempts, got %d", c.attempts, got)
+			}
+			if c.fails != (err != nil) {
+				t.Fatalf("expected failure %t, got: %v", c.fails, err)
+			}
+			if err != nil && !errors.Is(err, ErrHelperUploadFailed) {
+				t.Errorf("expected %v, got: %v", ErrHelperUploadFailed, err)
+			}
+			if retries := strings.Count(buf.String(), `"msg":"Upload of tunreadwriter`); retries != int(c.attempts)-1 {
+				t.Errorf("expected %d retries logged, got %d:\n%s", c.attempts-1, retries, buf.String())
+			}
+			if c.attempts > 1 && (!strings.Contains(buf.String(), `"attempt":1`) || !strings.Contains(buf.String(), `"stderr":"`+c.stderr+`"`)) {
+				t.Errorf("expected the attempt and stderr in the log, got:\n%s", buf.String())
+			}
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	hp, err := sshtest.NewHoneyPot(
+		sshtest.WithExec("uname -m", sshtest.ExecResult{Stdout: "x86_64\n"}),
+		sshtest.WithExec("/usr/bin/scp -t", sshtest.ExecResult{ExitStatus: 1, Stderr: "scp: /tmp: No space left on device"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hp.Close()
+	client, err := ssh.Dial("tcp", hp.Addr(), hp.ClientConfig("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	s := NewSecureShellTunneler(nil)
+	s.UploadMethod = UPLOAD_SCP
+	disabled := false
+	s.CompressUpload = &disabled
+	uploadRetryDelay = time.Hour
+	if err := s.uploadHelperRetrying(ctx, client); err == nil || !strings.Contains(err.Error(), "No space left") {
+		t.Errorf("expected the upload error once ctx is done, got: %v", err)
+	}
+}
+
+func TestRetryableUploadError(t *testing.T) {
+	if !retryableUploadError(&ssh.OpenChannelError{Reason: ssh.Prohibited, Message: "open failed"}) {
+		t.Error("expected a session that could not be opened to be retryable")
+	}
+	for _, err := range []error{
+		ErrSCPNotFound,
+		errors.New("EOF"),
+		ErrUnsupportedArchitecture,
+	} {
+		if retryableUploadError(err) {
+			t.Errorf("expected %v not to be retryable", err)
+		}
+	}
+}
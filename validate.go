@@ -0,0 +1,396 @@
+package sshtun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ifNameSize is IFNAMSIZ from linux/if.h, the size of a device name
+// including the terminating NUL.
+const ifNameSize int = 16
+
+var (
+	ErrInvalidConfig error = errors.New("invalid configuration")
+)
+
+// sudoWord matches a word of remote_sudo_command that needs no shell
+// quoting, e.g sudo, -u, tunneluser or /usr/bin/doas.
+var sudoWord = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// Validate checks the configuration of every tunnel and that tunnel
+// names are unique. Returns nil if all tunnels are valid, otherwise
+// an errors.Join of all problems found, one *TunnelError per problem
+// of a named tunnel.
+func (t *Tunnels) Validate() error {
+	var errs []error
+	seen := make(map[string]bool)
+	for _, tunnel := range t.snapshot() {
+		if tunnel == nil {
+			errs = append(errs, fmt.Errorf("%w: null tunnel in configuration", ErrInvalidConfig))
+			continue
+		}
+		if seen[tunnel.Name] {
+			errs = append(errs, &TunnelError{Name: tunnel.Name, Err: fmt.Errorf("%w: duplicate name", ErrInvalidConfig)})
+		}
+		seen[tunnel.Name] = true
+		if err := tunnel.Validate(); err != nil {
+			errs = append(errs, &TunnelError{Name: tunnel.Name, Err: err})
+		}
+	}
+	if t.AddressPool != "" {
+		if _, err := t.addressPool(); err != nil {
+			errs = append(errs, fmt.Errorf("%w: address_pool: %w", ErrInvalidConfig, err))
+		}
+	}
+	if t.DebugListen != "" {
+		if err := CheckDebugListen(t.DebugListen, t.DebugAllowRemote); err != nil {
+			errs = append(errs, fmt.Errorf("%w: debug_listen: %w", ErrInvalidConfig, err))
+		}
+	}
+	if t.AuditLogMaxSize < 0 {
+		errs = append(errs, fmt.Errorf("%w: audit_log_max_size must not be negative", ErrInvalidConfig))
+	}
+	return errors.Join(errs...)
+}
+
+// Validate checks the tunnel configuration for errors without
+// touching the network or requiring privileges. Returns an
+// errors.Join of all problems found or nil.
+func (s *SSHTUN) Validate() error {
+	var errs []error
+	invalid := func(format string, a ...any) {
+		errs = append(errs, fmt.Errorf("%w: tunnel %q: %s", ErrInvalidConfig, s.Name, fmt.Sprintf(format, a...)))
+	}
+	if s.Name == "" {
+		invalid("name is empty")
+	}
+	switch s.Protocol {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		invalid("protocol %q is not one of tcp, tcp4 or tcp6", s.Protocol)
+	}
+	switch s.tunnelType() {
+	case TYPE_TUN:
+		if len(s.Forwards) > 0 {
+			invalid("forwards requires type %s or %s", TYPE_LOCAL_FORWARD, TYPE_REMOTE_FORWARD)
+		}
+	case TYPE_LOCAL_FORWARD, TYPE_REMOTE_FORWARD:
+		if len(s.Forwards) == 0 {
+			invalid("type %s requires at least one forward", s.Type)
+		}
+		if s.Role != "" || s.serverPolicy() || s.DefaultRoute {
+			invalid("role, default_route and server_* options require type %s", TYPE_TUN)
+		}
+		if s.RemoteMasquerade || s.RemoteEnableForwarding {
+			invalid("remote_masquerade and remote_enable_forwarding require type %s", TYPE_TUN)
+		}
+		if len(s.DNSServers) > 0 || len(s.DNSSearch) > 0 {
+			invalid("dns_servers and dns_search require type %s", TYPE_TUN)
+		}
+		if s.DeviceType != "" || s.bridging() {
+			invalid("device_type, local_bridge and remote_bridge require type %s", TYPE_TUN)
+		}
+		for i, f := range s.Forwards {
+			if f == nil {
+				invalid("forwards[%d] is null", i)
+				continue
+			}
+			if _, _, err := net.SplitHostPort(f.Listen); err != nil {
+				invalid("forwards[%d].listen: %v", i, err)
+			}
+			if _, _, err := net.SplitHostPort(f.Target); err != nil {
+				invalid("forwards[%d].target: %v", i, err)
+			}
+		}
+	default:
+		invalid("type %q is not one of %s, %s or %s", s.Type, TYPE_TUN, TYPE_LOCAL_FORWARD, TYPE_REMOTE_FORWARD)
+	}
+	// Port forwards have no tun device.
+	if !s.forwarding() {
+		// A bridged end has no addresses of its own.
+		for _, f := range [][3]string{{"local_network", s.LocalNetwork, s.LocalBridge}, {"remote_network", s.RemoteNetwork, s.RemoteBridge}} {
+			if f[2] != "" {
+				continue
+			}
+			ip, _, err := net.ParseCIDR(f[1])
+			if err != nil {
+				invalid("%s: %v", f[0], err)
+			} else if ip.To4() == nil {
+				invalid("%s %q is not an IPv4 address", f[0], f[1])
+			}
+		}
+		for _, f := range [][2]string{{"local_network6", s.LocalNetwork6}, {"remote_network6", s.RemoteNetwork6}} {
+			if f[1] == "" {
+				continue
+			}
+			ip, _, err := net.ParseCIDR(f[1])
+			if err != nil {
+				invalid("%s: %v", f[0], err)
+			} else if ip.To4() != nil {
+				invalid("%s %q is not an IPv6 address", f[0], f[1])
+			}
+		}
+		if (s.LocalNetwork6 == "") != (s.RemoteNetwork6 == "") && !s.bridging() {
+			invalid("local_network6 and remote_network6 must both be set for IPv6")
+		}
+		if _, err := s.ValidateAddressing(); err != nil {
+			errs = append(errs, err)
+		}
+		for _, f := range [][2]string{{"local_tun_device", s.LocalTunDevice}, {"remote_tun_device", s.RemoteTunDevice}} {
+			if len(f[1]) >= ifNameSize {
+				invalid("%s %q is longer than %d characters", f[0], f[1], ifNameSize-1)
+			}
+		}
+		if s.Unprivileged && (s.LocalTunDevice == "" || strings.Contains(s.LocalTunDevice, "%")) {
+			invalid("unprivileged requires local_tun_device to name the provisioned device, got %q", s.LocalTunDevice)
+		}
+		for _, route := range s.RemoteRoutes {
+			if ip, _, err := net.ParseCIDR(route); err != nil {
+				invalid("remote_routes: %v", err)
+			} else if ip.To4() == nil {
+				invalid("remote_routes: %q is not an IPv4 network", route)
+			}
+		}
+		if s.RemoteRouteVia != "" && net.ParseIP(s.RemoteRouteVia).To4() == nil {
+			invalid("remote_route_via %q is not an IPv4 address", s.RemoteRouteVia)
+		}
+		switch s.DeviceType {
+		case "", DEVICE_TUN, DEVICE_TAP:
+		default:
+			invalid("device_type %q is not one of %s or %s", s.DeviceType, DEVICE_TUN, DEVICE_TAP)
+		}
+		if s.bridging() && !s.tap() {
+			invalid("local_bridge and remote_bridge require device_type %s", DEVICE_TAP)
+		}
+		for _, f := range [][2]string{{"local_bridge", s.LocalBridge}, {"remote_bridge", s.RemoteBridge}} {
+			if len(f[1]) >= ifNameSize {
+				invalid("%s %q is longer than %d characters", f[0], f[1], ifNameSize-1)
+			}
+		}
+		if s.LocalTunOwner != "" {
+			if _, _, err := lookupOwner(s.LocalTunOwner); err != nil {
+				invalid("local_tun_owner: %v", err)
+			}
+		}
+		if s.LocalTunGroup != "" {
+			if _, err := lookupGroup(s.LocalTunGroup); err != nil {
+				invalid("local_tun_group: %v", err)
+			}
+		}
+		if s.Unprivileged && (s.LocalTunOwner != "" || s.LocalTunGroup != "") {
+			invalid("local_tun_owner and local_tun_group have no effect with unprivileged, the device is provisioned for the user of sshtun")
+		}
+		if s.tap() && s.Unprivileged {
+			invalid("unprivileged only supports device_type %s", DEVICE_TUN)
+		}
+		if s.tap() && s.HealthCheck != nil {
+			invalid("health_check requires device_type %s", DEVICE_TUN)
+		}
+		switch s.Role {
+		case "", ROLE_CLIENT, ROLE_SERVER:
+		default:
+			invalid("role %q is not one of %s or %s", s.Role, ROLE_CLIENT, ROLE_SERVER)
+		}
+		for _, route := range s.ServerRoutes {
+			if ip, _, err := net.ParseCIDR(route); err != nil {
+				invalid("server_routes: %v", err)
+			} else if ip.To4() == nil {
+				invalid("server_routes: %q is not an IPv4 network", route)
+			}
+		}
+		for i, server := range s.DNSServers {
+			if net.ParseIP(server) == nil {
+				invalid("dns_servers[%d]: %q is not an IP address", i, server)
+			}
+		}
+		for i, domain := range s.DNSSearch {
+			if domain == "" || strings.ContainsAny(domain, " \t\r\n") {
+				invalid("dns_search[%d]: %q is not a domain", i, domain)
+			}
+		}
+		if s.Unprivileged && s.localPolicy() {
+			invalid("unprivileged can not apply the %s side server_* options or default_route locally", s.role())
+		}
+		if s.RemoteMasquerade && (s.LocalNetwork == "" || s.LocalBridge != "") {
+			invalid("remote_masquerade requires local_network without local_bridge")
+		}
+		if s.RemoteMasquerade && s.ServerNAT && s.role() == ROLE_CLIENT {
+			invalid("remote_masquerade and server_nat both masquerade the local network on the remote, use one")
+		}
+		if s.DefaultRoute && s.ServerDefaultRoute && s.role() == ROLE_SERVER {
+			invalid("default_route with server_default_route and role %s routes both ends through each other", ROLE_SERVER)
+		}
+	}
+	if s.LocalMTU < 0 {
+		invalid("local_mtu can not be negative")
+	}
+	if s.RemoteMTU < 0 {
+		invalid("remote_mtu can not be negative")
+	}
+	if _, _, err := net.SplitHostPort(s.Remote); err != nil {
+		invalid("remote: %v", err)
+	}
+	if s.RemoteUser == "" {
+		invalid("remote_user is empty")
+	}
+	if !s.UseSSHAgent && len(s.PrivateKeyFiles) == 0 {
+		invalid("use_ssh_agent is false and private_key_files is empty")
+	}
+	if s.RemoteSudoCommand != nil {
+		for _, word := range strings.Fields(*s.RemoteSudoCommand) {
+			if !sudoWord.MatchString(word) {
+				invalid("remote_sudo_command %q contains shell metacharacters, only plain words are allowed", *s.RemoteSudoCommand)
+				break
+			}
+		}
+	}
+	for i, arg := range s.RemoteHelperExtraArgs {
+		if strings.ContainsAny(arg, "\x00\r\n") {
+			invalid("remote_helper_extra_args[%d] %q contains a NUL or newline character", i, arg)
+		}
+	}
+	if s.RemoteUploadDirectory != "" && !strings.HasPrefix(s.RemoteUploadDirectory, "/") {
+		invalid("remote_upload_directory %q is not an absolute path", s.RemoteUploadDirectory)
+	}
+	if s.RemoteHelperPath != "" && !strings.HasPrefix(s.RemoteHelperPath, "/") {
+		invalid("remote_helper_path %q is not an absolute path", s.RemoteHelperPath)
+	}
+	switch s.UploadMethod {
+	case "", UPLOAD_SCP, UPLOAD_SFTP, UPLOAD_CAT, UPLOAD_AUTO, UPLOAD_MEMFD:
+	default:
+		invalid("upload_method %q is not one of scp, sftp, cat, memfd or auto", s.UploadMethod)
+	}
+	if s.UploadMethod == UPLOAD_MEMFD && len(s.sudoCommand()) > 0 && !s.MemfdSudoPython {
+		invalid("upload_method memfd runs python3 through %s which requires a sudoers entry allowing python3 (full root access), set memfd_sudo_python to accept that", strings.Join(s.sudoCommand(), " "))
+	}
+	if s.LogLevel != "" {
+		if _, err := parseLogLevel(s.LogLevel); err != nil {
+			invalid("log_level %q is not one of DEBUG, INFO, WARN or ERROR", s.LogLevel)
+		}
+	}
+	if s.RemoteHelperRestarts != nil && *s.RemoteHelperRestarts < 0 {
+		invalid("remote_helper_restarts can not be negative")
+	}
+	if s.RemoteStatsInterval < 0 {
+		invalid("remote_stats_interval can not be negative")
+	}
+	if s.RemoteIdleExit < 0 {
+		invalid("remote_idle_exit can not be negative")
+	}
+	if s.KeepaliveInterval < 0 {
+		invalid("keepalive_interval can not be negative")
+	}
+	if s.KeepaliveTimeout < 0 {
+		invalid("keepalive_timeout can not be negative")
+	}
+	if s.StableUptime < 0 {
+		invalid("stable_uptime can not be negative")
+	}
+	if s.MaxReconnectAttempts < 0 {
+		invalid("max_reconnect_attempts can not be negative")
+	}
+	if s.TCPKeepalive < 0 {
+		invalid("tcp_keepalive can not be negative")
+	}
+	if s.TCPUserTimeout < 0 {
+		invalid("tcp_user_timeout can not be negative")
+	}
+	if s.TransportTOS < 0 || s.TransportTOS > 255 {
+		invalid("transport_tos must be between 0 and 255")
+	}
+	if s.CopyDSCP < 0 || s.CopyDSCP > 63 {
+		invalid("copy_dscp must be a DSCP between 0 (off) and 63")
+	}
+	if s.CopyDSCP != 0 && s.tap() {
+		invalid("copy_dscp requires device_type %s", DEVICE_TUN)
+	}
+	if s.WindowSize < 0 || s.WindowSize > MAX_WINDOW_SIZE {
+		invalid("window_size must be between 0 and %d bytes", MAX_WINDOW_SIZE)
+	}
+	if s.UploadTimeout < 0 {
+		invalid("upload_timeout can not be negative")
+	}
+	if s.StartTimeout < 0 {
+		invalid("start_timeout can not be negative")
+	}
+	if s.HealthCheck != nil {
+		if s.HealthCheck.Interval < 0 {
+			invalid("health_check.interval can not be negative")
+		}
+		if s.HealthCheck.MaxMisses < 0 {
+			invalid("health_check.max_misses can not be negative")
+		}
+	}
+	if s.KeepaliveMaxErrorCount < 0 {
+		invalid("keepalive_max_error_count can not be negative")
+	}
+	for _, setting := range s.unsupportedSettings() {
+		invalid("%s is not supported on %s", setting, runtime.GOOS)
+	}
+	return errors.Join(errs...)
+}
+
+// CheckPrivateKeys verifies that every file in PrivateKeyFiles exists
+// and can be parsed as an un-encrypted private key. Keys protected
+// by a passphrase are reported as errors as Dial can not use them.
+func (s *SSHTUN) CheckPrivateKeys() error {
+	if s.UseSSHAgent {
+		if os.Getenv(SSH_AUTH_SOCK) == "" {
+			return ErrEmptySshAuthSock
+		}
+		return nil
+	}
+	var errs []error
+	for _, pk := range s.PrivateKeyFiles {
+		pth, err := ResolveTilde(pk)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		pemBytes, err := os.ReadFile(pth)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if _, err := ssh.ParsePrivateKey(pemBytes); err != nil {
+			var passphraseMissing *ssh.PassphraseMissingError
+			if errors.As(err, &passphraseMissing) {
+				errs = append(errs, fmt.Errorf("%s: key is encrypted with a passphrase", pk))
+				continue
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", pk, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ResolveRemote looks up the host part of Remote in DNS.
+func (s *SSHTUN) ResolveRemote(ctx context.Context) error {
+	host, _, err := net.SplitHostPort(s.Remote)
+	if err != nil {
+		return err
+	}
+	if _, err := net.DefaultResolver.LookupHost(ctx, host); err != nil {
+		return err
+	}
+	return nil
+}
+
+// CheckConnect dials Remote and performs the SSH handshake including
+// authentication, then closes the connection. No TUN device is
+// created and no privileges are required.
+func (s *SSHTUN) CheckConnect(ctx context.Context) error {
+	client, err := s.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	return client.Close()
+}
@@ -0,0 +1,9 @@
+//go:build linux
+
+package sshtun
+
+// unsupportedSettings returns the settings of s this platform can not
+// apply locally, none on Linux.
+func (s *SSHTUN) unsupportedSettings() []string {
+	return nil
+}
@@ -0,0 +1,212 @@
+package sshtun
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	newValid := func() *SSHTUN {
+		s := NewSecureShellTunneler(nil)
+		s.RemoteUser = "abc123"
+		return s
+	}
+	valid := newValid()
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("expected default configuration to be valid, got: %v", err)
+	}
+
+	cases := []struct {
+		name   string
+		modify func(s *SSHTUN)
+		want   string
+	}{
+		{"empty name", func(s *SSHTUN) { s.Name = "" }, "name is empty"},
+		{"bad protocol", func(s *SSHTUN) { s.Protocol = "udp" }, "protocol"},
+		{"bad local network", func(s *SSHTUN) { s.LocalNetwork = "172.18.0.1" }, "local_network"},
+		{"ipv6 remote network", func(s *SSHTUN) { s.RemoteNetwork = "fd00::1/64" }, "not an IPv4 address"},
+		{"long device", func(s *SSHTUN) { s.LocalTunDevice = "abcdefghijklmnop" }, "local_tun_device"},
+		{"missing port", func(s *SSHTUN) { s.Remote = "localhost" }, "remote:"},
+		{"no keys", func(s *SSHTUN) { s.PrivateKeyFiles = nil }, "private_key_files is empty"},
+		{"negative mtu", func(s *SSHTUN) { s.RemoteMTU = -1 }, "remote_mtu"},
+		{"sudo metacharacters", func(s *SSHTUN) { sudo := "sudo; rm -rf /"; s.RemoteSudoCommand = &sudo }, "remote_sudo_command"},
+		{"ipv4 network6", func(s *SSHTUN) { s.LocalNetwork6, s.RemoteNetwork6 = "172.18.0.1/24", "fd00::2/64" }, "local_network6 \"172.18.0.1/24\" is not an IPv6 address"},
+		{"one sided network6", func(s *SSHTUN) { s.RemoteNetwork6 = "fd00::2/64" }, "must both be set"},
+		{"bad remote route", func(s *SSHTUN) { s.RemoteRoutes = []string{"10.0.0.0"} }, "remote_routes"},
+		{"relative upload directory", func(s *SSHTUN) { s.RemoteUploadDirectory = "tmp" }, "remote_upload_directory"},
+		{"bad upload method", func(s *SSHTUN) { s.UploadMethod = "ftp" }, "upload_method"},
+		{"memfd through sudo", func(s *SSHTUN) { s.UploadMethod = UPLOAD_MEMFD }, "memfd_sudo_python"},
+		{"unprivileged device pattern", func(s *SSHTUN) { s.Unprivileged, s.LocalTunDevice = true, "tun%d" }, "unprivileged"},
+		{"negative keepalive timeout", func(s *SSHTUN) { s.KeepaliveTimeout = -1 }, "keepalive_timeout"},
+		{"negative health check interval", func(s *SSHTUN) { s.HealthCheck = &HealthCheck{Interval: -1} }, "health_check.interval"},
+		{"negative tcp user timeout", func(s *SSHTUN) { s.TCPUserTimeout = -1 }, "tcp_user_timeout"},
+		{"window size too large", func(s *SSHTUN) { s.WindowSize = MAX_WINDOW_SIZE + 1 }, "window_size"},
+		{"transport tos beyond a byte", func(s *SSHTUN) { s.TransportTOS = 256 }, "transport_tos"},
+		{"copy dscp beyond six bits", func(s *SSHTUN) { s.CopyDSCP = 64 }, "copy_dscp"},
+		{"copy dscp on tap", func(s *SSHTUN) { s.CopyDSCP, s.DeviceType = 46, DEVICE_TAP }, "copy_dscp"},
+		{"bad log level", func(s *SSHTUN) { s.LogLevel = "LOUD" }, "log_level"},
+		{"negative stable uptime", func(s *SSHTUN) { s.StableUptime = -1 }, "stable_uptime"},
+		{"negative upload timeout", func(s *SSHTUN) { s.UploadTimeout = -1 }, "upload_timeout"},
+		{"negative start timeout", func(s *SSHTUN) { s.StartTimeout = -1 }, "start_timeout"},
+		{"negative max reconnect attempts", func(s *SSHTUN) { s.MaxReconnectAttempts = -1 }, "max_reconnect_attempts"},
+		{"negative helper restarts", func(s *SSHTUN) { restarts := -1; s.RemoteHelperRestarts = &restarts }, "remote_helper_restarts"},
+		{"relative helper path", func(s *SSHTUN) { s.RemoteHelperPath = "sshtun-helper" }, "remote_helper_path"},
+		{"bad type", func(s *SSHTUN) { s.Type = "socks" }, "type \"socks\""},
+		{"forward without forwards", func(s *SSHTUN) { s.Type = TYPE_LOCAL_FORWARD }, "at least one forward"},
+		{"forwards on tun", func(s *SSHTUN) { s.Forwards = []*Forward{{Listen: "127.0.0.1:8080", Target: "10.0.0.1:80"}} }, "forwards requires type"},
+		{"bad forward target", func(s *SSHTUN) {
+			s.Type, s.Forwards = TYPE_REMOTE_FORWARD, []*Forward{{Listen: "127.0.0.1:8080", Target: "10.0.0.1"}}
+		}, "forwards[0].target"},
+		{"bad role", func(s *SSHTUN) { s.Role = "peer" }, "role \"peer\""},
+		{"bad server route", func(s *SSHTUN) { s.ServerRoutes = []string{"fd00::/64"} }, "server_routes"},
+		{"unprivileged server nat", func(s *SSHTUN) { s.Unprivileged, s.Role, s.ServerNAT = true, ROLE_SERVER, true }, "unprivileged can not apply the server side"},
+		{"unprivileged default route", func(s *SSHTUN) { s.Unprivileged, s.DefaultRoute = true, true }, "or default_route locally"},
+		{"default route both ends", func(s *SSHTUN) { s.Role, s.ServerDefaultRoute, s.DefaultRoute = ROLE_SERVER, true, true }, "both ends through each other"},
+		{"remote masquerade with server nat", func(s *SSHTUN) { s.RemoteMasquerade, s.ServerNAT = true, true }, "use one"},
+		{"remote masquerade without local network", func(s *SSHTUN) { s.RemoteMasquerade, s.LocalNetwork = true, "" }, "remote_masquerade requires local_network"},
+		{"remote enable forwarding on forward", func(s *SSHTUN) {
+			s.Type, s.RemoteEnableForwarding, s.Forwards = TYPE_LOCAL_FORWARD, true, []*Forward{{Listen: "127.0.0.1:8080", Target: "10.0.0.1:80"}}
+		}, "remote_enable_forwarding require type"},
+		{"bad dns server", func(s *SSHTUN) { s.DNSServers = []string{"10.0.0.53", "ns.corp.example"} }, "dns_servers[1]"},
+		{"bad dns search", func(s *SSHTUN) { s.DNSSearch = []string{"corp.example home.example"} }, "dns_search[0]"},
+		{"bad device type", func(s *SSHTUN) { s.DeviceType = "tin" }, "device_type \"tin\""},
+		{"bridge on tun", func(s *SSHTUN) { s.LocalBridge = "br0" }, "require device_type tap"},
+		{"long bridge", func(s *SSHTUN) { s.DeviceType, s.RemoteBridge = DEVICE_TAP, "br-abcdefghijklmnop" }, "remote_bridge"},
+		{"unprivileged tap", func(s *SSHTUN) { s.DeviceType, s.Unprivileged = DEVICE_TAP, true }, "unprivileged only supports"},
+		{"tap health check", func(s *SSHTUN) { s.DeviceType, s.HealthCheck = DEVICE_TAP, &HealthCheck{} }, "health_check requires"},
+		{"unknown local tun owner", func(s *SSHTUN) { s.LocalTunOwner = "sshtun-no-such-user" }, "local_tun_owner"},
+		{"unknown local tun group", func(s *SSHTUN) { s.LocalTunGroup = "sshtun-no-such-group" }, "local_tun_group"},
+		{"negative local tun group", func(s *SSHTUN) { s.LocalTunGroup = "-1" }, "local_tun_group"},
+		{"unprivileged local tun owner", func(s *SSHTUN) { s.Unprivileged, s.LocalTunOwner = true, "0" }, "no effect with unprivileged"},
+		{"newline in helper extra args", func(s *SSHTUN) { s.RemoteHelperExtraArgs = []string{"-route", "10.0.0.0/8\nreboot"} }, "remote_helper_extra_args[1]"},
+		{"role on forward", func(s *SSHTUN) {
+			s.Type, s.Role, s.Forwards = TYPE_LOCAL_FORWARD, ROLE_SERVER, []*Forward{{Listen: "127.0.0.1:8080", Target: "10.0.0.1:80"}}
+		}, "role, default_route and server_* options require type"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newValid()
+			c.modify(s)
+			err := s.Validate()
+			if !errors.Is(err, ErrInvalidConfig) {
+				t.Fatalf("expected ErrInvalidConfig, got: %v", err)
+			}
+			if !strings.Contains(err.Error(), c.want) {
+				t.Errorf("expected error to contain %q, got: %v", c.want, err)
+			}
+		})
+	}
+
+	tunnels := &Tunnels{Tunnels: []*SSHTUN{valid, newValid()}}
+	if err := tunnels.Validate(); err == nil || !strings.Contains(err.Error(), "duplicate name") {
+		t.Errorf("expected duplicate name error, got: %v", err)
+	}
+}
+
+func TestCheckPrivateKeys(t *testing.T) {
+	s := NewSecureShellTunneler(nil)
+	s.PrivateKeyFiles = PrivateKeyFiles{filepath.Join(t.TempDir(), "missing")}
+	if err := s.CheckPrivateKeys(); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist, got: %v", err)
+	}
+	garbage := filepath.Join(t.TempDir(), "garbage")
+	if err := os.WriteFile(garbage, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s.PrivateKeyFiles = PrivateKeyFiles{garbage}
+	if err := s.CheckPrivateKeys(); err == nil {
+		t.Error("expected error parsing garbage key file")
+	}
+}
+
+func TestValidateForward(t *testing.T) {
+	s := NewSecureShellTunneler(nil)
+	s.RemoteUser = "abc123"
+	s.Type = TYPE_LOCAL_FORWARD
+	s.Forwards = []*Forward{{Listen: "127.0.0.1:8080", Target: "10.0.0.1:80"}}
+	// A port forward has no tun device to validate.
+	s.LocalNetwork, s.LocalTunDevice = "", "abcdefghijklmnop"
+	if err := s.Validate(); err != nil {
+		t.Errorf("expected a local-forward without tun configuration to be valid, got: %v", err)
+	}
+}
+
+func TestValidateBridge(t *testing.T) {
+	s := NewSecureShellTunneler(nil)
+	s.RemoteUser = "abc123"
+	s.DeviceType = DEVICE_TAP
+	s.LocalBridge, s.RemoteBridge = "br0", "br-lan"
+	// Bridged ends take no addresses.
+	s.LocalNetwork, s.RemoteNetwork = "", ""
+	if err := s.Validate(); err != nil {
+		t.Errorf("expected a bridged tap tunnel without networks to be valid, got: %v", err)
+	}
+	s.RemoteBridge = ""
+	if err := s.Validate(); err == nil || !strings.Contains(err.Error(), "remote_network") {
+		t.Errorf("expected remote_network to be required without remote_bridge, got: %v", err)
+	}
+}
+
+func TestValidateAddressing(t *testing.T) {
+	cases := []struct {
+		local, remote string
+		want          string
+		warning       string
+	}{
+		{"172.18.0.1/24", "172.18.0.2/24", "", ""},
+		{"10.0.0.0/31", "10.0.0.1/31", "", ""},
+		{"fd00::1/64", "fd00::2/64", "", ""},
+		{"172.18.0.1/24", "172.19.0.2/24", "not in the same subnet", ""},
+		{"172.18.0.1/24", "172.18.0.1/24", "have the same address", ""},
+		{"172.18.0.0/24", "172.18.0.2/24", "local_network 172.18.0.0/24 is the network address", ""},
+		{"172.18.0.1/24", "172.18.0.255/24", "remote_network 172.18.0.255/24 is the broadcast address", ""},
+		{"172.18.0.1/32", "172.18.0.2/32", "", ""},
+		{"10.9.1.1/32", "10.9.2.1/32", "", ""},
+		{"10.9.1.1/32", "10.9.1.1/32", "have the same address", ""},
+		{"fd00::1/128", "fd00::2/64", "local_network6 fd00::1/128 is a single address", ""},
+		{"172.18.0.1/16", "172.18.0.2/24", "", "different prefix lengths"},
+		{"198.51.100.1/30", "198.51.100.2/30", "", "not a private address"},
+		{"100.64.0.1/30", "100.64.0.2/30", "", ""},
+	}
+	for _, c := range cases {
+		s := NewSecureShellTunneler(nil)
+		s.RemoteUser = "abc123"
+		if strings.Contains(c.local, ":") {
+			s.LocalNetwork6, s.RemoteNetwork6 = c.local, c.remote
+		} else {
+			s.LocalNetwork, s.RemoteNetwork = c.local, c.remote
+		}
+		warnings, err := s.ValidateAddressing()
+		if c.want == "" && err != nil {
+			t.Errorf("%s %s: expected no error, got: %v", c.local, c.remote, err)
+		} else if c.want != "" && (!errors.Is(err, ErrInvalidConfig) || !strings.Contains(err.Error(), c.want) || !strings.Contains(err.Error(), `tunnel "example"`)) {
+			t.Errorf("%s %s: expected an error containing %q, got: %v", c.local, c.remote, c.want, err)
+		}
+		if c.want != "" && !errors.Is(s.Validate(), ErrInvalidConfig) {
+			t.Errorf("%s %s: expected Validate to fail", c.local, c.remote)
+		}
+		joined := strings.Join(warnings, "\n")
+		if c.warning == "" && len(warnings) > 0 {
+			t.Errorf("%s %s: expected no warnings, got %q", c.local, c.remote, warnings)
+		} else if c.warning != "" && (!strings.Contains(joined, c.warning) || !strings.Contains(joined, `tunnel "example"`)) {
+			t.Errorf("%s %s: expected a warning containing %q, got %q", c.local, c.remote, c.warning, warnings)
+		}
+	}
+
+	s := NewSecureShellTunneler(nil)
+	s.DeviceType = DEVICE_TAP
+	s.LocalNetwork, s.RemoteNetwork = "10.9.1.1/32", "10.9.2.1/32"
+	if _, err := s.ValidateAddressing(); !errors.Is(err, ErrInvalidConfig) || !strings.Contains(err.Error(), "is a single address") {
+		t.Errorf("expected a /32 on a tap device to be refused, got: %v", err)
+	}
+
+	s = NewSecureShellTunneler(nil)
+	s.DeviceType, s.LocalBridge = DEVICE_TAP, "br0"
+	s.RemoteNetwork = "10.0.0.1/24"
+	if warnings, err := s.ValidateAddressing(); err != nil || len(warnings) > 0 {
+		t.Errorf("expected a bridged tunnel not to be checked, got %q and %v", warnings, err)
+	}
+}
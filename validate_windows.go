@@ -0,0 +1,40 @@
+//go:build windows
+
+package sshtun
+
+import (
+	"strings"
+)
+
+// unsupportedSettings returns the settings of s this platform can not
+// apply locally. On Windows the local device is a wintun adapter
+// (layer 3 only) created in-process, routing policy and DNS are left
+// to the administrator.
+func (s *SSHTUN) unsupportedSettings() []string {
+	if s.forwarding() {
+		return nil
+	}
+	var settings []string
+	if s.LocalTunDevice == "" || strings.Contains(s.LocalTunDevice, "%") {
+		settings = append(settings, "local_tun_device without a fixed name")
+	}
+	if s.tap() {
+		settings = append(settings, "device_type "+DEVICE_TAP)
+	}
+	if s.LocalBridge != "" {
+		settings = append(settings, "local_bridge")
+	}
+	if s.LocalTunOwner != "" {
+		settings = append(settings, "local_tun_owner")
+	}
+	if s.Unprivileged {
+		settings = append(settings, "unprivileged")
+	}
+	if s.localPolicy() {
+		settings = append(settings, "routing policy (default_route, server_routes, server_default_route, server_forward, server_nat)")
+	}
+	if len(s.DNSServers) > 0 || len(s.DNSSearch) > 0 {
+		settings = append(settings, "DNS (dns_servers, dns_search)")
+	}
+	return settings
+}